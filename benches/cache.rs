@@ -0,0 +1,65 @@
+//! Render latency with and without a resource cache.
+//!
+//! ```sh
+//! cargo bench --bench cache
+//! # also measure font parsing with an embedded Helvetica replacement:
+//! FORGE_BENCH_FONT=/path/to/font.ttf cargo bench --bench cache
+//! ```
+//!
+//! Uses `std::time::Instant` rather than a benchmark harness to keep the
+//! dev-dependency list empty.
+
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use base64::{engine::general_purpose::STANDARD as BASE64_STD, Engine as _};
+use pdf_forge::cache::LruCache;
+use pdf_forge::pipeline::{generate, PipelineConfig};
+
+const ITERATIONS: u32 = 20;
+
+/// A template with one large photo-like PNG, as in a logo-heavy letterhead.
+fn template() -> String {
+    let img = image::RgbImage::from_fn(1024, 1024, |x, y| {
+        image::Rgb([(x % 251) as u8, (y % 241) as u8, ((x ^ y) % 239) as u8])
+    });
+    let mut png = std::io::Cursor::new(Vec::new());
+    img.write_to(&mut png, image::ImageFormat::Png)
+        .expect("encode PNG");
+    let src = format!("data:image/png;base64,{}", BASE64_STD.encode(png.into_inner()));
+    format!(
+        r#"<h1>Quarterly report</h1>
+<img src="{src}" style="width: 200px; height: 200px" />
+<p>Revenue grew in every region.</p>"#
+    )
+}
+
+fn average(html: &str, config: &PipelineConfig) -> Duration {
+    // Warm up (and fill the cache, if any).
+    generate(html, config).expect("render");
+    let start = Instant::now();
+    for _ in 0..ITERATIONS {
+        generate(html, config).expect("render");
+    }
+    start.elapsed() / ITERATIONS
+}
+
+fn main() {
+    let html = template();
+    let mut config = PipelineConfig::default();
+    if let Ok(path) = std::env::var("FORGE_BENCH_FONT") {
+        config.base_font = Some(std::fs::read(&path).expect("read FORGE_BENCH_FONT"));
+        config.embed_base_fonts = true;
+    }
+
+    let uncached = average(&html, &config);
+    let cached = average(&html, &config.clone().with_cache(Arc::new(LruCache::default())));
+
+    println!("renders per run:  {ITERATIONS}");
+    println!("without cache:    {uncached:?} / render");
+    println!("with LruCache:    {cached:?} / render");
+    println!(
+        "speed-up:         {:.1}x",
+        uncached.as_secs_f64() / cached.as_secs_f64()
+    );
+}
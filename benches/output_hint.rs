@@ -0,0 +1,78 @@
+//! Reallocations of the output buffer with and without a size hint.
+//!
+//! ```sh
+//! cargo bench --bench output_hint
+//! ```
+//!
+//! Counts `realloc` calls and the bytes they had to carry over with a
+//! counting global allocator, for a large document that is post-processed
+//! (`optimize`), so the final buffer is the one the hint sizes.
+
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+use pdf_forge::pipeline::{generate, PipelineConfig};
+
+struct Counting;
+
+static REALLOCS: AtomicUsize = AtomicUsize::new(0);
+static REALLOC_BYTES: AtomicUsize = AtomicUsize::new(0);
+
+unsafe impl GlobalAlloc for Counting {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        System.alloc(layout)
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        System.dealloc(ptr, layout)
+    }
+
+    unsafe fn realloc(&self, ptr: *mut u8, layout: Layout, new_size: usize) -> *mut u8 {
+        REALLOCS.fetch_add(1, Ordering::Relaxed);
+        REALLOC_BYTES.fetch_add(layout.size(), Ordering::Relaxed);
+        System.realloc(ptr, layout, new_size)
+    }
+}
+
+#[global_allocator]
+static ALLOCATOR: Counting = Counting;
+
+/// A long table, a few hundred pages once rendered.
+fn template() -> String {
+    let rows: String = (0..6000)
+        .map(|i| format!("<tr><td>Item {i}</td><td>{}.00</td></tr>", i * 7 % 1000))
+        .collect();
+    format!(
+        "<h1>Ledger</h1><table><thead><tr><th>Item</th><th>Amount</th></tr></thead>{rows}</table>"
+    )
+}
+
+/// `(reallocs, bytes carried over, output size)` for one render.
+fn measure(html: &str, config: &PipelineConfig) -> (usize, usize, usize) {
+    REALLOCS.store(0, Ordering::Relaxed);
+    REALLOC_BYTES.store(0, Ordering::Relaxed);
+    let pdf = generate(html, config).expect("render");
+    (
+        REALLOCS.load(Ordering::Relaxed),
+        REALLOC_BYTES.load(Ordering::Relaxed),
+        pdf.bytes.len(),
+    )
+}
+
+fn main() {
+    let html = template();
+    let config = PipelineConfig::default().with_optimize(true);
+
+    let (reallocs, moved, size) = measure(&html, &config);
+    let hinted = config.clone().with_output_size_hint(size + size / 16);
+    let (hinted_reallocs, hinted_moved, _) = measure(&html, &hinted);
+
+    println!("output size:      {size} bytes");
+    println!("without hint:     {reallocs} reallocs, {moved} bytes carried over");
+    println!("with hint:        {hinted_reallocs} reallocs, {hinted_moved} bytes carried over");
+    println!(
+        "saved:            {} reallocs, {} bytes",
+        reallocs.saturating_sub(hinted_reallocs),
+        moved.saturating_sub(hinted_moved)
+    );
+}
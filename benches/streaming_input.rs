@@ -0,0 +1,120 @@
+//! Peak memory of parsing a large document from one buffer and from a reader.
+//!
+//! ```sh
+//! cargo bench --bench streaming_input
+//! ```
+//!
+//! Tracks the high-water mark of live heap bytes with a counting global
+//! allocator.  The buffered path holds the whole source next to its DOM; the
+//! streamed path ([`parse_html_reader`]) only holds a window of it, so its
+//! peak is lower by about the size of the source.
+
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::io::{self, Read};
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+use pdf_forge::dom::{parse_html, parse_html_reader};
+
+struct Counting;
+
+static LIVE: AtomicUsize = AtomicUsize::new(0);
+static PEAK: AtomicUsize = AtomicUsize::new(0);
+
+fn grow(size: usize) {
+    let live = LIVE.fetch_add(size, Ordering::Relaxed) + size;
+    PEAK.fetch_max(live, Ordering::Relaxed);
+}
+
+unsafe impl GlobalAlloc for Counting {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        grow(layout.size());
+        System.alloc(layout)
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        LIVE.fetch_sub(layout.size(), Ordering::Relaxed);
+        System.dealloc(ptr, layout)
+    }
+
+    unsafe fn realloc(&self, ptr: *mut u8, layout: Layout, new_size: usize) -> *mut u8 {
+        if new_size > layout.size() {
+            grow(new_size - layout.size());
+        } else {
+            LIVE.fetch_sub(layout.size() - new_size, Ordering::Relaxed);
+        }
+        System.realloc(ptr, layout, new_size)
+    }
+}
+
+#[global_allocator]
+static ALLOCATOR: Counting = Counting;
+
+const ROWS: usize = 200_000;
+
+fn row(i: usize) -> String {
+    format!("<tr><td>Item {i}</td><td>{}.00</td></tr>\n", i * 7 % 1000)
+}
+
+/// The synthetic ledger, generated a row at a time so it never exists whole.
+struct Ledger {
+    next: usize,
+    buf: Vec<u8>,
+    at: usize,
+}
+
+impl Read for Ledger {
+    fn read(&mut self, out: &mut [u8]) -> io::Result<usize> {
+        if self.at == self.buf.len() {
+            self.buf = match self.next {
+                0 => b"<h1>Ledger</h1><table>".to_vec(),
+                n if n <= ROWS => row(n - 1).into_bytes(),
+                n if n == ROWS + 1 => b"</table>".to_vec(),
+                _ => return Ok(0),
+            };
+            self.next += 1;
+            self.at = 0;
+        }
+        let n = out.len().min(self.buf.len() - self.at);
+        out[..n].copy_from_slice(&self.buf[self.at..self.at + n]);
+        self.at += n;
+        Ok(n)
+    }
+}
+
+fn ledger() -> Ledger {
+    Ledger {
+        next: 0,
+        buf: Vec::new(),
+        at: 0,
+    }
+}
+
+/// Peak live heap bytes above the starting level while `f` runs, and the
+/// number of top-level nodes it parsed.
+fn peak(f: impl FnOnce() -> usize) -> (usize, usize) {
+    let base = LIVE.load(Ordering::Relaxed);
+    PEAK.store(base, Ordering::Relaxed);
+    let nodes = f();
+    (PEAK.load(Ordering::Relaxed) - base, nodes)
+}
+
+fn main() {
+    let (buffered, buffered_nodes) = peak(|| {
+        let mut html = String::new();
+        ledger().read_to_string(&mut html).expect("generate");
+        parse_html(&html).len()
+    });
+    let (streamed, streamed_nodes) =
+        peak(|| parse_html_reader(ledger()).expect("parse").len());
+    assert_eq!(buffered_nodes, streamed_nodes);
+
+    let mib = |bytes: usize| bytes as f64 / (1024.0 * 1024.0);
+    println!("rows:             {ROWS}");
+    println!("buffered peak:    {:.1} MiB", mib(buffered));
+    println!("streamed peak:    {:.1} MiB", mib(streamed));
+    println!("saved:            {:.1} MiB", mib(buffered.saturating_sub(streamed)));
+    assert!(
+        streamed < buffered,
+        "streaming should lower peak memory ({streamed} >= {buffered} bytes)"
+    );
+}
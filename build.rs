@@ -1,5 +1,7 @@
 use std::env;
 use std::path::PathBuf;
+use std::process::Command;
+use std::time::{SystemTime, UNIX_EPOCH};
 
 fn main() {
     // Only regenerate the header when the FFI source changes.
@@ -8,6 +10,8 @@ fn main() {
 
     let crate_dir = env::var("CARGO_MANIFEST_DIR").expect("CARGO_MANIFEST_DIR not set");
 
+    emit_build_info(&crate_dir);
+
     let output_file = PathBuf::from(&crate_dir).join("include").join("rpdf.h");
 
     // Ensure the include/ directory exists.
@@ -30,3 +34,56 @@ fn main() {
         output_file.display()
     );
 }
+
+/// Expose the git commit, build date and enabled features to
+/// `rpdf_build_info` as `PDF_FORGE_*` compile-time variables.
+fn emit_build_info(crate_dir: &str) {
+    println!("cargo:rerun-if-changed=.git/HEAD");
+    println!("cargo:rerun-if-changed=.git/refs");
+    println!("cargo:rerun-if-env-changed=SOURCE_DATE_EPOCH");
+
+    let commit = Command::new("git")
+        .args(["rev-parse", "--short=12", "HEAD"])
+        .current_dir(crate_dir)
+        .output()
+        .ok()
+        .filter(|out| out.status.success())
+        .and_then(|out| String::from_utf8(out.stdout).ok())
+        .map(|s| s.trim().to_string())
+        .filter(|s| !s.is_empty())
+        .unwrap_or_else(|| "unknown".to_string());
+    println!("cargo:rustc-env=PDF_FORGE_GIT_COMMIT={commit}");
+
+    // SOURCE_DATE_EPOCH keeps reproducible builds byte-identical.
+    let epoch = env::var("SOURCE_DATE_EPOCH")
+        .ok()
+        .and_then(|s| s.parse::<u64>().ok())
+        .unwrap_or_else(|| {
+            SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .map_or(0, |d| d.as_secs())
+        });
+    println!("cargo:rustc-env=PDF_FORGE_BUILD_DATE={}", civil_date(epoch));
+
+    let mut features: Vec<String> = env::vars()
+        .filter_map(|(key, _)| key.strip_prefix("CARGO_FEATURE_").map(str::to_lowercase))
+        .collect();
+    features.sort();
+    println!("cargo:rustc-env=PDF_FORGE_FEATURES={}", features.join(","));
+}
+
+/// `YYYY-MM-DD` (UTC) of a Unix timestamp.
+fn civil_date(epoch: u64) -> String {
+    // Howard Hinnant's days-to-civil algorithm.
+    let days = (epoch / 86_400) as i64 + 719_468;
+    let era = days.div_euclid(146_097);
+    let day_of_era = days.rem_euclid(146_097);
+    let year_of_era =
+        (day_of_era - day_of_era / 1_460 + day_of_era / 36_524 - day_of_era / 146_096) / 365;
+    let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+    let mp = (5 * day_of_year + 2) / 153;
+    let day = day_of_year - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = year_of_era + era * 400 + i64::from(month <= 2);
+    format!("{year:04}-{month:02}-{day:02}")
+}
@@ -26,31 +26,298 @@ package main
 #cgo CFLAGS: -I../../include
 #include "rpdf.h"
 #include <stdlib.h>
+
+extern intptr_t goReadHTMLChunk(void *ctx, uint8_t *buf, uintptr_t cap);
 */
 import "C"
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"runtime/cgo"
+	"strings"
+	"sync"
 	"unsafe"
 )
 
+// ErrInternal is returned (wrapped) when the native library hit an internal
+// error – a Rust panic caught at the FFI boundary instead of aborting the
+// process. The wrapped message carries the panic text.
+var ErrInternal = errors.New("pdf_forge internal error")
+
+// ErrOutputTooLarge is returned (wrapped) when the PDF is larger than the
+// WithMaxOutputBytes limit, even after any image recompression it allows.
+var ErrOutputTooLarge = errors.New("pdf_forge output too large")
+
+// rcInternal mirrors the library's "internal error" return code.
+const rcInternal = 5
+
+// rcOutputTooLarge mirrors the library's "output too large" return code.
+const rcOutputTooLarge = 6
+
+// Option adjusts a single GeneratePDF call.
+type Option func(*options)
+
+type options struct {
+	allowEmpty      bool
+	stylesheetFiles []string
+	baseFont        []byte
+	textAsOutlines  bool
+	embedBaseFonts  bool
+	htmlReader      io.Reader
+	colorManaged    bool
+	headerHeight    float64
+	footerHeight    float64
+	namedDests      bool
+	maxOutputBytes  int64
+	fitOutputSize   bool
+	grayscale       bool
+	minFontSize     float64
+	pageAttachments []pageAttachment
+}
+
+// AFRelationship says how a file attached with WithPageAttachment relates
+// to its page (the PDF /AFRelationship).
+type AFRelationship int
+
+const (
+	AFUnspecified AFRelationship = iota
+	AFSource
+	AFData
+	AFAlternative
+	AFSupplement
+)
+
+type pageAttachment struct {
+	page int
+	name string
+	data []byte
+	rel  AFRelationship
+}
+
+// WithAllowEmpty makes empty html produce a valid one-page blank PDF, with
+// the configured page size and margins, instead of an error.
+func WithAllowEmpty(allow bool) Option {
+	return func(o *options) { o.allowEmpty = allow }
+}
+
+// WithStylesheetFiles applies the CSS files at paths, in order, before the
+// document's own styles. Relative url()s in each file resolve against that
+// file's folder. A file that cannot be read is skipped with a warning.
+func WithStylesheetFiles(paths ...string) Option {
+	return func(o *options) { o.stylesheetFiles = append(o.stylesheetFiles, paths...) }
+}
+
+// WithTextAsOutlines draws all text as vector paths taken from font, a
+// TrueType/OpenType program used for the default (Helvetica) family. The
+// PDF then contains no fonts and its text cannot be selected or extracted.
+func WithTextAsOutlines(font []byte) Option {
+	return func(o *options) {
+		o.baseFont = font
+		o.textAsOutlines = true
+	}
+}
+
+// WithBaseFont uses font, a TrueType/OpenType program, for the default
+// (Helvetica) family: text is measured with its metrics, and it is the
+// program WithForceEmbedBaseFonts embeds.
+func WithBaseFont(font []byte) Option {
+	return func(o *options) { o.baseFont = font }
+}
+
+// WithForceEmbedBaseFonts embeds a program for the standard-14 fonts instead
+// of referencing them by name, as PDF/A validators and some print RIPs
+// require. The program is the one given with WithBaseFont; generation fails
+// without one, since the standard-14 programs are not bundled.
+func WithForceEmbedBaseFonts(enabled bool) Option {
+	return func(o *options) { o.embedBaseFonts = enabled }
+}
+
+// WithImageColorManagement tags images that carry their own ICC profile
+// (PNG iCCP, JPEG APP2) with it, so viewers convert their colours from the
+// source space instead of reading them as device RGB.
+func WithImageColorManagement(enabled bool) Option {
+	return func(o *options) { o.colorManaged = enabled }
+}
+
+// WithHeaderHeight reserves exactly pt points below the top margin of every
+// page for the header, whatever its content: the body starts pt points
+// lower, and a header taller than the band is clipped.
+func WithHeaderHeight(pt float64) Option {
+	return func(o *options) { o.headerHeight = pt }
+}
+
+// WithFooterHeight is WithHeaderHeight for the footer, above the bottom
+// margin.
+func WithFooterHeight(pt float64) Option {
+	return func(o *options) { o.footerHeight = pt }
+}
+
+// WithNamedDestinations turns every element id into a named destination,
+// so a link to file.pdf#nameddest=intro opens the PDF at id="intro".
+func WithNamedDestinations(enabled bool) Option {
+	return func(o *options) { o.namedDests = enabled }
+}
+
+// WithMaxOutputBytes makes GeneratePDF fail with ErrOutputTooLarge when the
+// PDF would be larger than n bytes, e.g. to stay under an email attachment
+// limit. With fit, it first re-encodes the document's opaque images as ever
+// smaller JPEGs and only fails if even the smallest attempt is too large.
+func WithMaxOutputBytes(n int64, fit bool) Option {
+	return func(o *options) {
+		o.maxOutputBytes = n
+		o.fitOutputSize = fit
+	}
+}
+
+// WithGrayscale writes every colour and image in DeviceGray, so
+// black-and-white print runs are not billed as colour pages.
+func WithGrayscale(enabled bool) Option {
+	return func(o *options) { o.grayscale = enabled }
+}
+
+// WithMinimumFontSize prints any text smaller than pt points at pt points,
+// so fine print such as legal terms stays legible. Text is laid out at the
+// larger size, so it wraps and paginates accordingly.
+func WithMinimumFontSize(pt float64) Option {
+	return func(o *options) { o.minFontSize = pt }
+}
+
+// WithPageAttachment embeds data as a file called name and associates it
+// with the 1-based page, listing it in that page's /AF array – e.g. the CSV
+// behind a chart for PDF/A-3 archives. Generation fails if the document has
+// no such page. Repeat the option to attach several files.
+func WithPageAttachment(page int, name string, data []byte, rel AFRelationship) Option {
+	return func(o *options) {
+		o.pageAttachments = append(o.pageAttachments, pageAttachment{page, name, data, rel})
+	}
+}
+
+// WithChunkedHTMLInput makes GeneratePDF read the document from r, which the
+// library parses chunk by chunk as it arrives, instead of from the html
+// argument (which must then be nil). The source is never held in memory
+// whole, which lowers peak memory for documents of hundreds of megabytes;
+// the parsed document still is. r is read on the calling goroutine.
+func WithChunkedHTMLInput(r io.Reader) Option {
+	return func(o *options) { o.htmlReader = r }
+}
+
 // GeneratePDF converts HTML bytes into a PDF byte slice using the given config.
 // title is embedded in the PDF document metadata; pass "" for the default.
 // landscape rotates the effective page to A4 landscape when true.
-func GeneratePDF(html []byte, title string, landscape bool) ([]byte, error) {
-	if len(html) == 0 {
+func GeneratePDF(html []byte, title string, landscape bool, opts ...Option) ([]byte, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.htmlReader != nil && len(html) > 0 {
+		return nil, errors.New("html must be nil with WithChunkedHTMLInput")
+	}
+	if len(html) == 0 && o.htmlReader == nil && !o.allowEmpty {
 		return nil, errors.New("html must not be empty")
 	}
 
-	// Build the C config struct.
-	var cfg C.RpdfPipelineConfig
+	cfg, freeConfig := o.cConfig(title, landscape)
+	defer freeConfig()
+
+	var outBuf *C.uint8_t
+	var outLen C.uint32_t
+
+	var rc C.int
+	if o.htmlReader != nil {
+		src := &chunkSource{r: o.htmlReader}
+		h := cgo.NewHandle(src)
+		defer h.Delete()
+		rc = C.rpdf_generate_pdf_stream_ex(C.RpdfReadFn(C.goReadHTMLChunk), unsafe.Pointer(&h), &cfg, &outBuf, &outLen)
+		if src.err != nil {
+			return nil, fmt.Errorf("reading html: %w", src.err)
+		}
+	} else {
+		// The library needs a non-null pointer even for empty input.
+		src := html
+		if len(src) == 0 {
+			src = []byte{0}
+		}
+		htmlPtr := (*C.uint8_t)(unsafe.Pointer(&src[0]))
+		htmlLen := C.uint32_t(len(html))
+		rc = C.rpdf_generate_pdf_ex(htmlPtr, htmlLen, &cfg, &outBuf, &outLen)
+	}
+	if rc != 0 {
+		return nil, generationError(rc, "rpdf_generate_pdf_ex")
+	}
+	defer C.rpdf_free_buffer(outBuf, outLen)
+
+	// Copy the Rust-owned bytes into a Go slice before freeing.
+	return C.GoBytes(unsafe.Pointer(outBuf), C.int(outLen)), nil
+}
+
+// GenerateToFile converts HTML bytes into a PDF written to the file at path,
+// replacing any file there, and returns its size. The document is never
+// copied into Go memory, which keeps the Go heap small for very large PDFs.
+// WithChunkedHTMLInput is not supported here.
+func GenerateToFile(path string, html []byte, opts ...Option) (int64, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.htmlReader != nil {
+		return 0, errors.New("GenerateToFile does not support WithChunkedHTMLInput")
+	}
+	if len(html) == 0 && !o.allowEmpty {
+		return 0, errors.New("html must not be empty")
+	}
+
+	cfg, freeConfig := o.cConfig("", false)
+	defer freeConfig()
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	// The library needs a non-null pointer even for empty input.
+	src := html
+	if len(src) == 0 {
+		src = []byte{0}
+	}
+	var outLen C.uint64_t
+	rc := C.rpdf_generate_pdf_to_file_ex((*C.uint8_t)(unsafe.Pointer(&src[0])), C.uint32_t(len(html)), &cfg, cPath, &outLen)
+	if rc != 0 {
+		return 0, generationError(rc, "rpdf_generate_pdf_to_file_ex")
+	}
+	return int64(outLen), nil
+}
+
+// generationError describes the failure code rc of the generation function
+// fn, wrapping ErrInternal or ErrOutputTooLarge where they apply.
+func generationError(rc C.int, fn string) error {
+	errPtr := C.rpdf_last_error()
+	if rc == rcInternal {
+		return fmt.Errorf("%w: %s", ErrInternal, C.GoString(errPtr))
+	}
+	if rc == rcOutputTooLarge {
+		return fmt.Errorf("%w: %s", ErrOutputTooLarge, C.GoString(errPtr))
+	}
+	if errPtr != nil {
+		return fmt.Errorf("rpdf error (code %d): %s", int(rc), C.GoString(errPtr))
+	}
+	return fmt.Errorf("%s failed with code %d", fn, int(rc))
+}
+
+// cConfig builds the C config for o. The strings and buffers it points to
+// are allocated in C memory; call free once the library call has returned.
+func (o *options) cConfig(title string, landscape bool) (cfg C.RpdfPipelineConfig, free func()) {
+	var allocs []unsafe.Pointer
+	free = func() {
+		for _, p := range allocs {
+			C.free(p)
+		}
+	}
 
 	// Title string: allocate a C string for the duration of the call.
 	if title != "" {
 		cTitle := C.CString(title)
-		defer C.free(unsafe.Pointer(cTitle))
+		allocs = append(allocs, unsafe.Pointer(cTitle))
 		cfg.title = cTitle
 	} // nil → library uses default ("rpdf output")
 
@@ -61,29 +328,341 @@ func GeneratePDF(html []byte, title string, landscape bool) ([]byte, error) {
 	}
 	// page_width, page_height, page_margin left at 0 → A4 defaults
 
-	htmlPtr := (*C.uint8_t)(unsafe.Pointer(&html[0]))
-	htmlLen := C.uint32_t(len(html))
+	if len(o.stylesheetFiles) > 0 {
+		cFiles := C.CString(strings.Join(o.stylesheetFiles, "\n"))
+		allocs = append(allocs, unsafe.Pointer(cFiles))
+		cfg.stylesheet_files = cFiles
+	}
+
+	if len(o.baseFont) > 0 {
+		cFont := C.CBytes(o.baseFont)
+		allocs = append(allocs, cFont)
+		cfg.base_font_ptr = (*C.uint8_t)(cFont)
+		cfg.base_font_len = C.uint32_t(len(o.baseFont))
+	}
+	cfg.text_as_outlines = C.bool(o.textAsOutlines)
+	cfg.embed_base_fonts = C.bool(o.embedBaseFonts)
+	cfg.image_color_management = C.bool(o.colorManaged)
+	cfg.header_height = C.float(o.headerHeight)
+	cfg.footer_height = C.float(o.footerHeight)
+	cfg.named_destinations = C.bool(o.namedDests)
+	if o.maxOutputBytes > 0 {
+		cfg.max_output_bytes = C.uint64_t(o.maxOutputBytes)
+		cfg.fit_output_size = C.bool(o.fitOutputSize)
+	}
+	cfg.grayscale = C.bool(o.grayscale)
+	cfg.min_font_size = C.float(o.minFontSize)
+	if n := len(o.pageAttachments); n > 0 {
+		// The array is C memory: cgo forbids passing Go memory that holds
+		// pointers.
+		list := C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.RpdfPageAttachment{})))
+		allocs = append(allocs, list)
+		entries := unsafe.Slice((*C.RpdfPageAttachment)(list), n)
+		for i, a := range o.pageAttachments {
+			cName := C.CString(a.name)
+			allocs = append(allocs, unsafe.Pointer(cName))
+			entries[i] = C.RpdfPageAttachment{
+				page:         C.uint32_t(a.page),
+				name:         cName,
+				relationship: uint32(a.rel),
+			}
+			if len(a.data) > 0 {
+				cData := C.CBytes(a.data)
+				allocs = append(allocs, cData)
+				entries[i].data_ptr = (*C.uint8_t)(cData)
+				entries[i].data_len = C.uint32_t(len(a.data))
+			}
+		}
+		cfg.page_attachments = (*C.RpdfPageAttachment)(list)
+		cfg.page_attachments_len = C.uint32_t(n)
+	}
+
+	return cfg, free
+}
+
+// chunkSource is the reader behind a WithChunkedHTMLInput call, with the
+// first error it returned other than io.EOF.
+type chunkSource struct {
+	r   io.Reader
+	err error
+}
+
+// goReadHTMLChunk is the library's RpdfReadFn for WithChunkedHTMLInput: ctx
+// points to the cgo.Handle of a *chunkSource.
+//
+//export goReadHTMLChunk
+func goReadHTMLChunk(ctx unsafe.Pointer, buf *C.uint8_t, capacity C.uintptr_t) C.intptr_t {
+	src := (*(*cgo.Handle)(ctx)).Value().(*chunkSource)
+	dst := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(capacity))
+	for {
+		n, err := src.r.Read(dst)
+		switch {
+		case n > 0:
+			return C.intptr_t(n)
+		case err == io.EOF:
+			return 0
+		case err != nil:
+			src.err = err
+			return -1
+		}
+	}
+}
+
+// GenerateResult is the outcome of a GenerateAsync call.
+type GenerateResult struct {
+	PDF []byte
+	Err error
+}
+
+// GenerateAsync runs GeneratePDF on a new goroutine and delivers its result
+// on the returned channel exactly once. The channel is buffered, so the
+// goroutine never leaks if the caller stops listening. html must not be
+// modified until the result arrives.
+func GenerateAsync(html []byte, title string, landscape bool, opts ...Option) <-chan GenerateResult {
+	ch := make(chan GenerateResult, 1)
+	go func() {
+		pdf, err := GeneratePDF(html, title, landscape, opts...)
+		ch <- GenerateResult{PDF: pdf, Err: err}
+	}()
+	return ch
+}
+
+// SetMaxConcurrency caps how many calls may render inside the native library
+// at once, no matter how many goroutines call in; the rest queue until a slot
+// frees up. n <= 0 removes the limit.
+func SetMaxConcurrency(n int) {
+	if n < 0 {
+		n = 0
+	}
+	C.rpdf_set_max_concurrency(C.uint32_t(n))
+}
+
+// FontInfo describes one font resource of a PDF.
+type FontInfo struct {
+	Name     string `json:"name"`     // BaseFont, including any subset tag
+	Kind     string `json:"kind"`     // Type1, TrueType, Type0, Type3, …
+	Embedded bool   `json:"embedded"` // a font program is in the file
+	Subset   bool   `json:"subset"`   // the embedded program is a subset
+}
+
+// ListFonts reports the fonts used by pdf, e.g. for licence audits.
+func ListFonts(pdf []byte) ([]FontInfo, error) {
+	if len(pdf) == 0 {
+		return nil, errors.New("pdf must not be empty")
+	}
+
+	var outJSON *C.char
+	rc := C.rpdf_list_fonts((*C.uint8_t)(unsafe.Pointer(&pdf[0])), C.uint32_t(len(pdf)), &outJSON)
+	if rc != 0 {
+		return nil, fmt.Errorf("rpdf error (code %d): %s", int(rc), C.GoString(C.rpdf_last_error()))
+	}
+	defer C.rpdf_free_string(outJSON)
+
+	var fonts []FontInfo
+	if err := json.Unmarshal([]byte(C.GoString(outJSON)), &fonts); err != nil {
+		return nil, err
+	}
+	return fonts, nil
+}
+
+// Metadata is the document information of a PDF.
+type Metadata struct {
+	Title        string `json:"title"`
+	Author       string `json:"author"`
+	Subject      string `json:"subject"`
+	Keywords     string `json:"keywords"`
+	Creator      string `json:"creator"`
+	Producer     string `json:"producer"`
+	CreationDate string `json:"creation_date"` // as written, e.g. D:20240131120000Z
+	PageCount    int    `json:"page_count"`
+}
+
+// ReadMetadata reads the Info dictionary and page count of pdf. Unset
+// entries are left empty.
+func ReadMetadata(pdf []byte) (Metadata, error) {
+	if len(pdf) == 0 {
+		return Metadata{}, errors.New("pdf must not be empty")
+	}
+
+	var outJSON *C.char
+	rc := C.rpdf_read_metadata((*C.uint8_t)(unsafe.Pointer(&pdf[0])), C.uint32_t(len(pdf)), &outJSON)
+	if rc != 0 {
+		return Metadata{}, fmt.Errorf("rpdf error (code %d): %s", int(rc), C.GoString(C.rpdf_last_error()))
+	}
+	defer C.rpdf_free_string(outJSON)
+
+	var metadata Metadata
+	if err := json.Unmarshal([]byte(C.GoString(outJSON)), &metadata); err != nil {
+		return Metadata{}, err
+	}
+	return metadata, nil
+}
+
+// Box is one laid-out box with its computed geometry, in points. X is
+// measured from the left page edge, Y from the top of the content area of
+// the unpaginated document.
+type Box struct {
+	Tag      string   `json:"tag"` // "" for anonymous boxes such as text runs
+	ID       string   `json:"id"`
+	Classes  []string `json:"classes"`
+	X        float64  `json:"x"`
+	Y        float64  `json:"y"`
+	Width    float64  `json:"width"`
+	Height   float64  `json:"height"`
+	Lines    []string `json:"lines"`
+	Children []Box    `json:"children"`
+}
+
+// LayoutTree lays html out with the default config and returns the
+// top-level boxes, without producing a PDF – useful for asserting on the
+// geometry of a template in tests.
+func LayoutTree(html []byte) ([]Box, error) {
+	if len(html) == 0 {
+		return nil, errors.New("html must not be empty")
+	}
+
+	var outJSON *C.char
+	rc := C.rpdf_layout_tree_ex((*C.uint8_t)(unsafe.Pointer(&html[0])), C.uint32_t(len(html)), nil, &outJSON)
+	if rc != 0 {
+		return nil, fmt.Errorf("rpdf error (code %d): %s", int(rc), C.GoString(C.rpdf_last_error()))
+	}
+	defer C.rpdf_free_string(outJSON)
+
+	var boxes []Box
+	if err := json.Unmarshal([]byte(C.GoString(outJSON)), &boxes); err != nil {
+		return nil, err
+	}
+	return boxes, nil
+}
+
+// Repair rebuilds the cross-reference table of a malformed PDF, e.g. a
+// third-party file whose xref offsets are wrong.
+func Repair(pdf []byte) ([]byte, error) {
+	if len(pdf) == 0 {
+		return nil, errors.New("pdf must not be empty")
+	}
 
 	var outBuf *C.uint8_t
 	var outLen C.uint32_t
-
-	rc := C.rpdf_generate_pdf_ex(htmlPtr, htmlLen, &cfg, &outBuf, &outLen)
+	rc := C.rpdf_repair((*C.uint8_t)(unsafe.Pointer(&pdf[0])), C.uint32_t(len(pdf)), &outBuf, &outLen)
 	if rc != 0 {
-		errPtr := C.rpdf_last_error()
-		if errPtr != nil {
-			return nil, fmt.Errorf("rpdf error (code %d): %s", int(rc), C.GoString(errPtr))
-		}
-		return nil, fmt.Errorf("rpdf_generate_pdf_ex failed with code %d", int(rc))
+		return nil, fmt.Errorf("rpdf error (code %d): %s", int(rc), C.GoString(C.rpdf_last_error()))
 	}
 	defer C.rpdf_free_buffer(outBuf, outLen)
 
-	// Copy the Rust-owned bytes into a Go slice before freeing.
 	return C.GoBytes(unsafe.Pointer(outBuf), C.int(outLen)), nil
 }
 
-// Version returns the pdf_forge library version string.
+// PageToSVG converts page (1-based) of pdf to an SVG document, e.g. for a
+// browser preview of a generated file.
+func PageToSVG(pdf []byte, page int) ([]byte, error) {
+	if len(pdf) == 0 {
+		return nil, errors.New("pdf must not be empty")
+	}
+	if page < 1 {
+		return nil, fmt.Errorf("page %d out of range", page)
+	}
+
+	var outSVG *C.char
+	rc := C.rpdf_page_to_svg((*C.uint8_t)(unsafe.Pointer(&pdf[0])), C.uint32_t(len(pdf)), C.uint32_t(page), &outSVG)
+	if rc != 0 {
+		return nil, fmt.Errorf("rpdf error (code %d): %s", int(rc), C.GoString(C.rpdf_last_error()))
+	}
+	defer C.rpdf_free_string(outSVG)
+
+	return []byte(C.GoString(outSVG)), nil
+}
+
+// Image is an image embedded in a PDF.
+type Image struct {
+	Page   int    `json:"page"`   // 1-based page the image was found on
+	Name   string `json:"name"`   // resource name, e.g. Im1
+	Format string `json:"format"` // "jpeg" or "png"
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Data   []byte `json:"data"` // the encoded file
+}
+
+// ExtractImages returns the images embedded in pdf, each once, in page order.
+func ExtractImages(pdf []byte) ([]Image, error) {
+	if len(pdf) == 0 {
+		return nil, errors.New("pdf must not be empty")
+	}
+
+	var outJSON *C.char
+	rc := C.rpdf_extract_images((*C.uint8_t)(unsafe.Pointer(&pdf[0])), C.uint32_t(len(pdf)), &outJSON)
+	if rc != 0 {
+		return nil, fmt.Errorf("rpdf error (code %d): %s", int(rc), C.GoString(C.rpdf_last_error()))
+	}
+	defer C.rpdf_free_string(outJSON)
+
+	var images []Image
+	if err := json.Unmarshal([]byte(C.GoString(outJSON)), &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// PreflightIssue is one print-readiness problem found by Preflight.
+type PreflightIssue struct {
+	Check   string `json:"check"` // "rgb_color", "font_not_embedded", "low_resolution_image" or "missing_bleed"
+	Page    *int   `json:"page"`  // 1-based; nil for fonts
+	Message string `json:"message"`
+}
+
+// PreflightReport lists every problem Preflight found; it is empty for a
+// print-ready file.
+type PreflightReport struct {
+	Issues []PreflightIssue `json:"issues"`
+}
+
+// Preflight checks pdf for RGB colour, fonts that are not embedded, images
+// drawn below minImageDPI (0 for the default of 150) and missing bleed.
+func Preflight(pdf []byte, minImageDPI float64) (PreflightReport, error) {
+	var report PreflightReport
+	if len(pdf) == 0 {
+		return report, errors.New("pdf must not be empty")
+	}
+
+	var outJSON *C.char
+	rc := C.rpdf_preflight((*C.uint8_t)(unsafe.Pointer(&pdf[0])), C.uint32_t(len(pdf)), C.float(minImageDPI), &outJSON)
+	if rc != 0 {
+		return report, fmt.Errorf("rpdf error (code %d): %s", int(rc), C.GoString(C.rpdf_last_error()))
+	}
+	defer C.rpdf_free_string(outJSON)
+
+	err := json.Unmarshal([]byte(C.GoString(outJSON)), &report)
+	return report, err
+}
+
+var (
+	versionOnce sync.Once
+	version     string
+)
+
+// Version returns the pdf_forge library version string. It is read from the
+// native library once per process.
 func Version() string {
-	return C.GoString(C.rpdf_version())
+	versionOnce.Do(func() {
+		version = C.GoString(C.rpdf_version())
+	})
+	return version
+}
+
+// BuildDetails describes how the native library was built.
+type BuildDetails struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`     // short git hash, or "unknown"
+	BuildDate string   `json:"build_date"` // UTC, YYYY-MM-DD
+	Features  []string `json:"features"`   // enabled Cargo features
+}
+
+// BuildInfo reports the version, git commit, build date and enabled features
+// of the native library.
+func BuildInfo() (BuildDetails, error) {
+	var info BuildDetails
+	err := json.Unmarshal([]byte(C.GoString(C.rpdf_build_info())), &info)
+	return info, err
 }
 
 func main() {
@@ -16,6 +16,8 @@
  *   2  invalid UTF-8 in input
  *   3  pipeline / layout error
  *   4  render / PDF error
+ *   5  internal error (a panic caught at the FFI boundary)
+ *   6  PDF larger than RpdfPipelineConfig.max_output_bytes
  *
  * LINK FLAGS
  *   Windows MSVC  : pdf_forge.lib  Ws2_32.lib Bcrypt.lib Ntdll.lib Userenv.lib
@@ -50,6 +52,154 @@ typedef enum RpdfPageOrientation {
   Landscape = 1,
 } RpdfPageOrientation;
 
+/**
+ * Colour rendering intent for use in [`RpdfPipelineConfig`].
+ */
+typedef enum RpdfRenderingIntent {
+  /**
+   * Leave the viewer default (relative colorimetric).
+   */
+  IntentDefault = 0,
+  Perceptual = 1,
+  RelativeColorimetric = 2,
+  Saturation = 3,
+  AbsoluteColorimetric = 4,
+} RpdfRenderingIntent;
+
+/**
+ * How `RpdfPipelineConfig::page_background_ptr` is fitted to the page.
+ */
+typedef enum RpdfBackgroundMode {
+  /**
+   * Scale to cover the page, cropping the overflow (default).
+   */
+  BackgroundCover = 0,
+  /**
+   * Scale to fit inside the page.
+   */
+  BackgroundContain = 1,
+  /**
+   * Repeat at the image's own size from the top-left corner.
+   */
+  BackgroundTile = 2,
+} RpdfBackgroundMode;
+
+/**
+ * Viewer panel shown on opening, for use in [`RpdfPipelineConfig`].
+ */
+typedef enum RpdfPageMode {
+  /**
+   * No side panel (default).
+   */
+  PageModeUseNone = 0,
+  /**
+   * The bookmarks panel.
+   */
+  PageModeUseOutlines = 1,
+  /**
+   * The page thumbnails.
+   */
+  PageModeUseThumbs = 2,
+  /**
+   * Full-screen.
+   */
+  PageModeFullScreen = 3,
+} RpdfPageMode;
+
+/**
+ * Line style of a link border, for [`RpdfPipelineConfig`].
+ */
+typedef enum RpdfLinkBorderStyle {
+  /**
+   * A solid line (default).
+   */
+  LinkBorderSolid = 0,
+  /**
+   * 3 pt dashes with 3 pt gaps.
+   */
+  LinkBorderDashed = 1,
+  /**
+   * A single line along the bottom of the link.
+   */
+  LinkBorderUnderline = 2,
+} RpdfLinkBorderStyle;
+
+/**
+ * What a viewer does to a link while it is clicked, for
+ * [`RpdfPipelineConfig`].
+ */
+typedef enum RpdfLinkHighlight {
+  /**
+   * Invert the colours of the link area (default).
+   */
+  LinkHighlightInvert = 0,
+  /**
+   * No visual change.
+   */
+  LinkHighlightNone = 1,
+  /**
+   * Invert the link's border.
+   */
+  LinkHighlightOutline = 2,
+  /**
+   * Draw the link as if pushed below the page.
+   */
+  LinkHighlightPush = 3,
+} RpdfLinkHighlight;
+
+/**
+ * How a page attachment relates to its page, for [`RpdfPageAttachment`].
+ */
+typedef enum RpdfAfRelationship {
+  /**
+   * No stated relationship (default).
+   */
+  AfRelationshipUnspecified = 0,
+  /**
+   * The original the page was made from.
+   */
+  AfRelationshipSource = 1,
+  /**
+   * Data the page shows.
+   */
+  AfRelationshipData = 2,
+  /**
+   * Another representation of the page.
+   */
+  AfRelationshipAlternative = 3,
+  /**
+   * Additional material.
+   */
+  AfRelationshipSupplement = 4,
+} RpdfAfRelationship;
+
+/**
+ * A file associated with one page, for
+ * `RpdfPipelineConfig::page_attachments`.
+ */
+typedef struct RpdfPageAttachment {
+  /**
+   * 1-based page the file belongs to.
+   */
+  uint32_t page;
+  /**
+   * Null-terminated UTF-8 file name.
+   */
+  const char *name;
+  /**
+   * The file's bytes.
+   */
+  const uint8_t *data_ptr;
+  /**
+   * Length of `data_ptr` in bytes.
+   */
+  uint32_t data_len;
+  /**
+   * How the file relates to the page.
+   */
+  enum RpdfAfRelationship relationship;
+} RpdfPageAttachment;
+
 /**
  * Optional configuration for PDF generation passed to the `*_ex` functions.
  *
@@ -81,14 +231,264 @@ typedef struct RpdfPipelineConfig {
    * Page orientation (portrait = 0, landscape = 1).
    */
   enum RpdfPageOrientation orientation;
+  /**
+   * Embed a font program for the standard-14 fonts instead of referencing
+   * them by name. Requires `base_font_ptr`.
+   */
+  bool embed_base_fonts;
+  /**
+   * TrueType/OpenType bytes used for the Helvetica family. May be `NULL`.
+   */
+  const uint8_t *base_font_ptr;
+  /**
+   * Length of `base_font_ptr` in bytes.
+   */
+  uint32_t base_font_len;
+  /**
+   * Null-terminated UTF-8 CSS applied after the document's own styles so
+   * it overrides them. May be `NULL`.
+   */
+  const char *extra_css;
+  /**
+   * Colour rendering intent applied to every page.
+   */
+  enum RpdfRenderingIntent rendering_intent;
+  /**
+   * Null-terminated UTF-8 XMP packet embedded verbatim as the document
+   * metadata. Must be well-formed XML. May be `NULL`.
+   */
+  const char *xmp;
+  /**
+   * Fail with return code `3` on any warning (skipped image, dropped
+   * CSS rule, missing glyph, …) instead of degrading the output.
+   */
+  bool strict;
+  /**
+   * Omit the Info dictionary and XMP metadata and zero the document ID.
+   */
+  bool strip_metadata;
+  /**
+   * Merge identical PDF objects and drop unreferenced ones after rendering.
+   */
+  bool optimize;
+  /**
+   * Reuse parsed font programs and decoded images through an in-memory
+   * LRU cache shared by every call in the process.
+   */
+  bool use_cache;
+  /**
+   * Store embedded font programs uncompressed (fonts are FlateDecode
+   * compressed by default).
+   */
+  bool uncompressed_fonts;
+  /**
+   * Fail with return code `3` when an image or the base font cannot be
+   * loaded, while tolerating every other warning.
+   */
+  bool fail_on_missing_assets;
+  /**
+   * PNG or JPEG bytes drawn behind the content of every page. May be
+   * `NULL`.
+   */
+  const uint8_t *page_background_ptr;
+  /**
+   * Length of `page_background_ptr` in bytes.
+   */
+  uint32_t page_background_len;
+  /**
+   * How the page background is fitted to the page.
+   */
+  enum RpdfBackgroundMode page_background_mode;
+  /**
+   * Give every page exactly one content stream.
+   */
+  bool single_content_stream;
+  /**
+   * Expected PDF size in bytes, used to preallocate the output buffer of
+   * post-processed files. `0` for no hint.
+   */
+  uint32_t output_size_hint;
+  /**
+   * Drop a final page left without visible content, unless a page break
+   * started it.
+   */
+  bool trim_trailing_blank_page;
+  /**
+   * Null-terminated path of a folder of `.ttf` / `.otf` files to register
+   * by family name. May be `NULL`.
+   */
+  const char *fonts_directory;
+  /**
+   * Paint backgrounds even where the document sets
+   * `print-color-adjust: economy`.
+   */
+  bool print_backgrounds;
+  /**
+   * Minimum stroke width in points for borders, outlines and underlines;
+   * `0` for none.
+   */
+  float min_line_width;
+  /**
+   * Skip images whose header claims more than this many pixels
+   * (width × height); `0` for no limit.
+   */
+  uint64_t max_image_pixels;
+  /**
+   * PDF bytes whose page `overlay_pdf_page` is drawn on every page (e.g.
+   * pre-printed letterhead). May be `NULL`.
+   */
+  const uint8_t *overlay_pdf_ptr;
+  /**
+   * Length of `overlay_pdf_ptr` in bytes.
+   */
+  uint32_t overlay_pdf_len;
+  /**
+   * 1-based page of the overlay PDF to draw; `0` for the first.
+   */
+  uint32_t overlay_pdf_page;
+  /**
+   * Draw the overlay beneath the content instead of over it.
+   */
+  bool overlay_behind;
+  /**
+   * Write page geometry in units of this many points (`/UserUnit`) for
+   * pages over 14 400 pt; between 1 and 75 000, or `0` for plain points.
+   */
+  float user_unit;
+  /**
+   * Pack objects into object streams with a cross-reference stream
+   * (PDF 1.5) instead of a classic xref table.
+   */
+  bool object_streams;
+  /**
+   * With `title` `NULL`, use the document's `<title>` or first `<h1>`
+   * text as the title.
+   */
+  bool title_from_first_heading;
+  /**
+   * Null-terminated UTF-8 Info `/Producer`. `NULL` keeps the default.
+   */
+  const char *producer;
+  /**
+   * Null-terminated UTF-8 Info `/Creator`. `NULL` keeps the default.
+   */
+  const char *creator;
+  /**
+   * Lay out in a viewport this many CSS pixels wide, scaled to fit the
+   * page; `0` lays out at the page size.
+   */
+  float viewport_width;
+  /**
+   * Null-terminated UTF-8 selector of an element moved out of the flow
+   * and repeated in every page's top margin. `NULL` repeats nothing.
+   */
+  const char *header_selector;
+  /**
+   * Like `header_selector`, for the bottom margin.
+   */
+  const char *footer_selector;
+  /**
+   * Make bare URLs in the text clickable links.
+   */
+  bool auto_link;
+  /**
+   * Null-terminated UTF-8 list of CSS file paths, one per line, applied
+   * in order before the document's own styles. May be `NULL`.
+   */
+  const char *stylesheet_files;
+  /**
+   * Panel the viewer shows when the file is opened.
+   */
+  enum RpdfPageMode page_mode;
+  /**
+   * Draw text as vector paths, leaving no fonts in the file. Requires
+   * `base_font_ptr`.
+   */
+  bool text_as_outlines;
+  /**
+   * Tag images that carry an ICC profile with it instead of device RGB.
+   */
+  bool image_color_management;
+  /**
+   * Reserve exactly this many points below the top margin for the
+   * header, clipping what does not fit; `0` puts it in the margin.
+   */
+  float header_height;
+  /**
+   * Like `header_height`, above the bottom margin for the footer.
+   */
+  float footer_height;
+  /**
+   * Make every element `id` a named destination (`#nameddest=id`).
+   */
+  bool named_destinations;
+  /**
+   * Fail with return code `6` when the PDF would be larger than this
+   * many bytes; `0` allows any size.
+   */
+  uint64_t max_output_bytes;
+  /**
+   * Over `max_output_bytes`, first shrink and recompress images to fit.
+   */
+  bool fit_output_size;
+  /**
+   * Convert every colour and image to DeviceGray.
+   */
+  bool grayscale;
+  /**
+   * Print text smaller than this many points at this size; `0` keeps
+   * every size.
+   */
+  float min_font_size;
+  /**
+   * Files to associate with pages (their `/AF`). May be `NULL`.
+   * Generation fails with return code `3` if a page does not exist.
+   */
+  const struct RpdfPageAttachment *page_attachments;
+  /**
+   * Number of entries in `page_attachments`.
+   */
+  uint32_t page_attachments_len;
+  /**
+   * Border width of `auto_link` links in points; `0` draws no border.
+   */
+  float link_border_width;
+  /**
+   * Border colour of links (RGB, `0.0..=1.0`).
+   */
+  float link_border_color[3];
+  /**
+   * Line style of link borders.
+   */
+  enum RpdfLinkBorderStyle link_border_style;
+  /**
+   * What a viewer does to a link while it is clicked.
+   */
+  enum RpdfLinkHighlight link_highlight;
 } RpdfPipelineConfig;
 
+/**
+ * Callback that supplies HTML to [`rpdf_generate_pdf_stream_ex`]: copy up to
+ * `cap` bytes into `buf` and return how many were copied, `0` at the end of
+ * the input, or a negative value if reading failed.
+ */
+typedef intptr_t (*RpdfReadFn)(void *ctx, uint8_t *buf, uintptr_t cap);
 
 
 
 
 
 
+
+/**
+ * Limit how many `rpdf_*` calls may run the HTML → PDF pipeline at the same
+ * time.  Further calls block until a running one finishes.
+ *
+ * Pass `0` to remove the limit (the default).  Lowering the limit does not
+ * interrupt calls that are already running.
+ */
+void rpdf_set_max_concurrency(uint32_t max);
+
 /**
  * Generate a PDF from an HTML template string.
  *
@@ -168,6 +568,56 @@ int rpdf_generate_pdf_ex(const uint8_t *html_ptr,
                          uint8_t **out_buf,
                          uint32_t *out_len);
 
+/**
+ * Generate a PDF from HTML with a custom [`RpdfPipelineConfig`] and write
+ * it to the file at `path`, replacing any file there, instead of returning
+ * it in a buffer – for documents too large to copy into the host's memory.
+ *
+ * # Parameters
+ * - `html_ptr`, `html_len`: UTF-8 HTML input
+ * - `cfg`: optional pointer to an [`RpdfPipelineConfig`]; pass `NULL` for defaults
+ * - `path`: null-terminated UTF-8 path of the output file
+ * - `out_len`: receives the size of the written file in bytes
+ *
+ * # Returns
+ * `0` on success; `3` if generation or writing the file fails.
+ *
+ * # Safety
+ * Same as `rpdf_generate_pdf_ex`; `path` must be a valid null-terminated
+ * string.
+ */
+int rpdf_generate_pdf_to_file_ex(const uint8_t *html_ptr,
+                                 uint32_t html_len,
+                                 const struct RpdfPipelineConfig *cfg,
+                                 const char *path,
+                                 uint64_t *out_len);
+
+/**
+ * Generate a PDF from HTML pulled through `read`, parsing it as it arrives
+ * instead of requiring the whole document in one buffer.
+ *
+ * # Parameters
+ * - `read`, `ctx`: callback supplying UTF-8 HTML; `ctx` is passed to every
+ *   call unchanged
+ * - `cfg`: optional pointer to an [`RpdfPipelineConfig`]; pass `NULL` for defaults
+ * - `out_buf`, `out_len`: PDF output
+ *
+ * # Returns
+ * `0` on success; `3` if the callback reports an error, the input is not
+ * valid UTF-8 or generation fails.
+ *
+ * # Safety
+ * - `read` must be safe to call with `ctx` until this function returns; it
+ *   is called on the calling thread only.
+ * - `cfg` is as for `rpdf_generate_pdf_ex`.
+ * - The caller must free `*out_buf` with `rpdf_free_buffer`.
+ */
+int rpdf_generate_pdf_stream_ex(RpdfReadFn read,
+                                void *ctx,
+                                const struct RpdfPipelineConfig *cfg,
+                                uint8_t **out_buf,
+                                uint32_t *out_len);
+
 /**
  * Generate a PDF and layout JSON from HTML with a custom [`RpdfPipelineConfig`].
  *
@@ -199,7 +649,7 @@ int rpdf_generate_pdf_with_layout_ex(const uint8_t *html_ptr,
  * - `out_json_ptr`: layout JSON output (free with `rpdf_free_string`)
  *
  * # Returns
- * `0` on success.
+ * `0` on success, `3` if the config's fonts cannot be loaded.
  *
  * # Safety
  * Same as `rpdf_generate_pdf_ex`.
@@ -209,6 +659,51 @@ int rpdf_compute_layout_ex(const uint8_t *html_ptr,
                            const struct RpdfPipelineConfig *cfg,
                            char **out_json_ptr);
 
+/**
+ * Lay HTML out and return the box tree with computed geometry as JSON,
+ * without paginating or rendering.
+ *
+ * # Parameters
+ * - `html_ptr`, `html_len`: UTF-8 HTML input
+ * - `cfg`: optional pointer to an [`RpdfPipelineConfig`]; pass `NULL` for defaults
+ * - `out_json_ptr`: array of box objects (`tag`, `id`, `classes`, `x`, `y`,
+ *   `width`, `height`, `lines`, `children`); free with `rpdf_free_string`
+ *
+ * # Returns
+ * `0` on success, `3` if the configured fonts cannot be loaded.
+ *
+ * # Safety
+ * Same as `rpdf_generate_pdf_ex`.
+ */
+int rpdf_layout_tree_ex(const uint8_t *html_ptr,
+                        uint32_t html_len,
+                        const struct RpdfPipelineConfig *cfg,
+                        char **out_json_ptr);
+
+/**
+ * Generate a PDF like [`rpdf_generate_pdf_ex`] and also write the SHA-256
+ * digest of the PDF bytes to `out_sha256`.
+ *
+ * # Parameters
+ * - `html_ptr`, `html_len`: UTF-8 HTML input
+ * - `cfg`: optional pointer to an [`RpdfPipelineConfig`]; pass `NULL` for defaults
+ * - `out_buf`, `out_len`: PDF output (free with `rpdf_free_buffer`)
+ * - `out_sha256`: caller-owned buffer of at least 32 bytes
+ *
+ * # Returns
+ * `0` on success.
+ *
+ * # Safety
+ * Same as `rpdf_generate_pdf_ex`. Additionally, `out_sha256` must be valid
+ * for 32 bytes of writes.
+ */
+int rpdf_generate_pdf_digest_ex(const uint8_t *html_ptr,
+                                uint32_t html_len,
+                                const struct RpdfPipelineConfig *cfg,
+                                uint8_t **out_buf,
+                                uint32_t *out_len,
+                                uint8_t *out_sha256);
+
 /**
  * Render a PDF from a layout config JSON string.
  *
@@ -216,6 +711,107 @@ int rpdf_compute_layout_ex(const uint8_t *html_ptr,
  */
 int rpdf_render_from_layout(const char *json_ptr, uint8_t **out_buf, uint32_t *out_len);
 
+/**
+ * List the fonts used by a PDF (any PDF, not only pdf-forge output).
+ *
+ * `*out_json_ptr` receives a JSON array of
+ * `{"name", "kind", "embedded", "subset"}` objects; free it with
+ * `rpdf_free_string`.
+ *
+ * # Returns
+ * `0` on success, `3` if the bytes are not a readable PDF.
+ *
+ * # Safety
+ * `pdf_ptr` must point to `pdf_len` readable bytes.
+ */
+int rpdf_list_fonts(const uint8_t *pdf_ptr, uint32_t pdf_len, char **out_json_ptr);
+
+/**
+ * Read the document information and page count of a PDF (any PDF, not
+ * only pdf-forge output).
+ *
+ * `*out_json_ptr` receives a JSON object with `title`, `author`,
+ * `subject`, `keywords`, `creator`, `producer` and `creation_date` (each a
+ * string or `null`) and `page_count`; free it with `rpdf_free_string`.
+ *
+ * # Returns
+ * `0` on success, `3` if the bytes are not a readable PDF.
+ *
+ * # Safety
+ * `pdf_ptr` must point to `pdf_len` readable bytes.
+ */
+int rpdf_read_metadata(const uint8_t *pdf_ptr, uint32_t pdf_len, char **out_json_ptr);
+
+/**
+ * Rebuild the cross-reference table of a malformed PDF (see
+ * `pdf_forge::repair::repair`).
+ *
+ * On success `*out_buf` / `*out_len` receive the repaired file; free it
+ * with `rpdf_free_buffer`.
+ *
+ * # Returns
+ * `0` on success, `3` if the file cannot be repaired.
+ *
+ * # Safety
+ * `pdf_ptr` must point to `pdf_len` readable bytes.
+ */
+int rpdf_repair(const uint8_t *pdf_ptr, uint32_t pdf_len, uint8_t **out_buf, uint32_t *out_len);
+
+/**
+ * Convert one page of a PDF (any PDF, not only pdf-forge output) to SVG
+ * for web previews (see `pdf_forge::svg::page_to_svg`).
+ *
+ * `page` is 1-based. `*out_svg_ptr` receives the SVG document; free it with
+ * `rpdf_free_string`.
+ *
+ * # Returns
+ * `0` on success, `3` if the bytes are not a readable PDF or the page does
+ * not exist.
+ *
+ * # Safety
+ * `pdf_ptr` must point to `pdf_len` readable bytes.
+ */
+int rpdf_page_to_svg(const uint8_t *pdf_ptr, uint32_t pdf_len, uint32_t page, char **out_svg_ptr);
+
+/**
+ * Extract the images embedded in a PDF (any PDF, not only pdf-forge
+ * output; see `pdf_forge::inspect::extract_images`).
+ *
+ * `*out_json_ptr` receives a JSON array of
+ * `{"page", "name", "format", "width", "height", "data"}` objects, where
+ * `format` is `"jpeg"` or `"png"` and `data` is the base64-encoded file;
+ * free it with `rpdf_free_string`.
+ *
+ * # Returns
+ * `0` on success, `3` if the bytes are not a readable PDF.
+ *
+ * # Safety
+ * `pdf_ptr` must point to `pdf_len` readable bytes.
+ */
+int rpdf_extract_images(const uint8_t *pdf_ptr, uint32_t pdf_len, char **out_json_ptr);
+
+/**
+ * Check a PDF for print-readiness problems (see
+ * `pdf_forge::inspect::preflight`): RGB colour, fonts that are not
+ * embedded, images below `min_image_dpi` (`0` for the default of 150) and
+ * missing bleed.
+ *
+ * `*out_json_ptr` receives `{"issues": [{"check", "page", "message"}]}`,
+ * where `check` is `"rgb_color"`, `"font_not_embedded"`,
+ * `"low_resolution_image"` or `"missing_bleed"` and `page` is 1-based or
+ * `null` for fonts; free it with `rpdf_free_string`.
+ *
+ * # Returns
+ * `0` on success, `3` if the bytes are not a readable PDF.
+ *
+ * # Safety
+ * `pdf_ptr` must point to `pdf_len` readable bytes.
+ */
+int rpdf_preflight(const uint8_t *pdf_ptr,
+                   uint32_t pdf_len,
+                   float min_image_dpi,
+                   char **out_json_ptr);
+
 /**
  * Free a PDF buffer returned by `rpdf_generate_pdf`.
  *
@@ -250,4 +846,11 @@ const char *rpdf_last_error(void);
  */
 const char *rpdf_version(void);
 
+/**
+ * Return how the library was built as a null-terminated JSON object:
+ * `{"version", "commit", "build_date", "features"}`.
+ * The caller must **not** free this pointer.
+ */
+const char *rpdf_build_info(void);
+
 #endif  /* RPDF_H */
@@ -0,0 +1,82 @@
+//! Page-level associated files – data files embedded in the PDF and tied to
+//! the page they belong to, as PDF 2.0 and PDF/A-3 describe (see
+//! `PipelineConfig::page_attachments`).
+//!
+//! Each attachment becomes a file specification with its `/AFRelationship`,
+//! listed in its page's `/AF` array.  It is also added to the catalog's
+//! `/EmbeddedFiles` name tree, which is where viewers list attachments.
+
+use lopdf::{dictionary, Document, Object, Stream, StringFormat};
+
+use crate::destinations::names_dictionary;
+use crate::layout_config::PageAttachment;
+
+/// Embed `attachments` and reference each from its page's `/AF` array.
+/// Fails if one names a page the document does not have.
+pub fn write(doc: &mut Document, attachments: &[PageAttachment]) -> Result<(), String> {
+    let page_ids: Vec<_> = doc.get_pages().into_values().collect();
+    let mut names = Vec::new();
+    for attachment in attachments {
+        let page_id = attachment
+            .page
+            .checked_sub(1)
+            .and_then(|index| page_ids.get(index))
+            .copied()
+            .ok_or_else(|| {
+                let (name, page) = (&attachment.name, attachment.page);
+                format!("Attachment `{name}`: the document has no page {page}")
+            })?;
+
+        let mut file = Stream::new(
+            dictionary! {
+                "Type" => "EmbeddedFile",
+                "Params" => dictionary! { "Size" => attachment.data.len() as i64 },
+            },
+            attachment.data.clone(),
+        );
+        // Best effort: an uncompressed stream is still valid.
+        let _ = file.compress();
+        let file = doc.add_object(file);
+        let spec = doc.add_object(dictionary! {
+            "Type" => "Filespec",
+            "F" => Object::string_literal(attachment.name.as_str()),
+            "UF" => text_string(&attachment.name),
+            "EF" => dictionary! { "F" => file, "UF" => file },
+            "AFRelationship" => attachment.relationship.pdf_name(),
+        });
+
+        let page = doc
+            .get_dictionary_mut(page_id)
+            .map_err(|e| format!("Read page: {e}"))?;
+        match page.get_mut(b"AF") {
+            Ok(Object::Array(list)) => list.push(spec.into()),
+            _ => page.set("AF", Object::Array(vec![spec.into()])),
+        }
+        names.push((attachment.name.clone(), spec));
+    }
+    if names.is_empty() {
+        return Ok(());
+    }
+
+    // A name tree's keys must be sorted; a repeated name keeps every file.
+    names.sort_by(|a, b| a.0.cmp(&b.0));
+    let names: Vec<Object> = names
+        .into_iter()
+        .flat_map(|(name, spec)| [text_string(&name), spec.into()])
+        .collect();
+    let tree = Object::Reference(doc.add_object(dictionary! { "Names" => names }));
+    names_dictionary(doc)?.set("EmbeddedFiles", tree);
+    Ok(())
+}
+
+/// `text` as a PDF text string: UTF-16BE with a byte order mark unless it
+/// is ASCII.
+fn text_string(text: &str) -> Object {
+    let bytes = if text.is_ascii() {
+        text.as_bytes().to_vec()
+    } else {
+        let units = text.encode_utf16().flat_map(u16::to_be_bytes);
+        [0xFE, 0xFF].into_iter().chain(units).collect()
+    };
+    Object::String(bytes, StringFormat::Literal)
+}
@@ -0,0 +1,221 @@
+//! Auto-linking – turns bare URLs in laid-out text into clickable link
+//! annotations (see `PipelineConfig::auto_link`).
+//!
+//! A URL is a whitespace-delimited word starting with `http://`, `https://`
+//! or `www.`, less any trailing punctuation.  Its rectangle is measured with
+//! the same font metrics as line wrapping, so it covers the drawn glyphs.
+//! Vertical text and transformed boxes are not linked, since their glyphs
+//! are not where the measured rectangle would put them.
+
+use lopdf::{dictionary, Dictionary, Document, Object};
+
+use crate::fonts::FontManager;
+use crate::layout_config::{LayoutBox, LinkBorderStyle, LinkStyle, PageLayout};
+
+/// A clickable area of a page.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Link {
+    /// `[x1, y1, x2, y2]` in PDF user space (points, y up).
+    pub rect: [f32; 4],
+    pub uri: String,
+}
+
+/// Links for the bare URLs on `page`.  `scale` is the viewport scale the
+/// page is drawn at (points per layout unit).
+pub fn page_links(
+    page: &PageLayout,
+    page_height: f32,
+    scale: f32,
+    fonts: &FontManager,
+) -> Vec<Link> {
+    let mut links = Vec::new();
+    for lbox in &page.boxes {
+        collect_links(lbox, fonts, &mut |x1, top, x2, bottom, uri| {
+            let rect = [
+                x1 * scale,
+                page_height - bottom * scale,
+                x2 * scale,
+                page_height - top * scale,
+            ];
+            links.push(Link { rect, uri });
+        });
+    }
+    links
+}
+
+/// Report each URL under `lbox` as `(x1, top, x2, bottom, uri)` in layout
+/// coordinates.
+fn collect_links(
+    lbox: &LayoutBox,
+    fonts: &FontManager,
+    found: &mut dyn FnMut(f32, f32, f32, f32, String),
+) {
+    if lbox.transform.is_some() {
+        return;
+    }
+    if let Some(text) = lbox.text.as_ref().filter(|t| !t.writing_mode.is_vertical()) {
+        let width = |s: &str| {
+            fonts.measure_text_width(s, text.font_size, text.bold, text.italic, &text.font_family)
+        };
+        for line in &text.lines {
+            let x = lbox.x + line.x_offset;
+            let top = lbox.y + line.y_offset;
+            for (start, end) in find_urls(&line.text) {
+                let url = &line.text[start..end];
+                let x1 = x + width(&line.text[..start]);
+                let uri = if url.starts_with("www.") {
+                    format!("http://{url}")
+                } else {
+                    url.to_string()
+                };
+                found(x1, top, x1 + width(url), top + text.line_height, uri);
+            }
+        }
+    }
+    for child in &lbox.children {
+        collect_links(child, fonts, found);
+    }
+}
+
+/// Byte ranges of the bare URLs in `text`.
+pub fn find_urls(text: &str) -> Vec<(usize, usize)> {
+    let mut urls = Vec::new();
+    let mut word_start = None;
+    for (i, c) in text.char_indices().chain([(text.len(), ' ')]) {
+        match (word_start, c.is_whitespace()) {
+            (None, false) => word_start = Some(i),
+            (Some(start), true) => {
+                let word = text[start..i]
+                    .trim_end_matches(['.', ',', ';', ':', '!', '?', ')', ']', '"', '\'']);
+                let body = ["http://", "https://", "www."]
+                    .iter()
+                    .find_map(|prefix| word.strip_prefix(prefix));
+                if body.is_some_and(|b| b.contains(|c: char| c.is_alphanumeric())) {
+                    urls.push((start, start + word.len()));
+                }
+                word_start = None;
+            }
+            _ => {}
+        }
+    }
+    urls
+}
+
+/// Add `links[i]` to the `i`-th page of `doc` as URI link annotations drawn
+/// in `style`, with rectangles divided by the page's `/UserUnit`.
+pub fn annotate(
+    doc: &mut Document,
+    links: &[Vec<Link>],
+    style: &LinkStyle,
+    user_unit: f32,
+) -> Result<(), String> {
+    let page_ids: Vec<_> = doc.get_pages().into_values().collect();
+    for (page_id, page_links) in page_ids.into_iter().zip(links) {
+        let mut annots = Vec::new();
+        for link in page_links {
+            let rect = link.rect.iter().map(|&v| Object::Real(v / user_unit));
+            let mut annot = dictionary! {
+                "Type" => "Annot",
+                "Subtype" => "Link",
+                "Rect" => rect.collect::<Vec<_>>(),
+                "H" => style.highlight.pdf_name(),
+                "A" => dictionary! {
+                    "S" => "URI",
+                    "URI" => Object::string_literal(link.uri.as_str()),
+                },
+            };
+            set_border(&mut annot, style);
+            annots.push(Object::Reference(doc.add_object(annot)));
+        }
+        if annots.is_empty() {
+            continue;
+        }
+        let page = doc
+            .get_dictionary_mut(page_id)
+            .map_err(|e| format!("Read page: {e}"))?;
+        match page.get_mut(b"Annots") {
+            Ok(Object::Array(existing)) => existing.extend(annots),
+            _ => page.set("Annots", annots),
+        }
+    }
+    Ok(())
+}
+
+/// Write `style`'s border as `/Border` (read by every viewer) and, for a
+/// visible border, `/BS` and `/C`.
+fn set_border(annot: &mut Dictionary, style: &LinkStyle) {
+    let width = Object::Real(style.border_width);
+    let dash = || Object::Array(vec![3.into(), 3.into()]);
+    let mut border = vec![0.into(), 0.into(), width.clone()];
+    if style.border_style == LinkBorderStyle::Dashed {
+        border.push(dash());
+    }
+    annot.set("Border", border);
+    if style.border_width <= 0.0 {
+        return;
+    }
+    let mut bs = dictionary! {
+        "W" => width,
+        "S" => style.border_style.pdf_name(),
+    };
+    if style.border_style == LinkBorderStyle::Dashed {
+        bs.set("D", dash());
+    }
+    annot.set("BS", bs);
+    let color = style.border_color.iter().map(|&c| Object::Real(c));
+    annot.set("C", color.collect::<Vec<_>>());
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::layout_config::LinkHighlight;
+
+    #[test]
+    fn bare_urls_are_found_without_trailing_punctuation() {
+        let text = "See https://example.com/docs, or www.acme.io. Not http:// alone.";
+        let urls: Vec<&str> = find_urls(text).iter().map(|&(s, e)| &text[s..e]).collect();
+        assert_eq!(urls, vec!["https://example.com/docs", "www.acme.io"]);
+    }
+
+    fn annotation(style: &LinkStyle) -> Dictionary {
+        let mut doc = Document::with_version("1.7");
+        crate::test_pdf::add_pages(&mut doc, [(dictionary! {}, Vec::new())]);
+        let link = Link { rect: [10.0, 10.0, 50.0, 20.0], uri: "https://example.com".into() };
+        annotate(&mut doc, &[vec![link]], style, 1.0).unwrap();
+        let page = doc.get_pages()[&1];
+        let annots = doc.get_dictionary(page).unwrap().get(b"Annots").unwrap().as_array().unwrap();
+        doc.get_dictionary(annots[0].as_reference().unwrap()).unwrap().clone()
+    }
+
+    fn reals(obj: &Object) -> Vec<f32> {
+        obj.as_array().unwrap().iter().filter_map(|o| o.as_float().ok()).collect()
+    }
+
+    #[test]
+    fn default_links_have_no_border_and_invert_when_clicked() {
+        let annot = annotation(&LinkStyle::default());
+        assert_eq!(reals(annot.get(b"Border").unwrap()), vec![0.0, 0.0, 0.0]);
+        assert_eq!(annot.get(b"H").unwrap().as_name().unwrap(), b"I");
+        assert!(annot.get(b"BS").is_err());
+        assert!(annot.get(b"C").is_err());
+    }
+
+    #[test]
+    fn link_style_sets_border_color_and_highlight() {
+        let style = LinkStyle {
+            border_width: 1.5,
+            border_color: [0.0, 0.0, 1.0],
+            border_style: LinkBorderStyle::Dashed,
+            highlight: LinkHighlight::Outline,
+        };
+        let annot = annotation(&style);
+        let border = annot.get(b"Border").unwrap().as_array().unwrap();
+        assert_eq!(reals(annot.get(b"Border").unwrap()), vec![0.0, 0.0, 1.5]);
+        assert_eq!(reals(&border[3]), vec![3.0, 3.0]);
+        let bs = annot.get(b"BS").unwrap().as_dict().unwrap();
+        assert_eq!(bs.get(b"S").unwrap().as_name().unwrap(), b"D");
+        assert_eq!(reals(annot.get(b"C").unwrap()), vec![0.0, 0.0, 1.0]);
+        assert_eq!(annot.get(b"H").unwrap().as_name().unwrap(), b"O");
+    }
+}
@@ -0,0 +1,161 @@
+//! Resource cache – reuses expensive decoded resources (parsed font
+//! programs, decoded images) across renders.
+//!
+//! The renderer keys entries by a SHA-256 of the source bytes, prefixed with
+//! the resource kind (`font:…`, `image:…`), and stores them as type-erased
+//! `Arc`s.  Implement [`Cache`] to plug in another store; [`LruCache`] is
+//! the in-memory default.
+//!
+//! Images are only ever read from data URIs, so there are no network
+//! fetches to cache; keying by content still spares the PNG/JPEG decode.
+
+use std::any::Any;
+use std::collections::HashMap;
+use std::fmt::Debug;
+use std::sync::{Arc, Mutex};
+
+use sha2::{Digest, Sha256};
+
+/// A cached value; the renderer downcasts it back to its concrete type.
+pub type CacheValue = Arc<dyn Any + Send + Sync>;
+
+/// A thread-safe key/value store for decoded resources.  Shared between
+/// renders (and threads) through `PipelineConfig::cache`.
+pub trait Cache: Debug + Send + Sync {
+    fn get(&self, key: &str) -> Option<CacheValue>;
+    fn put(&self, key: String, value: CacheValue);
+}
+
+/// Build a cache key for `bytes` of the given resource kind.
+pub fn cache_key(kind: &str, bytes: &[u8]) -> String {
+    let digest = Sha256::digest(bytes);
+    let hex: String = digest.iter().map(|b| format!("{b:02x}")).collect();
+    format!("{kind}:{hex}")
+}
+
+/// Look `key` up in `cache` as a `T`, or build it with `make` and store it.
+/// Without a cache this is just `make()`.
+pub fn get_or_insert<T, E>(
+    cache: Option<&dyn Cache>,
+    key: impl FnOnce() -> String,
+    make: impl FnOnce() -> Result<T, E>,
+) -> Result<Arc<T>, E>
+where
+    T: Any + Send + Sync,
+{
+    let Some(cache) = cache else {
+        return make().map(Arc::new);
+    };
+    let key = key();
+    if let Some(hit) = cache.get(&key).and_then(|v| v.downcast::<T>().ok()) {
+        return Ok(hit);
+    }
+    let value = Arc::new(make()?);
+    cache.put(key, value.clone());
+    Ok(value)
+}
+
+/// In-memory cache that evicts the least recently used entry once it holds
+/// `capacity` entries.
+#[derive(Debug)]
+pub struct LruCache {
+    capacity: usize,
+    inner: Mutex<LruInner>,
+}
+
+#[derive(Debug, Default)]
+struct LruInner {
+    /// Value and the tick of its last use.
+    entries: HashMap<String, (CacheValue, u64)>,
+    tick: u64,
+}
+
+impl LruCache {
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            capacity: capacity.max(1),
+            inner: Mutex::new(LruInner::default()),
+        }
+    }
+
+    pub fn len(&self) -> usize {
+        self.inner.lock().unwrap_or_else(|e| e.into_inner()).entries.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+}
+
+impl Default for LruCache {
+    /// Room for 64 entries – a handful of fonts and logos.
+    fn default() -> Self {
+        Self::new(64)
+    }
+}
+
+impl Cache for LruCache {
+    fn get(&self, key: &str) -> Option<CacheValue> {
+        let mut inner = self.inner.lock().unwrap_or_else(|e| e.into_inner());
+        inner.tick += 1;
+        let tick = inner.tick;
+        inner.entries.get_mut(key).map(|(value, used)| {
+            *used = tick;
+            value.clone()
+        })
+    }
+
+    fn put(&self, key: String, value: CacheValue) {
+        let mut inner = self.inner.lock().unwrap_or_else(|e| e.into_inner());
+        inner.tick += 1;
+        let tick = inner.tick;
+        if !inner.entries.contains_key(&key) && inner.entries.len() >= self.capacity {
+            let oldest = inner
+                .entries
+                .iter()
+                .min_by_key(|(_, (_, used))| *used)
+                .map(|(k, _)| k.clone());
+            if let Some(oldest) = oldest {
+                inner.entries.remove(&oldest);
+            }
+        }
+        inner.entries.insert(key, (value, tick));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn lru_evicts_least_recently_used() {
+        let cache = LruCache::new(2);
+        cache.put("a".into(), Arc::new(1u32));
+        cache.put("b".into(), Arc::new(2u32));
+        assert!(cache.get("a").is_some()); // `b` is now the oldest
+        cache.put("c".into(), Arc::new(3u32));
+        assert_eq!(cache.len(), 2);
+        assert!(cache.get("b").is_none());
+        assert!(cache.get("a").is_some());
+        assert!(cache.get("c").is_some());
+    }
+
+    #[test]
+    fn get_or_insert_builds_once() {
+        let cache = LruCache::default();
+        let mut builds = 0;
+        for _ in 0..3 {
+            let value = get_or_insert::<String, ()>(
+                Some(&cache),
+                || cache_key("font", b"program"),
+                || {
+                    builds += 1;
+                    Ok("parsed".to_string())
+                },
+            )
+            .unwrap();
+            assert_eq!(*value, "parsed");
+        }
+        assert_eq!(builds, 1);
+    }
+}
@@ -0,0 +1,1095 @@
+//! Stylesheet support – parses author CSS (`<style>` blocks and
+//! caller-supplied overrides) into rules that the style resolver matches
+//! against DOM elements.
+//!
+//! Supported selectors: type (`p`), universal (`*`), class (`.total`),
+//! id (`#footer`), attribute (`[data-x]`, `[data-x="y"]`), compounds of
+//! those, and descendant / child (`>`) combinators, in comma-separated
+//! lists.  A selector may end in a `::before` or `::after` pseudo-element;
+//! such rules are read through [`Stylesheet::matching_pseudo`].  Rules using
+//! any other selector syntax are skipped, as are at-rules the engine does not
+//! understand.
+//!
+//! `@media` blocks are evaluated against the output [`Media`]: the media
+//! type is always `print`, and `orientation` / `width` / `height` features
+//! (with `min-` / `max-` prefixes) compare against the effective page size.
+//!
+//! `@supports` blocks apply when the engine implements the queried
+//! declarations (see [`crate::style::supports`]) or selectors.
+//!
+//! `@page` rules (optionally `:first`, `:left` or `:right`) are collected
+//! separately and read through [`Stylesheet::page_rules`]; only their
+//! declarations are kept, page-margin boxes such as `@top-center` are skipped.
+//!
+//! `@import` rules are resolved before parsing, and only for external
+//! stylesheets with a folder to read from (see [`resolve_imports`]).
+//!
+//! Declarations use the same property subset as inline `style` attributes.
+
+use std::borrow::Cow;
+use std::path::{Path, PathBuf};
+
+use base64::{engine::general_purpose::STANDARD as BASE64_STD, Engine as _};
+
+use crate::dom::{DomNode, ElementNode, Tag};
+
+/// Where a rule came from; later origins win regardless of specificity.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Origin {
+    /// The document's own `<style>` blocks, and external stylesheets
+    /// applied before them.
+    Document,
+    /// CSS supplied through `PipelineConfig::extra_css`.
+    Extra,
+}
+
+/// Selector specificity as `(ids, classes/attributes, types)`.
+pub type Specificity = (u32, u32, u32);
+
+/// Specificity of a single class selector.  Tailwind utility classes are
+/// applied at this level, so only more specific author rules beat them.
+pub const CLASS_SPECIFICITY: Specificity = (0, 1, 0);
+
+/// The medium media queries are evaluated against: a printed page.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Media {
+    /// Page width in points, after orientation is applied.
+    pub width: f32,
+    /// Page height in points, after orientation is applied.
+    pub height: f32,
+}
+
+impl Default for Media {
+    /// A4 portrait.
+    fn default() -> Self {
+        Self {
+            width: 595.28,
+            height: 841.89,
+        }
+    }
+}
+
+/// A parsed stylesheet: an ordered list of rules.
+#[derive(Debug, Clone, Default)]
+pub struct Stylesheet {
+    rules: Vec<Rule>,
+    pages: Vec<PageRule>,
+    media: Media,
+}
+
+/// One selector from a rule's selector list, with its declarations.
+#[derive(Debug, Clone)]
+pub struct Rule {
+    pub origin: Origin,
+    pub specificity: Specificity,
+    /// Position in the stylesheet, used to break specificity ties.
+    pub order: usize,
+    pub declarations: Vec<Declaration>,
+    /// The pseudo-element the rule styles, if any.
+    pub pseudo: Option<PseudoElement>,
+    selector: Selector,
+}
+
+/// A generated-content pseudo-element.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum PseudoElement {
+    Before,
+    After,
+}
+
+/// The pages an `@page` rule applies to.  Ordered by specificity: a
+/// `:first` rule beats `:left` / `:right`, which beat a bare `@page`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum PageSelector {
+    All,
+    Left,
+    Right,
+    First,
+}
+
+/// One `@page` rule with its declarations.
+#[derive(Debug, Clone)]
+pub struct PageRule {
+    pub origin: Origin,
+    pub selector: PageSelector,
+    /// Position among the `@page` rules, used to break ties.
+    pub order: usize,
+    pub declarations: Vec<Declaration>,
+}
+
+/// A `property: value` pair.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Declaration {
+    pub property: String,
+    pub value: String,
+    pub important: bool,
+}
+
+#[derive(Debug, Clone)]
+struct Selector {
+    /// Compound selectors from left to right; `combinators[i]` joins
+    /// `compounds[i]` and `compounds[i + 1]`.
+    compounds: Vec<Compound>,
+    combinators: Vec<Combinator>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Combinator {
+    Descendant,
+    Child,
+}
+
+#[derive(Debug, Clone, Default)]
+struct Compound {
+    tag: Option<String>,
+    id: Option<String>,
+    classes: Vec<String>,
+    attributes: Vec<(String, Option<String>)>,
+}
+
+impl Stylesheet {
+    /// An empty stylesheet whose `@media` blocks are evaluated against `media`.
+    pub fn new(media: Media) -> Self {
+        Self {
+            rules: Vec::new(),
+            pages: Vec::new(),
+            media,
+        }
+    }
+
+    /// Parse a stylesheet with [`Origin::Document`] for the default medium.
+    pub fn parse(css: &str) -> Self {
+        let mut sheet = Self::default();
+        sheet.append(css, Origin::Document);
+        sheet
+    }
+
+    /// Collect the contents of every `<style>` element in the document.
+    pub fn from_dom(nodes: &[DomNode]) -> Self {
+        let mut sheet = Self::default();
+        sheet.append_dom(nodes);
+        sheet
+    }
+
+    /// Add the contents of every `<style>` element in the document.
+    pub fn append_dom(&mut self, nodes: &[DomNode]) {
+        collect_style_blocks(nodes, self);
+    }
+
+    /// Parse `css` and add its rules after the existing ones.
+    pub fn append(&mut self, css: &str, origin: Origin) {
+        let css = strip_comments(css);
+        parse_rules(&css, origin, &self.media, &mut self.rules, &mut self.pages);
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.rules.is_empty() && self.pages.is_empty()
+    }
+
+    /// Every `@page` rule, in cascade order (lowest priority first).
+    pub fn page_rules(&self) -> Vec<&PageRule> {
+        let mut rules: Vec<&PageRule> = self.pages.iter().collect();
+        rules.sort_by_key(|r| (r.origin, r.selector, r.order));
+        rules
+    }
+
+    /// Rules whose selector matches `element`, in cascade order (lowest
+    /// priority first).  `ancestors` runs from the root down to the parent.
+    pub fn matching(&self, element: &ElementNode, ancestors: &[&ElementNode]) -> Vec<&Rule> {
+        self.matching_rules(element, ancestors, None)
+    }
+
+    /// Rules styling the `pseudo` element of `element`, in cascade order.
+    pub fn matching_pseudo(
+        &self,
+        element: &ElementNode,
+        ancestors: &[&ElementNode],
+        pseudo: PseudoElement,
+    ) -> Vec<&Rule> {
+        self.matching_rules(element, ancestors, Some(pseudo))
+    }
+
+    fn matching_rules(
+        &self,
+        element: &ElementNode,
+        ancestors: &[&ElementNode],
+        pseudo: Option<PseudoElement>,
+    ) -> Vec<&Rule> {
+        let mut matched: Vec<&Rule> = self
+            .rules
+            .iter()
+            .filter(|r| r.pseudo == pseudo && r.selector.matches(element, ancestors))
+            .collect();
+        matched.sort_by_key(|r| (r.origin, r.specificity, r.order));
+        matched
+    }
+}
+
+/// Child-index path to the first element of `nodes`, in document order,
+/// that `selector` matches.  The selector uses the syntax rules do, as a
+/// comma-separated list without pseudo-elements; `None` if it is unsupported
+/// or nothing matches.
+pub fn select_first(nodes: &[DomNode], selector: &str) -> Option<Vec<usize>> {
+    let selectors = selector
+        .split(',')
+        .map(|text| match Selector::parse(text.trim())? {
+            (selector, None) => Some(selector),
+            (_, Some(_)) => None,
+        })
+        .collect::<Option<Vec<_>>>()?;
+    let mut path = Vec::new();
+    first_match(nodes, &selectors, &mut Vec::new(), &mut path).then_some(path)
+}
+
+/// Depth-first search for [`select_first`], leaving the match's path in `path`.
+fn first_match<'a>(
+    nodes: &'a [DomNode],
+    selectors: &[Selector],
+    ancestors: &mut Vec<&'a ElementNode>,
+    path: &mut Vec<usize>,
+) -> bool {
+    for (index, node) in nodes.iter().enumerate() {
+        let DomNode::Element(element) = node else {
+            continue;
+        };
+        path.push(index);
+        if selectors.iter().any(|s| s.matches(element, ancestors)) {
+            return true;
+        }
+        ancestors.push(element);
+        let found = first_match(&element.children, selectors, ancestors, path);
+        ancestors.pop();
+        if found {
+            return true;
+        }
+        path.pop();
+    }
+    false
+}
+
+/// Inline the relative `url(…)` references of an external stylesheet as
+/// data URIs, reading each file relative to `base` – images are only loaded
+/// from data URIs.  Data URIs and other absolute URLs are left alone, as are
+/// files that cannot be read (reported as missing assets).
+pub fn inline_relative_urls(css: &str, base: &Path) -> String {
+    let mut out = String::with_capacity(css.len());
+    let mut rest = css;
+    while let Some(at) = rest.find("url(") {
+        let (before, tail) = rest.split_at(at + "url(".len());
+        out.push_str(before);
+        let close = tail.find(')').unwrap_or(tail.len());
+        let written = &tail[..close];
+        let target = written.trim().trim_matches(['"', '\'']);
+        match file_data_uri(target, base) {
+            Some(uri) => out.push_str(&uri),
+            None => out.push_str(written),
+        }
+        rest = &tail[close..];
+    }
+    out.push_str(rest);
+    out
+}
+
+/// Replace the top-level `@import` rules of an external stylesheet with the
+/// imported files, read relative to `base`, and inline the relative `url()`s
+/// of every file as [`inline_relative_urls`] does.  An import's media list
+/// wraps its rules in an `@media` block.  Imports of absolute URLs, of files
+/// that cannot be read (reported as missing assets) and of a file that is
+/// already being imported (a cycle) are skipped.
+pub fn resolve_imports(css: &str, base: &Path) -> String {
+    resolve_imports_in(css, base, &mut Vec::new())
+}
+
+fn resolve_imports_in(css: &str, base: &Path, importing: &mut Vec<PathBuf>) -> String {
+    let css = strip_comments(css);
+    let mut out = String::with_capacity(css.len());
+    let mut rest = css.as_str();
+    while let Some(at) = find_top_level_import(rest) {
+        out.push_str(&inline_relative_urls(&rest[..at], base));
+        let end = rest[at..].find(';').map_or(rest.len(), |e| at + e + 1);
+        let statement = rest[at + "@import".len()..end].trim_end_matches(';');
+        if let Some(imported) = import_file(statement, base, importing) {
+            out.push_str(&imported);
+        }
+        rest = &rest[end..];
+    }
+    out.push_str(&inline_relative_urls(rest, base));
+    out
+}
+
+/// Byte offset of the first `@import` outside any block.
+fn find_top_level_import(css: &str) -> Option<usize> {
+    let mut depth = 0usize;
+    for (i, c) in css.char_indices() {
+        match c {
+            '{' => depth += 1,
+            '}' => depth = depth.saturating_sub(1),
+            '@' if depth == 0 && css[i..].starts_with("@import") => return Some(i),
+            _ => {}
+        }
+    }
+    None
+}
+
+/// The resolved rules of one `@import` statement (the text after the
+/// keyword), or `None` when it is skipped.
+fn import_file(statement: &str, base: &Path, importing: &mut Vec<PathBuf>) -> Option<String> {
+    let Some((target, media)) = import_target(statement.trim()) else {
+        let message = format!("Skipping malformed `@import {}`", statement.trim());
+        crate::diagnostics::warn("css", message);
+        return None;
+    };
+    if target.is_empty() || target.contains(':') {
+        let message = format!("Skipping @import of {target}: only local files can be imported");
+        crate::diagnostics::warn("css", message);
+        return None;
+    }
+    let path = base.join(target);
+    let key = path.canonicalize().unwrap_or_else(|_| path.clone());
+    if importing.contains(&key) {
+        let message = format!("Skipping @import of {}: import cycle", path.display());
+        crate::diagnostics::warn("css", message);
+        return None;
+    }
+    let css = match std::fs::read_to_string(&path) {
+        Ok(css) => css,
+        Err(e) => {
+            let message = format!("Skipping @import of {}: {e}", path.display());
+            crate::diagnostics::missing_asset("css", message);
+            return None;
+        }
+    };
+    importing.push(key);
+    let folder = path.parent().unwrap_or(Path::new(""));
+    let css = resolve_imports_in(&css, folder, importing);
+    importing.pop();
+    let media = media.trim();
+    if media.is_empty() {
+        Some(css)
+    } else {
+        Some(format!("@media {media} {{\n{css}\n}}"))
+    }
+}
+
+/// Split `url("x.css") print` or `"x.css" print` into the target and the
+/// media list.
+fn import_target(statement: &str) -> Option<(&str, &str)> {
+    if let Some(args) = statement.strip_prefix("url(") {
+        let close = args.find(')')?;
+        let target = args[..close].trim().trim_matches(['"', '\'']);
+        return Some((target, &args[close + 1..]));
+    }
+    let quote = statement.chars().next().filter(|c| matches!(c, '"' | '\''))?;
+    let close = statement[1..].find(quote)? + 1;
+    Some((&statement[1..close], &statement[close + 1..]))
+}
+
+/// `target`, resolved against `base`, as a data URI – `None` for absolute
+/// URLs (anything with a scheme) and fragment references.
+fn file_data_uri(target: &str, base: &Path) -> Option<String> {
+    if target.is_empty() || target.contains(':') || target.starts_with('#') {
+        return None;
+    }
+    let path = base.join(target);
+    let extension = path.extension().and_then(|e| e.to_str());
+    let mime = match extension.map(str::to_ascii_lowercase).as_deref() {
+        Some("png") => "image/png",
+        Some("jpg" | "jpeg") => "image/jpeg",
+        Some("gif") => "image/gif",
+        Some("webp") => "image/webp",
+        _ => "application/octet-stream",
+    };
+    match std::fs::read(&path) {
+        Ok(bytes) => Some(format!("data:{mime};base64,{}", BASE64_STD.encode(bytes))),
+        Err(e) => {
+            let message = format!("Leaving url({target}) as written: {}: {e}", path.display());
+            crate::diagnostics::missing_asset("css", message);
+            None
+        }
+    }
+}
+
+fn collect_style_blocks(nodes: &[DomNode], sheet: &mut Stylesheet) {
+    for node in nodes {
+        if let DomNode::Element(e) = node {
+            if e.tag == Tag::Style {
+                for child in &e.children {
+                    if let DomNode::Text(css) = child {
+                        sheet.append(css, Origin::Document);
+                    }
+                }
+            } else {
+                collect_style_blocks(&e.children, sheet);
+            }
+        }
+    }
+}
+
+// ---------------------------------------------------------------------------
+// Parsing
+// ---------------------------------------------------------------------------
+
+fn strip_comments(css: &str) -> String {
+    let mut out = String::with_capacity(css.len());
+    let mut rest = css;
+    while let Some(start) = rest.find("/*") {
+        out.push_str(&rest[..start]);
+        match rest[start + 2..].find("*/") {
+            Some(end) => rest = &rest[start + 2 + end + 2..],
+            None => return out,
+        }
+    }
+    out.push_str(rest);
+    out
+}
+
+/// Return the index just past the `}` that closes the block opened at `open`.
+fn block_end(css: &str, open: usize) -> usize {
+    let mut depth = 0usize;
+    for (i, c) in css[open..].char_indices() {
+        match c {
+            '{' => depth += 1,
+            '}' => {
+                depth -= 1;
+                if depth == 0 {
+                    return open + i + 1;
+                }
+            }
+            _ => {}
+        }
+    }
+    css.len()
+}
+
+fn parse_rules(
+    css: &str,
+    origin: Origin,
+    media: &Media,
+    rules: &mut Vec<Rule>,
+    pages: &mut Vec<PageRule>,
+) {
+    let mut pos = 0;
+    while pos < css.len() {
+        let rest = &css[pos..];
+        let trimmed = rest.trim_start();
+        if trimmed.is_empty() {
+            break;
+        }
+        pos += rest.len() - trimmed.len();
+
+        if trimmed.starts_with('@') {
+            // At-rules: statements end at `;`, blocks are skipped whole
+            // unless they are `@media` or `@supports` blocks that match, or
+            // `@page`.
+            let semi = trimmed.find(';');
+            let brace = trimmed.find('{');
+            let start = pos;
+            pos = match (semi, brace) {
+                (Some(s), Some(b)) if s < b => pos + s + 1,
+                (_, Some(b)) => block_end(css, pos + b),
+                (Some(s), None) => pos + s + 1,
+                (None, None) => css.len(),
+            };
+            let block = brace.filter(|&b| semi.map_or(true, |s| b < s));
+            match (trimmed.strip_prefix("@media"), block) {
+                (Some(query), Some(b)) => {
+                    if media_matches(&query[..b - "@media".len()], media) {
+                        let inner = &css[start + b + 1..pos];
+                        let inner = inner.strip_suffix('}').unwrap_or(inner);
+                        parse_rules(inner, origin, media, rules, pages);
+                    }
+                }
+                (None, Some(b)) if at_rule_name(trimmed) == "@supports" => {
+                    if supports_matches(&trimmed["@supports".len()..b]) {
+                        let inner = &css[start + b + 1..pos];
+                        let inner = inner.strip_suffix('}').unwrap_or(inner);
+                        parse_rules(inner, origin, media, rules, pages);
+                    }
+                }
+                (None, Some(b)) if at_rule_name(trimmed) == "@page" => {
+                    let prelude = trimmed["@page".len()..b].trim();
+                    let inner = &css[start + b + 1..pos];
+                    let inner = inner.strip_suffix('}').unwrap_or(inner);
+                    match PageSelector::parse(prelude) {
+                        Some(selector) => pages.push(PageRule {
+                            origin,
+                            selector,
+                            order: pages.len(),
+                            declarations: parse_declarations(&strip_margin_boxes(inner)),
+                        }),
+                        None => crate::diagnostics::warn(
+                            "css",
+                            format!("Skipping unsupported page selector `@page {prelude}`"),
+                        ),
+                    }
+                }
+                _ => crate::diagnostics::warn(
+                    "css",
+                    format!("Skipping unsupported at-rule `{}`", at_rule_name(trimmed)),
+                ),
+            }
+            continue;
+        }
+
+        let Some(brace) = trimmed.find('{') else {
+            break;
+        };
+        let end = block_end(css, pos + brace);
+        let prelude = &trimmed[..brace];
+        let body = css[pos + brace + 1..end].trim_end_matches('}');
+        pos = end;
+
+        let declarations = parse_declarations(body);
+        if declarations.is_empty() {
+            continue;
+        }
+        for text in prelude.split(',') {
+            match Selector::parse(text.trim()) {
+                Some((selector, pseudo)) => rules.push(Rule {
+                    origin,
+                    specificity: selector.specificity(pseudo),
+                    order: rules.len(),
+                    declarations: declarations.clone(),
+                    pseudo,
+                    selector,
+                }),
+                None => crate::diagnostics::warn(
+                    "css",
+                    format!("Skipping unsupported selector `{}`", text.trim()),
+                ),
+            }
+        }
+    }
+}
+
+impl PageSelector {
+    /// Parse the prelude of an `@page` rule; named pages and `:blank` are
+    /// not supported.
+    fn parse(prelude: &str) -> Option<Self> {
+        match prelude.to_ascii_lowercase().as_str() {
+            "" => Some(Self::All),
+            ":first" => Some(Self::First),
+            ":left" => Some(Self::Left),
+            ":right" => Some(Self::Right),
+            _ => None,
+        }
+    }
+}
+
+/// Drop nested page-margin boxes (`@top-center { … }`) from an `@page` body.
+fn strip_margin_boxes(body: &str) -> String {
+    let mut out = String::with_capacity(body.len());
+    let mut rest = body;
+    while let Some(at) = rest.find('@') {
+        out.push_str(&rest[..at]);
+        let tail = &rest[at..];
+        crate::diagnostics::warn(
+            "css",
+            format!(
+                "Skipping unsupported page-margin box `{}`",
+                at_rule_name(tail)
+            ),
+        );
+        rest = match tail.find('{') {
+            Some(open) => &tail[block_end(tail, open)..],
+            None => "",
+        };
+    }
+    out.push_str(rest);
+    out
+}
+
+/// `@name` at the start of an at-rule.
+fn at_rule_name(rule: &str) -> &str {
+    let len = 1 + ident_len(&rule[1..]);
+    &rule[..len]
+}
+
+/// Evaluate a comma-separated media query list.  Unknown media features
+/// make their query false, so rules meant for other media never apply.
+fn media_matches(list: &str, media: &Media) -> bool {
+    list.split(',').any(|query| media_query_matches(query, media))
+}
+
+fn media_query_matches(query: &str, media: &Media) -> bool {
+    let query = query.trim().to_ascii_lowercase();
+    let (negated, query) = match query.strip_prefix("not ") {
+        Some(rest) => (true, rest.trim_start()),
+        None => (false, query.strip_prefix("only ").unwrap_or(&query).trim_start()),
+    };
+    if query.is_empty() {
+        return negated;
+    }
+    let mut result = true;
+    for (i, term) in query.split(" and ").enumerate() {
+        let term = term.trim();
+        let matched = if let Some(feature) = term.strip_prefix('(') {
+            media_feature_matches(feature.trim_end_matches(')'), media)
+        } else if i == 0 {
+            matches!(term, "all" | "print")
+        } else {
+            false
+        };
+        result &= matched;
+    }
+    result != negated
+}
+
+fn media_feature_matches(feature: &str, media: &Media) -> bool {
+    let Some((name, value)) = feature.split_once(':') else {
+        return false;
+    };
+    let value = value.trim();
+    if name.trim() == "orientation" {
+        let landscape = media.width > media.height;
+        return match value {
+            "landscape" => landscape,
+            "portrait" => !landscape,
+            _ => false,
+        };
+    }
+    let Some(length) = media_length(value) else {
+        return false;
+    };
+    match name.trim() {
+        "width" => (media.width - length).abs() < 0.5,
+        "min-width" => media.width >= length,
+        "max-width" => media.width <= length,
+        "height" => (media.height - length).abs() < 0.5,
+        "min-height" => media.height >= length,
+        "max-height" => media.height <= length,
+        _ => false,
+    }
+}
+
+/// Evaluate an `@supports` condition against what the engine implements:
+/// `(prop: value)` asks [`crate::style::supports`], `selector(…)` whether
+/// the selector parses, combined with `not`, `and` and `or`.  Conditions
+/// that cannot be parsed are false.
+fn supports_matches(condition: &str) -> bool {
+    let condition = condition.trim().to_ascii_lowercase();
+    if let Some(rest) = condition.strip_prefix("not") {
+        return rest.starts_with([' ', '(']) && !supports_in_parens(rest.trim_start());
+    }
+    let all = split_top_level(&condition, " and ");
+    let any = split_top_level(&condition, " or ");
+    match (all.len(), any.len()) {
+        (1, 1) => supports_in_parens(&condition),
+        (_, 1) => all.iter().all(|term| supports_in_parens(term)),
+        (1, _) => any.iter().any(|term| supports_in_parens(term)),
+        // Mixing `and` and `or` without parentheses is invalid.
+        _ => false,
+    }
+}
+
+/// One parenthesised `@supports` term: a declaration, a nested condition or
+/// a `selector()` function.
+fn supports_in_parens(term: &str) -> bool {
+    let term = term.trim();
+    if let Some(selector) = term.strip_prefix("selector(") {
+        let selector = selector.strip_suffix(')').unwrap_or(selector);
+        return Selector::parse(selector.trim()).is_some();
+    }
+    let Some(inner) = term.strip_prefix('(').and_then(|t| t.strip_suffix(')')) else {
+        return false;
+    };
+    let inner = inner.trim();
+    let nested = ["(", "not ", "selector("]
+        .iter()
+        .any(|p| inner.starts_with(p));
+    match inner.split_once(':') {
+        Some((prop, value)) if !nested => crate::style::supports(prop.trim(), value.trim()),
+        _ => supports_matches(inner),
+    }
+}
+
+/// Split `text` at each `separator` outside parentheses.
+fn split_top_level<'a>(text: &'a str, separator: &str) -> Vec<&'a str> {
+    let mut parts = Vec::new();
+    let (mut depth, mut start) = (0i32, 0);
+    for (i, c) in text.char_indices() {
+        match c {
+            '(' => depth += 1,
+            ')' => depth -= 1,
+            _ if depth == 0 && text[i..].starts_with(separator) => {
+                parts.push(&text[start..i]);
+                start = i + separator.len();
+            }
+            _ => {}
+        }
+    }
+    parts.push(&text[start..]);
+    parts
+}
+
+/// A media query (or `@page` margin) length in points.  As elsewhere in the
+/// engine, `px` and `pt` are the same unit.
+pub(crate) fn media_length(value: &str) -> Option<f32> {
+    let split = value
+        .find(|c: char| !(c.is_ascii_digit() || c == '.'))
+        .unwrap_or(value.len());
+    let number: f32 = value[..split].parse().ok()?;
+    let scale = match value[split..].trim() {
+        "" | "px" | "pt" => 1.0,
+        "in" => 72.0,
+        "cm" => 72.0 / 2.54,
+        "mm" => 72.0 / 25.4,
+        _ => return None,
+    };
+    Some(number * scale)
+}
+
+/// Parse a `prop: value; …` declaration block.
+pub fn parse_declarations(body: &str) -> Vec<Declaration> {
+    let mut out = Vec::new();
+    for decl in split_declarations(body) {
+        let Some((prop, val)) = decl.split_once(':') else {
+            continue;
+        };
+        let prop = prop.trim().to_ascii_lowercase();
+        let mut value = val.trim();
+        let important = match value.to_ascii_lowercase().rfind("!important") {
+            Some(i) => {
+                value = value[..i].trim_end();
+                true
+            }
+            None => false,
+        };
+        if prop.is_empty() || value.is_empty() {
+            continue;
+        }
+        out.push(Declaration {
+            property: prop,
+            value: value.to_string(),
+            important,
+        });
+    }
+    out
+}
+
+/// Split a declaration block on the `;` that end declarations, ignoring any
+/// inside parentheses or quotes (as in `url(data:image/png;base64,…)`).
+pub fn split_declarations(body: &str) -> Vec<&str> {
+    let mut parts = Vec::new();
+    let (mut depth, mut quote, mut start) = (0usize, None, 0);
+    for (i, c) in body.char_indices() {
+        match (quote, c) {
+            (Some(q), _) if c == q => quote = None,
+            (Some(_), _) => {}
+            (None, '"' | '\'') => quote = Some(c),
+            (None, '(') => depth += 1,
+            (None, ')') => depth = depth.saturating_sub(1),
+            (None, ';') if depth == 0 => {
+                parts.push(&body[start..i]);
+                start = i + 1;
+            }
+            _ => {}
+        }
+    }
+    parts.push(&body[start..]);
+    parts
+}
+
+impl PseudoElement {
+    /// Split a trailing `::before` / `::after` (or the legacy single-colon
+    /// form) off a selector.  A bare pseudo-element applies to any element.
+    fn split(text: &str) -> (Cow<'_, str>, Option<Self>) {
+        let lower = text.to_ascii_lowercase();
+        for (suffix, pseudo) in [
+            ("::before", Self::Before),
+            ("::after", Self::After),
+            (":before", Self::Before),
+            (":after", Self::After),
+        ] {
+            if lower.ends_with(suffix) {
+                let base = &text[..text.len() - suffix.len()];
+                return match base.chars().last() {
+                    None | Some(' ' | '>') => (Cow::Owned(format!("{base}*")), Some(pseudo)),
+                    _ => (Cow::Borrowed(base), Some(pseudo)),
+                };
+            }
+        }
+        (Cow::Borrowed(text), None)
+    }
+}
+
+impl Selector {
+    /// Parse one selector, with the pseudo-element it ends in.
+    fn parse(text: &str) -> Option<(Self, Option<PseudoElement>)> {
+        let (text, pseudo) = PseudoElement::split(text);
+        Some((Self::parse_compounds(&text)?, pseudo))
+    }
+
+    fn parse_compounds(text: &str) -> Option<Self> {
+        if text.is_empty() {
+            return None;
+        }
+        let mut compounds = Vec::new();
+        let mut combinators = Vec::new();
+        let mut pending: Option<Combinator> = None;
+
+        // Put spaces around `>` so it tokenises like a descendant gap.
+        let spaced = text.replace('>', " > ");
+        for token in spaced.split_whitespace() {
+            if token == ">" {
+                if compounds.is_empty() || pending == Some(Combinator::Child) {
+                    return None;
+                }
+                pending = Some(Combinator::Child);
+                continue;
+            }
+            let compound = Compound::parse(token)?;
+            if !compounds.is_empty() {
+                combinators.push(pending.unwrap_or(Combinator::Descendant));
+            }
+            pending = None;
+            compounds.push(compound);
+        }
+        if compounds.is_empty() || pending.is_some() {
+            return None;
+        }
+        Some(Self {
+            compounds,
+            combinators,
+        })
+    }
+
+    /// Specificity; a pseudo-element counts like a type selector.
+    fn specificity(&self, pseudo: Option<PseudoElement>) -> Specificity {
+        let init = (0, 0, pseudo.is_some() as u32);
+        self.compounds.iter().fold(init, |(a, b, c), comp| {
+            (
+                a + comp.id.is_some() as u32,
+                b + (comp.classes.len() + comp.attributes.len()) as u32,
+                c + comp.tag.is_some() as u32,
+            )
+        })
+    }
+
+    fn matches(&self, element: &ElementNode, ancestors: &[&ElementNode]) -> bool {
+        let (last, rest) = self.compounds.split_last().expect("non-empty selector");
+        last.matches(element) && self.matches_ancestors(rest.len(), ancestors)
+    }
+
+    /// Match `compounds[..count]` against `ancestors`, honouring the
+    /// combinator that joins each compound to the one after it.
+    fn matches_ancestors(&self, count: usize, ancestors: &[&ElementNode]) -> bool {
+        if count == 0 {
+            return true;
+        }
+        let compound = &self.compounds[count - 1];
+        match self.combinators[count - 1] {
+            Combinator::Child => match ancestors.split_last() {
+                Some((parent, above)) => {
+                    compound.matches(parent) && self.matches_ancestors(count - 1, above)
+                }
+                None => false,
+            },
+            Combinator::Descendant => (0..ancestors.len()).rev().any(|i| {
+                compound.matches(ancestors[i]) && self.matches_ancestors(count - 1, &ancestors[..i])
+            }),
+        }
+    }
+}
+
+impl Compound {
+    fn parse(token: &str) -> Option<Self> {
+        let mut compound = Compound::default();
+        let mut rest = token;
+
+        let name_len = ident_len(rest);
+        if rest.starts_with('*') {
+            rest = &rest[1..];
+        } else if name_len > 0 {
+            compound.tag = Some(rest[..name_len].to_ascii_lowercase());
+            rest = &rest[name_len..];
+        }
+
+        while let Some(c) = rest.chars().next() {
+            match c {
+                '.' | '#' => {
+                    let len = ident_len(&rest[1..]);
+                    if len == 0 {
+                        return None;
+                    }
+                    let name = rest[1..1 + len].to_string();
+                    if c == '.' {
+                        compound.classes.push(name);
+                    } else {
+                        compound.id = Some(name);
+                    }
+                    rest = &rest[1 + len..];
+                }
+                '[' => {
+                    let close = rest.find(']')?;
+                    let inner = &rest[1..close];
+                    let attr = match inner.split_once('=') {
+                        Some((name, value)) => (
+                            name.trim().to_ascii_lowercase(),
+                            Some(value.trim().trim_matches(|q| q == '"' || q == '\'').to_string()),
+                        ),
+                        None => (inner.trim().to_ascii_lowercase(), None),
+                    };
+                    if attr.0.is_empty() || ident_len(&attr.0) != attr.0.len() {
+                        return None;
+                    }
+                    compound.attributes.push(attr);
+                    rest = &rest[close + 1..];
+                }
+                // Pseudo-classes, `+` / `~` combinators, etc.
+                _ => return None,
+            }
+        }
+        Some(compound)
+    }
+
+    fn matches(&self, element: &ElementNode) -> bool {
+        if let Some(tag) = &self.tag {
+            if element.tag.name() != *tag {
+                return false;
+            }
+        }
+        if let Some(id) = &self.id {
+            if element.attributes.get("id") != Some(id) {
+                return false;
+            }
+        }
+        let classes = element.classes();
+        if !self.classes.iter().all(|c| classes.contains(&c.as_str())) {
+            return false;
+        }
+        self.attributes
+            .iter()
+            .all(|(name, value)| match (element.attributes.get(name), value) {
+                (Some(_), None) => true,
+                (Some(actual), Some(expected)) => actual == expected,
+                (None, _) => false,
+            })
+    }
+}
+
+/// Length in bytes of the CSS identifier at the start of `s`.
+fn ident_len(s: &str) -> usize {
+    s.char_indices()
+        .find(|&(_, c)| !(c.is_alphanumeric() || c == '-' || c == '_'))
+        .map(|(i, _)| i)
+        .unwrap_or(s.len())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::dom::parse_html;
+
+    fn first_element(html: &str) -> ElementNode {
+        match parse_html(html).into_iter().next() {
+            Some(DomNode::Element(e)) => e,
+            _ => panic!("Expected element"),
+        }
+    }
+
+    #[test]
+    fn parses_rules_and_skips_unsupported() {
+        let sheet = Stylesheet::parse(
+            "/* c */ p, .a { color: #f00 } @media screen { p { color: #0f0 } } a:hover { x: y }",
+        );
+        assert_eq!(sheet.rules.len(), 2);
+        assert_eq!(sheet.rules[0].specificity, (0, 0, 1));
+        assert_eq!(sheet.rules[1].specificity, CLASS_SPECIFICITY);
+        assert_eq!(sheet.rules[0].declarations[0].value, "#f00");
+    }
+
+    #[test]
+    fn matches_descendant_and_child_combinators() {
+        let div = first_element(r#"<div id="main"><p class="x" data-k="v">Hi</p></div>"#);
+        let p = match &div.children[0] {
+            DomNode::Element(e) => e.clone(),
+            _ => panic!("Expected p"),
+        };
+        let ancestors = [&div];
+        let sheet = Stylesheet::parse(
+            "#main > p.x { color: #111 } body p { color: #222 } div [data-k=\"v\"] { color: #333 }",
+        );
+        let matched = sheet.matching(&p, &ancestors);
+        let values: Vec<&str> = matched
+            .iter()
+            .map(|r| r.declarations[0].value.as_str())
+            .collect();
+        // Sorted by specificity: the attribute rule (0,1,1) before the id rule (1,1,1).
+        assert_eq!(values, vec!["#333", "#111"]);
+    }
+
+    #[test]
+    fn pseudo_element_rules_match_only_through_matching_pseudo() {
+        let li = first_element("<li>Item</li>");
+        let sheet = Stylesheet::parse(
+            "li::before { content: '- ' } li:after { content: '.' } ::before { color: #f00 } \
+             li { color: #00f }",
+        );
+        assert_eq!(sheet.matching(&li, &[]).len(), 1);
+
+        let before = sheet.matching_pseudo(&li, &[], PseudoElement::Before);
+        let values: Vec<&str> = before
+            .iter()
+            .map(|r| r.declarations[0].value.as_str())
+            .collect();
+        // `*::before` (0,0,1) sorts before `li::before` (0,0,2).
+        assert_eq!(values, vec!["#f00", "'- '"]);
+        let after = sheet.matching_pseudo(&li, &[], PseudoElement::After);
+        assert_eq!(after.len(), 1);
+    }
+
+    #[test]
+    fn media_queries_follow_page_orientation_and_size() {
+        let css = "@media print and (orientation: landscape) { p { color: #f00 } } \
+                   @media screen, (min-width: 10in) { p { color: #0f0 } } \
+                   @media not print { p { color: #00f } }";
+        let portrait = Stylesheet::parse(css);
+        assert!(portrait.is_empty());
+
+        let mut landscape = Stylesheet::new(Media {
+            width: 841.89,
+            height: 595.28,
+        });
+        landscape.append(css, Origin::Document);
+        let values: Vec<&str> = landscape
+            .rules
+            .iter()
+            .map(|r| r.declarations[0].value.as_str())
+            .collect();
+        assert_eq!(values, vec!["#f00", "#0f0"]);
+    }
+
+    #[test]
+    fn supports_blocks_follow_engine_features() {
+        let css = "@supports (display: grid) { p { color: #f00 } } \
+                   @supports not (display: grid) { p { color: #0f0 } } \
+                   @supports (display: contents) or (filter: blur(2px)) { p { color: #00f } } \
+                   @supports (color: red) and (not (display: ruby)) { p { color: #ff0 } } \
+                   @supports selector(li > p) { p { color: #0ff } }";
+        let sheet = Stylesheet::parse(css);
+        let values: Vec<&str> = sheet
+            .rules
+            .iter()
+            .map(|r| r.declarations[0].value.as_str())
+            .collect();
+        assert_eq!(values, vec!["#f00", "#ff0", "#0ff"]);
+    }
+
+    #[test]
+    fn page_rules_are_collected_in_cascade_order() {
+        let sheet = Stylesheet::parse(
+            "@page :first { margin-top: 1in } @page { margin: 20mm; @top-center { content: 'x' } } \
+             @page :left { margin-left: 50px } @page cover { margin: 0 }",
+        );
+        let rules = sheet.page_rules();
+        let selectors: Vec<PageSelector> = rules.iter().map(|r| r.selector).collect();
+        assert_eq!(
+            selectors,
+            vec![PageSelector::All, PageSelector::Left, PageSelector::First]
+        );
+        assert_eq!(rules[0].declarations.len(), 1);
+        assert_eq!(rules[0].declarations[0].value, "20mm");
+        assert!(sheet.rules.is_empty());
+    }
+}
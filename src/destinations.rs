@@ -0,0 +1,133 @@
+//! Named destinations – lets links from outside the document open it at an
+//! element, as in `report.pdf#nameddest=intro` (see
+//! `PipelineConfig::named_destinations`).
+//!
+//! Every element with an `id` becomes an entry in the catalog's `/Dests`
+//! name tree that shows its page with the element's top-left corner at the
+//! top-left of the window.  An element split across pages points to its
+//! first part; when an id repeats, the first element wins.
+
+use std::collections::BTreeMap;
+
+use lopdf::{dictionary, Dictionary, Document, Object};
+
+use crate::layout_config::{LayoutBox, PageLayout};
+
+/// Where a named destination points.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Destination {
+    /// Zero-based page index.
+    pub page: usize,
+    /// `[left, top]` in PDF user space (points, y up).
+    pub point: [f32; 2],
+}
+
+/// The destination of every element id on `pages`, by id.  `scale` is the
+/// viewport scale the pages are drawn at (points per layout unit).
+pub fn collect(
+    pages: &[PageLayout],
+    page_height: f32,
+    scale: f32,
+) -> BTreeMap<String, Destination> {
+    let mut dests = BTreeMap::new();
+    for (page, layout) in pages.iter().enumerate() {
+        for lbox in &layout.boxes {
+            visit(lbox, &mut |id, x, y| {
+                let point = [x * scale, page_height - y * scale];
+                dests.entry(id.to_string()).or_insert(Destination { page, point });
+            });
+        }
+    }
+    dests
+}
+
+/// Report `(id, x, y)` for `lbox` and each descendant that has an id, in
+/// document order.
+fn visit(lbox: &LayoutBox, found: &mut dyn FnMut(&str, f32, f32)) {
+    if let Some(id) = &lbox.id {
+        found(id, lbox.x, lbox.y);
+    }
+    for child in &lbox.children {
+        visit(child, found);
+    }
+}
+
+/// Write `dests` to the catalog's `/Dests` name tree, replacing any there.
+/// A name tree's keys must be sorted, which `BTreeMap` already does.
+pub fn write(
+    doc: &mut Document,
+    dests: &BTreeMap<String, Destination>,
+    user_unit: f32,
+) -> Result<(), String> {
+    let page_ids: Vec<_> = doc.get_pages().into_values().collect();
+    let mut names = Vec::new();
+    for (name, dest) in dests {
+        let Some(&page_id) = page_ids.get(dest.page) else {
+            continue;
+        };
+        let [left, top] = dest.point.map(|v| Object::Real(v / user_unit));
+        names.push(Object::string_literal(name.as_str()));
+        names.push(Object::Array(vec![
+            Object::Reference(page_id),
+            "XYZ".into(),
+            left,
+            top,
+            Object::Null,
+        ]));
+    }
+    if names.is_empty() {
+        return Ok(());
+    }
+    let tree = Object::Reference(doc.add_object(dictionary! { "Names" => names }));
+    names_dictionary(doc)?.set("Dests", tree);
+    Ok(())
+}
+
+/// The catalog's `/Names` dictionary, created if there is none.
+pub(crate) fn names_dictionary(doc: &mut Document) -> Result<&mut Dictionary, String> {
+    let catalog = doc.catalog().map_err(|e| format!("Read catalog: {e}"))?;
+    let shared = match catalog.get(b"Names") {
+        Ok(Object::Reference(id)) => Some(*id),
+        _ => None,
+    };
+    match shared {
+        Some(id) => doc
+            .get_dictionary_mut(id)
+            .map_err(|e| format!("Read name dictionary: {e}")),
+        None => {
+            let catalog = doc.catalog_mut().map_err(|e| format!("Read catalog: {e}"))?;
+            if !matches!(catalog.get(b"Names"), Ok(Object::Dictionary(_))) {
+                catalog.set("Names", dictionary! {});
+            }
+            catalog
+                .get_mut(b"Names")
+                .and_then(Object::as_dict_mut)
+                .map_err(|e| format!("Read name dictionary: {e}"))
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn first_box_of_each_id_is_its_destination() {
+        let page = |boxes| PageLayout {
+            page_index: 0,
+            boxes,
+        };
+        let with_id = |id: &str, y| LayoutBox {
+            id: Some(id.to_string()),
+            ..LayoutBox::new(10.0, y, 100.0, 20.0)
+        };
+        let mut outer = LayoutBox::new(0.0, 0.0, 200.0, 200.0);
+        outer.children.push(with_id("intro", 50.0));
+        let pages = [page(vec![outer]), page(vec![with_id("intro", 5.0), with_id("end", 30.0)])];
+        let dests = collect(&pages, 800.0, 2.0);
+        let expected = |page, point| Destination { page, point };
+        assert_eq!(dests["intro"], expected(0, [20.0, 700.0]));
+        assert_eq!(dests["end"], expected(1, [20.0, 740.0]));
+        assert_eq!(dests.len(), 2);
+    }
+}
@@ -0,0 +1,111 @@
+//! Diagnostics – non-fatal problems found while generating a document.
+//!
+//! Pipeline stages report degradations (a skipped image, a dropped CSS rule,
+//! a character the font cannot draw) through [`warn`], or [`missing_asset`]
+//! when a resource the document asked for could not be loaded.  The message is
+//! logged and, while a [`collect`] call is running on the current thread,
+//! recorded so the pipeline can hand it back to the caller – or, in strict
+//! mode, fail the render with it.  It also goes to the current
+//! [`event sink`](crate::events), if any.
+
+use std::cell::RefCell;
+use std::fmt;
+
+/// One reported degradation.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Diagnostic {
+    /// Pipeline stage that reported it (`"css"`, `"fonts"`, `"render"`, …).
+    pub stage: &'static str,
+    pub message: String,
+    /// A referenced image or font could not be loaded.
+    pub missing_asset: bool,
+}
+
+impl fmt::Display for Diagnostic {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "[{}] {}", self.stage, self.message)
+    }
+}
+
+thread_local! {
+    static COLLECTOR: RefCell<Option<Vec<Diagnostic>>> = RefCell::new(None);
+}
+
+/// Report a warning.  Repeats of an already recorded diagnostic are dropped.
+pub fn warn(stage: &'static str, message: impl Into<String>) {
+    report(Diagnostic {
+        stage,
+        message: message.into(),
+        missing_asset: false,
+    });
+}
+
+/// Report a resource that could not be loaded and was left out.
+pub fn missing_asset(stage: &'static str, message: impl Into<String>) {
+    report(Diagnostic {
+        stage,
+        message: message.into(),
+        missing_asset: true,
+    });
+}
+
+fn report(diagnostic: Diagnostic) {
+    let fresh = COLLECTOR.with(|c| match c.borrow_mut().as_mut() {
+        Some(list) if list.contains(&diagnostic) => false,
+        Some(list) => {
+            list.push(diagnostic.clone());
+            true
+        }
+        None => true,
+    });
+    if fresh {
+        log::warn!("{diagnostic}");
+        let level = crate::events::Level::Warn;
+        crate::events::emit(level, diagnostic.stage, diagnostic.message, None, None);
+    }
+}
+
+/// Run `f`, returning its result with every diagnostic reported meanwhile
+/// on this thread.  Nested calls see only their own diagnostics.
+pub fn collect<T>(f: impl FnOnce() -> T) -> (T, Vec<Diagnostic>) {
+    /// Restores the enclosing collector even if `f` panics.
+    struct Restore(Option<Vec<Diagnostic>>);
+    impl Drop for Restore {
+        fn drop(&mut self) {
+            let outer = self.0.take();
+            COLLECTOR.with(|c| *c.borrow_mut() = outer);
+        }
+    }
+
+    let outer = COLLECTOR.with(|c| c.borrow_mut().replace(Vec::new()));
+    let _restore = Restore(outer);
+    let value = f();
+    let collected = COLLECTOR.with(|c| c.borrow_mut().take()).unwrap_or_default();
+    (value, collected)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn collect_records_deduplicated_warnings_per_scope() {
+        let ((), outer) = collect(|| {
+            warn("css", "dropped");
+            let ((), inner) = collect(|| warn("render", "skipped"));
+            assert_eq!(inner.len(), 1);
+            warn("css", "dropped");
+        });
+        assert_eq!(
+            outer,
+            vec![Diagnostic {
+                stage: "css",
+                message: "dropped".to_string(),
+                missing_asset: false,
+            }]
+        );
+        // Outside any scope warnings are only logged.
+        warn("css", "unrecorded");
+        assert!(collect(|| ()).1.is_empty());
+    }
+}
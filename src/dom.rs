@@ -1,11 +1,16 @@
 //! HTML parser – converts an HTML string into a simple DOM tree.
 //!
 //! We support a controlled subset of elements:
-//! - Structural: div, p, h1-h3, ul, ol, li, table, tr, td, th, img
+//! - Structural: div, p, pre, h1-h3, ul, ol, li, table, thead, tbody, tfoot,
+//!   tr, td, th, img
 //! - Inline: span
-//! - Styling via `class` and `style` attributes
+//! - `<canvas>` with a pre-rendered `data-snapshot` image, drawn as an img
+//! - Styling via `class` and `style` attributes, plus `<style>` blocks whose
+//!   contents are kept verbatim as a single text child
 
+use std::borrow::Cow;
 use std::collections::HashMap;
+use std::io::{self, Read};
 
 // ---------------------------------------------------------------------------
 // DOM types
@@ -16,6 +21,7 @@ use std::collections::HashMap;
 pub enum Tag {
     Div,
     P,
+    Pre,
     H1,
     H2,
     H3,
@@ -23,14 +29,21 @@ pub enum Tag {
     Ol,
     Li,
     Table,
+    Thead,
+    Tbody,
+    Tfoot,
     Tr,
     Td,
     Th,
     Span,
     Img,
+    Hr,
     Body,
     Html,
     Head,
+    Style,
+    Details,
+    Summary,
     /// Catch-all for unknown tags – they are kept but treated as divs.
     Unknown(String),
 }
@@ -40,6 +53,7 @@ impl Tag {
         match s.to_ascii_lowercase().as_str() {
             "div" => Tag::Div,
             "p" => Tag::P,
+            "pre" => Tag::Pre,
             "h1" => Tag::H1,
             "h2" => Tag::H2,
             "h3" => Tag::H3,
@@ -47,23 +61,63 @@ impl Tag {
             "ol" => Tag::Ol,
             "li" => Tag::Li,
             "table" => Tag::Table,
+            "thead" => Tag::Thead,
+            "tbody" => Tag::Tbody,
+            "tfoot" => Tag::Tfoot,
             "tr" => Tag::Tr,
             "td" => Tag::Td,
             "th" => Tag::Th,
             "span" => Tag::Span,
             "img" => Tag::Img,
+            "hr" => Tag::Hr,
             "body" => Tag::Body,
             "html" => Tag::Html,
             "head" => Tag::Head,
+            "style" => Tag::Style,
+            "details" => Tag::Details,
+            "summary" => Tag::Summary,
             _ => Tag::Unknown(s.to_string()),
         }
     }
 
+    /// Lower-case tag name, as matched by CSS type selectors.
+    pub fn name(&self) -> String {
+        match self {
+            Tag::Div => "div".to_string(),
+            Tag::P => "p".to_string(),
+            Tag::Pre => "pre".to_string(),
+            Tag::H1 => "h1".to_string(),
+            Tag::H2 => "h2".to_string(),
+            Tag::H3 => "h3".to_string(),
+            Tag::Ul => "ul".to_string(),
+            Tag::Ol => "ol".to_string(),
+            Tag::Li => "li".to_string(),
+            Tag::Table => "table".to_string(),
+            Tag::Thead => "thead".to_string(),
+            Tag::Tbody => "tbody".to_string(),
+            Tag::Tfoot => "tfoot".to_string(),
+            Tag::Tr => "tr".to_string(),
+            Tag::Td => "td".to_string(),
+            Tag::Th => "th".to_string(),
+            Tag::Span => "span".to_string(),
+            Tag::Img => "img".to_string(),
+            Tag::Hr => "hr".to_string(),
+            Tag::Body => "body".to_string(),
+            Tag::Html => "html".to_string(),
+            Tag::Head => "head".to_string(),
+            Tag::Style => "style".to_string(),
+            Tag::Details => "details".to_string(),
+            Tag::Summary => "summary".to_string(),
+            Tag::Unknown(name) => name.to_ascii_lowercase(),
+        }
+    }
+
     pub fn is_block(&self) -> bool {
         matches!(
             self,
             Tag::Div
                 | Tag::P
+                | Tag::Pre
                 | Tag::H1
                 | Tag::H2
                 | Tag::H3
@@ -71,11 +125,17 @@ impl Tag {
                 | Tag::Ol
                 | Tag::Li
                 | Tag::Table
+                | Tag::Thead
+                | Tag::Tbody
+                | Tag::Tfoot
                 | Tag::Tr
                 | Tag::Td
                 | Tag::Th
+                | Tag::Hr
                 | Tag::Body
                 | Tag::Html
+                | Tag::Details
+                | Tag::Summary
                 | Tag::Unknown(_)
         )
     }
@@ -85,7 +145,10 @@ impl Tag {
     }
 
     pub fn is_table_part(&self) -> bool {
-        matches!(self, Tag::Table | Tag::Tr | Tag::Td | Tag::Th)
+        matches!(
+            self,
+            Tag::Table | Tag::Thead | Tag::Tbody | Tag::Tfoot | Tag::Tr | Tag::Td | Tag::Th
+        )
     }
 }
 
@@ -143,19 +206,67 @@ pub fn parse_html(html: &str) -> Vec<DomNode> {
     parser.parse_nodes()
 }
 
+/// Parse HTML read incrementally from `reader` into a list of DOM nodes.
+///
+/// The result is the same as [`parse_html`] on the whole input, but only a
+/// window of about [`READ_CHUNK`] bytes (plus the text node or `<style>`
+/// block being read) is buffered at a time, so a very large document never
+/// has to be held in memory next to its DOM.  Fails on a read error or
+/// invalid UTF-8.
+pub fn parse_html_reader<R: Read>(mut reader: R) -> io::Result<Vec<DomNode>> {
+    let mut parser = Parser::streaming(&mut reader);
+    let nodes = parser.parse_nodes();
+    match parser.error.take() {
+        Some(e) => Err(e),
+        None => Ok(nodes),
+    }
+}
+
+/// Bytes requested from the reader at a time when streaming; consumed input
+/// is dropped from the window once it grows past this.
+pub const READ_CHUNK: usize = 64 * 1024;
+
 struct Parser<'a> {
-    input: &'a str,
+    /// Input not yet dropped: the whole document, or the streaming window.
+    input: Cow<'a, str>,
     pos: usize,
+    /// Source of further input; `None` once exhausted (or not streaming).
+    reader: Option<&'a mut dyn Read>,
+    /// Read buffer, [`READ_CHUNK`] bytes when streaming.
+    chunk: Vec<u8>,
+    /// Bytes read but not yet in `input`: a UTF-8 sequence cut by a chunk.
+    pending: Vec<u8>,
+    /// First read or UTF-8 error; parsing then ends as if at end of input.
+    error: Option<io::Error>,
 }
 
 impl<'a> Parser<'a> {
     fn new(input: &'a str) -> Self {
-        Self { input, pos: 0 }
+        Self {
+            input: Cow::Borrowed(input),
+            pos: 0,
+            reader: None,
+            chunk: Vec::new(),
+            pending: Vec::new(),
+            error: None,
+        }
+    }
+
+    fn streaming(reader: &'a mut dyn Read) -> Self {
+        Self {
+            input: Cow::Owned(String::new()),
+            pos: 0,
+            reader: Some(reader),
+            chunk: vec![0; READ_CHUNK],
+            pending: Vec::new(),
+            error: None,
+        }
     }
 
     fn parse_nodes(&mut self) -> Vec<DomNode> {
         let mut nodes = Vec::new();
         loop {
+            self.compact();
             self.skip_whitespace_preserve();
             if self.eof() || self.starts_with("</") {
                 break;
@@ -216,10 +327,10 @@ impl<'a> Parser<'a> {
         }
 
         // Self-closing tags
-        let self_closing = tag == Tag::Img;
+        let self_closing = matches!(tag, Tag::Img | Tag::Hr);
         if self.starts_with("/>") {
             self.advance(2);
-            return DomNode::Element(elem);
+            return DomNode::Element(canvas_snapshot(elem));
         }
         if self.starts_with(">") {
             self.advance(1);
@@ -228,8 +339,27 @@ impl<'a> Parser<'a> {
             return DomNode::Element(elem);
         }
 
-        // Parse children
-        elem.children = self.parse_nodes();
+        // <style> holds raw CSS: keep it verbatim up to the closing tag.
+        if tag == Tag::Style {
+            let close = b"</style";
+            let mut from = self.pos;
+            let end = loop {
+                let rest = self.input.as_bytes()[from..].to_ascii_lowercase();
+                if let Some(i) = rest.windows(close.len()).position(|w| w == close) {
+                    break from + i;
+                }
+                // The closing tag may straddle the next chunk.
+                from = self.input.len().saturating_sub(close.len() - 1).max(from);
+                if !self.read_chunk() {
+                    break self.input.len();
+                }
+            };
+            elem.children.push(DomNode::Text(self.input[self.pos..end].to_string()));
+            self.pos = end;
+        } else {
+            // Parse children
+            elem.children = self.parse_nodes();
+        }
 
         // Consume closing tag
         if self.starts_with("</") {
@@ -241,7 +371,7 @@ impl<'a> Parser<'a> {
             }
         }
 
-        DomNode::Element(elem)
+        DomNode::Element(canvas_snapshot(elem))
     }
 
     fn parse_tag_name(&mut self) -> String {
@@ -333,26 +463,135 @@ impl<'a> Parser<'a> {
         }
     }
 
-    fn starts_with(&self, s: &str) -> bool {
+    fn starts_with(&mut self, s: &str) -> bool {
+        self.fill(s.len());
         self.input[self.pos..].starts_with(s)
     }
 
-    fn eof(&self) -> bool {
-        self.pos >= self.input.len()
+    fn eof(&mut self) -> bool {
+        !self.fill(1)
     }
 
-    fn current_char(&self) -> char {
+    fn current_char(&mut self) -> char {
+        self.fill(1);
         self.input[self.pos..].chars().next().unwrap()
     }
 
     fn advance(&mut self, n: usize) {
         // Advance by `n` characters (not bytes).
         for _ in 0..n {
+            if !self.fill(1) {
+                break;
+            }
             if let Some(c) = self.input[self.pos..].chars().next() {
                 self.pos += c.len_utf8();
             }
         }
     }
+
+    /// Make at least `n` bytes past `pos` available, reading more input when
+    /// streaming.  Returns `false` if the input ends first.  `input` only
+    /// ever holds whole characters, so one byte is enough for a `char`.
+    fn fill(&mut self, n: usize) -> bool {
+        while self.input.len() < self.pos + n {
+            if !self.read_chunk() {
+                return false;
+            }
+        }
+        true
+    }
+
+    /// Append the next chunk from the reader to `input`; `false` at the end
+    /// of input or on an error (kept in `error`).
+    fn read_chunk(&mut self) -> bool {
+        let Some(reader) = self.reader.as_mut() else {
+            return false;
+        };
+        let read = loop {
+            match reader.read(&mut self.chunk) {
+                Err(e) if e.kind() == io::ErrorKind::Interrupted => continue,
+                result => break result,
+            }
+        };
+        let n = match read {
+            Ok(0) if self.pending.is_empty() => return self.stop(None),
+            Ok(0) => {
+                let msg = "Invalid UTF-8: input ends mid-character";
+                return self.stop(Some(io::Error::new(io::ErrorKind::InvalidData, msg)));
+            }
+            Ok(n) => n,
+            Err(e) => return self.stop(Some(e)),
+        };
+        self.pending.extend_from_slice(&self.chunk[..n]);
+        let valid = match std::str::from_utf8(&self.pending) {
+            Ok(text) => text.len(),
+            // An incomplete sequence at the end is finished by the next chunk.
+            Err(e) if e.error_len().is_none() => e.valid_up_to(),
+            Err(e) => {
+                let e = io::Error::new(io::ErrorKind::InvalidData, format!("Invalid UTF-8: {e}"));
+                return self.stop(Some(e));
+            }
+        };
+        let text = std::str::from_utf8(&self.pending[..valid]).unwrap();
+        self.input.to_mut().push_str(text);
+        self.pending.drain(..valid);
+        true
+    }
+
+    /// Stop reading, recording `error` if there is one; returns `false` for
+    /// [`Self::read_chunk`].
+    fn stop(&mut self, error: Option<io::Error>) -> bool {
+        self.reader = None;
+        self.error = self.error.take().or(error);
+        false
+    }
+
+    /// Drop the consumed part of a streaming window.  Only called between
+    /// nodes, where no caller holds a position into `input`.
+    fn compact(&mut self) {
+        if let Cow::Owned(input) = &mut self.input {
+            if self.pos > READ_CHUNK {
+                input.drain(..self.pos);
+                self.pos = 0;
+            }
+        }
+    }
+}
+
+/// Turn a `<canvas>` carrying a pre-rendered `data-snapshot` (base64 PNG,
+/// bare or as a data URI) into an `<img>` of that snapshot, sized by the
+/// canvas's `width` / `height` attributes unless its style sets a size.
+/// Without a snapshot – there is no script engine to draw one – the canvas
+/// stays an unknown element and is not rendered.
+fn canvas_snapshot(mut elem: ElementNode) -> ElementNode {
+    if elem.tag.name() != "canvas" {
+        return elem;
+    }
+    let Some(snapshot) = elem.attributes.remove("data-snapshot") else {
+        return elem;
+    };
+    let snapshot = snapshot.trim();
+    let src = if snapshot.starts_with("data:") {
+        snapshot.to_string()
+    } else {
+        format!("data:image/png;base64,{snapshot}")
+    };
+    let mut style = String::new();
+    for side in ["width", "height"] {
+        let value = elem.attributes.get(side);
+        if let Some(px) = value.and_then(|v| v.trim().parse::<f32>().ok()) {
+            style.push_str(&format!("{side}: {px}px; "));
+        }
+    }
+    if let Some(inline) = elem.attributes.get("style") {
+        style.push_str(inline);
+    }
+    let style = style.trim_end().to_string();
+    elem.attributes.insert("src".to_string(), src);
+    elem.attributes.insert("style".to_string(), style);
+    elem.tag = Tag::Img;
+    elem.children.clear();
+    elem
 }
 
 fn decode_entities(s: &str) -> String {
@@ -389,6 +628,105 @@ pub fn body_children(nodes: &[DomNode]) -> Vec<DomNode> {
     nodes.to_vec()
 }
 
+/// The text of the document's `<title>`, or failing that of its first
+/// `<h1>`, with whitespace collapsed.  `None` if neither has any text.
+pub fn document_title(nodes: &[DomNode]) -> Option<String> {
+    let title = find_element(nodes, &|tag| tag.name() == "title");
+    let heading = find_element(nodes, &|tag| *tag == Tag::H1);
+    [title, heading].into_iter().flatten().find_map(|e| {
+        let mut text = String::new();
+        text_content(&e.children, &mut text);
+        let text = text.split_whitespace().collect::<Vec<_>>().join(" ");
+        (!text.is_empty()).then_some(text)
+    })
+}
+
+/// Serialise `nodes` back to HTML as the parser understood them (entities
+/// decoded and re-escaped, attributes sorted, unclosed elements closed),
+/// wrapped in `<html><body>` when they are a fragment, as layout treats it.
+pub fn to_html(nodes: &[DomNode]) -> String {
+    let mut out = String::new();
+    let fragment = find_element(nodes, &|tag| *tag == Tag::Body).is_none();
+    if fragment {
+        out.push_str("<html><body>");
+    }
+    write_html(nodes, &mut out);
+    if fragment {
+        out.push_str("</body></html>");
+    }
+    out
+}
+
+fn write_html(nodes: &[DomNode], out: &mut String) {
+    let escape = |text: &str, quote: bool| {
+        let text = text.replace('&', "&amp;").replace('<', "&lt;");
+        let text = text.replace('>', "&gt;");
+        if quote {
+            text.replace('"', "&quot;")
+        } else {
+            text
+        }
+    };
+    for node in nodes {
+        let e = match node {
+            DomNode::Text(text) => {
+                out.push_str(&escape(text, false));
+                continue;
+            }
+            DomNode::Element(e) => e,
+        };
+        let name = e.tag.name();
+        out.push('<');
+        out.push_str(&name);
+        let mut attributes: Vec<_> = e.attributes.iter().collect();
+        attributes.sort();
+        for (key, value) in attributes {
+            out.push_str(&format!(" {key}=\"{}\"", escape(value, true)));
+        }
+        out.push('>');
+        if matches!(e.tag, Tag::Img | Tag::Hr) {
+            continue;
+        }
+        match (&e.tag, e.children.as_slice()) {
+            (Tag::Style, [DomNode::Text(css)]) => out.push_str(css),
+            (_, children) => write_html(children, out),
+        }
+        out.push_str(&format!("</{name}>"));
+    }
+}
+
+/// Remove and return the node at child-index `path` (as
+/// [`crate::css::select_first`] returns it).
+pub fn remove_node(nodes: &mut Vec<DomNode>, path: &[usize]) -> Option<DomNode> {
+    match path {
+        [] => None,
+        [index] => (*index < nodes.len()).then(|| nodes.remove(*index)),
+        [index, rest @ ..] => match nodes.get_mut(*index)? {
+            DomNode::Element(e) => remove_node(&mut e.children, rest),
+            DomNode::Text(_) => None,
+        },
+    }
+}
+
+/// The first element, in document order, whose tag satisfies `pred`.
+fn find_element<'a>(nodes: &'a [DomNode], pred: &dyn Fn(&Tag) -> bool) -> Option<&'a ElementNode> {
+    nodes.iter().find_map(|node| match node {
+        DomNode::Element(e) if pred(&e.tag) => Some(e),
+        DomNode::Element(e) => find_element(&e.children, pred),
+        DomNode::Text(_) => None,
+    })
+}
+
+/// Append the text of `nodes` and their descendants to `out`.
+fn text_content(nodes: &[DomNode], out: &mut String) {
+    for node in nodes {
+        match node {
+            DomNode::Text(text) => out.push_str(text),
+            DomNode::Element(e) => text_content(&e.children, out),
+        }
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -433,6 +771,22 @@ mod tests {
         }
     }
 
+    #[test]
+    fn parse_style_block_verbatim() {
+        let html = "<style>div > p { color: #f00 } a<b</style><p>After</p>";
+        let nodes = parse_html(html);
+        assert_eq!(nodes.len(), 2);
+        if let DomNode::Element(e) = &nodes[0] {
+            assert_eq!(e.tag, Tag::Style);
+            match &e.children[..] {
+                [DomNode::Text(css)] => assert_eq!(css, "div > p { color: #f00 } a<b"),
+                other => panic!("Expected one text child, got {:?}", other),
+            }
+        } else {
+            panic!("Expected style element");
+        }
+    }
+
     #[test]
     fn parse_table() {
         let html = r#"<table><tr><th>Name</th><th>Age</th></tr><tr><td>Alice</td><td>30</td></tr></table>"#;
@@ -445,4 +799,82 @@ mod tests {
             panic!("Expected table");
         }
     }
+
+    #[test]
+    fn document_title_prefers_title_element_over_first_heading() {
+        let title = |html: &str| document_title(&parse_html(html));
+        let html = "<html><head><title> Q3\n  Report </title></head>\
+                    <body><h1>Heading <span>one</span></h1></body></html>";
+        assert_eq!(title(html).as_deref(), Some("Q3 Report"));
+        let html = "<div><h1>Heading <span>one</span></h1></div><h1>Two</h1>";
+        assert_eq!(title(html).as_deref(), Some("Heading one"));
+        assert_eq!(title("<h1> </h1><p>Body</p>"), None);
+    }
+
+    #[test]
+    fn canvas_snapshot_becomes_a_sized_img() {
+        let html = r#"<canvas width="200" height="100" data-snapshot="iVBORw0KGgo=">
+            Fallback</canvas><canvas></canvas>"#;
+        let nodes = parse_html(html);
+        let DomNode::Element(img) = &nodes[0] else {
+            panic!("Expected canvas element");
+        };
+        assert_eq!(img.tag, Tag::Img);
+        assert_eq!(img.src(), Some("data:image/png;base64,iVBORw0KGgo="));
+        assert_eq!(img.inline_style(), Some("width: 200px; height: 100px;"));
+        assert!(img.children.is_empty());
+        let DomNode::Element(bare) = &nodes[1] else {
+            panic!("Expected canvas element");
+        };
+        assert_eq!(bare.tag, Tag::Unknown("canvas".to_string()));
+    }
+
+    #[test]
+    fn to_html_serialises_fragments_as_parsed() {
+        let nodes = parse_html(
+            r#"<p id="x" class="a">Fish &amp; chips<img src="a.png"><span title='"q"'>open</p>"#,
+        );
+        assert_eq!(
+            to_html(&nodes),
+            "<html><body><p class=\"a\" id=\"x\">Fish &amp; chips<img src=\"a.png\">\
+             <span title=\"&quot;q&quot;\">open</span></p></body></html>"
+        );
+        let document = parse_html("<html><body><style>p > b { x: y }</style></body></html>");
+        assert_eq!(
+            to_html(&document),
+            "<html><body><style>p > b { x: y }</style></body></html>"
+        );
+    }
+
+    /// Hands out its input a few bytes at a time, splitting characters and
+    /// tags across reads.
+    struct Trickle<'a>(&'a [u8]);
+
+    impl Read for Trickle<'_> {
+        fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+            let n = self.0.len().min(buf.len()).min(3);
+            buf[..n].copy_from_slice(&self.0[..n]);
+            self.0 = &self.0[n..];
+            Ok(n)
+        }
+    }
+
+    #[test]
+    fn streamed_input_parses_like_a_string() {
+        let filler = "<p class=\"row\">Grüße – naïve café</p>".repeat(READ_CHUNK / 20);
+        let html = format!(
+            "<!DOCTYPE html><html><head><style>p {{ color: red }}</STYLE></head>\
+             <body>{filler}<!-- note --><img src='a.png'/><p>Fin &amp; end</p></body></html>"
+        );
+        let streamed = parse_html_reader(Trickle(html.as_bytes())).unwrap();
+        assert_eq!(to_html(&streamed), to_html(&parse_html(&html)));
+    }
+
+    #[test]
+    fn streamed_input_rejects_invalid_utf8() {
+        let err = parse_html_reader(&b"<p>caf\xc3</p>"[..]).unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+        let err = parse_html_reader(&b"<p>caf\xc3"[..]).unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+    }
 }
@@ -0,0 +1,207 @@
+//! Structured events – a machine-readable trace of a render, for services
+//! that ship JSON logs.
+//!
+//! While [`generate`](crate::pipeline::generate) runs with
+//! `PipelineConfig::event_sink` set, each pipeline phase reports an
+//! [`Event`] with its duration when it ends, every image decoded reports one
+//! naming the resource, and every [`diagnostic`](crate::diagnostics) is
+//! forwarded as a warning.  [`Event::to_json`] renders one log line.
+//!
+//! Like diagnostics, the sink is bound to the current thread for the length
+//! of the render, so stages report without it being passed around.
+
+use std::cell::RefCell;
+use std::fmt::Debug;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use sha2::{Digest, Sha256};
+
+pub use log::Level;
+
+/// Longest resource name reported as is; longer data URIs are summarised.
+const MAX_RESOURCE_LEN: usize = 64;
+
+/// One thing that happened during a render.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Event {
+    pub timestamp: SystemTime,
+    pub level: Level,
+    /// Pipeline phase (`"parse"`, `"layout"`, `"render"`, …).
+    pub phase: &'static str,
+    pub message: String,
+    /// How long the phase or resource load took.
+    pub duration: Option<Duration>,
+    /// The resource loaded – an image source.  Data URIs longer than 64
+    /// characters are given as their header, a digest and their length
+    /// (`data:image/png;base64,sha256=…;len=…`).
+    pub resource: Option<String>,
+}
+
+impl Event {
+    /// The event as a single-line JSON object with the fields `timestamp`
+    /// (milliseconds since the Unix epoch), `level`, `phase`, `message`,
+    /// `duration_ms` and `resource_url`.
+    pub fn to_json(&self) -> String {
+        let timestamp = self
+            .timestamp
+            .duration_since(UNIX_EPOCH)
+            .map_or(0, |d| d.as_millis() as u64);
+        serde_json::json!({
+            "timestamp": timestamp,
+            "level": self.level.as_str(),
+            "phase": self.phase,
+            "message": self.message,
+            "duration_ms": self.duration.map(|d| d.as_secs_f64() * 1000.0),
+            "resource_url": self.resource,
+        })
+        .to_string()
+    }
+}
+
+/// Receives the events of a render.  Shared between renders (and threads)
+/// through `PipelineConfig::event_sink`.
+pub trait EventSink: Debug + Send + Sync {
+    fn event(&self, event: Event);
+}
+
+/// An [`EventSink`] that keeps every event in memory.
+#[derive(Debug, Default)]
+pub struct EventLog {
+    events: Mutex<Vec<Event>>,
+}
+
+impl EventLog {
+    /// The events received so far, oldest first.
+    pub fn events(&self) -> Vec<Event> {
+        let events = self.events.lock().unwrap_or_else(|e| e.into_inner());
+        events.clone()
+    }
+}
+
+impl EventSink for EventLog {
+    fn event(&self, event: Event) {
+        let mut events = self.events.lock().unwrap_or_else(|e| e.into_inner());
+        events.push(event);
+    }
+}
+
+thread_local! {
+    static SINK: RefCell<Option<Arc<dyn EventSink>>> = RefCell::new(None);
+}
+
+/// Run `f` with `sink` receiving the events reported on this thread.
+pub fn with_sink<T>(sink: Option<Arc<dyn EventSink>>, f: impl FnOnce() -> T) -> T {
+    /// Restores the enclosing sink even if `f` panics.
+    struct Restore(Option<Arc<dyn EventSink>>);
+    impl Drop for Restore {
+        fn drop(&mut self) {
+            let outer = self.0.take();
+            SINK.with(|s| *s.borrow_mut() = outer);
+        }
+    }
+
+    let outer = SINK.with(|s| s.replace(sink));
+    let _restore = Restore(outer);
+    f()
+}
+
+/// Report an event to the current sink, if any.
+pub fn emit(
+    level: Level,
+    phase: &'static str,
+    message: impl Into<String>,
+    duration: Option<Duration>,
+    resource: Option<&str>,
+) {
+    let Some(sink) = SINK.with(|s| s.borrow().clone()) else {
+        return;
+    };
+    sink.event(Event {
+        timestamp: SystemTime::now(),
+        level,
+        phase,
+        message: message.into(),
+        duration,
+        resource: resource.map(resource_name),
+    });
+}
+
+/// How `resource` is named in an event.
+fn resource_name(resource: &str) -> String {
+    let long = resource.len() > MAX_RESOURCE_LEN;
+    match resource.split_once(',') {
+        Some((header, data)) if long && header.starts_with("data:") => {
+            let digest = Sha256::digest(data.as_bytes());
+            let hex: String = digest[..8].iter().map(|b| format!("{b:02x}")).collect();
+            format!("{header},sha256={hex};len={}", data.len())
+        }
+        _ => resource.to_string(),
+    }
+}
+
+/// A running phase; [`Phase::end`] reports it with its duration.
+#[must_use]
+pub struct Phase {
+    name: &'static str,
+    start: Instant,
+}
+
+/// Start timing the phase `name`.
+pub fn phase(name: &'static str) -> Phase {
+    Phase {
+        name,
+        start: Instant::now(),
+    }
+}
+
+impl Phase {
+    pub fn end(self) {
+        let message = format!("{} finished", self.name);
+        let duration = Some(self.start.elapsed());
+        emit(Level::Info, self.name, message, duration, None);
+    }
+}
+
+/// Run `load` for `resource`, reporting how long it took and whether it
+/// succeeded.
+pub fn load_resource<T>(
+    phase: &'static str,
+    resource: &str,
+    load: impl FnOnce() -> Result<T, String>,
+) -> Result<T, String> {
+    let start = Instant::now();
+    let result = load();
+    let (level, message) = match &result {
+        Ok(_) => (Level::Info, "Loaded resource".to_string()),
+        Err(e) => (Level::Warn, format!("Could not load resource: {e}")),
+    };
+    emit(level, phase, message, Some(start.elapsed()), Some(resource));
+    result
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn events_reach_only_the_bound_sink() {
+        let uri = "data:image/png;base64,AAAA";
+        let log = Arc::new(EventLog::default());
+        with_sink(Some(log.clone()), || {
+            phase("layout").end();
+            let _ = load_resource("render", uri, || Ok(()));
+        });
+        emit(Level::Info, "parse", "unbound", None, None);
+
+        let events = log.events();
+        assert_eq!(events.len(), 2);
+        assert_eq!(events[0].phase, "layout");
+        assert!(events[0].duration.is_some());
+        assert_eq!(events[1].resource.as_deref(), Some(uri));
+        let json: serde_json::Value = serde_json::from_str(&events[1].to_json()).unwrap();
+        assert_eq!(json["level"], "INFO");
+        assert_eq!(json["resource_url"], uri);
+        assert!(json["duration_ms"].is_f64());
+    }
+}
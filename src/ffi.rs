@@ -13,10 +13,14 @@
 //! ## Error handling
 //! - Functions that can fail return a `c_int` (0 = success, non-zero = error).
 //! - Error details can be retrieved via `rpdf_last_error`.
+//! - Panics never unwind into the caller: they are caught and reported as
+//!   code `5` (internal error) with the panic message as the last error.
 //!
 //! ## Thread safety
 //! - The `rpdf_last_error` uses a thread-local, so it is safe to call from
 //!   multiple threads.
+//! - `rpdf_set_max_concurrency` caps how many calls may run the pipeline at
+//!   once; callers beyond the limit block until a slot frees up.
 //!
 //! ## Usage from Go (cgo)
 //! ```go
@@ -30,24 +34,163 @@
 //! import "C"
 //! ```
 
+#[cfg(test)]
+use std::cell::Cell;
 use std::cell::RefCell;
 use std::ffi::{CStr, CString};
-use std::os::raw::{c_char, c_int};
+use std::io::{self, Read};
+use std::os::raw::{c_char, c_int, c_void};
+use std::panic::{self, AssertUnwindSafe};
+use std::path::{Path, PathBuf};
 use std::ptr;
 use std::slice;
-
-use crate::pipeline::{generate_pdf, PageOrientation, PipelineConfig};
+use std::sync::{Arc, Condvar, Mutex, OnceLock};
+
+use crate::cache::{Cache, LruCache};
+use crate::layout_config::{
+    AfRelationship, BackgroundMode, LinkBorderStyle, LinkHighlight, LinkStyle, PageAttachment,
+    PageBackground, PageMode, PdfOverlay, RenderingIntent,
+};
+use crate::pipeline::{
+    generate, generate_from_reader, generate_pdf, generate_to_file, PageOrientation, PipelineConfig,
+    StylesheetSource, OUTPUT_TOO_LARGE,
+};
 
 thread_local! {
     static LAST_ERROR: RefCell<Option<CString>> = RefCell::new(None);
 }
 
+#[cfg(test)]
+thread_local! {
+    /// Set by tests to make the next entry point on this thread panic.
+    static PANIC_NEXT_CALL: Cell<bool> = const { Cell::new(false) };
+}
+
 fn set_last_error(msg: &str) {
     LAST_ERROR.with(|e| {
         *e.borrow_mut() = CString::new(msg).ok();
     });
 }
 
+/// Return code for a panic caught at the FFI boundary.
+const RC_INTERNAL: c_int = 5;
+
+/// Return code when the PDF exceeds `RpdfPipelineConfig::max_output_bytes`.
+const RC_OUTPUT_TOO_LARGE: c_int = 6;
+
+/// Record a generation error and return its code: [`RC_OUTPUT_TOO_LARGE`]
+/// for an over-size PDF, `3` for anything else.
+fn generation_error(e: &str) -> c_int {
+    set_last_error(e);
+    if e.starts_with(OUTPUT_TOO_LARGE) {
+        RC_OUTPUT_TOO_LARGE
+    } else {
+        3
+    }
+}
+
+/// Run an FFI entry point body, converting a panic into [`RC_INTERNAL`] so it
+/// never unwinds across the C ABI (which would abort the host process).
+fn ffi_guard(f: impl FnOnce() -> c_int) -> c_int {
+    let body = || {
+        #[cfg(test)]
+        if PANIC_NEXT_CALL.with(|p| p.replace(false)) {
+            panic!("panic injected by test");
+        }
+        f()
+    };
+    match panic::catch_unwind(AssertUnwindSafe(body)) {
+        Ok(rc) => rc,
+        Err(payload) => {
+            let msg = payload
+                .downcast_ref::<&str>()
+                .map(|s| s.to_string())
+                .or_else(|| payload.downcast_ref::<String>().cloned())
+                .unwrap_or_else(|| "unknown panic".to_string());
+            set_last_error(&format!("Internal error: {msg}"));
+            RC_INTERNAL
+        }
+    }
+}
+
+// ---------------------------------------------------------------------------
+// Concurrency limit
+// ---------------------------------------------------------------------------
+
+/// Bounds simultaneous pipeline runs; see [`rpdf_set_max_concurrency`].
+struct Limiter {
+    state: Mutex<LimiterState>,
+    freed: Condvar,
+}
+
+struct LimiterState {
+    /// Maximum simultaneous pipeline runs; `0` means unlimited.
+    max: usize,
+    active: usize,
+    /// Highest `active` value observed.
+    #[cfg(test)]
+    peak: usize,
+}
+
+static LIMITER: Limiter = Limiter::new();
+
+/// A held render slot; released on drop.
+struct Permit<'a>(&'a Limiter);
+
+impl Limiter {
+    const fn new() -> Self {
+        Limiter {
+            state: Mutex::new(LimiterState {
+                max: 0,
+                active: 0,
+                #[cfg(test)]
+                peak: 0,
+            }),
+            freed: Condvar::new(),
+        }
+    }
+
+    fn lock(&self) -> std::sync::MutexGuard<'_, LimiterState> {
+        self.state.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Block until a render slot is available under the current limit.
+    fn acquire(&self) -> Permit<'_> {
+        let mut state = self.lock();
+        while state.max != 0 && state.active >= state.max {
+            state = self.freed.wait(state).unwrap_or_else(|e| e.into_inner());
+        }
+        state.active += 1;
+        #[cfg(test)]
+        {
+            state.peak = state.peak.max(state.active);
+        }
+        Permit(self)
+    }
+
+    fn set_max(&self, max: usize) {
+        self.lock().max = max;
+        self.freed.notify_all();
+    }
+}
+
+impl Drop for Permit<'_> {
+    fn drop(&mut self) {
+        self.0.lock().active -= 1;
+        self.0.freed.notify_one();
+    }
+}
+
+/// Limit how many `rpdf_*` calls may run the HTML → PDF pipeline at the same
+/// time.  Further calls block until a running one finishes.
+///
+/// Pass `0` to remove the limit (the default).  Lowering the limit does not
+/// interrupt calls that are already running.
+#[no_mangle]
+pub extern "C" fn rpdf_set_max_concurrency(max: u32) {
+    LIMITER.set_max(max as usize);
+}
+
 // ---------------------------------------------------------------------------
 // C-compatible configuration types
 // ---------------------------------------------------------------------------
@@ -61,6 +204,97 @@ pub enum RpdfPageOrientation {
     Landscape = 1,
 }
 
+/// Colour rendering intent for use in [`RpdfPipelineConfig`].
+#[repr(C)]
+pub enum RpdfRenderingIntent {
+    /// Leave the viewer default (relative colorimetric).
+    IntentDefault = 0,
+    Perceptual = 1,
+    RelativeColorimetric = 2,
+    Saturation = 3,
+    AbsoluteColorimetric = 4,
+}
+
+/// How `RpdfPipelineConfig::page_background_ptr` is fitted to the page.
+#[repr(C)]
+pub enum RpdfBackgroundMode {
+    /// Scale to cover the page, cropping the overflow (default).
+    BackgroundCover = 0,
+    /// Scale to fit inside the page.
+    BackgroundContain = 1,
+    /// Repeat at the image's own size from the top-left corner.
+    BackgroundTile = 2,
+}
+
+/// Viewer panel shown on opening, for use in [`RpdfPipelineConfig`].
+#[repr(C)]
+pub enum RpdfPageMode {
+    /// No side panel (default).
+    PageModeUseNone = 0,
+    /// The bookmarks panel.
+    PageModeUseOutlines = 1,
+    /// The page thumbnails.
+    PageModeUseThumbs = 2,
+    /// Full-screen.
+    PageModeFullScreen = 3,
+}
+
+/// Line style of a link border, for [`RpdfPipelineConfig`].
+#[repr(C)]
+pub enum RpdfLinkBorderStyle {
+    /// A solid line (default).
+    LinkBorderSolid = 0,
+    /// 3 pt dashes with 3 pt gaps.
+    LinkBorderDashed = 1,
+    /// A single line along the bottom of the link.
+    LinkBorderUnderline = 2,
+}
+
+/// What a viewer does to a link while it is clicked, for
+/// [`RpdfPipelineConfig`].
+#[repr(C)]
+pub enum RpdfLinkHighlight {
+    /// Invert the colours of the link area (default).
+    LinkHighlightInvert = 0,
+    /// No visual change.
+    LinkHighlightNone = 1,
+    /// Invert the link's border.
+    LinkHighlightOutline = 2,
+    /// Draw the link as if pushed below the page.
+    LinkHighlightPush = 3,
+}
+
+/// How a page attachment relates to its page, for [`RpdfPageAttachment`].
+#[repr(C)]
+pub enum RpdfAfRelationship {
+    /// No stated relationship (default).
+    AfRelationshipUnspecified = 0,
+    /// The original the page was made from.
+    AfRelationshipSource = 1,
+    /// Data the page shows.
+    AfRelationshipData = 2,
+    /// Another representation of the page.
+    AfRelationshipAlternative = 3,
+    /// Additional material.
+    AfRelationshipSupplement = 4,
+}
+
+/// A file associated with one page, for
+/// `RpdfPipelineConfig::page_attachments`.
+#[repr(C)]
+pub struct RpdfPageAttachment {
+    /// 1-based page the file belongs to.
+    pub page: u32,
+    /// Null-terminated UTF-8 file name.
+    pub name: *const c_char,
+    /// The file's bytes.
+    pub data_ptr: *const u8,
+    /// Length of `data_ptr` in bytes.
+    pub data_len: u32,
+    /// How the file relates to the page.
+    pub relationship: RpdfAfRelationship,
+}
+
 /// Optional configuration for PDF generation passed to the `*_ex` functions.
 ///
 /// Fields set to `0` (or `NULL` for `title`) fall back to their A4 defaults:
@@ -81,12 +315,216 @@ pub struct RpdfPipelineConfig {
     pub page_margin: f32,
     /// Page orientation (portrait = 0, landscape = 1).
     pub orientation: RpdfPageOrientation,
+    /// Embed a font program for the standard-14 fonts instead of referencing
+    /// them by name. Requires `base_font_ptr`.
+    pub embed_base_fonts: bool,
+    /// TrueType/OpenType bytes used for the Helvetica family. May be `NULL`.
+    pub base_font_ptr: *const u8,
+    /// Length of `base_font_ptr` in bytes.
+    pub base_font_len: u32,
+    /// Null-terminated UTF-8 CSS applied after the document's own styles so
+    /// it overrides them. May be `NULL`.
+    pub extra_css: *const c_char,
+    /// Colour rendering intent applied to every page.
+    pub rendering_intent: RpdfRenderingIntent,
+    /// Null-terminated UTF-8 XMP packet embedded verbatim as the document
+    /// metadata. Must be well-formed XML. May be `NULL`.
+    pub xmp: *const c_char,
+    /// Fail with return code `3` on any warning (skipped image, dropped
+    /// CSS rule, missing glyph, …) instead of degrading the output.
+    pub strict: bool,
+    /// Omit the Info dictionary and XMP metadata and zero the document ID.
+    pub strip_metadata: bool,
+    /// Merge identical PDF objects and drop unreferenced ones after rendering.
+    pub optimize: bool,
+    /// Reuse parsed font programs and decoded images through an in-memory
+    /// LRU cache shared by every call in the process.
+    pub use_cache: bool,
+    /// Store embedded font programs uncompressed (fonts are FlateDecode
+    /// compressed by default).
+    pub uncompressed_fonts: bool,
+    /// Fail with return code `3` when an image or the base font cannot be
+    /// loaded, while tolerating every other warning.
+    pub fail_on_missing_assets: bool,
+    /// PNG or JPEG bytes drawn behind the content of every page. May be
+    /// `NULL`.
+    pub page_background_ptr: *const u8,
+    /// Length of `page_background_ptr` in bytes.
+    pub page_background_len: u32,
+    /// How the page background is fitted to the page.
+    pub page_background_mode: RpdfBackgroundMode,
+    /// Give every page exactly one content stream.
+    pub single_content_stream: bool,
+    /// Expected PDF size in bytes, used to preallocate the output buffer of
+    /// post-processed files. `0` for no hint.
+    pub output_size_hint: u32,
+    /// Drop a final page left without visible content, unless a page break
+    /// started it.
+    pub trim_trailing_blank_page: bool,
+    /// Null-terminated path of a folder of `.ttf` / `.otf` files to register
+    /// by family name. May be `NULL`.
+    pub fonts_directory: *const c_char,
+    /// Paint backgrounds even where the document sets
+    /// `print-color-adjust: economy`.
+    pub print_backgrounds: bool,
+    /// Minimum stroke width in points for borders, outlines and underlines;
+    /// `0` for none.
+    pub min_line_width: f32,
+    /// Skip images whose header claims more than this many pixels
+    /// (width × height); `0` for no limit.
+    pub max_image_pixels: u64,
+    /// PDF bytes whose page `overlay_pdf_page` is drawn on every page (e.g.
+    /// pre-printed letterhead). May be `NULL`.
+    pub overlay_pdf_ptr: *const u8,
+    /// Length of `overlay_pdf_ptr` in bytes.
+    pub overlay_pdf_len: u32,
+    /// 1-based page of the overlay PDF to draw; `0` for the first.
+    pub overlay_pdf_page: u32,
+    /// Draw the overlay beneath the content instead of over it.
+    pub overlay_behind: bool,
+    /// Write page geometry in units of this many points (`/UserUnit`) for
+    /// pages over 14 400 pt; between 1 and 75 000, or `0` for plain points.
+    pub user_unit: f32,
+    /// Pack objects into object streams with a cross-reference stream
+    /// (PDF 1.5) instead of a classic xref table.
+    pub object_streams: bool,
+    /// With `title` `NULL`, use the document's `<title>` or first `<h1>`
+    /// text as the title.
+    pub title_from_first_heading: bool,
+    /// Null-terminated UTF-8 Info `/Producer`. `NULL` keeps the default.
+    pub producer: *const c_char,
+    /// Null-terminated UTF-8 Info `/Creator`. `NULL` keeps the default.
+    pub creator: *const c_char,
+    /// Lay out in a viewport this many CSS pixels wide, scaled to fit the
+    /// page; `0` lays out at the page size.
+    pub viewport_width: f32,
+    /// Null-terminated UTF-8 selector of an element moved out of the flow
+    /// and repeated in every page's top margin. `NULL` repeats nothing.
+    pub header_selector: *const c_char,
+    /// Like `header_selector`, for the bottom margin.
+    pub footer_selector: *const c_char,
+    /// Make bare URLs in the text clickable links.
+    pub auto_link: bool,
+    /// Null-terminated UTF-8 list of CSS file paths, one per line, applied
+    /// in order before the document's own styles. May be `NULL`.
+    pub stylesheet_files: *const c_char,
+    /// Panel the viewer shows when the file is opened.
+    pub page_mode: RpdfPageMode,
+    /// Draw text as vector paths, leaving no fonts in the file. Requires
+    /// `base_font_ptr`.
+    pub text_as_outlines: bool,
+    /// Tag images that carry an ICC profile with it instead of device RGB.
+    pub image_color_management: bool,
+    /// Reserve exactly this many points below the top margin for the
+    /// header, clipping what does not fit; `0` puts it in the margin.
+    pub header_height: f32,
+    /// Like `header_height`, above the bottom margin for the footer.
+    pub footer_height: f32,
+    /// Make every element `id` a named destination (`#nameddest=id`).
+    pub named_destinations: bool,
+    /// Fail with return code `6` when the PDF would be larger than this
+    /// many bytes; `0` allows any size.
+    pub max_output_bytes: u64,
+    /// Over `max_output_bytes`, first shrink and recompress images to fit.
+    pub fit_output_size: bool,
+    /// Convert every colour and image to DeviceGray.
+    pub grayscale: bool,
+    /// Print text smaller than this many points at this size; `0` keeps
+    /// every size.
+    pub min_font_size: f32,
+    /// Files to associate with pages (their `/AF`). May be `NULL`.
+    /// Generation fails with return code `3` if a page does not exist.
+    pub page_attachments: *const RpdfPageAttachment,
+    /// Number of entries in `page_attachments`.
+    pub page_attachments_len: u32,
+    /// Border width of `auto_link` links in points; `0` draws no border.
+    pub link_border_width: f32,
+    /// Border colour of links (RGB, `0.0..=1.0`).
+    pub link_border_color: [f32; 3],
+    /// Line style of link borders.
+    pub link_border_style: RpdfLinkBorderStyle,
+    /// What a viewer does to a link while it is clicked.
+    pub link_highlight: RpdfLinkHighlight,
+}
+
+impl Default for RpdfPipelineConfig {
+    fn default() -> Self {
+        Self {
+            title: ptr::null(),
+            page_width: 0.0,
+            page_height: 0.0,
+            page_margin: 0.0,
+            orientation: RpdfPageOrientation::Portrait,
+            embed_base_fonts: false,
+            base_font_ptr: ptr::null(),
+            base_font_len: 0,
+            extra_css: ptr::null(),
+            rendering_intent: RpdfRenderingIntent::IntentDefault,
+            xmp: ptr::null(),
+            strict: false,
+            strip_metadata: false,
+            optimize: false,
+            use_cache: false,
+            uncompressed_fonts: false,
+            fail_on_missing_assets: false,
+            page_background_ptr: ptr::null(),
+            page_background_len: 0,
+            page_background_mode: RpdfBackgroundMode::BackgroundCover,
+            single_content_stream: false,
+            output_size_hint: 0,
+            trim_trailing_blank_page: false,
+            fonts_directory: ptr::null(),
+            print_backgrounds: false,
+            min_line_width: 0.0,
+            max_image_pixels: 0,
+            overlay_pdf_ptr: ptr::null(),
+            overlay_pdf_len: 0,
+            overlay_pdf_page: 0,
+            overlay_behind: false,
+            user_unit: 0.0,
+            object_streams: false,
+            title_from_first_heading: false,
+            producer: ptr::null(),
+            creator: ptr::null(),
+            viewport_width: 0.0,
+            header_selector: ptr::null(),
+            footer_selector: ptr::null(),
+            auto_link: false,
+            stylesheet_files: ptr::null(),
+            page_mode: RpdfPageMode::PageModeUseNone,
+            text_as_outlines: false,
+            image_color_management: false,
+            header_height: 0.0,
+            footer_height: 0.0,
+            named_destinations: false,
+            max_output_bytes: 0,
+            fit_output_size: false,
+            grayscale: false,
+            min_font_size: 0.0,
+            page_attachments: ptr::null(),
+            page_attachments_len: 0,
+            link_border_width: 0.0,
+            link_border_color: [0.0, 0.0, 0.0],
+            link_border_style: RpdfLinkBorderStyle::LinkBorderSolid,
+            link_highlight: RpdfLinkHighlight::LinkHighlightInvert,
+        }
+    }
 }
 
 /// Convert an `RpdfPipelineConfig` (FFI) to a `PipelineConfig` (Rust).
 ///
 /// # Safety
 /// `cfg.title`, if non-null, must point to a valid null-terminated UTF-8 string.
+/// `cfg.base_font_ptr`, if non-null, must point to `cfg.base_font_len` bytes,
+/// `cfg.page_background_ptr` to `cfg.page_background_len` bytes and
+/// `cfg.overlay_pdf_ptr` to `cfg.overlay_pdf_len` bytes.
+/// `cfg.page_attachments`, if non-null, must point to
+/// `cfg.page_attachments_len` attachments, each with a valid `name` (or
+/// `NULL`) and `data_len` bytes at `data_ptr`.
+/// `cfg.extra_css`, `cfg.xmp`, `cfg.fonts_directory`, `cfg.producer`,
+/// `cfg.creator`, `cfg.header_selector`, `cfg.footer_selector` and
+/// `cfg.stylesheet_files`, if non-null, must point to valid null-terminated
+/// strings.
 unsafe fn pipeline_config_from_c(cfg: &RpdfPipelineConfig) -> PipelineConfig {
     let defaults = PipelineConfig::default();
 
@@ -120,15 +558,178 @@ unsafe fn pipeline_config_from_c(cfg: &RpdfPipelineConfig) -> PipelineConfig {
         RpdfPageOrientation::Landscape => PageOrientation::Landscape,
     };
 
+    let base_font = if cfg.base_font_ptr.is_null() || cfg.base_font_len == 0 {
+        None
+    } else {
+        Some(slice::from_raw_parts(cfg.base_font_ptr, cfg.base_font_len as usize).to_vec())
+    };
+
+    let page_background = if cfg.page_background_ptr.is_null() || cfg.page_background_len == 0 {
+        None
+    } else {
+        let image =
+            slice::from_raw_parts(cfg.page_background_ptr, cfg.page_background_len as usize);
+        let mode = match cfg.page_background_mode {
+            RpdfBackgroundMode::BackgroundCover => BackgroundMode::Cover,
+            RpdfBackgroundMode::BackgroundContain => BackgroundMode::Contain,
+            RpdfBackgroundMode::BackgroundTile => BackgroundMode::Tile,
+        };
+        Some(PageBackground::from_bytes(image, mode))
+    };
+
+    let overlay_pdf = if cfg.overlay_pdf_ptr.is_null() || cfg.overlay_pdf_len == 0 {
+        None
+    } else {
+        let pdf = slice::from_raw_parts(cfg.overlay_pdf_ptr, cfg.overlay_pdf_len as usize);
+        let page = cfg.overlay_pdf_page.max(1) as usize;
+        Some(PdfOverlay::from_bytes(pdf, page, cfg.overlay_behind))
+    };
+
+    let extra_css = if cfg.extra_css.is_null() {
+        defaults.extra_css.clone()
+    } else {
+        CStr::from_ptr(cfg.extra_css)
+            .to_string_lossy()
+            .into_owned()
+    };
+
+    let rendering_intent = match cfg.rendering_intent {
+        RpdfRenderingIntent::IntentDefault => None,
+        RpdfRenderingIntent::Perceptual => Some(RenderingIntent::Perceptual),
+        RpdfRenderingIntent::RelativeColorimetric => Some(RenderingIntent::RelativeColorimetric),
+        RpdfRenderingIntent::Saturation => Some(RenderingIntent::Saturation),
+        RpdfRenderingIntent::AbsoluteColorimetric => Some(RenderingIntent::AbsoluteColorimetric),
+    };
+
+    let xmp = if cfg.xmp.is_null() {
+        defaults.xmp.clone()
+    } else {
+        Some(CStr::from_ptr(cfg.xmp).to_string_lossy().into_owned())
+    };
+
+    let fonts_directory = if cfg.fonts_directory.is_null() {
+        defaults.fonts_directory.clone()
+    } else {
+        let path = CStr::from_ptr(cfg.fonts_directory).to_string_lossy();
+        Some(PathBuf::from(path.into_owned()))
+    };
+
+    let optional_text = |ptr: *const c_char| {
+        (!ptr.is_null()).then(|| CStr::from_ptr(ptr).to_string_lossy().into_owned())
+    };
+
+    let page_mode = match cfg.page_mode {
+        RpdfPageMode::PageModeUseNone => PageMode::UseNone,
+        RpdfPageMode::PageModeUseOutlines => PageMode::UseOutlines,
+        RpdfPageMode::PageModeUseThumbs => PageMode::UseThumbs,
+        RpdfPageMode::PageModeFullScreen => PageMode::FullScreen,
+    };
+
+    let link_style = LinkStyle {
+        border_width: cfg.link_border_width.max(0.0),
+        border_color: cfg.link_border_color,
+        border_style: match cfg.link_border_style {
+            RpdfLinkBorderStyle::LinkBorderSolid => LinkBorderStyle::Solid,
+            RpdfLinkBorderStyle::LinkBorderDashed => LinkBorderStyle::Dashed,
+            RpdfLinkBorderStyle::LinkBorderUnderline => LinkBorderStyle::Underline,
+        },
+        highlight: match cfg.link_highlight {
+            RpdfLinkHighlight::LinkHighlightInvert => LinkHighlight::Invert,
+            RpdfLinkHighlight::LinkHighlightNone => LinkHighlight::None,
+            RpdfLinkHighlight::LinkHighlightOutline => LinkHighlight::Outline,
+            RpdfLinkHighlight::LinkHighlightPush => LinkHighlight::Push,
+        },
+    };
+
+    let page_attachments = if cfg.page_attachments.is_null() {
+        Vec::new()
+    } else {
+        let list = slice::from_raw_parts(cfg.page_attachments, cfg.page_attachments_len as usize);
+        list.iter()
+            .map(|a| PageAttachment {
+                page: a.page as usize,
+                name: optional_text(a.name).unwrap_or_default(),
+                data: if a.data_ptr.is_null() {
+                    Vec::new()
+                } else {
+                    slice::from_raw_parts(a.data_ptr, a.data_len as usize).to_vec()
+                },
+                relationship: match a.relationship {
+                    RpdfAfRelationship::AfRelationshipUnspecified => AfRelationship::Unspecified,
+                    RpdfAfRelationship::AfRelationshipSource => AfRelationship::Source,
+                    RpdfAfRelationship::AfRelationshipData => AfRelationship::Data,
+                    RpdfAfRelationship::AfRelationshipAlternative => AfRelationship::Alternative,
+                    RpdfAfRelationship::AfRelationshipSupplement => AfRelationship::Supplement,
+                },
+            })
+            .collect()
+    };
+
+    let stylesheets = optional_text(cfg.stylesheet_files)
+        .iter()
+        .flat_map(|paths| paths.lines())
+        .filter(|path| !path.trim().is_empty())
+        .map(|path| StylesheetSource::File(PathBuf::from(path)))
+        .collect();
+
     PipelineConfig {
         title,
         page_width,
         page_height,
         page_margin,
         orientation,
+        embed_base_fonts: cfg.embed_base_fonts,
+        base_font,
+        extra_css,
+        stylesheets,
+        rendering_intent,
+        xmp,
+        strict: cfg.strict,
+        strip_metadata: cfg.strip_metadata,
+        optimize: cfg.optimize,
+        font_compression: !cfg.uncompressed_fonts,
+        cache: cfg.use_cache.then(shared_cache),
+        fail_on_missing_assets: cfg.fail_on_missing_assets,
+        page_background,
+        single_content_stream: cfg.single_content_stream,
+        output_size_hint: cfg.output_size_hint as usize,
+        trim_trailing_blank_page: cfg.trim_trailing_blank_page,
+        fonts_directory,
+        print_backgrounds: cfg.print_backgrounds,
+        min_line_width: cfg.min_line_width,
+        max_image_pixels: (cfg.max_image_pixels > 0).then_some(cfg.max_image_pixels),
+        overlay_pdf,
+        user_unit: (cfg.user_unit != 0.0).then_some(cfg.user_unit),
+        object_streams: cfg.object_streams,
+        title_from_first_heading: cfg.title_from_first_heading,
+        producer: optional_text(cfg.producer),
+        creator: optional_text(cfg.creator),
+        viewport_width: (cfg.viewport_width > 0.0).then_some(cfg.viewport_width),
+        header_selector: optional_text(cfg.header_selector),
+        footer_selector: optional_text(cfg.footer_selector),
+        auto_link: cfg.auto_link,
+        link_style,
+        page_mode,
+        text_as_outlines: cfg.text_as_outlines,
+        image_color_management: cfg.image_color_management,
+        header_height: (cfg.header_height > 0.0).then_some(cfg.header_height),
+        footer_height: (cfg.footer_height > 0.0).then_some(cfg.footer_height),
+        named_destinations: cfg.named_destinations,
+        max_output_bytes: (cfg.max_output_bytes > 0).then_some(cfg.max_output_bytes),
+        fit_output_size: cfg.fit_output_size,
+        grayscale: cfg.grayscale,
+        min_font_size: cfg.min_font_size,
+        page_attachments,
+        ..defaults
     }
 }
 
+/// The process-wide cache behind `RpdfPipelineConfig::use_cache`.
+fn shared_cache() -> Arc<dyn Cache> {
+    static SHARED: OnceLock<Arc<LruCache>> = OnceLock::new();
+    SHARED.get_or_init(|| Arc::new(LruCache::default())).clone()
+}
+
 // ---------------------------------------------------------------------------
 // Core API
 // ---------------------------------------------------------------------------
@@ -155,34 +756,37 @@ pub unsafe extern "C" fn rpdf_generate_pdf(
     out_buf: *mut *mut u8,
     out_len: *mut u32,
 ) -> c_int {
-    if html_ptr.is_null() || out_buf.is_null() || out_len.is_null() {
-        set_last_error("Null pointer argument");
-        return 1;
-    }
-
-    let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
-    let html = match std::str::from_utf8(html_bytes) {
-        Ok(s) => s,
-        Err(e) => {
-            set_last_error(&format!("Invalid UTF-8: {e}"));
-            return 2;
+    ffi_guard(|| {
+        if html_ptr.is_null() || out_buf.is_null() || out_len.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
         }
-    };
 
-    match generate_pdf(html, &PipelineConfig::default()) {
-        Ok((pdf_bytes, _config)) => {
-            let len = pdf_bytes.len() as u32;
-            let buf = pdf_bytes.into_boxed_slice();
-            let raw = Box::into_raw(buf) as *mut u8;
-            *out_buf = raw;
-            *out_len = len;
-            0
-        }
-        Err(e) => {
-            set_last_error(&e);
-            3
+        let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
+        let html = match std::str::from_utf8(html_bytes) {
+            Ok(s) => s,
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8: {e}"));
+                return 2;
+            }
+        };
+
+        let _permit = LIMITER.acquire();
+        match generate_pdf(html, &PipelineConfig::default()) {
+            Ok((pdf_bytes, _config)) => {
+                let len = pdf_bytes.len() as u32;
+                let buf = pdf_bytes.into_boxed_slice();
+                let raw = Box::into_raw(buf) as *mut u8;
+                *out_buf = raw;
+                *out_len = len;
+                0
+            }
+            Err(e) => {
+                set_last_error(&e);
+                3
+            }
         }
-    }
+    })
 }
 
 /// Generate a PDF and also return the layout config JSON.
@@ -206,51 +810,54 @@ pub unsafe extern "C" fn rpdf_generate_pdf_with_layout(
     out_pdf_len: *mut u32,
     out_json_ptr: *mut *mut c_char,
 ) -> c_int {
-    if html_ptr.is_null()
-        || out_pdf_buf.is_null()
-        || out_pdf_len.is_null()
-        || out_json_ptr.is_null()
-    {
-        set_last_error("Null pointer argument");
-        return 1;
-    }
-
-    let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
-    let html = match std::str::from_utf8(html_bytes) {
-        Ok(s) => s,
-        Err(e) => {
-            set_last_error(&format!("Invalid UTF-8: {e}"));
-            return 2;
+    ffi_guard(|| {
+        if html_ptr.is_null()
+            || out_pdf_buf.is_null()
+            || out_pdf_len.is_null()
+            || out_json_ptr.is_null()
+        {
+            set_last_error("Null pointer argument");
+            return 1;
         }
-    };
 
-    match generate_pdf(html, &PipelineConfig::default()) {
-        Ok((pdf_bytes, layout_config)) => {
-            // PDF bytes
-            let len = pdf_bytes.len() as u32;
-            let buf = pdf_bytes.into_boxed_slice();
-            let raw = Box::into_raw(buf) as *mut u8;
-            *out_pdf_buf = raw;
-            *out_pdf_len = len;
-
-            // JSON string
-            let json = layout_config.to_json();
-            match CString::new(json) {
-                Ok(cs) => {
-                    *out_json_ptr = cs.into_raw();
-                }
-                Err(_) => {
-                    *out_json_ptr = ptr::null_mut();
-                }
+        let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
+        let html = match std::str::from_utf8(html_bytes) {
+            Ok(s) => s,
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8: {e}"));
+                return 2;
             }
+        };
 
-            0
-        }
-        Err(e) => {
-            set_last_error(&e);
-            3
+        let _permit = LIMITER.acquire();
+        match generate_pdf(html, &PipelineConfig::default()) {
+            Ok((pdf_bytes, layout_config)) => {
+                // PDF bytes
+                let len = pdf_bytes.len() as u32;
+                let buf = pdf_bytes.into_boxed_slice();
+                let raw = Box::into_raw(buf) as *mut u8;
+                *out_pdf_buf = raw;
+                *out_pdf_len = len;
+
+                // JSON string
+                let json = layout_config.to_json();
+                match CString::new(json) {
+                    Ok(cs) => {
+                        *out_json_ptr = cs.into_raw();
+                    }
+                    Err(_) => {
+                        *out_json_ptr = ptr::null_mut();
+                    }
+                }
+
+                0
+            }
+            Err(e) => {
+                set_last_error(&e);
+                3
+            }
         }
-    }
+    })
 }
 
 /// Compute only the layout config (no PDF rendering). Returns JSON.
@@ -267,33 +874,42 @@ pub unsafe extern "C" fn rpdf_compute_layout(
     html_len: u32,
     out_json_ptr: *mut *mut c_char,
 ) -> c_int {
-    if html_ptr.is_null() || out_json_ptr.is_null() {
-        set_last_error("Null pointer argument");
-        return 1;
-    }
-
-    let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
-    let html = match std::str::from_utf8(html_bytes) {
-        Ok(s) => s,
-        Err(e) => {
-            set_last_error(&format!("Invalid UTF-8: {e}"));
-            return 2;
+    ffi_guard(|| {
+        if html_ptr.is_null() || out_json_ptr.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
         }
-    };
 
-    let config = crate::pipeline::compute_layout_config(html, &PipelineConfig::default());
-    let json = config.to_json();
+        let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
+        let html = match std::str::from_utf8(html_bytes) {
+            Ok(s) => s,
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8: {e}"));
+                return 2;
+            }
+        };
 
-    match CString::new(json) {
-        Ok(cs) => {
-            *out_json_ptr = cs.into_raw();
-            0
-        }
-        Err(_) => {
-            set_last_error("JSON contained null byte");
-            3
+        let _permit = LIMITER.acquire();
+        let config = PipelineConfig::default();
+        let json = match crate::pipeline::try_compute_layout_config(html, &config) {
+            Ok(config) => config.to_json(),
+            Err(e) => {
+                set_last_error(&e);
+                return 3;
+            }
+        };
+
+        match CString::new(json) {
+            Ok(cs) => {
+                *out_json_ptr = cs.into_raw();
+                0
+            }
+            Err(_) => {
+                set_last_error("JSON contained null byte");
+                3
+            }
         }
-    }
+    })
 }
 
 // ---------------------------------------------------------------------------
@@ -324,41 +940,183 @@ pub unsafe extern "C" fn rpdf_generate_pdf_ex(
     out_buf: *mut *mut u8,
     out_len: *mut u32,
 ) -> c_int {
-    if html_ptr.is_null() || out_buf.is_null() || out_len.is_null() {
-        set_last_error("Null pointer argument");
-        return 1;
-    }
+    ffi_guard(|| {
+        if html_ptr.is_null() || out_buf.is_null() || out_len.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
+        }
 
-    let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
-    let html = match std::str::from_utf8(html_bytes) {
-        Ok(s) => s,
-        Err(e) => {
-            set_last_error(&format!("Invalid UTF-8: {e}"));
-            return 2;
+        let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
+        let html = match std::str::from_utf8(html_bytes) {
+            Ok(s) => s,
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8: {e}"));
+                return 2;
+            }
+        };
+
+        let config = if cfg.is_null() {
+            PipelineConfig::default()
+        } else {
+            pipeline_config_from_c(&*cfg)
+        };
+
+        let _permit = LIMITER.acquire();
+        match generate_pdf(html, &config) {
+            Ok((pdf_bytes, _)) => {
+                let len = pdf_bytes.len() as u32;
+                let buf = pdf_bytes.into_boxed_slice();
+                *out_buf = Box::into_raw(buf) as *mut u8;
+                *out_len = len;
+                0
+            }
+            Err(e) => generation_error(&e),
         }
-    };
+    })
+}
 
-    let config = if cfg.is_null() {
-        PipelineConfig::default()
-    } else {
-        pipeline_config_from_c(&*cfg)
-    };
+/// Generate a PDF from HTML with a custom [`RpdfPipelineConfig`] and write
+/// it to the file at `path`, replacing any file there, instead of returning
+/// it in a buffer – for documents too large to copy into the host's memory.
+///
+/// # Parameters
+/// - `html_ptr`, `html_len`: UTF-8 HTML input
+/// - `cfg`: optional pointer to an [`RpdfPipelineConfig`]; pass `NULL` for defaults
+/// - `path`: null-terminated UTF-8 path of the output file
+/// - `out_len`: receives the size of the written file in bytes
+///
+/// # Returns
+/// `0` on success; `3` if generation or writing the file fails.
+///
+/// # Safety
+/// Same as `rpdf_generate_pdf_ex`; `path` must be a valid null-terminated
+/// string.
+#[no_mangle]
+pub unsafe extern "C" fn rpdf_generate_pdf_to_file_ex(
+    html_ptr: *const u8,
+    html_len: u32,
+    cfg: *const RpdfPipelineConfig,
+    path: *const c_char,
+    out_len: *mut u64,
+) -> c_int {
+    ffi_guard(|| {
+        if html_ptr.is_null() || path.is_null() || out_len.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
+        }
 
-    match generate_pdf(html, &config) {
-        Ok((pdf_bytes, _)) => {
-            let len = pdf_bytes.len() as u32;
-            let buf = pdf_bytes.into_boxed_slice();
-            *out_buf = Box::into_raw(buf) as *mut u8;
-            *out_len = len;
-            0
+        let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
+        let html = match std::str::from_utf8(html_bytes) {
+            Ok(s) => s,
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8: {e}"));
+                return 2;
+            }
+        };
+        let path = match CStr::from_ptr(path).to_str() {
+            Ok(p) => Path::new(p),
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8 in path: {e}"));
+                return 2;
+            }
+        };
+
+        let config = if cfg.is_null() {
+            PipelineConfig::default()
+        } else {
+            pipeline_config_from_c(&*cfg)
+        };
+
+        let _permit = LIMITER.acquire();
+        match generate_to_file(html, path, &config) {
+            Ok(len) => {
+                *out_len = len;
+                0
+            }
+            Err(e) => generation_error(&e),
         }
-        Err(e) => {
-            set_last_error(&e);
-            3
+    })
+}
+
+/// Callback that supplies HTML to [`rpdf_generate_pdf_stream_ex`]: copy up to
+/// `cap` bytes into `buf` and return how many were copied, `0` at the end of
+/// the input, or a negative value if reading failed.
+pub type RpdfReadFn =
+    Option<unsafe extern "C" fn(ctx: *mut c_void, buf: *mut u8, cap: usize) -> isize>;
+
+/// [`Read`] over an [`RpdfReadFn`].
+struct CallbackReader {
+    read: unsafe extern "C" fn(*mut c_void, *mut u8, usize) -> isize,
+    ctx: *mut c_void,
+}
+
+impl Read for CallbackReader {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = unsafe { (self.read)(self.ctx, buf.as_mut_ptr(), buf.len()) };
+        match usize::try_from(n) {
+            Ok(n) if n <= buf.len() => Ok(n),
+            Ok(_) => Err(io::Error::other("read callback overran the buffer")),
+            Err(_) => Err(io::Error::other(format!("read callback failed ({n})"))),
         }
     }
 }
 
+/// Generate a PDF from HTML pulled through `read`, parsing it as it arrives
+/// instead of requiring the whole document in one buffer.
+///
+/// # Parameters
+/// - `read`, `ctx`: callback supplying UTF-8 HTML; `ctx` is passed to every
+///   call unchanged
+/// - `cfg`: optional pointer to an [`RpdfPipelineConfig`]; pass `NULL` for defaults
+/// - `out_buf`, `out_len`: PDF output
+///
+/// # Returns
+/// `0` on success; `3` if the callback reports an error, the input is not
+/// valid UTF-8 or generation fails.
+///
+/// # Safety
+/// - `read` must be safe to call with `ctx` until this function returns; it
+///   is called on the calling thread only.
+/// - `cfg` is as for `rpdf_generate_pdf_ex`.
+/// - The caller must free `*out_buf` with `rpdf_free_buffer`.
+#[no_mangle]
+pub unsafe extern "C" fn rpdf_generate_pdf_stream_ex(
+    read: RpdfReadFn,
+    ctx: *mut c_void,
+    cfg: *const RpdfPipelineConfig,
+    out_buf: *mut *mut u8,
+    out_len: *mut u32,
+) -> c_int {
+    ffi_guard(|| {
+        let Some(read) = read else {
+            set_last_error("Null pointer argument");
+            return 1;
+        };
+        if out_buf.is_null() || out_len.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
+        }
+
+        let config = if cfg.is_null() {
+            PipelineConfig::default()
+        } else {
+            pipeline_config_from_c(&*cfg)
+        };
+
+        let _permit = LIMITER.acquire();
+        match generate_from_reader(CallbackReader { read, ctx }, &config) {
+            Ok(generated) => {
+                let len = generated.bytes.len() as u32;
+                let buf = generated.bytes.into_boxed_slice();
+                *out_buf = Box::into_raw(buf) as *mut u8;
+                *out_len = len;
+                0
+            }
+            Err(e) => generation_error(&e),
+        }
+    })
+}
+
 /// Generate a PDF and layout JSON from HTML with a custom [`RpdfPipelineConfig`].
 ///
 /// # Parameters
@@ -381,49 +1139,49 @@ pub unsafe extern "C" fn rpdf_generate_pdf_with_layout_ex(
     out_pdf_len: *mut u32,
     out_json_ptr: *mut *mut c_char,
 ) -> c_int {
-    if html_ptr.is_null()
-        || out_pdf_buf.is_null()
-        || out_pdf_len.is_null()
-        || out_json_ptr.is_null()
-    {
-        set_last_error("Null pointer argument");
-        return 1;
-    }
-
-    let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
-    let html = match std::str::from_utf8(html_bytes) {
-        Ok(s) => s,
-        Err(e) => {
-            set_last_error(&format!("Invalid UTF-8: {e}"));
-            return 2;
+    ffi_guard(|| {
+        if html_ptr.is_null()
+            || out_pdf_buf.is_null()
+            || out_pdf_len.is_null()
+            || out_json_ptr.is_null()
+        {
+            set_last_error("Null pointer argument");
+            return 1;
         }
-    };
 
-    let config = if cfg.is_null() {
-        PipelineConfig::default()
-    } else {
-        pipeline_config_from_c(&*cfg)
-    };
+        let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
+        let html = match std::str::from_utf8(html_bytes) {
+            Ok(s) => s,
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8: {e}"));
+                return 2;
+            }
+        };
 
-    match generate_pdf(html, &config) {
-        Ok((pdf_bytes, layout_config)) => {
-            let len = pdf_bytes.len() as u32;
-            let buf = pdf_bytes.into_boxed_slice();
-            *out_pdf_buf = Box::into_raw(buf) as *mut u8;
-            *out_pdf_len = len;
+        let config = if cfg.is_null() {
+            PipelineConfig::default()
+        } else {
+            pipeline_config_from_c(&*cfg)
+        };
 
-            let json = layout_config.to_json();
-            match CString::new(json) {
-                Ok(cs) => *out_json_ptr = cs.into_raw(),
-                Err(_) => *out_json_ptr = ptr::null_mut(),
+        let _permit = LIMITER.acquire();
+        match generate_pdf(html, &config) {
+            Ok((pdf_bytes, layout_config)) => {
+                let len = pdf_bytes.len() as u32;
+                let buf = pdf_bytes.into_boxed_slice();
+                *out_pdf_buf = Box::into_raw(buf) as *mut u8;
+                *out_pdf_len = len;
+
+                let json = layout_config.to_json();
+                match CString::new(json) {
+                    Ok(cs) => *out_json_ptr = cs.into_raw(),
+                    Err(_) => *out_json_ptr = ptr::null_mut(),
+                }
+                0
             }
-            0
-        }
-        Err(e) => {
-            set_last_error(&e);
-            3
+            Err(e) => generation_error(&e),
         }
-    }
+    })
 }
 
 /// Compute only the layout config JSON from HTML with a custom [`RpdfPipelineConfig`].
@@ -434,7 +1192,7 @@ pub unsafe extern "C" fn rpdf_generate_pdf_with_layout_ex(
 /// - `out_json_ptr`: layout JSON output (free with `rpdf_free_string`)
 ///
 /// # Returns
-/// `0` on success.
+/// `0` on success, `3` if the config's fonts cannot be loaded.
 ///
 /// # Safety
 /// Same as `rpdf_generate_pdf_ex`.
@@ -445,39 +1203,172 @@ pub unsafe extern "C" fn rpdf_compute_layout_ex(
     cfg: *const RpdfPipelineConfig,
     out_json_ptr: *mut *mut c_char,
 ) -> c_int {
-    if html_ptr.is_null() || out_json_ptr.is_null() {
-        set_last_error("Null pointer argument");
-        return 1;
-    }
+    ffi_guard(|| {
+        if html_ptr.is_null() || out_json_ptr.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
+        }
+
+        let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
+        let html = match std::str::from_utf8(html_bytes) {
+            Ok(s) => s,
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8: {e}"));
+                return 2;
+            }
+        };
 
-    let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
-    let html = match std::str::from_utf8(html_bytes) {
-        Ok(s) => s,
-        Err(e) => {
-            set_last_error(&format!("Invalid UTF-8: {e}"));
-            return 2;
+        let config = if cfg.is_null() {
+            PipelineConfig::default()
+        } else {
+            pipeline_config_from_c(&*cfg)
+        };
+
+        let _permit = LIMITER.acquire();
+        let json = match crate::pipeline::try_compute_layout_config(html, &config) {
+            Ok(layout) => layout.to_json(),
+            Err(e) => {
+                set_last_error(&e);
+                return 3;
+            }
+        };
+
+        match CString::new(json) {
+            Ok(cs) => {
+                *out_json_ptr = cs.into_raw();
+                0
+            }
+            Err(_) => {
+                set_last_error("JSON contained null byte");
+                3
+            }
         }
-    };
+    })
+}
 
-    let config = if cfg.is_null() {
-        PipelineConfig::default()
-    } else {
-        pipeline_config_from_c(&*cfg)
-    };
+/// Lay HTML out and return the box tree with computed geometry as JSON,
+/// without paginating or rendering.
+///
+/// # Parameters
+/// - `html_ptr`, `html_len`: UTF-8 HTML input
+/// - `cfg`: optional pointer to an [`RpdfPipelineConfig`]; pass `NULL` for defaults
+/// - `out_json_ptr`: array of box objects (`tag`, `id`, `classes`, `x`, `y`,
+///   `width`, `height`, `lines`, `children`); free with `rpdf_free_string`
+///
+/// # Returns
+/// `0` on success, `3` if the configured fonts cannot be loaded.
+///
+/// # Safety
+/// Same as `rpdf_generate_pdf_ex`.
+#[no_mangle]
+pub unsafe extern "C" fn rpdf_layout_tree_ex(
+    html_ptr: *const u8,
+    html_len: u32,
+    cfg: *const RpdfPipelineConfig,
+    out_json_ptr: *mut *mut c_char,
+) -> c_int {
+    ffi_guard(|| {
+        if html_ptr.is_null() || out_json_ptr.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
+        }
+
+        let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
+        let html = match std::str::from_utf8(html_bytes) {
+            Ok(s) => s,
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8: {e}"));
+                return 2;
+            }
+        };
 
-    let layout = crate::pipeline::compute_layout_config(html, &config);
-    let json = layout.to_json();
+        let config = if cfg.is_null() {
+            PipelineConfig::default()
+        } else {
+            pipeline_config_from_c(&*cfg)
+        };
+
+        let _permit = LIMITER.acquire();
+        let tree = match crate::pipeline::layout_tree(html, &config) {
+            Ok(tree) => tree,
+            Err(e) => {
+                set_last_error(&e);
+                return 3;
+            }
+        };
+        let json = serde_json::to_string(&tree).unwrap_or_else(|_| "[]".to_string());
 
-    match CString::new(json) {
-        Ok(cs) => {
-            *out_json_ptr = cs.into_raw();
-            0
+        match CString::new(json) {
+            Ok(cs) => {
+                *out_json_ptr = cs.into_raw();
+                0
+            }
+            Err(_) => {
+                set_last_error("JSON contained null byte");
+                3
+            }
+        }
+    })
+}
+
+/// Generate a PDF like [`rpdf_generate_pdf_ex`] and also write the SHA-256
+/// digest of the PDF bytes to `out_sha256`.
+///
+/// # Parameters
+/// - `html_ptr`, `html_len`: UTF-8 HTML input
+/// - `cfg`: optional pointer to an [`RpdfPipelineConfig`]; pass `NULL` for defaults
+/// - `out_buf`, `out_len`: PDF output (free with `rpdf_free_buffer`)
+/// - `out_sha256`: caller-owned buffer of at least 32 bytes
+///
+/// # Returns
+/// `0` on success.
+///
+/// # Safety
+/// Same as `rpdf_generate_pdf_ex`. Additionally, `out_sha256` must be valid
+/// for 32 bytes of writes.
+#[no_mangle]
+pub unsafe extern "C" fn rpdf_generate_pdf_digest_ex(
+    html_ptr: *const u8,
+    html_len: u32,
+    cfg: *const RpdfPipelineConfig,
+    out_buf: *mut *mut u8,
+    out_len: *mut u32,
+    out_sha256: *mut u8,
+) -> c_int {
+    ffi_guard(|| {
+        if html_ptr.is_null() || out_buf.is_null() || out_len.is_null() || out_sha256.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
         }
-        Err(_) => {
-            set_last_error("JSON contained null byte");
-            3
+
+        let html_bytes = slice::from_raw_parts(html_ptr, html_len as usize);
+        let html = match std::str::from_utf8(html_bytes) {
+            Ok(s) => s,
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8: {e}"));
+                return 2;
+            }
+        };
+
+        let config = if cfg.is_null() {
+            PipelineConfig::default()
+        } else {
+            pipeline_config_from_c(&*cfg)
+        };
+
+        let _permit = LIMITER.acquire();
+        match generate(html, &config) {
+            Ok(pdf) => {
+                ptr::copy_nonoverlapping(pdf.sha256.as_ptr(), out_sha256, pdf.sha256.len());
+                let len = pdf.bytes.len() as u32;
+                let buf = pdf.bytes.into_boxed_slice();
+                *out_buf = Box::into_raw(buf) as *mut u8;
+                *out_len = len;
+                0
+            }
+            Err(e) => generation_error(&e),
         }
-    }
+    })
 }
 
 /// Render a PDF from a layout config JSON string.
@@ -489,42 +1380,329 @@ pub unsafe extern "C" fn rpdf_render_from_layout(
     out_buf: *mut *mut u8,
     out_len: *mut u32,
 ) -> c_int {
-    if json_ptr.is_null() || out_buf.is_null() || out_len.is_null() {
-        set_last_error("Null pointer argument");
-        return 1;
-    }
+    ffi_guard(|| {
+        if json_ptr.is_null() || out_buf.is_null() || out_len.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
+        }
 
-    let json_cstr = CStr::from_ptr(json_ptr);
-    let json = match json_cstr.to_str() {
-        Ok(s) => s,
-        Err(e) => {
-            set_last_error(&format!("Invalid UTF-8 in JSON: {e}"));
-            return 2;
+        let json_cstr = CStr::from_ptr(json_ptr);
+        let json = match json_cstr.to_str() {
+            Ok(s) => s,
+            Err(e) => {
+                set_last_error(&format!("Invalid UTF-8 in JSON: {e}"));
+                return 2;
+            }
+        };
+
+        let layout_config = match crate::layout_config::LayoutConfig::from_json(json) {
+            Ok(c) => c,
+            Err(e) => {
+                set_last_error(&format!("Invalid layout JSON: {e}"));
+                return 3;
+            }
+        };
+
+        let _permit = LIMITER.acquire();
+        match crate::render::render_pdf(&layout_config) {
+            Ok(pdf_bytes) => {
+                let len = pdf_bytes.len() as u32;
+                let buf = pdf_bytes.into_boxed_slice();
+                let raw = Box::into_raw(buf) as *mut u8;
+                *out_buf = raw;
+                *out_len = len;
+                0
+            }
+            Err(e) => {
+                set_last_error(&e);
+                4
+            }
+        }
+    })
+}
+
+/// List the fonts used by a PDF (any PDF, not only pdf-forge output).
+///
+/// `*out_json_ptr` receives a JSON array of
+/// `{"name", "kind", "embedded", "subset"}` objects; free it with
+/// `rpdf_free_string`.
+///
+/// # Returns
+/// `0` on success, `3` if the bytes are not a readable PDF.
+///
+/// # Safety
+/// `pdf_ptr` must point to `pdf_len` readable bytes.
+#[no_mangle]
+pub unsafe extern "C" fn rpdf_list_fonts(
+    pdf_ptr: *const u8,
+    pdf_len: u32,
+    out_json_ptr: *mut *mut c_char,
+) -> c_int {
+    ffi_guard(|| {
+        if pdf_ptr.is_null() || out_json_ptr.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
         }
-    };
 
-    let layout_config = match crate::layout_config::LayoutConfig::from_json(json) {
-        Ok(c) => c,
-        Err(e) => {
-            set_last_error(&format!("Invalid layout JSON: {e}"));
-            return 3;
+        let pdf = slice::from_raw_parts(pdf_ptr, pdf_len as usize);
+        let fonts = match crate::inspect::list_fonts(pdf) {
+            Ok(f) => f,
+            Err(e) => {
+                set_last_error(&e);
+                return 3;
+            }
+        };
+        let json = serde_json::to_string(&fonts).unwrap_or_else(|_| "[]".to_string());
+
+        match CString::new(json) {
+            Ok(cs) => {
+                *out_json_ptr = cs.into_raw();
+                0
+            }
+            Err(_) => {
+                set_last_error("JSON contained null byte");
+                3
+            }
         }
-    };
+    })
+}
 
-    match crate::render::render_pdf(&layout_config) {
-        Ok(pdf_bytes) => {
-            let len = pdf_bytes.len() as u32;
-            let buf = pdf_bytes.into_boxed_slice();
-            let raw = Box::into_raw(buf) as *mut u8;
-            *out_buf = raw;
-            *out_len = len;
-            0
+/// Read the document information and page count of a PDF (any PDF, not
+/// only pdf-forge output).
+///
+/// `*out_json_ptr` receives a JSON object with `title`, `author`,
+/// `subject`, `keywords`, `creator`, `producer` and `creation_date` (each a
+/// string or `null`) and `page_count`; free it with `rpdf_free_string`.
+///
+/// # Returns
+/// `0` on success, `3` if the bytes are not a readable PDF.
+///
+/// # Safety
+/// `pdf_ptr` must point to `pdf_len` readable bytes.
+#[no_mangle]
+pub unsafe extern "C" fn rpdf_read_metadata(
+    pdf_ptr: *const u8,
+    pdf_len: u32,
+    out_json_ptr: *mut *mut c_char,
+) -> c_int {
+    ffi_guard(|| {
+        if pdf_ptr.is_null() || out_json_ptr.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
         }
-        Err(e) => {
-            set_last_error(&e);
-            4
+
+        let pdf = slice::from_raw_parts(pdf_ptr, pdf_len as usize);
+        let metadata = match crate::inspect::read_metadata(pdf) {
+            Ok(m) => m,
+            Err(e) => {
+                set_last_error(&e);
+                return 3;
+            }
+        };
+        let json = serde_json::to_string(&metadata).unwrap_or_else(|_| "{}".to_string());
+
+        match CString::new(json) {
+            Ok(cs) => {
+                *out_json_ptr = cs.into_raw();
+                0
+            }
+            Err(_) => {
+                set_last_error("JSON contained null byte");
+                3
+            }
         }
-    }
+    })
+}
+
+/// Rebuild the cross-reference table of a malformed PDF (see
+/// `pdf_forge::repair::repair`).
+///
+/// On success `*out_buf` / `*out_len` receive the repaired file; free it
+/// with `rpdf_free_buffer`.
+///
+/// # Returns
+/// `0` on success, `3` if the file cannot be repaired.
+///
+/// # Safety
+/// `pdf_ptr` must point to `pdf_len` readable bytes.
+#[no_mangle]
+pub unsafe extern "C" fn rpdf_repair(
+    pdf_ptr: *const u8,
+    pdf_len: u32,
+    out_buf: *mut *mut u8,
+    out_len: *mut u32,
+) -> c_int {
+    ffi_guard(|| {
+        if pdf_ptr.is_null() || out_buf.is_null() || out_len.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
+        }
+
+        let pdf = slice::from_raw_parts(pdf_ptr, pdf_len as usize);
+        match crate::repair::repair(pdf) {
+            Ok(bytes) => {
+                let len = bytes.len() as u32;
+                let buf = bytes.into_boxed_slice();
+                *out_buf = Box::into_raw(buf) as *mut u8;
+                *out_len = len;
+                0
+            }
+            Err(e) => {
+                set_last_error(&e);
+                3
+            }
+        }
+    })
+}
+
+/// Convert one page of a PDF (any PDF, not only pdf-forge output) to SVG
+/// for web previews (see `pdf_forge::svg::page_to_svg`).
+///
+/// `page` is 1-based. `*out_svg_ptr` receives the SVG document; free it with
+/// `rpdf_free_string`.
+///
+/// # Returns
+/// `0` on success, `3` if the bytes are not a readable PDF or the page does
+/// not exist.
+///
+/// # Safety
+/// `pdf_ptr` must point to `pdf_len` readable bytes.
+#[no_mangle]
+pub unsafe extern "C" fn rpdf_page_to_svg(
+    pdf_ptr: *const u8,
+    pdf_len: u32,
+    page: u32,
+    out_svg_ptr: *mut *mut c_char,
+) -> c_int {
+    ffi_guard(|| {
+        if pdf_ptr.is_null() || out_svg_ptr.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
+        }
+
+        let pdf = slice::from_raw_parts(pdf_ptr, pdf_len as usize);
+        let svg = match crate::svg::page_to_svg(pdf, page as usize) {
+            Ok(svg) => svg,
+            Err(e) => {
+                set_last_error(&e);
+                return 3;
+            }
+        };
+
+        match CString::new(svg) {
+            Ok(cs) => {
+                *out_svg_ptr = cs.into_raw();
+                0
+            }
+            Err(_) => {
+                set_last_error("SVG contained null byte");
+                3
+            }
+        }
+    })
+}
+
+/// Extract the images embedded in a PDF (any PDF, not only pdf-forge
+/// output; see `pdf_forge::inspect::extract_images`).
+///
+/// `*out_json_ptr` receives a JSON array of
+/// `{"page", "name", "format", "width", "height", "data"}` objects, where
+/// `format` is `"jpeg"` or `"png"` and `data` is the base64-encoded file;
+/// free it with `rpdf_free_string`.
+///
+/// # Returns
+/// `0` on success, `3` if the bytes are not a readable PDF.
+///
+/// # Safety
+/// `pdf_ptr` must point to `pdf_len` readable bytes.
+#[no_mangle]
+pub unsafe extern "C" fn rpdf_extract_images(
+    pdf_ptr: *const u8,
+    pdf_len: u32,
+    out_json_ptr: *mut *mut c_char,
+) -> c_int {
+    ffi_guard(|| {
+        if pdf_ptr.is_null() || out_json_ptr.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
+        }
+
+        let pdf = slice::from_raw_parts(pdf_ptr, pdf_len as usize);
+        let images = match crate::inspect::extract_images(pdf) {
+            Ok(i) => i,
+            Err(e) => {
+                set_last_error(&e);
+                return 3;
+            }
+        };
+        let json = serde_json::to_string(&images).unwrap_or_else(|_| "[]".to_string());
+
+        match CString::new(json) {
+            Ok(cs) => {
+                *out_json_ptr = cs.into_raw();
+                0
+            }
+            Err(_) => {
+                set_last_error("JSON contained null byte");
+                3
+            }
+        }
+    })
+}
+
+/// Check a PDF for print-readiness problems (see
+/// `pdf_forge::inspect::preflight`): RGB colour, fonts that are not
+/// embedded, images below `min_image_dpi` (`0` for the default of 150) and
+/// missing bleed.
+///
+/// `*out_json_ptr` receives `{"issues": [{"check", "page", "message"}]}`,
+/// where `check` is `"rgb_color"`, `"font_not_embedded"`,
+/// `"low_resolution_image"` or `"missing_bleed"` and `page` is 1-based or
+/// `null` for fonts; free it with `rpdf_free_string`.
+///
+/// # Returns
+/// `0` on success, `3` if the bytes are not a readable PDF.
+///
+/// # Safety
+/// `pdf_ptr` must point to `pdf_len` readable bytes.
+#[no_mangle]
+pub unsafe extern "C" fn rpdf_preflight(
+    pdf_ptr: *const u8,
+    pdf_len: u32,
+    min_image_dpi: f32,
+    out_json_ptr: *mut *mut c_char,
+) -> c_int {
+    ffi_guard(|| {
+        if pdf_ptr.is_null() || out_json_ptr.is_null() {
+            set_last_error("Null pointer argument");
+            return 1;
+        }
+
+        let pdf = slice::from_raw_parts(pdf_ptr, pdf_len as usize);
+        let mut options = crate::inspect::PreflightOptions::default();
+        if min_image_dpi > 0.0 {
+            options.min_image_dpi = min_image_dpi;
+        }
+        let report = match crate::inspect::preflight(pdf, &options) {
+            Ok(r) => r,
+            Err(e) => {
+                set_last_error(&e);
+                return 3;
+            }
+        };
+        let json = serde_json::to_string(&report).unwrap_or_else(|_| "{}".to_string());
+
+        match CString::new(json) {
+            Ok(cs) => {
+                *out_json_ptr = cs.into_raw();
+                0
+            }
+            Err(_) => {
+                set_last_error("JSON contained null byte");
+                3
+            }
+        }
+    })
 }
 
 // ---------------------------------------------------------------------------
@@ -580,6 +1758,38 @@ pub extern "C" fn rpdf_version() -> *const c_char {
     b"0.1.0\0".as_ptr() as *const c_char
 }
 
+/// How the native library was built.
+#[derive(serde::Serialize)]
+struct BuildInfo {
+    version: &'static str,
+    /// Short git commit hash, or `unknown` when built outside a checkout.
+    commit: &'static str,
+    /// UTC build date, `YYYY-MM-DD`.
+    build_date: &'static str,
+    /// Enabled Cargo features.
+    features: Vec<&'static str>,
+}
+
+/// Return how the library was built as a null-terminated JSON object:
+/// `{"version", "commit", "build_date", "features"}`.
+/// The caller must **not** free this pointer.
+#[no_mangle]
+pub extern "C" fn rpdf_build_info() -> *const c_char {
+    static INFO: OnceLock<CString> = OnceLock::new();
+    INFO.get_or_init(|| {
+        let features = env!("PDF_FORGE_FEATURES");
+        let info = BuildInfo {
+            version: env!("CARGO_PKG_VERSION"),
+            commit: env!("PDF_FORGE_GIT_COMMIT"),
+            build_date: env!("PDF_FORGE_BUILD_DATE"),
+            features: features.split(',').filter(|f| !f.is_empty()).collect(),
+        };
+        let json = serde_json::to_string(&info).unwrap_or_else(|_| "{}".to_string());
+        CString::new(json).unwrap_or_default()
+    })
+    .as_ptr()
+}
+
 // ---------------------------------------------------------------------------
 // Tests
 // ---------------------------------------------------------------------------
@@ -637,6 +1847,81 @@ mod tests {
         assert_ne!(rc, 0, "Should fail on null input");
     }
 
+    #[test]
+    fn ffi_max_concurrency_bounds_simultaneous_renders() {
+        // A limiter of its own, so the other tests' renders do not count.
+        let limiter = Limiter::new();
+        limiter.set_max(2);
+        std::thread::scope(|scope| {
+            for _ in 0..8 {
+                scope.spawn(|| {
+                    let _permit = limiter.acquire();
+                    std::thread::sleep(std::time::Duration::from_millis(20));
+                });
+            }
+        });
+        let state = limiter.lock();
+        assert_eq!(state.active, 0);
+        // Eight 20 ms holders under a limit of 2: both slots were filled at
+        // once, and the others had to wait for them.
+        assert_eq!(state.peak, 2, "peak concurrency was {}", state.peak);
+    }
+
+    #[test]
+    fn ffi_digest_matches_output_bytes() {
+        use sha2::{Digest, Sha256};
+
+        let html = b"<h1>Digest</h1>";
+        let mut out_buf: *mut u8 = ptr::null_mut();
+        let mut out_len: u32 = 0;
+        let mut digest = [0u8; 32];
+
+        let rc = unsafe {
+            rpdf_generate_pdf_digest_ex(
+                html.as_ptr(),
+                html.len() as u32,
+                ptr::null(),
+                &mut out_buf,
+                &mut out_len,
+                digest.as_mut_ptr(),
+            )
+        };
+
+        assert_eq!(rc, 0);
+        let bytes = unsafe { slice::from_raw_parts(out_buf, out_len as usize) };
+        let expected: [u8; 32] = Sha256::digest(bytes).into();
+        assert_eq!(digest, expected);
+        unsafe { rpdf_free_buffer(out_buf, out_len) };
+    }
+
+    #[test]
+    fn ffi_guard_converts_panics_to_internal_error() {
+        let rc = ffi_guard(|| panic!("layout exploded"));
+        assert_eq!(rc, RC_INTERNAL);
+        let err = unsafe { CStr::from_ptr(rpdf_last_error()) }.to_str().unwrap();
+        assert_eq!(err, "Internal error: layout exploded");
+
+        // The library stays usable after a caught panic.
+        assert_eq!(ffi_guard(|| 0), 0);
+    }
+
+    #[test]
+    fn ffi_entry_point_reports_an_internal_panic_as_rc_internal() {
+        PANIC_NEXT_CALL.with(|p| p.set(true));
+        let html = b"<p>x</p>";
+        let mut out_json: *mut c_char = ptr::null_mut();
+        let rc = unsafe { rpdf_compute_layout(html.as_ptr(), html.len() as u32, &mut out_json) };
+        assert_eq!(rc, RC_INTERNAL);
+        assert!(out_json.is_null());
+        let err = unsafe { CStr::from_ptr(rpdf_last_error()) }.to_str().unwrap();
+        assert_eq!(err, "Internal error: panic injected by test");
+
+        // The hook fires once; the same call then succeeds.
+        let rc = unsafe { rpdf_compute_layout(html.as_ptr(), html.len() as u32, &mut out_json) };
+        assert_eq!(rc, 0);
+        unsafe { rpdf_free_string(out_json) };
+    }
+
     #[test]
     fn ffi_version() {
         let v = rpdf_version();
@@ -644,6 +1929,18 @@ mod tests {
         assert_eq!(version, "0.1.0");
     }
 
+    #[test]
+    fn ffi_build_info_is_static_json() {
+        let first = rpdf_build_info();
+        assert_eq!(first, rpdf_build_info());
+        let json = unsafe { CStr::from_ptr(first) }.to_str().unwrap();
+        let info: serde_json::Value = serde_json::from_str(json).unwrap();
+        assert_eq!(info["version"], "0.1.0");
+        assert!(!info["commit"].as_str().unwrap().is_empty());
+        assert_eq!(info["build_date"].as_str().unwrap().len(), 10);
+        assert!(info["features"].is_array());
+    }
+
     #[test]
     fn ffi_generate_pdf_ex_null_config_uses_defaults() {
         let html = b"<h1>Hello ex</h1>";
@@ -679,6 +1976,7 @@ mod tests {
             page_height: 0.0, // default
             page_margin: 20.0,
             orientation: RpdfPageOrientation::Landscape,
+            ..RpdfPipelineConfig::default()
         };
 
         let mut out_buf: *mut u8 = ptr::null_mut();
@@ -701,17 +1999,32 @@ mod tests {
         unsafe { rpdf_free_buffer(out_buf, out_len) };
     }
 
+    #[test]
+    fn ffi_generate_pdf_ex_renders_empty_html_as_one_blank_page() {
+        // Go's WithAllowEmpty passes a valid pointer with a zero length.
+        let html = [0u8];
+        let mut out_buf: *mut u8 = ptr::null_mut();
+        let mut out_len: u32 = 0;
+
+        let rc = unsafe {
+            rpdf_generate_pdf_ex(html.as_ptr(), 0, ptr::null(), &mut out_buf, &mut out_len)
+        };
+
+        assert_eq!(rc, 0);
+        let bytes = unsafe { slice::from_raw_parts(out_buf, out_len as usize) };
+        let doc = lopdf::Document::load_mem(bytes).unwrap();
+        assert_eq!(doc.get_pages().len(), 1);
+        unsafe { rpdf_free_buffer(out_buf, out_len) };
+    }
+
     #[test]
     fn ffi_compute_layout_ex_landscape() {
         use std::ffi::CString;
 
         let html = b"<p>Landscape layout</p>";
         let cfg = RpdfPipelineConfig {
-            title: ptr::null(),
-            page_width: 0.0,
-            page_height: 0.0,
-            page_margin: 0.0,
             orientation: RpdfPageOrientation::Landscape,
+            ..RpdfPipelineConfig::default()
         };
         let mut json_ptr: *mut c_char = ptr::null_mut();
 
@@ -729,4 +2042,53 @@ mod tests {
         );
         unsafe { rpdf_free_string(json_ptr) };
     }
+
+    #[test]
+    fn ffi_generate_pdf_stream_ex_pulls_html_through_the_callback() {
+        /// Serves the `&[u8]` behind `ctx` a few bytes per call.
+        unsafe extern "C" fn read(ctx: *mut c_void, buf: *mut u8, cap: usize) -> isize {
+            let rest = &mut *(ctx as *mut &[u8]);
+            let n = rest.len().min(cap).min(5);
+            ptr::copy_nonoverlapping(rest.as_ptr(), buf, n);
+            *rest = &rest[n..];
+            n as isize
+        }
+        unsafe extern "C" fn fail(_: *mut c_void, _: *mut u8, _: usize) -> isize {
+            -1
+        }
+
+        let mut html: &[u8] = b"<h1>Streamed</h1><p>One chunk at a time.</p>";
+        let ctx = &mut html as *mut &[u8] as *mut c_void;
+        let mut out_buf: *mut u8 = ptr::null_mut();
+        let mut out_len: u32 = 0;
+        let rc = unsafe {
+            rpdf_generate_pdf_stream_ex(Some(read), ctx, ptr::null(), &mut out_buf, &mut out_len)
+        };
+        assert_eq!(rc, 0);
+        assert!(html.is_empty(), "the whole input was read");
+        let bytes = unsafe { slice::from_raw_parts(out_buf, out_len as usize) };
+        assert_eq!(&bytes[0..5], b"%PDF-");
+        unsafe { rpdf_free_buffer(out_buf, out_len) };
+
+        let rc = unsafe {
+            rpdf_generate_pdf_stream_ex(
+                Some(fail),
+                ptr::null_mut(),
+                ptr::null(),
+                &mut out_buf,
+                &mut out_len,
+            )
+        };
+        assert_eq!(rc, 3);
+        let rc = unsafe {
+            rpdf_generate_pdf_stream_ex(
+                None,
+                ptr::null_mut(),
+                ptr::null(),
+                &mut out_buf,
+                &mut out_len,
+            )
+        };
+        assert_eq!(rc, 1);
+    }
 }
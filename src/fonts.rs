@@ -4,6 +4,10 @@
 //! glyph advances to feed Taffy with accurate intrinsic sizes.
 
 use std::collections::HashMap;
+use std::path::Path;
+
+use crate::diagnostics;
+use crate::style::LineHeight;
 
 /// A loaded font face with metrics.
 #[derive(Clone)]
@@ -68,6 +72,51 @@ impl FontManager {
         Ok(())
     }
 
+    /// Load every `.ttf` / `.otf` file under `dir` (recursively), keyed by the
+    /// family name and style the font itself declares.  Files that cannot be
+    /// parsed are skipped with a warning; a missing or unreadable directory is
+    /// an error.  Returns the number of faces loaded.
+    pub fn load_directory(&mut self, dir: &Path) -> Result<usize, String> {
+        let mut paths = Vec::new();
+        collect_font_files(dir, &mut paths)
+            .map_err(|e| format!("Fonts directory {}: {e}", dir.display()))?;
+        paths.sort();
+
+        let mut loaded = 0;
+        for path in paths {
+            let bytes = match std::fs::read(&path) {
+                Ok(bytes) => bytes,
+                Err(e) => {
+                    diagnostics::warn("fonts", format!("Skipping {}: {e}", path.display()));
+                    continue;
+                }
+            };
+            let face = match ttf_parser::Face::parse(&bytes, 0) {
+                Ok(face) => face,
+                Err(e) => {
+                    diagnostics::warn("fonts", format!("Skipping {}: {e}", path.display()));
+                    continue;
+                }
+            };
+            let Some(family) = family_name(&face) else {
+                diagnostics::warn("fonts", format!("Skipping {}: no family name", path.display()));
+                continue;
+            };
+            let (bold, italic) = (face.is_bold(), face.is_italic());
+            self.load_font(&family, bold, italic, bytes)?;
+            loaded += 1;
+        }
+        Ok(loaded)
+    }
+
+    /// Whether a font program is loaded for `family` (compared
+    /// case-insensitively, as CSS does).
+    pub fn has_family(&self, family: &str) -> bool {
+        self.fonts
+            .iter()
+            .any(|(key, data)| key.family.eq_ignore_ascii_case(family) && !data.bytes.is_empty())
+    }
+
     /// Register a builtin font with synthetic metrics (for when no TTF is
     /// available). Uses Helvetica-like metrics.
     pub fn ensure_default(&mut self) {
@@ -153,8 +202,8 @@ impl FontManager {
     }
 
     /// Measure the line height in px.
-    pub fn line_height_px(&self, font_size: f32, line_height_factor: f32) -> f32 {
-        font_size * line_height_factor
+    pub fn line_height_px(&self, font_size: f32, line_height: LineHeight) -> f32 {
+        line_height.px(font_size)
     }
 
     /// Get the ascender in px for the given font.
@@ -202,6 +251,34 @@ impl Default for FontManager {
     }
 }
 
+/// Push the font files under `dir` onto `out`.
+fn collect_font_files(dir: &Path, out: &mut Vec<std::path::PathBuf>) -> std::io::Result<()> {
+    for entry in std::fs::read_dir(dir)? {
+        let path = entry?.path();
+        if path.is_dir() {
+            collect_font_files(&path, out)?;
+        } else if path
+            .extension()
+            .and_then(|e| e.to_str())
+            .is_some_and(|e| e.eq_ignore_ascii_case("ttf") || e.eq_ignore_ascii_case("otf"))
+        {
+            out.push(path);
+        }
+    }
+    Ok(())
+}
+
+/// The typographic family name of `face`, or its legacy family name.
+fn family_name(face: &ttf_parser::Face) -> Option<String> {
+    let find = |id: u16| {
+        face.names()
+            .into_iter()
+            .filter(|n| n.name_id == id)
+            .find_map(|n| n.to_string())
+    };
+    find(ttf_parser::name_id::TYPOGRAPHIC_FAMILY).or_else(|| find(ttf_parser::name_id::FAMILY))
+}
+
 /// Word-wrap text to fit within `max_width` pixels. Returns a vec of lines.
 pub fn wrap_text(
     text: &str,
@@ -251,6 +328,146 @@ pub fn wrap_text(
     lines
 }
 
+/// Wrap one line of `white-space: pre-wrap` text.  Spaces are kept as
+/// written; breaks happen after a run of spaces, and the spaces at a break
+/// hang off the end of the line (they are dropped from it).
+pub fn wrap_preserving_spaces(
+    line: &str,
+    font_size: f32,
+    bold: bool,
+    italic: bool,
+    family: &str,
+    max_width: f32,
+    fonts: &FontManager,
+) -> Vec<String> {
+    if max_width <= 0.0 || line.is_empty() {
+        return vec![line.to_string()];
+    }
+
+    // Segments are a word plus the spaces after it; leading spaces stay
+    // attached to the first word.
+    let mut segments: Vec<String> = Vec::new();
+    let mut current = String::new();
+    let mut after_space = false;
+    for c in line.chars() {
+        if c != ' ' && after_space && !current.trim().is_empty() {
+            segments.push(std::mem::take(&mut current));
+        }
+        after_space = c == ' ';
+        current.push(c);
+    }
+    segments.push(current);
+
+    let mut lines: Vec<String> = Vec::new();
+    let mut current_line = String::new();
+    for segment in segments {
+        let candidate = format!("{current_line}{segment}");
+        let w = fonts.measure_text_width(candidate.trim_end(), font_size, bold, italic, family);
+        if w > max_width && !current_line.is_empty() {
+            lines.push(current_line.trim_end().to_string());
+            current_line = segment;
+        } else {
+            current_line = candidate;
+        }
+    }
+    lines.push(current_line.trim_end().to_string());
+    lines
+}
+
+/// Wrap `line` between any two characters to fit `max_width` pixels
+/// (`word-break: break-all`, or a word too wide for its line under
+/// `overflow-wrap: anywhere`).  Spaces at a break are dropped, and every
+/// line keeps at least one character.
+pub fn break_characters(
+    line: &str,
+    font_size: f32,
+    bold: bool,
+    italic: bool,
+    family: &str,
+    max_width: f32,
+    fonts: &FontManager,
+) -> Vec<String> {
+    if max_width <= 0.0 || line.is_empty() {
+        return vec![line.to_string()];
+    }
+
+    let mut lines: Vec<String> = Vec::new();
+    let mut current_line = String::new();
+    for c in line.chars() {
+        if c == ' ' && current_line.is_empty() && !lines.is_empty() {
+            continue;
+        }
+        let candidate = format!("{current_line}{c}");
+        let w = fonts.measure_text_width(candidate.trim_end(), font_size, bold, italic, family);
+        if w > max_width && !current_line.trim_end().is_empty() {
+            lines.push(current_line.trim_end().to_string());
+            current_line = if c == ' ' { String::new() } else { c.to_string() };
+        } else {
+            current_line = candidate;
+        }
+    }
+    if !current_line.is_empty() || lines.is_empty() {
+        lines.push(current_line.trim_end().to_string());
+    }
+    lines
+}
+
+/// `line` shortened to fit `max_width` pixels with a trailing `…`
+/// (`text-overflow: ellipsis`), or unchanged if it already fits.  Only the
+/// ellipsis remains when not even one character fits beside it.
+pub fn truncate_with_ellipsis(
+    line: &str,
+    font_size: f32,
+    bold: bool,
+    italic: bool,
+    family: &str,
+    max_width: f32,
+    fonts: &FontManager,
+) -> String {
+    let measure = |text: &str| fonts.measure_text_width(text, font_size, bold, italic, family);
+    if max_width <= 0.0 || measure(line) <= max_width {
+        return line.to_string();
+    }
+    let mut kept = line.to_string();
+    while kept.pop().is_some() {
+        let candidate = format!("{}\u{2026}", kept.trim_end());
+        if measure(&candidate) <= max_width {
+            return candidate;
+        }
+    }
+    "\u{2026}".to_string()
+}
+
+/// Break `text` into columns for vertical writing modes.  Every glyph is set
+/// upright on a one-em advance, so a column holds `max_height / font_size`
+/// characters; columns may break between any two characters, as in CJK.
+/// Runs of whitespace collapse to one space and newlines start a column.
+pub fn wrap_vertical(text: &str, font_size: f32, max_height: f32) -> Vec<String> {
+    let per_column = if font_size > 0.0 && max_height > 0.0 {
+        ((max_height / font_size).floor() as usize).max(1)
+    } else {
+        usize::MAX
+    };
+
+    let mut columns: Vec<String> = Vec::new();
+    for paragraph in text.split('\n') {
+        let chars: Vec<char> = paragraph
+            .split_whitespace()
+            .collect::<Vec<_>>()
+            .join(" ")
+            .chars()
+            .collect();
+        if chars.is_empty() {
+            columns.push(String::new());
+            continue;
+        }
+        for column in chars.chunks(per_column) {
+            columns.push(column.iter().collect::<String>().trim().to_string());
+        }
+    }
+    columns
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -263,10 +480,90 @@ mod tests {
         assert!((w - 40.0).abs() < 0.1);
     }
 
+    #[test]
+    fn pre_wrap_keeps_inner_spaces() {
+        let mgr = FontManager::default();
+        // 8 pt per character at 16 pt; 80 pt fits ten.
+        let lines = wrap_preserving_spaces("  a   b  cdefgh  ij", 16.0, false, false, "Helvetica", 80.0, &mgr);
+        assert_eq!(lines, vec!["  a   b", "cdefgh  ij"]);
+    }
+
+    /// A minimal TrueType file (`head`, `hhea`, `maxp` and a Windows `name`
+    /// table) declaring `family`.
+    fn minimal_font(family: &str) -> Vec<u8> {
+        let mut head = vec![0u8; 54];
+        head[..4].copy_from_slice(&0x0001_0000u32.to_be_bytes());
+        head[12..16].copy_from_slice(&0x5F0F_3CF5u32.to_be_bytes());
+        head[18..20].copy_from_slice(&1000u16.to_be_bytes());
+        let mut hhea = vec![0u8; 36];
+        hhea[..4].copy_from_slice(&0x0001_0000u32.to_be_bytes());
+        hhea[4..6].copy_from_slice(&800i16.to_be_bytes());
+        hhea[6..8].copy_from_slice(&(-200i16).to_be_bytes());
+        hhea[34..36].copy_from_slice(&1u16.to_be_bytes());
+        let mut maxp = 0x0000_5000u32.to_be_bytes().to_vec();
+        maxp.extend_from_slice(&1u16.to_be_bytes());
+        let utf16: Vec<u8> = family.encode_utf16().flat_map(u16::to_be_bytes).collect();
+        let mut name = Vec::new();
+        for field in [0u16, 1, 18, 3, 1, 0x0409, 1, utf16.len() as u16, 0] {
+            name.extend_from_slice(&field.to_be_bytes());
+        }
+        name.extend_from_slice(&utf16);
+
+        // Table records must be sorted by tag.
+        let tables: [(&[u8; 4], Vec<u8>); 4] =
+            [(b"head", head), (b"hhea", hhea), (b"maxp", maxp), (b"name", name)];
+        let mut font = 0x0001_0000u32.to_be_bytes().to_vec();
+        for field in [tables.len() as u16, 64, 2, 0] {
+            font.extend_from_slice(&field.to_be_bytes());
+        }
+        let mut offset = 12 + 16 * tables.len();
+        for (tag, data) in &tables {
+            font.extend_from_slice(*tag);
+            font.extend_from_slice(&0u32.to_be_bytes());
+            font.extend_from_slice(&(offset as u32).to_be_bytes());
+            font.extend_from_slice(&(data.len() as u32).to_be_bytes());
+            offset += data.len().next_multiple_of(4);
+        }
+        for (_, data) in &tables {
+            font.extend_from_slice(data);
+            font.resize(font.len().next_multiple_of(4), 0);
+        }
+        font
+    }
+
+    #[test]
+    fn fonts_directory_registers_faces_by_family_name() {
+        let dir = std::env::temp_dir().join(format!("pdf-forge-fonts-{}", std::process::id()));
+        std::fs::create_dir_all(dir.join("nested")).unwrap();
+        std::fs::write(dir.join("nested/Brand.ttf"), minimal_font("Brand Sans")).unwrap();
+        std::fs::write(dir.join("README.txt"), b"not a font").unwrap();
+
+        let mut mgr = FontManager::default();
+        assert!(!mgr.has_family("Brand Sans"));
+        assert_eq!(mgr.load_directory(&dir).unwrap(), 1);
+        assert!(mgr.has_family("brand sans"));
+        std::fs::remove_dir_all(&dir).unwrap();
+
+        assert!(mgr.load_directory(&dir).is_err());
+    }
+
     #[test]
     fn word_wrap_basic() {
         let mgr = FontManager::default();
         let lines = wrap_text("Hello world foo bar", 16.0, false, false, "Helvetica", 60.0, &mgr);
         assert!(lines.len() >= 2, "Expected wrapping, got {:?}", lines);
     }
+
+    #[test]
+    fn break_characters_splits_a_long_word() {
+        let mgr = FontManager::default();
+        let word = "abcdefghijklmnopqrstuvwxyz";
+        let lines = break_characters(word, 16.0, false, false, "Helvetica", 60.0, &mgr);
+        assert!(lines.len() >= 3, "Expected breaking, got {:?}", lines);
+        assert_eq!(lines.concat(), word);
+        for line in &lines {
+            let w = mgr.measure_text_width(line, 16.0, false, false, "Helvetica");
+            assert!(w <= 60.0, "{line:?} is {w}px wide");
+        }
+    }
 }
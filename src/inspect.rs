@@ -0,0 +1,969 @@
+//! Inspection of finished PDFs – reads any PDF (not only ones produced by
+//! this crate) for auditing purposes.
+
+use std::collections::HashSet;
+
+use base64::{engine::general_purpose::STANDARD as BASE64_STD, Engine as _};
+use lopdf::{Dictionary, Document, Object, ObjectId, Stream};
+use serde::Serialize;
+
+use crate::diagnostics;
+
+/// A font resource found in a PDF.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct FontInfo {
+    /// `/BaseFont` name, including any subset tag (`ABCDEF+NotoSans`).
+    pub name: String,
+    /// `/Subtype`: `Type1`, `TrueType`, `Type0`, `Type3`, …
+    pub kind: String,
+    /// Whether a font program is embedded in the file.
+    pub embedded: bool,
+    /// Whether the embedded program is a subset (six upper-case letters and
+    /// `+` before the name).
+    pub subset: bool,
+}
+
+/// List every font dictionary in `pdf`.
+///
+/// CID fonts are reported once, as their `Type0` parent; a Type0 font
+/// counts as embedded when its descendant's descriptor carries a program.
+/// Type3 fonts define their glyphs inline and are always embedded.
+pub fn list_fonts(pdf: &[u8]) -> Result<Vec<FontInfo>, String> {
+    let doc = Document::load_mem(pdf).map_err(|e| format!("Parse PDF: {e}"))?;
+    Ok(document_fonts(&doc))
+}
+
+fn document_fonts(doc: &Document) -> Vec<FontInfo> {
+    let mut fonts = Vec::new();
+    for object in doc.objects.values() {
+        let Ok(dict) = object.as_dict() else {
+            continue;
+        };
+        if name(doc, dict, b"Type").as_deref() != Some("Font") {
+            continue;
+        }
+        let kind = name(doc, dict, b"Subtype").unwrap_or_default();
+        if kind.starts_with("CIDFontType") {
+            continue;
+        }
+        let base = name(doc, dict, b"BaseFont").unwrap_or_default();
+        let embedded = match kind.as_str() {
+            "Type3" => true,
+            "Type0" => descendant(doc, dict).is_some_and(|d| has_font_file(doc, d)),
+            _ => has_font_file(doc, dict),
+        };
+        fonts.push(FontInfo {
+            subset: embedded && is_subset_name(&base),
+            name: base,
+            kind,
+            embedded,
+        });
+    }
+    fonts
+}
+
+/// Document information read from a PDF's Info dictionary.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct Metadata {
+    pub title: Option<String>,
+    pub author: Option<String>,
+    pub subject: Option<String>,
+    pub keywords: Option<String>,
+    pub creator: Option<String>,
+    pub producer: Option<String>,
+    /// `/CreationDate` as written, e.g. `D:20240131120000Z`.
+    pub creation_date: Option<String>,
+    pub page_count: usize,
+}
+
+/// Read the Info dictionary entries and page count of `pdf`.  Entries the
+/// file does not set (or a file without an Info dictionary) give `None`.
+pub fn read_metadata(pdf: &[u8]) -> Result<Metadata, String> {
+    let doc = Document::load_mem(pdf).map_err(|e| format!("Parse PDF: {e}"))?;
+    let info = doc
+        .trailer
+        .get(b"Info")
+        .ok()
+        .and_then(|o| resolve(&doc, o))
+        .and_then(|o| o.as_dict().ok());
+    let text = |key: &[u8]| {
+        let info = info?;
+        match entry(&doc, info, key)? {
+            Object::String(bytes, _) => Some(decode_text_string(bytes)),
+            _ => None,
+        }
+    };
+    Ok(Metadata {
+        title: text(b"Title"),
+        author: text(b"Author"),
+        subject: text(b"Subject"),
+        keywords: text(b"Keywords"),
+        creator: text(b"Creator"),
+        producer: text(b"Producer"),
+        creation_date: text(b"CreationDate"),
+        page_count: doc.get_pages().len(),
+    })
+}
+
+/// An image embedded in a PDF, as a standalone file.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct ExtractedImage {
+    /// 1-based number of the first page that draws the image.
+    pub page: usize,
+    /// Resource name the image is drawn by (`Im1`), on that page or in a
+    /// form XObject it draws.
+    pub name: String,
+    /// `jpeg` for DCT-encoded images, whose data is copied as is; `png` for
+    /// every other image, decoded and re-encoded.
+    pub format: String,
+    pub width: u32,
+    pub height: u32,
+    /// The file bytes; base64 in JSON.
+    #[serde(serialize_with = "serialize_base64")]
+    pub data: Vec<u8>,
+}
+
+/// Deepest nesting of form XObjects searched for images.
+const MAX_FORM_DEPTH: usize = 8;
+
+/// Extract every image XObject drawn by a page of `pdf`, each once.
+///
+/// FlateDecode (or otherwise compressed) samples in grey, RGB, CMYK, ICC
+/// based and indexed colour at 1–8 bits per component become PNG files.
+/// Images in other encodings (JPEG 2000, CCITT, JBIG2, 16-bit samples) and
+/// stencil masks are skipped with a diagnostic; soft masks are not applied.
+pub fn extract_images(pdf: &[u8]) -> Result<Vec<ExtractedImage>, String> {
+    let doc = Document::load_mem(pdf).map_err(|e| format!("Parse PDF: {e}"))?;
+    let mut seen = HashSet::new();
+    let mut images = Vec::new();
+    for (number, page_id) in doc.get_pages() {
+        let resources = doc
+            .get_dictionary(page_id)
+            .ok()
+            .and_then(|page| inherited(&doc, page, b"Resources"))
+            .and_then(|o| o.as_dict().ok());
+        if let Some(resources) = resources {
+            collect_images(&doc, resources, number as usize, 0, &mut seen, &mut images);
+        }
+    }
+    Ok(images)
+}
+
+fn collect_images(
+    doc: &Document,
+    resources: &Dictionary,
+    page: usize,
+    depth: usize,
+    seen: &mut HashSet<ObjectId>,
+    out: &mut Vec<ExtractedImage>,
+) {
+    let Some(xobjects) = entry(doc, resources, b"XObject").and_then(|o| o.as_dict().ok()) else {
+        return;
+    };
+    for (key, object) in xobjects.iter() {
+        let Object::Reference(id) = object else {
+            continue;
+        };
+        if !seen.insert(*id) {
+            continue;
+        }
+        let Ok(stream) = doc.get_object(*id).and_then(Object::as_stream) else {
+            continue;
+        };
+        let key = String::from_utf8_lossy(key).into_owned();
+        match name(doc, &stream.dict, b"Subtype").as_deref() {
+            Some("Image") => match encode_image(doc, stream) {
+                Some(image) => out.push(ExtractedImage {
+                    page,
+                    name: key,
+                    format: image.format.to_string(),
+                    width: image.width,
+                    height: image.height,
+                    data: image.data,
+                }),
+                None => diagnostics::warn(
+                    "inspect",
+                    format!("Skipping image /{key} on page {page} — unsupported encoding"),
+                ),
+            },
+            Some("Form") if depth < MAX_FORM_DEPTH => {
+                if let Some(inner) = entry(doc, &stream.dict, b"Resources") {
+                    if let Ok(inner) = inner.as_dict() {
+                        collect_images(doc, inner, page, depth + 1, seen, out);
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+}
+
+/// What [`preflight`] checks for.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct PreflightOptions {
+    /// Images drawn at fewer pixels per inch than this are reported.
+    pub min_image_dpi: f32,
+}
+
+impl Default for PreflightOptions {
+    /// 150 dpi, below which photos visibly soften in print.
+    fn default() -> Self {
+        Self {
+            min_image_dpi: 150.0,
+        }
+    }
+}
+
+/// The result of [`preflight`]: every problem found, page by page.
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct PreflightReport {
+    pub issues: Vec<PreflightIssue>,
+}
+
+impl PreflightReport {
+    /// Whether the file passed every check.
+    pub fn is_clean(&self) -> bool {
+        self.issues.is_empty()
+    }
+}
+
+/// One problem found by [`preflight`].
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct PreflightIssue {
+    pub check: PreflightCheck,
+    /// 1-based page the problem is on; `None` for fonts, which belong to
+    /// the document.
+    pub page: Option<usize>,
+    pub message: String,
+}
+
+/// The checks [`preflight`] runs.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum PreflightCheck {
+    /// RGB colours or images, which a CMYK press converts on its own terms.
+    RgbColor,
+    /// A font whose program is not in the file, so the RIP substitutes one.
+    FontNotEmbedded,
+    /// An image drawn at less than [`PreflightOptions::min_image_dpi`].
+    LowResolutionImage,
+    /// A page without a `/BleedBox` reaching past its trim box on every side.
+    MissingBleed,
+}
+
+/// Check `pdf` (any PDF, not only pdf-forge output) for common causes of
+/// print rejects: RGB colour, fonts that are not embedded, low-resolution
+/// images and missing bleed.  The file is only read.
+///
+/// Colour is checked in the page content streams (`rg` / `RG`, RGB colour
+/// spaces and shadings) and in the images they draw.  An image's resolution
+/// is taken from the smaller of its two scale factors wherever it is drawn,
+/// including through form XObjects; each image is reported once per page,
+/// at its lowest resolution there.
+pub fn preflight(pdf: &[u8], options: &PreflightOptions) -> Result<PreflightReport, String> {
+    let doc = Document::load_mem(pdf).map_err(|e| format!("Parse PDF: {e}"))?;
+    let mut issues = Vec::new();
+    for font in document_fonts(&doc).into_iter().filter(|f| !f.embedded) {
+        issues.push(PreflightIssue {
+            check: PreflightCheck::FontNotEmbedded,
+            page: None,
+            message: format!("Font {} ({}) is not embedded", font.name, font.kind),
+        });
+    }
+    for (number, page_id) in doc.get_pages() {
+        let page = number as usize;
+        let Ok(page_dict) = doc.get_dictionary(page_id) else {
+            continue;
+        };
+        let mut scan = PageScan::default();
+        if let Ok(content) = doc.get_page_content(page_id) {
+            let resources = inherited(&doc, page_dict, b"Resources");
+            let resources = resources.and_then(|o| o.as_dict().ok());
+            scan_content(&doc, &content, resources, IDENTITY, 0, &mut scan);
+        }
+        if scan.rgb_operators {
+            issues.push(PreflightIssue {
+                check: PreflightCheck::RgbColor,
+                page: Some(page),
+                message: "Page content paints in RGB".to_string(),
+            });
+        }
+        for image in scan.images {
+            if image.rgb {
+                issues.push(PreflightIssue {
+                    check: PreflightCheck::RgbColor,
+                    page: Some(page),
+                    message: format!("Image /{} is RGB", image.name),
+                });
+            }
+            if image.dpi < options.min_image_dpi {
+                issues.push(PreflightIssue {
+                    check: PreflightCheck::LowResolutionImage,
+                    page: Some(page),
+                    message: format!(
+                        "Image /{} is drawn at {:.0} dpi, below {:.0}",
+                        image.name, image.dpi, options.min_image_dpi
+                    ),
+                });
+            }
+        }
+        if !has_bleed(&doc, page_dict) {
+            issues.push(PreflightIssue {
+                check: PreflightCheck::MissingBleed,
+                page: Some(page),
+                message: "No bleed box extends past the trim box".to_string(),
+            });
+        }
+    }
+    Ok(PreflightReport { issues })
+}
+
+/// A transformation matrix `[a b c d e f]`.
+type Matrix = [f32; 6];
+
+const IDENTITY: Matrix = [1.0, 0.0, 0.0, 1.0, 0.0, 0.0];
+
+/// `m` applied before `n`, as `cm` concatenates onto the current matrix.
+fn concat(m: Matrix, n: Matrix) -> Matrix {
+    [
+        m[0] * n[0] + m[1] * n[2],
+        m[0] * n[1] + m[1] * n[3],
+        m[2] * n[0] + m[3] * n[2],
+        m[2] * n[1] + m[3] * n[3],
+        m[4] * n[0] + m[5] * n[2] + n[4],
+        m[4] * n[1] + m[5] * n[3] + n[5],
+    ]
+}
+
+fn matrix(operands: &[Object]) -> Option<Matrix> {
+    let values: Vec<f32> = operands.iter().filter_map(|o| o.as_float().ok()).collect();
+    <[f32; 6]>::try_from(values).ok()
+}
+
+/// What one page's content draws, as far as [`preflight`] cares.
+#[derive(Default)]
+struct PageScan {
+    rgb_operators: bool,
+    images: Vec<PlacedImage>,
+    /// Images already in `images`, by object id.
+    seen: Vec<ObjectId>,
+}
+
+struct PlacedImage {
+    name: String,
+    /// Lowest resolution the image is drawn at on the page.
+    dpi: f32,
+    rgb: bool,
+}
+
+/// Walk a content stream, tracking the current matrix through `q` / `Q` /
+/// `cm` and into form XObjects up to [`MAX_FORM_DEPTH`].
+fn scan_content(
+    doc: &Document,
+    content: &[u8],
+    resources: Option<&Dictionary>,
+    mut ctm: Matrix,
+    depth: usize,
+    scan: &mut PageScan,
+) {
+    let Ok(content) = lopdf::content::Content::decode(content) else {
+        return;
+    };
+    let resource = |category: &[u8], key: &Object| {
+        let key = key.as_name().ok()?;
+        let dict = entry(doc, resources?, category)?.as_dict().ok()?;
+        entry(doc, dict, key)
+    };
+    let mut saved = Vec::new();
+    for op in &content.operations {
+        let first = op.operands.first();
+        match op.operator.as_str() {
+            "q" => saved.push(ctm),
+            "Q" => ctm = saved.pop().unwrap_or(ctm),
+            "cm" => {
+                if let Some(m) = matrix(&op.operands) {
+                    ctm = concat(m, ctm);
+                }
+            }
+            "rg" | "RG" => scan.rgb_operators = true,
+            "cs" | "CS" => {
+                let space = first.and_then(|f| resource(b"ColorSpace", f).or(Some(f)));
+                if space.and_then(|s| color_space(doc, s)).is_some_and(|s| s.is_rgb()) {
+                    scan.rgb_operators = true;
+                }
+            }
+            "sh" => {
+                let shading = first.and_then(|f| resource(b"Shading", f));
+                let space = shading
+                    .and_then(|s| s.as_dict().ok().or_else(|| Some(&s.as_stream().ok()?.dict)))
+                    .and_then(|d| entry(doc, d, b"ColorSpace"));
+                if space.and_then(|s| color_space(doc, s)).is_some_and(|s| s.is_rgb()) {
+                    scan.rgb_operators = true;
+                }
+            }
+            "Do" => {
+                let Some(Object::Reference(id)) = first.and_then(|f| {
+                    let dict = entry(doc, resources?, b"XObject")?.as_dict().ok()?;
+                    dict.get(f.as_name().ok()?).ok()
+                }) else {
+                    continue;
+                };
+                let Ok(stream) = doc.get_object(*id).and_then(Object::as_stream) else {
+                    continue;
+                };
+                let key = first.and_then(|f| f.as_name().ok()).unwrap_or_default();
+                let key = String::from_utf8_lossy(key).into_owned();
+                match name(doc, &stream.dict, b"Subtype").as_deref() {
+                    Some("Image") => place_image(doc, *id, stream, key, ctm, scan),
+                    Some("Form") if depth < MAX_FORM_DEPTH => {
+                        let form_matrix = entry(doc, &stream.dict, b"Matrix")
+                            .and_then(|m| m.as_array().ok())
+                            .and_then(|m| matrix(m))
+                            .unwrap_or(IDENTITY);
+                        let inner = entry(doc, &stream.dict, b"Resources")
+                            .and_then(|r| r.as_dict().ok())
+                            .or(resources);
+                        if let Some(data) = stream_data(stream) {
+                            let ctm = concat(form_matrix, ctm);
+                            scan_content(doc, &data, inner, ctm, depth + 1, scan);
+                        }
+                    }
+                    _ => {}
+                }
+            }
+            _ => {}
+        }
+    }
+}
+
+/// Record image XObject `id` drawn as `key` into the unit square under
+/// `ctm`.
+fn place_image(
+    doc: &Document,
+    id: ObjectId,
+    image: &Stream,
+    key: String,
+    ctm: Matrix,
+    scan: &mut PageScan,
+) {
+    let int = |k: &[u8]| entry(doc, &image.dict, k).and_then(|o| o.as_i64().ok());
+    let (Some(width), Some(height)) = (int(b"Width"), int(b"Height")) else {
+        return;
+    };
+    // Pixels per inch along each side of the drawn image.
+    let along = |pixels: i64, x: f32, y: f32| pixels as f32 * 72.0 / x.hypot(y);
+    let dpi = along(width, ctm[0], ctm[1]).min(along(height, ctm[2], ctm[3]));
+    if let Some(i) = scan.seen.iter().position(|seen| *seen == id) {
+        scan.images[i].dpi = scan.images[i].dpi.min(dpi);
+        return;
+    }
+    let rgb = entry(doc, &image.dict, b"ColorSpace")
+        .and_then(|s| color_space(doc, s))
+        .is_some_and(|s| s.is_rgb());
+    scan.seen.push(id);
+    scan.images.push(PlacedImage {
+        name: key,
+        dpi,
+        rgb,
+    });
+}
+
+/// Whether the page's `/BleedBox` extends past its trim box (its
+/// `/TrimBox`, else its crop or media box) on every side.
+fn has_bleed(doc: &Document, page: &Dictionary) -> bool {
+    let rect = |object: Option<&Object>| -> Option<[f32; 4]> {
+        let values: Vec<f32> = object?
+            .as_array()
+            .ok()?
+            .iter()
+            .filter_map(|v| resolve(doc, v)?.as_float().ok())
+            .collect();
+        let [x1, y1, x2, y2] = <[f32; 4]>::try_from(values).ok()?;
+        Some([x1.min(x2), y1.min(y2), x1.max(x2), y1.max(y2)])
+    };
+    let trim = rect(entry(doc, page, b"TrimBox"))
+        .or_else(|| rect(inherited(doc, page, b"CropBox")))
+        .or_else(|| rect(inherited(doc, page, b"MediaBox")));
+    match (rect(entry(doc, page, b"BleedBox")), trim) {
+        (Some(bleed), Some(trim)) => {
+            bleed[0] < trim[0] && bleed[1] < trim[1] && bleed[2] > trim[2] && bleed[3] > trim[3]
+        }
+        _ => false,
+    }
+}
+
+/// An image XObject re-encoded as a standalone file (see [`encode_image`]).
+pub(crate) struct EncodedImage {
+    /// `jpeg` or `png`.
+    pub format: &'static str,
+    pub width: u32,
+    pub height: u32,
+    pub data: Vec<u8>,
+}
+
+/// Colour space of image samples, as far as [`encode_image`] decodes them.
+enum ColorSpace {
+    Gray,
+    Rgb,
+    Cmyk,
+    /// Palette of 8-bit `base` colours, one index per sample.
+    Indexed {
+        base: Box<ColorSpace>,
+        palette: Vec<u8>,
+    },
+}
+
+impl ColorSpace {
+    fn components(&self) -> usize {
+        match self {
+            ColorSpace::Gray | ColorSpace::Indexed { .. } => 1,
+            ColorSpace::Rgb => 3,
+            ColorSpace::Cmyk => 4,
+        }
+    }
+
+    /// Whether the colours are RGB (directly or through a palette).
+    fn is_rgb(&self) -> bool {
+        match self {
+            ColorSpace::Rgb => true,
+            ColorSpace::Indexed { base, .. } => base.is_rgb(),
+            _ => false,
+        }
+    }
+
+    /// Whether decoded pixels are grey rather than RGB.
+    fn is_gray(&self) -> bool {
+        match self {
+            ColorSpace::Gray => true,
+            ColorSpace::Indexed { base, .. } => base.is_gray(),
+            _ => false,
+        }
+    }
+
+    /// Append the grey or RGB pixel for one colour of 8-bit components.
+    fn push_pixel(&self, color: &[u8], out: &mut Vec<u8>) {
+        match self {
+            ColorSpace::Cmyk => {
+                let k = 255 - u32::from(color[3]);
+                let channel = |c: u8| ((255 - u32::from(c)) * k / 255) as u8;
+                out.extend(color[..3].iter().map(|&c| channel(c)));
+            }
+            _ => out.extend_from_slice(color),
+        }
+    }
+}
+
+/// An image XObject as a JPEG (DCT data passed through) or PNG file.
+/// Returns `None` for encodings it cannot decode (see [`extract_images`]).
+pub(crate) fn encode_image(doc: &Document, image: &Stream) -> Option<EncodedImage> {
+    let dict = &image.dict;
+    let int = |key: &[u8]| entry(doc, dict, key).and_then(|o| o.as_i64().ok());
+    let width = u32::try_from(int(b"Width")?).ok()?;
+    let height = u32::try_from(int(b"Height")?).ok()?;
+    let filter = match entry(doc, dict, b"Filter") {
+        Some(Object::Name(name)) => Some(name.as_slice()),
+        Some(Object::Array(filters)) if filters.len() == 1 => filters[0].as_name().ok(),
+        _ => None,
+    };
+    if filter == Some(&b"DCTDecode"[..]) {
+        return Some(EncodedImage {
+            format: "jpeg",
+            width,
+            height,
+            data: image.content.clone(),
+        });
+    }
+
+    let is_mask = entry(doc, dict, b"ImageMask").is_some_and(|o| matches!(o.as_bool(), Ok(true)));
+    let bits = int(b"BitsPerComponent").unwrap_or(8);
+    if is_mask || ![1, 2, 4, 8].contains(&bits) {
+        return None;
+    }
+    let bits = bits as usize;
+    let space = color_space(doc, entry(doc, dict, b"ColorSpace")?)?;
+    let samples = stream_data(image)?;
+
+    let values_per_row = width as usize * space.components();
+    let row_len = (values_per_row * bits).div_ceil(8);
+    if row_len == 0 || samples.len() < row_len * height as usize {
+        return None;
+    }
+    let max = (1u32 << bits) - 1;
+    let mut pixels = Vec::new();
+    let mut color = Vec::with_capacity(4);
+    for row in samples.chunks(row_len).take(height as usize) {
+        let values = (0..values_per_row).map(|i| {
+            let bit = i * bits;
+            let byte = u32::from(row[bit / 8]);
+            (byte >> (8 - bits - bit % 8)) & max
+        });
+        match &space {
+            ColorSpace::Indexed { base, palette } => {
+                let n = base.components();
+                for index in values {
+                    let start = index as usize * n;
+                    base.push_pixel(palette.get(start..start + n)?, &mut pixels);
+                }
+            }
+            _ => {
+                for value in values {
+                    color.push((value * 255 / max) as u8);
+                    if color.len() == space.components() {
+                        space.push_pixel(&color, &mut pixels);
+                        color.clear();
+                    }
+                }
+            }
+        }
+    }
+
+    let decoded = if space.is_gray() {
+        ::image::GrayImage::from_raw(width, height, pixels).map(::image::DynamicImage::ImageLuma8)
+    } else {
+        ::image::RgbImage::from_raw(width, height, pixels).map(::image::DynamicImage::ImageRgb8)
+    }?;
+    let mut png = std::io::Cursor::new(Vec::new());
+    decoded.write_to(&mut png, ::image::ImageFormat::Png).ok()?;
+    Some(EncodedImage {
+        format: "png",
+        width,
+        height,
+        data: png.into_inner(),
+    })
+}
+
+fn color_space(doc: &Document, object: &Object) -> Option<ColorSpace> {
+    let (family, params) = match resolve(doc, object)? {
+        Object::Name(name) => (name.as_slice(), &[][..]),
+        Object::Array(items) => (resolve(doc, items.first()?)?.as_name().ok()?, &items[1..]),
+        _ => return None,
+    };
+    match family {
+        b"DeviceGray" | b"CalGray" | b"G" => Some(ColorSpace::Gray),
+        b"DeviceRGB" | b"CalRGB" | b"RGB" => Some(ColorSpace::Rgb),
+        b"DeviceCMYK" | b"CMYK" => Some(ColorSpace::Cmyk),
+        b"ICCBased" => {
+            let profile = resolve(doc, params.first()?)?.as_stream().ok()?;
+            match entry(doc, &profile.dict, b"N")?.as_i64().ok()? {
+                1 => Some(ColorSpace::Gray),
+                3 => Some(ColorSpace::Rgb),
+                4 => Some(ColorSpace::Cmyk),
+                _ => None,
+            }
+        }
+        b"Indexed" | b"I" => {
+            let [base, _hival, lookup] = params else {
+                return None;
+            };
+            let base = color_space(doc, base)?;
+            if matches!(base, ColorSpace::Indexed { .. }) {
+                return None;
+            }
+            let palette = match resolve(doc, lookup)? {
+                Object::String(bytes, _) => bytes.clone(),
+                Object::Stream(stream) => stream_data(stream)?,
+                _ => return None,
+            };
+            Some(ColorSpace::Indexed {
+                base: Box::new(base),
+                palette,
+            })
+        }
+        _ => None,
+    }
+}
+
+/// Stream bytes, decompressed when the stream has a filter.
+fn stream_data(stream: &Stream) -> Option<Vec<u8>> {
+    if stream.dict.has(b"Filter") {
+        stream.decompressed_content().ok()
+    } else {
+        Some(stream.content.clone())
+    }
+}
+
+fn serialize_base64<S: serde::Serializer>(bytes: &[u8], serializer: S) -> Result<S::Ok, S::Error> {
+    serializer.serialize_str(&BASE64_STD.encode(bytes))
+}
+
+/// A PDF text string: UTF-16BE after a byte order mark, otherwise
+/// PDFDocEncoding (read as Latin-1, which it matches for printable text).
+fn decode_text_string(bytes: &[u8]) -> String {
+    match bytes.strip_prefix(&[0xFE, 0xFF]) {
+        Some(utf16) => {
+            let units: Vec<u16> = utf16
+                .chunks_exact(2)
+                .map(|pair| u16::from_be_bytes([pair[0], pair[1]]))
+                .collect();
+            String::from_utf16_lossy(&units)
+        }
+        None => bytes.iter().map(|&b| b as char).collect(),
+    }
+}
+
+fn resolve<'a>(doc: &'a Document, object: &'a Object) -> Option<&'a Object> {
+    match object {
+        Object::Reference(id) => doc.get_object(*id).ok(),
+        other => Some(other),
+    }
+}
+
+fn entry<'a>(doc: &'a Document, dict: &'a Dictionary, key: &[u8]) -> Option<&'a Object> {
+    dict.get(key).ok().and_then(|o| resolve(doc, o))
+}
+
+/// `key` from `page` or the nearest ancestor in the page tree that sets it.
+fn inherited<'a>(doc: &'a Document, page: &'a Dictionary, key: &[u8]) -> Option<&'a Object> {
+    let mut node = page;
+    // The depth limit guards against a cyclic `/Parent` chain.
+    for _ in 0..32 {
+        if let Some(value) = entry(doc, node, key) {
+            return Some(value);
+        }
+        node = entry(doc, node, b"Parent")?.as_dict().ok()?;
+    }
+    None
+}
+
+fn name(doc: &Document, dict: &Dictionary, key: &[u8]) -> Option<String> {
+    entry(doc, dict, key)
+        .and_then(|o| o.as_name().ok())
+        .map(|n| String::from_utf8_lossy(n).into_owned())
+}
+
+/// The first `/DescendantFonts` entry of a Type0 font.
+fn descendant<'a>(doc: &'a Document, dict: &'a Dictionary) -> Option<&'a Dictionary> {
+    let array = entry(doc, dict, b"DescendantFonts")?.as_array().ok()?;
+    resolve(doc, array.first()?)?.as_dict().ok()
+}
+
+fn has_font_file(doc: &Document, font: &Dictionary) -> bool {
+    entry(doc, font, b"FontDescriptor")
+        .and_then(|d| d.as_dict().ok())
+        .is_some_and(|d| {
+            [&b"FontFile"[..], b"FontFile2", b"FontFile3"]
+                .iter()
+                .any(|key| d.has(key))
+        })
+}
+
+fn is_subset_name(name: &str) -> bool {
+    let bytes = name.as_bytes();
+    bytes.len() > 7 && bytes[6] == b'+' && bytes[..6].iter().all(u8::is_ascii_uppercase)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_pdf::{add_pages, pdf_with_pages};
+    use lopdf::dictionary;
+
+    /// A one-page PDF using standard Helvetica plus a subset-embedded
+    /// TrueType CID font.
+    fn mixed_fonts_fixture() -> Vec<u8> {
+        let mut doc = Document::with_version("1.7");
+        let helvetica = doc.add_object(dictionary! {
+            "Type" => "Font",
+            "Subtype" => "Type1",
+            "BaseFont" => "Helvetica",
+        });
+        let program = doc.add_object(Stream::new(dictionary! {}, vec![0u8; 16]));
+        let descriptor = doc.add_object(dictionary! {
+            "Type" => "FontDescriptor",
+            "FontName" => "ABCDEF+NotoSans",
+            "FontFile2" => program,
+        });
+        let cid_font = doc.add_object(dictionary! {
+            "Type" => "Font",
+            "Subtype" => "CIDFontType2",
+            "BaseFont" => "ABCDEF+NotoSans",
+            "FontDescriptor" => descriptor,
+        });
+        let noto = doc.add_object(dictionary! {
+            "Type" => "Font",
+            "Subtype" => "Type0",
+            "BaseFont" => "ABCDEF+NotoSans",
+            "Encoding" => "Identity-H",
+            "DescendantFonts" => vec![cid_font.into()],
+        });
+
+        let resources = dictionary! {
+            "Font" => dictionary! { "F1" => helvetica, "F2" => noto },
+        };
+        pdf_with_pages(doc, [(resources, b"BT ET".to_vec())])
+    }
+
+    #[test]
+    fn classifies_standard_and_embedded_fonts() {
+        let mut fonts = list_fonts(&mixed_fonts_fixture()).unwrap();
+        fonts.sort_by(|a, b| a.name.cmp(&b.name));
+        assert_eq!(
+            fonts,
+            vec![
+                FontInfo {
+                    name: "ABCDEF+NotoSans".to_string(),
+                    kind: "Type0".to_string(),
+                    embedded: true,
+                    subset: true,
+                },
+                FontInfo {
+                    name: "Helvetica".to_string(),
+                    kind: "Type1".to_string(),
+                    embedded: false,
+                    subset: false,
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn rejects_non_pdf_input() {
+        assert!(list_fonts(b"not a pdf").is_err());
+        assert!(read_metadata(b"not a pdf").is_err());
+    }
+
+    /// Two pages: the first draws a JPEG, the second the same JPEG again and,
+    /// through a form XObject, a 2-bit indexed image (red, green, blue,
+    /// white).
+    fn two_images_fixture(jpeg: &[u8]) -> Vec<u8> {
+        let mut doc = Document::with_version("1.7");
+        let photo = doc.add_object(Stream::new(
+            dictionary! {
+                "Type" => "XObject",
+                "Subtype" => "Image",
+                "Width" => 2,
+                "Height" => 2,
+                "ColorSpace" => "DeviceRGB",
+                "BitsPerComponent" => 8,
+                "Filter" => "DCTDecode",
+            },
+            jpeg.to_vec(),
+        ));
+        let palette = vec![255, 0, 0, 0, 255, 0, 0, 0, 255, 255, 255, 255];
+        let mut swatch = Stream::new(
+            dictionary! {
+                "Type" => "XObject",
+                "Subtype" => "Image",
+                "Width" => 4,
+                "Height" => 1,
+                "ColorSpace" => vec![
+                    "Indexed".into(),
+                    "DeviceRGB".into(),
+                    3.into(),
+                    Object::String(palette, lopdf::StringFormat::Hexadecimal),
+                ],
+                "BitsPerComponent" => 2,
+            },
+            vec![0b0001_1011],
+        );
+        swatch.compress().unwrap();
+        let swatch = doc.add_object(swatch);
+        let form = doc.add_object(Stream::new(
+            dictionary! {
+                "Type" => "XObject",
+                "Subtype" => "Form",
+                "BBox" => vec![0.into(), 0.into(), 4.into(), 1.into()],
+                "Resources" => dictionary! { "XObject" => dictionary! { "Sw" => swatch } },
+            },
+            b"/Sw Do".to_vec(),
+        ));
+
+        let page_one = dictionary! { "Im1" => photo };
+        let page_two = dictionary! { "Im1" => photo, "Fm1" => form };
+        let pages = [page_one, page_two]
+            .map(|xobjects| (dictionary! { "XObject" => xobjects }, b"/Im1 Do".to_vec()));
+        pdf_with_pages(doc, pages)
+    }
+
+    #[test]
+    fn extracts_jpeg_and_indexed_images_once_each() {
+        let mut jpeg = std::io::Cursor::new(Vec::new());
+        ::image::RgbImage::from_pixel(2, 2, ::image::Rgb([10, 20, 30]))
+            .write_to(&mut jpeg, ::image::ImageFormat::Jpeg)
+            .unwrap();
+        let jpeg = jpeg.into_inner();
+
+        let images = extract_images(&two_images_fixture(&jpeg)).unwrap();
+        assert_eq!(images.len(), 2, "{images:?}");
+        assert_eq!((images[0].page, images[0].name.as_str()), (1, "Im1"));
+        assert_eq!(images[0].format, "jpeg");
+        assert_eq!(images[0].data, jpeg);
+
+        assert_eq!((images[1].page, images[1].name.as_str()), (2, "Sw"));
+        assert_eq!(images[1].format, "png");
+        let swatch = ::image::load_from_memory(&images[1].data).unwrap();
+        let pixels: Vec<[u8; 3]> = swatch.to_rgb8().pixels().map(|p| p.0).collect();
+        assert_eq!(
+            pixels,
+            vec![[255, 0, 0], [0, 255, 0], [0, 0, 255], [255, 255, 255]]
+        );
+    }
+
+    /// One page drawing a 10×10 RGB image across 200 pt (3.6 dpi) and text
+    /// in standard Helvetica, with `bleed` as its `/BleedBox`, if any.
+    fn preflight_fixture(bleed: Option<[i64; 4]>) -> Vec<u8> {
+        let mut doc = Document::with_version("1.7");
+        let helvetica = doc.add_object(dictionary! {
+            "Type" => "Font",
+            "Subtype" => "Type1",
+            "BaseFont" => "Helvetica",
+        });
+        let photo = doc.add_object(Stream::new(
+            dictionary! {
+                "Type" => "XObject",
+                "Subtype" => "Image",
+                "Width" => 10,
+                "Height" => 10,
+                "ColorSpace" => "DeviceRGB",
+                "BitsPerComponent" => 8,
+            },
+            vec![128; 300],
+        ));
+        let ops = b"q 200 0 0 200 50 50 cm /Im1 Do Q BT /F1 12 Tf (Hi) Tj ET".to_vec();
+        let resources = dictionary! {
+            "Font" => dictionary! { "F1" => helvetica },
+            "XObject" => dictionary! { "Im1" => photo },
+        };
+        let page = add_pages(&mut doc, [(resources, ops)])[0];
+        if let Some(rect) = bleed {
+            let page = doc.get_dictionary_mut(page).unwrap();
+            page.set("BleedBox", rect.map(Object::Integer).to_vec());
+        }
+
+        let mut bytes = Vec::new();
+        doc.save_to(&mut bytes).unwrap();
+        bytes
+    }
+
+    #[test]
+    fn preflight_reports_unembedded_fonts_and_low_resolution_images() {
+        let report = preflight(&preflight_fixture(None), &PreflightOptions::default()).unwrap();
+        let checks: Vec<(PreflightCheck, Option<usize>)> =
+            report.issues.iter().map(|i| (i.check, i.page)).collect();
+        assert_eq!(
+            checks,
+            vec![
+                (PreflightCheck::FontNotEmbedded, None),
+                (PreflightCheck::RgbColor, Some(1)),
+                (PreflightCheck::LowResolutionImage, Some(1)),
+                (PreflightCheck::MissingBleed, Some(1)),
+            ]
+        );
+        assert_eq!(report.issues[0].message, "Font Helvetica (Type1) is not embedded");
+        assert_eq!(report.issues[2].message, "Image /Im1 is drawn at 4 dpi, below 150");
+
+        // A lower threshold accepts the image; a bleed box past the media
+        // box on every side is bleed.
+        let bleed = preflight_fixture(Some([-9, -9, 604, 851]));
+        let lenient = PreflightOptions { min_image_dpi: 2.0 };
+        let report = preflight(&bleed, &lenient).unwrap();
+        let checks: Vec<PreflightCheck> = report.issues.iter().map(|i| i.check).collect();
+        assert_eq!(checks, vec![PreflightCheck::FontNotEmbedded, PreflightCheck::RgbColor]);
+    }
+
+    #[test]
+    fn decodes_utf16_and_pdfdoc_strings() {
+        assert_eq!(decode_text_string(b"Caf\xe9"), "Café");
+        assert_eq!(decode_text_string(&[0xFE, 0xFF, 0x00, 0x41, 0x20, 0xAC]), "A€");
+    }
+}
@@ -0,0 +1,290 @@
+//! Invoice builder – opinionated sugar over the pipeline for the most common
+//! document type.
+//!
+//! [`InvoiceBuilder`] collects parties, line items and totals, renders them
+//! into a built-in HTML template and runs it through [`generate`].  The look
+//! can be adjusted with [`InvoiceBuilder::css`], which is applied as
+//! `extra_css` on top of the template's own `<style>` block.
+//!
+//! Amounts are integer minor units (cents) to avoid rounding surprises.
+
+use crate::pipeline::{generate, GeneratedPdf, PipelineConfig};
+
+/// Seller or buyer details.
+#[derive(Debug, Clone, Default)]
+pub struct Party {
+    pub name: String,
+    /// Address / contact lines, rendered one per line under the name.
+    pub lines: Vec<String>,
+}
+
+/// One billed item.
+#[derive(Debug, Clone)]
+pub struct LineItem {
+    pub description: String,
+    pub quantity: u32,
+    pub unit_price_cents: i64,
+}
+
+impl LineItem {
+    pub fn total_cents(&self) -> i64 {
+        self.unit_price_cents * self.quantity as i64
+    }
+}
+
+/// Invoice totals, in cents.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Totals {
+    pub subtotal_cents: i64,
+    pub tax_cents: i64,
+    pub total_cents: i64,
+}
+
+/// Builds an invoice PDF from structured data.
+#[derive(Debug, Clone)]
+pub struct InvoiceBuilder {
+    number: String,
+    seller: Party,
+    buyer: Party,
+    items: Vec<LineItem>,
+    totals: Option<Totals>,
+    currency: String,
+    css: String,
+}
+
+/// Styles of the built-in template; override them with [`InvoiceBuilder::css`].
+const BASE_CSS: &str = "
+.invoice { padding: 24px }
+.invoice h1 { color: #1a365d; margin-bottom: 16px }
+.parties { margin-bottom: 24px }
+.party-name { font-weight: bold }
+.items th { background-color: #e5e7eb }
+.items th, .items td { padding: 8px }
+.totals { text-align: right; margin-top: 16px }
+.grand-total { font-size: 20px; font-weight: bold }
+";
+
+impl InvoiceBuilder {
+    /// Start an invoice with the given number (e.g. `"2024-001"`).
+    pub fn new(number: &str) -> Self {
+        Self {
+            number: number.to_string(),
+            seller: Party::default(),
+            buyer: Party::default(),
+            items: Vec::new(),
+            totals: None,
+            currency: "$".to_string(),
+            css: String::new(),
+        }
+    }
+
+    pub fn set_seller(&mut self, name: &str, lines: &[&str]) -> &mut Self {
+        self.seller = party(name, lines);
+        self
+    }
+
+    pub fn set_buyer(&mut self, name: &str, lines: &[&str]) -> &mut Self {
+        self.buyer = party(name, lines);
+        self
+    }
+
+    pub fn add_line_item(
+        &mut self,
+        description: &str,
+        quantity: u32,
+        unit_price_cents: i64,
+    ) -> &mut Self {
+        self.items.push(LineItem {
+            description: description.to_string(),
+            quantity,
+            unit_price_cents,
+        });
+        self
+    }
+
+    /// Use explicit totals instead of summing the line items (e.g. to add
+    /// tax or discounts computed elsewhere).
+    pub fn set_totals(&mut self, totals: Totals) -> &mut Self {
+        self.totals = Some(totals);
+        self
+    }
+
+    /// Currency symbol prefixed to every amount (default `"$"`).
+    pub fn set_currency(&mut self, symbol: &str) -> &mut Self {
+        self.currency = symbol.to_string();
+        self
+    }
+
+    /// Append CSS that overrides the built-in template styles.
+    pub fn css(&mut self, css: &str) -> &mut Self {
+        self.css.push_str(css);
+        self.css.push('\n');
+        self
+    }
+
+    /// The explicit totals, or the line items summed with no tax.
+    pub fn totals(&self) -> Totals {
+        self.totals.unwrap_or_else(|| {
+            let subtotal: i64 = self.items.iter().map(LineItem::total_cents).sum();
+            Totals {
+                subtotal_cents: subtotal,
+                tax_cents: 0,
+                total_cents: subtotal,
+            }
+        })
+    }
+
+    /// Render the invoice into the built-in HTML template.
+    pub fn to_html(&self) -> String {
+        let mut html = format!(
+            "<html><head><style>{BASE_CSS}</style></head><body><div class=\"invoice\">\
+             <h1>Invoice #{}</h1>\
+             <div class=\"parties flex justify-between\">{}{}</div>\
+             <table class=\"items w-full\"><thead><tr>\
+             <th class=\"text-left\">Item</th><th class=\"text-left\">Qty</th>\
+             <th class=\"text-left\">Price</th><th class=\"text-left\">Total</th>\
+             </tr></thead><tbody>",
+            escape(&self.number),
+            party_html("From:", &self.seller),
+            party_html("To:", &self.buyer),
+        );
+        for item in &self.items {
+            html.push_str(&format!(
+                "<tr><td>{}</td><td>{}</td><td>{}</td><td>{}</td></tr>",
+                escape(&item.description),
+                item.quantity,
+                self.money(item.unit_price_cents),
+                self.money(item.total_cents()),
+            ));
+        }
+        let totals = self.totals();
+        html.push_str(&format!(
+            "</tbody></table><div class=\"totals\">\
+             <p>Subtotal: {}</p><p>Tax: {}</p><p class=\"grand-total\">Total: {}</p>\
+             </div></div></body></html>",
+            self.money(totals.subtotal_cents),
+            self.money(totals.tax_cents),
+            self.money(totals.total_cents),
+        ));
+        html
+    }
+
+    /// Generate the invoice PDF.  `config.title` defaults to
+    /// `"Invoice <number>"` when left at the pipeline default.
+    pub fn build(&self, config: &PipelineConfig) -> Result<GeneratedPdf, String> {
+        let mut config = config.clone().with_extra_css(&self.css);
+        if config.title == PipelineConfig::default().title {
+            config.title = format!("Invoice {}", self.number);
+        }
+        generate(&self.to_html(), &config)
+    }
+
+    /// Format cents as e.g. `$1,234.50`.
+    fn money(&self, cents: i64) -> String {
+        let sign = if cents < 0 { "-" } else { "" };
+        let cents = cents.unsigned_abs();
+        let whole = (cents / 100).to_string();
+        let mut grouped = String::new();
+        for (i, c) in whole.chars().enumerate() {
+            if i > 0 && (whole.len() - i) % 3 == 0 {
+                grouped.push(',');
+            }
+            grouped.push(c);
+        }
+        format!("{sign}{}{grouped}.{:02}", escape(&self.currency), cents % 100)
+    }
+}
+
+fn party(name: &str, lines: &[&str]) -> Party {
+    Party {
+        name: name.to_string(),
+        lines: lines.iter().map(|l| l.to_string()).collect(),
+    }
+}
+
+fn party_html(label: &str, party: &Party) -> String {
+    let mut html = format!(
+        "<div><p class=\"font-bold\">{label}</p><p class=\"party-name\">{}</p>",
+        escape(&party.name)
+    );
+    for line in &party.lines {
+        html.push_str(&format!("<p>{}</p>", escape(line)));
+    }
+    html.push_str("</div>");
+    html
+}
+
+/// Escape text for inclusion in element content or attribute values.
+fn escape(s: &str) -> String {
+    s.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::layout_config::LayoutBox;
+
+    fn collect_text(lbox: &LayoutBox, out: &mut Vec<String>) {
+        if let Some(text) = &lbox.text {
+            out.extend(text.lines.iter().map(|l| l.text.clone()));
+        }
+        for child in &lbox.children {
+            collect_text(child, out);
+        }
+    }
+
+    #[test]
+    fn money_formatting() {
+        let b = InvoiceBuilder::new("1");
+        assert_eq!(b.money(900_000), "$9,000.00");
+        assert_eq!(b.money(-1_234_567), "-$12,345.67");
+        assert_eq!(b.money(5), "$0.05");
+    }
+
+    #[test]
+    fn invoice_with_three_items_renders_parties_and_totals() {
+        let mut b = InvoiceBuilder::new("2024-001");
+        b.set_seller("Acme Corp", &["123 Business St"])
+            .set_buyer("Client & Co", &["456 Client Ave"])
+            .add_line_item("Web Development", 40, 15_000)
+            .add_line_item("Design Services", 20, 12_500)
+            .add_line_item("Hosting (Annual)", 1, 50_000);
+        assert_eq!(b.totals().total_cents, 900_000);
+
+        let pdf = b.build(&PipelineConfig::default()).unwrap();
+        assert_eq!(&pdf.bytes[0..5], b"%PDF-");
+        assert_eq!(pdf.layout.title, "Invoice 2024-001");
+
+        let mut text = Vec::new();
+        for page in &pdf.layout.pages {
+            for lbox in &page.boxes {
+                collect_text(lbox, &mut text);
+            }
+        }
+        for expected in ["Acme Corp", "Client & Co", "$6,000.00", "Total: $9,000.00"] {
+            assert!(
+                text.iter().any(|t| t.contains(expected)),
+                "missing {expected:?} in {text:?}"
+            );
+        }
+    }
+
+    #[test]
+    fn retained_html_holds_the_expanded_table() {
+        let mut b = InvoiceBuilder::new("7");
+        b.add_line_item("Fish & Chips", 2, 500);
+        let plain = b.build(&PipelineConfig::default()).unwrap();
+        assert!(plain.expanded_html.is_none());
+
+        let config = PipelineConfig::default().with_retain_intermediate_html(true);
+        let html = b.build(&config).unwrap().expanded_html.unwrap();
+        assert!(html.starts_with("<html><head><style>"), "{html}");
+        let table = r#"<table class="items w-full"><thead>"#;
+        assert!(html.contains(table), "{html}");
+        let row = "<tr><td>Fish &amp; Chips</td><td>2</td>";
+        assert!(html.contains(row), "{html}");
+    }
+}
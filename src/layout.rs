@@ -4,8 +4,13 @@
 use std::collections::HashMap;
 use taffy::prelude::*;
 
-use crate::fonts::{wrap_text, FontManager};
-use crate::style::{self, ComputedStyle, FontStyle as CssFontStyle, FontWeight, StyledNode};
+use crate::fonts::{
+    break_characters, truncate_with_ellipsis, wrap_preserving_spaces, wrap_text, wrap_vertical,
+    FontManager,
+};
+use crate::style::{
+    self, ComputedStyle, FontStyle as CssFontStyle, FontWeight, StyledNode, WhiteSpace,
+};
 
 // ---------------------------------------------------------------------------
 // Intermediate layout tree (pre-pagination)
@@ -24,6 +29,18 @@ pub struct PositionedBox {
     pub page_break_before: bool,
     pub page_break_after: bool,
     pub page_break_inside_avoid: bool,
+    /// Element the box was generated for; `None` for anonymous boxes such as
+    /// text runs between blocks.
+    pub element: Option<BoxElement>,
+}
+
+/// Identity of the element behind a [`PositionedBox`].
+#[derive(Debug, Clone, PartialEq)]
+pub struct BoxElement {
+    /// Lower-case tag name.
+    pub tag: String,
+    pub id: Option<String>,
+    pub classes: Vec<String>,
 }
 
 #[derive(Debug, Clone)]
@@ -51,9 +68,58 @@ struct LayoutBuilder<'a> {
     fonts: &'a FontManager,
     node_styles: HashMap<NodeId, ComputedStyle>,
     node_content: HashMap<NodeId, BoxContent>,
+    node_elements: HashMap<NodeId, BoxElement>,
+    /// Absolutely positioned boxes still looking for their containing block:
+    /// they become children of the nearest positioned ancestor (or the root)
+    /// rather than of their DOM parent.
+    out_of_flow: Vec<NodeId>,
+    /// Cells of earlier rows in the current row group that span down into
+    /// the next row, by column.
+    row_spans: Vec<RowSpan>,
+    /// Every cell with a `rowspan`, and how many rows it spans.
+    row_span_cells: Vec<(NodeId, usize)>,
     available_width: f32,
 }
 
+/// Columns of a table row taken by a cell from an earlier row.
+#[derive(Debug, Clone, Copy)]
+struct RowSpan {
+    column: usize,
+    columns: usize,
+    /// The cell's horizontal padding and border, taken once per column.
+    edges: f32,
+    /// Rows still to cover, after the one being built.
+    rows_left: usize,
+}
+
+/// How a table row's columns are shared out (see
+/// [`LayoutBuilder::plan_row`]).
+struct RowPlan {
+    /// Columns the row covers.
+    columns: usize,
+    /// For each child, and once more for the end of the row, the cells
+    /// spanning down from earlier rows placed there.
+    covered: Vec<Vec<RowSpan>>,
+}
+
+/// A cell's `colspan` or `rowspan` attribute; missing or invalid is 1, and
+/// `rowspan="0"` (to the end of the row group) is `usize::MAX`.
+fn cell_span(attrs: &HashMap<String, String>, name: &str) -> usize {
+    match attrs.get(name).and_then(|v| v.trim().parse::<usize>().ok()) {
+        Some(0) if name == "rowspan" => usize::MAX,
+        Some(n) if n > 0 => n.min(1000),
+        _ => 1,
+    }
+}
+
+/// A table cell's horizontal padding and border.  Cells share a row's free
+/// width in proportion to their columns on top of this, so a cell spanning
+/// columns is given it once for each to line up with the cells it spans.
+fn cell_edges(s: &ComputedStyle) -> f32 {
+    let border = |bordered: bool| if bordered { s.border_width } else { 0.0 };
+    s.padding_left + s.padding_right + border(s.border_sides.left) + border(s.border_sides.right)
+}
+
 impl<'a> LayoutBuilder<'a> {
     fn new(fonts: &'a FontManager, available_width: f32) -> Self {
         Self {
@@ -61,10 +127,117 @@ impl<'a> LayoutBuilder<'a> {
             fonts,
             node_styles: HashMap::new(),
             node_content: HashMap::new(),
+            node_elements: HashMap::new(),
+            out_of_flow: Vec::new(),
+            row_spans: Vec::new(),
+            row_span_cells: Vec::new(),
             available_width,
         }
     }
 
+    /// Place the cells of a table row among the columns still taken by
+    /// cells spanning down from earlier rows, and record the spans this row
+    /// starts for the rows after it.
+    fn plan_row(&mut self, children: &[StyledNode]) -> RowPlan {
+        let carried = std::mem::take(&mut self.row_spans);
+        let mut covered = vec![Vec::new(); children.len() + 1];
+        let mut started = Vec::new();
+        let mut column = 0;
+        let mut pending = carried.iter().peekable();
+        for (index, child) in children.iter().enumerate() {
+            let StyledNode::Element { attrs, style, .. } = child else {
+                continue;
+            };
+            while let Some(span) = pending.next_if(|span| span.column <= column) {
+                covered[index].push(*span);
+                column = column.max(span.column + span.columns);
+            }
+            let columns = cell_span(attrs, "colspan");
+            let rows = cell_span(attrs, "rowspan");
+            if rows > 1 {
+                started.push(RowSpan {
+                    column,
+                    columns,
+                    edges: cell_edges(style),
+                    rows_left: rows - 1,
+                });
+            }
+            column += columns;
+        }
+        for span in pending {
+            covered[children.len()].push(*span);
+            column = column.max(span.column + span.columns);
+        }
+
+        let continuing = carried.into_iter().filter(|span| span.rows_left > 1);
+        let mut next: Vec<RowSpan> = continuing
+            .map(|span| RowSpan {
+                rows_left: span.rows_left - 1,
+                ..span
+            })
+            .chain(started)
+            .collect();
+        next.sort_by_key(|span| span.column);
+        self.row_spans = next;
+        RowPlan {
+            columns: column.max(1),
+            covered,
+        }
+    }
+
+    /// An empty stand-in for the columns of a row taken by a cell from an
+    /// earlier row.
+    fn covered_cell(&mut self, span: RowSpan) -> NodeId {
+        let style = Style {
+            flex_grow: span.columns as f32,
+            flex_shrink: 1.0,
+            flex_basis: taffy::Dimension::Length(span.columns as f32 * span.edges),
+            min_size: Size {
+                width: taffy::Dimension::Length(0.0),
+                height: taffy::Dimension::Auto,
+            },
+            ..Default::default()
+        };
+        self.taffy.new_leaf(style).unwrap()
+    }
+
+    /// Stretch each cell with a `rowspan` down over the rows it spans.  Its
+    /// outer height stays that of its own row – the extra is given back as a
+    /// negative bottom margin – so the rows keep their places.  Returns
+    /// whether any cell changed, in which case the tree must be laid out
+    /// again.
+    fn stretch_row_spans(&mut self) -> bool {
+        let bottom = |layout: &Layout| layout.location.y + layout.size.height;
+        let mut changed = false;
+        for (cell, rows) in self.row_span_cells.clone() {
+            let Some(row) = self.taffy.parent(cell) else {
+                continue;
+            };
+            let Some(group) = self.taffy.parent(row) else {
+                continue;
+            };
+            let siblings = self.taffy.children(group).unwrap_or_default();
+            let Some(index) = siblings.iter().position(|&r| r == row) else {
+                continue;
+            };
+            let Some(&last) = siblings[index..].iter().take(rows).last() else {
+                continue;
+            };
+            let extra = bottom(self.taffy.layout(last).unwrap())
+                - bottom(self.taffy.layout(row).unwrap());
+            if extra <= 0.0 {
+                continue;
+            }
+            let height = self.taffy.layout(cell).unwrap().size.height + extra;
+            let mut style = self.taffy.style(cell).unwrap().clone();
+            style.size.height = taffy::Dimension::Length(height);
+            style.margin.bottom = LengthPercentageAuto::Length(-extra);
+            self.taffy.set_style(cell, style).unwrap();
+            changed = true;
+        }
+        changed
+    }
+
     /// Collect all text content from an inline subtree (spans, text nodes).
     fn collect_inline_text(node: &StyledNode) -> String {
         match node {
@@ -103,7 +276,30 @@ impl<'a> LayoutBuilder<'a> {
                 style,
                 children,
                 attrs,
-            } => self.build_element_node(tag, style, children, attrs, parent_width),
+            } => {
+                let outer = std::mem::take(&mut self.out_of_flow);
+                let node = self.build_element_node(tag, style, children, attrs, parent_width);
+                // A positioned element is the containing block of the
+                // absolute boxes below it; otherwise they keep bubbling up.
+                let hoisted = std::mem::replace(&mut self.out_of_flow, outer);
+                if style.position.is_positioned() {
+                    for child in hoisted {
+                        self.taffy.add_child(node, child).unwrap();
+                    }
+                } else {
+                    self.out_of_flow.extend(hoisted);
+                }
+                let classes = attrs.get("class").map(|c| c.split_whitespace());
+                self.node_elements.insert(
+                    node,
+                    BoxElement {
+                        tag: tag.name(),
+                        id: attrs.get("id").cloned(),
+                        classes: classes.into_iter().flatten().map(str::to_string).collect(),
+                    },
+                );
+                node
+            }
         }
     }
 
@@ -150,15 +346,53 @@ impl<'a> LayoutBuilder<'a> {
         } else {
             self.available_width
         };
-        let lines = wrap_text(
-            text.trim(),
-            font_size,
-            bold,
-            italic,
-            family,
-            max_w,
-            self.fonts,
-        );
+        if style.writing_mode.is_vertical() {
+            return self.build_vertical_text_node(text, style, max_w, line_height_px);
+        }
+        let text = style.white_space.apply(text);
+        let break_chars = |line: &str| {
+            break_characters(line, font_size, bold, italic, family, max_w, self.fonts)
+        };
+        let lines = match style.white_space {
+            WhiteSpace::Nowrap => vec![text.clone()],
+            WhiteSpace::Pre => text.split('\n').map(str::to_string).collect(),
+            _ if style.word_break == style::WordBreak::BreakAll => {
+                text.split('\n').flat_map(&break_chars).collect()
+            }
+            WhiteSpace::Normal | WhiteSpace::PreLine => {
+                wrap_text(&text, font_size, bold, italic, family, max_w, self.fonts)
+            }
+            WhiteSpace::PreWrap | WhiteSpace::BreakSpaces => text
+                .split('\n')
+                .flat_map(|line| {
+                    wrap_preserving_spaces(line, font_size, bold, italic, family, max_w, self.fonts)
+                })
+                .collect(),
+        };
+        // `overflow-wrap: anywhere` breaks the words that still overflow.
+        let lines = if style.overflow_wrap.breaks_words()
+            && !matches!(style.white_space, WhiteSpace::Nowrap | WhiteSpace::Pre)
+        {
+            let fits = |l: &str| {
+                self.fonts.measure_text_width(l, font_size, bold, italic, family) <= max_w
+            };
+            lines
+                .into_iter()
+                .flat_map(|l| if fits(&l) { vec![l] } else { break_chars(&l) })
+                .collect()
+        } else {
+            lines
+        };
+        let lines = if style.overflow == style::Overflow::Hidden
+            && style.text_overflow == style::TextOverflow::Ellipsis
+        {
+            let fit = |l: &String| {
+                truncate_with_ellipsis(l, font_size, bold, italic, family, max_w, self.fonts)
+            };
+            lines.iter().map(fit).collect()
+        } else {
+            lines
+        };
 
         let text_width = lines
             .iter()
@@ -177,13 +411,43 @@ impl<'a> LayoutBuilder<'a> {
             ..Default::default()
         };
 
+        let node = self.taffy.new_leaf(taffy_style).unwrap();
+        self.node_styles.insert(node, style.clone());
+        self.node_content.insert(node, BoxContent::Text { text, lines });
+        node
+    }
+
+    /// Text in a vertical writing mode: each line is a column one line-height
+    /// wide.  Columns are as tall as the element's `height`, or `max_w` when
+    /// it has none (the page height is not known at this stage).
+    fn build_vertical_text_node(
+        &mut self,
+        text: &str,
+        style: &ComputedStyle,
+        max_w: f32,
+        line_height_px: f32,
+    ) -> NodeId {
+        let max_h = match style.height {
+            crate::style::Dimension::Px(h) if h > 0.0 => h,
+            _ => max_w,
+        };
+        let columns = wrap_vertical(text.trim(), style.font_size, max_h);
+        let longest = columns.iter().map(|c| c.chars().count()).max().unwrap_or(0);
+
+        let taffy_style = Style {
+            size: Size {
+                width: Dimension::Length(columns.len() as f32 * line_height_px),
+                height: Dimension::Length(longest as f32 * style.font_size),
+            },
+            ..Default::default()
+        };
         let node = self.taffy.new_leaf(taffy_style).unwrap();
         self.node_styles.insert(node, style.clone());
         self.node_content.insert(
             node,
             BoxContent::Text {
                 text: text.trim().to_string(),
-                lines,
+                lines: columns,
             },
         );
         node
@@ -201,16 +465,12 @@ impl<'a> LayoutBuilder<'a> {
         // text merged into a single wrapped text node so spans flow correctly.
         let is_paragraph = matches!(
             tag,
-            crate::dom::Tag::P | crate::dom::Tag::H1 | crate::dom::Tag::H2 | crate::dom::Tag::H3
+            crate::dom::Tag::P
+                | crate::dom::Tag::H1
+                | crate::dom::Tag::H2
+                | crate::dom::Tag::H3
+                | crate::dom::Tag::Summary
         );
-        if is_paragraph && !children.is_empty() && Self::all_inline(children) {
-            let raw: String = children.iter().map(Self::collect_inline_text).collect();
-            // Normalise runs of whitespace/newlines to single spaces.
-            let combined: String = raw.split_whitespace().collect::<Vec<_>>().join(" ");
-            if !combined.is_empty() {
-                return self.build_text_node_with_para_style(&combined, style, parent_width);
-            }
-        }
 
         // Compute the width available for children
         let my_width = match style.width {
@@ -220,6 +480,35 @@ impl<'a> LayoutBuilder<'a> {
         };
         let inner_width = my_width - style.padding_left - style.padding_right;
 
+        let columns = style.column_count.max(1) as usize;
+        let column_gap = style.column_gap.unwrap_or(style.font_size);
+        let column_width =
+            ((inner_width - column_gap * (columns - 1) as f32) / columns as f32).max(1.0);
+
+        if is_paragraph && !children.is_empty() && Self::all_inline(children) {
+            let raw: String = children.iter().map(Self::collect_inline_text).collect();
+            // Normalise whitespace as `white-space` dictates.
+            let combined = style.white_space.apply(&raw);
+            if !combined.is_empty() && columns > 1 {
+                // The box decorations belong to the container, not the text.
+                let text_style = ComputedStyle {
+                    background_color: style::Color::TRANSPARENT,
+                    background_gradient: None,
+                    background_image: None,
+                    border_width: 0.0,
+                    box_shadow: Vec::new(),
+                    transform: None,
+                    ..style.clone()
+                };
+                let text = self.build_text_node(&combined, &text_style, column_width);
+                let column_nodes = self.balance_into_columns(&[text], columns, column_width);
+                return self.build_multicol_container(style, tag, &column_nodes, column_gap);
+            }
+            if !combined.is_empty() {
+                return self.build_text_node_with_para_style(&combined, style, parent_width);
+            }
+        }
+
         // Estimate per-child width for flex-row containers and table rows so
         // that text is word-wrapped to the right column width at build time.
         let is_flex_row = style.display == style::Display::Flex
@@ -232,18 +521,43 @@ impl<'a> LayoutBuilder<'a> {
             .count()
             .max(1);
 
-        let child_build_width = if is_flex_row || is_table_row {
-            let gap_total = style.gap * (elem_child_count.saturating_sub(1)) as f32;
-            ((inner_width - gap_total) / elem_child_count as f32).max(1.0)
+        // A row shares its width out by columns, which cells spanning
+        // several take more of and which cells from rows above may hold.
+        let row_plan = is_table_row.then(|| self.plan_row(children));
+        let slots = row_plan.as_ref().map_or(elem_child_count, |plan| plan.columns);
+        let child_build_width = if columns > 1 {
+            column_width
+        } else if is_flex_row || is_table_row {
+            let gap_total = style.gap * (slots.saturating_sub(1)) as f32;
+            ((inner_width - gap_total) / slots as f32).max(1.0)
         } else {
             inner_width
         };
+        // Cells spanning rows do not reach past their row group.
+        let row_group = matches!(
+            tag,
+            crate::dom::Tag::Table
+                | crate::dom::Tag::Thead
+                | crate::dom::Tag::Tbody
+                | crate::dom::Tag::Tfoot
+        );
+        let outer_spans = row_group.then(|| std::mem::take(&mut self.row_spans));
 
         // Build child nodes
         let mut child_nodes = Vec::new();
         let mut list_counter = 0u32;
 
-        for child in children {
+        for (index, child) in children.iter().enumerate() {
+            let mut child_width = child_build_width;
+            if let Some(plan) = &row_plan {
+                for &span in &plan.covered[index] {
+                    let covered = self.covered_cell(span);
+                    child_nodes.push(covered);
+                }
+                if let StyledNode::Element { attrs, .. } = child {
+                    child_width *= cell_span(attrs, "colspan") as f32;
+                }
+            }
             // For list items, compute and record the marker string so it can
             // be rendered as a bullet / number in the left gutter.
             let li_marker: Option<String> =
@@ -262,7 +576,13 @@ impl<'a> LayoutBuilder<'a> {
                     None
                 };
 
-            let child_id = self.build_node(child, child_build_width);
+            let child_id = self.build_node(child, child_width);
+            if let StyledNode::Element { style: cs, .. } = child {
+                if cs.position == style::Position::Absolute {
+                    self.out_of_flow.push(child_id);
+                    continue;
+                }
+            }
 
             // Attach the marker to the taffy node so pagination can render it.
             if let Some(marker) = li_marker {
@@ -272,6 +592,34 @@ impl<'a> LayoutBuilder<'a> {
 
             child_nodes.push(child_id);
         }
+        if let Some(plan) = &row_plan {
+            for &span in &plan.covered[children.len()] {
+                let covered = self.covered_cell(span);
+                child_nodes.push(covered);
+            }
+        }
+        if let Some(outer) = outer_spans {
+            self.row_spans = outer;
+        }
+
+        let flow_container = !matches!(
+            tag,
+            crate::dom::Tag::Table
+                | crate::dom::Tag::Thead
+                | crate::dom::Tag::Tbody
+                | crate::dom::Tag::Tfoot
+                | crate::dom::Tag::Tr
+        ) && (matches!(tag, crate::dom::Tag::Td | crate::dom::Tag::Th)
+            || matches!(
+                style.display,
+                style::Display::Block
+                    | style::Display::ListItem
+                    | style::Display::InlineBlock
+                    | style::Display::TableCell
+            ));
+        if flow_container && columns == 1 {
+            self.collapse_sibling_margins(&child_nodes);
+        }
 
         // For <img> elements, resolve Auto width/height to concrete pixel dimensions
         // using the image's intrinsic size decoded from the base64 data URI.
@@ -287,13 +635,36 @@ impl<'a> LayoutBuilder<'a> {
             None
         };
 
+        if columns > 1 {
+            let column_nodes = self.balance_into_columns(&child_nodes, columns, column_width);
+            return self.build_multicol_container(style, tag, &column_nodes, column_gap);
+        }
+
         let effective_style = style_override.as_ref().unwrap_or(style);
-        let taffy_style = self.computed_to_taffy(effective_style, tag);
+        let mut taffy_style = self.computed_to_taffy(effective_style, tag);
+        let is_cell = matches!(tag, crate::dom::Tag::Td | crate::dom::Tag::Th);
+        if is_cell {
+            let columns = cell_span(attrs, "colspan") as f32;
+            taffy_style.flex_grow = columns;
+            let basis = columns * cell_edges(effective_style);
+            taffy_style.flex_basis = taffy::Dimension::Length(basis);
+        }
+        if flow_container
+            && matches!(
+                style.display,
+                style::Display::Block | style::Display::ListItem
+            )
+        {
+            self.collapse_through_parent(&mut taffy_style, &child_nodes);
+        }
         let node = self
             .taffy
             .new_with_children(taffy_style, &child_nodes)
             .unwrap();
         self.node_styles.insert(node, effective_style.clone());
+        if is_cell && cell_span(attrs, "rowspan") > 1 {
+            self.row_span_cells.push((node, cell_span(attrs, "rowspan")));
+        }
 
         // Handle images
         if *tag == crate::dom::Tag::Img {
@@ -304,6 +675,312 @@ impl<'a> LayoutBuilder<'a> {
         node
     }
 
+    /// Collapse the vertical margins of adjacent in-flow `children` of a
+    /// block container as CSS does: the margins that meet between two blocks
+    /// – including both margins of any empty blocks in between – become one,
+    /// the largest positive margin plus the most negative one.  The result
+    /// is kept on the upper block's bottom margin.
+    fn collapse_sibling_margins(&mut self, children: &[NodeId]) {
+        // Margins meeting at the current gap, and the block above it.
+        let mut run = Vec::new();
+        let mut above: Option<NodeId> = None;
+        let mut first_empty: Option<NodeId> = None;
+        for &child in children {
+            let Some((top, bottom)) = self.block_margins(child) else {
+                // Inline-level boxes separate margins without collapsing.
+                self.end_margin_run(above.take(), first_empty.take(), &mut run);
+                continue;
+            };
+            run.push(top);
+            if self.is_empty_block(child) {
+                run.push(bottom);
+                self.set_vertical_margins(child, Some(0.0), Some(0.0));
+                first_empty.get_or_insert(child);
+                continue;
+            }
+            let collapsed = collapse_margins(&run);
+            match above {
+                Some(prev) => {
+                    self.set_vertical_margins(prev, None, Some(collapsed));
+                    self.set_vertical_margins(child, Some(0.0), None);
+                }
+                None => self.set_vertical_margins(child, Some(collapsed), None),
+            }
+            run = vec![bottom];
+            above = Some(child);
+            first_empty = None;
+        }
+        self.end_margin_run(above, first_empty, &mut run);
+    }
+
+    /// Place the margins of a finished collapsing `run` on the bottom of the
+    /// block `above` it, or else on the first empty block it ran through.
+    fn end_margin_run(
+        &mut self,
+        above: Option<NodeId>,
+        first_empty: Option<NodeId>,
+        run: &mut Vec<f32>,
+    ) {
+        let collapsed = collapse_margins(run);
+        match (above, first_empty) {
+            (Some(block), _) => self.set_vertical_margins(block, None, Some(collapsed)),
+            (None, Some(block)) => self.set_vertical_margins(block, Some(collapsed), None),
+            (None, None) => {}
+        }
+        run.clear();
+    }
+
+    /// Collapse a block's first child's top margin, and its last child's
+    /// bottom margin, into the block's own (`parent`) where no padding or
+    /// border separates them.  The bottom margins only meet if the block's
+    /// height is automatic.
+    fn collapse_through_parent(&mut self, parent: &mut Style, children: &[NodeId]) {
+        let in_flow: Vec<NodeId> = children
+            .iter()
+            .copied()
+            .filter(|&c| self.taffy.style(c).unwrap().display != taffy::Display::None)
+            .collect();
+        let zero = LengthPercentage::Length(0.0);
+        if parent.padding.top == zero && parent.border.top == zero {
+            let first = in_flow.iter().find(|&&c| !self.is_empty_block(c));
+            if let (Some(&first), Some(own)) = (first, margin_length(parent.margin.top)) {
+                if let Some((top, _)) = self.block_margins(first) {
+                    parent.margin.top = LengthPercentageAuto::Length(collapse_margins(&[own, top]));
+                    self.set_vertical_margins(first, Some(0.0), None);
+                }
+            }
+        }
+        if parent.padding.bottom == zero
+            && parent.border.bottom == zero
+            && parent.size.height == Dimension::Auto
+        {
+            let last = in_flow.iter().rev().find(|&&c| !self.is_empty_block(c));
+            if let (Some(&last), Some(own)) = (last, margin_length(parent.margin.bottom)) {
+                if let Some((_, bottom)) = self.block_margins(last) {
+                    let collapsed = collapse_margins(&[own, bottom]);
+                    parent.margin.bottom = LengthPercentageAuto::Length(collapsed);
+                    self.set_vertical_margins(last, None, Some(0.0));
+                }
+            }
+        }
+    }
+
+    /// The top and bottom margins of `node` if it is an in-flow block-level
+    /// box whose vertical margins are fixed lengths, i.e. can collapse.
+    fn block_margins(&self, node: NodeId) -> Option<(f32, f32)> {
+        let ts = self.taffy.style(node).unwrap();
+        let display = self.node_styles.get(&node).map(|s| s.display);
+        if ts.display == taffy::Display::None
+            || matches!(
+                display,
+                Some(style::Display::Inline | style::Display::InlineBlock)
+            )
+        {
+            return None;
+        }
+        Some((
+            margin_length(ts.margin.top)?,
+            margin_length(ts.margin.bottom)?,
+        ))
+    }
+
+    /// Whether `node` is a block with no content, height, padding or border,
+    /// whose own top and bottom margins therefore collapse together.
+    fn is_empty_block(&self, node: NodeId) -> bool {
+        let ts = self.taffy.style(node).unwrap();
+        let zero = LengthPercentage::Length(0.0);
+        (ts.size.height == Dimension::Auto || ts.size.height == Dimension::Length(0.0))
+            && ts.min_size.height == Dimension::Auto
+            && ts.aspect_ratio.is_none()
+            && [
+                ts.padding.top,
+                ts.padding.bottom,
+                ts.border.top,
+                ts.border.bottom,
+            ]
+            .iter()
+            .all(|&edge| edge == zero)
+            && self.taffy.child_count(node) == 0
+            && !self.node_content.contains_key(&node)
+    }
+
+    /// Set the top and/or bottom margin of `node`.
+    fn set_vertical_margins(&mut self, node: NodeId, top: Option<f32>, bottom: Option<f32>) {
+        let mut ts = self.taffy.style(node).unwrap().clone();
+        if let Some(top) = top {
+            ts.margin.top = LengthPercentageAuto::Length(top);
+        }
+        if let Some(bottom) = bottom {
+            ts.margin.bottom = LengthPercentageAuto::Length(bottom);
+        }
+        self.taffy.set_style(node, ts).unwrap();
+    }
+
+    /// A multi-column element: a row of `column_nodes` `gap` apart.
+    fn build_multicol_container(
+        &mut self,
+        style: &ComputedStyle,
+        tag: &crate::dom::Tag,
+        column_nodes: &[NodeId],
+        gap: f32,
+    ) -> NodeId {
+        let mut taffy_style = self.computed_to_taffy(style, tag);
+        taffy_style.display = taffy::Display::Flex;
+        taffy_style.flex_direction = taffy::FlexDirection::Row;
+        taffy_style.flex_wrap = taffy::FlexWrap::NoWrap;
+        taffy_style.align_items = Some(taffy::AlignItems::Start);
+        taffy_style.gap.width = LengthPercentage::Length(gap);
+        let node = self
+            .taffy
+            .new_with_children(taffy_style, column_nodes)
+            .unwrap();
+        self.node_styles.insert(node, style.clone());
+        node
+    }
+
+    /// Lay `children` out in a single column `width` wide, then distribute
+    /// them over `columns` column nodes of about equal height.  Multi-line
+    /// paragraphs may be split between lines to balance the columns.
+    fn balance_into_columns(
+        &mut self,
+        children: &[NodeId],
+        columns: usize,
+        width: f32,
+    ) -> Vec<NodeId> {
+        let column_style = || Style {
+            display: taffy::Display::Flex,
+            flex_direction: taffy::FlexDirection::Column,
+            size: Size {
+                width: Dimension::Length(width),
+                height: Dimension::Auto,
+            },
+            flex_shrink: 0.0,
+            ..Default::default()
+        };
+
+        // Measure the content as one column.
+        let probe = self
+            .taffy
+            .new_with_children(column_style(), children)
+            .unwrap();
+        self.taffy
+            .compute_layout(
+                probe,
+                Size {
+                    width: AvailableSpace::Definite(width),
+                    height: AvailableSpace::MaxContent,
+                },
+            )
+            .unwrap();
+
+        // Break opportunities: between children and between the lines of a
+        // horizontal text leaf.  Each unit is (child, line, top, bottom).
+        let mut units: Vec<(usize, Option<usize>, f32, f32)> = Vec::new();
+        for (i, &child) in children.iter().enumerate() {
+            let layout = *self.taffy.layout(child).unwrap();
+            let (top, bottom) = (layout.location.y, layout.location.y + layout.size.height);
+            let lines = match (self.node_content.get(&child), self.node_styles.get(&child)) {
+                (Some(BoxContent::Text { lines, .. }), Some(st))
+                    if lines.len() > 1 && !st.writing_mode.is_vertical() =>
+                {
+                    Some((lines.len(), self.fonts.line_height_px(st.font_size, st.line_height)))
+                }
+                _ => None,
+            };
+            match lines {
+                Some((count, lh)) => {
+                    let first_line = top + layout.padding.top + layout.border.top;
+                    for line in 0..count {
+                        let line_top = if line == 0 { top } else { first_line + line as f32 * lh };
+                        let line_bottom = if line + 1 == count {
+                            bottom
+                        } else {
+                            first_line + (line + 1) as f32 * lh
+                        };
+                        units.push((i, Some(line), line_top, line_bottom));
+                    }
+                }
+                None => units.push((i, None, top, bottom)),
+            }
+        }
+        self.taffy.set_children(probe, &[]).unwrap();
+        self.taffy.remove(probe).unwrap();
+
+        let spans: Vec<(f32, f32)> = units.iter().map(|&(_, _, t, b)| (t, b)).collect();
+        let starts = balance_columns(&spans, columns);
+
+        let mut column_nodes = Vec::new();
+        for (c, &start) in starts.iter().enumerate() {
+            let end = starts.get(c + 1).copied().unwrap_or(units.len());
+            let mut members = Vec::new();
+            let mut u = start;
+            while u < end {
+                let child_index = units[u].0;
+                let mut run_end = u;
+                while run_end < end && units[run_end].0 == child_index {
+                    run_end += 1;
+                }
+                let child = children[child_index];
+                match (units[u].1, units[run_end - 1].1) {
+                    (Some(first), Some(last)) => {
+                        let total = units.iter().filter(|x| x.0 == child_index).count();
+                        if first == 0 && last + 1 == total {
+                            members.push(child);
+                        } else {
+                            members.push(self.text_leaf_part(child, first..last + 1, total));
+                        }
+                    }
+                    _ => members.push(child),
+                }
+                u = run_end;
+            }
+            column_nodes.push(self.taffy.new_with_children(column_style(), &members).unwrap());
+        }
+        while column_nodes.len() < columns {
+            column_nodes.push(self.taffy.new_leaf(column_style()).unwrap());
+        }
+        column_nodes
+    }
+
+    /// A copy of text leaf `node` holding only `lines` (of `total`); inner
+    /// edges lose their margin, padding and border so the parts join up.
+    fn text_leaf_part(
+        &mut self,
+        node: NodeId,
+        lines: std::ops::Range<usize>,
+        total: usize,
+    ) -> NodeId {
+        let style = self.node_styles.get(&node).cloned().unwrap_or_default();
+        let Some(BoxContent::Text { lines: all, .. }) = self.node_content.get(&node) else {
+            return node;
+        };
+        let part: Vec<String> = all[lines.clone()].to_vec();
+        let line_height = self.fonts.line_height_px(style.font_size, style.line_height);
+
+        let mut ts = self.taffy.style(node).unwrap().clone();
+        ts.size.height = Dimension::Length(part.len() as f32 * line_height);
+        if lines.start > 0 {
+            ts.margin.top = LengthPercentageAuto::Length(0.0);
+            ts.padding.top = LengthPercentage::Length(0.0);
+            ts.border.top = LengthPercentage::Length(0.0);
+        }
+        if lines.end < total {
+            ts.margin.bottom = LengthPercentageAuto::Length(0.0);
+            ts.padding.bottom = LengthPercentage::Length(0.0);
+            ts.border.bottom = LengthPercentage::Length(0.0);
+        }
+        let leaf = self.taffy.new_leaf(ts).unwrap();
+        self.node_styles.insert(leaf, style);
+        self.node_content.insert(
+            leaf,
+            BoxContent::Text {
+                text: part.join(" "),
+                lines: part,
+            },
+        );
+        leaf
+    }
+
     fn computed_to_taffy(&self, s: &ComputedStyle, tag: &crate::dom::Tag) -> Style {
         let mut ts = Style::default();
 
@@ -331,6 +1008,13 @@ impl<'a> LayoutBuilder<'a> {
                 };
                 return ts;
             }
+            crate::dom::Tag::Thead | crate::dom::Tag::Tbody | crate::dom::Tag::Tfoot => {
+                ts.display = taffy::Display::Flex;
+                ts.flex_direction = taffy::FlexDirection::Column;
+                ts.size.width = taffy::Dimension::Percent(1.0);
+                ts.min_size.width = taffy::Dimension::Length(0.0);
+                return ts;
+            }
             crate::dom::Tag::Tr => {
                 ts.display = taffy::Display::Flex;
                 ts.flex_direction = taffy::FlexDirection::Row;
@@ -352,18 +1036,27 @@ impl<'a> LayoutBuilder<'a> {
                 ts.flex_shrink = 1.0;
                 ts.flex_basis = taffy::Dimension::Length(0.0); // equal columns
                 ts.min_size.width = taffy::Dimension::Length(0.0);
+                // Cells stretch to the row's height; their content is placed
+                // in it by `vertical-align`, and across it by `text-align`.
+                ts.justify_content = Some(match s.vertical_align {
+                    style::VerticalAlign::Baseline | style::VerticalAlign::Top => {
+                        taffy::JustifyContent::Start
+                    }
+                    style::VerticalAlign::Middle => taffy::JustifyContent::Center,
+                    style::VerticalAlign::Bottom => taffy::JustifyContent::End,
+                });
+                ts.align_items = Some(match s.text_align {
+                    style::TextAlign::Left => taffy::AlignItems::Stretch,
+                    style::TextAlign::Center => taffy::AlignItems::Center,
+                    style::TextAlign::Right => taffy::AlignItems::End,
+                });
                 ts.padding = Rect {
                     top: LengthPercentage::Length(s.padding_top),
                     right: LengthPercentage::Length(s.padding_right),
                     bottom: LengthPercentage::Length(s.padding_bottom),
                     left: LengthPercentage::Length(s.padding_left),
                 };
-                ts.border = Rect {
-                    top: LengthPercentage::Length(s.border_width),
-                    right: LengthPercentage::Length(s.border_width),
-                    bottom: LengthPercentage::Length(s.border_width),
-                    left: LengthPercentage::Length(s.border_width),
-                };
+                ts.border = self.border_to_taffy(s);
                 return ts;
             }
             _ => {}
@@ -407,6 +1100,9 @@ impl<'a> LayoutBuilder<'a> {
             }
             style::Display::Block
             | style::Display::ListItem
+            | style::Display::TableHeaderGroup
+            | style::Display::TableRowGroup
+            | style::Display::TableFooterGroup
             | style::Display::TableRow
             | style::Display::TableCell
             | style::Display::InlineBlock => {
@@ -429,6 +1125,7 @@ impl<'a> LayoutBuilder<'a> {
             width: self.dim_to_taffy(s.width),
             height: self.dim_to_taffy(s.height),
         };
+        ts.aspect_ratio = s.aspect_ratio;
         // Allow flex/shrink items to compress below their natural content size
         ts.min_size = Size {
             width: if s.flex_shrink > 0.0 || s.flex_grow > 0.0 {
@@ -464,12 +1161,7 @@ impl<'a> LayoutBuilder<'a> {
         };
 
         // Border
-        ts.border = Rect {
-            top: LengthPercentage::Length(s.border_width),
-            right: LengthPercentage::Length(s.border_width),
-            bottom: LengthPercentage::Length(s.border_width),
-            left: LengthPercentage::Length(s.border_width),
-        };
+        ts.border = self.border_to_taffy(s);
 
         // Gap
         ts.gap = Size {
@@ -477,6 +1169,21 @@ impl<'a> LayoutBuilder<'a> {
             height: LengthPercentage::Length(s.gap),
         };
 
+        // Positioning (Taffy places absolute boxes against their parent,
+        // which `build_node` makes the CSS containing block)
+        ts.position = match s.position {
+            style::Position::Absolute => taffy::Position::Absolute,
+            style::Position::Static | style::Position::Relative => taffy::Position::Relative,
+        };
+        if s.position.is_positioned() {
+            ts.inset = Rect {
+                top: self.inset_to_taffy(s.inset_top),
+                right: self.inset_to_taffy(s.inset_right),
+                bottom: self.inset_to_taffy(s.inset_bottom),
+                left: self.inset_to_taffy(s.inset_left),
+            };
+        }
+
         ts
     }
 
@@ -488,6 +1195,25 @@ impl<'a> LayoutBuilder<'a> {
         }
     }
 
+    /// The border widths of `s`'s bordered sides, zero elsewhere.
+    fn border_to_taffy(&self, s: &ComputedStyle) -> Rect<LengthPercentage> {
+        let width = |bordered: bool| if bordered { s.border_width } else { 0.0 };
+        Rect {
+            top: LengthPercentage::Length(width(s.border_sides.top)),
+            right: LengthPercentage::Length(width(s.border_sides.right)),
+            bottom: LengthPercentage::Length(width(s.border_sides.bottom)),
+            left: LengthPercentage::Length(width(s.border_sides.left)),
+        }
+    }
+
+    fn inset_to_taffy(&self, d: crate::style::Dimension) -> LengthPercentageAuto {
+        match d {
+            crate::style::Dimension::Auto => LengthPercentageAuto::Auto,
+            crate::style::Dimension::Px(v) => LengthPercentageAuto::Length(v),
+            crate::style::Dimension::Percent(v) => LengthPercentageAuto::Percent(v / 100.0),
+        }
+    }
+
     /// Extract positioned boxes after layout computation.
     fn extract(&self, node: NodeId, offset_x: f32, offset_y: f32) -> PositionedBox {
         let layout = self.taffy.layout(node).unwrap();
@@ -517,6 +1243,7 @@ impl<'a> LayoutBuilder<'a> {
             page_break_before: style.page_break_before,
             page_break_after: style.page_break_after,
             page_break_inside_avoid: style.page_break_inside_avoid,
+            element: self.node_elements.get(&node).cloned(),
             style,
             content,
             children,
@@ -524,6 +1251,34 @@ impl<'a> LayoutBuilder<'a> {
     }
 }
 
+/// Split `units` (top, bottom in one tall column) into at most `columns`
+/// runs of about equal height, returning the index each run starts at.
+///
+/// Starts from the ideal height (total / columns) and, while the greedy fill
+/// needs too many columns, grows it to the smallest overflow seen.
+fn balance_columns(units: &[(f32, f32)], columns: usize) -> Vec<usize> {
+    let (Some(first), Some(last)) = (units.first(), units.last()) else {
+        return vec![0];
+    };
+    let mut height = (last.1 - first.0) / columns.max(1) as f32;
+    loop {
+        let mut starts = vec![0];
+        let mut column_top = first.0;
+        let mut overflow = f32::INFINITY;
+        for (i, &(top, bottom)) in units.iter().enumerate().skip(1) {
+            if bottom - column_top > height + 0.01 {
+                overflow = overflow.min(bottom - column_top);
+                starts.push(i);
+                column_top = top;
+            }
+        }
+        if starts.len() <= columns || !overflow.is_finite() {
+            return starts;
+        }
+        height = overflow;
+    }
+}
+
 // ---------------------------------------------------------------------------
 // Image intrinsic-size helper
 // ---------------------------------------------------------------------------
@@ -547,8 +1302,13 @@ fn resolve_img_auto_dimensions(
     let comma = src.find(',')?;
     let b64 = src[comma + 1..].trim();
     let bytes = BASE64_STD.decode(b64).ok()?;
-    let img = ::image::load_from_memory(&bytes).ok()?;
-    let (px_w, px_h) = (img.width() as f32, img.height() as f32);
+    // Only the header is read: the pixels are not needed for sizing.
+    let (px_w, px_h) = ::image::ImageReader::new(std::io::Cursor::new(&bytes))
+        .with_guessed_format()
+        .ok()?
+        .into_dimensions()
+        .ok()?;
+    let (px_w, px_h) = (px_w as f32, px_h as f32);
     if px_w == 0.0 || px_h == 0.0 {
         return None;
     }
@@ -593,15 +1353,50 @@ pub fn compute_layout(
     page_margin: f32,
     fonts: &FontManager,
 ) -> Vec<PositionedBox> {
-    let content_width = page_width - 2.0 * page_margin;
+    compute_layout_with_margins(styled_nodes, page_width, page_margin, page_margin, fonts)
+}
+
+/// [`compute_layout`] with different left and right page margins.
+/// The single margin that `margins` collapse into: the largest positive
+/// one plus the most negative one.
+fn collapse_margins(margins: &[f32]) -> f32 {
+    let positive = margins.iter().copied().fold(0.0f32, f32::max);
+    let negative = margins.iter().copied().fold(0.0f32, f32::min);
+    positive + negative
+}
+
+/// A fixed-length margin in points; `auto` and percentages do not collapse.
+fn margin_length(margin: LengthPercentageAuto) -> Option<f32> {
+    match margin {
+        LengthPercentageAuto::Length(v) => Some(v),
+        _ => None,
+    }
+}
+
+pub fn compute_layout_with_margins(
+    styled_nodes: &[StyledNode],
+    page_width: f32,
+    margin_left: f32,
+    margin_right: f32,
+    fonts: &FontManager,
+) -> Vec<PositionedBox> {
+    let content_width = page_width - margin_left - margin_right;
     let mut builder = LayoutBuilder::new(fonts, content_width);
 
     // Wrap all nodes in a root flex-column container
     let mut child_ids = Vec::new();
     for node in styled_nodes {
         let id = builder.build_node(node, content_width);
-        child_ids.push(id);
+        match node {
+            StyledNode::Element { style, .. } if style.position == style::Position::Absolute => {
+                builder.out_of_flow.push(id)
+            }
+            _ => child_ids.push(id),
+        }
     }
+    builder.collapse_sibling_margins(&child_ids);
+    // Absolute boxes without a positioned ancestor sit on the content area.
+    child_ids.append(&mut builder.out_of_flow);
 
     let root_style = Style {
         display: taffy::Display::Flex,
@@ -618,19 +1413,18 @@ pub fn compute_layout(
         .new_with_children(root_style, &child_ids)
         .unwrap();
 
-    builder
-        .taffy
-        .compute_layout(
-            root,
-            Size {
-                width: AvailableSpace::Definite(content_width),
-                height: AvailableSpace::MaxContent,
-            },
-        )
-        .unwrap();
+    let available = Size {
+        width: AvailableSpace::Definite(content_width),
+        height: AvailableSpace::MaxContent,
+    };
+    builder.taffy.compute_layout(root, available).unwrap();
+    // Cells spanning rows take their height from the rows laid out.
+    if builder.stretch_row_spans() {
+        builder.taffy.compute_layout(root, available).unwrap();
+    }
 
     // Extract positioned boxes
-    let root_box = builder.extract(root, page_margin, 0.0);
+    let root_box = builder.extract(root, margin_left, 0.0);
     root_box.children
 }
 
@@ -663,4 +1457,44 @@ mod tests {
         let boxes = compute_layout(&styled, 595.0, 40.0, &fonts);
         assert!(!boxes.is_empty());
     }
+
+    #[test]
+    fn adjacent_margins_collapse_to_the_larger_one() {
+        let html = r#"<p style="margin-bottom: 20px">A</p>
+            <div style="margin-top: 15px; margin-bottom: 15px"></div>
+            <p style="margin-top: 30px">B</p>"#;
+        let styled = build_styled_tree(&parse_html(html), None);
+        let boxes = compute_layout(&styled, 595.0, 40.0, &FontManager::default());
+        let (first, last) = (&boxes[0], boxes.last().unwrap());
+        // The empty block's margins collapse through it as well.
+        let gap = last.y - (first.y + first.height);
+        assert!((gap - 30.0).abs() < 0.01, "gap between paragraphs: {gap}");
+    }
+
+    #[test]
+    fn first_child_margin_collapses_into_its_parent() {
+        let html = r#"<div style="margin-top: 10px"><p style="margin-top: 25px">Inner</p></div>
+            <div style="margin-top: 10px; padding-top: 5px"><p style="margin-top: 25px">Padded</p></div>"#;
+        let styled = build_styled_tree(&parse_html(html), None);
+        let boxes = compute_layout(&styled, 595.0, 40.0, &FontManager::default());
+        let (parent, child) = (&boxes[0], &boxes[0].children[0]);
+        assert!((parent.y - 25.0).abs() < 0.01, "parent at {}", parent.y);
+        assert!((child.y - parent.y).abs() < 0.01, "child at {}", child.y);
+        // Padding keeps the margins apart.
+        let (padded, inner) = (&boxes[1], &boxes[1].children[0]);
+        let offset = inner.y - padded.y;
+        assert!((offset - 30.0).abs() < 0.01, "child offset {offset}");
+    }
+
+    #[test]
+    fn balance_columns_splits_at_equal_heights() {
+        let lines: Vec<(f32, f32)> = (0..6)
+            .map(|i| (i as f32 * 10.0, (i + 1) as f32 * 10.0))
+            .collect();
+        assert_eq!(balance_columns(&lines, 2), vec![0, 3]);
+        assert_eq!(balance_columns(&lines, 3), vec![0, 2, 4]);
+        // An item too tall for the ideal height pushes the height up.
+        let uneven = [(0.0, 50.0), (50.0, 60.0), (60.0, 70.0)];
+        assert_eq!(balance_columns(&uneven, 2), vec![0, 1]);
+    }
 }
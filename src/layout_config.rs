@@ -16,6 +16,295 @@ pub struct LayoutConfig {
     pub page_height_pt: f32,
     /// Ordered list of pages.
     pub pages: Vec<PageLayout>,
+    /// Embed font programs for the standard-14 base fonts instead of
+    /// referencing them by name only.
+    #[serde(default)]
+    pub embed_base_fonts: bool,
+    /// Colour rendering intent applied to every page (`ri` operator);
+    /// `None` leaves the viewer default (relative colorimetric).
+    #[serde(default)]
+    pub rendering_intent: Option<RenderingIntent>,
+    /// Caller-supplied XMP packet embedded verbatim as the catalog's
+    /// `/Metadata` stream.
+    #[serde(default)]
+    pub xmp: Option<String>,
+    /// Omit the Info dictionary and any XMP metadata and write an all-zero
+    /// document ID, so the file carries nothing about when or how it was made.
+    #[serde(default)]
+    pub strip_metadata: bool,
+    /// Merge identical objects and drop unreferenced ones after rendering.
+    #[serde(default)]
+    pub optimize: bool,
+    /// FlateDecode-compress embedded font programs; `false` stores them
+    /// uncompressed for consumers that cannot decode compressed fonts.
+    #[serde(default = "LayoutConfig::default_font_compression")]
+    pub font_compression: bool,
+    /// Image drawn across every page beneath all content.
+    #[serde(default)]
+    pub page_background: Option<PageBackground>,
+    /// Concatenate each page's content streams into one, for consumers that
+    /// cannot handle a `/Contents` array.
+    #[serde(default)]
+    pub single_content_stream: bool,
+    /// Expected size of the finished file in bytes; the buffer the
+    /// post-processed PDF is written into starts with this capacity.
+    /// `0` lets it grow from empty.
+    #[serde(default)]
+    pub output_size_hint: usize,
+    /// Thinnest stroke drawn, in points: thinner borders, outlines and
+    /// underlines are widened to it.  `0` draws them as laid out.
+    #[serde(default)]
+    pub min_line_width: f32,
+    /// Largest image (width × height, as its header claims) that is decoded;
+    /// bigger ones are skipped with a diagnostic.  `None` means no limit.
+    #[serde(default)]
+    pub max_image_pixels: Option<u64>,
+    /// A page of another PDF drawn on every page, beneath or over the content.
+    #[serde(default)]
+    pub overlay_pdf: Option<PdfOverlay>,
+    /// `/UserUnit` of every page: the page boxes are written in units of
+    /// this many points, so pages can exceed the 14 400-unit limit.
+    #[serde(default)]
+    pub user_unit: Option<f32>,
+    /// Pack objects into object streams indexed by a cross-reference stream
+    /// (PDF 1.5) instead of writing a classic `xref` table.
+    #[serde(default)]
+    pub object_streams: bool,
+    /// Info `/Producer` in place of the one printpdf writes.
+    #[serde(default)]
+    pub producer: Option<String>,
+    /// Info `/Creator` in place of the one printpdf writes.
+    #[serde(default)]
+    pub creator: Option<String>,
+    /// Points per layout unit when the document was laid out at a fixed
+    /// viewport width: boxes are in CSS pixels and drawn scaled by this
+    /// factor, while the page size stays in points.  `None` means 1.
+    #[serde(default)]
+    pub viewport_scale: Option<f32>,
+    /// Make bare URLs in the text clickable link annotations.
+    #[serde(default)]
+    pub auto_link: bool,
+    /// Border and highlight of the link annotations.
+    #[serde(default)]
+    pub link_style: LinkStyle,
+    /// Panel the viewer shows when the file is opened (catalog `/PageMode`).
+    #[serde(default)]
+    pub page_mode: PageMode,
+    /// Draw text as filled glyph outlines instead of text operators, so the
+    /// file references no fonts (and its text cannot be selected).
+    #[serde(default)]
+    pub text_as_outlines: bool,
+    /// Tag images that carry an ICC profile with it (`/ICCBased`) instead of
+    /// `/DeviceRGB` / `/DeviceGray`.
+    #[serde(default)]
+    pub image_color_management: bool,
+    /// Write a named destination for every element `id` (catalog `/Dests`).
+    #[serde(default)]
+    pub named_destinations: bool,
+    /// Paint every colour and image in `/DeviceGray`.
+    #[serde(default)]
+    pub grayscale: bool,
+    /// Files embedded in the PDF and associated with a page (its `/AF`).
+    #[serde(default)]
+    pub page_attachments: Vec<PageAttachment>,
+}
+
+/// A page background image (branded stationery, a paper texture).
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PageBackground {
+    /// Base64 data URI of the image, as for `<img>`.
+    pub src: String,
+    pub mode: BackgroundMode,
+}
+
+/// A page of an existing PDF (pre-printed letterhead) drawn on every page,
+/// where it sits on its own page and unscaled.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PdfOverlay {
+    /// Base64 data URI of the source PDF.
+    pub src: String,
+    /// 1-based page of the source to draw.
+    pub page: usize,
+    /// Draw beneath the content instead of over it.
+    pub behind: bool,
+}
+
+/// A file embedded in the PDF as an associated file of one page, such as
+/// the source data of a chart on that page.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PageAttachment {
+    /// 1-based page the file belongs to.
+    pub page: usize,
+    /// File name shown by viewers.
+    pub name: String,
+    pub data: Vec<u8>,
+    pub relationship: AfRelationship,
+}
+
+/// How an associated file relates to the content it is attached to
+/// (`/AFRelationship`).
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AfRelationship {
+    /// The original the content was made from.
+    Source,
+    /// Data the content shows, such as a chart's table.
+    Data,
+    /// Another representation of the content.
+    Alternative,
+    /// Additional material, not needed to understand the content.
+    Supplement,
+    #[default]
+    Unspecified,
+}
+
+impl AfRelationship {
+    /// The PDF name for this relationship.
+    pub fn pdf_name(self) -> &'static str {
+        match self {
+            AfRelationship::Source => "Source",
+            AfRelationship::Data => "Data",
+            AfRelationship::Alternative => "Alternative",
+            AfRelationship::Supplement => "Supplement",
+            AfRelationship::Unspecified => "Unspecified",
+        }
+    }
+}
+
+/// Appearance of a link annotation (`/Border`, `/BS`, `/C` and `/H`).  The
+/// default draws no border and inverts the link area while it is clicked.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct LinkStyle {
+    /// Border width in points; `0` draws no border.
+    pub border_width: f32,
+    /// Border colour (RGB, `0.0..=1.0`).
+    pub border_color: [f32; 3],
+    pub border_style: LinkBorderStyle,
+    pub highlight: LinkHighlight,
+}
+
+impl Default for LinkStyle {
+    fn default() -> Self {
+        Self {
+            border_width: 0.0,
+            border_color: [0.0, 0.0, 0.0],
+            border_style: LinkBorderStyle::Solid,
+            highlight: LinkHighlight::Invert,
+        }
+    }
+}
+
+/// Line style of a link border (`/BS /S`).
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum LinkBorderStyle {
+    #[default]
+    Solid,
+    /// 3 pt dashes with 3 pt gaps.
+    Dashed,
+    /// A single line along the bottom of the link.
+    Underline,
+}
+
+impl LinkBorderStyle {
+    /// The PDF name for this style.
+    pub fn pdf_name(self) -> &'static str {
+        match self {
+            LinkBorderStyle::Solid => "S",
+            LinkBorderStyle::Dashed => "D",
+            LinkBorderStyle::Underline => "U",
+        }
+    }
+}
+
+/// What a viewer does to a link while it is clicked (`/H`).
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum LinkHighlight {
+    /// No visual change.
+    None,
+    /// Invert the colours of the link area (the PDF default).
+    #[default]
+    Invert,
+    /// Invert the link's border.
+    Outline,
+    /// Draw the link as if pushed below the page.
+    Push,
+}
+
+impl LinkHighlight {
+    /// The PDF name for this mode.
+    pub fn pdf_name(self) -> &'static str {
+        match self {
+            LinkHighlight::None => "N",
+            LinkHighlight::Invert => "I",
+            LinkHighlight::Outline => "O",
+            LinkHighlight::Push => "P",
+        }
+    }
+}
+
+/// How a viewer opens the document (catalog `/PageMode`).
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum PageMode {
+    /// No side panel (the PDF default; not written).
+    #[default]
+    UseNone,
+    /// Show the bookmarks panel.
+    UseOutlines,
+    /// Show the page thumbnails.
+    UseThumbs,
+    /// Full-screen, with no menu bar or window controls.
+    FullScreen,
+}
+
+impl PageMode {
+    /// The PDF name for this mode.
+    pub fn pdf_name(self) -> &'static str {
+        match self {
+            PageMode::UseNone => "UseNone",
+            PageMode::UseOutlines => "UseOutlines",
+            PageMode::UseThumbs => "UseThumbs",
+            PageMode::FullScreen => "FullScreen",
+        }
+    }
+}
+
+/// How a [`PageBackground`] is fitted to the page.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum BackgroundMode {
+    /// Scale to cover the whole page, centred; the overflow is cropped.
+    #[default]
+    Cover,
+    /// Scale to fit inside the page, centred.
+    Contain,
+    /// Repeat at the image's own size (1 px = 1 pt) from the top-left corner.
+    Tile,
+}
+
+/// PDF colour rendering intent.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum RenderingIntent {
+    Perceptual,
+    RelativeColorimetric,
+    Saturation,
+    AbsoluteColorimetric,
+}
+
+impl RenderingIntent {
+    /// The PDF name for this intent.
+    pub fn pdf_name(self) -> &'static str {
+        match self {
+            RenderingIntent::Perceptual => "Perceptual",
+            RenderingIntent::RelativeColorimetric => "RelativeColorimetric",
+            RenderingIntent::Saturation => "Saturation",
+            RenderingIntent::AbsoluteColorimetric => "AbsoluteColorimetric",
+        }
+    }
 }
 
 /// One page of content.
@@ -34,6 +323,10 @@ pub struct LayoutBox {
     pub width: f32,
     pub height: f32,
 
+    /// `id` attribute of the element that generated the box.
+    #[serde(default)]
+    pub id: Option<String>,
+
     /// Visual styling
     pub background_color: Option<[f32; 4]>,
     pub border: Option<BorderStyle>,
@@ -42,17 +335,299 @@ pub struct LayoutBox {
     pub text: Option<TextContent>,
     pub image: Option<ImageContent>,
 
+    /// CSS `transform` matrix `[a, b, c, d, e, f]` in layout coordinates
+    /// (y down), applied about the box centre to the box and its children.
+    #[serde(default)]
+    pub transform: Option<[f32; 6]>,
+
+    /// Outer `box-shadow` layers, painted beneath the box, first on top.
+    #[serde(default)]
+    pub box_shadow: Vec<Shadow>,
+
+    /// CSS gradient background, painted over `background_color`.
+    #[serde(default)]
+    pub background_gradient: Option<Gradient>,
+
+    /// CSS `background-image: url(…)`, painted over `background_color`.
+    #[serde(default)]
+    pub background_image: Option<BackgroundImage>,
+
+    /// `border-radius` of every corner: the box, its border and its
+    /// children are clipped to the rounded outline.
+    #[serde(default)]
+    pub border_radius: Option<Radius>,
+
+    /// CSS `clip-path`: the box, its shadows and its children are clipped to
+    /// this shape.
+    #[serde(default)]
+    pub clip_path: Option<ClipPath>,
+
     /// Children (nested boxes)
     pub children: Vec<LayoutBox>,
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
 pub struct BorderStyle {
     pub width: f32,
     pub color: [f32; 4],
+    /// Dash pattern of a box border.
+    #[serde(default)]
+    pub style: LineStyle,
+    /// Edges of the box the border is drawn along.
+    #[serde(default)]
+    pub sides: BorderSides,
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+/// CSS `border-style` of a drawn border.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum LineStyle {
+    #[default]
+    Solid,
+    Dashed,
+    Dotted,
+}
+
+/// The edges of a box that carry its border.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct BorderSides {
+    pub top: bool,
+    pub right: bool,
+    pub bottom: bool,
+    pub left: bool,
+}
+
+impl BorderSides {
+    pub const ALL: Self = Self {
+        top: true,
+        right: true,
+        bottom: true,
+        left: true,
+    };
+    pub const NONE: Self = Self {
+        top: false,
+        right: false,
+        bottom: false,
+        left: false,
+    };
+
+    pub const TOP: Self = Self {
+        top: true,
+        ..Self::NONE
+    };
+    pub const RIGHT: Self = Self {
+        right: true,
+        ..Self::NONE
+    };
+    pub const BOTTOM: Self = Self {
+        bottom: true,
+        ..Self::NONE
+    };
+    pub const LEFT: Self = Self {
+        left: true,
+        ..Self::NONE
+    };
+
+    pub fn is_all(self) -> bool {
+        self == Self::ALL
+    }
+
+    /// The edges in either set.
+    pub fn union(self, other: Self) -> Self {
+        Self {
+            top: self.top || other.top,
+            right: self.right || other.right,
+            bottom: self.bottom || other.bottom,
+            left: self.left || other.left,
+        }
+    }
+
+    /// The edges in `self` but not in `other`.
+    pub fn without(self, other: Self) -> Self {
+        Self {
+            top: self.top && !other.top,
+            right: self.right && !other.right,
+            bottom: self.bottom && !other.bottom,
+            left: self.left && !other.left,
+        }
+    }
+}
+
+impl Default for BorderSides {
+    fn default() -> Self {
+        Self::ALL
+    }
+}
+
+/// One `box-shadow` / `text-shadow` layer, in points.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+pub struct Shadow {
+    pub offset_x: f32,
+    /// Positive moves the shadow down.
+    pub offset_y: f32,
+    pub blur: f32,
+    /// Grows (or, negative, shrinks) the shadow; always `0` for text.
+    pub spread: f32,
+    pub color: [f32; 4],
+}
+
+/// A `linear-gradient()` / `radial-gradient()` background.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Gradient {
+    pub shape: GradientShape,
+    /// At least two stops, offsets ascending from `0.0` to `1.0`.  Alpha is
+    /// ignored.
+    pub stops: Vec<GradientStop>,
+}
+
+/// Geometry of a [`Gradient`].
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum GradientShape {
+    /// Along `angle` degrees, clockwise from "to top" (`180` is top to
+    /// bottom).
+    Linear { angle: f32 },
+    /// Toward the corner whose directions are given by the signs of `x`
+    /// (right positive) and `y` (down positive); the angle depends on the
+    /// box's aspect ratio.
+    LinearToCorner { x: f32, y: f32 },
+    /// Centred on the box and reaching its corners; a circle or an ellipse
+    /// with the box's proportions.
+    Radial { circle: bool },
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+pub struct GradientStop {
+    /// Position along the gradient line, `0.0..=1.0`.
+    pub offset: f32,
+    pub color: [f32; 4],
+}
+
+/// A `background-image: url(…)`, sized, positioned and repeated within the
+/// box it belongs to.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct BackgroundImage {
+    /// Base64 data URI of the image, as for `<img>`.
+    pub src: String,
+    pub size: BackgroundSize,
+    /// `background-position` along x and y.  A percentage puts that point
+    /// of the image on the same point of the box, so `50%` centres it.
+    pub position: [BackgroundLength; 2],
+    pub repeat: BackgroundRepeat,
+}
+
+/// CSS `background-size`.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum BackgroundSize {
+    /// The image's own size (1 px = 1 pt).
+    #[default]
+    Auto,
+    /// Scale to cover the whole box, keeping the aspect ratio.
+    Cover,
+    /// Scale to fit inside the box, keeping the aspect ratio.
+    Contain,
+    /// A width and height, percentages of the box; a missing one follows
+    /// from the other and the aspect ratio.
+    Explicit {
+        width: Option<BackgroundLength>,
+        height: Option<BackgroundLength>,
+    },
+}
+
+impl BackgroundSize {
+    /// The drawn size of a `px_w` × `px_h` image in a `box_w` × `box_h` box.
+    pub fn resolve(self, px_w: f32, px_h: f32, box_w: f32, box_h: f32) -> (f32, f32) {
+        let (sx, sy) = (box_w / px_w, box_h / px_h);
+        match self {
+            BackgroundSize::Auto => (px_w, px_h),
+            BackgroundSize::Cover => (px_w * sx.max(sy), px_h * sx.max(sy)),
+            BackgroundSize::Contain => (px_w * sx.min(sy), px_h * sx.min(sy)),
+            BackgroundSize::Explicit { width, height } => {
+                let width = width.map(|w| w.resolve(box_w));
+                let height = height.map(|h| h.resolve(box_h));
+                match (width, height) {
+                    (Some(w), Some(h)) => (w, h),
+                    (Some(w), None) => (w, px_h * w / px_w),
+                    (None, Some(h)) => (px_w * h / px_h, h),
+                    (None, None) => (px_w, px_h),
+                }
+            }
+        }
+    }
+}
+
+/// A background size or position along one axis.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum BackgroundLength {
+    /// In points.
+    Length(f32),
+    /// Percentage of a reference length that depends on the property.
+    Percent(f32),
+}
+
+impl BackgroundLength {
+    /// The length in points, given the length a percentage refers to.
+    pub fn resolve(self, reference: f32) -> f32 {
+        match self {
+            BackgroundLength::Length(v) => v,
+            BackgroundLength::Percent(p) => reference * p / 100.0,
+        }
+    }
+}
+
+/// CSS `background-repeat`.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum BackgroundRepeat {
+    /// Tile in both directions.
+    #[default]
+    Repeat,
+    RepeatX,
+    RepeatY,
+    NoRepeat,
+}
+
+/// A corner or circle radius.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Radius {
+    /// In points.
+    Length(f32),
+    /// Percentage of a reference length that depends on the property.
+    Percent(f32),
+}
+
+impl Radius {
+    /// The radius in points, given the length a percentage refers to.
+    pub fn resolve(self, reference: f32) -> f32 {
+        match self {
+            Radius::Length(v) => v,
+            Radius::Percent(p) => reference * p / 100.0,
+        }
+    }
+}
+
+/// A CSS `clip-path` basic shape, relative to the border box.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ClipPath {
+    /// `inset(top right bottom left round r)`: the box shrunk by the given
+    /// points, with corners rounded as by `border-radius: r`.
+    Inset {
+        top: f32,
+        right: f32,
+        bottom: f32,
+        left: f32,
+        round: Option<Radius>,
+    },
+    /// `circle(r)` centred on the box.  Percentages refer to
+    /// √((w² + h²) / 2); `None` is `closest-side`.
+    Circle { radius: Option<Radius> },
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
 pub struct TextContent {
     /// Pre-wrapped lines of text.
     pub lines: Vec<TextLine>,
@@ -66,6 +641,58 @@ pub struct TextContent {
     pub underline: bool,
     /// List bullet/number prefix (e.g. "• " or "1. ")
     pub list_marker: Option<String>,
+    /// Image source drawn in place of `list_marker` (CSS
+    /// `list-style-image`); the marker is kept for when it cannot be loaded.
+    #[serde(default)]
+    pub list_marker_image: Option<String>,
+    /// How glyphs are painted (PDF text rendering mode, `Tr`).
+    #[serde(default)]
+    pub render_mode: TextRenderMode,
+    /// Glyph outline for the stroking render modes.
+    #[serde(default)]
+    pub stroke: Option<BorderStyle>,
+    /// Line direction.  In the vertical modes each [`TextLine`] is a column
+    /// of upright glyphs whose `x_offset` places it within the box.
+    #[serde(default)]
+    pub writing_mode: WritingMode,
+    /// `text-shadow` layers, painted beneath the glyphs, first on top.
+    #[serde(default)]
+    pub shadow: Vec<Shadow>,
+}
+
+/// CSS `writing-mode`.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum WritingMode {
+    /// Horizontal lines stacked top to bottom.
+    #[default]
+    HorizontalTb,
+    /// Vertical columns stacked right to left (CJK).
+    VerticalRl,
+    /// Vertical columns stacked left to right.
+    VerticalLr,
+}
+
+impl WritingMode {
+    pub fn is_vertical(self) -> bool {
+        self != WritingMode::HorizontalTb
+    }
+}
+
+/// PDF text rendering mode.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum TextRenderMode {
+    /// Filled glyphs (`0 Tr`).
+    #[default]
+    Fill,
+    /// Outlined glyphs (`1 Tr`).
+    Stroke,
+    /// Filled and outlined glyphs (`2 Tr`).
+    FillStroke,
+    /// Unpainted but still selectable / extractable text (`3 Tr`), e.g. an
+    /// OCR layer over a scanned image.
+    Invisible,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -82,6 +709,76 @@ pub struct ImageContent {
     pub src: String,
     pub width: f32,
     pub height: f32,
+    /// CSS `filter` functions, applied in order to the pixels when the image
+    /// is embedded.
+    #[serde(default)]
+    pub filter: Vec<ImageFilter>,
+}
+
+/// One CSS `filter` function, with its amount as a factor (`50%` is `0.5`).
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ImageFilter {
+    Grayscale(f32),
+    Brightness(f32),
+    Contrast(f32),
+    Opacity(f32),
+}
+
+impl ImageFilter {
+    /// Apply the filter to one pixel, with channels from 0 to 1.
+    pub fn apply(self, rgb: &mut [f32; 3], alpha: &mut f32) {
+        match self {
+            ImageFilter::Grayscale(amount) => {
+                // The matrix of the Filter Effects spec, with Rec. 709 weights.
+                let keep = 1.0 - amount.clamp(0.0, 1.0);
+                let [r, g, b] = *rgb;
+                let luma = 0.2126 * r + 0.7152 * g + 0.0722 * b;
+                *rgb = [
+                    luma + keep * (r - luma),
+                    luma + keep * (g - luma),
+                    luma + keep * (b - luma),
+                ];
+            }
+            ImageFilter::Brightness(amount) => rgb.iter_mut().for_each(|c| *c *= amount),
+            ImageFilter::Contrast(amount) => {
+                rgb.iter_mut().for_each(|c| *c = (*c - 0.5) * amount + 0.5)
+            }
+            ImageFilter::Opacity(amount) => *alpha *= amount.clamp(0.0, 1.0),
+        }
+        rgb.iter_mut().for_each(|c| *c = c.clamp(0.0, 1.0));
+    }
+}
+
+/// One box of the laid-out tree returned by `pipeline::layout_tree`, before
+/// pagination.  `x` is measured from the left page edge and `y` from the top
+/// of the content area, as if the document were one endless page.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LayoutNode {
+    /// Tag of the element that generated the box; `None` for anonymous boxes
+    /// such as text runs between blocks.
+    pub tag: Option<String>,
+    pub id: Option<String>,
+    #[serde(default)]
+    pub classes: Vec<String>,
+    pub x: f32,
+    pub y: f32,
+    pub width: f32,
+    pub height: f32,
+    /// Wrapped lines of a text box.
+    #[serde(default)]
+    pub lines: Vec<String>,
+    pub children: Vec<LayoutNode>,
+}
+
+impl LayoutNode {
+    /// This box or the first descendant generated by the element with `id`.
+    pub fn find(&self, id: &str) -> Option<&LayoutNode> {
+        if self.id.as_deref() == Some(id) {
+            return Some(self);
+        }
+        self.children.iter().find_map(|c| c.find(id))
+    }
 }
 
 impl LayoutConfig {
@@ -93,6 +790,31 @@ impl LayoutConfig {
             page_width_pt: 595.28,
             page_height_pt: 841.89,
             pages: Vec::new(),
+            embed_base_fonts: false,
+            rendering_intent: None,
+            xmp: None,
+            strip_metadata: false,
+            optimize: false,
+            font_compression: true,
+            page_background: None,
+            single_content_stream: false,
+            output_size_hint: 0,
+            min_line_width: 0.0,
+            max_image_pixels: None,
+            overlay_pdf: None,
+            user_unit: None,
+            object_streams: false,
+            producer: None,
+            creator: None,
+            viewport_scale: None,
+            auto_link: false,
+            link_style: LinkStyle::default(),
+            page_mode: PageMode::UseNone,
+            text_as_outlines: false,
+            image_color_management: false,
+            named_destinations: false,
+            grayscale: false,
+            page_attachments: Vec::new(),
         }
     }
 
@@ -100,6 +822,10 @@ impl LayoutConfig {
         "rpdf output".to_string()
     }
 
+    fn default_font_compression() -> bool {
+        true
+    }
+
     /// Serialise to JSON.
     pub fn to_json(&self) -> String {
         serde_json::to_string_pretty(self).unwrap_or_default()
@@ -111,6 +837,38 @@ impl LayoutConfig {
     }
 }
 
+impl PageBackground {
+    /// A background from raw image bytes, stored as a data URI.
+    pub fn from_bytes(image: &[u8], mode: BackgroundMode) -> Self {
+        use base64::{engine::general_purpose::STANDARD as BASE64_STD, Engine as _};
+
+        let mime = if image.starts_with(b"\x89PNG") {
+            "image/png"
+        } else if image.starts_with(&[0xFF, 0xD8]) {
+            "image/jpeg"
+        } else {
+            "application/octet-stream"
+        };
+        Self {
+            src: format!("data:{mime};base64,{}", BASE64_STD.encode(image)),
+            mode,
+        }
+    }
+}
+
+impl PdfOverlay {
+    /// An overlay of page `page` (1-based) of `pdf`, stored as a data URI.
+    pub fn from_bytes(pdf: &[u8], page: usize, behind: bool) -> Self {
+        use base64::{engine::general_purpose::STANDARD as BASE64_STD, Engine as _};
+
+        Self {
+            src: format!("data:application/pdf;base64,{}", BASE64_STD.encode(pdf)),
+            page,
+            behind,
+        }
+    }
+}
+
 impl LayoutBox {
     pub fn new(x: f32, y: f32, width: f32, height: f32) -> Self {
         Self {
@@ -118,10 +876,17 @@ impl LayoutBox {
             y,
             width,
             height,
+            id: None,
             background_color: None,
             border: None,
             text: None,
             image: None,
+            transform: None,
+            box_shadow: Vec::new(),
+            background_gradient: None,
+            background_image: None,
+            border_radius: None,
+            clip_path: None,
             children: Vec::new(),
         }
     }
@@ -4,23 +4,42 @@
 //! templates into reproducible PDF documents. The pipeline stages are:
 //!
 //! 1. **Parse** – HTML string → DOM tree ([`dom`])
-//! 2. **Style** – apply inline styles and Tailwind-like classes ([`style`])
+//! 2. **Style** – apply stylesheets ([`css`]), inline styles and Tailwind-like
+//!    classes ([`style`])
 //! 3. **Layout** – compute flexbox/grid layout with Taffy ([`layout`])
 //! 4. **Paginate** – split into A4 pages ([`pagination`])
 //! 5. **Render** – emit PDF bytes via printpdf ([`render`])
 //!
 //! A C-compatible FFI surface is exposed via the [`ffi`] module.
 
+pub mod attachments;
+pub mod autolink;
+pub mod cache;
+pub mod css;
+pub mod destinations;
+pub mod diagnostics;
 pub mod dom;
+pub mod events;
 pub mod ffi;
 pub mod fonts;
+pub mod inspect;
+pub mod invoice;
 pub mod layout;
 pub mod layout_config;
+pub mod object_streams;
 pub mod pagination;
 pub mod pipeline;
+pub mod recompress;
 pub mod render;
+pub mod repair;
 pub mod style;
+pub mod svg;
 pub mod templates;
+#[cfg(test)]
+mod test_pdf;
+pub mod xmp;
 
 // Re-exports for convenience
-pub use pipeline::{generate_pdf, generate_pdf_from_html, PageOrientation};
+pub use pipeline::{
+    generate, generate_pdf, generate_pdf_from_html, GeneratedPdf, Length, PageOrientation, PageSize,
+};
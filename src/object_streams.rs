@@ -0,0 +1,234 @@
+//! Object streams – repacks a finished PDF so its small objects are
+//! compressed together in `/ObjStm` streams and indexed by a
+//! cross-reference stream instead of a classic `xref` table (PDF 1.5).
+//!
+//! [`pack`] works on a file with one classic xref table, as lopdf writes
+//! it: every object is located through the table and its bytes are reused
+//! as written.  Stream objects, which cannot live in an object stream, are
+//! copied whole; everything else goes into object streams.  Readers older
+//! than PDF 1.5 cannot open the result.
+
+use std::collections::HashSet;
+
+use lopdf::{dictionary, Document, ObjectId, Stream};
+
+use crate::repair::{dictionary_at, digits, find, object_header, rfind, skip_whitespace};
+
+/// Most objects packed into one object stream.
+const OBJECTS_PER_STREAM: usize = 100;
+
+/// How one object is reached in the rewritten file.
+#[derive(Clone, Copy)]
+enum Entry {
+    Free,
+    /// Written directly, at this offset.
+    Direct {
+        offset: usize,
+        generation: u16,
+    },
+    /// Packed into object stream `stream` at position `index`.
+    Packed {
+        stream: u32,
+        index: usize,
+    },
+}
+
+/// Rewrite `pdf` with object streams and a cross-reference stream.
+/// `streams` lists the stream objects (they are written directly).
+pub fn pack(pdf: &[u8], streams: &HashSet<ObjectId>) -> Result<Vec<u8>, String> {
+    let startxref =
+        rfind(pdf, b"startxref").ok_or_else(|| "Object streams: no startxref".to_string())?;
+    let (xref_offset, _) = digits(pdf, skip_whitespace(pdf, startxref + b"startxref".len()))
+        .ok_or_else(|| "Object streams: unreadable startxref".to_string())?;
+    let xref_offset = xref_offset as usize;
+    if !pdf
+        .get(xref_offset..)
+        .is_some_and(|t| t.starts_with(b"xref"))
+    {
+        return Err("Object streams: input has no classic xref table".to_string());
+    }
+    let trailer_at = find(pdf, b"trailer", xref_offset)
+        .ok_or_else(|| "Object streams: no trailer".to_string())?;
+    let trailer = dictionary_at(pdf, trailer_at)
+        .ok_or_else(|| "Object streams: unreadable trailer".to_string())?;
+    let mut objects = xref_entries(&pdf[xref_offset + b"xref".len()..trailer_at])?;
+    objects.sort_by_key(|&(_, _, offset)| offset);
+
+    let first_offset = objects
+        .first()
+        .map_or(xref_offset, |&(_, _, offset)| offset);
+    let mut out = pdf[..first_offset].to_vec();
+    let size = objects.iter().map(|&(n, _, _)| n + 1).max().unwrap_or(1);
+    let mut entries = vec![Entry::Free; size as usize];
+    let mut packed: Vec<(u32, &[u8])> = Vec::new();
+
+    for (i, &(number, generation, offset)) in objects.iter().enumerate() {
+        let end = objects.get(i + 1).map_or(xref_offset, |&(_, _, next)| next);
+        let object = &pdf[offset..end];
+        let close = rfind(object, b"endobj")
+            .ok_or_else(|| format!("Object streams: object {number} has no endobj"))?;
+        if generation != 0 || streams.contains(&(number, generation)) {
+            entries[number as usize] = Entry::Direct {
+                offset: out.len(),
+                generation,
+            };
+            out.extend_from_slice(&object[..close + b"endobj".len()]);
+            out.push(b'\n');
+            continue;
+        }
+        let (_, _, body) = object_header(object, 0)
+            .ok_or_else(|| format!("Object streams: object {number} has no header"))?;
+        packed.push((number, object[body..close].trim_ascii()));
+    }
+
+    let mut next_number = size;
+    for chunk in packed.chunks(OBJECTS_PER_STREAM) {
+        let stream_number = next_number;
+        next_number += 1;
+        let mut index_table = String::new();
+        let mut bodies = Vec::new();
+        for (index, &(number, body)) in chunk.iter().enumerate() {
+            index_table.push_str(&format!("{number} {} ", bodies.len()));
+            bodies.extend_from_slice(body);
+            bodies.push(b'\n');
+            entries[number as usize] = Entry::Packed {
+                stream: stream_number,
+                index,
+            };
+        }
+        let first = index_table.len();
+        let mut content = index_table.into_bytes();
+        content.extend_from_slice(&bodies);
+        let dict = format!("/Type /ObjStm /N {} /First {first}", chunk.len());
+        entries.push(Entry::Direct {
+            offset: out.len(),
+            generation: 0,
+        });
+        write_stream(&mut out, stream_number, &dict, content)?;
+    }
+
+    // The cross-reference stream indexes itself as the last object.
+    let xref_number = next_number;
+    entries.push(Entry::Direct {
+        offset: out.len(),
+        generation: 0,
+    });
+    let mut rows = Vec::with_capacity(entries.len() * 7);
+    for entry in &entries {
+        let (kind, field2, field3) = match *entry {
+            Entry::Free => (0u8, 0u32, 0u16),
+            Entry::Direct { offset, generation } => (1, offset as u32, generation),
+            Entry::Packed { stream, index } => (2, stream, index as u16),
+        };
+        rows.push(kind);
+        rows.extend_from_slice(&field2.to_be_bytes());
+        rows.extend_from_slice(&field3.to_be_bytes());
+    }
+    // Object 0 heads the free list with generation 65535.
+    rows[5..7].copy_from_slice(&u16::MAX.to_be_bytes());
+    let dict = format!(
+        "/Type /XRef /Size {} /W [1 4 2] {}",
+        entries.len(),
+        trailer_entries(trailer)
+    );
+    let xref_at = out.len();
+    write_stream(&mut out, xref_number, &dict, rows)?;
+    out.extend_from_slice(format!("startxref\n{xref_at}\n%%EOF\n").as_bytes());
+
+    Document::load_mem(&out)
+        .map_err(|e| format!("Object streams: rewritten file is unreadable: {e}"))?;
+    Ok(out)
+}
+
+/// `(number, generation, offset)` of every in-use entry of a classic xref
+/// table, given the bytes between `xref` and `trailer`.
+fn xref_entries(table: &[u8]) -> Result<Vec<(u32, u16, usize)>, String> {
+    let text = std::str::from_utf8(table).map_err(|_| "Object streams: unreadable xref")?;
+    let mut tokens = text.split_ascii_whitespace();
+    let mut entries = Vec::new();
+    let number = |t: Option<&str>| t.and_then(|t| t.parse::<usize>().ok());
+    while let Some(start) = number(tokens.next()) {
+        let count = number(tokens.next()).ok_or("Object streams: unreadable xref")?;
+        for n in start..start + count {
+            let offset = number(tokens.next());
+            let generation = number(tokens.next());
+            match (offset, generation, tokens.next()) {
+                (Some(offset), Some(generation), Some("n")) => {
+                    entries.push((n as u32, generation as u16, offset))
+                }
+                (Some(_), Some(_), Some("f")) => {}
+                _ => return Err("Object streams: unreadable xref".to_string()),
+            }
+        }
+    }
+    Ok(entries)
+}
+
+/// The entries of the classic trailer dictionary except `/Size`, which the
+/// cross-reference stream sets itself.
+fn trailer_entries(trailer: &[u8]) -> String {
+    let inner = &trailer[2..trailer.len() - 2];
+    let mut text = inner.to_vec();
+    if let Some(at) = find(inner, b"/Size", 0) {
+        let value = skip_whitespace(inner, at + b"/Size".len());
+        let end = digits(inner, value).map_or(value, |(_, end)| end);
+        text.drain(at..end);
+    }
+    String::from_utf8_lossy(&text).trim().to_string()
+}
+
+/// Append `number 0 obj << dict /Length … >> stream … endstream endobj`,
+/// Flate-compressing `content`.
+fn write_stream(
+    out: &mut Vec<u8>,
+    number: u32,
+    dict: &str,
+    content: Vec<u8>,
+) -> Result<(), String> {
+    let mut stream = Stream::new(dictionary! {}, content);
+    stream
+        .compress()
+        .map_err(|e| format!("Object streams: compress: {e}"))?;
+    // Compression is skipped when it would not make the stream smaller.
+    let filter = if stream.dict.has(b"Filter") {
+        " /Filter /FlateDecode"
+    } else {
+        ""
+    };
+    let length = stream.content.len();
+    out.extend_from_slice(
+        format!("{number} 0 obj\n<< {dict}{filter} /Length {length} >>\nstream\n").as_bytes(),
+    );
+    out.extend_from_slice(&stream.content);
+    out.extend_from_slice(b"\nendstream\nendobj\n");
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_pdf::add_pages;
+    use lopdf::{Dictionary, Object};
+
+    #[test]
+    fn packs_dictionaries_and_keeps_streams_direct() {
+        let mut doc = Document::with_version("1.5");
+        let page = add_pages(&mut doc, [(Dictionary::new(), b"BT ET".to_vec())])[0];
+        let content = doc.get_dictionary(page).unwrap().get(b"Contents").unwrap();
+        let content = content.as_reference().unwrap();
+        let catalog = doc.trailer.get(b"Root").and_then(Object::as_reference).unwrap();
+        let mut classic = Vec::new();
+        doc.save_to(&mut classic).unwrap();
+
+        let packed = pack(&classic, &HashSet::from([content])).unwrap();
+        assert!(find(&packed, b"/Type /ObjStm", 0).is_some());
+        assert!(find(&packed, b"/Type /XRef", 0).is_some());
+        assert!(find(&packed, b"\nxref", 0).is_none());
+        // Only the content stream is still a top-level object.
+        assert!(find(&packed, format!("{} 0 obj", content.0).as_bytes(), 0).is_some());
+        assert!(find(&packed, format!("\n{} 0 obj", catalog.0).as_bytes(), 0).is_none());
+
+        let reread = Document::load_mem(&packed).unwrap();
+        assert_eq!(reread.get_pages().len(), 1);
+    }
+}
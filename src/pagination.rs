@@ -3,8 +3,10 @@
 //! Handles:
 //! - A4 page boundaries
 //! - Page-break-before / page-break-after hints
-//! - Table row splitting across pages
-//! - Orphan avoidance for text blocks
+//! - Table row splitting across pages, repeating `<thead>` / `<tfoot>` rows
+//! - Paragraphs breaking between lines, honouring `orphans` / `widows`
+//! - Per-page margins from `@page :first` / `:left` / `:right`
+//! - Optionally dropping a trailing page left without content
 
 use crate::fonts::FontManager;
 use crate::layout::{BoxContent, PositionedBox};
@@ -14,8 +16,88 @@ use crate::style;
 /// Default page margins in points.
 pub const PAGE_MARGIN_PT: f32 = 40.0;
 
+/// The four margins of a page, in points.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Margins {
+    pub top: f32,
+    pub right: f32,
+    pub bottom: f32,
+    pub left: f32,
+}
+
+impl Margins {
+    pub fn uniform(margin: f32) -> Self {
+        Self {
+            top: margin,
+            right: margin,
+            bottom: margin,
+            left: margin,
+        }
+    }
+
+    /// These margins multiplied by `factor`.
+    pub fn scaled(self, factor: f32) -> Self {
+        Self {
+            top: self.top * factor,
+            right: self.right * factor,
+            bottom: self.bottom * factor,
+            left: self.left * factor,
+        }
+    }
+}
+
+/// Margins by page position, as set by `@page` rules.  `base` (plain
+/// `@page`) fixes the content width used for layout; the other entries move
+/// the content and change how much of it fits on their pages.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct PageMargins {
+    pub base: Margins,
+    pub first: Margins,
+    pub left: Margins,
+    pub right: Margins,
+}
+
+impl PageMargins {
+    pub fn uniform(margin: f32) -> Self {
+        let m = Margins::uniform(margin);
+        Self {
+            base: m,
+            first: m,
+            left: m,
+            right: m,
+        }
+    }
+
+    /// Every entry multiplied by `factor`.
+    pub fn scaled(&self, factor: f32) -> Self {
+        Self {
+            base: self.base.scaled(factor),
+            first: self.first.scaled(factor),
+            left: self.left.scaled(factor),
+            right: self.right.scaled(factor),
+        }
+    }
+
+    /// Margins of the page at zero-based `index`.  The first page is a right
+    /// page, so even indices are right pages and odd ones left pages.
+    pub fn for_page(&self, index: usize) -> Margins {
+        match index {
+            0 => self.first,
+            i if i % 2 == 1 => self.left,
+            _ => self.right,
+        }
+    }
+
+    fn content_height(&self, page_height: f32, index: usize) -> f32 {
+        let m = self.for_page(index);
+        page_height - m.top - m.bottom
+    }
+}
+
 /// Recursively expand any pure-container box whose height exceeds a single
-/// page so its children can be split across pages individually.
+/// page so its children can be split across pages individually.  Tables are
+/// kept whole so `split_table_box` can repeat their header and footer rows,
+/// and multi-column boxes because their columns share the same rows.
 fn flatten_for_pagination<'a>(
     boxes: &'a [PositionedBox],
     content_height: f32,
@@ -25,6 +107,8 @@ fn flatten_for_pagination<'a>(
         if pbox.height > content_height
             && matches!(pbox.content, BoxContent::None)
             && !pbox.children.is_empty()
+            && !is_table_like(pbox)
+            && pbox.style.column_count <= 1
         {
             result.extend(flatten_for_pagination(&pbox.children, content_height));
         } else {
@@ -41,18 +125,44 @@ pub fn paginate(
     page_height: f32,
     page_margin: f32,
     fonts: &FontManager,
+) -> LayoutConfig {
+    paginate_with_margins(
+        boxes,
+        page_width,
+        page_height,
+        &PageMargins::uniform(page_margin),
+        false,
+        fonts,
+    )
+}
+
+/// [`paginate`] with margins that depend on the page position.  `boxes` must
+/// have been laid out between `margins.base.left` and `margins.base.right`.
+///
+/// With `trim_trailing_blank`, a last page that holds nothing visible (only
+/// empty boxes that spilled over a full page) is dropped, unless a page
+/// break started it.
+pub fn paginate_with_margins(
+    boxes: &[PositionedBox],
+    page_width: f32,
+    page_height: f32,
+    margins: &PageMargins,
+    trim_trailing_blank: bool,
+    fonts: &FontManager,
 ) -> LayoutConfig {
     let mut config = LayoutConfig {
-        title: "rpdf output".to_string(),
         page_width_pt: page_width,
         page_height_pt: page_height,
-        pages: Vec::new(),
+        ..LayoutConfig::a4()
     };
 
-    let content_height = page_height - 2.0 * page_margin;
+    // Boxes are placed below the base top margin and moved to their page's
+    // own margins once every page is complete.
+    let page_margin = margins.base.top;
+    let base_height = page_height - margins.base.top - margins.base.bottom;
 
     // Expand oversized wrapper divs so their children can paginate individually.
-    let flat = flatten_for_pagination(boxes, content_height);
+    let flat = flatten_for_pagination(boxes, base_height);
 
     let mut current_page = PageLayout {
         page_index: 0,
@@ -64,10 +174,14 @@ pub fn paginate(
     // so `pbox.y - page_start_doc_y` gives the y-on-page for any box.
     let mut page_start_doc_y = 0.0f32;
 
+    // Index of the last page started by an explicit page break.
+    let mut forced_page = None;
+
     for pbox in &flat {
         // Page break before
         if pbox.page_break_before && !current_page.boxes.is_empty() {
             config.pages.push(current_page);
+            forced_page = Some(config.pages.len());
             current_page = PageLayout {
                 page_index: config.pages.len(),
                 boxes: Vec::new(),
@@ -75,19 +189,43 @@ pub fn paginate(
             page_start_doc_y = pbox.y;
         }
 
+        // A paragraph that overflows breaks between lines; the pages it
+        // fills are pushed and the rest is placed like any other box.
+        let remainder;
+        let mut pbox: &PositionedBox = pbox;
+        if is_splittable_text(pbox)
+            && (pbox.y - page_start_doc_y).max(0.0) + pbox.height
+                > margins.content_height(page_height, config.pages.len())
+        {
+            remainder = split_text_box(
+                pbox,
+                &mut config,
+                &mut current_page,
+                &mut page_start_doc_y,
+                page_height,
+                margins,
+                fonts,
+            );
+            pbox = &remainder;
+        }
+
         let y_on_page = (pbox.y - page_start_doc_y).max(0.0);
         let box_bottom = y_on_page + pbox.height;
+        let content_height = margins.content_height(page_height, config.pages.len());
 
         // Does this box overflow the current page?
-        if box_bottom > content_height && !current_page.boxes.is_empty() {
-            if is_table_like(pbox) && !pbox.page_break_inside_avoid {
+        // Tables split between rows even when they start the page, since they
+        // are never flattened.
+        let splittable_table = is_table_like(pbox) && !pbox.page_break_inside_avoid;
+        if box_bottom > content_height && (!current_page.boxes.is_empty() || splittable_table) {
+            if splittable_table {
                 split_table_box(
                     pbox,
                     &mut config,
                     &mut current_page,
                     &mut page_start_doc_y,
-                    content_height,
-                    page_margin,
+                    page_height,
+                    margins,
                     fonts,
                 );
                 continue;
@@ -108,6 +246,7 @@ pub fn paginate(
         // Page break after
         if pbox.page_break_after {
             config.pages.push(current_page);
+            forced_page = Some(config.pages.len());
             current_page = PageLayout {
                 page_index: config.pages.len(),
                 boxes: Vec::new(),
@@ -119,31 +258,272 @@ pub fn paginate(
     if !current_page.boxes.is_empty() {
         config.pages.push(current_page);
     }
+    let last = config.pages.len().wrapping_sub(1);
+    if trim_trailing_blank
+        && config.pages.len() > 1
+        && forced_page != Some(last)
+        && !config.pages[last].boxes.iter().any(has_visible_content)
+    {
+        config.pages.pop();
+    }
     if config.pages.is_empty() {
         config.pages.push(PageLayout {
             page_index: 0,
             boxes: Vec::new(),
         });
     }
+    for (index, page) in config.pages.iter_mut().enumerate() {
+        let m = margins.for_page(index);
+        let (dx, dy) = (m.left - margins.base.left, m.top - margins.base.top);
+        if dx != 0.0 || dy != 0.0 {
+            for lbox in &mut page.boxes {
+                shift_box(lbox, dx, dy);
+            }
+        }
+    }
     config
 }
 
+/// Fixed heights of the header and footer bands.  A band with a height is
+/// reserved inside the page margin, between it and the content, and clips
+/// whatever does not fit; without one the element sits in the margin itself.
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct BandHeights {
+    pub header: Option<f32>,
+    pub footer: Option<f32>,
+}
+
+impl BandHeights {
+    /// These heights multiplied by `factor`.
+    pub fn scaled(self, factor: f32) -> Self {
+        Self {
+            header: self.header.map(|h| h * factor),
+            footer: self.footer.map(|h| h * factor),
+        }
+    }
+}
+
+impl PageMargins {
+    /// These margins grown by the reserved band heights, leaving the area
+    /// the content is paginated into.
+    pub fn reserving(&self, bands: BandHeights) -> Self {
+        let grow = |m: Margins| Margins {
+            top: m.top + bands.header.unwrap_or(0.0),
+            bottom: m.bottom + bands.footer.unwrap_or(0.0),
+            ..m
+        };
+        Self {
+            base: grow(self.base),
+            first: grow(self.first),
+            left: grow(self.left),
+            right: grow(self.right),
+        }
+    }
+}
+
+/// Repeat `header` in the top margin and `footer` in the bottom margin of
+/// every page of `config`, each centred vertically in its margin (or flush
+/// with the margin's top if taller).  Both must have been laid out like the
+/// content, between `margins.base.left` and `margins.base.right`.  A band
+/// with a fixed height in `bands` goes just inside the margin instead and is
+/// clipped to that height.
+pub fn add_margin_boxes(
+    config: &mut LayoutConfig,
+    header: &[PositionedBox],
+    footer: &[PositionedBox],
+    margins: &PageMargins,
+    bands: BandHeights,
+    fonts: &FontManager,
+) {
+    let (page_width, page_height) = (config.page_width_pt, config.page_height_pt);
+    for (index, page) in config.pages.iter_mut().enumerate() {
+        let m = margins.for_page(index);
+        let dx = m.left - margins.base.left;
+        let mut boxes = match bands.header {
+            Some(height) => clipped_band(header, m.top, height, dx, page_width, fonts),
+            None => band_boxes(header, 0.0, m.top, dx, fonts),
+        };
+        boxes.append(&mut page.boxes);
+        boxes.extend(match bands.footer {
+            Some(height) => {
+                let top = page_height - m.bottom - height;
+                clipped_band(footer, top, height, dx, page_width, fonts)
+            }
+            None => band_boxes(footer, page_height - m.bottom, m.bottom, dx, fonts),
+        });
+        page.boxes = boxes;
+    }
+}
+
+/// Like [`band_boxes`], wrapped in a page-wide box that clips them to the
+/// band.
+fn clipped_band(
+    boxes: &[PositionedBox],
+    top: f32,
+    height: f32,
+    dx: f32,
+    page_width: f32,
+    fonts: &FontManager,
+) -> Vec<LayoutBox> {
+    if boxes.is_empty() {
+        return Vec::new();
+    }
+    let mut band = LayoutBox::new(0.0, top, page_width, height);
+    band.clip_path = Some(ClipPath::Inset {
+        top: 0.0,
+        right: 0.0,
+        bottom: 0.0,
+        left: 0.0,
+        round: None,
+    });
+    band.children = band_boxes(boxes, top, height, dx, fonts);
+    vec![band]
+}
+
+/// `boxes` as page boxes centred in the band `height` tall starting at `top`,
+/// moved right by `dx`.
+fn band_boxes(
+    boxes: &[PositionedBox],
+    top: f32,
+    height: f32,
+    dx: f32,
+    fonts: &FontManager,
+) -> Vec<LayoutBox> {
+    let start = boxes.iter().map(|b| b.y).fold(f32::INFINITY, f32::min);
+    let end = boxes.iter().map(|b| b.y + b.height).fold(0.0, f32::max);
+    let offset = top + ((height - (end - start)) / 2.0).max(0.0);
+    boxes
+        .iter()
+        .map(|pbox| {
+            let mut lbox = positioned_to_layout_box(pbox, offset, pbox.y - start, fonts);
+            shift_box(&mut lbox, dx, 0.0);
+            lbox
+        })
+        .collect()
+}
+
+/// Whether drawing `lbox` would put any mark on the page.
+fn has_visible_content(lbox: &LayoutBox) -> bool {
+    let text = lbox
+        .text
+        .as_ref()
+        .is_some_and(|t| t.lines.iter().any(|l| !l.text.trim().is_empty()));
+    text || lbox.image.is_some()
+        || lbox.background_color.is_some_and(|c| c[3] > 0.0)
+        || lbox.border.as_ref().is_some_and(|b| b.width > 0.0)
+        || !lbox.box_shadow.is_empty()
+        || lbox.background_gradient.is_some()
+        || lbox.background_image.is_some()
+        || lbox.children.iter().any(has_visible_content)
+}
+
+/// Move a box and its descendants by `(dx, dy)`.
+fn shift_box(lbox: &mut LayoutBox, dx: f32, dy: f32) {
+    lbox.x += dx;
+    lbox.y += dy;
+    for child in &mut lbox.children {
+        shift_box(child, dx, dy);
+    }
+}
+
 fn is_table_like(pbox: &PositionedBox) -> bool {
     pbox.style.display == style::Display::Grid && !pbox.children.is_empty()
 }
 
+/// Which row group a table row belongs to.
+#[derive(Clone, Copy, PartialEq, Eq)]
+enum RowGroup {
+    Header,
+    Body,
+    Footer,
+}
+
+/// Flatten a table's children into rows, looking through `<thead>`, `<tbody>`
+/// and `<tfoot>` wrappers.  Rows placed directly under `<table>` count as body.
+fn table_rows(table: &PositionedBox) -> Vec<(RowGroup, &PositionedBox)> {
+    let mut rows = Vec::new();
+    for child in &table.children {
+        let group = match child.style.display {
+            style::Display::TableHeaderGroup => RowGroup::Header,
+            style::Display::TableFooterGroup => RowGroup::Footer,
+            style::Display::TableRowGroup => RowGroup::Body,
+            _ => {
+                rows.push((RowGroup::Body, child));
+                continue;
+            }
+        };
+        rows.extend(child.children.iter().map(|row| (group, row)));
+    }
+    rows
+}
+
+/// Total height spanned by a run of consecutive rows.
+fn rows_height(rows: &[&PositionedBox]) -> f32 {
+    match (rows.first(), rows.last()) {
+        (Some(first), Some(last)) => last.y + last.height - first.y,
+        _ => 0.0,
+    }
+}
+
+/// Push copies of `rows` onto `page`, the first one starting at `y_on_page`.
+fn place_rows(
+    page: &mut PageLayout,
+    rows: &[&PositionedBox],
+    y_on_page: f32,
+    page_margin: f32,
+    fonts: &FontManager,
+) {
+    let Some(first) = rows.first() else {
+        return;
+    };
+    for row in rows {
+        let y = y_on_page + (row.y - first.y);
+        page.boxes.push(positioned_to_layout_box(row, page_margin, y, fonts));
+    }
+}
+
+/// Split a table between rows.  Header rows are repeated at the top of every
+/// continuation page and footer rows at the bottom of every page the table
+/// breaks on, with room for the footer reserved before each break.
 fn split_table_box(
     pbox: &PositionedBox,
     config: &mut LayoutConfig,
     current_page: &mut PageLayout,
     page_start_doc_y: &mut f32,
-    content_height: f32,
-    page_margin: f32,
+    page_height: f32,
+    margins: &PageMargins,
     fonts: &FontManager,
 ) {
-    for child in &pbox.children {
-        let y_on_page = (child.y - *page_start_doc_y).max(0.0);
-        if y_on_page + child.height > content_height && !current_page.boxes.is_empty() {
+    let page_margin = margins.base.top;
+    let rows = table_rows(pbox);
+    let header: Vec<&PositionedBox> = rows
+        .iter()
+        .filter(|(group, _)| *group == RowGroup::Header)
+        .map(|(_, row)| *row)
+        .collect();
+    let footer: Vec<&PositionedBox> = rows
+        .iter()
+        .filter(|(group, _)| *group == RowGroup::Footer)
+        .map(|(_, row)| *row)
+        .collect();
+    let header_height = rows_height(&header);
+    let footer_height = rows_height(&footer);
+
+    for (group, row) in rows {
+        let is_body = group == RowGroup::Body;
+        let reserve = if is_body { footer_height } else { 0.0 };
+        let y_on_page = (row.y - *page_start_doc_y).max(0.0);
+        let content_height = margins.content_height(page_height, config.pages.len());
+        // A row starting a `rowspan` goes over with the rows it spans.
+        let extent = row
+            .children
+            .iter()
+            .map(|cell| cell.y + cell.height - row.y)
+            .fold(row.height, f32::max);
+        if y_on_page + extent + reserve > content_height && !current_page.boxes.is_empty() {
+            if is_body {
+                place_rows(current_page, &footer, y_on_page, page_margin, fonts);
+            }
             config.pages.push(std::mem::replace(
                 current_page,
                 PageLayout {
@@ -151,14 +531,106 @@ fn split_table_box(
                     boxes: Vec::new(),
                 },
             ));
-            *page_start_doc_y = child.y;
+            *page_start_doc_y = row.y;
+            // Only repeat the header if it fits with room to spare for a row.
+            let content_height = margins.content_height(page_height, config.pages.len());
+            if is_body && !header.is_empty() && header_height + extent <= content_height {
+                place_rows(current_page, &header, 0.0, page_margin, fonts);
+                *page_start_doc_y = row.y - header_height;
+            }
         }
-        let y = (child.y - *page_start_doc_y).max(0.0);
-        let row_box = positioned_to_layout_box(child, page_margin, y, fonts);
+        let y = (row.y - *page_start_doc_y).max(0.0);
+        let row_box = positioned_to_layout_box(row, page_margin, y, fonts);
         current_page.boxes.push(row_box);
     }
 }
 
+/// A horizontal paragraph of several lines that may break between them.
+fn is_splittable_text(pbox: &PositionedBox) -> bool {
+    matches!(&pbox.content, BoxContent::Text { lines, .. } if lines.len() > 1)
+        && pbox.children.is_empty()
+        && !pbox.page_break_inside_avoid
+        && pbox.style.writing_mode == WritingMode::HorizontalTb
+}
+
+/// Break a paragraph that overflows the current page between lines.  At
+/// least `orphans` lines stay at the bottom of a page and at least `widows`
+/// lines move to the next; if fewer than `orphans` fit, the paragraph starts
+/// on a new page instead.  Filled pages are pushed onto `config`; returns
+/// the part still to be placed.
+fn split_text_box(
+    pbox: &PositionedBox,
+    config: &mut LayoutConfig,
+    current_page: &mut PageLayout,
+    page_start_doc_y: &mut f32,
+    page_height: f32,
+    margins: &PageMargins,
+    fonts: &FontManager,
+) -> PositionedBox {
+    let line_height = fonts.line_height_px(pbox.style.font_size, pbox.style.line_height);
+    let orphans = pbox.style.orphans.max(1) as usize;
+    let widows = pbox.style.widows.max(1) as usize;
+    let mut rest = pbox.clone();
+    loop {
+        let BoxContent::Text { lines, .. } = &rest.content else {
+            return rest;
+        };
+        let y_on_page = (rest.y - *page_start_doc_y).max(0.0);
+        let available = margins.content_height(page_height, config.pages.len()) - y_on_page;
+        if rest.height <= available {
+            return rest;
+        }
+        let fitting = ((available / line_height).floor().max(0.0) as usize).min(lines.len());
+        let fit = fitting.min(lines.len().saturating_sub(widows));
+        if fit < orphans {
+            if current_page.boxes.is_empty() {
+                // Already at the top of a page: place it whole (overflowing).
+                return rest;
+            }
+            config.pages.push(std::mem::replace(
+                current_page,
+                PageLayout {
+                    page_index: config.pages.len() + 1,
+                    boxes: Vec::new(),
+                },
+            ));
+            *page_start_doc_y = rest.y;
+            continue;
+        }
+
+        let head_height = fit as f32 * line_height;
+        let (head_lines, tail_lines) = lines.split_at(fit);
+        let head = PositionedBox {
+            height: head_height,
+            content: BoxContent::Text {
+                text: head_lines.join(" "),
+                lines: head_lines.to_vec(),
+            },
+            page_break_after: false,
+            ..rest.clone()
+        };
+        let tail_content = BoxContent::Text {
+            text: tail_lines.join(" "),
+            lines: tail_lines.to_vec(),
+        };
+        current_page
+            .boxes
+            .push(positioned_to_layout_box(&head, margins.base.top, y_on_page, fonts));
+        config.pages.push(std::mem::replace(
+            current_page,
+            PageLayout {
+                page_index: config.pages.len() + 1,
+                boxes: Vec::new(),
+            },
+        ));
+        rest.y += head_height;
+        rest.height -= head_height;
+        rest.content = tail_content;
+        rest.page_break_before = false;
+        *page_start_doc_y = rest.y;
+    }
+}
+
 /// Convert a PositionedBox to a LayoutBox with page-absolute coordinates.
 /// `y_on_page` = `pbox.y - page_start_doc_y`; Taffy's layout already encodes
 /// margin spacing into `pbox.y`, so we do not add margin_top separately.
@@ -195,27 +667,62 @@ fn build_layout_box(
         lb.background_color = Some([c.r, c.g, c.b, c.a]);
     }
 
+    lb.transform = pbox.style.transform;
+    lb.box_shadow = pbox.style.box_shadow.clone();
+    lb.background_gradient = pbox.style.background_gradient.clone();
+    lb.background_image = pbox.style.background_image.clone().map(|src| BackgroundImage {
+        src,
+        size: pbox.style.background_size,
+        position: pbox.style.background_position,
+        repeat: pbox.style.background_repeat,
+    });
+    lb.border_radius = pbox.style.border_radius;
+    lb.clip_path = pbox.style.clip_path;
+    // Anonymous text runs share their element's style; the element clips.
+    let clips = pbox.style.overflow == style::Overflow::Hidden && pbox.element.is_some();
+    if clips && lb.clip_path.is_none() {
+        lb.clip_path = Some(ClipPath::Inset {
+            top: 0.0,
+            right: 0.0,
+            bottom: 0.0,
+            left: 0.0,
+            round: pbox.style.border_radius,
+        });
+    }
+
     // Border
-    if pbox.style.border_width > 0.5 {
+    if pbox.style.border_width > 0.0 && pbox.style.border_sides != BorderSides::NONE {
         let c = &pbox.style.border_color;
         lb.border = Some(BorderStyle {
             width: pbox.style.border_width,
             color: [c.r, c.g, c.b, c.a],
+            style: pbox.style.border_style,
+            sides: pbox.style.border_sides,
         });
     }
 
     // Content
+    let (render_mode, stroke) = text_paint(&pbox.style);
     match &pbox.content {
         BoxContent::Text { lines, .. } => {
             let c = &pbox.style.color;
             let line_height = fonts.line_height_px(pbox.style.font_size, pbox.style.line_height);
+            let writing_mode = pbox.style.writing_mode;
+            let columns = lines.len();
             let text_lines: Vec<TextLine> = lines
                 .iter()
                 .enumerate()
-                .map(|(i, line)| TextLine {
-                    text: line.clone(),
-                    x_offset: 0.0,
-                    y_offset: i as f32 * line_height,
+                .map(|(i, line)| {
+                    let (x_offset, y_offset) = match writing_mode {
+                        WritingMode::HorizontalTb => (0.0, i as f32 * line_height),
+                        WritingMode::VerticalRl => ((columns - 1 - i) as f32 * line_height, 0.0),
+                        WritingMode::VerticalLr => (i as f32 * line_height, 0.0),
+                    };
+                    TextLine {
+                        text: line.clone(),
+                        x_offset,
+                        y_offset,
+                    }
                 })
                 .collect();
 
@@ -234,6 +741,11 @@ fn build_layout_box(
                 },
                 underline: pbox.style.text_decoration == style::TextDecoration::Underline,
                 list_marker: None,
+                list_marker_image: None,
+                render_mode,
+                stroke,
+                writing_mode,
+                shadow: pbox.style.text_shadow.clone(),
             });
         }
         BoxContent::Image { src } => {
@@ -241,6 +753,7 @@ fn build_layout_box(
                 src: src.clone(),
                 width: pbox.width,
                 height: pbox.height,
+                filter: pbox.style.filter.clone(),
             });
         }
         BoxContent::ListItem { marker } => {
@@ -260,11 +773,23 @@ fn build_layout_box(
                 text_align: "left".to_string(),
                 underline: false,
                 list_marker: Some(marker.clone()),
+                list_marker_image: pbox.style.list_style_image.clone(),
+                render_mode,
+                stroke,
+                writing_mode: WritingMode::HorizontalTb,
+                shadow: Vec::new(),
             });
         }
         BoxContent::None => {}
     }
 
+    // A hidden box keeps its place but paints nothing of its own; its
+    // children may still opt back in with `visibility: visible`.
+    if pbox.style.visibility != style::Visibility::Visible {
+        lb = LayoutBox::new(abs_x, abs_y, pbox.width, pbox.height);
+    }
+    lb.id = pbox.element.as_ref().and_then(|e| e.id.clone());
+
     // Recurse into children, propagating absolute coordinates.
     // Each child's PositionedBox.y is a document-space absolute, so
     // (child.y − pbox.y) gives the child's offset within the parent.
@@ -278,6 +803,27 @@ fn build_layout_box(
     lb
 }
 
+/// Map `-webkit-text-stroke` / `-webkit-text-fill-color` onto a PDF text
+/// rendering mode.  Transparent fill without a stroke gives invisible text.
+fn text_paint(s: &style::ComputedStyle) -> (TextRenderMode, Option<BorderStyle>) {
+    let stroked = s.text_stroke_width > 0.0;
+    let mode = match (!s.text_fill_transparent, stroked) {
+        (true, false) => TextRenderMode::Fill,
+        (false, true) => TextRenderMode::Stroke,
+        (true, true) => TextRenderMode::FillStroke,
+        (false, false) => TextRenderMode::Invisible,
+    };
+    let stroke = stroked.then(|| {
+        let c = s.text_stroke_color.unwrap_or(s.color);
+        BorderStyle {
+            width: s.text_stroke_width,
+            color: [c.r, c.g, c.b, c.a],
+            ..Default::default()
+        }
+    });
+    (mode, stroke)
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -314,4 +860,53 @@ mod tests {
             config.pages.len()
         );
     }
+
+    fn page_text(page: &PageLayout) -> Vec<String> {
+        fn visit(lb: &LayoutBox, out: &mut Vec<String>) {
+            if let Some(text) = &lb.text {
+                out.extend(text.lines.iter().map(|l| l.text.clone()));
+            }
+            for child in &lb.children {
+                visit(child, out);
+            }
+        }
+        let mut out = Vec::new();
+        for lb in &page.boxes {
+            visit(lb, &mut out);
+        }
+        out
+    }
+
+    #[test]
+    fn table_header_and_footer_repeat_on_every_page() {
+        let mut html = String::from(
+            "<p>Intro</p><table><thead><tr><th>Item Name</th></tr></thead><tbody>",
+        );
+        for i in 0..80 {
+            html.push_str(&format!("<tr><td>Row {}</td></tr>", i));
+        }
+        html.push_str("</tbody><tfoot><tr><td>Continued</td></tr></tfoot></table>");
+        let dom = parse_html(&html);
+        let styled = build_styled_tree(&dom, None);
+        let fonts = FontManager::default();
+        let boxes = compute_layout(&styled, 595.0, PAGE_MARGIN_PT, &fonts);
+        let config = paginate(&boxes, 595.0, 842.0, PAGE_MARGIN_PT, &fonts);
+        assert!(config.pages.len() > 1, "table should span several pages");
+
+        let content_bottom = 842.0 - PAGE_MARGIN_PT;
+        for page in &config.pages {
+            let text = page_text(page);
+            assert!(text.iter().any(|t| t == "Item Name"), "missing header: {:?}", text);
+            assert!(text.iter().any(|t| t == "Continued"), "missing footer: {:?}", text);
+            for lb in &page.boxes {
+                assert!(lb.y + lb.height <= content_bottom + 0.5, "row overflows page");
+            }
+        }
+        let rows: usize = config
+            .pages
+            .iter()
+            .map(|p| page_text(p).iter().filter(|t| t.starts_with("Row ")).count())
+            .sum();
+        assert_eq!(rows, 80, "every body row is emitted exactly once");
+    }
 }
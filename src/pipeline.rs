@@ -1,13 +1,35 @@
 //! Pipeline – ties together parsing, styling, layout, pagination, and
 //! rendering into a single function call.
 
-use crate::dom::{body_children, parse_html};
+use std::fs::File;
+use std::io::{BufWriter, Read};
+use std::panic::{self, AssertUnwindSafe};
+use std::path::{Path, PathBuf};
+use std::sync::{mpsc, Arc};
+use std::thread;
+
+use sha2::{Digest, Sha256};
+
+use crate::cache::Cache;
+use crate::css::{resolve_imports, select_first, Media, Origin, Stylesheet};
+use crate::diagnostics::{self, Diagnostic};
+use crate::dom::{document_title, parse_html, parse_html_reader, remove_node, to_html, DomNode};
+use crate::events::{self, EventSink};
 use crate::fonts::FontManager;
-use crate::layout::compute_layout;
-use crate::layout_config::LayoutConfig;
-use crate::pagination::{paginate, PAGE_MARGIN_PT};
-use crate::render::render_pdf;
-use crate::style::build_styled_tree;
+use crate::layout::{compute_layout_with_margins, BoxContent, PositionedBox};
+use crate::layout_config::{
+    AfRelationship, BackgroundMode, LayoutConfig, LayoutNode, LinkStyle, PageAttachment,
+    PageBackground, PageMode, PdfOverlay, RenderingIntent,
+};
+use crate::pagination::{
+    add_margin_boxes, paginate_with_margins, BandHeights, PageMargins, PAGE_MARGIN_PT,
+};
+use crate::recompress;
+use crate::render::{render_document_with_cache, render_pdf_with_cache, RenderedPdf};
+use crate::style::{
+    build_document_tree, drop_economy_backgrounds, enforce_min_font_size, resolve_page_margins,
+    StyledNode,
+};
 
 /// Page orientation for the generated PDF.
 #[derive(Debug, Clone, PartialEq, Eq, Default)]
@@ -19,6 +41,93 @@ pub enum PageOrientation {
     Landscape,
 }
 
+/// A page dimension.  Stored in PDF points (1/72 inch), the unit of every
+/// `f32` size in [`PipelineConfig`]; the constructors name the unit so a
+/// millimetre value cannot be passed where points are expected.
+#[derive(Debug, Clone, Copy, PartialEq, PartialOrd, Default)]
+pub struct Length(f32);
+
+impl Length {
+    pub const fn pt(points: f32) -> Self {
+        Self(points)
+    }
+
+    pub fn mm(millimetres: f32) -> Self {
+        Self(millimetres * 72.0 / 25.4)
+    }
+
+    pub fn inch(inches: f32) -> Self {
+        Self(inches * 72.0)
+    }
+
+    /// The length in PDF points.
+    pub fn to_pt(self) -> f32 {
+        self.0
+    }
+}
+
+/// A portrait page size; pair with [`PageOrientation::Landscape`] to turn it.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct PageSize {
+    pub width: Length,
+    pub height: Length,
+}
+
+impl PageSize {
+    pub const A3: Self = Self::pt(841.89, 1190.55);
+    pub const A4: Self = Self::pt(595.28, 841.89);
+    pub const A5: Self = Self::pt(419.53, 595.28);
+    /// US Letter, 8.5 × 11 in.
+    pub const LETTER: Self = Self::pt(612.0, 792.0);
+    /// US Legal, 8.5 × 14 in.
+    pub const LEGAL: Self = Self::pt(612.0, 1008.0);
+
+    const fn pt(width: f32, height: f32) -> Self {
+        Self {
+            width: Length::pt(width),
+            height: Length::pt(height),
+        }
+    }
+}
+
+/// An external stylesheet, applied before the document's own `<style>`
+/// blocks (see [`PipelineConfig::stylesheets`]).
+#[derive(Debug, Clone, PartialEq)]
+pub enum StylesheetSource {
+    /// A CSS file, read when the document is styled.  Its `@import`s and
+    /// relative `url()`s resolve against the file's folder.
+    File(PathBuf),
+    /// CSS text whose `@import`s and relative `url()`s resolve against
+    /// `base`, if given.
+    Css { css: String, base: Option<PathBuf> },
+}
+
+impl StylesheetSource {
+    /// The CSS with `@import`s and relative `url()`s inlined (see
+    /// [`resolve_imports`]), or `None` – reported as a missing asset –
+    /// when the file cannot be read.
+    fn load(&self) -> Option<String> {
+        match self {
+            Self::File(path) => match std::fs::read_to_string(path) {
+                Ok(css) => {
+                    let base = path.parent().unwrap_or(Path::new(""));
+                    Some(resolve_imports(&css, base))
+                }
+                Err(e) => {
+                    let message = format!("Skipping stylesheet {}: {e}", path.display());
+                    diagnostics::missing_asset("css", message);
+                    None
+                }
+            },
+            Self::Css {
+                css,
+                base: Some(base),
+            } => Some(resolve_imports(css, base)),
+            Self::Css { css, base: None } => Some(css.clone()),
+        }
+    }
+}
+
 /// Configuration for the PDF generation pipeline.
 #[derive(Debug, Clone)]
 pub struct PipelineConfig {
@@ -32,6 +141,167 @@ pub struct PipelineConfig {
     pub page_margin: f32,
     /// Page orientation; swaps effective width/height when `Landscape`.
     pub orientation: PageOrientation,
+    /// Embed a font program for the standard-14 fonts instead of referencing
+    /// them by name only (needed for PDF/A and some print RIPs).
+    pub embed_base_fonts: bool,
+    /// TrueType/OpenType program used for the Helvetica family. The
+    /// standard-14 programs are not bundled, so `embed_base_fonts` requires it.
+    pub base_font: Option<Vec<u8>>,
+    /// Folder of `.ttf` / `.otf` files (searched recursively) registered by
+    /// their own family names, e.g. a container's `/usr/share/fonts`.
+    pub fonts_directory: Option<PathBuf>,
+    /// CSS applied after the document's own styles, overriding its
+    /// `<style>` rules, classes and inline styles (e.g. a print override).
+    pub extra_css: String,
+    /// External stylesheets applied in order before the document's own
+    /// `<style>` blocks, as if linked from its head: they share the
+    /// document's cascade, so its rules win only on equal specificity.
+    pub stylesheets: Vec<StylesheetSource>,
+    /// Colour rendering intent for every page; `None` keeps the viewer
+    /// default. Glyph hinting has no equivalent knob – pdf-forge only emits
+    /// vector PDF and never rasterises text itself.
+    pub rendering_intent: Option<RenderingIntent>,
+    /// Custom XMP packet embedded verbatim as the document metadata stream.
+    /// Must be well-formed XML or generation fails.
+    pub xmp: Option<String>,
+    /// Fail generation if any [`Diagnostic`] is reported (a skipped image,
+    /// a dropped CSS rule, a missing glyph, …) instead of degrading.
+    pub strict: bool,
+    /// Fail generation if a referenced asset (an image, the base font)
+    /// cannot be loaded, while tolerating every other diagnostic.  Implied
+    /// by `strict`.
+    pub fail_on_missing_assets: bool,
+    /// Strip identifying metadata: no Info dictionary (so `title` is not
+    /// written), no XMP (`xmp` is ignored) and an all-zero document ID.
+    pub strip_metadata: bool,
+    /// Post-process the file to merge identical streams, fonts and graphics
+    /// states and remove unreferenced objects (slower; smaller output).
+    pub optimize: bool,
+    /// FlateDecode-compress embedded font programs (default `true`).  Only
+    /// matters with `embed_base_fonts`.
+    pub font_compression: bool,
+    /// Shared store for parsed font programs and decoded images, reused
+    /// across renders.  `None` (the default) decodes everything each time.
+    pub cache: Option<Arc<dyn Cache>>,
+    /// Receives a structured [`Event`](crate::events::Event) for each
+    /// pipeline phase, image decode and diagnostic of [`generate`].
+    pub event_sink: Option<Arc<dyn EventSink>>,
+    /// Image drawn on every page beneath the content.
+    pub page_background: Option<PageBackground>,
+    /// Give every page exactly one content stream, merging any `/Contents`
+    /// array (for minimal PDF consumers).
+    pub single_content_stream: bool,
+    /// Expected output size in bytes, used to preallocate the output buffer
+    /// when the file is post-processed (the options above that printpdf
+    /// cannot apply itself).  A wrong hint only costs memory or regrowth.
+    pub output_size_hint: usize,
+    /// Drop a final page left without visible content, as when a table
+    /// exactly fills the page before it.  Pages started by an explicit page
+    /// break are always kept.
+    pub trim_trailing_blank_page: bool,
+    /// Paint backgrounds even where the document sets
+    /// `print-color-adjust: economy` (by default those are dropped).
+    pub print_backgrounds: bool,
+    /// Minimum stroke width in points for borders, text outlines and
+    /// underlines; hairlines thinner than this may vanish on a printer.
+    /// `0` (the default) leaves every stroke as the document sets it.
+    pub min_line_width: f32,
+    /// Skip images whose header claims more than this many pixels, before
+    /// any pixel buffer is allocated (a decompression-bomb guard).  The skip
+    /// is a missing-asset diagnostic, so strict mode turns it into an error.
+    pub max_image_pixels: Option<u64>,
+    /// A page of an existing PDF – typically pre-printed letterhead – drawn
+    /// on every generated page as a form XObject, beneath the content or
+    /// over it.  Rendering fails if the PDF does not have that page.
+    pub overlay_pdf: Option<PdfOverlay>,
+    /// Write pages in units of this many points (`/UserUnit`, PDF 1.6) for
+    /// large formats: a page box side may not exceed 14 400 units, so a
+    /// factor of 10 allows posters up to 144 000 pt (about 50 m).  Must be
+    /// between 1 and 75 000; `None` keeps plain points.
+    pub user_unit: Option<f32>,
+    /// Compress the document's small objects together in object streams,
+    /// indexed by a cross-reference stream, instead of writing a classic
+    /// `xref` table.  Files get smaller, but readers older than PDF 1.5
+    /// cannot open them; independent of `font_compression`.
+    pub object_streams: bool,
+    /// When `title` is left at its default, use the text of the document's
+    /// `<title>` or, failing that, of its first `<h1>` as the title.
+    pub title_from_first_heading: bool,
+    /// Info `/Producer` to write instead of printpdf's, e.g. a product name
+    /// for white-label output.  `None` keeps the library default.
+    pub producer: Option<String>,
+    /// Info `/Creator` (the authoring application) to write instead of
+    /// printpdf's.  `None` keeps the library default.
+    pub creator: Option<String>,
+    /// Lay the document out in a viewport this many CSS pixels wide, as a
+    /// browser window would: `@media` width queries see it, and the result
+    /// is scaled so the viewport fills the page's content width.  `None`
+    /// lays out in points at the page size.
+    pub viewport_width: Option<f32>,
+    /// Selector of an element taken out of the document's flow and repeated
+    /// in the top margin of every page, so headers share the document's
+    /// stylesheet.  It is styled as a top-level element: it inherits nothing
+    /// from its former ancestors, and descendant selectors through them no
+    /// longer match.  `None` repeats nothing.
+    pub header_selector: Option<String>,
+    /// Like [`Self::header_selector`], for the bottom margin.
+    pub footer_selector: Option<String>,
+    /// Reserve exactly this many points below the top margin for the
+    /// header, clipping a header that is taller.  The content starts below
+    /// the band.  `None` puts the header in the top margin instead.
+    pub header_height: Option<f32>,
+    /// Like [`Self::header_height`], above the bottom margin for the footer.
+    pub footer_height: Option<f32>,
+    /// Keep the document as parsed in [`GeneratedPdf::expanded_html`], for
+    /// debugging templates that render unexpectedly.
+    pub retain_intermediate_html: bool,
+    /// Make bare URLs in the text (words starting with `http://`,
+    /// `https://` or `www.`) clickable link annotations.  Off by default.
+    pub auto_link: bool,
+    /// Border and click highlight of the [`Self::auto_link`] annotations.
+    /// The default draws no border and inverts the link when clicked.
+    pub link_style: LinkStyle,
+    /// Panel the viewer opens with, e.g. [`PageMode::UseThumbs`] for the
+    /// page thumbnails.  pdf-forge writes no bookmarks, so
+    /// [`PageMode::UseOutlines`] opens an empty panel.
+    pub page_mode: PageMode,
+    /// Convert all text to vector paths: glyphs are drawn as filled
+    /// outlines from the font programs, so the PDF contains no font objects
+    /// and its text can be neither selected nor extracted.  The standard-14
+    /// outlines are not bundled, so this requires [`Self::base_font`]; it
+    /// overrides `embed_base_fonts`.
+    pub text_as_outlines: bool,
+    /// Colour-manage images that carry their own ICC profile (PNG `iCCP`,
+    /// JPEG `APP2`): the image is tagged with that profile as an
+    /// `/ICCBased` colour space, so viewers and RIPs convert its samples
+    /// from the source space instead of reading them as device RGB.
+    /// Samples are not converted by pdf-forge itself.  Off by default.
+    pub image_color_management: bool,
+    /// Make every element `id` a named destination in the catalog's
+    /// `/Dests` name tree, so links such as `report.pdf#nameddest=intro`
+    /// open the document at that element.  Off by default.
+    pub named_destinations: bool,
+    /// Convert every colour and image to `/DeviceGray` when the PDF is
+    /// written, for black-and-white print runs that charge for colour
+    /// pages.  Off by default.
+    pub grayscale: bool,
+    /// Fail with an error starting with [`OUTPUT_TOO_LARGE`] when the PDF
+    /// would be larger than this many bytes, for delivery channels with a
+    /// size limit such as email.  `None` allows any size.
+    pub max_output_bytes: Option<u64>,
+    /// Over [`Self::max_output_bytes`], first re-encode the document's
+    /// opaque images as ever smaller JPEGs (see [`crate::recompress`]) until
+    /// the PDF fits, failing only if even the smallest does not.
+    pub fit_output_size: bool,
+    /// Smallest font size in points that text is printed at: smaller text
+    /// is laid out and drawn at this size instead, so fine print stays
+    /// legible.  `0` (the default) keeps every size the document sets.
+    pub min_font_size: f32,
+    /// Files embedded in the PDF as associated files of a page – listed in
+    /// that page's `/AF` array with how they relate to it, for standards
+    /// such as PDF/A-3 that tie data to the page showing it.  Generation
+    /// fails if a page does not exist.
+    pub page_attachments: Vec<PageAttachment>,
 }
 
 impl Default for PipelineConfig {
@@ -42,6 +312,50 @@ impl Default for PipelineConfig {
             page_height: 841.89,
             page_margin: PAGE_MARGIN_PT,
             orientation: PageOrientation::Portrait,
+            embed_base_fonts: false,
+            base_font: None,
+            fonts_directory: None,
+            extra_css: String::new(),
+            stylesheets: Vec::new(),
+            rendering_intent: None,
+            xmp: None,
+            strict: false,
+            fail_on_missing_assets: false,
+            strip_metadata: false,
+            optimize: false,
+            font_compression: true,
+            cache: None,
+            event_sink: None,
+            page_background: None,
+            single_content_stream: false,
+            output_size_hint: 0,
+            trim_trailing_blank_page: false,
+            print_backgrounds: false,
+            min_line_width: 0.0,
+            max_image_pixels: None,
+            overlay_pdf: None,
+            user_unit: None,
+            object_streams: false,
+            title_from_first_heading: false,
+            producer: None,
+            creator: None,
+            viewport_width: None,
+            header_selector: None,
+            footer_selector: None,
+            header_height: None,
+            footer_height: None,
+            retain_intermediate_html: false,
+            auto_link: false,
+            link_style: LinkStyle::default(),
+            page_mode: PageMode::UseNone,
+            text_as_outlines: false,
+            image_color_management: false,
+            named_destinations: false,
+            grayscale: false,
+            max_output_bytes: None,
+            fit_output_size: false,
+            min_font_size: 0.0,
+            page_attachments: Vec::new(),
         }
     }
 }
@@ -63,6 +377,401 @@ impl PipelineConfig {
         }
     }
 
+    /// Build the font manager for this config, loading `fonts_directory` and
+    /// registering `base_font` (if any) as the regular Helvetica face.
+    pub fn font_manager(&self) -> Result<FontManager, String> {
+        let mut fonts = FontManager::default();
+        if let Some(dir) = &self.fonts_directory {
+            fonts.load_directory(dir)?;
+        }
+        if let Some(bytes) = &self.base_font {
+            fonts.load_font("Helvetica", false, false, bytes.clone())?;
+        }
+        Ok(fonts)
+    }
+
+    /// Register the fonts under `dir` (see [`Self::fonts_directory`]).  A
+    /// directory that does not exist makes generation fail.
+    pub fn with_fonts_directory(mut self, dir: impl Into<PathBuf>) -> Self {
+        self.fonts_directory = Some(dir.into());
+        self
+    }
+
+    /// Set the page size (before orientation is applied).
+    pub fn with_page_size(mut self, size: PageSize) -> Self {
+        self.page_width = size.width.to_pt();
+        self.page_height = size.height.to_pt();
+        self
+    }
+
+    /// Set the margin on all four sides.
+    pub fn with_margins(mut self, margin: Length) -> Self {
+        self.page_margin = margin.to_pt();
+        self
+    }
+
+    /// Append `css` to [`Self::extra_css`]; repeated calls concatenate, so
+    /// later rules win ties with earlier ones.
+    pub fn with_extra_css(mut self, css: &str) -> Self {
+        if !self.extra_css.is_empty() {
+            self.extra_css.push('\n');
+        }
+        self.extra_css.push_str(css);
+        self
+    }
+
+    /// Apply the CSS files at `paths`, in order, before the document's own
+    /// styles (see [`Self::stylesheets`]).  A file that cannot be read is
+    /// reported as a missing asset.
+    pub fn with_stylesheet_files<P: AsRef<Path>>(mut self, paths: &[P]) -> Self {
+        let files = paths.iter().map(|p| p.as_ref().to_path_buf());
+        self.stylesheets.extend(files.map(StylesheetSource::File));
+        self
+    }
+
+    /// Apply the stylesheet `css` after those added before it, resolving its
+    /// relative `url()`s against `base_dir` (or leaving them as written).
+    pub fn with_stylesheet(mut self, css: &str, base_dir: Option<&Path>) -> Self {
+        self.stylesheets.push(StylesheetSource::Css {
+            css: css.to_string(),
+            base: base_dir.map(Path::to_path_buf),
+        });
+        self
+    }
+
+    /// Turn every diagnostic into a generation error (see [`Self::strict`]).
+    pub fn with_strict_mode(mut self, strict: bool) -> Self {
+        self.strict = strict;
+        self
+    }
+
+    /// Fail only on assets that cannot be loaded (see
+    /// [`Self::fail_on_missing_assets`]).
+    pub fn with_fail_fast_on_missing_assets(mut self, fail: bool) -> Self {
+        self.fail_on_missing_assets = fail;
+        self
+    }
+
+    /// Omit all identifying metadata (see [`Self::strip_metadata`]).
+    pub fn without_metadata(mut self) -> Self {
+        self.strip_metadata = true;
+        self
+    }
+
+    /// Enable or disable the size optimisation pass (see [`Self::optimize`]).
+    pub fn with_optimize(mut self, optimize: bool) -> Self {
+        self.optimize = optimize;
+        self
+    }
+
+    /// Compress embedded font programs or store them uncompressed (see
+    /// [`Self::font_compression`]).
+    pub fn with_font_compression(mut self, compress: bool) -> Self {
+        self.font_compression = compress;
+        self
+    }
+
+    /// Reuse decoded resources through `cache` (see [`Self::cache`]); share
+    /// one [`LruCache`](crate::cache::LruCache) between configs to benefit.
+    pub fn with_cache(mut self, cache: Arc<dyn Cache>) -> Self {
+        self.cache = Some(cache);
+        self
+    }
+
+    /// Report structured events of each render to `sink` (see
+    /// [`crate::events`]).
+    pub fn with_event_sink(mut self, sink: Arc<dyn EventSink>) -> Self {
+        self.event_sink = Some(sink);
+        self
+    }
+
+    /// Draw `image` (PNG or JPEG bytes) behind the content of every page,
+    /// fitted as `mode` says (see [`Self::page_background`]).
+    pub fn with_page_background_image(mut self, image: &[u8], mode: BackgroundMode) -> Self {
+        self.page_background = Some(PageBackground::from_bytes(image, mode));
+        self
+    }
+
+    /// Merge each page's content streams into one (see
+    /// [`Self::single_content_stream`]).
+    pub fn with_single_content_stream(mut self, single: bool) -> Self {
+        self.single_content_stream = single;
+        self
+    }
+
+    /// Preallocate `bytes` for the output (see [`Self::output_size_hint`]).
+    pub fn with_output_size_hint(mut self, bytes: usize) -> Self {
+        self.output_size_hint = bytes;
+        self
+    }
+
+    /// Drop an empty trailing page (see [`Self::trim_trailing_blank_page`]).
+    pub fn with_trim_trailing_blank_page(mut self, trim: bool) -> Self {
+        self.trim_trailing_blank_page = trim;
+        self
+    }
+
+    /// Force backgrounds on regardless of `print-color-adjust` (see
+    /// [`Self::print_backgrounds`]).
+    pub fn with_print_backgrounds(mut self, force: bool) -> Self {
+        self.print_backgrounds = force;
+        self
+    }
+
+    /// Widen strokes thinner than `pt` points (see [`Self::min_line_width`]).
+    pub fn with_min_line_width(mut self, pt: f32) -> Self {
+        self.min_line_width = pt;
+        self
+    }
+
+    /// Refuse to decode images larger than `pixels` (see
+    /// [`Self::max_image_pixels`]).
+    pub fn with_max_image_pixels(mut self, pixels: u64) -> Self {
+        self.max_image_pixels = Some(pixels);
+        self
+    }
+
+    /// Draw page `page` (1-based) of `pdf` on every page, beneath the
+    /// content if `behind` is set and over it otherwise (see
+    /// [`Self::overlay_pdf`]).
+    pub fn with_overlay_pdf(mut self, pdf: &[u8], page: usize, behind: bool) -> Self {
+        self.overlay_pdf = Some(PdfOverlay::from_bytes(pdf, page, behind));
+        self
+    }
+
+    /// Express page geometry in units of `factor` points (see
+    /// [`Self::user_unit`]).
+    pub fn with_user_unit(mut self, factor: f32) -> Self {
+        self.user_unit = Some(factor);
+        self
+    }
+
+    /// Write object streams and a cross-reference stream (see
+    /// [`Self::object_streams`]).
+    pub fn with_object_streams(mut self, enabled: bool) -> Self {
+        self.object_streams = enabled;
+        self
+    }
+
+    /// Derive the title from the document when none is set (see
+    /// [`Self::title_from_first_heading`]).
+    pub fn with_title_from_first_heading(mut self, enabled: bool) -> Self {
+        self.title_from_first_heading = enabled;
+        self
+    }
+
+    /// Write `producer` as the Info `/Producer` (see [`Self::producer`]).
+    pub fn with_producer(mut self, producer: &str) -> Self {
+        self.producer = Some(producer.to_string());
+        self
+    }
+
+    /// Write `creator` as the Info `/Creator` (see [`Self::creator`]).
+    pub fn with_creator(mut self, creator: &str) -> Self {
+        self.creator = Some(creator.to_string());
+        self
+    }
+
+    /// Lay out at a fixed viewport width (see [`Self::viewport_width`]).
+    pub fn with_viewport_width(mut self, px: f32) -> Self {
+        self.viewport_width = Some(px);
+        self
+    }
+
+    /// Repeat the elements `header` and `footer` select in the page margins
+    /// (see [`Self::header_selector`]); an empty selector leaves that margin
+    /// empty.
+    pub fn with_margin_selectors(mut self, header: &str, footer: &str) -> Self {
+        let selector = |s: &str| (!s.trim().is_empty()).then(|| s.to_string());
+        self.header_selector = selector(header);
+        self.footer_selector = selector(footer);
+        self
+    }
+
+    /// Reserve a fixed band for the header (see [`Self::header_height`]).
+    pub fn with_header_height(mut self, pt: f32) -> Self {
+        self.header_height = Some(pt);
+        self
+    }
+
+    /// Reserve a fixed band for the footer (see [`Self::footer_height`]).
+    pub fn with_footer_height(mut self, pt: f32) -> Self {
+        self.footer_height = Some(pt);
+        self
+    }
+
+    /// Return the parsed document with the PDF (see
+    /// [`Self::retain_intermediate_html`]).
+    pub fn with_retain_intermediate_html(mut self, retain: bool) -> Self {
+        self.retain_intermediate_html = retain;
+        self
+    }
+
+    /// Link bare URLs in the text (see [`Self::auto_link`]).
+    pub fn with_auto_link(mut self, enabled: bool) -> Self {
+        self.auto_link = enabled;
+        self
+    }
+
+    /// Draw link annotations in `style` (see [`Self::link_style`]).
+    pub fn with_link_appearance(mut self, style: LinkStyle) -> Self {
+        self.link_style = style;
+        self
+    }
+
+    /// Open the document with `mode`'s panel (see [`Self::page_mode`]).
+    pub fn with_page_mode(mut self, mode: PageMode) -> Self {
+        self.page_mode = mode;
+        self
+    }
+
+    /// Draw text as vector paths (see [`Self::text_as_outlines`]).
+    pub fn with_text_as_outlines(mut self, enabled: bool) -> Self {
+        self.text_as_outlines = enabled;
+        self
+    }
+
+    /// Tag images with their embedded ICC profiles (see
+    /// [`Self::image_color_management`]).
+    pub fn with_image_color_management(mut self, enabled: bool) -> Self {
+        self.image_color_management = enabled;
+        self
+    }
+
+    /// Write a named destination for every element id (see
+    /// [`Self::named_destinations`]).
+    pub fn with_named_destinations(mut self, enabled: bool) -> Self {
+        self.named_destinations = enabled;
+        self
+    }
+
+    /// Write the document in grayscale (see [`Self::grayscale`]).
+    pub fn with_grayscale(mut self, enabled: bool) -> Self {
+        self.grayscale = enabled;
+        self
+    }
+
+    /// Cap the size of the PDF (see [`Self::max_output_bytes`]); with `fit`,
+    /// shrink images to meet the cap before failing.
+    pub fn with_max_output_bytes(mut self, max: u64, fit: bool) -> Self {
+        self.max_output_bytes = Some(max);
+        self.fit_output_size = fit;
+        self
+    }
+
+    /// Attach `data` as `name` to the 1-based `page` (see
+    /// [`Self::page_attachments`]).
+    pub fn with_page_attachment(
+        mut self,
+        page: usize,
+        name: &str,
+        data: Vec<u8>,
+        relationship: AfRelationship,
+    ) -> Self {
+        self.page_attachments.push(PageAttachment {
+            page,
+            name: name.to_string(),
+            data,
+            relationship,
+        });
+        self
+    }
+
+    /// Print no text smaller than `pt` points (see [`Self::min_font_size`]).
+    pub fn with_min_font_size(mut self, pt: f32) -> Self {
+        self.min_font_size = pt;
+        self
+    }
+
+    /// The styled tree of `dom` under `sheet`, with the backgrounds and font
+    /// sizes this config overrides adjusted.
+    fn style_document(&self, dom: &[DomNode], sheet: &Stylesheet) -> Vec<StyledNode> {
+        let mut styled = build_document_tree(dom, sheet);
+        if !self.print_backgrounds {
+            drop_economy_backgrounds(&mut styled);
+        }
+        if self.min_font_size > 0.0 {
+            // Layout is in CSS pixels at a fixed viewport width.
+            let scale = self.viewport_scale(&resolve_page_margins(sheet, self.page_margin));
+            enforce_min_font_size(&mut styled, self.min_font_size / scale);
+        }
+        styled
+    }
+
+    /// Remove the header and footer elements from `dom`, warning about a
+    /// selector that matches nothing.
+    fn take_margin_elements(&self, dom: &mut Vec<DomNode>) -> (Option<DomNode>, Option<DomNode>) {
+        let mut take = |selector: &Option<String>| {
+            let selector = selector.as_deref()?;
+            let node = select_first(dom, selector).and_then(|path| remove_node(dom, &path));
+            if node.is_none() {
+                diagnostics::warn(
+                    "layout",
+                    format!("No element matches margin selector `{selector}`"),
+                );
+            }
+            node
+        };
+        (take(&self.header_selector), take(&self.footer_selector))
+    }
+
+    /// The fixed header and footer band heights, in layout units at
+    /// `scale` points each.
+    fn band_heights(&self, scale: f32) -> BandHeights {
+        BandHeights {
+            header: self.header_height,
+            footer: self.footer_height,
+        }
+        .scaled(1.0 / scale)
+    }
+
+    /// Points per layout unit: with [`Self::viewport_width`] set, the content
+    /// width inside `margins` over the viewport width, otherwise 1.
+    pub fn viewport_scale(&self, margins: &PageMargins) -> f32 {
+        match self.viewport_width {
+            Some(px) if px > 0.0 => {
+                (self.effective_width() - margins.base.left - margins.base.right) / px
+            }
+            _ => 1.0,
+        }
+    }
+
+    /// The title written for `dom`: [`Self::title`], unless it is the default
+    /// and [`Self::title_from_first_heading`] finds one in the document.
+    pub fn document_title(&self, dom: &[DomNode]) -> String {
+        let derived = (self.title_from_first_heading && self.title == Self::default().title)
+            .then(|| document_title(dom))
+            .flatten();
+        derived.unwrap_or_else(|| self.title.clone())
+    }
+
+    /// Embed `packet` as the document's XMP metadata.
+    pub fn with_xmp(mut self, packet: &str) -> Self {
+        self.xmp = Some(packet.to_string());
+        self
+    }
+
+    /// [`Self::stylesheets`], the document's `<style>` blocks and then
+    /// [`Self::extra_css`], with `@media` queries evaluated against the effective page size, or against
+    /// the viewport (its height in the page's proportions) when one is set.
+    pub fn stylesheet(&self, dom: &[DomNode]) -> Stylesheet {
+        let (width, height) = (self.effective_width(), self.effective_height());
+        let media = match self.viewport_width {
+            Some(px) if px > 0.0 => Media {
+                width: px,
+                height: height * px / width,
+            },
+            _ => Media { width, height },
+        };
+        let mut sheet = Stylesheet::new(media);
+        for css in self.stylesheets.iter().filter_map(StylesheetSource::load) {
+            sheet.append(&css, Origin::Document);
+        }
+        sheet.append_dom(dom);
+        sheet.append(&self.extra_css, Origin::Extra);
+        sheet
+    }
+
     /// Create an A4 landscape config.
     pub fn a4_landscape() -> Self {
         Self {
@@ -79,27 +788,212 @@ pub fn generate_pdf(
     html: &str,
     config: &PipelineConfig,
 ) -> Result<(Vec<u8>, LayoutConfig), String> {
-    // 1. Parse HTML
-    let dom = parse_html(html);
-    let dom_nodes = body_children(&dom);
+    let generated = generate(html, config)?;
+    Ok((generated.bytes, generated.layout))
+}
 
-    // 2. Build styled tree
-    let styled = build_styled_tree(&dom_nodes, None);
+/// PDF, layout and (with `retain_intermediate_html`) the serialised
+/// document of one pipeline run.
+type PipelineOutput = (RenderedPdf, LayoutConfig, Option<String>);
 
-    // 3. Compute layout
-    let fonts = FontManager::default();
-    let eff_w = config.effective_width();
-    let eff_h = config.effective_height();
-    let boxes = compute_layout(&styled, eff_w, config.page_margin, &fonts);
+fn run_pipeline(
+    parse: impl FnOnce() -> Result<Vec<DomNode>, String>,
+    config: &PipelineConfig,
+) -> Result<PipelineOutput, String> {
+    // 1. Parse HTML
+    let phase = events::phase("parse");
+    let dom = parse()?;
+    phase.end();
+    let expanded_html = config.retain_intermediate_html.then(|| to_html(&dom));
 
-    // 4. Paginate
-    let mut layout_config = paginate(&boxes, eff_w, eff_h, config.page_margin, &fonts);
-    layout_config.title = config.title.clone();
+    // 2.–4. Style, lay out and paginate
+    let fonts = config.font_manager()?;
+    let layout_config = paginate(lay_out(dom, config, &fonts), config, &fonts);
 
     // 5. Render PDF
-    let pdf_bytes = render_pdf(&layout_config)?;
+    let phase = events::phase("render");
+    let mut pdf = render_document_with_cache(&layout_config, &fonts, config.cache.as_deref())?;
+    phase.end();
+
+    // 6. Enforce the size limit
+    if let Some(max) = config.max_output_bytes {
+        let size = pdf.byte_len()?;
+        if size > max {
+            pdf = fit_output(size, max, &layout_config, config, &fonts)?.into();
+        }
+    }
+
+    Ok((pdf, layout_config, expanded_html))
+}
+
+/// Start of the error returned when the PDF exceeds
+/// [`PipelineConfig::max_output_bytes`].
+pub const OUTPUT_TOO_LARGE: &str = "Output too large";
+
+/// With [`PipelineConfig::fit_output_size`], the first re-render of
+/// `layout` with recompressed images that fits in `max`, for a PDF of
+/// `size` bytes that does not.  Fails with [`OUTPUT_TOO_LARGE`].
+fn fit_output(
+    size: u64,
+    max: u64,
+    layout: &LayoutConfig,
+    config: &PipelineConfig,
+    fonts: &FontManager,
+) -> Result<Vec<u8>, String> {
+    let fits = |bytes: &[u8]| bytes.len() as u64 <= max;
+    let steps = if config.fit_output_size { recompress::STEPS } else { &[] };
+    let mut smallest = size;
+    for &step in steps {
+        let phase = events::phase("recompress");
+        let mut smaller = layout.clone();
+        recompress::shrink_images(&mut smaller, step);
+        let bytes = render_pdf_with_cache(&smaller, fonts, config.cache.as_deref())?;
+        phase.end();
+        if fits(&bytes) {
+            return Ok(bytes);
+        }
+        smallest = smallest.min(bytes.len() as u64);
+    }
+    Err(format!(
+        "{OUTPUT_TOO_LARGE}: the PDF is {smallest} bytes, over the limit of {max}"
+    ))
+}
+
+/// A generated PDF together with its layout and a digest of the bytes.
+#[derive(Debug, Clone)]
+pub struct GeneratedPdf {
+    pub bytes: Vec<u8>,
+    pub layout: LayoutConfig,
+    /// SHA-256 of `bytes`.  Output is deterministic, so identical input and
+    /// config give the same digest – usable directly as a cache key.
+    pub sha256: [u8; 32],
+    /// Degradations reported while generating (always empty in strict mode).
+    pub diagnostics: Vec<Diagnostic>,
+    /// The HTML the engine laid out, serialised back from the parsed
+    /// document (see [`crate::dom::to_html`]).  Only kept with
+    /// [`PipelineConfig::retain_intermediate_html`].
+    pub expanded_html: Option<String>,
+}
+
+impl GeneratedPdf {
+    /// Lower-case hex encoding of [`Self::sha256`].
+    pub fn sha256_hex(&self) -> String {
+        self.sha256.iter().map(|b| format!("{b:02x}")).collect()
+    }
+}
+
+/// Like [`generate_pdf`], but also returns the SHA-256 of the output and
+/// the diagnostics reported along the way.
+///
+/// With [`PipelineConfig::strict`] set, any diagnostic fails generation with
+/// an error listing all of them; with
+/// [`PipelineConfig::fail_on_missing_assets`], only missing assets do.
+pub fn generate(html: &str, config: &PipelineConfig) -> Result<GeneratedPdf, String> {
+    generate_parsed(|| Ok(parse_html(html)), config)
+}
 
-    Ok((pdf_bytes, layout_config))
+/// Like [`generate`], but reads the HTML from `reader` as it parses it (see
+/// [`crate::dom::parse_html_reader`]) instead of taking it as one string –
+/// for documents of hundreds of megabytes, whose source then never sits in
+/// memory whole.  The parsed document itself is still held in full.
+///
+/// Fails if reading fails or the input is not valid UTF-8.
+pub fn generate_from_reader<R: Read>(
+    reader: R,
+    config: &PipelineConfig,
+) -> Result<GeneratedPdf, String> {
+    let parse = || parse_html_reader(reader).map_err(|e| format!("Failed to read HTML: {e}"));
+    generate_parsed(parse, config)
+}
+
+/// Like [`generate`], but writes the PDF to `path` (replacing any file
+/// there) and returns its size.  A host calling through the FFI never
+/// copies the document into its own memory, and when lopdf finishes the
+/// file (see [`RenderedPdf`]) it is serialised straight into it rather than
+/// into a buffer; [`PipelineConfig::max_output_bytes`] is checked by
+/// counting the bytes as they would be written.  Three cases are still
+/// written from one buffer: a file printpdf saves with nothing to patch
+/// (printpdf only saves to memory), [`PipelineConfig::object_streams`]
+/// (packing reads the saved file) and a re-render that fits the file under
+/// the size limit.
+pub fn generate_to_file(html: &str, path: &Path, config: &PipelineConfig) -> Result<u64, String> {
+    let ((pdf, ..), _) = run_checked(|| Ok(parse_html(html)), config)?;
+    let fail = |e: &dyn std::fmt::Display| format!("Failed to write {}: {e}", path.display());
+    let mut out = BufWriter::new(File::create(path).map_err(|e| fail(&e))?);
+    pdf.write_to(&mut out).map_err(|e| fail(&e))?;
+    let file = out.into_inner().map_err(|e| fail(e.error()))?;
+    file.metadata().map(|m| m.len()).map_err(|e| fail(&e))
+}
+
+fn generate_parsed(
+    parse: impl FnOnce() -> Result<Vec<DomNode>, String>,
+    config: &PipelineConfig,
+) -> Result<GeneratedPdf, String> {
+    let ((pdf, layout, expanded_html), diagnostics) = run_checked(parse, config)?;
+    let bytes = pdf.into_bytes()?;
+    let sha256 = Sha256::digest(&bytes).into();
+    Ok(GeneratedPdf {
+        bytes,
+        layout,
+        sha256,
+        diagnostics,
+        expanded_html,
+    })
+}
+
+/// Run the pipeline, collecting its diagnostics, and fail as
+/// [`PipelineConfig::strict`] and [`PipelineConfig::fail_on_missing_assets`]
+/// ask.
+fn run_checked(
+    parse: impl FnOnce() -> Result<Vec<DomNode>, String>,
+    config: &PipelineConfig,
+) -> Result<(PipelineOutput, Vec<Diagnostic>), String> {
+    let sink = config.event_sink.clone();
+    let run = || events::with_sink(sink, || run_pipeline(parse, config));
+    let (result, diagnostics) = diagnostics::collect(run);
+    let output = result?;
+    let list = |filter: fn(&Diagnostic) -> bool| -> Vec<String> {
+        diagnostics
+            .iter()
+            .filter(|d| filter(d))
+            .map(|d| format!("\n  {d}"))
+            .collect()
+    };
+    if config.strict && !diagnostics.is_empty() {
+        return Err(format!(
+            "Strict mode: {} warning(s) during generation:{}",
+            diagnostics.len(),
+            list(|_| true).concat()
+        ));
+    }
+    let missing = list(|d| d.missing_asset);
+    if config.fail_on_missing_assets && !missing.is_empty() {
+        return Err(format!(
+            "Missing assets: {} asset(s) could not be loaded:{}",
+            missing.len(),
+            missing.concat()
+        ));
+    }
+    Ok((output, diagnostics))
+}
+
+/// Run [`generate`] on a new thread and deliver its result on the returned
+/// channel, exactly once – for event loops that poll rather than block.
+///
+/// A panic during generation is delivered as an error rather than leaving
+/// the receiver disconnected.
+pub fn spawn_generate(
+    html: String,
+    config: PipelineConfig,
+) -> mpsc::Receiver<Result<GeneratedPdf, String>> {
+    let (tx, rx) = mpsc::sync_channel(1);
+    thread::spawn(move || {
+        let result = panic::catch_unwind(AssertUnwindSafe(|| generate(&html, &config)))
+            .unwrap_or_else(|_| Err("Internal error: generation panicked".to_string()));
+        // The caller may have dropped the receiver; nothing to do then.
+        let _ = tx.send(result);
+    });
+    rx
 }
 
 /// Convenience: generate PDF with default A4 config.
@@ -109,15 +1003,174 @@ pub fn generate_pdf_from_html(html: &str) -> Result<Vec<u8>, String> {
 }
 
 /// Generate only the layout config (no PDF rendering) – useful for testing.
+///
+/// Fonts that cannot be loaded are reported as a missing asset and replaced
+/// by the built-in metrics; see [`try_compute_layout_config`] to fail instead.
 pub fn compute_layout_config(html: &str, config: &PipelineConfig) -> LayoutConfig {
-    let dom = parse_html(html);
-    let dom_nodes = body_children(&dom);
-    let styled = build_styled_tree(&dom_nodes, None);
-    let fonts = FontManager::default();
-    let eff_w = config.effective_width();
-    let eff_h = config.effective_height();
-    let boxes = compute_layout(&styled, eff_w, config.page_margin, &fonts);
-    paginate(&boxes, eff_w, eff_h, config.page_margin, &fonts)
+    let fonts = config.font_manager().unwrap_or_else(|e| {
+        diagnostics::missing_asset("fonts", format!("Ignoring base font — {e}"));
+        FontManager::default()
+    });
+    paginate(lay_out(parse_html(html), config, &fonts), config, &fonts)
+}
+
+/// Like [`compute_layout_config`], but fails, as [`generate`] does, if the
+/// config's fonts cannot be loaded.
+pub fn try_compute_layout_config(
+    html: &str,
+    config: &PipelineConfig,
+) -> Result<LayoutConfig, String> {
+    let fonts = config.font_manager()?;
+    Ok(paginate(lay_out(parse_html(html), config, &fonts), config, &fonts))
+}
+
+/// A document styled and laid out at the page width, not yet paginated.
+struct LaidOut {
+    dom: Vec<DomNode>,
+    sheet: Stylesheet,
+    /// Elements taken out by [`PipelineConfig::take_margin_elements`].
+    header: Option<DomNode>,
+    footer: Option<DomNode>,
+    /// Page margins in layout units.
+    margins: PageMargins,
+    /// Points per layout unit (see [`PipelineConfig::viewport_scale`]).
+    scale: f32,
+    boxes: Vec<PositionedBox>,
+}
+
+/// Style `dom` and lay it out at the page width – in CSS pixels when a
+/// viewport width is set.
+fn lay_out(mut dom: Vec<DomNode>, config: &PipelineConfig, fonts: &FontManager) -> LaidOut {
+    let phase = events::phase("style");
+    let sheet = config.stylesheet(&dom);
+    let (header, footer) = config.take_margin_elements(&mut dom);
+    let styled = config.style_document(&dom, &sheet);
+    phase.end();
+
+    let phase = events::phase("layout");
+    // At a fixed viewport width, lay out in CSS pixels and scale to the page.
+    let margins = resolve_page_margins(&sheet, config.page_margin);
+    let scale = config.viewport_scale(&margins);
+    let margins = margins.scaled(1.0 / scale);
+    let width = config.effective_width() / scale;
+    let (left, right) = (margins.base.left, margins.base.right);
+    let boxes = compute_layout_with_margins(&styled, width, left, right, fonts);
+    phase.end();
+    LaidOut {
+        dom,
+        sheet,
+        header,
+        footer,
+        margins,
+        scale,
+        boxes,
+    }
+}
+
+/// Paginate `laid_out` into the [`LayoutConfig`] that is rendered, carrying
+/// over `config`'s output settings.  This is the only place they are copied.
+fn paginate(laid_out: LaidOut, config: &PipelineConfig, fonts: &FontManager) -> LayoutConfig {
+    let LaidOut {
+        dom,
+        sheet,
+        header,
+        footer,
+        margins,
+        scale,
+        boxes,
+    } = laid_out;
+    let phase = events::phase("paginate");
+    let eff_w = config.effective_width() / scale;
+    let eff_h = config.effective_height() / scale;
+    let (left, right) = (margins.base.left, margins.base.right);
+    let bands = config.band_heights(scale);
+    let mut layout_config = paginate_with_margins(
+        &boxes,
+        eff_w,
+        eff_h,
+        &margins.reserving(bands),
+        config.trim_trailing_blank_page,
+        fonts,
+    );
+    let band = |node| lay_out_margin_element(node, &sheet, config, eff_w, left, right, fonts);
+    let (header, footer) = (band(header), band(footer));
+    add_margin_boxes(&mut layout_config, &header, &footer, &margins, bands, fonts);
+    phase.end();
+    layout_config.page_width_pt = config.effective_width();
+    layout_config.page_height_pt = config.effective_height();
+    layout_config.viewport_scale = (scale != 1.0).then_some(scale);
+    layout_config.title = config.document_title(&dom);
+    layout_config.embed_base_fonts = config.embed_base_fonts;
+    layout_config.rendering_intent = config.rendering_intent;
+    layout_config.xmp = config.xmp.clone();
+    layout_config.strip_metadata = config.strip_metadata;
+    layout_config.optimize = config.optimize;
+    layout_config.font_compression = config.font_compression;
+    layout_config.page_background = config.page_background.clone();
+    layout_config.single_content_stream = config.single_content_stream;
+    layout_config.output_size_hint = config.output_size_hint;
+    layout_config.min_line_width = config.min_line_width;
+    layout_config.max_image_pixels = config.max_image_pixels;
+    layout_config.overlay_pdf = config.overlay_pdf.clone();
+    layout_config.user_unit = config.user_unit;
+    layout_config.object_streams = config.object_streams;
+    layout_config.producer = config.producer.clone();
+    layout_config.creator = config.creator.clone();
+    layout_config.auto_link = config.auto_link;
+    layout_config.link_style = config.link_style;
+    layout_config.page_mode = config.page_mode;
+    layout_config.text_as_outlines = config.text_as_outlines;
+    layout_config.image_color_management = config.image_color_management;
+    layout_config.named_destinations = config.named_destinations;
+    layout_config.grayscale = config.grayscale;
+    layout_config.page_attachments = config.page_attachments.clone();
+    layout_config
+}
+
+/// Lay out an element taken out by [`PipelineConfig::take_margin_elements`]
+/// on its own, like the content.
+fn lay_out_margin_element(
+    node: Option<DomNode>,
+    sheet: &Stylesheet,
+    config: &PipelineConfig,
+    width: f32,
+    left: f32,
+    right: f32,
+    fonts: &FontManager,
+) -> Vec<PositionedBox> {
+    let Some(node) = node else {
+        return Vec::new();
+    };
+    let styled = config.style_document(std::slice::from_ref(&node), sheet);
+    compute_layout_with_margins(&styled, width, left, right, fonts)
+}
+
+/// Lay `html` out and return the box tree with its computed geometry,
+/// without paginating or rendering – for asserting on template layout.
+/// Geometry is in CSS pixels when a viewport width is set.  Fails only if
+/// the configured fonts cannot be loaded.
+pub fn layout_tree(html: &str, config: &PipelineConfig) -> Result<Vec<LayoutNode>, String> {
+    let fonts = config.font_manager()?;
+    let laid_out = lay_out(parse_html(html), config, &fonts);
+    Ok(laid_out.boxes.iter().map(layout_node).collect())
+}
+
+fn layout_node(pbox: &PositionedBox) -> LayoutNode {
+    let element = pbox.element.as_ref();
+    LayoutNode {
+        tag: element.map(|e| e.tag.clone()),
+        id: element.and_then(|e| e.id.clone()),
+        classes: element.map(|e| e.classes.clone()).unwrap_or_default(),
+        x: pbox.x,
+        y: pbox.y,
+        width: pbox.width,
+        height: pbox.height,
+        lines: match &pbox.content {
+            BoxContent::Text { lines, .. } => lines.clone(),
+            _ => Vec::new(),
+        },
+        children: pbox.children.iter().map(layout_node).collect(),
+    }
 }
 
 #[cfg(test)]
@@ -132,4 +1185,62 @@ mod tests {
         assert!(!config.pages.is_empty());
         assert_eq!(&bytes[0..5], b"%PDF-");
     }
+
+    #[test]
+    fn embed_base_fonts_without_program_errors() {
+        let config = PipelineConfig {
+            embed_base_fonts: true,
+            ..PipelineConfig::default()
+        };
+        let err = generate_pdf("<p>Embedded</p>", &config).unwrap_err();
+        assert!(err.contains("Helvetica"), "unexpected error: {err}");
+    }
+
+    #[test]
+    fn unreadable_base_font_fails_layout_and_generation_alike() {
+        let config = PipelineConfig {
+            base_font: Some(b"not a font".to_vec()),
+            ..PipelineConfig::default()
+        };
+        let generated = generate("<p>Text</p>", &config).unwrap_err();
+        let layout = try_compute_layout_config("<p>Text</p>", &config).unwrap_err();
+        assert_eq!(generated, layout);
+    }
+
+    #[test]
+    fn spawn_generate_delivers_one_result() {
+        let rx = spawn_generate("<p>Later</p>".to_string(), PipelineConfig::default());
+        let pdf = rx
+            .recv_timeout(std::time::Duration::from_secs(30))
+            .expect("no result delivered")
+            .unwrap();
+        assert_eq!(&pdf.bytes[0..5], b"%PDF-");
+        // The sender is gone after the single result.
+        assert!(rx.recv().is_err());
+    }
+
+    #[test]
+    fn lengths_convert_to_points() {
+        assert_eq!(Length::inch(8.5), PageSize::LETTER.width);
+        assert!((Length::mm(210.0).to_pt() - PageSize::A4.width.to_pt()).abs() < 0.01);
+
+        let config = PipelineConfig::default()
+            .with_page_size(PageSize {
+                width: Length::inch(8.5),
+                height: Length::inch(11.0),
+            })
+            .with_margins(Length::mm(25.4));
+        let letter = PipelineConfig::default().with_page_size(PageSize::LETTER);
+        assert_eq!(config.effective_width(), letter.effective_width());
+        assert_eq!(config.effective_height(), letter.effective_height());
+        assert!((config.page_margin - 72.0).abs() < 1e-4);
+    }
+
+    #[test]
+    fn extra_css_calls_concatenate() {
+        let config = PipelineConfig::default()
+            .with_extra_css("p { color: #ff0000 }")
+            .with_extra_css("p { color: #0000ff }");
+        assert_eq!(config.extra_css, "p { color: #ff0000 }\np { color: #0000ff }");
+    }
 }
@@ -0,0 +1,130 @@
+//! Image recompression for `PipelineConfig::fit_output_size` – re-encodes
+//! the raster images of a laid-out document as smaller JPEGs so the PDF
+//! fits under `PipelineConfig::max_output_bytes`.
+//!
+//! Each [`Step`] starts again from the original images, so lossy passes do
+//! not compound.  Images with an alpha channel are left alone (JPEG has no
+//! transparency), as is any image the step would not make smaller.
+
+use std::collections::HashMap;
+
+use ::image::codecs::jpeg::JpegEncoder;
+use ::image::imageops::FilterType;
+use base64::{engine::general_purpose::STANDARD as BASE64_STD, Engine as _};
+
+use crate::layout_config::{LayoutBox, LayoutConfig};
+use crate::render::parse_data_uri;
+
+/// One recompression attempt.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Step {
+    /// JPEG quality, 1–100.
+    pub quality: u8,
+    /// Factor applied to each image's pixel dimensions.
+    pub scale: f32,
+}
+
+/// The attempts made, gentlest first.
+pub const STEPS: &[Step] = &[
+    Step {
+        quality: 75,
+        scale: 1.0,
+    },
+    Step {
+        quality: 50,
+        scale: 0.75,
+    },
+    Step {
+        quality: 35,
+        scale: 0.5,
+    },
+    Step {
+        quality: 25,
+        scale: 0.25,
+    },
+];
+
+/// Replace the images of `config` (including list markers and the page
+/// background) with their re-encoding at `step`.
+pub fn shrink_images(config: &mut LayoutConfig, step: Step) {
+    let mut done: HashMap<String, String> = HashMap::new();
+    let mut shrink = |src: &mut String| {
+        let smaller = done
+            .entry(src.clone())
+            .or_insert_with(|| reencode(src, step).unwrap_or_else(|| src.clone()));
+        src.clone_from(smaller);
+    };
+    for page in &mut config.pages {
+        for lbox in &mut page.boxes {
+            visit(lbox, &mut shrink);
+        }
+    }
+    if let Some(background) = &mut config.page_background {
+        shrink(&mut background.src);
+    }
+}
+
+fn visit(lbox: &mut LayoutBox, shrink: &mut dyn FnMut(&mut String)) {
+    if let Some(image) = &mut lbox.image {
+        shrink(&mut image.src);
+    }
+    if let Some(marker) = lbox.text.as_mut().and_then(|t| t.list_marker_image.as_mut()) {
+        shrink(marker);
+    }
+    if let Some(background) = &mut lbox.background_image {
+        shrink(&mut background.src);
+    }
+    for child in &mut lbox.children {
+        visit(child, shrink);
+    }
+}
+
+/// `src` re-encoded at `step` as a JPEG data URI, or `None` if it cannot be
+/// decoded, has an alpha channel, or would not get smaller.
+fn reencode(src: &str, step: Step) -> Option<String> {
+    let bytes = parse_data_uri(src).ok()?;
+    let image = ::image::load_from_memory(&bytes).ok()?;
+    if image.color().has_alpha() {
+        return None;
+    }
+    let image = if step.scale < 1.0 {
+        let scaled = |px: u32| ((px as f32 * step.scale).round() as u32).max(1);
+        let (width, height) = (scaled(image.width()), scaled(image.height()));
+        image.resize_exact(width, height, FilterType::Triangle)
+    } else {
+        image
+    };
+    let mut jpeg = Vec::new();
+    let encoder = JpegEncoder::new_with_quality(&mut jpeg, step.quality);
+    image.to_rgb8().write_with_encoder(encoder).ok()?;
+    (jpeg.len() < bytes.len())
+        .then(|| format!("data:image/jpeg;base64,{}", BASE64_STD.encode(&jpeg)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// A PNG of `w`×`h` pixels of noise, which Flate cannot compress.
+    fn noise_png(w: u32, h: u32) -> String {
+        let mut seed = 1u32;
+        let img = ::image::RgbImage::from_fn(w, h, |_, _| {
+            seed = seed.wrapping_mul(1_664_525).wrapping_add(1_013_904_223);
+            let [r, g, b, _] = seed.to_be_bytes();
+            ::image::Rgb([r, g, b])
+        });
+        let mut png = std::io::Cursor::new(Vec::new());
+        img.write_to(&mut png, ::image::ImageFormat::Png).unwrap();
+        format!("data:image/png;base64,{}", BASE64_STD.encode(png.into_inner()))
+    }
+
+    #[test]
+    fn steps_shrink_opaque_images() {
+        let src = noise_png(64, 64);
+        let smaller = reencode(&src, STEPS[3]).unwrap();
+        assert!(smaller.starts_with("data:image/jpeg;base64,"));
+        assert!(smaller.len() < src.len() / 4, "{} vs {}", smaller.len(), src.len());
+        let decoded = ::image::load_from_memory(&parse_data_uri(&smaller).unwrap()).unwrap();
+        assert_eq!((decoded.width(), decoded.height()), (16, 16));
+    }
+}
@@ -1,11 +1,20 @@
 //! PDF renderer – takes a [`LayoutConfig`] and produces PDF bytes using
 //! `printpdf` (v0.8 ops-based API).
 
-use std::collections::{HashMap, HashSet};
+use std::cell::RefCell;
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::io::Write;
 
 use base64::{engine::general_purpose::STANDARD as BASE64_STD, Engine as _};
 use printpdf::*;
 
+use crate::attachments;
+use crate::autolink::{self, Link};
+use crate::cache::{self, Cache};
+use crate::destinations;
+use crate::diagnostics;
+use crate::events;
+use crate::fonts::{FontKey, FontManager};
 use crate::layout_config::*;
 
 /// A printpdf XObject together with the pixel dimensions of the source image.
@@ -15,465 +24,3825 @@ struct ImageResource {
     px_height: u32,
 }
 
+/// A decoded image ready to be added to a document; cached across renders.
+struct DecodedImage {
+    raw: RawImage,
+    px_width: u32,
+    px_height: u32,
+    /// ICC profile embedded in the source file, if any.
+    icc_profile: Option<Vec<u8>>,
+}
+
+/// Per-render state shared by every [`render_box`] call.
+struct RenderContext<'a> {
+    page_width: f32,
+    page_height: f32,
+    /// Drawn first on every page.
+    background: Option<&'a PageBackground>,
+    images: &'a HashMap<String, ImageResource>,
+    /// Embedded replacements for the builtin Helvetica faces, keyed by
+    /// `(bold, italic)`. Empty unless `embed_base_fonts` is set.
+    embedded_fonts: &'a HashMap<(bool, bool), FontId>,
+    /// Programs text is drawn from as glyph outlines instead of text
+    /// operators. `None` unless `text_as_outlines` is set.
+    outline_fonts: Option<&'a FontManager>,
+    /// See [`LayoutConfig::min_line_width`].
+    min_line_width: f32,
+    /// Points per layout unit (see [`LayoutConfig::viewport_scale`]).
+    scale: f32,
+    /// Gradients drawn so far, indexed by their placeholder tags.
+    gradients: RefCell<Vec<GradientFill>>,
+    /// See [`LayoutConfig::grayscale`].
+    grayscale: bool,
+}
+
+/// A gradient background awaiting its shading (see [`push_gradient`]).
+struct GradientFill {
+    gradient: Gradient,
+    /// Painted area `[x1, y1, x2, y2]` in PDF user space.
+    rect: [f32; 4],
+}
+
+impl RenderContext<'_> {
+    /// Stroke thickness for a line laid out `width` points wide.
+    fn line_width(&self, width: f32) -> Pt {
+        Pt(width.max(self.min_line_width / self.scale))
+    }
+
+    /// Page height in layout units, the origin boxes are flipped against.
+    fn layout_height(&self) -> f32 {
+        self.page_height / self.scale
+    }
+}
+
 /// Render a LayoutConfig into PDF bytes.
 ///
 /// `<img>` elements whose `src` is not a base64 data URI, or whose bytes
-/// cannot be decoded, are silently skipped (a `log::warn` is emitted).
+/// cannot be decoded, are skipped with a [`diagnostics`](crate::diagnostics)
+/// warning.
 pub fn render_pdf(config: &LayoutConfig) -> Result<Vec<u8>, String> {
+    render_pdf_with_fonts(config, &FontManager::default())
+}
+
+/// Render a LayoutConfig into PDF bytes, taking font programs from `fonts`.
+///
+/// The fonts are only consulted when `config.embed_base_fonts` or
+/// `config.text_as_outlines` is set, in which case a program must be
+/// registered for the Helvetica family.
+///
+/// Fails if `config.xmp` is not well-formed XML, or if `config.user_unit` is
+/// out of range or still leaves a page side over [`MAX_PAGE_UNITS`].
+pub fn render_pdf_with_fonts(config: &LayoutConfig, fonts: &FontManager) -> Result<Vec<u8>, String> {
+    render_pdf_with_cache(config, fonts, None)
+}
+
+/// Like [`render_pdf_with_fonts`], reusing parsed font programs and decoded
+/// images from `cache` (and storing the ones it had to decode).
+pub fn render_pdf_with_cache(
+    config: &LayoutConfig,
+    fonts: &FontManager,
+    cache: Option<&dyn Cache>,
+) -> Result<Vec<u8>, String> {
+    render_document_with_cache(config, fonts, cache)?.into_bytes()
+}
+
+/// A rendered PDF not yet turned into bytes.  When the settings printpdf
+/// has no API for were patched in with lopdf, this holds the patched
+/// document, which [`Self::write_to`] serialises straight into the writer
+/// instead of into a buffer first.
+pub struct RenderedPdf(Rendered);
+
+enum Rendered {
+    /// printpdf's output, which needed no patching.
+    Saved(Vec<u8>),
+    Patched {
+        doc: lopdf::Document,
+        object_streams: bool,
+        size_hint: usize,
+    },
+}
+
+impl From<Vec<u8>> for RenderedPdf {
+    fn from(bytes: Vec<u8>) -> Self {
+        RenderedPdf(Rendered::Saved(bytes))
+    }
+}
+
+impl RenderedPdf {
+    /// The bytes of the PDF file.
+    pub fn into_bytes(self) -> Result<Vec<u8>, String> {
+        match self.0 {
+            Rendered::Saved(bytes) => Ok(bytes),
+            Rendered::Patched {
+                mut doc,
+                object_streams,
+                size_hint,
+            } => {
+                let mut out = Vec::with_capacity(size_hint);
+                doc.save_to(&mut out)
+                    .map_err(|e| format!("Save PDF: {e}"))?;
+                if object_streams {
+                    out = pack_object_streams(&doc, &out)?;
+                }
+                Ok(out)
+            }
+        }
+    }
+
+    /// Size of the PDF file in bytes.  A patched document is serialised to
+    /// count them without keeping them, unless its objects are packed into
+    /// object streams: the packed file is then kept for writing out.
+    pub fn byte_len(&mut self) -> Result<u64, String> {
+        match &mut self.0 {
+            Rendered::Saved(bytes) => Ok(bytes.len() as u64),
+            Rendered::Patched {
+                doc,
+                object_streams: false,
+                ..
+            } => {
+                let mut counter = ByteCounter::default();
+                doc.save_to(&mut counter)
+                    .map_err(|e| format!("Save PDF: {e}"))?;
+                Ok(counter.0)
+            }
+            Rendered::Patched { doc, .. } => {
+                let mut saved = Vec::new();
+                doc.save_to(&mut saved)
+                    .map_err(|e| format!("Save PDF: {e}"))?;
+                let packed = pack_object_streams(doc, &saved)?;
+                let len = packed.len() as u64;
+                self.0 = Rendered::Saved(packed);
+                Ok(len)
+            }
+        }
+    }
+
+    /// Write the PDF file to `out`.  Object streams are packed from the
+    /// saved file, so with [`LayoutConfig::object_streams`] set the file is
+    /// still built in memory first.
+    pub fn write_to(self, out: &mut impl Write) -> Result<(), String> {
+        match self.0 {
+            Rendered::Patched {
+                mut doc,
+                object_streams: false,
+                ..
+            } => doc.save_to(out).map_err(|e| format!("Save PDF: {e}")),
+            rendered => {
+                let bytes = RenderedPdf(rendered).into_bytes()?;
+                out.write_all(&bytes).map_err(|e| format!("Save PDF: {e}"))
+            }
+        }
+    }
+}
+
+/// A writer that only counts the bytes written to it.
+#[derive(Default)]
+struct ByteCounter(u64);
+
+impl Write for ByteCounter {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.0 += buf.len() as u64;
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+/// Render a LayoutConfig like [`render_pdf_with_cache`], leaving the result
+/// to be written out (see [`RenderedPdf`]).
+pub fn render_document_with_cache(
+    config: &LayoutConfig,
+    fonts: &FontManager,
+    cache: Option<&dyn Cache>,
+) -> Result<RenderedPdf, String> {
+    if let Some(xmp) = &config.xmp {
+        crate::xmp::check_well_formed(xmp)?;
+    }
+    if let Some(unit) = config.user_unit {
+        check_user_unit(unit, config.page_width_pt, config.page_height_pt)?;
+    }
+
     let page_w = Mm(config.page_width_pt * 0.352778); // pt → mm
     let page_h = Mm(config.page_height_pt * 0.352778);
 
     let mut doc = PdfDocument::new(&config.title);
 
+    if config.text_as_outlines && !fonts.has_real_fonts() {
+        return Err(
+            "text_as_outlines is set but no font program is registered for Helvetica \
+             (see PipelineConfig::base_font)"
+                .to_string(),
+        );
+    }
+    // Outlined text references no font, so there is nothing to embed.
+    let embedded_fonts = if config.embed_base_fonts && !config.text_as_outlines {
+        embed_base_fonts(&mut doc, fonts, cache)?
+    } else {
+        HashMap::new()
+    };
+
     // ── Pre-register all images ────────────────────────────────────────────
-    let mut all_srcs: HashSet<&str> = HashSet::new();
+    // By resource key, since a filtered image is a different resource.
+    let mut all_srcs: HashMap<String, (&str, &[ImageFilter])> = HashMap::new();
+    let mut marker_srcs: HashSet<&str> = HashSet::new();
     for page_layout in &config.pages {
         for lbox in &page_layout.boxes {
-            collect_image_srcs(lbox, &mut all_srcs);
+            collect_image_srcs(lbox, &mut all_srcs, &mut marker_srcs);
         }
     }
+    if let Some(bg) = &config.page_background {
+        all_srcs.insert(bg.src.clone(), (bg.src.as_str(), &[]));
+    }
 
     let mut image_resources: HashMap<String, ImageResource> = HashMap::new();
+    // ICC profiles to tag image XObjects with, by resource name.
+    let mut image_profiles: HashMap<String, Vec<u8>> = HashMap::new();
     let mut img_warnings: Vec<PdfWarnMsg> = Vec::new();
 
-    for src in &all_srcs {
-        let bytes = match parse_data_uri(src) {
-            Ok(b) => b,
-            Err(e) => {
-                log::warn!("Skipping image — {e}");
-                continue;
-            }
-        };
-
-        // Decode with the `image` crate to obtain pixel dimensions.
-        let dyn_img = match ::image::load_from_memory(&bytes) {
-            Ok(img) => img,
+    // Grayscale conversion happens at decode time, so it is part of the key.
+    let image_kind = if config.grayscale { "gray-image" } else { "image" };
+    for (key, &(src, filter)) in &all_srcs {
+        let decoded = cache::get_or_insert(
+            cache,
+            || cache::cache_key(image_kind, key.as_bytes()),
+            || {
+                events::load_resource("render", src, || {
+                    let max_pixels = config.max_image_pixels;
+                    let gray = config.grayscale;
+                    decode_image(src, filter, max_pixels, gray, &mut img_warnings)
+                })
+            },
+        );
+        // A cached image may have been decoded under a looser limit.
+        let decoded = decoded.and_then(|d| {
+            check_pixel_limit(d.px_width, d.px_height, config.max_image_pixels)?;
+            Ok(d)
+        });
+        let decoded = match decoded {
+            Ok(d) => d,
             Err(e) => {
-                log::warn!("Skipping image — decode error: {e}");
+                diagnostics::missing_asset("render", format!("Skipping image — {e}"));
                 continue;
             }
         };
-        let (px_width, px_height) = (dyn_img.width(), dyn_img.height());
-
-        // Register with printpdf as a reusable XObject.
-        let raw = match RawImage::decode_from_bytes(&bytes, &mut img_warnings) {
-            Ok(r) => r,
-            Err(e) => {
-                log::warn!("Skipping image — PDF encode error: {e}");
-                continue;
+        let xobj_id = doc.add_image(&decoded.raw);
+        if let Some(profile) = decoded.icc_profile.as_ref() {
+            if config.image_color_management {
+                image_profiles.insert(xobj_id.0.clone(), profile.clone());
             }
-        };
-        let xobj_id = doc.add_image(&raw);
+        }
 
         image_resources.insert(
-            src.to_string(),
+            key.clone(),
             ImageResource {
                 xobj_id,
-                px_width,
-                px_height,
+                px_width: decoded.px_width,
+                px_height: decoded.px_height,
             },
         );
     }
+    for src in &marker_srcs {
+        if !image_resources.contains_key(*src) {
+            diagnostics::missing_asset(
+                "render",
+                "Drawing the default list marker — list-style-image could not be loaded",
+            );
+        }
+    }
 
     // ── Render pages ──────────────────────────────────────────────────────
     let mut pages = Vec::new();
 
-    for page_layout in &config.pages {
-        let mut ops = Vec::new();
-
-        for lbox in &page_layout.boxes {
-            render_box(&mut ops, lbox, config.page_height_pt, &image_resources);
-        }
+    let ctx = RenderContext {
+        page_width: config.page_width_pt,
+        page_height: config.page_height_pt,
+        background: config.page_background.as_ref(),
+        images: &image_resources,
+        embedded_fonts: &embedded_fonts,
+        outline_fonts: config.text_as_outlines.then_some(fonts),
+        min_line_width: config.min_line_width,
+        scale: config.viewport_scale.unwrap_or(1.0),
+        gradients: RefCell::default(),
+        grayscale: config.grayscale,
+    };
 
-        let page = PdfPage::new(page_w, page_h, ops);
+    for page_layout in &config.pages {
+        let page = PdfPage::new(page_w, page_h, page_ops(page_layout, &ctx));
         pages.push(page);
     }
 
     // Ensure at least one page.
     if pages.is_empty() {
-        pages.push(PdfPage::new(page_w, page_h, Vec::new()));
+        let blank = PageLayout {
+            page_index: 0,
+            boxes: Vec::new(),
+        };
+        pages.push(PdfPage::new(page_w, page_h, page_ops(&blank, &ctx)));
     }
 
     doc.with_pages(pages);
     let bytes = doc.save(&PdfSaveOptions::default(), &mut Vec::new());
+    drop(doc);
 
-    Ok(bytes)
+    let links: Vec<Vec<Link>> = if config.auto_link {
+        let scale = ctx.scale;
+        let page_links = |page| autolink::page_links(page, config.page_height_pt, scale, fonts);
+        config.pages.iter().map(page_links).collect()
+    } else {
+        Vec::new()
+    };
+    let dests = if config.named_destinations {
+        destinations::collect(&config.pages, config.page_height_pt, ctx.scale)
+    } else {
+        BTreeMap::new()
+    };
+    let gradients = ctx.gradients.into_inner();
+    post_process(bytes, config, &gradients, &links, &dests, &image_profiles)
 }
 
-/// Convert a UTF-8 string to raw Windows-1252 bytes then wrap in a String so
-/// printpdf writes the bytes unchanged into the PDF stream (builtin fonts use
-/// WinAnsiEncoding, so each glyph is one byte 0x00–0xFF).
-fn to_winlatin(s: &str) -> String {
-    let bytes: Vec<u8> = s
-        .chars()
-        .map(|c| match c {
-            '\u{20AC}' => 0x80, // euro
-            '\u{201A}' => 0x82, // single low-9 quote
-            '\u{201E}' => 0x84, // double low-9 quote
-            '\u{2026}' => 0x85, // ellipsis
-            '\u{2018}' => 0x91, // left single quote
-            '\u{2019}' => 0x92, // right single quote
-            '\u{201C}' => 0x93, // left double quote
-            '\u{201D}' => 0x94, // right double quote
-            '\u{2022}' => 0x95, // bullet
-            '\u{2013}' => 0x96, // en-dash
-            '\u{2014}' => 0x97, // em-dash
-            '\u{2122}' => 0x99, // trademark
-            '\u{00A0}' => 0x20, // non-breaking space -> space
-            c if (c as u32) < 256 => c as u8,
-            _ => b'?',
+/// Apply the settings printpdf has no API for by patching the saved file
+/// with lopdf.  `bytes` are returned untouched when none are set and no
+/// gradients, `links`, `dests` or `image_profiles` were drawn.
+fn post_process(
+    bytes: Vec<u8>,
+    config: &LayoutConfig,
+    gradients: &[GradientFill],
+    links: &[Vec<Link>],
+    dests: &BTreeMap<String, destinations::Destination>,
+    image_profiles: &HashMap<String, Vec<u8>>,
+) -> Result<RenderedPdf, String> {
+    let needed = !gradients.is_empty()
+        || links.iter().any(|l| !l.is_empty())
+        || !dests.is_empty()
+        || !image_profiles.is_empty()
+        || config.rendering_intent.is_some()
+        || config.xmp.is_some()
+        || config.strip_metadata
+        || config.optimize
+        || config.embed_base_fonts
+        || config.single_content_stream
+        || config.overlay_pdf.is_some()
+        || config.user_unit.is_some()
+        || config.object_streams
+        || config.producer.is_some()
+        || config.creator.is_some()
+        || config.page_mode != Default::default()
+        || !config.page_attachments.is_empty();
+    if !needed {
+        return Ok(bytes.into());
+    }
+    let mut doc = lopdf::Document::load_mem(&bytes).map_err(|e| format!("Reload PDF: {e}"))?;
+    drop(bytes);
+    if !gradients.is_empty() {
+        apply_gradients(&mut doc, gradients, config.grayscale)?;
+    }
+    if !image_profiles.is_empty() {
+        apply_image_profiles(&mut doc, image_profiles)?;
+    }
+    if let Some(overlay) = &config.overlay_pdf {
+        apply_overlay(&mut doc, overlay)?;
+    }
+    if let Some(intent) = config.rendering_intent {
+        apply_rendering_intent(&mut doc, intent)?;
+    }
+    if let Some(unit) = config.user_unit {
+        apply_user_unit(&mut doc, unit)?;
+    }
+    autolink::annotate(&mut doc, links, &config.link_style, config.user_unit.unwrap_or(1.0))?;
+    if !dests.is_empty() {
+        destinations::write(&mut doc, dests, config.user_unit.unwrap_or(1.0))?;
+    }
+    attachments::write(&mut doc, &config.page_attachments)?;
+    if let Some(xmp) = &config.xmp {
+        embed_xmp(&mut doc, xmp)?;
+    }
+    if config.page_mode != Default::default() {
+        let mode = lopdf::Object::Name(config.page_mode.pdf_name().into());
+        doc.catalog_mut()
+            .map_err(|e| format!("Read catalog: {e}"))?
+            .set("PageMode", mode);
+    }
+    let info_entries = [("Producer", &config.producer), ("Creator", &config.creator)];
+    for (key, value) in info_entries {
+        if let Some(value) = value {
+            set_info_entry(&mut doc, key, value)?;
+        }
+    }
+    if config.strip_metadata {
+        strip_metadata(&mut doc)?;
+    }
+    if config.embed_base_fonts {
+        set_font_compression(&mut doc, config.font_compression);
+    }
+    if config.single_content_stream {
+        merge_content_streams(&mut doc)?;
+    }
+    if config.optimize {
+        optimize(&mut doc);
+    }
+    // Object streams were introduced in PDF 1.5.
+    if config.object_streams && doc.version.as_str() < "1.5" {
+        doc.version = "1.5".to_string();
+    }
+    Ok(RenderedPdf(Rendered::Patched {
+        doc,
+        object_streams: config.object_streams,
+        size_hint: config.output_size_hint,
+    }))
+}
+
+/// `saved`, the file of `doc`, with its non-stream objects packed into
+/// object streams.
+fn pack_object_streams(doc: &lopdf::Document, saved: &[u8]) -> Result<Vec<u8>, String> {
+    let streams: HashSet<lopdf::ObjectId> = doc
+        .objects
+        .iter()
+        .filter(|(_, object)| matches!(object, lopdf::Object::Stream(_)))
+        .map(|(&id, _)| id)
+        .collect();
+    crate::object_streams::pack(saved, &streams)
+}
+
+/// Compress every embedded font program with FlateDecode, or decompress
+/// them all.
+fn set_font_compression(doc: &mut lopdf::Document, compress: bool) {
+    let programs: Vec<lopdf::ObjectId> = doc
+        .objects
+        .values()
+        .filter_map(|o| o.as_dict().ok())
+        .filter(|d| {
+            d.get(b"Type")
+                .and_then(lopdf::Object::as_name)
+                .is_ok_and(|n| n == b"FontDescriptor")
+        })
+        .flat_map(|d| {
+            [&b"FontFile"[..], b"FontFile2", b"FontFile3"]
+                .into_iter()
+                .filter_map(|key| d.get(key).and_then(lopdf::Object::as_reference).ok())
         })
         .collect();
-    // SAFETY: intentionally non-UTF-8 for 0x80-0x9F range; printpdf passes
-    // these bytes straight to the PDF stream, decoded by WinAnsiEncoding.
-    #[allow(unsafe_code)]
-    unsafe {
-        String::from_utf8_unchecked(bytes)
+    for id in programs {
+        let Ok(lopdf::Object::Stream(stream)) = doc.get_object_mut(id) else {
+            continue;
+        };
+        stream.allows_compression = compress;
+        let result = if compress {
+            stream.compress()
+        } else if stream.dict.has(b"Filter") {
+            stream.decompressed_content().map(|data| {
+                stream.dict.remove(b"Filter");
+                stream.dict.remove(b"DecodeParms");
+                stream.set_content(data);
+            })
+        } else {
+            Ok(())
+        };
+        if let Err(e) = result {
+            diagnostics::warn("render", format!("Font program left as is — {e}"));
+        }
     }
 }
 
-/// Parse a `data:<mime>;base64,<data>` URI and return the raw decoded bytes.
-///
-/// Returns `Err` if `src` is not a data URI or does not use base64 encoding.
-fn parse_data_uri(src: &str) -> Result<Vec<u8>, String> {
-    if !src.starts_with("data:") {
-        let preview = if src.len() > 80 { &src[..80] } else { src };
-        return Err(format!(
-            "Image src must be a base64 data URI \
-             (e.g. `data:image/png;base64,...`). Got: {preview:?}"
-        ));
+/// Replace every `/Contents` array with a single stream holding the
+/// concatenated content.  Streams no other page uses are dropped.
+fn merge_content_streams(doc: &mut lopdf::Document) -> Result<(), String> {
+    use lopdf::Object;
+
+    let mut arrays = Vec::new();
+    let mut uses: HashMap<lopdf::ObjectId, usize> = HashMap::new();
+    for page_id in doc.get_pages().into_values() {
+        let streams = doc.get_page_contents(page_id);
+        for id in &streams {
+            *uses.entry(*id).or_default() += 1;
+        }
+        let is_array = doc
+            .get_dictionary(page_id)
+            .and_then(|page| page.get_deref(b"Contents", doc))
+            .is_ok_and(|contents| matches!(contents, Object::Array(_)));
+        if is_array {
+            arrays.push((page_id, streams));
+        }
     }
-    let rest = &src["data:".len()..];
-    let comma_pos = rest.find(',').ok_or_else(|| {
-        "Invalid data URI: missing `,` separator between header and data".to_string()
-    })?;
-    let header = &rest[..comma_pos];
-    if !header.contains(";base64") {
-        return Err("Only base64-encoded data URIs are supported. \
-             The header must contain `;base64` (e.g. `data:image/png;base64,...`)."
-            .to_string());
+
+    for (page_id, streams) in arrays {
+        let mut content = Vec::new();
+        for id in &streams {
+            let stream = doc
+                .get_object(*id)
+                .and_then(Object::as_stream)
+                .map_err(|e| format!("Read page content: {e}"))?;
+            let data = if stream.dict.has(b"Filter") {
+                stream
+                    .decompressed_content()
+                    .map_err(|e| format!("Read page content: {e}"))?
+            } else {
+                stream.content.clone()
+            };
+            content.extend(data);
+            // Operators must not run together across the old boundaries.
+            content.push(b'\n');
+        }
+        let mut merged = lopdf::Stream::new(lopdf::Dictionary::new(), content);
+        // Best effort: an uncompressed stream is still valid.
+        let _ = merged.compress();
+        let merged_id = doc.add_object(merged);
+        doc.get_dictionary_mut(page_id)
+            .map_err(|e| format!("Write page content: {e}"))?
+            .set("Contents", merged_id);
+        for id in streams {
+            if uses.get(&id) == Some(&1) {
+                doc.objects.remove(&id);
+            }
+        }
     }
-    let b64_data = rest[comma_pos + 1..].trim();
-    BASE64_STD
-        .decode(b64_data)
-        .map_err(|e| format!("Base64 decode error: {e}"))
+    Ok(())
 }
 
-/// Recursively collect all unique `image.src` strings from a [`LayoutBox`] tree.
-fn collect_image_srcs<'a>(lbox: &'a LayoutBox, srcs: &mut HashSet<&'a str>) {
-    if let Some(img) = &lbox.image {
-        srcs.insert(img.src.as_str());
+/// Prefix every page's content stream with `/<Intent> ri`.
+fn apply_rendering_intent(
+    doc: &mut lopdf::Document,
+    intent: crate::layout_config::RenderingIntent,
+) -> Result<(), String> {
+    let prefix = format!("/{} ri\n", intent.pdf_name());
+    for page_id in doc.get_pages().into_values() {
+        let mut content = prefix.clone().into_bytes();
+        content.extend(
+            doc.get_page_content(page_id)
+                .map_err(|e| format!("Read page content: {e}"))?,
+        );
+        doc.change_page_content(page_id, content)
+            .map_err(|e| format!("Write page content: {e}"))?;
     }
-    for child in &lbox.children {
-        collect_image_srcs(child, srcs);
+    Ok(())
+}
+
+/// Replace the placeholders left by [`push_gradient`] with `sh` operators and
+/// add the shadings they paint to the page resources, in `/DeviceGray` when
+/// `gray` is set.
+fn apply_gradients(
+    doc: &mut lopdf::Document,
+    fills: &[GradientFill],
+    gray: bool,
+) -> Result<(), String> {
+    use lopdf::content::Content;
+
+    let shadings: Vec<lopdf::ObjectId> = fills
+        .iter()
+        .map(|fill| doc.add_object(shading_dict(fill, gray)))
+        .collect();
+    for page_id in doc.get_pages().into_values() {
+        let content = doc
+            .get_page_content(page_id)
+            .map_err(|e| format!("Read page content: {e}"))?;
+        let mut content =
+            Content::decode(&content).map_err(|e| format!("Read page content: {e}"))?;
+        let mut used = lopdf::Dictionary::new();
+        let mut operations = Vec::with_capacity(content.operations.len());
+        let mut ops = content.operations.into_iter().peekable();
+        while let Some(op) = ops.next() {
+            let index = gradient_index(&op).filter(|&i| i < fills.len());
+            let Some(index) = index else {
+                operations.push(op);
+                continue;
+            };
+            if ops.peek().is_some_and(|next| next.operator == "EMC") {
+                ops.next();
+            }
+            let name = format!("Sh{index}");
+            operations.extend(shading_ops(&fills[index], &name));
+            used.set(name, shadings[index]);
+        }
+        content.operations = operations;
+        if used.is_empty() {
+            continue;
+        }
+        let encoded = content
+            .encode()
+            .map_err(|e| format!("Write page content: {e}"))?;
+        doc.change_page_content(page_id, encoded)
+            .map_err(|e| format!("Write page content: {e}"))?;
+        add_page_resources(doc, page_id, "Shading", used)?;
     }
+    Ok(())
 }
 
-/// Recursively render a LayoutBox and its children into PDF ops.
-fn render_box(
-    ops: &mut Vec<Op>,
-    lbox: &LayoutBox,
-    page_height: f32,
-    images: &HashMap<String, ImageResource>,
-) {
-    // PDF coordinate system: origin at bottom-left.
-    // Our layout uses origin at top-left. Convert:
-    let pdf_y = page_height - lbox.y;
+/// Resource name of the form XObject [`apply_overlay`] draws.
+const OVERLAY_NAME: &str = "PdfForgeOverlay";
 
-    // Background
-    if let Some(bg) = &lbox.background_color {
-        ops.push(Op::SetFillColor {
-            col: Color::Rgb(Rgb {
-                r: bg[0],
-                g: bg[1],
-                b: bg[2],
-                icc_profile: None,
-            }),
-        });
+/// Copy page `overlay.page` of the overlay PDF into `doc` as a form XObject
+/// and draw it on every page, beneath or over the existing content.
+fn apply_overlay(doc: &mut lopdf::Document, overlay: &PdfOverlay) -> Result<(), String> {
+    use lopdf::{dictionary, Object, Stream};
 
-        // Draw filled rectangle
-        let x1 = lbox.x;
-        let y1 = pdf_y - lbox.height;
-        let x2 = lbox.x + lbox.width;
-        let y2 = pdf_y;
+    let source = lopdf::Document::load_mem(&parse_data_uri(&overlay.src)?)
+        .map_err(|e| format!("Overlay PDF: {e}"))?;
+    let pages = source.get_pages();
+    let source_page = u32::try_from(overlay.page)
+        .ok()
+        .and_then(|n| pages.get(&n))
+        .copied()
+        .ok_or_else(|| {
+            format!(
+                "Overlay PDF has no page {} (it has {})",
+                overlay.page,
+                pages.len()
+            )
+        })?;
+    let content = source
+        .get_page_content(source_page)
+        .map_err(|e| format!("Overlay PDF: {e}"))?;
+    let bbox = inherited_attribute(&source, source_page, b"CropBox")
+        .or_else(|| inherited_attribute(&source, source_page, b"MediaBox"))
+        .ok_or("Overlay PDF: page has no MediaBox")?;
+    let resources = inherited_attribute(&source, source_page, b"Resources")
+        .cloned()
+        .unwrap_or_else(|| lopdf::Dictionary::new().into());
 
-        ops.push(Op::DrawPolygon {
-            polygon: Polygon {
-                rings: vec![PolygonRing {
-                    points: vec![
-                        LinePoint {
-                            p: Point {
-                                x: Pt(x1),
-                                y: Pt(y1),
-                            },
-                            bezier: false,
-                        },
-                        LinePoint {
-                            p: Point {
-                                x: Pt(x2),
-                                y: Pt(y1),
-                            },
-                            bezier: false,
-                        },
-                        LinePoint {
-                            p: Point {
-                                x: Pt(x2),
-                                y: Pt(y2),
-                            },
-                            bezier: false,
-                        },
-                        LinePoint {
-                            p: Point {
-                                x: Pt(x1),
-                                y: Pt(y2),
-                            },
-                            bezier: false,
-                        },
-                    ],
-                }],
-                mode: PaintMode::Fill,
-                winding_order: WindingOrder::NonZero,
-            },
-        });
+    let mut copied = HashMap::new();
+    let bbox = import_object(doc, &source, bbox, &mut copied);
+    let resources = import_object(doc, &source, &resources, &mut copied);
+    let mut form = Stream::new(
+        dictionary! {
+            "Type" => "XObject",
+            "Subtype" => "Form",
+            "BBox" => bbox,
+            "Resources" => resources,
+        },
+        content,
+    );
+    // Best effort: an uncompressed stream is still valid.
+    let _ = form.compress();
+    let form_id = doc.add_object(form);
+
+    let draw = format!("q /{OVERLAY_NAME} Do Q\n");
+    for page_id in doc.get_pages().into_values() {
+        let existing = doc
+            .get_page_content(page_id)
+            .map_err(|e| format!("Read page content: {e}"))?;
+        // Wrapped in q/Q so state the content leaves set cannot move the
+        // overlay drawn after it.
+        let mut content = Vec::with_capacity(existing.len() + 2 * draw.len());
+        if overlay.behind {
+            content.extend_from_slice(draw.as_bytes());
+        }
+        content.extend_from_slice(b"q\n");
+        content.extend(existing);
+        content.extend_from_slice(b"\nQ\n");
+        if !overlay.behind {
+            content.extend_from_slice(draw.as_bytes());
+        }
+        doc.change_page_content(page_id, content)
+            .map_err(|e| format!("Write page content: {e}"))?;
+        let mut form = lopdf::Dictionary::new();
+        form.set(OVERLAY_NAME, form_id);
+        add_page_resources(doc, page_id, "XObject", form)?;
     }
+    Ok(())
+}
 
-    // Border
-    if let Some(border) = &lbox.border {
-        ops.push(Op::SetOutlineColor {
-            col: Color::Rgb(Rgb {
-                r: border.color[0],
-                g: border.color[1],
-                b: border.color[2],
-                icc_profile: None,
-            }),
-        });
-        ops.push(Op::SetOutlineThickness {
-            pt: Pt(border.width),
-        });
+/// `key` of page `page_id`, looked up through the `/Parent` chain as the
+/// inheritable page attributes are.
+fn inherited_attribute<'a>(
+    doc: &'a lopdf::Document,
+    page_id: lopdf::ObjectId,
+    key: &[u8],
+) -> Option<&'a lopdf::Object> {
+    let mut node = page_id;
+    // Bounded, in case a broken file's parents form a cycle.
+    for _ in 0..32 {
+        let dict = doc.get_dictionary(node).ok()?;
+        if let Ok(value) = dict.get_deref(key, doc) {
+            return Some(value);
+        }
+        node = dict.get(b"Parent").ok()?.as_reference().ok()?;
+    }
+    None
+}
 
-        let x1 = lbox.x;
-        let y1 = pdf_y - lbox.height;
-        let x2 = lbox.x + lbox.width;
-        let y2 = pdf_y;
+/// Copy `object` from `source` into `target`, together with every object it
+/// refers to; `copied` maps source ids to their copies so each is copied
+/// once.
+fn import_object(
+    target: &mut lopdf::Document,
+    source: &lopdf::Document,
+    object: &lopdf::Object,
+    copied: &mut HashMap<lopdf::ObjectId, lopdf::ObjectId>,
+) -> lopdf::Object {
+    use lopdf::Object;
 
-        ops.push(Op::DrawLine {
-            line: Line {
-                points: vec![
-                    LinePoint {
-                        p: Point {
-                            x: Pt(x1),
-                            y: Pt(y2),
-                        },
-                        bezier: false,
-                    },
-                    LinePoint {
-                        p: Point {
-                            x: Pt(x2),
-                            y: Pt(y2),
+    match object {
+        Object::Reference(id) => {
+            if let Some(&new_id) = copied.get(id) {
+                return Object::Reference(new_id);
+            }
+            let new_id = target.new_object_id();
+            copied.insert(*id, new_id);
+            let value = match source.get_object(*id) {
+                Ok(value) => import_object(target, source, value, copied),
+                Err(_) => Object::Null,
+            };
+            target.objects.insert(new_id, value);
+            Object::Reference(new_id)
+        }
+        Object::Array(items) => Object::Array(
+            items
+                .iter()
+                .map(|item| import_object(target, source, item, copied))
+                .collect(),
+        ),
+        Object::Dictionary(dict) => Object::Dictionary(import_dict(target, source, dict, copied)),
+        Object::Stream(stream) => {
+            let dict = import_dict(target, source, &stream.dict, copied);
+            let mut stream = stream.clone();
+            stream.dict = dict;
+            Object::Stream(stream)
+        }
+        other => other.clone(),
+    }
+}
+
+fn import_dict(
+    target: &mut lopdf::Document,
+    source: &lopdf::Document,
+    dict: &lopdf::Dictionary,
+    copied: &mut HashMap<lopdf::ObjectId, lopdf::ObjectId>,
+) -> lopdf::Dictionary {
+    let mut out = lopdf::Dictionary::new();
+    for (key, value) in dict.iter() {
+        out.set(key.clone(), import_object(target, source, value, copied));
+    }
+    out
+}
+
+/// The index in a `/PdfForgeGradient<n> BMC` placeholder.
+fn gradient_index(op: &lopdf::content::Operation) -> Option<usize> {
+    if op.operator != "BMC" {
+        return None;
+    }
+    let tag = op.operands.first()?.as_name().ok()?;
+    std::str::from_utf8(tag.strip_prefix(GRADIENT_TAG.as_bytes())?)
+        .ok()?
+        .parse()
+        .ok()
+}
+
+/// Tag the image XObjects named in `profiles` with their ICC profile as an
+/// `/ICCBased` colour space.  A profile for another number of components
+/// than the samples have (a CMYK JPEG is decoded to RGB) is left out with a
+/// diagnostic.
+fn apply_image_profiles(
+    doc: &mut lopdf::Document,
+    profiles: &HashMap<String, Vec<u8>>,
+) -> Result<(), String> {
+    use lopdf::Object;
+
+    let mut images = Vec::new();
+    for page_id in doc.get_pages().into_values() {
+        let xobjects = inherited_attribute(doc, page_id, b"Resources")
+            .and_then(|r| r.as_dict().ok())
+            .and_then(|r| r.get_deref(b"XObject", doc).ok())
+            .and_then(|x| x.as_dict().ok());
+        for (name, object) in xobjects.into_iter().flat_map(|x| x.iter()) {
+            let profile = profiles.get(String::from_utf8_lossy(name).as_ref());
+            if let (Some(profile), Ok(id)) = (profile, object.as_reference()) {
+                images.push((id, profile));
+            }
+        }
+    }
+    let mut tagged = HashSet::new();
+    for (id, profile) in images {
+        if !tagged.insert(id) {
+            continue;
+        }
+        let image = doc.get_object(id).and_then(Object::as_stream);
+        let color_space = image.and_then(|i| i.dict.get(b"ColorSpace"));
+        let components = match color_space.and_then(Object::as_name) {
+            Ok(b"DeviceRGB") => 3,
+            Ok(b"DeviceGray") => 1,
+            _ => continue,
+        };
+        if icc_components(profile) != Some(components) {
+            diagnostics::warn(
+                "render",
+                "Drawing an image as device colour — its ICC profile does not match its samples",
+            );
+            continue;
+        }
+        let mut icc = lopdf::Stream::new(lopdf::dictionary! { "N" => components }, profile.clone());
+        let _ = icc.compress();
+        let icc_id = doc.add_object(icc);
+        let color_space = vec![Object::Name(b"ICCBased".to_vec()), Object::Reference(icc_id)];
+        doc.get_object_mut(id)
+            .and_then(Object::as_stream_mut)
+            .map_err(|e| format!("Read image: {e}"))?
+            .dict
+            .set("ColorSpace", color_space);
+    }
+    Ok(())
+}
+
+/// Number of colour components of an ICC profile, from the data colour
+/// space in its header.
+fn icc_components(profile: &[u8]) -> Option<i64> {
+    match profile.get(16..20)? {
+        b"GRAY" => Some(1),
+        b"RGB " => Some(3),
+        b"CMYK" => Some(4),
+        _ => None,
+    }
+}
+
+/// Merge `entries` into the `category` (`Shading`, `XObject`, …) resources
+/// of the page.
+fn add_page_resources(
+    doc: &mut lopdf::Document,
+    page_id: lopdf::ObjectId,
+    category: &str,
+    entries: lopdf::Dictionary,
+) -> Result<(), String> {
+    use lopdf::Object;
+
+    let shared = doc
+        .get_dictionary(page_id)
+        .map_err(|e| format!("Read page: {e}"))?
+        .get(b"Resources")
+        .and_then(Object::as_reference)
+        .ok();
+    let resources = match shared {
+        Some(id) => doc.get_dictionary_mut(id),
+        None => {
+            let page = doc
+                .get_dictionary_mut(page_id)
+                .map_err(|e| format!("Read page: {e}"))?;
+            if !page.get(b"Resources").is_ok_and(|r| r.as_dict().is_ok()) {
+                page.set("Resources", lopdf::Dictionary::new());
+            }
+            page.get_mut(b"Resources").and_then(Object::as_dict_mut)
+        }
+    }
+    .map_err(|e| format!("Read page resources: {e}"))?;
+    match resources.get_mut(category.as_bytes()) {
+        Ok(Object::Dictionary(existing)) => existing.extend(&entries),
+        _ => resources.set(category, entries),
+    }
+    Ok(())
+}
+
+/// An axial (type 2) or radial (type 3) shading for `fill`.
+///
+/// A linear gradient runs through the box centre along its angle, with the
+/// length CSS gives it: the ends meet the perpendiculars through the far
+/// corners.  A radial gradient is defined on the unit circle and scaled to
+/// the box by [`shading_ops`].
+fn shading_dict(fill: &GradientFill, gray: bool) -> lopdf::Dictionary {
+    use lopdf::Object;
+
+    let [x1, y1, x2, y2] = fill.rect;
+    let (w, h) = (x2 - x1, y2 - y1);
+    let (cx, cy) = ((x1 + x2) / 2.0, (y1 + y2) / 2.0);
+    let (shading_type, coords) = match linear_direction(fill.gradient.shape, w, h) {
+        Some((dx, dy)) => {
+            let half = (w * dx.abs() + h * dy.abs()) / 2.0;
+            let (sx, sy) = (cx - dx * half, cy - dy * half);
+            (2, vec![sx, sy, cx + dx * half, cy + dy * half])
+        }
+        None => (3, vec![0.0, 0.0, 0.0, 0.0, 0.0, 1.0]),
+    };
+    lopdf::dictionary! {
+        "ShadingType" => shading_type,
+        "ColorSpace" => if gray { "DeviceGray" } else { "DeviceRGB" },
+        "Coords" => coords.into_iter().map(Object::Real).collect::<Vec<_>>(),
+        "Function" => gradient_function(&fill.gradient.stops, gray),
+        "Extend" => vec![Object::Boolean(true), Object::Boolean(true)],
+    }
+}
+
+/// Unit direction of a linear gradient in PDF space (y up), or `None` for a
+/// radial one.
+fn linear_direction(shape: GradientShape, w: f32, h: f32) -> Option<(f32, f32)> {
+    match shape {
+        GradientShape::Linear { angle } => Some(angle.to_radians().sin_cos()),
+        // Perpendicular to the diagonal between the other two corners.
+        GradientShape::LinearToCorner { x, y } => {
+            let len = w.hypot(h);
+            Some((x * h / len, -y * w / len))
+        }
+        GradientShape::Radial { .. } => None,
+    }
+}
+
+/// A function from `0..1` to the stop colours (their gray levels when `gray`
+/// is set): exponential (type 2) for two stops, otherwise one per pair of
+/// stops stitched together (type 3).
+fn gradient_function(stops: &[GradientStop], gray: bool) -> lopdf::Dictionary {
+    use lopdf::Object;
+
+    let unit = || vec![Object::Integer(0), Object::Integer(1)];
+    let components = |c: [f32; 4]| {
+        if gray {
+            vec![Object::Real(gray_level(c))]
+        } else {
+            c[..3].iter().map(|&v| Object::Real(v)).collect::<Vec<_>>()
+        }
+    };
+    let segment = |a: &GradientStop, b: &GradientStop| {
+        lopdf::dictionary! {
+            "FunctionType" => 2,
+            "Domain" => unit(),
+            "C0" => components(a.color),
+            "C1" => components(b.color),
+            "N" => 1,
+        }
+    };
+    if let [a, b] = stops {
+        return segment(a, b);
+    }
+    let functions: Vec<Object> = stops
+        .windows(2)
+        .map(|pair| segment(&pair[0], &pair[1]).into())
+        .collect();
+    let bounds: Vec<Object> = stops[1..stops.len() - 1]
+        .iter()
+        .map(|stop| Object::Real(stop.offset))
+        .collect();
+    let encode: Vec<Object> = functions.iter().flat_map(|_| unit()).collect();
+    lopdf::dictionary! {
+        "FunctionType" => 3,
+        "Domain" => unit(),
+        "Functions" => functions,
+        "Bounds" => bounds,
+        "Encode" => encode,
+    }
+}
+
+/// The operators painting shading `name` for `fill`; a radial shading is
+/// scaled from the unit circle to one (or an ellipse with the box's
+/// proportions) that passes through the box corners.
+fn shading_ops(fill: &GradientFill, name: &str) -> Vec<lopdf::content::Operation> {
+    use lopdf::content::Operation;
+    use lopdf::Object;
+
+    let paint = Operation::new("sh", vec![Object::Name(name.as_bytes().to_vec())]);
+    let GradientShape::Radial { circle } = fill.gradient.shape else {
+        return vec![paint];
+    };
+    let [x1, y1, x2, y2] = fill.rect;
+    let (w, h) = (x2 - x1, y2 - y1);
+    let (rx, ry) = if circle {
+        let r = w.hypot(h) / 2.0;
+        (r, r)
+    } else {
+        (w / std::f32::consts::SQRT_2, h / std::f32::consts::SQRT_2)
+    };
+    let matrix = [rx, 0.0, 0.0, ry, (x1 + x2) / 2.0, (y1 + y2) / 2.0];
+    vec![
+        Operation::new("q", vec![]),
+        Operation::new("cm", matrix.into_iter().map(Object::Real).collect()),
+        paint,
+        Operation::new("Q", vec![]),
+    ]
+}
+
+/// Largest page box side viewers accept, in (user) units.
+pub const MAX_PAGE_UNITS: f32 = 14_400.0;
+
+/// Range of `/UserUnit` factors accepted, as Acrobat does.
+const USER_UNIT_RANGE: std::ops::RangeInclusive<f32> = 1.0..=75_000.0;
+
+fn check_user_unit(unit: f32, page_width: f32, page_height: f32) -> Result<(), String> {
+    if !USER_UNIT_RANGE.contains(&unit) {
+        return Err(format!(
+            "User unit {unit} is outside {}..={}",
+            USER_UNIT_RANGE.start(),
+            USER_UNIT_RANGE.end()
+        ));
+    }
+    let longest = page_width.max(page_height) / unit;
+    if longest > MAX_PAGE_UNITS {
+        return Err(format!(
+            "A {page_width}×{page_height} pt page is {longest} units long at user unit \
+             {unit}; the limit is {MAX_PAGE_UNITS}"
+        ));
+    }
+    Ok(())
+}
+
+/// Set `/UserUnit` on every page, dividing the page boxes by `unit` and
+/// scaling the content (laid out in points) down to match, so the physical
+/// size is unchanged.
+fn apply_user_unit(doc: &mut lopdf::Document, unit: f32) -> Result<(), String> {
+    use lopdf::Object;
+
+    let prefix = format!("{} 0 0 {} 0 0 cm\n", 1.0 / unit, 1.0 / unit);
+    for page_id in doc.get_pages().into_values() {
+        let mut content = prefix.clone().into_bytes();
+        content.extend(
+            doc.get_page_content(page_id)
+                .map_err(|e| format!("Read page content: {e}"))?,
+        );
+        doc.change_page_content(page_id, content)
+            .map_err(|e| format!("Write page content: {e}"))?;
+
+        let page = doc
+            .get_dictionary_mut(page_id)
+            .map_err(|e| format!("Read page: {e}"))?;
+        for key in ["MediaBox", "CropBox", "BleedBox", "TrimBox", "ArtBox"] {
+            if let Ok(Object::Array(corners)) = page.get_mut(key.as_bytes()) {
+                for corner in corners.iter_mut() {
+                    if let Ok(v) = corner.as_float() {
+                        *corner = Object::Real(v / unit);
+                    }
+                }
+            }
+        }
+        page.set("UserUnit", Object::Real(unit));
+    }
+    // `/UserUnit` was introduced in PDF 1.6.
+    if doc.version.as_str() < "1.6" {
+        doc.version = "1.6".to_string();
+    }
+    Ok(())
+}
+
+/// Set `key` of the Info dictionary to the text string `value`, creating the
+/// dictionary if the file has none.
+fn set_info_entry(doc: &mut lopdf::Document, key: &str, value: &str) -> Result<(), String> {
+    let info = match doc.trailer.get(b"Info") {
+        Ok(lopdf::Object::Reference(id)) => *id,
+        _ => {
+            let id = doc.add_object(lopdf::dictionary! {});
+            doc.trailer.set("Info", id);
+            id
+        }
+    };
+    // Text strings outside ASCII are written as UTF-16BE with a byte order mark.
+    let bytes = if value.is_ascii() {
+        value.as_bytes().to_vec()
+    } else {
+        let units = value.encode_utf16().flat_map(u16::to_be_bytes);
+        [0xFE, 0xFF].into_iter().chain(units).collect()
+    };
+    let value = lopdf::Object::String(bytes, lopdf::StringFormat::Literal);
+    doc.get_dictionary_mut(info)
+        .map_err(|e| format!("Read Info dictionary: {e}"))?
+        .set(key, value);
+    Ok(())
+}
+
+/// Drop the Info dictionary (title, producer, dates) and the XMP stream, and
+/// replace the file identifier with zeros.
+fn strip_metadata(doc: &mut lopdf::Document) -> Result<(), String> {
+    if let Some(lopdf::Object::Reference(id)) = doc.trailer.remove(b"Info") {
+        doc.objects.remove(&id);
+    }
+    let zero = lopdf::Object::String(vec![0; 16], lopdf::StringFormat::Hexadecimal);
+    doc.trailer
+        .set("ID", lopdf::Object::Array(vec![zero.clone(), zero]));
+
+    let metadata = doc
+        .catalog_mut()
+        .map_err(|e| format!("Read catalog: {e}"))?
+        .remove(b"Metadata");
+    if let Some(lopdf::Object::Reference(id)) = metadata {
+        doc.objects.remove(&id);
+    }
+    Ok(())
+}
+
+/// Merge identical objects, then drop everything unreachable from the
+/// trailer (mark-and-sweep) and renumber what is left.
+fn optimize(doc: &mut lopdf::Document) {
+    // Merging can make the objects that referenced the duplicates identical
+    // in turn, so repeat until nothing changes.
+    loop {
+        let duplicates = duplicate_objects(doc);
+        if duplicates.is_empty() {
+            break;
+        }
+        for object in doc.objects.values_mut() {
+            remap_references(object, &duplicates);
+        }
+        for (_, object) in doc.trailer.iter_mut() {
+            remap_references(object, &duplicates);
+        }
+        for id in duplicates.keys() {
+            doc.objects.remove(id);
+        }
+    }
+    doc.prune_objects();
+    doc.renumber_objects();
+}
+
+/// Map each shareable object that is identical to an earlier one onto that
+/// earlier object.  Only streams (font programs, images, form XObjects) and
+/// font, font descriptor and graphics state dictionaries are merged: pages,
+/// annotations, outline items and structure elements each belong to one
+/// parent and must stay separate objects.
+fn duplicate_objects(doc: &lopdf::Document) -> HashMap<lopdf::ObjectId, lopdf::ObjectId> {
+    let mut first: HashMap<Vec<u8>, lopdf::ObjectId> = HashMap::new();
+    let mut duplicates = HashMap::new();
+    for (&id, object) in &doc.objects {
+        let shareable = match object {
+            lopdf::Object::Stream(_) => true,
+            lopdf::Object::Dictionary(dict) => dict
+                .get(b"Type")
+                .and_then(lopdf::Object::as_name)
+                .is_ok_and(|t| matches!(t, b"Font" | b"FontDescriptor" | b"ExtGState")),
+            _ => false,
+        };
+        if !shareable {
+            continue;
+        }
+        let mut key = Vec::new();
+        object_key(object, &mut key);
+        match first.get(&key) {
+            Some(&canonical) => {
+                duplicates.insert(id, canonical);
+            }
+            None => {
+                first.insert(key, id);
+            }
+        }
+    }
+    duplicates
+}
+
+/// Append an unambiguous encoding of `object` to `key`: equal keys mean
+/// equal objects.
+fn object_key(object: &lopdf::Object, key: &mut Vec<u8>) {
+    use lopdf::Object;
+
+    match object {
+        Object::Null => key_field(key, b'n', &[]),
+        Object::Boolean(b) => key_field(key, b'b', &[*b as u8]),
+        Object::Integer(i) => key_field(key, b'i', &i.to_le_bytes()),
+        Object::Real(r) => key_field(key, b'f', r.to_string().as_bytes()),
+        Object::Name(name) => key_field(key, b'/', name),
+        Object::String(text, lopdf::StringFormat::Hexadecimal) => key_field(key, b'<', text),
+        Object::String(text, _) => key_field(key, b'(', text),
+        Object::Reference((number, generation)) => {
+            key_field(key, b'R', &number.to_le_bytes());
+            key_field(key, b'G', &generation.to_le_bytes());
+        }
+        Object::Array(items) => {
+            key_field(key, b'[', &(items.len() as u64).to_le_bytes());
+            for item in items {
+                object_key(item, key);
+            }
+        }
+        Object::Dictionary(dict) => dictionary_key(dict, key),
+        Object::Stream(stream) => {
+            dictionary_key(&stream.dict, key);
+            key_field(key, b's', &stream.content);
+        }
+    }
+}
+
+fn dictionary_key(dict: &lopdf::Dictionary, key: &mut Vec<u8>) {
+    key_field(key, b'{', &(dict.len() as u64).to_le_bytes());
+    for (name, value) in dict.iter() {
+        key_field(key, b'/', name);
+        object_key(value, key);
+    }
+}
+
+/// One tagged, length-prefixed field of an [`object_key`].
+fn key_field(key: &mut Vec<u8>, tag: u8, data: &[u8]) {
+    key.push(tag);
+    key.extend_from_slice(&(data.len() as u64).to_le_bytes());
+    key.extend_from_slice(data);
+}
+
+fn remap_references(
+    object: &mut lopdf::Object,
+    map: &HashMap<lopdf::ObjectId, lopdf::ObjectId>,
+) {
+    match object {
+        lopdf::Object::Reference(id) => {
+            if let Some(target) = map.get(id) {
+                *id = *target;
+            }
+        }
+        lopdf::Object::Array(items) => {
+            for item in items {
+                remap_references(item, map);
+            }
+        }
+        lopdf::Object::Dictionary(dict) => {
+            for (_, value) in dict.iter_mut() {
+                remap_references(value, map);
+            }
+        }
+        lopdf::Object::Stream(stream) => {
+            for (_, value) in stream.dict.iter_mut() {
+                remap_references(value, map);
+            }
+        }
+        _ => {}
+    }
+}
+
+/// Store `xmp` verbatim (uncompressed, as XMP readers expect) as the
+/// catalog's `/Metadata` stream, replacing any existing one.
+fn embed_xmp(doc: &mut lopdf::Document, xmp: &str) -> Result<(), String> {
+    let stream = lopdf::Stream::new(
+        lopdf::dictionary! { "Type" => "Metadata", "Subtype" => "XML" },
+        xmp.as_bytes().to_vec(),
+    )
+    .with_compression(false);
+    let id = doc.add_object(stream);
+    doc.catalog_mut()
+        .map_err(|e| format!("Read catalog: {e}"))?
+        .set("Metadata", lopdf::Object::Reference(id));
+    Ok(())
+}
+
+/// Decode a data-URI image into its pixel dimensions and printpdf form, with
+/// `filter` applied and converted to grayscale when `gray` is set.  The size
+/// in the image header is checked against `max_pixels` before anything is
+/// decoded.
+fn decode_image(
+    src: &str,
+    filter: &[ImageFilter],
+    max_pixels: Option<u64>,
+    gray: bool,
+    warnings: &mut Vec<PdfWarnMsg>,
+) -> Result<DecodedImage, String> {
+    use ::image::ImageDecoder as _;
+
+    let bytes = parse_data_uri(src)?;
+
+    let mut decoder = ::image::ImageReader::new(std::io::Cursor::new(&bytes))
+        .with_guessed_format()
+        .map_err(|e| format!("decode error: {e}"))?
+        .into_decoder()
+        .map_err(|e| format!("decode error: {e}"))?;
+    let (width, height) = decoder.dimensions();
+    check_pixel_limit(width, height, max_pixels)?;
+    let icc_profile = decoder.icc_profile().ok().flatten();
+
+    let filtered;
+    let (bytes, gray_samples) = if filter.is_empty() {
+        (&bytes, false)
+    } else {
+        filtered = filtered_png(&bytes, filter)?;
+        (&filtered.0, filtered.1)
+    };
+    // Only the header is read here; a broken profile is just not used.  A
+    // colour profile does not describe the gray samples written instead.
+    let icc_profile = icc_profile.filter(|_| !gray && !gray_samples);
+
+    let gray_png;
+    let bytes = if gray && !gray_samples {
+        gray_png = grayscale_png(bytes)?;
+        &gray_png
+    } else {
+        bytes
+    };
+    // Registered with printpdf as a reusable XObject by the caller.
+    let raw = RawImage::decode_from_bytes(bytes, warnings)
+        .map_err(|e| format!("PDF encode error: {e}"))?;
+    Ok(DecodedImage {
+        raw,
+        px_width: width,
+        px_height: height,
+        icc_profile,
+    })
+}
+
+/// `bytes` with the CSS `filter` functions applied, re-encoded as a PNG,
+/// and whether its samples came out gray.  An image left with every pixel
+/// gray is written with gray samples, so `grayscale(1)` embeds a
+/// `/DeviceGray` image, and one left opaque without an alpha channel.
+fn filtered_png(bytes: &[u8], filter: &[ImageFilter]) -> Result<(Vec<u8>, bool), String> {
+    let mut image = ::image::load_from_memory(bytes)
+        .map_err(|e| format!("decode error: {e}"))?
+        .to_rgba8();
+    for pixel in image.pixels_mut() {
+        let [r, g, b, a] = pixel.0.map(|c| c as f32 / 255.0);
+        let (mut rgb, mut alpha) = ([r, g, b], a);
+        for f in filter {
+            f.apply(&mut rgb, &mut alpha);
+        }
+        let [r, g, b] = rgb.map(|c| (c * 255.0).round() as u8);
+        pixel.0 = [r, g, b, (alpha * 255.0).round() as u8];
+    }
+    let gray = image.pixels().all(|p| p[0] == p[1] && p[1] == p[2]);
+    let alpha = image.pixels().any(|p| p[3] < 255);
+    let image = ::image::DynamicImage::ImageRgba8(image);
+    let image = match (gray, alpha) {
+        (true, true) => ::image::DynamicImage::ImageLumaA8(image.to_luma_alpha8()),
+        (true, false) => ::image::DynamicImage::ImageLuma8(image.to_luma8()),
+        (false, true) => image,
+        (false, false) => ::image::DynamicImage::ImageRgb8(image.to_rgb8()),
+    };
+    let mut png = std::io::Cursor::new(Vec::new());
+    image
+        .write_to(&mut png, ::image::ImageFormat::Png)
+        .map_err(|e| format!("filter encode error: {e}"))?;
+    Ok((png.into_inner(), gray))
+}
+
+/// `bytes` re-encoded as a gray (or gray and alpha) PNG, which printpdf
+/// writes as a `/DeviceGray` image.
+fn grayscale_png(bytes: &[u8]) -> Result<Vec<u8>, String> {
+    let image = ::image::load_from_memory(bytes).map_err(|e| format!("decode error: {e}"))?;
+    let gray = if image.color().has_alpha() {
+        ::image::DynamicImage::ImageLumaA8(image.to_luma_alpha8())
+    } else {
+        ::image::DynamicImage::ImageLuma8(image.to_luma8())
+    };
+    let mut png = std::io::Cursor::new(Vec::new());
+    gray.write_to(&mut png, ::image::ImageFormat::Png)
+        .map_err(|e| format!("grayscale encode error: {e}"))?;
+    Ok(png.into_inner())
+}
+
+/// The luminance of `color`, with the Rec. 709 weights the `image` crate
+/// uses for images, so colours and pictures turn the same gray.
+fn gray_level(color: [f32; 4]) -> f32 {
+    0.2126 * color[0] + 0.7152 * color[1] + 0.0722 * color[2]
+}
+
+/// Replace the RGB colours set by `ops` with their gray levels.
+fn convert_to_gray(ops: &mut [Op]) {
+    for op in ops {
+        let (Op::SetFillColor { col } | Op::SetOutlineColor { col }) = op else {
+            continue;
+        };
+        if let Color::Rgb(rgb) = col {
+            let percent = gray_level([rgb.r, rgb.g, rgb.b, 1.0]);
+            *col = Color::Greyscale(Greyscale {
+                percent,
+                icc_profile: None,
+            });
+        }
+    }
+}
+
+fn check_pixel_limit(width: u32, height: u32, max_pixels: Option<u64>) -> Result<(), String> {
+    match max_pixels {
+        Some(max) if u64::from(width) * u64::from(height) > max => Err(format!(
+            "{width}×{height} image exceeds the limit of {max} pixels"
+        )),
+        _ => Ok(()),
+    }
+}
+
+/// Build the content-stream ops for one page.
+fn page_ops(page_layout: &PageLayout, ctx: &RenderContext) -> Vec<Op> {
+    let mut ops = Vec::new();
+    if let Some(bg) = ctx.background {
+        push_page_background(&mut ops, bg, ctx);
+    }
+    let scaled = ctx.scale != 1.0;
+    if scaled {
+        ops.push(Op::SaveGraphicsState);
+        ops.push(Op::SetTransformationMatrix {
+            matrix: CurTransMat::Raw([ctx.scale, 0.0, 0.0, ctx.scale, 0.0, 0.0]),
+        });
+    }
+    for lbox in &page_layout.boxes {
+        render_box(&mut ops, lbox, ctx);
+    }
+    if scaled {
+        ops.push(Op::RestoreGraphicsState);
+    }
+    if ctx.grayscale {
+        convert_to_gray(&mut ops);
+    }
+    ops
+}
+
+/// Most images a tiled background draws per page; smaller tiles are scaled
+/// up to stay within it.
+const MAX_BACKGROUND_TILES: f32 = 2500.0;
+
+/// Draw the page background image (skipped, already reported, if it could
+/// not be decoded).
+fn push_page_background(ops: &mut Vec<Op>, bg: &PageBackground, ctx: &RenderContext) {
+    let Some(res) = ctx.images.get(&bg.src) else {
+        return;
+    };
+    let (px_w, px_h) = (res.px_width as f32, res.px_height as f32);
+    if px_w <= 0.0 || px_h <= 0.0 {
+        return;
+    }
+    let (page_w, page_h) = (ctx.page_width, ctx.page_height);
+    let mut place = |x: f32, y: f32, scale: f32| {
+        ops.push(Op::UseXobject {
+            id: res.xobj_id.clone(),
+            transform: XObjectTransform {
+                translate_x: Some(Pt(x)),
+                translate_y: Some(Pt(y)),
+                dpi: Some(72.0),
+                scale_x: Some(scale),
+                scale_y: Some(scale),
+                rotate: None,
+            },
+        });
+    };
+    match bg.mode {
+        BackgroundMode::Cover | BackgroundMode::Contain => {
+            let (sx, sy) = (page_w / px_w, page_h / px_h);
+            let scale = if bg.mode == BackgroundMode::Cover {
+                sx.max(sy)
+            } else {
+                sx.min(sy)
+            };
+            // Centred; whatever spills past the page is cut off by the MediaBox.
+            place(
+                (page_w - px_w * scale) / 2.0,
+                (page_h - px_h * scale) / 2.0,
+                scale,
+            );
+        }
+        BackgroundMode::Tile => {
+            let tiles = (page_w / px_w).ceil() * (page_h / px_h).ceil();
+            let scale = (tiles / MAX_BACKGROUND_TILES).sqrt().max(1.0);
+            let (tile_w, tile_h) = (px_w * scale, px_h * scale);
+            let mut top = page_h;
+            while top > 0.0 {
+                let mut x = 0.0;
+                while x < page_w {
+                    place(x, top - tile_h, scale);
+                    x += tile_w;
+                }
+                top -= tile_h;
+            }
+        }
+    }
+}
+
+/// Draw the `background-image` of `lbox`, whose top edge is at `pdf_y`,
+/// clipped to the box (skipped, already reported, if it could not be
+/// decoded).  Tiles are scaled up as for the page background so no more
+/// than [`MAX_BACKGROUND_TILES`] are drawn.
+fn push_background_image(
+    ops: &mut Vec<Op>,
+    bg: &BackgroundImage,
+    lbox: &LayoutBox,
+    pdf_y: f32,
+    ctx: &RenderContext,
+) {
+    let Some(res) = ctx.images.get(&bg.src) else {
+        return;
+    };
+    let (px_w, px_h) = (res.px_width as f32, res.px_height as f32);
+    let (box_w, box_h) = (lbox.width, lbox.height);
+    if px_w <= 0.0 || px_h <= 0.0 || box_w <= 0.0 || box_h <= 0.0 {
+        return;
+    }
+    let (mut w, mut h) = bg.size.resolve(px_w, px_h, box_w, box_h);
+    if w <= 0.0 || h <= 0.0 {
+        return;
+    }
+    let (repeat_x, repeat_y) = match bg.repeat {
+        BackgroundRepeat::Repeat => (true, true),
+        BackgroundRepeat::RepeatX => (true, false),
+        BackgroundRepeat::RepeatY => (false, true),
+        BackgroundRepeat::NoRepeat => (false, false),
+    };
+    let columns = if repeat_x { (box_w / w).ceil() + 1.0 } else { 1.0 };
+    let rows = if repeat_y { (box_h / h).ceil() + 1.0 } else { 1.0 };
+    let grow = (columns * rows / MAX_BACKGROUND_TILES).sqrt().max(1.0);
+    (w, h) = (w * grow, h * grow);
+    // The tile the position places; repeats extend from it to both edges.
+    let left = lbox.x + bg.position[0].resolve(box_w - w);
+    let top = pdf_y - bg.position[1].resolve(box_h - h);
+    let x0 = if repeat_x { left - ((left - lbox.x) / w).ceil() * w } else { left };
+    let top0 = if repeat_y { top + ((pdf_y - top) / h).ceil() * h } else { top };
+
+    ops.push(Op::SaveGraphicsState);
+    push_clip(ops, rect_ring(lbox.x, pdf_y - box_h, lbox.x + box_w, pdf_y));
+    let mut row_top = top0;
+    loop {
+        let mut x = x0;
+        loop {
+            ops.push(Op::UseXobject {
+                id: res.xobj_id.clone(),
+                transform: XObjectTransform {
+                    translate_x: Some(Pt(x)),
+                    translate_y: Some(Pt(row_top - h)),
+                    dpi: Some(72.0),
+                    scale_x: Some(w / px_w),
+                    scale_y: Some(h / px_h),
+                    rotate: None,
+                },
+            });
+            x += w;
+            if !repeat_x || x >= lbox.x + box_w {
+                break;
+            }
+        }
+        row_top -= h;
+        if !repeat_y || row_top <= pdf_y - box_h {
+            break;
+        }
+    }
+    ops.push(Op::RestoreGraphicsState);
+}
+
+/// Register font programs for the four Helvetica faces so text is drawn with
+/// an embedded font instead of the non-embedded standard-14 reference.
+///
+/// Bold / italic faces without their own program reuse the regular one.
+fn embed_base_fonts(
+    doc: &mut PdfDocument,
+    fonts: &FontManager,
+    cache: Option<&dyn Cache>,
+) -> Result<HashMap<(bool, bool), FontId>, String> {
+    let mut warnings: Vec<PdfWarnMsg> = Vec::new();
+    let mut add_font = |bytes: &[u8]| -> Result<FontId, String> {
+        let parsed = cache::get_or_insert(
+            cache,
+            || cache::cache_key("font", bytes),
+            || {
+                ParsedFont::from_bytes(bytes, 0, &mut warnings)
+                    .ok_or_else(|| "Failed to parse the Helvetica font program".to_string())
+            },
+        )?;
+        Ok(doc.add_font(&parsed))
+    };
+
+    let regular_key = FontKey {
+        family: "Helvetica".to_string(),
+        bold: false,
+        italic: false,
+    };
+    let regular_bytes = fonts.font_bytes(&regular_key).ok_or_else(|| {
+        "embed_base_fonts is set but no font program is registered for Helvetica \
+         (see PipelineConfig::base_font)"
+            .to_string()
+    })?;
+    let regular_id = add_font(regular_bytes)?;
+
+    let mut ids = HashMap::new();
+    ids.insert((false, false), regular_id.clone());
+    for (bold, italic) in [(true, false), (false, true), (true, true)] {
+        let key = FontKey {
+            family: "Helvetica".to_string(),
+            bold,
+            italic,
+        };
+        let id = match fonts.font_bytes(&key) {
+            Some(bytes) => add_font(bytes)?,
+            None => regular_id.clone(),
+        };
+        ids.insert((bold, italic), id);
+    }
+    Ok(ids)
+}
+
+/// Select the font for a text run: the embedded program when one was
+/// registered, otherwise the matching builtin Helvetica face.
+fn push_set_font(ops: &mut Vec<Op>, ctx: &RenderContext, size: f32, bold: bool, italic: bool) {
+    match ctx.embedded_fonts.get(&(bold, italic)) {
+        Some(font) => ops.push(Op::SetFontSize {
+            size: Pt(size),
+            font: font.clone(),
+        }),
+        None => ops.push(Op::SetFontSizeBuiltinFont {
+            size: Pt(size),
+            font: builtin_font(bold, italic),
+        }),
+    }
+}
+
+/// Emit a text run in the font chosen by [`push_set_font`].
+fn push_write_text(ops: &mut Vec<Op>, ctx: &RenderContext, text: &str, bold: bool, italic: bool) {
+    match ctx.embedded_fonts.get(&(bold, italic)) {
+        // Embedded fonts are addressed by Unicode; printpdf maps to glyph ids.
+        Some(font) => ops.push(Op::WriteText {
+            items: vec![TextItem::Text(text.to_string())],
+            font: font.clone(),
+        }),
+        None => ops.push(Op::WriteTextBuiltinFont {
+            items: vec![TextItem::Text(to_winlatin(text))],
+            font: builtin_font(bold, italic),
+        }),
+    }
+}
+
+/// Write `run` in `text`'s font, colour and rendering mode with its
+/// baseline starting at `(x, y)` (PDF coordinates).
+fn push_text_run(ops: &mut Vec<Op>, ctx: &RenderContext, text: &TextContent, run: &str, x: f32, y: f32) {
+    if let Some(fonts) = ctx.outline_fonts {
+        let key = FontKey {
+            family: text.font_family.clone(),
+            bold: text.bold,
+            italic: text.italic,
+        };
+        let rings = glyph_rings(fonts, &key, text.font_size, run, x, y);
+        push_text_outlines(ops, ctx, text, rings);
+        return;
+    }
+    ops.push(Op::StartTextSection);
+    ops.push(Op::SetTextCursor {
+        pos: Point { x: Pt(x), y: Pt(y) },
+    });
+    push_set_font(ops, ctx, text.font_size, text.bold, text.italic);
+    ops.push(Op::SetLineHeight {
+        lh: Pt(text.line_height),
+    });
+    ops.push(Op::SetFillColor {
+        col: Color::Rgb(Rgb {
+            r: text.color[0],
+            g: text.color[1],
+            b: text.color[2],
+            icc_profile: None,
+        }),
+    });
+    let painted = push_text_render_mode(ops, ctx, text);
+    push_write_text(ops, ctx, run, text.bold, text.italic);
+    if painted {
+        // `Tr` is graphics state and outlives the text object.
+        ops.push(Op::SetTextRenderingMode {
+            mode: TextRenderingMode::Fill,
+        });
+    }
+    ops.push(Op::EndTextSection);
+}
+
+/// Switch to a non-default text rendering mode (and its outline) for `text`.
+/// Returns `false`, emitting nothing, for plain filled text.
+fn push_text_render_mode(ops: &mut Vec<Op>, ctx: &RenderContext, text: &TextContent) -> bool {
+    let mode = match text.render_mode {
+        TextRenderMode::Fill => return false,
+        TextRenderMode::Stroke => TextRenderingMode::Stroke,
+        TextRenderMode::FillStroke => TextRenderingMode::FillStroke,
+        TextRenderMode::Invisible => TextRenderingMode::Invisible,
+    };
+    if let Some(stroke) = &text.stroke {
+        ops.push(Op::SetOutlineColor {
+            col: Color::Rgb(Rgb {
+                r: stroke.color[0],
+                g: stroke.color[1],
+                b: stroke.color[2],
+                icc_profile: None,
+            }),
+        });
+        ops.push(Op::SetOutlineThickness {
+            pt: ctx.line_width(stroke.width),
+        });
+    }
+    ops.push(Op::SetTextRenderingMode { mode });
+    true
+}
+
+/// Paint glyph outlines from [`glyph_rings`] the way `text`'s rendering
+/// mode would paint its glyphs.
+fn push_text_outlines(
+    ops: &mut Vec<Op>,
+    ctx: &RenderContext,
+    text: &TextContent,
+    rings: Vec<PolygonRing>,
+) {
+    if rings.is_empty() {
+        return;
+    }
+    let mode = match text.render_mode {
+        TextRenderMode::Invisible => return,
+        TextRenderMode::Fill => PaintMode::Fill,
+        TextRenderMode::Stroke => PaintMode::Stroke,
+        TextRenderMode::FillStroke => PaintMode::FillStroke,
+    };
+    ops.push(Op::SaveGraphicsState);
+    ops.push(Op::SetFillColor {
+        col: Color::Rgb(Rgb {
+            r: text.color[0],
+            g: text.color[1],
+            b: text.color[2],
+            icc_profile: None,
+        }),
+    });
+    let stroked = !matches!(mode, PaintMode::Fill);
+    if let (Some(stroke), true) = (&text.stroke, stroked) {
+        ops.push(Op::SetOutlineColor {
+            col: Color::Rgb(Rgb {
+                r: stroke.color[0],
+                g: stroke.color[1],
+                b: stroke.color[2],
+                icc_profile: None,
+            }),
+        });
+        ops.push(Op::SetOutlineThickness {
+            pt: ctx.line_width(stroke.width),
+        });
+    }
+    ops.push(Op::DrawPolygon {
+        polygon: Polygon {
+            rings,
+            mode,
+            // TrueType contours are wound for the non-zero rule.
+            winding_order: WindingOrder::NonZero,
+        },
+    });
+    ops.push(Op::RestoreGraphicsState);
+}
+
+/// The outlines of `run`'s glyphs at `size` points with the baseline
+/// starting at `(x, y)`, taken from `key`'s program – or the regular
+/// Helvetica one, as when measuring, if `key` has none.  Curves are
+/// flattened into straight segments; characters without a glyph leave a
+/// gap as wide as the layout measured them.
+fn glyph_rings(
+    fonts: &FontManager,
+    key: &FontKey,
+    size: f32,
+    run: &str,
+    x: f32,
+    y: f32,
+) -> Vec<PolygonRing> {
+    let data = fonts.get(key);
+    let Ok(face) = ttf_parser::Face::parse(&data.bytes, 0) else {
+        return Vec::new();
+    };
+    let mut outline = GlyphOutline {
+        scale: size / data.units_per_em,
+        origin: (x, y),
+        rings: Vec::new(),
+        points: Vec::new(),
+        pen: (0.0, 0.0),
+    };
+    for ch in run.chars() {
+        let Some(gid) = face.glyph_index(ch) else {
+            outline.origin.0 += size * 0.5;
+            continue;
+        };
+        face.outline_glyph(gid, &mut outline);
+        outline.end_contour();
+        let advance = face.glyph_hor_advance(gid).unwrap_or(0);
+        outline.origin.0 += advance as f32 * outline.scale;
+    }
+    outline.rings
+}
+
+/// Straight segments approximating each curve of a glyph outline.
+const CURVE_SEGMENTS: usize = 8;
+
+/// Collects a glyph's contours, in font units, as polygon rings in PDF
+/// user space.
+struct GlyphOutline {
+    /// Points per font unit.
+    scale: f32,
+    /// Where the current glyph's origin lies on the page.
+    origin: (f32, f32),
+    rings: Vec<PolygonRing>,
+    /// The contour being built.
+    points: Vec<LinePoint>,
+    /// The last point of the contour, in font units.
+    pen: (f32, f32),
+}
+
+impl GlyphOutline {
+    /// Keep the contour being built as a ring, unless it has no area.
+    fn end_contour(&mut self) {
+        if self.points.len() > 2 {
+            let points = std::mem::take(&mut self.points);
+            self.rings.push(PolygonRing { points });
+        }
+        self.points.clear();
+    }
+
+    fn push(&mut self, x: f32, y: f32) {
+        self.pen = (x, y);
+        let p = Point {
+            x: Pt(self.origin.0 + x * self.scale),
+            y: Pt(self.origin.1 + y * self.scale),
+        };
+        self.points.push(LinePoint { p, bezier: false });
+    }
+
+    /// Approximate a Bézier curve from the pen through `controls` with
+    /// [`CURVE_SEGMENTS`] straight segments.
+    fn flatten(&mut self, controls: &[(f32, f32)]) {
+        let mut curve = vec![self.pen];
+        curve.extend_from_slice(controls);
+        for i in 1..=CURVE_SEGMENTS {
+            let t = i as f32 / CURVE_SEGMENTS as f32;
+            // De Casteljau: interpolate between neighbours until one is left.
+            let lerp = |a: f32, b: f32| a + (b - a) * t;
+            let mut level = curve.clone();
+            while level.len() > 1 {
+                level = level
+                    .windows(2)
+                    .map(|w| (lerp(w[0].0, w[1].0), lerp(w[0].1, w[1].1)))
+                    .collect();
+            }
+            self.push(level[0].0, level[0].1);
+        }
+    }
+}
+
+impl ttf_parser::OutlineBuilder for GlyphOutline {
+    fn move_to(&mut self, x: f32, y: f32) {
+        self.end_contour();
+        self.push(x, y);
+    }
+
+    fn line_to(&mut self, x: f32, y: f32) {
+        self.push(x, y);
+    }
+
+    fn quad_to(&mut self, x1: f32, y1: f32, x: f32, y: f32) {
+        self.flatten(&[(x1, y1), (x, y)]);
+    }
+
+    fn curve_to(&mut self, x1: f32, y1: f32, x2: f32, y2: f32, x: f32, y: f32) {
+        self.flatten(&[(x1, y1), (x2, y2), (x, y)]);
+    }
+
+    fn close(&mut self) {
+        self.end_contour();
+    }
+}
+
+fn builtin_font(bold: bool, italic: bool) -> BuiltinFont {
+    match (bold, italic) {
+        (true, true) => BuiltinFont::HelveticaBoldOblique,
+        (true, false) => BuiltinFont::HelveticaBold,
+        (false, true) => BuiltinFont::HelveticaOblique,
+        (false, false) => BuiltinFont::Helvetica,
+    }
+}
+
+/// Convert a UTF-8 string to raw Windows-1252 bytes then wrap in a String so
+/// printpdf writes the bytes unchanged into the PDF stream (builtin fonts use
+/// WinAnsiEncoding, so each glyph is one byte 0x00–0xFF).
+fn to_winlatin(s: &str) -> String {
+    let bytes: Vec<u8> = s
+        .chars()
+        .map(|c| match c {
+            '\u{20AC}' => 0x80, // euro
+            '\u{201A}' => 0x82, // single low-9 quote
+            '\u{201E}' => 0x84, // double low-9 quote
+            '\u{2026}' => 0x85, // ellipsis
+            '\u{2018}' => 0x91, // left single quote
+            '\u{2019}' => 0x92, // right single quote
+            '\u{201C}' => 0x93, // left double quote
+            '\u{201D}' => 0x94, // right double quote
+            '\u{2022}' => 0x95, // bullet
+            '\u{2013}' => 0x96, // en-dash
+            '\u{2014}' => 0x97, // em-dash
+            '\u{2122}' => 0x99, // trademark
+            '\u{00A0}' => 0x20, // non-breaking space -> space
+            c if (c as u32) < 256 => c as u8,
+            c => {
+                diagnostics::warn(
+                    "fonts",
+                    format!("No glyph for {c:?} in the standard Helvetica font; drawn as `?`"),
+                );
+                b'?'
+            }
+        })
+        .collect();
+    // SAFETY: intentionally non-UTF-8 for 0x80-0x9F range; printpdf passes
+    // these bytes straight to the PDF stream, decoded by WinAnsiEncoding.
+    #[allow(unsafe_code)]
+    unsafe {
+        String::from_utf8_unchecked(bytes)
+    }
+}
+
+/// Parse a `data:<mime>;base64,<data>` URI and return the raw decoded bytes.
+///
+/// Returns `Err` if `src` is not a data URI or does not use base64 encoding.
+pub(crate) fn parse_data_uri(src: &str) -> Result<Vec<u8>, String> {
+    if !src.starts_with("data:") {
+        let preview = if src.len() > 80 { &src[..80] } else { src };
+        return Err(format!(
+            "Image src must be a base64 data URI \
+             (e.g. `data:image/png;base64,...`). Got: {preview:?}"
+        ));
+    }
+    let rest = &src["data:".len()..];
+    let comma_pos = rest.find(',').ok_or_else(|| {
+        "Invalid data URI: missing `,` separator between header and data".to_string()
+    })?;
+    let header = &rest[..comma_pos];
+    if !header.contains(";base64") {
+        return Err("Only base64-encoded data URIs are supported. \
+             The header must contain `;base64` (e.g. `data:image/png;base64,...`)."
+            .to_string());
+    }
+    let b64_data = rest[comma_pos + 1..].trim();
+    BASE64_STD
+        .decode(b64_data)
+        .map_err(|e| format!("Base64 decode error: {e}"))
+}
+
+/// Recursively collect all unique `image.src` strings from a [`LayoutBox`] tree.
+/// Gather every image under `lbox` into `srcs` by [`image_key`], noting the
+/// sources of list markers in `markers` as well.
+fn collect_image_srcs<'a>(
+    lbox: &'a LayoutBox,
+    srcs: &mut HashMap<String, (&'a str, &'a [ImageFilter])>,
+    markers: &mut HashSet<&'a str>,
+) {
+    if let Some(img) = &lbox.image {
+        let key = image_key(&img.src, &img.filter);
+        srcs.insert(key, (img.src.as_str(), img.filter.as_slice()));
+    }
+    if let Some(bg) = &lbox.background_image {
+        srcs.insert(bg.src.clone(), (bg.src.as_str(), &[]));
+    }
+    if let Some(TextContent {
+        list_marker_image: Some(src),
+        ..
+    }) = &lbox.text
+    {
+        srcs.insert(src.clone(), (src.as_str(), &[]));
+        markers.insert(src.as_str());
+    }
+    for child in &lbox.children {
+        collect_image_srcs(child, srcs, markers);
+    }
+}
+
+/// The key an image is registered under: its source, set apart by the
+/// filters applied to it.
+fn image_key(src: &str, filter: &[ImageFilter]) -> String {
+    if filter.is_empty() {
+        src.to_string()
+    } else {
+        format!("{filter:?}{src}")
+    }
+}
+
+/// Recursively render a LayoutBox and its children into PDF ops.
+fn render_box(ops: &mut Vec<Op>, lbox: &LayoutBox, ctx: &RenderContext) {
+    let Some(transform) = lbox.transform else {
+        return draw_box(ops, lbox, ctx);
+    };
+    ops.push(Op::SaveGraphicsState);
+    ops.push(Op::SetTransformationMatrix {
+        matrix: CurTransMat::Raw(pdf_transform(transform, lbox, ctx.layout_height())),
+    });
+    draw_box(ops, lbox, ctx);
+    ops.push(Op::RestoreGraphicsState);
+}
+
+/// Convert a CSS transform of `lbox` (y down, about the box centre) into a
+/// PDF `cm` matrix (y up, about the page origin).
+fn pdf_transform(m: [f32; 6], lbox: &LayoutBox, page_height: f32) -> [f32; 6] {
+    let [a, b, c, d, e, f] = m;
+    // Flipping the y axis negates the off-diagonal terms and `f`.
+    let (pa, pb, pc, pd) = (a, -b, -c, d);
+    let ox = lbox.x + lbox.width / 2.0;
+    let oy = page_height - (lbox.y + lbox.height / 2.0);
+    [
+        pa,
+        pb,
+        pc,
+        pd,
+        ox + e - (pa * ox + pc * oy),
+        oy - f - (pb * ox + pd * oy),
+    ]
+}
+
+/// Draw `lbox` and its children in the current coordinate system, clipped
+/// to its `clip-path` and, except for its shadows, its rounded corners.
+fn draw_box(ops: &mut Vec<Op>, lbox: &LayoutBox, ctx: &RenderContext) {
+    // PDF coordinate system: origin at bottom-left.
+    // Our layout uses origin at top-left. Convert:
+    let pdf_y = ctx.layout_height() - lbox.y;
+    let (x1, y1, x2, y2) = (lbox.x, pdf_y - lbox.height, lbox.x + lbox.width, pdf_y);
+
+    let clip_path = lbox
+        .clip_path
+        .map(|shape| clip_path_ring(shape, x1, y1, x2, y2));
+    let corners = lbox.border_radius.map(|radius| {
+        let (rx, ry) = (radius.resolve(lbox.width), radius.resolve(lbox.height));
+        rounded_ring(x1, y1, x2, y2, rx, ry)
+    });
+    let clipped = clip_path.is_some() || corners.is_some();
+    if clipped {
+        ops.push(Op::SaveGraphicsState);
+    }
+    if let Some(ring) = clip_path {
+        push_clip(ops, ring);
+    }
+    push_box_shadows(ops, lbox, pdf_y);
+    if let Some(ring) = corners {
+        push_clip(ops, ring);
+    }
+    paint_box(ops, lbox, pdf_y, ctx);
+    if clipped {
+        ops.push(Op::RestoreGraphicsState);
+    }
+}
+
+/// Paint the background, border and content of `lbox`, whose top edge is
+/// at `pdf_y`, then its children.
+fn paint_box(ops: &mut Vec<Op>, lbox: &LayoutBox, pdf_y: f32, ctx: &RenderContext) {
+    // Background
+    if let Some(bg) = &lbox.background_color {
+        ops.push(Op::SetFillColor {
+            col: Color::Rgb(Rgb {
+                r: bg[0],
+                g: bg[1],
+                b: bg[2],
+                icc_profile: None,
+            }),
+        });
+
+        // Draw filled rectangle
+        let x1 = lbox.x;
+        let y1 = pdf_y - lbox.height;
+        let x2 = lbox.x + lbox.width;
+        let y2 = pdf_y;
+
+        ops.push(Op::DrawPolygon {
+            polygon: Polygon {
+                rings: vec![PolygonRing {
+                    points: vec![
+                        LinePoint {
+                            p: Point {
+                                x: Pt(x1),
+                                y: Pt(y1),
+                            },
+                            bezier: false,
+                        },
+                        LinePoint {
+                            p: Point {
+                                x: Pt(x2),
+                                y: Pt(y1),
+                            },
+                            bezier: false,
                         },
-                        bezier: false,
+                        LinePoint {
+                            p: Point {
+                                x: Pt(x2),
+                                y: Pt(y2),
+                            },
+                            bezier: false,
+                        },
+                        LinePoint {
+                            p: Point {
+                                x: Pt(x1),
+                                y: Pt(y2),
+                            },
+                            bezier: false,
+                        },
+                    ],
+                }],
+                mode: PaintMode::Fill,
+                winding_order: WindingOrder::NonZero,
+            },
+        });
+    }
+    if let Some(gradient) = &lbox.background_gradient {
+        push_gradient(ops, gradient, lbox, pdf_y, ctx);
+    }
+    if let Some(image) = &lbox.background_image {
+        push_background_image(ops, image, lbox, pdf_y, ctx);
+    }
+
+    // Border
+    if let Some(border) = &lbox.border {
+        ops.push(Op::SetOutlineColor {
+            col: Color::Rgb(Rgb {
+                r: border.color[0],
+                g: border.color[1],
+                b: border.color[2],
+                icc_profile: None,
+            }),
+        });
+        let width = ctx.line_width(border.width);
+        ops.push(Op::SetOutlineThickness { pt: width });
+
+        let x1 = lbox.x;
+        let y1 = pdf_y - lbox.height;
+        let x2 = lbox.x + lbox.width;
+        let y2 = pdf_y;
+
+        let dashed = border.style != LineStyle::Solid;
+        if dashed {
+            ops.push(Op::SaveGraphicsState);
+            ops.push(Op::SetLineDashPattern {
+                dash: dash_pattern(border.style, width),
+            });
+        }
+        if !border.sides.is_all() {
+            push_border_sides(ops, border.sides, width, x1, y1, x2, y2);
+        } else if let Some(radius) = lbox.border_radius {
+            // Stroked inside the outline, which clips everything outside it.
+            let inset = width / 2.0;
+            let (rx, ry) = (radius.resolve(lbox.width), radius.resolve(lbox.height));
+            let ring = rounded_ring(
+                x1 + inset,
+                y1 + inset,
+                x2 - inset,
+                y2 - inset,
+                (rx - inset).max(0.0),
+                (ry - inset).max(0.0),
+            );
+            ops.push(Op::DrawPolygon {
+                polygon: Polygon {
+                    rings: vec![ring],
+                    mode: PaintMode::Stroke,
+                    winding_order: WindingOrder::NonZero,
+                },
+            });
+        } else {
+            ops.push(Op::DrawLine {
+                line: Line {
+                    points: vec![
+                        LinePoint {
+                            p: Point {
+                                x: Pt(x1),
+                                y: Pt(y2),
+                            },
+                            bezier: false,
+                        },
+                        LinePoint {
+                            p: Point {
+                                x: Pt(x2),
+                                y: Pt(y2),
+                            },
+                            bezier: false,
+                        },
+                        LinePoint {
+                            p: Point {
+                                x: Pt(x2),
+                                y: Pt(y1),
+                            },
+                            bezier: false,
+                        },
+                        LinePoint {
+                            p: Point {
+                                x: Pt(x1),
+                                y: Pt(y1),
+                            },
+                            bezier: false,
+                        },
+                    ],
+                    is_closed: true,
+                },
+            });
+        }
+        if dashed {
+            ops.push(Op::RestoreGraphicsState);
+        }
+    }
+
+    // Text
+    if let Some(text) = &lbox.text {
+        // (dx, dy, copy) per shadow, bottom layer first; dy is PDF space.
+        let shadows: Vec<(f32, f32, TextContent)> = text
+            .shadow
+            .iter()
+            .rev()
+            .map(|s| (s.offset_x, -s.offset_y, shadow_text(text, s)))
+            .collect();
+        for tline in &text.lines {
+            if tline.text.is_empty() {
+                continue;
+            }
+            let text_x = lbox.x + tline.x_offset;
+            // Baseline ≈ top of line + ascender (approx 0.75 × font_size)
+            let ascender_offset = text.font_size * 0.75;
+            let text_y = pdf_y - tline.y_offset - ascender_offset;
+
+            if text.writing_mode.is_vertical() {
+                // Each line is a column: upright glyphs one em apart,
+                // centred in the column.
+                let glyph_x = text_x + (text.line_height - text.font_size) / 2.0;
+                for (k, c) in tline.text.chars().enumerate() {
+                    if !c.is_whitespace() {
+                        let glyph = c.to_string();
+                        let glyph_y = text_y - k as f32 * text.font_size;
+                        for (dx, dy, shadow) in &shadows {
+                            push_text_run(ops, ctx, shadow, &glyph, glyph_x + dx, glyph_y + dy);
+                        }
+                        push_text_run(ops, ctx, text, &glyph, glyph_x, glyph_y);
+                    }
+                }
+                continue;
+            }
+
+            for (dx, dy, shadow) in &shadows {
+                push_text_run(ops, ctx, shadow, &tline.text, text_x + dx, text_y + dy);
+            }
+            push_text_run(ops, ctx, text, &tline.text, text_x, text_y);
+
+            // Underline
+            if text.underline {
+                let underline_y = text_y - text.font_size * 0.1;
+                ops.push(Op::SetOutlineThickness {
+                    pt: ctx.line_width(0.5),
+                });
+                ops.push(Op::SetOutlineColor {
+                    col: Color::Rgb(Rgb {
+                        r: text.color[0],
+                        g: text.color[1],
+                        b: text.color[2],
+                        icc_profile: None,
+                    }),
+                });
+                ops.push(Op::DrawLine {
+                    line: Line {
+                        points: vec![
+                            LinePoint {
+                                p: Point {
+                                    x: Pt(text_x),
+                                    y: Pt(underline_y),
+                                },
+                                bezier: false,
+                            },
+                            LinePoint {
+                                p: Point {
+                                    x: Pt(text_x + lbox.width),
+                                    y: Pt(underline_y),
+                                },
+                                bezier: false,
+                            },
+                        ],
+                        is_closed: false,
                     },
-                    LinePoint {
-                        p: Point {
-                            x: Pt(x2),
-                            y: Pt(y1),
-                        },
-                        bezier: false,
+                });
+            }
+        }
+
+        // List marker: the `list-style-image` if it loaded, else the text.
+        let marker_image = text.list_marker_image.as_ref();
+        let marker_image = marker_image.and_then(|src| ctx.images.get(src));
+        if let (Some(_), Some(res)) = (&text.list_marker, marker_image) {
+            push_marker_image(ops, res, lbox.x - 16.0, pdf_y, text);
+        } else if let (Some(marker), Some(fonts)) = (&text.list_marker, ctx.outline_fonts) {
+            let key = FontKey {
+                family: text.font_family.clone(),
+                bold: false,
+                italic: false,
+            };
+            let (marker_x, marker_y) = (lbox.x - 16.0, pdf_y - text.font_size * 0.75);
+            let rings = glyph_rings(fonts, &key, text.font_size, marker, marker_x, marker_y);
+            // Markers are always plain filled text.
+            let plain = TextContent {
+                color: text.color,
+                ..TextContent::default()
+            };
+            push_text_outlines(ops, ctx, &plain, rings);
+        } else if let Some(marker) = &text.list_marker {
+            let marker_x = lbox.x - 16.0;
+            let marker_y = pdf_y - text.font_size * 0.75;
+            ops.push(Op::StartTextSection);
+            ops.push(Op::SetTextCursor {
+                pos: Point {
+                    x: Pt(marker_x),
+                    y: Pt(marker_y),
+                },
+            });
+            push_set_font(ops, ctx, text.font_size, false, false);
+            ops.push(Op::SetFillColor {
+                col: Color::Rgb(Rgb {
+                    r: text.color[0],
+                    g: text.color[1],
+                    b: text.color[2],
+                    icc_profile: None,
+                }),
+            });
+            push_write_text(ops, ctx, marker, false, false);
+            ops.push(Op::EndTextSection);
+        }
+    }
+
+    // Image – embed from pre-registered XObject
+    if let Some(img) = &lbox.image {
+        if let Some(res) = ctx.images.get(&image_key(&img.src, &img.filter)) {
+            let px_w = res.px_width as f32;
+            let px_h = res.px_height as f32;
+            if px_w <= 0.0 || px_h <= 0.0 {
+                diagnostics::missing_asset("render", "Skipping image — zero intrinsic dimensions");
+            } else {
+                // Determine render dimensions. If the layout gave us a zero
+                // width or height (e.g. because no CSS size was specified and
+                // the intrinsic resolution fallback in layout.rs couldn't run
+                // for non-data-URI sources), fall back to the intrinsic pixel
+                // size at 72 dpi (1 px = 1 pt).
+                let asp = px_w / px_h;
+                let render_w = if img.width > 0.0 {
+                    img.width
+                } else if img.height > 0.0 {
+                    img.height * asp
+                } else {
+                    px_w // intrinsic fallback
+                };
+                let render_h = if img.height > 0.0 {
+                    img.height
+                } else if img.width > 0.0 {
+                    img.width / asp
+                } else {
+                    px_h // intrinsic fallback
+                };
+
+                // PDF origin is bottom-left; our layout origin is top-left.
+                let img_bottom_y = ctx.layout_height() - lbox.y - render_h;
+
+                // At dpi=72 printpdf renders 1 px = 1 pt, so
+                // scale = desired_pt / px_dim.
+                let scale_x = render_w / px_w;
+                let scale_y = render_h / px_h;
+
+                ops.push(Op::UseXobject {
+                    id: res.xobj_id.clone(),
+                    transform: XObjectTransform {
+                        translate_x: Some(Pt(lbox.x)),
+                        translate_y: Some(Pt(img_bottom_y)),
+                        dpi: Some(72.0),
+                        scale_x: Some(scale_x),
+                        scale_y: Some(scale_y),
+                        rotate: None,
                     },
-                    LinePoint {
-                        p: Point {
-                            x: Pt(x1),
-                            y: Pt(y1),
-                        },
-                        bezier: false,
+                });
+            }
+        }
+    }
+
+    // Children
+    for child in &lbox.children {
+        render_box(ops, child, ctx);
+    }
+}
+
+/// Draw a `list-style-image` marker from `x`, as tall as the font size and
+/// centred on the first line below `top`.
+fn push_marker_image(ops: &mut Vec<Op>, res: &ImageResource, x: f32, top: f32, text: &TextContent) {
+    if res.px_width == 0 || res.px_height == 0 {
+        return;
+    }
+    let scale = text.font_size / res.px_height as f32;
+    ops.push(Op::UseXobject {
+        id: res.xobj_id.clone(),
+        transform: XObjectTransform {
+            translate_x: Some(Pt(x)),
+            translate_y: Some(Pt(top - (text.line_height + text.font_size) / 2.0)),
+            dpi: Some(72.0),
+            scale_x: Some(scale),
+            scale_y: Some(scale),
+            rotate: None,
+        },
+    });
+}
+
+/// Marked-content tag of the placeholders [`push_gradient`] leaves for
+/// [`apply_gradients`], followed by the index of the gradient.
+const GRADIENT_TAG: &str = "PdfForgeGradient";
+
+/// Paint `gradient` over `lbox`, whose top edge is at `pdf_y`.
+///
+/// printpdf has no shading operator, so this only clips to the box and
+/// leaves an empty `/PdfForgeGradient<n> BMC EMC` sequence that
+/// [`apply_gradients`] replaces once the file is saved.
+fn push_gradient(
+    ops: &mut Vec<Op>,
+    gradient: &Gradient,
+    lbox: &LayoutBox,
+    pdf_y: f32,
+    ctx: &RenderContext,
+) {
+    if gradient.stops.len() < 2 || lbox.width <= 0.0 || lbox.height <= 0.0 {
+        return;
+    }
+    let (x1, y1, x2, y2) = (lbox.x, pdf_y - lbox.height, lbox.x + lbox.width, pdf_y);
+    let mut fills = ctx.gradients.borrow_mut();
+    ops.push(Op::SaveGraphicsState);
+    ops.push(Op::DrawPolygon {
+        polygon: Polygon {
+            rings: vec![rect_ring(x1, y1, x2, y2)],
+            mode: PaintMode::Clip,
+            winding_order: WindingOrder::NonZero,
+        },
+    });
+    ops.push(Op::BeginMarkedContent {
+        tag: format!("{GRADIENT_TAG}{}", fills.len()),
+    });
+    ops.push(Op::EndMarkedContent);
+    ops.push(Op::RestoreGraphicsState);
+    fills.push(GradientFill {
+        gradient: gradient.clone(),
+        rect: [x1, y1, x2, y2],
+    });
+}
+
+/// Paint the outer box shadows of `lbox`, whose top edge is at `pdf_y`,
+/// clipped to the area outside the box.
+///
+/// There is no transparency support, so a shadow's alpha is simulated by
+/// blending its colour toward white (the page), and blur by concentric bands
+/// that step from faint at the outer edge to the full colour.
+fn push_box_shadows(ops: &mut Vec<Op>, lbox: &LayoutBox, pdf_y: f32) {
+    if lbox.box_shadow.is_empty() {
+        return;
+    }
+    let (x1, y1, x2, y2) = (lbox.x, pdf_y - lbox.height, lbox.x + lbox.width, pdf_y);
+    let reach = lbox
+        .box_shadow
+        .iter()
+        .map(|s| s.offset_x.abs().max(s.offset_y.abs()) + s.blur + s.spread.max(0.0))
+        .fold(0.0, f32::max)
+        + 1.0;
+
+    ops.push(Op::SaveGraphicsState);
+    ops.push(Op::DrawPolygon {
+        polygon: Polygon {
+            rings: vec![
+                rect_ring(x1 - reach, y1 - reach, x2 + reach, y2 + reach),
+                rect_ring(x1, y1, x2, y2),
+            ],
+            mode: PaintMode::Clip,
+            winding_order: WindingOrder::EvenOdd,
+        },
+    });
+    for shadow in lbox.box_shadow.iter().rev() {
+        let (dx, dy) = (shadow.offset_x, -shadow.offset_y);
+        let steps = (shadow.blur / 2.0).ceil().clamp(1.0, 8.0) as usize;
+        for i in 0..steps {
+            let grow = shadow.spread + shadow.blur / 2.0 - shadow.blur * i as f32 / steps as f32;
+            let (w, h) = (lbox.width + 2.0 * grow, lbox.height + 2.0 * grow);
+            if w <= 0.0 || h <= 0.0 {
+                continue;
+            }
+            let [r, g, b, _] = shadow_color(shadow.color, (i + 1) as f32 / steps as f32);
+            ops.push(Op::SetFillColor {
+                col: Color::Rgb(Rgb {
+                    r,
+                    g,
+                    b,
+                    icc_profile: None,
+                }),
+            });
+            ops.push(Op::DrawPolygon {
+                polygon: Polygon {
+                    rings: vec![rect_ring(
+                        x1 - grow + dx,
+                        y1 - grow + dy,
+                        x2 + grow + dx,
+                        y2 + grow + dy,
+                    )],
+                    mode: PaintMode::Fill,
+                    winding_order: WindingOrder::NonZero,
+                },
+            });
+        }
+    }
+    ops.push(Op::RestoreGraphicsState);
+}
+
+/// `color` at `strength` × its alpha, blended over white.
+fn shadow_color(color: [f32; 4], strength: f32) -> [f32; 4] {
+    let alpha = color[3] * strength;
+    let blend = |c: f32| 1.0 - alpha * (1.0 - c);
+    [blend(color[0]), blend(color[1]), blend(color[2]), 1.0]
+}
+
+/// A copy of `text` painted in `shadow`'s colour, for its text shadow.
+/// Text shadows are drawn without blur.
+fn shadow_text(text: &TextContent, shadow: &Shadow) -> TextContent {
+    let color = shadow_color(shadow.color, 1.0);
+    let render_mode = match text.render_mode {
+        // Even unpainted glyphs cast a shadow, as in CSS.
+        TextRenderMode::Invisible => TextRenderMode::Fill,
+        mode => mode,
+    };
+    TextContent {
+        lines: Vec::new(),
+        color,
+        render_mode,
+        stroke: text.stroke.as_ref().map(|s| BorderStyle {
+            color,
+            ..s.clone()
+        }),
+        list_marker: None,
+        list_marker_image: None,
+        shadow: Vec::new(),
+        ..text.clone()
+    }
+}
+
+/// Dashes and gaps three times the border `width` for `dashed`, as long as
+/// it is wide for `dotted`.
+fn dash_pattern(style: LineStyle, width: f32) -> LineDashPattern {
+    let unit = match style {
+        LineStyle::Dashed => 3.0 * width,
+        LineStyle::Dotted | LineStyle::Solid => width,
+    };
+    let unit = (unit.round() as i64).max(1);
+    LineDashPattern {
+        dash_1: Some(unit),
+        gap_1: Some(unit),
+        ..Default::default()
+    }
+}
+
+/// Stroke the bordered `sides` of the box `(x1, y1)`–`(x2, y2)` as separate
+/// lines, each inset by half the stroke `width` so it stays inside the box.
+fn push_border_sides(
+    ops: &mut Vec<Op>,
+    sides: BorderSides,
+    width: f32,
+    x1: f32,
+    y1: f32,
+    x2: f32,
+    y2: f32,
+) {
+    let inset = width / 2.0;
+    let edges = [
+        (sides.top, (x1, y2 - inset), (x2, y2 - inset)),
+        (sides.right, (x2 - inset, y1), (x2 - inset, y2)),
+        (sides.bottom, (x1, y1 + inset), (x2, y1 + inset)),
+        (sides.left, (x1 + inset, y1), (x1 + inset, y2)),
+    ];
+    for (_, from, to) in edges.into_iter().filter(|&(bordered, ..)| bordered) {
+        let point = |(x, y): (f32, f32)| LinePoint {
+            p: Point { x: Pt(x), y: Pt(y) },
+            bezier: false,
+        };
+        ops.push(Op::DrawLine {
+            line: Line {
+                points: vec![point(from), point(to)],
+                is_closed: false,
+            },
+        });
+    }
+}
+
+/// The axis-aligned rectangle `(x1, y1)`–`(x2, y2)` as a polygon ring.
+fn rect_ring(x1: f32, y1: f32, x2: f32, y2: f32) -> PolygonRing {
+    let corner = |x: f32, y: f32| LinePoint {
+        p: Point { x: Pt(x), y: Pt(y) },
+        bezier: false,
+    };
+    PolygonRing {
+        points: vec![corner(x1, y1), corner(x2, y1), corner(x2, y2), corner(x1, y2)],
+    }
+}
+
+/// Straight segments approximating each quarter of a rounded corner or
+/// circle; at 12 the outline is within 0.3 % of the radius of the arc.
+const CORNER_SEGMENTS: usize = 12;
+
+/// Intersect the clipping path with the area inside `ring`.
+fn push_clip(ops: &mut Vec<Op>, ring: PolygonRing) {
+    ops.push(Op::DrawPolygon {
+        polygon: Polygon {
+            rings: vec![ring],
+            mode: PaintMode::Clip,
+            winding_order: WindingOrder::NonZero,
+        },
+    });
+}
+
+/// The rectangle `(x1, y1)`–`(x2, y2)` with elliptical corners of radii
+/// `rx` × `ry`, limited to half the rectangle, as a polygon ring.
+fn rounded_ring(x1: f32, y1: f32, x2: f32, y2: f32, rx: f32, ry: f32) -> PolygonRing {
+    let rx = rx.min((x2 - x1) / 2.0);
+    let ry = ry.min((y2 - y1) / 2.0);
+    if rx <= 0.0 || ry <= 0.0 {
+        return rect_ring(x1, y1, x2, y2);
+    }
+    // Corner centres, counter-clockwise from the bottom right, each with the
+    // angle its quarter arc starts at.
+    let corners = [
+        (x2 - rx, y1 + ry, -90.0f32),
+        (x2 - rx, y2 - ry, 0.0),
+        (x1 + rx, y2 - ry, 90.0),
+        (x1 + rx, y1 + ry, 180.0),
+    ];
+    let points = corners
+        .iter()
+        .flat_map(|&(cx, cy, start)| {
+            (0..=CORNER_SEGMENTS).map(move |i| {
+                let angle = (start + 90.0 * i as f32 / CORNER_SEGMENTS as f32).to_radians();
+                LinePoint {
+                    p: Point {
+                        x: Pt(cx + rx * angle.cos()),
+                        y: Pt(cy + ry * angle.sin()),
                     },
-                ],
-                is_closed: true,
+                    bezier: false,
+                }
+            })
+        })
+        .collect();
+    PolygonRing { points }
+}
+
+/// The outline of `shape` on the box `(x1, y1)`–`(x2, y2)`.
+fn clip_path_ring(shape: ClipPath, x1: f32, y1: f32, x2: f32, y2: f32) -> PolygonRing {
+    let (w, h) = (x2 - x1, y2 - y1);
+    match shape {
+        ClipPath::Inset {
+            top,
+            right,
+            bottom,
+            left,
+            round,
+        } => {
+            let (ix1, iy1) = (x1 + left, y1 + bottom);
+            let (ix2, iy2) = ((x2 - right).max(ix1), (y2 - top).max(iy1));
+            let (rx, ry) =
+                round.map_or((0.0, 0.0), |r| (r.resolve(ix2 - ix1), r.resolve(iy2 - iy1)));
+            rounded_ring(ix1, iy1, ix2, iy2, rx, ry)
+        }
+        ClipPath::Circle { radius } => {
+            let r = radius.map_or(w.min(h) / 2.0, |r| {
+                r.resolve(((w * w + h * h) / 2.0).sqrt())
+            });
+            let (cx, cy) = (x1 + w / 2.0, y1 + h / 2.0);
+            rounded_ring(cx - r, cy - r, cx + r, cy + r, r, r)
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn render_empty_page() {
+        let config = LayoutConfig::a4();
+        let bytes = render_pdf(&config).unwrap();
+        assert!(bytes.len() > 100, "PDF should have content");
+        // PDF magic number
+        assert_eq!(&bytes[0..5], b"%PDF-");
+    }
+
+    fn text_box(text: &str) -> LayoutBox {
+        let mut lbox = LayoutBox::new(40.0, 40.0, 200.0, 20.0);
+        lbox.text = Some(TextContent {
+            lines: vec![TextLine {
+                text: text.to_string(),
+                x_offset: 0.0,
+                y_offset: 0.0,
+            }],
+            font_family: "Helvetica".to_string(),
+            font_size: 12.0,
+            color: [0.0, 0.0, 0.0, 1.0],
+            line_height: 16.0,
+            text_align: "left".to_string(),
+            ..TextContent::default()
+        });
+        lbox
+    }
+
+    fn ops_for(boxes: Vec<LayoutBox>) -> Vec<Op> {
+        ops_with_min_line_width(boxes, 0.0)
+    }
+
+    fn ops_with_min_line_width(boxes: Vec<LayoutBox>, min_line_width: f32) -> Vec<Op> {
+        let images = HashMap::new();
+        let embedded_fonts = HashMap::new();
+        let ctx = RenderContext {
+            page_width: 595.0,
+            page_height: 842.0,
+            background: None,
+            images: &images,
+            embedded_fonts: &embedded_fonts,
+            outline_fonts: None,
+            min_line_width,
+            scale: 1.0,
+            gradients: RefCell::default(),
+            grayscale: false,
+        };
+        page_ops(
+            &PageLayout {
+                page_index: 0,
+                boxes,
             },
+            &ctx,
+        )
+    }
+
+    #[test]
+    fn plain_text_uses_default_render_mode() {
+        let ops = ops_for(vec![text_box("Plain")]);
+        assert!(!ops
+            .iter()
+            .any(|op| matches!(op, Op::SetTextRenderingMode { .. })));
+    }
+
+    #[test]
+    fn stroked_text_sets_stroke_render_mode() {
+        let mut lbox = text_box("Outline");
+        let text = lbox.text.as_mut().unwrap();
+        text.render_mode = TextRenderMode::Stroke;
+        text.stroke = Some(BorderStyle {
+            width: 0.75,
+            color: [1.0, 0.0, 0.0, 1.0],
+            ..Default::default()
+        });
+        let ops = ops_for(vec![lbox]);
+        let mode_at = ops
+            .iter()
+            .position(|op| {
+                matches!(
+                    op,
+                    Op::SetTextRenderingMode {
+                        mode: TextRenderingMode::Stroke
+                    }
+                )
+            })
+            .expect("stroke mode set");
+        let write_at = ops
+            .iter()
+            .position(|op| matches!(op, Op::WriteTextBuiltinFont { .. }))
+            .unwrap();
+        assert!(mode_at < write_at);
+        assert!(ops
+            .iter()
+            .any(|op| matches!(op, Op::SetOutlineThickness { pt } if pt.0 == 0.75)));
+    }
+
+    #[test]
+    fn invisible_text_is_still_written() {
+        let mut lbox = text_box("Hidden OCR layer");
+        lbox.text.as_mut().unwrap().render_mode = TextRenderMode::Invisible;
+        let ops = ops_for(vec![lbox]);
+        assert!(ops.iter().any(|op| matches!(
+            op,
+            Op::SetTextRenderingMode {
+                mode: TextRenderingMode::Invisible
+            }
+        )));
+        let written: Vec<&TextItem> = ops
+            .iter()
+            .filter_map(|op| match op {
+                Op::WriteTextBuiltinFont { items, .. } => Some(items),
+                _ => None,
+            })
+            .flatten()
+            .collect();
+        assert!(matches!(written[..], [TextItem::Text(t)] if t == "Hidden OCR layer"));
+    }
+
+    #[test]
+    fn vertical_rl_text_advances_down_columns_right_to_left() {
+        let mut lbox = text_box("");
+        if let Some(text) = &mut lbox.text {
+            text.writing_mode = WritingMode::VerticalRl;
+            // Two columns as laid out by pagination: first column rightmost.
+            text.lines = vec![
+                TextLine {
+                    text: "縦書".to_string(),
+                    x_offset: 16.0,
+                    y_offset: 0.0,
+                },
+                TextLine {
+                    text: "き".to_string(),
+                    x_offset: 0.0,
+                    y_offset: 0.0,
+                },
+            ];
+        }
+        let cursors: Vec<(f32, f32)> = ops_for(vec![lbox])
+            .iter()
+            .filter_map(|op| match op {
+                Op::SetTextCursor { pos } => Some((pos.x.0, pos.y.0)),
+                _ => None,
+            })
+            .collect();
+        assert_eq!(cursors.len(), 3, "one text run per glyph");
+        let (first, second, next_column) = (cursors[0], cursors[1], cursors[2]);
+        assert_eq!(first.0, second.0);
+        assert!(second.1 < first.1, "glyphs advance downwards");
+        assert!(next_column.0 < first.0, "columns proceed right to left");
+        assert_eq!(next_column.1, first.1);
+    }
+
+    #[test]
+    fn base_fonts_are_referenced_by_name_by_default() {
+        let mut config = LayoutConfig::a4();
+        config.pages.push(PageLayout {
+            page_index: 0,
+            boxes: vec![text_box("Hello")],
+        });
+
+        let bytes = render_pdf(&config).unwrap();
+        let contains = |needle: &[u8]| bytes.windows(needle.len()).any(|w| w == needle);
+        assert!(contains(b"Helvetica"));
+        assert!(!contains(b"FontFile"), "standard font should not be embedded");
+    }
+
+    #[test]
+    fn rendering_intent_is_set_on_every_page() {
+        let mut config = LayoutConfig::a4();
+        config.rendering_intent = Some(crate::layout_config::RenderingIntent::Perceptual);
+        for page_index in 0..2 {
+            config.pages.push(PageLayout {
+                page_index,
+                boxes: vec![text_box("Colour")],
+            });
+        }
+        let bytes = render_pdf(&config).unwrap();
+        let doc = lopdf::Document::load_mem(&bytes).unwrap();
+        let pages = doc.get_pages();
+        assert_eq!(pages.len(), 2);
+        for page_id in pages.into_values() {
+            let content = doc.get_page_content(page_id).unwrap();
+            assert!(content.starts_with(b"/Perceptual ri\n"));
+        }
+    }
+
+    #[test]
+    fn xmp_packet_is_embedded_verbatim() {
+        let packet = r#"<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description rdf:about="" xmlns:acme="urn:acme"><acme:batch>42</acme:batch></rdf:Description></rdf:RDF></x:xmpmeta>"#;
+        let mut config = LayoutConfig::a4();
+        config.xmp = Some(packet.to_string());
+        let bytes = render_pdf(&config).unwrap();
+
+        let doc = lopdf::Document::load_mem(&bytes).unwrap();
+        let id = doc
+            .catalog()
+            .unwrap()
+            .get(b"Metadata")
+            .and_then(lopdf::Object::as_reference)
+            .unwrap();
+        let stream = doc.get_object(id).and_then(lopdf::Object::as_stream).unwrap();
+        assert_eq!(stream.content, packet.as_bytes());
+    }
+
+    #[test]
+    fn stripped_metadata_leaves_no_info_xmp_or_id() {
+        let mut config = LayoutConfig::a4();
+        config.title = "Quarterly report".to_string();
+        config.xmp = Some("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"/>".to_string());
+        config.strip_metadata = true;
+        let bytes = render_pdf(&config).unwrap();
+
+        let doc = lopdf::Document::load_mem(&bytes).unwrap();
+        assert!(doc.trailer.get(b"Info").is_err(), "Info dictionary present");
+        assert!(doc.catalog().unwrap().get(b"Metadata").is_err(), "XMP present");
+        let id = doc.trailer.get(b"ID").and_then(lopdf::Object::as_array).unwrap();
+        assert_eq!(id.len(), 2);
+        for part in id {
+            assert!(matches!(part, lopdf::Object::String(b, _) if b.iter().all(|&x| x == 0)));
+        }
+        let contains = |needle: &[u8]| bytes.windows(needle.len()).any(|w| w == needle);
+        assert!(!contains(b"Quarterly report"));
+    }
+
+    #[test]
+    fn optimize_removes_dead_and_duplicate_objects() {
+        let mut config = LayoutConfig::a4();
+        config.pages.push(PageLayout {
+            page_index: 0,
+            boxes: vec![text_box("Optimised")],
+        });
+        let rendered = render_pdf(&config).unwrap();
+
+        // Reference a large form XObject from the page, then drop the
+        // reference again; also add two identical live objects.
+        let mut doc = lopdf::Document::load_mem(&rendered).unwrap();
+        let stamp_content = b"0 0 m 100 100 l S\n".repeat(200);
+        let stamp = doc.add_object(lopdf::Stream::new(
+            lopdf::dictionary! { "Type" => "XObject", "Subtype" => "Form" },
+            stamp_content.clone(),
+        ));
+        let page_id = *doc.get_pages().values().next().unwrap();
+        let page = doc.get_object_mut(page_id).and_then(lopdf::Object::as_dict_mut).unwrap();
+        page.set("Stamp", lopdf::Object::Reference(stamp));
+        page.remove(b"Stamp");
+        for key in ["ExtraA", "ExtraB"] {
+            let id = doc.add_object(lopdf::dictionary! { "Type" => "ExtGState", "CA" => 0.5 });
+            doc.trailer.set(key, lopdf::Object::Reference(id));
+        }
+
+        let save = |doc: &lopdf::Document| {
+            let mut out = Vec::new();
+            doc.clone().save_to(&mut out).unwrap();
+            out
+        };
+        let plain = save(&doc);
+        optimize(&mut doc);
+        let optimized = save(&doc);
+
+        assert!(
+            optimized.len() < plain.len(),
+            "optimized {} bytes, plain {} bytes",
+            optimized.len(),
+            plain.len()
+        );
+        assert_eq!(doc.get_pages().len(), 1);
+        assert!(
+            !doc.objects.values().any(|o| matches!(o, lopdf::Object::Stream(s) if s.content == stamp_content)),
+            "dead XObject survived"
+        );
+        let extra_a = doc.trailer.get(b"ExtraA").and_then(lopdf::Object::as_reference).unwrap();
+        let extra_b = doc.trailer.get(b"ExtraB").and_then(lopdf::Object::as_reference).unwrap();
+        assert_eq!(extra_a, extra_b, "identical objects were not merged");
+    }
+
+    #[test]
+    fn optimize_keeps_identical_annotations_on_different_pages_apart() {
+        let mut config = LayoutConfig::a4();
+        for page_index in 0..2 {
+            config.pages.push(PageLayout {
+                page_index,
+                boxes: vec![text_box("Linked")],
+            });
+        }
+        let rendered = render_pdf(&config).unwrap();
+        let mut doc = lopdf::Document::load_mem(&rendered).unwrap();
+        let page_ids: Vec<_> = doc.get_pages().values().copied().collect();
+        for &page_id in &page_ids {
+            let link = doc.add_object(lopdf::dictionary! {
+                "Type" => "Annot",
+                "Subtype" => "Link",
+                "Rect" => vec![0.into(), 0.into(), 10.into(), 10.into()],
+                "Border" => vec![0.into(), 0.into(), 0.into()],
+            });
+            let annots = doc.add_object(vec![lopdf::Object::Reference(link)]);
+            let page = doc.get_object_mut(page_id).and_then(lopdf::Object::as_dict_mut).unwrap();
+            page.set("Annots", lopdf::Object::Reference(annots));
+        }
+
+        optimize(&mut doc);
+        let annotations: Vec<_> = doc
+            .get_pages()
+            .values()
+            .map(|&id| {
+                let page = doc.get_dictionary(id).unwrap();
+                let annots = page.get(b"Annots").and_then(lopdf::Object::as_reference).unwrap();
+                let array = doc.get_object(annots).and_then(lopdf::Object::as_array).unwrap();
+                (annots, array[0].as_reference().unwrap())
+            })
+            .collect();
+        assert_eq!(annotations.len(), 2);
+        assert_ne!(annotations[0].0, annotations[1].0, "/Annots arrays were merged");
+        assert_ne!(annotations[0].1, annotations[1].1, "annotations were merged");
+    }
+
+    #[test]
+    fn malformed_xmp_is_rejected() {
+        let mut config = LayoutConfig::a4();
+        config.xmp = Some("<x:xmpmeta>".to_string());
+        let err = render_pdf(&config).unwrap_err();
+        assert!(err.contains("never closed"), "unexpected error: {err}");
+    }
+
+    #[test]
+    fn forced_embedding_requires_a_font_program() {
+        let mut config = LayoutConfig::a4();
+        config.embed_base_fonts = true;
+        let err = render_pdf(&config).unwrap_err();
+        assert!(err.contains("Helvetica"), "unexpected error: {err}");
+    }
+
+    #[test]
+    fn forced_embedding_writes_the_font_program() {
+        let mut config = LayoutConfig::a4();
+        config.embed_base_fonts = true;
+        config.pages.push(PageLayout {
+            page_index: 0,
+            boxes: vec![text_box("Hi!")],
+        });
+        let mut fonts = FontManager::default();
+        fonts
+            .load_font("Helvetica", false, false, square_glyph_font())
+            .unwrap();
+        let pdf = render_pdf_with_fonts(&config, &fonts).unwrap();
+
+        let doc = lopdf::Document::load_mem(&pdf).unwrap();
+        let program = doc.objects.values().find_map(|o| {
+            let dict = o.as_dict().ok()?;
+            if dict.get(b"Type").and_then(lopdf::Object::as_name).ok()? != b"FontDescriptor" {
+                return None;
+            }
+            let file = dict.get(b"FontFile2").or_else(|_| dict.get(b"FontFile3")).ok()?;
+            doc.get_object(file.as_reference().ok()?).ok()?.as_stream().ok().cloned()
+        });
+        let program = program.expect("no font descriptor with an embedded program");
+        assert!(!program.content.is_empty());
+    }
+
+    /// A TrueType program whose every character from U+0020 to U+007E is
+    /// the same glyph: a 400 × 700 unit square, 500 units wide.
+    fn square_glyph_font() -> Vec<u8> {
+        let mut head = vec![0u8; 54];
+        head[..4].copy_from_slice(&0x0001_0000u32.to_be_bytes());
+        head[12..16].copy_from_slice(&0x5F0F_3CF5u32.to_be_bytes());
+        head[18..20].copy_from_slice(&1000u16.to_be_bytes());
+        let mut hhea = vec![0u8; 36];
+        hhea[..4].copy_from_slice(&0x0001_0000u32.to_be_bytes());
+        hhea[4..6].copy_from_slice(&800i16.to_be_bytes());
+        hhea[6..8].copy_from_slice(&(-200i16).to_be_bytes());
+        hhea[34..36].copy_from_slice(&2u16.to_be_bytes());
+        let mut maxp = 0x0000_5000u32.to_be_bytes().to_vec();
+        maxp.extend_from_slice(&2u16.to_be_bytes());
+        // Format 13 maps a whole range of characters to one glyph.
+        let mut cmap = Vec::new();
+        for field in [0u16, 1, 3, 10, 0, 12, 13, 0] {
+            cmap.extend_from_slice(&field.to_be_bytes());
+        }
+        for field in [28u32, 0, 1, 0x20, 0x7E, 1] {
+            cmap.extend_from_slice(&field.to_be_bytes());
+        }
+        // Glyph 0 is empty; glyph 1 is one contour of four on-curve points,
+        // given as x then y deltas.
+        let mut glyf = Vec::new();
+        let coords = [100i16, 400, 0, -400, 0, 0, 700, 0];
+        for field in [1i16, 100, 0, 500, 700, 3, 0].into_iter().chain(coords) {
+            glyf.extend_from_slice(&field.to_be_bytes());
+        }
+        glyf.splice(14..14, [1u8; 4]);
+        glyf.resize(36, 0);
+        let loca: Vec<u8> = [0u16, 0, 18].iter().flat_map(|o| o.to_be_bytes()).collect();
+        let hmtx: Vec<u8> = [500u16, 0, 500, 100]
+            .iter()
+            .flat_map(|v| v.to_be_bytes())
+            .collect();
+
+        // Table records must be sorted by tag.
+        let tables: [(&[u8; 4], Vec<u8>); 7] = [
+            (b"cmap", cmap),
+            (b"glyf", glyf),
+            (b"head", head),
+            (b"hhea", hhea),
+            (b"hmtx", hmtx),
+            (b"loca", loca),
+            (b"maxp", maxp),
+        ];
+        let mut font = 0x0001_0000u32.to_be_bytes().to_vec();
+        for field in [tables.len() as u16, 64, 2, 48] {
+            font.extend_from_slice(&field.to_be_bytes());
+        }
+        let mut offset = 12 + 16 * tables.len();
+        for (tag, data) in &tables {
+            font.extend_from_slice(*tag);
+            font.extend_from_slice(&0u32.to_be_bytes());
+            font.extend_from_slice(&(offset as u32).to_be_bytes());
+            font.extend_from_slice(&(data.len() as u32).to_be_bytes());
+            offset += data.len().next_multiple_of(4);
+        }
+        for (_, data) in &tables {
+            font.extend_from_slice(data);
+            font.resize(font.len().next_multiple_of(4), 0);
+        }
+        font
+    }
+
+    #[test]
+    fn text_as_outlines_leaves_no_fonts_or_text() {
+        let mut config = LayoutConfig::a4();
+        config.text_as_outlines = true;
+        config.pages.push(PageLayout {
+            page_index: 0,
+            boxes: vec![text_box("Hi!")],
         });
+        let err = render_pdf(&config).unwrap_err();
+        assert!(err.contains("Helvetica"), "unexpected error: {err}");
+
+        let mut fonts = FontManager::default();
+        fonts
+            .load_font("Helvetica", false, false, square_glyph_font())
+            .unwrap();
+        let pdf = render_pdf_with_fonts(&config, &fonts).unwrap();
+        assert!(crate::inspect::list_fonts(&pdf).unwrap().is_empty());
+
+        let doc = lopdf::Document::load_mem(&pdf).unwrap();
+        assert!(doc.extract_text(&[1]).unwrap_or_default().trim().is_empty());
+        let page_id = *doc.get_pages().get(&1).unwrap();
+        let content = doc.get_page_content(page_id).unwrap();
+        let content = lopdf::content::Content::decode(&content).unwrap();
+        let operators: Vec<&str> = content
+            .operations
+            .iter()
+            .map(|op| op.operator.as_str())
+            .collect();
+        assert!(!operators.contains(&"BT"), "{operators:?}");
+        // One filled path for the three glyphs, each a four-point ring.
+        assert_eq!(operators.iter().filter(|op| **op == "f").count(), 1);
+        assert_eq!(operators.iter().filter(|op| **op == "m").count(), 3);
     }
 
-    // Text
-    if let Some(text) = &lbox.text {
-        let font = match (text.bold, text.italic) {
-            (true, true) => BuiltinFont::HelveticaBoldOblique,
-            (true, false) => BuiltinFont::HelveticaBold,
-            (false, true) => BuiltinFont::HelveticaOblique,
-            (false, false) => BuiltinFont::Helvetica,
-        };
+    /// A `w`×`h` grey PNG as a base64 data URI.
+    fn png_data_uri(w: u32, h: u32) -> String {
+        let img = ::image::GrayImage::from_pixel(w, h, ::image::Luma([128]));
+        let mut png = std::io::Cursor::new(Vec::new());
+        img.write_to(&mut png, ::image::ImageFormat::Png).unwrap();
+        format!("data:image/png;base64,{}", BASE64_STD.encode(png.into_inner()))
+    }
 
-        for tline in &text.lines {
-            if tline.text.is_empty() {
-                continue;
-            }
-            let text_x = lbox.x + tline.x_offset;
-            // Baseline ≈ top of line + ascender (approx 0.75 × font_size)
-            let ascender_offset = text.font_size * 0.75;
-            let text_y = pdf_y - tline.y_offset - ascender_offset;
+    /// An 8×8 red JPEG whose APP2 segment carries `profile`.
+    fn jpeg_with_icc_profile(profile: &[u8]) -> String {
+        let img = ::image::RgbImage::from_pixel(8, 8, ::image::Rgb([200, 40, 40]));
+        let mut jpeg = std::io::Cursor::new(Vec::new());
+        img.write_to(&mut jpeg, ::image::ImageFormat::Jpeg).unwrap();
+        let jpeg = jpeg.into_inner();
+        let mut app2 = b"\xff\xe2".to_vec();
+        app2.extend_from_slice(&(2 + 14 + profile.len() as u16).to_be_bytes());
+        app2.extend_from_slice(b"ICC_PROFILE\0\x01\x01");
+        app2.extend_from_slice(profile);
+        // Right after the SOI marker.
+        let data = [&jpeg[..2], &app2, &jpeg[2..]].concat();
+        format!("data:image/jpeg;base64,{}", BASE64_STD.encode(data))
+    }
 
-            ops.push(Op::StartTextSection);
-            ops.push(Op::SetTextCursor {
-                pos: Point {
-                    x: Pt(text_x),
-                    y: Pt(text_y),
-                },
-            });
-            ops.push(Op::SetFontSizeBuiltinFont {
-                size: Pt(text.font_size),
-                font,
-            });
-            ops.push(Op::SetLineHeight {
-                lh: Pt(text.line_height),
-            });
-            ops.push(Op::SetFillColor {
-                col: Color::Rgb(Rgb {
-                    r: text.color[0],
-                    g: text.color[1],
-                    b: text.color[2],
-                    icc_profile: None,
-                }),
-            });
-            ops.push(Op::WriteTextBuiltinFont {
-                items: vec![TextItem::Text(to_winlatin(&tline.text))],
-                font,
+    #[test]
+    fn image_color_management_tags_images_with_their_icc_profile() {
+        // The header of a non-sRGB RGB profile; only its colour space is read.
+        let mut profile = vec![0u8; 128];
+        profile[..4].copy_from_slice(&128u32.to_be_bytes());
+        profile[16..20].copy_from_slice(b"RGB ");
+        profile[36..40].copy_from_slice(b"acsp");
+        let mut lbox = LayoutBox::new(40.0, 40.0, 100.0, 100.0);
+        lbox.image = Some(ImageContent {
+            src: jpeg_with_icc_profile(&profile),
+            width: 100.0,
+            height: 100.0,
+            filter: Vec::new(),
+        });
+        let mut config = LayoutConfig::a4();
+        config.pages = vec![PageLayout {
+            page_index: 0,
+            boxes: vec![lbox],
+        }];
+
+        // The image's colour space, with the profile stream it refers to.
+        let color_space = |config: &LayoutConfig| {
+            let doc = lopdf::Document::load_mem(&render_pdf(config).unwrap()).unwrap();
+            let image = doc
+                .objects
+                .values()
+                .filter_map(|o| o.as_stream().ok())
+                .find(|s| {
+                    let subtype = s.dict.get(b"Subtype").and_then(lopdf::Object::as_name);
+                    subtype.is_ok_and(|n| n == b"Image")
+                })
+                .unwrap();
+            let color_space = image.dict.get(b"ColorSpace").unwrap().clone();
+            let profile = color_space.as_array().ok().map(|cs| {
+                let id = cs[1].as_reference().unwrap();
+                let icc = doc.get_object(id).and_then(lopdf::Object::as_stream).unwrap();
+                assert_eq!(icc.dict.get(b"N").and_then(lopdf::Object::as_i64).unwrap(), 3);
+                icc.decompressed_content().unwrap_or_else(|_| icc.content.clone())
             });
-            ops.push(Op::EndTextSection);
+            (color_space, profile)
+        };
 
-            // Underline
-            if text.underline {
-                let underline_y = text_y - text.font_size * 0.1;
-                ops.push(Op::SetOutlineThickness { pt: Pt(0.5) });
-                ops.push(Op::SetOutlineColor {
-                    col: Color::Rgb(Rgb {
-                        r: text.color[0],
-                        g: text.color[1],
-                        b: text.color[2],
-                        icc_profile: None,
-                    }),
-                });
-                ops.push(Op::DrawLine {
-                    line: Line {
-                        points: vec![
-                            LinePoint {
-                                p: Point {
-                                    x: Pt(text_x),
-                                    y: Pt(underline_y),
-                                },
-                                bezier: false,
-                            },
-                            LinePoint {
-                                p: Point {
-                                    x: Pt(text_x + lbox.width),
-                                    y: Pt(underline_y),
-                                },
-                                bezier: false,
-                            },
-                        ],
-                        is_closed: false,
-                    },
-                });
-            }
+        let (device, none) = color_space(&config);
+        assert_eq!(device.as_name().unwrap(), b"DeviceRGB");
+        assert!(none.is_none());
+
+        config.image_color_management = true;
+        let (tagged, embedded) = color_space(&config);
+        assert_eq!(tagged.as_array().unwrap()[0].as_name().unwrap(), b"ICCBased");
+        assert_eq!(embedded.unwrap(), profile);
+    }
+
+    #[test]
+    fn grayscale_paints_colours_and_images_in_device_gray() {
+        let mut filled = LayoutBox::new(40.0, 40.0, 100.0, 20.0);
+        filled.background_color = Some([1.0, 0.0, 0.0, 1.0]);
+        let img = ::image::RgbImage::from_pixel(8, 8, ::image::Rgb([200, 40, 40]));
+        let mut png = std::io::Cursor::new(Vec::new());
+        img.write_to(&mut png, ::image::ImageFormat::Png).unwrap();
+        let mut pictured = LayoutBox::new(40.0, 80.0, 100.0, 100.0);
+        pictured.image = Some(ImageContent {
+            src: format!("data:image/png;base64,{}", BASE64_STD.encode(png.into_inner())),
+            width: 100.0,
+            height: 100.0,
+            filter: Vec::new(),
+        });
+        let mut config = LayoutConfig::a4();
+        config.grayscale = true;
+        config.pages = vec![PageLayout {
+            page_index: 0,
+            boxes: vec![filled, pictured],
+        }];
+
+        let doc = lopdf::Document::load_mem(&render_pdf(&config).unwrap()).unwrap();
+        let page_id = *doc.get_pages().values().next().unwrap();
+        let content = doc.get_page_content(page_id).unwrap();
+        let content = lopdf::content::Content::decode(&content).unwrap();
+        let fills: Vec<_> = content
+            .operations
+            .iter()
+            .filter(|op| matches!(op.operator.as_str(), "g" | "rg" | "G" | "RG"))
+            .collect();
+        assert!(!fills.is_empty());
+        assert!(fills.iter().all(|op| op.operator.eq_ignore_ascii_case("g")), "{fills:?}");
+        // Pure red at Rec. 709 luminance.
+        let red = fills.iter().find(|op| op.operator == "g").unwrap();
+        let level = red.operands[0].as_float().unwrap();
+        assert!((level - 0.2126).abs() < 1e-3, "{level}");
+
+        let image = doc
+            .objects
+            .values()
+            .filter_map(|o| o.as_stream().ok())
+            .find(|s| {
+                let subtype = s.dict.get(b"Subtype").and_then(lopdf::Object::as_name);
+                subtype.is_ok_and(|n| n == b"Image")
+            })
+            .unwrap();
+        let color_space = image.dict.get(b"ColorSpace").unwrap();
+        assert_eq!(color_space.as_name().unwrap(), b"DeviceGray");
+    }
+
+    #[test]
+    fn cached_render_reuses_decoded_images() {
+        let mut lbox = LayoutBox::new(40.0, 40.0, 100.0, 100.0);
+        lbox.image = Some(ImageContent {
+            src: png_data_uri(8, 8),
+            width: 100.0,
+            height: 100.0,
+            filter: Vec::new(),
+        });
+        let mut config = LayoutConfig::a4();
+        config.pages = vec![PageLayout {
+            page_index: 0,
+            boxes: vec![lbox],
+        }];
+
+        let fonts = FontManager::default();
+        let cache = crate::cache::LruCache::default();
+        let uncached = render_pdf_with_fonts(&config, &fonts).unwrap();
+        let first = render_pdf_with_cache(&config, &fonts, Some(&cache)).unwrap();
+        assert_eq!(cache.len(), 1);
+        let second = render_pdf_with_cache(&config, &fonts, Some(&cache)).unwrap();
+        assert_eq!(cache.len(), 1);
+        assert_eq!(first, uncached);
+        assert_eq!(second, uncached);
+    }
+
+    #[test]
+    fn rounded_image_is_drawn_inside_a_clipping_path() {
+        let mut lbox = LayoutBox::new(40.0, 40.0, 100.0, 100.0);
+        lbox.border_radius = Some(Radius::Percent(50.0));
+        lbox.image = Some(ImageContent {
+            src: png_data_uri(8, 8),
+            width: 100.0,
+            height: 100.0,
+            filter: Vec::new(),
+        });
+        let clip: Vec<(f32, f32)> = ops_for(vec![lbox.clone()])
+            .iter()
+            .find_map(|op| match op {
+                Op::DrawPolygon { polygon } if matches!(polygon.mode, PaintMode::Clip) => Some(
+                    polygon.rings[0]
+                        .points
+                        .iter()
+                        .map(|lp| (lp.p.x.0, lp.p.y.0))
+                        .collect(),
+                ),
+                _ => None,
+            })
+            .expect("clipping path");
+        // A circle of radius 50 about the image centre (90, 842 - 90).
+        for (x, y) in clip {
+            let r = ((x - 90.0).powi(2) + (y - 752.0).powi(2)).sqrt();
+            assert!((r - 50.0).abs() < 1e-2, "({x}, {y}) is off the circle");
         }
 
-        // List marker
-        if let Some(marker) = &text.list_marker {
-            let marker_x = lbox.x - 16.0;
-            let marker_y = pdf_y - text.font_size * 0.75;
-            ops.push(Op::StartTextSection);
-            ops.push(Op::SetTextCursor {
-                pos: Point {
-                    x: Pt(marker_x),
-                    y: Pt(marker_y),
-                },
-            });
-            ops.push(Op::SetFontSizeBuiltinFont {
-                size: Pt(text.font_size),
-                font: BuiltinFont::Helvetica,
+        let mut config = LayoutConfig::a4();
+        config.pages.push(PageLayout {
+            page_index: 0,
+            boxes: vec![lbox],
+        });
+        let doc = lopdf::Document::load_mem(&render_pdf(&config).unwrap()).unwrap();
+        let page_id = *doc.get_pages().get(&1).unwrap();
+        let content = doc.get_page_content(page_id).unwrap();
+        let content = lopdf::content::Content::decode(&content).unwrap();
+        let operators: Vec<&str> = content
+            .operations
+            .iter()
+            .map(|op| op.operator.as_str())
+            .collect();
+        let at = |name: &str| operators.iter().position(|op| *op == name);
+        let (clip, draw) = (at("W").expect("no clip"), at("Do").expect("no image"));
+        assert!(clip < draw, "{operators:?}");
+        assert!(operators[..clip].contains(&"q"));
+        assert!(operators[draw..].contains(&"Q"));
+    }
+
+    #[test]
+    fn rotated_box_is_wrapped_in_a_transformation_matrix() {
+        let mut lbox = LayoutBox::new(100.0, 100.0, 100.0, 50.0);
+        lbox.background_color = Some([1.0, 0.0, 0.0, 1.0]);
+        lbox.transform = Some([0.0, 1.0, -1.0, 0.0, 0.0, 0.0]); // rotate(90deg)
+        let ops = ops_for(vec![lbox]);
+
+        assert!(matches!(ops.first(), Some(Op::SaveGraphicsState)), "{ops:?}");
+        let Some(Op::SetTransformationMatrix {
+            matrix: CurTransMat::Raw(m),
+        }) = ops.get(1)
+        else {
+            panic!("expected a cm operator, got {ops:?}");
+        };
+        // Clockwise quarter turn about the box centre (150, 842 - 125).
+        let expected = [0.0, -1.0, 1.0, 0.0, -567.0, 867.0];
+        for (got, want) in m.iter().zip(expected) {
+            assert!((got - want).abs() < 1e-3, "{m:?}");
+        }
+        let fill = ops.iter().position(|op| matches!(op, Op::DrawPolygon { .. }));
+        assert!(fill.is_some_and(|i| i > 1));
+        assert!(matches!(ops.last(), Some(Op::RestoreGraphicsState)), "{ops:?}");
+    }
+
+    #[test]
+    fn box_shadow_paints_an_offset_shape_beneath_the_box() {
+        let mut lbox = LayoutBox::new(100.0, 100.0, 100.0, 50.0);
+        lbox.background_color = Some([1.0, 1.0, 1.0, 1.0]);
+        lbox.box_shadow = vec![Shadow {
+            offset_x: 4.0,
+            offset_y: 6.0,
+            blur: 0.0,
+            spread: 0.0,
+            color: [0.0, 0.0, 0.0, 0.5],
+        }];
+        let ops = ops_for(vec![lbox]);
+
+        let fills: Vec<Vec<(f32, f32)>> = ops
+            .iter()
+            .filter_map(|op| match op {
+                Op::DrawPolygon { polygon } if matches!(polygon.mode, PaintMode::Fill) => Some(
+                    polygon.rings[0]
+                        .points
+                        .iter()
+                        .map(|lp| (lp.p.x.0, lp.p.y.0))
+                        .collect(),
+                ),
+                _ => None,
+            })
+            .collect();
+        // The shadow (down and to the right), then the background on top.
+        assert_eq!(fills.len(), 2, "{ops:?}");
+        assert_eq!(fills[0][0], (104.0, 842.0 - 156.0));
+        assert_eq!(fills[0][2], (204.0, 842.0 - 106.0));
+        assert_eq!(fills[1][0], (100.0, 842.0 - 150.0));
+        assert!(ops.iter().any(|op| matches!(
+            op,
+            Op::SetFillColor {
+                col: Color::Rgb(Rgb { r, .. })
+            } if (*r - 0.5).abs() < 1e-6
+        )));
+    }
+
+    #[test]
+    fn page_background_is_drawn_beneath_content_on_every_page() {
+        let png = png_data_uri(64, 64);
+        let mut config = LayoutConfig::a4();
+        config.page_background = Some(PageBackground {
+            src: png,
+            mode: BackgroundMode::Tile,
+        });
+        for page_index in 0..2 {
+            config.pages.push(PageLayout {
+                page_index,
+                boxes: vec![text_box("Letterhead")],
             });
-            ops.push(Op::SetFillColor {
-                col: Color::Rgb(Rgb {
-                    r: text.color[0],
-                    g: text.color[1],
-                    b: text.color[2],
-                    icc_profile: None,
-                }),
+        }
+
+        let bytes = render_pdf(&config).unwrap();
+        let doc = lopdf::Document::load_mem(&bytes).unwrap();
+        let pages = doc.get_pages();
+        assert_eq!(pages.len(), 2);
+        for page_id in pages.into_values() {
+            let content = doc.get_page_content(page_id).unwrap();
+            let ops = lopdf::content::Content::decode(&content).unwrap().operations;
+            let first_draw = ops.iter().position(|op| op.operator == "Do" || op.operator == "BT");
+            assert_eq!(first_draw.map(|i| ops[i].operator.as_str()), Some("Do"));
+            assert!(ops.iter().any(|op| op.operator == "BT"));
+        }
+    }
+
+    #[test]
+    fn single_content_stream_merges_contents_arrays() {
+        use lopdf::{dictionary, Object, Stream};
+
+        let mut config = LayoutConfig::a4();
+        config.single_content_stream = true;
+        config.rendering_intent = Some(crate::layout_config::RenderingIntent::Saturation);
+        for page_index in 0..2 {
+            config.pages.push(PageLayout {
+                page_index,
+                boxes: vec![text_box("Minimal reader")],
             });
-            ops.push(Op::WriteTextBuiltinFont {
-                items: vec![TextItem::Text(to_winlatin(marker))],
-                font: BuiltinFont::Helvetica,
+        }
+        let bytes = render_pdf(&config).unwrap();
+        let doc = lopdf::Document::load_mem(&bytes).unwrap();
+        for page_id in doc.get_pages().into_values() {
+            let page = doc.get_dictionary(page_id).unwrap();
+            assert!(matches!(page.get(b"Contents"), Ok(Object::Reference(_))));
+            assert_eq!(doc.get_page_contents(page_id).len(), 1);
+        }
+
+        // A page split over two streams, as other producers write them.
+        let mut doc = lopdf::Document::with_version("1.7");
+        let page = (lopdf::Dictionary::new(), b"BT (a) Tj ET".to_vec());
+        let page_id = crate::test_pdf::add_pages(&mut doc, [page])[0];
+        let second = doc.add_object(Stream::new(dictionary! {}, b"BT (b) Tj ET".to_vec()));
+        let page = doc.get_dictionary_mut(page_id).unwrap();
+        let first = page.get(b"Contents").and_then(Object::as_reference).unwrap();
+        page.set("Contents", vec![first.into(), second.into()]);
+
+        merge_content_streams(&mut doc).unwrap();
+        assert_eq!(doc.get_page_contents(page_id).len(), 1);
+        assert_eq!(
+            doc.get_page_content(page_id).unwrap(),
+            b"BT (a) Tj ET\nBT (b) Tj ET\n"
+        );
+        assert!(doc.get_object(first).is_err(), "old streams are dropped");
+    }
+
+    #[test]
+    fn font_compression_shrinks_embedded_font_programs() {
+        // A large, repetitive stand-in for a CJK font program.
+        let program: Vec<u8> = (0..256 * 1024u32).map(|i| (i % 251 / 7) as u8).collect();
+        let build = |compress: bool| {
+            let mut doc = lopdf::Document::with_version("1.7");
+            let file = doc.add_object(lopdf::Stream::new(
+                lopdf::dictionary! { "Length1" => program.len() as i64 },
+                program.clone(),
+            ));
+            doc.add_object(lopdf::dictionary! {
+                "Type" => "FontDescriptor",
+                "FontName" => "ABCDEF+NotoSansCJK",
+                "FontFile2" => file,
             });
-            ops.push(Op::EndTextSection);
+            set_font_compression(&mut doc, compress);
+            let filtered = doc
+                .get_object(file)
+                .and_then(lopdf::Object::as_stream)
+                .map(|s| s.dict.has(b"Filter"))
+                .unwrap();
+            let mut out = Vec::new();
+            doc.save_to(&mut out).unwrap();
+            (out.len(), filtered)
+        };
+
+        let (compressed, compressed_filtered) = build(true);
+        let (plain, plain_filtered) = build(false);
+        assert!(compressed_filtered && !plain_filtered);
+        assert!(compressed < plain / 2, "compressed {compressed} bytes, plain {plain} bytes");
+    }
+
+    #[test]
+    fn hr_border_top_draws_a_dashed_coloured_rule() {
+        let html = r#"<hr style="border-top: 2px dashed red">"#;
+        let config = crate::pipeline::compute_layout_config(html, &Default::default());
+        let ops = ops_for(config.pages[0].boxes.clone());
+        let thickness = ops.iter().find_map(|op| match op {
+            Op::SetOutlineThickness { pt } => Some(pt.0),
+            _ => None,
+        });
+        assert_eq!(thickness, Some(2.0));
+        let dash = ops.iter().find_map(|op| match op {
+            Op::SetLineDashPattern { dash } => Some((dash.dash_1, dash.gap_1)),
+            _ => None,
+        });
+        assert_eq!(dash, Some((Some(6), Some(6))));
+        let color = ops.iter().find_map(|op| match op {
+            Op::SetOutlineColor {
+                col: Color::Rgb(Rgb { r, g, b, .. }),
+            } => Some((*r, *g, *b)),
+            _ => None,
+        });
+        assert_eq!(color, Some((1.0, 0.0, 0.0)));
+        // One line along the top edge rather than a rectangle.
+        let lines: Vec<usize> = ops
+            .iter()
+            .filter_map(|op| match op {
+                Op::DrawLine { line } => Some(line.points.len()),
+                _ => None,
+            })
+            .collect();
+        assert_eq!(lines, [2]);
+    }
+
+    #[test]
+    fn hairline_borders_are_widened_to_the_minimum() {
+        let mut lbox = LayoutBox::new(40.0, 40.0, 200.0, 20.0);
+        lbox.border = Some(BorderStyle {
+            width: 0.1,
+            color: [0.0, 0.0, 0.0, 1.0],
+            ..Default::default()
+        });
+        let thickness = |ops: Vec<Op>| {
+            ops.iter().find_map(|op| match op {
+                Op::SetOutlineThickness { pt } => Some(pt.0),
+                _ => None,
+            })
+        };
+        assert_eq!(thickness(ops_for(vec![lbox.clone()])), Some(0.1));
+        assert_eq!(
+            thickness(ops_with_min_line_width(vec![lbox], 0.5)),
+            Some(0.5)
+        );
+    }
+
+    #[test]
+    fn images_over_the_pixel_limit_are_skipped_before_decoding() {
+        let mut lbox = LayoutBox::new(40.0, 40.0, 100.0, 100.0);
+        lbox.image = Some(ImageContent {
+            src: png_data_uri(2000, 1000),
+            width: 100.0,
+            height: 100.0,
+            filter: Vec::new(),
+        });
+        let mut config = LayoutConfig::a4();
+        config.pages = vec![PageLayout {
+            page_index: 0,
+            boxes: vec![lbox],
+        }];
+        config.max_image_pixels = Some(1_000_000);
+
+        let (result, warnings) = diagnostics::collect(|| render_pdf(&config));
+        result.unwrap();
+        assert!(warnings
+            .iter()
+            .any(|d| d.missing_asset && d.message.contains("2000×1000 image exceeds")));
+
+        config.max_image_pixels = Some(2_000_000);
+        let (_, warnings) = diagnostics::collect(|| render_pdf(&config));
+        assert!(warnings.is_empty(), "{warnings:?}");
+    }
+
+    #[test]
+    fn linear_gradient_background_becomes_an_axial_shading() {
+        let mut lbox = LayoutBox::new(100.0, 100.0, 200.0, 50.0);
+        lbox.background_gradient = Some(Gradient {
+            shape: GradientShape::Linear { angle: 90.0 },
+            stops: vec![
+                GradientStop {
+                    offset: 0.0,
+                    color: [1.0, 0.0, 0.0, 1.0],
+                },
+                GradientStop {
+                    offset: 0.5,
+                    color: [0.0, 1.0, 0.0, 1.0],
+                },
+                GradientStop {
+                    offset: 1.0,
+                    color: [0.0, 0.0, 1.0, 1.0],
+                },
+            ],
+        });
+        let mut config = LayoutConfig::a4();
+        config.pages.push(PageLayout {
+            page_index: 0,
+            boxes: vec![lbox],
+        });
+
+        let bytes = render_pdf(&config).unwrap();
+        let doc = lopdf::Document::load_mem(&bytes).unwrap();
+        let page_id = *doc.get_pages().get(&1).unwrap();
+        let page = doc.get_dictionary(page_id).unwrap();
+        let resources = page.get_deref(b"Resources", &doc).unwrap();
+        let shadings = resources.as_dict().unwrap().get_deref(b"Shading", &doc);
+        let (_, shading) = shadings.unwrap().as_dict().unwrap().iter().next().unwrap();
+        let shading = doc.get_dictionary(shading.as_reference().unwrap()).unwrap();
+        assert_eq!(shading.get(b"ShadingType").unwrap().as_i64().unwrap(), 2);
+        let coords: Vec<f32> = shading
+            .get(b"Coords")
+            .and_then(lopdf::Object::as_array)
+            .unwrap()
+            .iter()
+            .map(|c| c.as_float().unwrap())
+            .collect();
+        for (got, want) in coords.iter().zip([100.0, 717.0, 300.0, 717.0]) {
+            assert!((got - want).abs() < 1e-3, "{coords:?}");
         }
+        let function = shading.get(b"Function").unwrap().as_dict().unwrap();
+        assert_eq!(function.get(b"FunctionType").unwrap().as_i64().unwrap(), 3);
+
+        let content = doc.get_page_content(page_id).unwrap();
+        let content = lopdf::content::Content::decode(&content).unwrap();
+        let operators: Vec<&str> = content
+            .operations
+            .iter()
+            .map(|op| op.operator.as_str())
+            .collect();
+        assert!(operators.contains(&"sh"), "{operators:?}");
+        assert!(!operators.contains(&"BMC"));
     }
 
-    // Image – embed from pre-registered XObject
-    if let Some(img) = &lbox.image {
-        if let Some(res) = images.get(&img.src) {
-            let px_w = res.px_width as f32;
-            let px_h = res.px_height as f32;
-            if px_w <= 0.0 || px_h <= 0.0 {
-                log::warn!("Skipping image — zero intrinsic dimensions");
-            } else {
-                // Determine render dimensions. If the layout gave us a zero
-                // width or height (e.g. because no CSS size was specified and
-                // the intrinsic resolution fallback in layout.rs couldn't run
-                // for non-data-URI sources), fall back to the intrinsic pixel
-                // size at 72 dpi (1 px = 1 pt).
-                let asp = px_w / px_h;
-                let render_w = if img.width > 0.0 {
-                    img.width
-                } else if img.height > 0.0 {
-                    img.height * asp
-                } else {
-                    px_w // intrinsic fallback
-                };
-                let render_h = if img.height > 0.0 {
-                    img.height
-                } else if img.width > 0.0 {
-                    img.width / asp
-                } else {
-                    px_h // intrinsic fallback
-                };
+    #[test]
+    fn overlay_pdf_page_is_drawn_as_a_form_on_every_page() {
+        let mut letterhead = LayoutConfig::a4();
+        letterhead.pages.push(PageLayout {
+            page_index: 0,
+            boxes: vec![text_box("ACME Ltd")],
+        });
+        let letterhead = render_pdf(&letterhead).unwrap();
 
-                // PDF origin is bottom-left; our layout origin is top-left.
-                let img_bottom_y = page_height - lbox.y - render_h;
+        let mut config = LayoutConfig::a4();
+        for page_index in 0..2 {
+            config.pages.push(PageLayout {
+                page_index,
+                boxes: vec![text_box("Dear customer")],
+            });
+        }
+        config.overlay_pdf = Some(PdfOverlay::from_bytes(&letterhead, 1, true));
+        let bytes = render_pdf(&config).unwrap();
 
-                // At dpi=72 printpdf renders 1 px = 1 pt, so
-                // scale = desired_pt / px_dim.
-                let scale_x = render_w / px_w;
-                let scale_y = render_h / px_h;
+        let doc = lopdf::Document::load_mem(&bytes).unwrap();
+        let pages = doc.get_pages();
+        assert_eq!(pages.len(), 2);
+        for page_id in pages.into_values() {
+            let page = doc.get_dictionary(page_id).unwrap();
+            let resources = page.get_deref(b"Resources", &doc).unwrap();
+            let xobjects = resources.as_dict().unwrap().get_deref(b"XObject", &doc);
+            let form_id = xobjects
+                .unwrap()
+                .as_dict()
+                .unwrap()
+                .get(OVERLAY_NAME.as_bytes())
+                .and_then(lopdf::Object::as_reference)
+                .unwrap();
+            let form = doc.get_object(form_id).unwrap().as_stream().unwrap();
+            let subtype = form.dict.get(b"Subtype").and_then(lopdf::Object::as_name);
+            assert_eq!(subtype.unwrap(), b"Form");
+            let form_resources = form.dict.get_deref(b"Resources", &doc).unwrap();
+            assert!(form_resources.as_dict().unwrap().has(b"Font"));
 
-                ops.push(Op::UseXobject {
-                    id: res.xobj_id.clone(),
-                    transform: XObjectTransform {
-                        translate_x: Some(Pt(lbox.x)),
-                        translate_y: Some(Pt(img_bottom_y)),
-                        dpi: Some(72.0),
-                        scale_x: Some(scale_x),
-                        scale_y: Some(scale_y),
-                        rotate: None,
-                    },
-                });
-            }
+            let content = doc.get_page_content(page_id).unwrap();
+            let expected = format!("q /{OVERLAY_NAME} Do Q");
+            assert!(content.starts_with(expected.as_bytes()), "not drawn behind");
         }
+
+        config.overlay_pdf = Some(PdfOverlay::from_bytes(&letterhead, 2, false));
+        assert!(render_pdf(&config).unwrap_err().contains("no page 2"));
     }
 
-    // Children
-    for child in &lbox.children {
-        render_box(ops, child, page_height, images);
+    #[test]
+    fn user_unit_keeps_oversized_page_boxes_within_limits() {
+        let mut config = LayoutConfig::a4();
+        config.page_width_pt = 36_000.0;
+        config.page_height_pt = 72_000.0;
+        config.user_unit = Some(10.0);
+        config.pages.push(PageLayout {
+            page_index: 0,
+            boxes: vec![text_box("Banner")],
+        });
+        let bytes = render_pdf(&config).unwrap();
+
+        let doc = lopdf::Document::load_mem(&bytes).unwrap();
+        let page_id = *doc.get_pages().get(&1).unwrap();
+        let page = doc.get_dictionary(page_id).unwrap();
+        let unit = page.get(b"UserUnit").and_then(lopdf::Object::as_float);
+        assert_eq!(unit.unwrap(), 10.0);
+        let media_box: Vec<f32> = page
+            .get(b"MediaBox")
+            .and_then(lopdf::Object::as_array)
+            .unwrap()
+            .iter()
+            .map(|v| v.as_float().unwrap())
+            .collect();
+        assert!((media_box[2] - 3_600.0).abs() < 0.5, "{media_box:?}");
+        assert!((media_box[3] - 7_200.0).abs() < 0.5, "{media_box:?}");
+        assert!(media_box.iter().all(|&v| v <= MAX_PAGE_UNITS));
+
+        config.user_unit = Some(2.0);
+        assert!(render_pdf(&config).is_err(), "page still over the limit");
+        config.user_unit = Some(0.5);
+        assert!(render_pdf(&config).is_err(), "factor below 1");
     }
-}
 
-#[cfg(test)]
-mod tests {
-    use super::*;
+    #[test]
+    fn background_image_is_scaled_to_cover_and_centred_in_its_box() {
+        let src = png_data_uri(4, 4);
+        let mut doc = PdfDocument::new("background");
+        let decoded = decode_image(&src, None, false, &mut Vec::new()).unwrap();
+        let resource = ImageResource {
+            xobj_id: doc.add_image(&decoded.raw),
+            px_width: 4,
+            px_height: 4,
+        };
+        let images = HashMap::from([(src.clone(), resource)]);
+        let embedded_fonts = HashMap::new();
+        let ctx = RenderContext {
+            page_width: 595.0,
+            page_height: 842.0,
+            background: None,
+            images: &images,
+            embedded_fonts: &embedded_fonts,
+            outline_fonts: None,
+            min_line_width: 0.0,
+            scale: 1.0,
+            gradients: RefCell::default(),
+            grayscale: false,
+        };
+        let panel = |size, repeat| {
+            let mut lbox = LayoutBox::new(50.0, 100.0, 200.0, 100.0);
+            lbox.background_image = Some(BackgroundImage {
+                src: src.clone(),
+                size,
+                position: [BackgroundLength::Percent(50.0); 2],
+                repeat,
+            });
+            PageLayout {
+                page_index: 0,
+                boxes: vec![lbox],
+            }
+        };
+        let placed = |page: &PageLayout| -> Vec<(f32, f32, f32, f32)> {
+            page_ops(page, &ctx)
+                .iter()
+                .filter_map(|op| match op {
+                    Op::UseXobject { transform, .. } => Some((
+                        transform.translate_x?.0,
+                        transform.translate_y?.0,
+                        transform.scale_x?,
+                        transform.scale_y?,
+                    )),
+                    _ => None,
+                })
+                .collect()
+        };
+
+        // 200 pt square over the 200 × 100 box (top at y = 742): 50 pt
+        // overflows above and below and is clipped.
+        let cover = panel(BackgroundSize::Cover, BackgroundRepeat::NoRepeat);
+        assert_eq!(placed(&cover), vec![(50.0, 592.0, 50.0, 50.0)]);
+        let ops = page_ops(&cover, &ctx);
+        assert!(ops.iter().any(|op| matches!(
+            op,
+            Op::DrawPolygon { polygon } if matches!(polygon.mode, PaintMode::Clip)
+        )));
+
+        let contain = panel(BackgroundSize::Contain, BackgroundRepeat::NoRepeat);
+        assert_eq!(placed(&contain), vec![(100.0, 642.0, 25.0, 25.0)]);
+
+        // Centred 60 pt tiles repeated along x: the row starts off the box's
+        // left edge so that one tile sits in the middle.
+        let size = BackgroundSize::Explicit {
+            width: Some(BackgroundLength::Length(60.0)),
+            height: None,
+        };
+        let tiles = placed(&panel(size, BackgroundRepeat::RepeatX));
+        let xs: Vec<f32> = tiles.iter().map(|t| t.0).collect();
+        assert_eq!(xs, vec![0.0, 60.0, 120.0, 180.0, 240.0]);
+        assert!(tiles.iter().all(|t| t.1 == 662.0 && t.2 == 15.0));
+    }
 
     #[test]
-    fn render_empty_page() {
-        let config = LayoutConfig::a4();
-        let bytes = render_pdf(&config).unwrap();
-        assert!(bytes.len() > 100, "PDF should have content");
-        // PDF magic number
-        assert_eq!(&bytes[0..5], b"%PDF-");
+    fn list_style_image_is_drawn_at_each_items_marker() {
+        let src = png_data_uri(4, 4);
+        let mut doc = PdfDocument::new("markers");
+        let decoded = decode_image(&src, None, false, &mut Vec::new()).unwrap();
+        let resource = ImageResource {
+            xobj_id: doc.add_image(&decoded.raw),
+            px_width: 4,
+            px_height: 4,
+        };
+        let images = HashMap::from([(src.clone(), resource)]);
+        let embedded_fonts = HashMap::new();
+        let ctx = RenderContext {
+            page_width: 595.0,
+            page_height: 842.0,
+            background: None,
+            images: &images,
+            embedded_fonts: &embedded_fonts,
+            outline_fonts: None,
+            min_line_width: 0.0,
+            scale: 1.0,
+            gradients: RefCell::default(),
+            grayscale: false,
+        };
+        let item = |y: f32| {
+            let mut lbox = LayoutBox::new(60.0, y, 200.0, 16.0);
+            lbox.text = Some(TextContent {
+                font_size: 12.0,
+                line_height: 16.0,
+                list_marker: Some("\u{2022} ".to_string()),
+                list_marker_image: Some(src.clone()),
+                ..TextContent::default()
+            });
+            lbox
+        };
+        let page = PageLayout {
+            page_index: 0,
+            boxes: vec![item(40.0), item(56.0)],
+        };
+        let ops = page_ops(&page, &ctx);
+        let placed: Vec<(f32, f32, f32)> = ops
+            .iter()
+            .filter_map(|op| match op {
+                Op::UseXobject { transform, .. } => Some((
+                    transform.translate_x?.0,
+                    transform.translate_y?.0,
+                    transform.scale_y?,
+                )),
+                _ => None,
+            })
+            .collect();
+        // 12 pt tall, centred on each 16 pt line, in the 16 pt gutter.
+        assert_eq!(placed, vec![(44.0, 788.0, 3.0), (44.0, 772.0, 3.0)]);
+        assert!(!ops.iter().any(|op| matches!(op, Op::StartTextSection)));
+
+        // Without the image the bullet is written instead.
+        let missing = HashMap::new();
+        let ctx = RenderContext {
+            images: &missing,
+            ..ctx
+        };
+        let ops = page_ops(&page, &ctx);
+        assert!(ops.iter().any(|op| matches!(op, Op::StartTextSection)));
+        assert!(!ops.iter().any(|op| matches!(op, Op::UseXobject { .. })));
     }
 }
@@ -0,0 +1,339 @@
+//! Repair of malformed PDFs – rebuilds a broken cross-reference table so
+//! third-party files can be read (and post-processed) again.
+//!
+//! [`repair`] ignores the file's own xref sections: it scans the body for
+//! `N G obj … endobj` blocks, records where each one starts (the last
+//! definition of an object number wins, as with incremental updates), and
+//! appends a fresh classic xref table and trailer.  The object bytes are kept
+//! as they are, so only the file's index is changed, never its content.
+
+use std::collections::BTreeMap;
+
+use lopdf::Document;
+
+/// Rebuild the cross-reference table of `pdf`.
+///
+/// The trailer's `/Root`, `/Info` and `/ID` are taken from the last
+/// `trailer` dictionary (or cross-reference stream) in the file; without
+/// one, the first object typed `/Catalog` becomes the root.  Fails if no
+/// objects or no catalog can be found, or if the result still cannot be
+/// parsed.
+pub fn repair(pdf: &[u8]) -> Result<Vec<u8>, String> {
+    let header_window = &pdf[..pdf.len().min(1024)];
+    if find(header_window, b"%PDF-", 0).is_none() {
+        return Err("Repair: missing %PDF- header".to_string());
+    }
+
+    let objects = scan_objects(pdf);
+    if objects.is_empty() {
+        return Err("Repair: no objects found".to_string());
+    }
+
+    let trailer = last_trailer_dict(pdf, &objects);
+    let root = trailer
+        .and_then(|t| reference_after(t, b"/Root"))
+        .or_else(|| find_catalog(pdf, &objects))
+        .ok_or_else(|| "Repair: no document catalog found".to_string())?;
+    let info = trailer.and_then(|t| reference_after(t, b"/Info"));
+    let id = trailer.and_then(|t| array_after(t, b"/ID"));
+
+    // A corrupt file may number an object in the billions, so only the
+    // numbers actually found get an entry.  Object 0 is the head of the
+    // free list and never a real object.
+    let offsets: BTreeMap<u32, (usize, u16)> = objects
+        .iter()
+        .filter(|o| o.number != 0)
+        .map(|o| (o.number, (o.start, o.generation)))
+        .collect();
+    let size = offsets.keys().next_back().map_or(0, |&n| u64::from(n)) + 1;
+
+    // Keep the body up to the last object; drop the stale xref and trailer.
+    let body_end = objects.iter().map(|o| o.end).max().unwrap_or(0);
+    let mut out = pdf[..body_end].to_vec();
+    out.push(b'\n');
+
+    let xref_offset = out.len();
+    out.extend_from_slice(b"xref\n0 1\n0000000000 65535 f \n");
+    // One subsection per run of consecutive object numbers.
+    let numbers: Vec<u32> = offsets.keys().copied().collect();
+    for run in numbers.chunk_by(|a, b| *b == a + 1) {
+        out.extend_from_slice(format!("{} {}\n", run[0], run.len()).as_bytes());
+        for number in run {
+            let (offset, generation) = offsets[number];
+            out.extend_from_slice(format!("{offset:010} {generation:05} n \n").as_bytes());
+        }
+    }
+
+    let mut trailer = format!("trailer\n<< /Size {size} /Root {} {} R", root.0, root.1);
+    if let Some((n, g)) = info {
+        trailer.push_str(&format!(" /Info {n} {g} R"));
+    }
+    if let Some(id) = id {
+        trailer.push_str(" /ID ");
+        trailer.push_str(&String::from_utf8_lossy(id));
+    }
+    trailer.push_str(&format!(" >>\nstartxref\n{xref_offset}\n%%EOF\n"));
+    out.extend_from_slice(trailer.as_bytes());
+
+    Document::load_mem(&out)
+        .map_err(|e| format!("Repair: rebuilt file is still unreadable: {e}"))?;
+    Ok(out)
+}
+
+/// One `N G obj … endobj` block found in the file.
+struct ScannedObject {
+    number: u32,
+    generation: u16,
+    /// Byte offset of the object number.
+    start: usize,
+    /// Byte offset just past `endobj`.
+    end: usize,
+}
+
+fn scan_objects(pdf: &[u8]) -> Vec<ScannedObject> {
+    let mut objects = Vec::new();
+    let mut i = 0;
+    while i < pdf.len() {
+        let at_token_start = i == 0 || is_whitespace(pdf[i - 1]) || is_delimiter(pdf[i - 1]);
+        if at_token_start && pdf[i].is_ascii_digit() {
+            if let Some((number, generation, body)) = object_header(pdf, i) {
+                if let Some(close) = find(pdf, b"endobj", body) {
+                    let end = close + b"endobj".len();
+                    objects.push(ScannedObject {
+                        number,
+                        generation,
+                        start: i,
+                        end,
+                    });
+                    i = end;
+                    continue;
+                }
+            }
+        }
+        i += 1;
+    }
+    objects
+}
+
+/// Parse `N G obj` at `at`; returns the numbers and the offset after `obj`.
+pub(crate) fn object_header(pdf: &[u8], at: usize) -> Option<(u32, u16, usize)> {
+    let (number, rest) = digits(pdf, at)?;
+    let rest = skip_whitespace(pdf, rest);
+    let (generation, rest) = digits(pdf, rest)?;
+    let rest = skip_whitespace(pdf, rest);
+    if !pdf[rest..].starts_with(b"obj") {
+        return None;
+    }
+    let after = rest + 3;
+    if after < pdf.len() && !is_whitespace(pdf[after]) && !is_delimiter(pdf[after]) {
+        return None;
+    }
+    Some((number.try_into().ok()?, generation.try_into().ok()?, after))
+}
+
+/// The last `trailer` dictionary, or failing that the dictionary of the
+/// last cross-reference stream.
+fn last_trailer_dict<'a>(pdf: &'a [u8], objects: &[ScannedObject]) -> Option<&'a [u8]> {
+    if let Some(at) = rfind(pdf, b"trailer") {
+        if let Some(dict) = dictionary_at(pdf, at) {
+            return Some(dict);
+        }
+    }
+    objects
+        .iter()
+        .rev()
+        .filter_map(|o| dictionary_at(&pdf[..o.end], o.start))
+        .find(|dict| has_type(dict, b"/XRef"))
+}
+
+fn find_catalog(pdf: &[u8], objects: &[ScannedObject]) -> Option<(u32, u16)> {
+    objects
+        .iter()
+        .find(|o| {
+            dictionary_at(&pdf[..o.end], o.start).is_some_and(|d| has_type(d, b"/Catalog"))
+        })
+        .map(|o| (o.number, o.generation))
+}
+
+/// The first balanced `<< … >>` at or after `from`.  Literal `( … )` and
+/// hex `< … >` strings are skipped, so brackets inside them do not count.
+pub(crate) fn dictionary_at(pdf: &[u8], from: usize) -> Option<&[u8]> {
+    let open = find(pdf, b"<<", from)?;
+    let mut depth = 0usize;
+    let mut i = open;
+    while i + 1 < pdf.len() {
+        if pdf[i..].starts_with(b"<<") {
+            depth += 1;
+            i += 2;
+        } else if pdf[i..].starts_with(b">>") {
+            depth -= 1;
+            i += 2;
+            if depth == 0 {
+                return Some(&pdf[open..i]);
+            }
+        } else if pdf[i] == b'<' {
+            i = find(pdf, b">", i)? + 1;
+        } else if pdf[i] == b'(' {
+            i = literal_string_end(pdf, i)?;
+        } else {
+            i += 1;
+        }
+    }
+    None
+}
+
+/// The offset just past the literal string opening at `open`, which may
+/// hold balanced parentheses and backslash escapes.
+fn literal_string_end(pdf: &[u8], open: usize) -> Option<usize> {
+    let mut depth = 0usize;
+    let mut i = open;
+    while i < pdf.len() {
+        match pdf[i] {
+            b'\\' => i += 1,
+            b'(' => depth += 1,
+            b')' => {
+                depth -= 1;
+                if depth == 0 {
+                    return Some(i + 1);
+                }
+            }
+            _ => {}
+        }
+        i += 1;
+    }
+    None
+}
+
+fn has_type(dict: &[u8], kind: &[u8]) -> bool {
+    find(dict, b"/Type", 0).is_some_and(|at| {
+        let value = skip_whitespace(dict, at + b"/Type".len());
+        dict[value..].starts_with(kind)
+            && dict
+                .get(value + kind.len())
+                .map_or(true, |&c| is_whitespace(c) || is_delimiter(c))
+    })
+}
+
+/// `N G R` following `key` in `dict`.
+fn reference_after(dict: &[u8], key: &[u8]) -> Option<(u32, u16)> {
+    let at = find(dict, key, 0)? + key.len();
+    let (number, rest) = digits(dict, skip_whitespace(dict, at))?;
+    let (generation, rest) = digits(dict, skip_whitespace(dict, rest))?;
+    let rest = skip_whitespace(dict, rest);
+    dict[rest..]
+        .starts_with(b"R")
+        .then_some((number.try_into().ok()?, generation.try_into().ok()?))
+}
+
+/// The `[ … ]` array following `key` in `dict`, verbatim.
+fn array_after<'a>(dict: &'a [u8], key: &[u8]) -> Option<&'a [u8]> {
+    let at = skip_whitespace(dict, find(dict, key, 0)? + key.len());
+    if dict.get(at) != Some(&b'[') {
+        return None;
+    }
+    let close = at + dict[at..].iter().position(|&c| c == b']')?;
+    Some(&dict[at..=close])
+}
+
+pub(crate) fn digits(pdf: &[u8], at: usize) -> Option<(u64, usize)> {
+    let len = pdf[at.min(pdf.len())..]
+        .iter()
+        .take_while(|c| c.is_ascii_digit())
+        .count();
+    if len == 0 || len > 10 {
+        return None;
+    }
+    let value = std::str::from_utf8(&pdf[at..at + len]).ok()?.parse().ok()?;
+    Some((value, at + len))
+}
+
+pub(crate) fn skip_whitespace(pdf: &[u8], mut at: usize) -> usize {
+    while at < pdf.len() && is_whitespace(pdf[at]) {
+        at += 1;
+    }
+    at
+}
+
+pub(crate) fn find(haystack: &[u8], needle: &[u8], from: usize) -> Option<usize> {
+    haystack
+        .get(from..)?
+        .windows(needle.len())
+        .position(|w| w == needle)
+        .map(|p| p + from)
+}
+
+pub(crate) fn rfind(haystack: &[u8], needle: &[u8]) -> Option<usize> {
+    haystack.windows(needle.len()).rposition(|w| w == needle)
+}
+
+fn is_whitespace(c: u8) -> bool {
+    matches!(c, b' ' | b'\t' | b'\n' | b'\r' | b'\x0c' | b'\0')
+}
+
+fn is_delimiter(c: u8) -> bool {
+    matches!(c, b'(' | b')' | b'<' | b'>' | b'[' | b']' | b'{' | b'}' | b'/' | b'%')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_pdf::pdf_with_pages;
+    use lopdf::Dictionary;
+
+    /// A two-page PDF whose xref offsets all point at byte 10.
+    fn corrupted_xref_fixture() -> Vec<u8> {
+        let pages = ["page one", "page two"]
+            .map(|text| (Dictionary::new(), format!("BT ({text}) Tj ET").into_bytes()));
+        let mut bytes = pdf_with_pages(Document::with_version("1.7"), pages);
+
+        let trailer = rfind(&bytes, b"trailer").unwrap();
+        let xref = rfind(&bytes[..trailer], b"xref").unwrap();
+        let table = String::from_utf8(bytes[xref..trailer].to_vec()).unwrap();
+        let broken: String = table
+            .split_inclusive('\n')
+            .map(|line| match line.strip_suffix(" n \r\n").or(line.strip_suffix(" n \n")) {
+                Some(_) => format!("0000000010{}", &line[10..]),
+                None => line.to_string(),
+            })
+            .collect();
+        bytes.splice(xref..trailer, broken.into_bytes());
+        bytes
+    }
+
+    #[test]
+    fn rebuilds_a_corrupted_xref_table() {
+        let broken = corrupted_xref_fixture();
+        let pages_before = Document::load_mem(&broken).map_or(0, |d| d.get_pages().len());
+        assert_ne!(pages_before, 2, "fixture is not actually broken");
+
+        let repaired = repair(&broken).unwrap();
+        let doc = Document::load_mem(&repaired).unwrap();
+        assert_eq!(doc.get_pages().len(), 2);
+    }
+
+    #[test]
+    fn huge_object_numbers_get_their_own_xref_subsection() {
+        let pdf = b"%PDF-1.7\n\
+            1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n\
+            2 0 obj\n<< /Type /Pages /Kids [] /Count 0 >>\nendobj\n\
+            4000000000 0 obj\n(stray)\nendobj\n%%EOF\n";
+        let repaired = repair(pdf).unwrap();
+        let text = String::from_utf8_lossy(&repaired);
+        assert!(text.contains("\n1 2\n") && text.contains("\n4000000000 1\n"), "{text}");
+        assert!(text.contains("/Size 4000000001"), "{text}");
+    }
+
+    #[test]
+    fn dictionaries_end_outside_strings() {
+        let literal = b"<< /T (a>>b \\) >>) /N 1 >> tail";
+        assert_eq!(dictionary_at(literal, 0), Some(&literal[..26]));
+        let hex = b"<< /ID [<ab>] /K <cd>>> tail";
+        assert_eq!(dictionary_at(hex, 0), Some(&hex[..23]));
+    }
+
+    #[test]
+    fn rejects_input_without_objects() {
+        assert!(repair(b"not a pdf").is_err());
+        assert!(repair(b"%PDF-1.7\n%%EOF\n").is_err());
+    }
+}
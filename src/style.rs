@@ -1,7 +1,30 @@
-//! Style resolver – maps CSS inline styles and Tailwind-like utility classes
-//! to a flat [`ComputedStyle`] struct consumed by the layout engine.
-
+//! Style resolver – maps CSS inline styles, Tailwind-like utility classes and
+//! stylesheet rules to a flat [`ComputedStyle`] struct consumed by the layout
+//! engine.
+//!
+//! Cascade order, lowest priority first: tag defaults, inherited text
+//! properties, document rules less specific than a class, Tailwind classes,
+//! remaining document rules, the inline `style` attribute, `extra_css` rules,
+//! and finally `!important` declarations in the same order.
+//!
+//! `::before` / `::after` rules with a `content` value insert generated text
+//! as the first / last child of their element; `counter()` values follow
+//! `counter-reset` and `counter-increment` in document order, and every list
+//! counts its items in the `list-item` counter.
+
+use std::collections::HashMap;
+
+use crate::css::{
+    media_length, split_declarations, Origin, PageSelector, PseudoElement, Rule, Stylesheet,
+    CLASS_SPECIFICITY,
+};
+use crate::diagnostics;
 use crate::dom::{DomNode, ElementNode, Tag};
+pub use crate::layout_config::{
+    BackgroundLength, BackgroundRepeat, BackgroundSize, BorderSides, ClipPath, Gradient,
+    GradientShape, GradientStop, ImageFilter, LineStyle, Radius, Shadow, WritingMode,
+};
+use crate::pagination::{Margins, PageMargins};
 
 /// Fully resolved style for a single element.
 #[derive(Debug, Clone)]
@@ -16,6 +39,12 @@ pub struct ComputedStyle {
     pub align_items: AlignItems,
     pub gap: f32,
 
+    // Multi-column
+    /// CSS `column-count`; `1` lays children out normally.
+    pub column_count: u32,
+    /// CSS `column-gap`; `None` is `normal` (1em).
+    pub column_gap: Option<f32>,
+
     // Grid
     pub grid_template_columns: Vec<GridTrack>,
     pub grid_template_rows: Vec<GridTrack>,
@@ -25,6 +54,22 @@ pub struct ComputedStyle {
     pub height: Dimension,
     pub min_width: Dimension,
     pub max_width: Dimension,
+    /// CSS `aspect-ratio` as width ÷ height, sizing the auto dimension from
+    /// the other; `None` is `auto`.  Not inherited.
+    pub aspect_ratio: Option<f32>,
+
+    // Positioning
+    /// CSS `position`.  Not inherited.
+    pub position: Position,
+    /// CSS `top` / `right` / `bottom` / `left`; percentages refer to the
+    /// containing block.  Not inherited.
+    pub inset_top: Dimension,
+    pub inset_right: Dimension,
+    pub inset_bottom: Dimension,
+    pub inset_left: Dimension,
+    /// CSS `visibility`.  Inherited, so a hidden subtree can reveal
+    /// individual descendants with `visibility: visible`.
+    pub visibility: Visibility,
 
     // Spacing (px)
     pub margin_top: f32,
@@ -39,6 +84,10 @@ pub struct ComputedStyle {
     // Border
     pub border_width: f32,
     pub border_color: Color,
+    /// One width, colour and style is shared by every side that has a
+    /// border; `border_sides` picks those sides.
+    pub border_style: LineStyle,
+    pub border_sides: BorderSides,
 
     // Typography
     pub font_size: f32,
@@ -46,17 +95,85 @@ pub struct ComputedStyle {
     pub font_family: String,
     pub color: Color,
     pub text_align: TextAlign,
-    pub line_height: f32,
+    /// CSS `vertical-align`, read by table cells only.  Inherited, so it can
+    /// be set on a whole row as in browsers.
+    pub vertical_align: VerticalAlign,
+    pub line_height: LineHeight,
     pub text_decoration: TextDecoration,
     pub font_style: FontStyle,
+    /// `-webkit-text-stroke` width; `0` draws no glyph outline.
+    pub text_stroke_width: f32,
+    /// `-webkit-text-stroke` colour; `None` uses `color`.
+    pub text_stroke_color: Option<Color>,
+    /// `-webkit-text-fill-color: transparent` – glyphs are not filled.
+    pub text_fill_transparent: bool,
+    pub writing_mode: WritingMode,
+    pub white_space: WhiteSpace,
+    pub word_break: WordBreak,
+    pub overflow_wrap: OverflowWrap,
+    /// CSS `text-shadow` layers, first on top.
+    pub text_shadow: Vec<Shadow>,
 
     // Background
     pub background_color: Color,
+    /// `background-image: linear-gradient(…)` or `radial-gradient(…)`.
+    /// Not inherited.
+    pub background_gradient: Option<Gradient>,
+    /// `background-image: url(…)`, the address as written.  Not inherited,
+    /// like `background-size`, `-position` and `-repeat` below.
+    pub background_image: Option<String>,
+    pub background_size: BackgroundSize,
+    /// `background-position` x and y.
+    pub background_position: [BackgroundLength; 2],
+    pub background_repeat: BackgroundRepeat,
+    /// CSS `print-color-adjust`; `economy` lets the printer drop this
+    /// element's background (see `PipelineConfig::print_backgrounds`).
+    pub print_color_adjust: PrintColorAdjust,
+    /// CSS `box-shadow` layers (outer only), first on top.  Not inherited.
+    pub box_shadow: Vec<Shadow>,
+
+    /// CSS `transform` as a 2D matrix `[a, b, c, d, e, f]` (y down), applied
+    /// about the box centre.  Not inherited.
+    pub transform: Option<[f32; 6]>,
+
+    /// CSS `border-radius`, one radius for all four corners; percentages
+    /// refer to the box's width and height.  Not inherited.
+    pub border_radius: Option<Radius>,
+    /// CSS `clip-path` basic shape.  Not inherited.
+    pub clip_path: Option<ClipPath>,
+    /// CSS `filter` functions, applied to the pixels of an `<img>`.  Not
+    /// inherited.
+    pub filter: Vec<ImageFilter>,
+    /// CSS `overflow`.  Not inherited.
+    pub overflow: Overflow,
+    /// CSS `text-overflow`, applied to the element's own lines of text when
+    /// `overflow` hides what does not fit.  Not inherited.
+    pub text_overflow: TextOverflow,
+
+    // Lists
+    /// CSS `list-style-image`: drawn as a list item's marker in place of its
+    /// bullet or number.
+    pub list_style_image: Option<String>,
 
     // Page break
     pub page_break_before: bool,
     pub page_break_after: bool,
     pub page_break_inside_avoid: bool,
+    /// CSS `orphans`: fewest lines of a paragraph left at the bottom of a
+    /// page when it breaks.
+    pub orphans: u32,
+    /// CSS `widows`: fewest lines of a paragraph carried to the top of the
+    /// next page when it breaks.
+    pub widows: u32,
+
+    // Generated content
+    /// CSS `content`; only used on `::before` / `::after`, and empty for
+    /// `none`.  Not inherited.
+    pub content: Vec<ContentItem>,
+    /// CSS `counter-reset` as `(name, value)` pairs.  Not inherited.
+    pub counter_reset: Vec<(String, i32)>,
+    /// CSS `counter-increment` as `(name, step)` pairs.  Not inherited.
+    pub counter_increment: Vec<(String, i32)>,
 }
 
 impl Default for ComputedStyle {
@@ -70,12 +187,21 @@ impl Default for ComputedStyle {
             justify_content: JustifyContent::Start,
             align_items: AlignItems::Stretch,
             gap: 0.0,
+            column_count: 1,
+            column_gap: None,
             grid_template_columns: Vec::new(),
             grid_template_rows: Vec::new(),
             width: Dimension::Auto,
             height: Dimension::Auto,
             min_width: Dimension::Auto,
             max_width: Dimension::Auto,
+            aspect_ratio: None,
+            position: Position::Static,
+            inset_top: Dimension::Auto,
+            inset_right: Dimension::Auto,
+            inset_bottom: Dimension::Auto,
+            inset_left: Dimension::Auto,
+            visibility: Visibility::Visible,
             margin_top: 0.0,
             margin_right: 0.0,
             margin_bottom: 0.0,
@@ -86,18 +212,48 @@ impl Default for ComputedStyle {
             padding_left: 0.0,
             border_width: 0.0,
             border_color: Color::BLACK,
+            border_style: LineStyle::Solid,
+            border_sides: BorderSides::ALL,
             font_size: 16.0,
             font_weight: FontWeight::Normal,
             font_family: "Helvetica".to_string(),
             color: Color::BLACK,
             text_align: TextAlign::Left,
-            line_height: 1.4,
+            vertical_align: VerticalAlign::Baseline,
+            line_height: LineHeight::Factor(1.4),
             text_decoration: TextDecoration::None,
             font_style: FontStyle::Normal,
+            text_stroke_width: 0.0,
+            text_stroke_color: None,
+            text_fill_transparent: false,
+            writing_mode: WritingMode::HorizontalTb,
+            white_space: WhiteSpace::Normal,
+            word_break: WordBreak::Normal,
+            overflow_wrap: OverflowWrap::Normal,
+            text_shadow: Vec::new(),
             background_color: Color::TRANSPARENT,
+            background_gradient: None,
+            background_image: None,
+            background_size: BackgroundSize::Auto,
+            background_position: [BackgroundLength::Percent(0.0); 2],
+            background_repeat: BackgroundRepeat::Repeat,
+            print_color_adjust: PrintColorAdjust::Exact,
+            box_shadow: Vec::new(),
+            transform: None,
+            border_radius: None,
+            clip_path: None,
+            filter: Vec::new(),
+            overflow: Overflow::Visible,
+            text_overflow: TextOverflow::Clip,
+            list_style_image: None,
             page_break_before: false,
             page_break_after: false,
             page_break_inside_avoid: false,
+            orphans: 2,
+            widows: 2,
+            content: Vec::new(),
+            counter_reset: Vec::new(),
+            counter_increment: Vec::new(),
         }
     }
 }
@@ -114,11 +270,58 @@ pub enum Display {
     Inline,
     InlineBlock,
     ListItem,
+    TableHeaderGroup,
+    TableRowGroup,
+    TableFooterGroup,
     TableRow,
     TableCell,
     None,
 }
 
+/// CSS `position`.  An absolutely positioned box is taken out of the flow
+/// and placed against the padding box of its nearest positioned ancestor,
+/// or the page content area when there is none.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Position {
+    Static,
+    Relative,
+    Absolute,
+}
+
+impl Position {
+    /// Whether the box is a containing block for absolutely positioned
+    /// descendants.
+    pub fn is_positioned(self) -> bool {
+        self != Position::Static
+    }
+}
+
+/// CSS `visibility`.  Unlike `display: none`, a hidden box keeps its place
+/// in the layout and only skips painting.  `collapse` removes table rows
+/// entirely and behaves like `hidden` everywhere else.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Visibility {
+    Visible,
+    Hidden,
+    Collapse,
+}
+
+/// CSS `overflow`.  A page cannot scroll, so `auto` and `scroll` clip like
+/// `hidden` and `clip` do: content is cut at the border box.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Overflow {
+    Visible,
+    Hidden,
+}
+
+/// CSS `text-overflow`: how a line cut by `overflow` ends.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TextOverflow {
+    Clip,
+    /// The line is shortened to fit with a trailing `…`.
+    Ellipsis,
+}
+
 #[derive(Debug, Clone, Copy, PartialEq, Eq)]
 pub enum FlexDirection {
     Row,
@@ -141,6 +344,16 @@ pub enum JustifyContent {
     SpaceEvenly,
 }
 
+/// CSS `vertical-align` of a table cell's content.  Cells share one font
+/// per row in practice, so `Baseline` places content like `Top`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum VerticalAlign {
+    Baseline,
+    Top,
+    Middle,
+    Bottom,
+}
+
 #[derive(Debug, Clone, Copy, PartialEq, Eq)]
 pub enum AlignItems {
     Start,
@@ -162,6 +375,298 @@ pub enum TextAlign {
     Right,
 }
 
+/// CSS `print-color-adjust`.  Unlike browsers, which economise by default,
+/// the engine paints backgrounds unless a document opts into `economy`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum PrintColorAdjust {
+    Exact,
+    Economy,
+}
+
+/// One part of a `content` value.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ContentItem {
+    /// A quoted string (or `open-quote` / `close-quote`).
+    Text(String),
+    /// `attr(name)`: the element's attribute, empty when it is missing.
+    Attr(String),
+    /// `counter(name, style)`.
+    Counter { name: String, style: CounterStyle },
+    /// `counters(name, separator, style)`: every counter named `name` in
+    /// scope, outermost first, joined by `separator` (`1.2.3`).
+    Counters {
+        name: String,
+        separator: String,
+        style: CounterStyle,
+    },
+}
+
+/// The counter styles `counter()` can format with.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum CounterStyle {
+    Decimal,
+    DecimalLeadingZero,
+    LowerAlpha,
+    UpperAlpha,
+    LowerRoman,
+    UpperRoman,
+    Disc,
+    Circle,
+    Square,
+    None,
+}
+
+impl CounterStyle {
+    pub fn from_css(value: &str) -> Option<Self> {
+        Some(match value {
+            "decimal" => CounterStyle::Decimal,
+            "decimal-leading-zero" => CounterStyle::DecimalLeadingZero,
+            "lower-alpha" | "lower-latin" => CounterStyle::LowerAlpha,
+            "upper-alpha" | "upper-latin" => CounterStyle::UpperAlpha,
+            "lower-roman" => CounterStyle::LowerRoman,
+            "upper-roman" => CounterStyle::UpperRoman,
+            "disc" => CounterStyle::Disc,
+            "circle" => CounterStyle::Circle,
+            "square" => CounterStyle::Square,
+            "none" => CounterStyle::None,
+            _ => return None,
+        })
+    }
+
+    /// Format a counter value.  Alphabetic and roman styles fall back to
+    /// decimal outside the range they can represent.
+    pub fn format(self, value: i32) -> String {
+        match self {
+            CounterStyle::LowerAlpha | CounterStyle::UpperAlpha if value > 0 => {
+                let mut n = value as u32;
+                let mut letters = Vec::new();
+                while n > 0 {
+                    n -= 1;
+                    letters.push(char::from(b'a' + (n % 26) as u8));
+                    n /= 26;
+                }
+                let lower: String = letters.into_iter().rev().collect();
+                match self {
+                    CounterStyle::UpperAlpha => lower.to_ascii_uppercase(),
+                    _ => lower,
+                }
+            }
+            CounterStyle::LowerRoman | CounterStyle::UpperRoman if (1..4000).contains(&value) => {
+                const NUMERALS: [(i32, &str); 13] = [
+                    (1000, "m"),
+                    (900, "cm"),
+                    (500, "d"),
+                    (400, "cd"),
+                    (100, "c"),
+                    (90, "xc"),
+                    (50, "l"),
+                    (40, "xl"),
+                    (10, "x"),
+                    (9, "ix"),
+                    (5, "v"),
+                    (4, "iv"),
+                    (1, "i"),
+                ];
+                let mut rest = value;
+                let mut lower = String::new();
+                for (step, numeral) in NUMERALS {
+                    while rest >= step {
+                        lower.push_str(numeral);
+                        rest -= step;
+                    }
+                }
+                match self {
+                    CounterStyle::UpperRoman => lower.to_ascii_uppercase(),
+                    _ => lower,
+                }
+            }
+            CounterStyle::DecimalLeadingZero if (0..10).contains(&value) => format!("0{value}"),
+            CounterStyle::Disc => "\u{2022}".to_string(),
+            CounterStyle::Circle => "\u{25E6}".to_string(),
+            CounterStyle::Square => "\u{25AA}".to_string(),
+            CounterStyle::None => String::new(),
+            _ => value.to_string(),
+        }
+    }
+}
+
+/// CSS `line-height`.  A number is a factor of the font size, inherited as
+/// the factor so that text of another size keeps the same proportions; a
+/// length or percentage is computed on the element that declares it and
+/// inherited as that length.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum LineHeight {
+    Factor(f32),
+    Px(f32),
+    /// A percentage or `em` value as a factor of the element's own font
+    /// size, until [`LineHeight::computed`] makes it a length.
+    Relative(f32),
+}
+
+impl LineHeight {
+    /// The height of a line of text set at `font_size`.
+    pub fn px(self, font_size: f32) -> f32 {
+        match self {
+            LineHeight::Factor(factor) | LineHeight::Relative(factor) => font_size * factor,
+            LineHeight::Px(px) => px,
+        }
+    }
+
+    /// The computed value on an element whose font size is `font_size`.
+    fn computed(self, font_size: f32) -> Self {
+        match self {
+            LineHeight::Relative(factor) => LineHeight::Px(font_size * factor),
+            other => other,
+        }
+    }
+}
+
+/// `line-height: normal | <number> | <length> | <percentage>`, with `normal`
+/// as the default factor.
+fn parse_line_height(val: &str) -> Option<LineHeight> {
+    let val = val.trim();
+    let number = |n: &str| n.trim().parse::<f32>().ok().filter(|n| *n >= 0.0);
+    if val == "normal" {
+        Some(ComputedStyle::default().line_height)
+    } else if let Some(percent) = val.strip_suffix('%') {
+        Some(LineHeight::Relative(number(percent)? / 100.0))
+    } else if let Some(em) = val.strip_suffix("em").filter(|n| !n.ends_with('r')) {
+        Some(LineHeight::Relative(number(em)?))
+    } else if let Some(px) = val.strip_suffix("px") {
+        Some(LineHeight::Px(number(px)?))
+    } else {
+        Some(LineHeight::Factor(number(val)?))
+    }
+}
+
+/// CSS `word-break`.  `keep-all` only differs from `normal` for CJK text,
+/// which is not broken between characters anyway.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum WordBreak {
+    Normal,
+    /// Lines may break between any two characters.
+    BreakAll,
+    KeepAll,
+}
+
+impl WordBreak {
+    pub fn from_css(value: &str) -> Option<Self> {
+        Some(match value {
+            "normal" => WordBreak::Normal,
+            "break-all" => WordBreak::BreakAll,
+            "keep-all" => WordBreak::KeepAll,
+            _ => return None,
+        })
+    }
+}
+
+/// CSS `overflow-wrap` (alias `word-wrap`).
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum OverflowWrap {
+    /// Words wider than the line overflow it.
+    Normal,
+    /// Words wider than the line are broken between characters.
+    Anywhere,
+    /// As `Anywhere`; the two differ only in min-content sizing, which
+    /// layout does not use.
+    BreakWord,
+}
+
+impl OverflowWrap {
+    pub fn from_css(value: &str) -> Option<Self> {
+        Some(match value {
+            "normal" => OverflowWrap::Normal,
+            "anywhere" => OverflowWrap::Anywhere,
+            "break-word" => OverflowWrap::BreakWord,
+            _ => return None,
+        })
+    }
+
+    /// Whether words too wide for the line may be broken.
+    pub fn breaks_words(self) -> bool {
+        self != OverflowWrap::Normal
+    }
+}
+
+/// CSS `white-space`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum WhiteSpace {
+    /// Collapse whitespace and newlines; wrap.
+    Normal,
+    /// Collapse whitespace and newlines; never wrap.
+    Nowrap,
+    /// Keep spaces and newlines; never wrap.
+    Pre,
+    /// Keep spaces and newlines; wrap.
+    PreWrap,
+    /// Collapse spaces but keep newlines; wrap.
+    PreLine,
+    /// Like `PreWrap` (trailing spaces are not laid out separately).
+    BreakSpaces,
+}
+
+impl WhiteSpace {
+    pub fn from_css(value: &str) -> Option<Self> {
+        Some(match value {
+            "normal" => WhiteSpace::Normal,
+            "nowrap" => WhiteSpace::Nowrap,
+            "pre" => WhiteSpace::Pre,
+            "pre-wrap" => WhiteSpace::PreWrap,
+            "pre-line" => WhiteSpace::PreLine,
+            "break-spaces" => WhiteSpace::BreakSpaces,
+            _ => return None,
+        })
+    }
+
+    /// Whether runs of spaces and tabs are kept as written.
+    pub fn preserves_spaces(self) -> bool {
+        matches!(
+            self,
+            WhiteSpace::Pre | WhiteSpace::PreWrap | WhiteSpace::BreakSpaces
+        )
+    }
+
+    /// Normalise `text` for layout: collapsed modes become a single line of
+    /// single-spaced words (`PreLine` keeps its newlines); preserving modes
+    /// expand tabs to 8-column stops and drop one leading and one trailing
+    /// newline, as browsers do for `<pre>`.
+    pub fn apply(self, text: &str) -> String {
+        let text = text.replace("\r\n", "\n");
+        match self {
+            WhiteSpace::Normal | WhiteSpace::Nowrap => {
+                text.split_whitespace().collect::<Vec<_>>().join(" ")
+            }
+            WhiteSpace::PreLine => text
+                .trim()
+                .split('\n')
+                .map(|line| line.split_whitespace().collect::<Vec<_>>().join(" "))
+                .collect::<Vec<_>>()
+                .join("\n"),
+            WhiteSpace::Pre | WhiteSpace::PreWrap | WhiteSpace::BreakSpaces => {
+                let text = text.strip_prefix('\n').unwrap_or(&text);
+                let text = text.strip_suffix('\n').unwrap_or(text);
+                text.split('\n')
+                    .map(expand_tabs)
+                    .collect::<Vec<_>>()
+                    .join("\n")
+            }
+        }
+    }
+}
+
+fn expand_tabs(line: &str) -> String {
+    let mut out = String::with_capacity(line.len());
+    for c in line.chars() {
+        if c == '\t' {
+            let pad = 8 - out.chars().count() % 8;
+            out.extend(std::iter::repeat(' ').take(pad));
+        } else {
+            out.push(c);
+        }
+    }
+    out
+}
+
 #[derive(Debug, Clone, Copy, PartialEq, Eq)]
 pub enum TextDecoration {
     None,
@@ -245,32 +750,114 @@ impl Color {
 
 /// Resolve the style for an element, inheriting text properties from its parent.
 pub fn resolve_style(element: &ElementNode, parent: Option<&ComputedStyle>) -> ComputedStyle {
-    let mut style = base_style_for_tag(&element.tag);
+    resolve_style_with_sheet(element, parent, &Stylesheet::default(), &[])
+}
 
-    // Inherit text properties from parent
+/// Resolve the style for an element, also applying matching `sheet` rules.
+/// `ancestors` runs from the root element down to the element's parent.
+pub fn resolve_style_with_sheet(
+    element: &ElementNode,
+    parent: Option<&ComputedStyle>,
+    sheet: &Stylesheet,
+    ancestors: &[&ElementNode],
+) -> ComputedStyle {
+    let mut style = base_style_for_tag(&element.tag);
     if let Some(p) = parent {
-        style.font_size = p.font_size;
-        style.font_weight = p.font_weight;
-        style.font_family = p.font_family.clone();
-        style.color = p.color;
-        style.text_align = p.text_align;
-        style.line_height = p.line_height;
-        style.font_style = p.font_style;
+        inherit_text_properties(&mut style, p);
     }
 
+    let rules = sheet.matching(element, ancestors);
+    let apply_rules = |style: &mut ComputedStyle, pick: &dyn Fn(&Rule) -> bool| {
+        for rule in rules.iter().filter(|r| pick(r)) {
+            for decl in rule.declarations.iter().filter(|d| !d.important) {
+                apply_css_property(style, &decl.property, &decl.value);
+            }
+        }
+    };
+
+    // Document rules less specific than a class (type selectors, `*`)
+    apply_rules(&mut style, &|r| {
+        r.origin == Origin::Document && r.specificity < CLASS_SPECIFICITY
+    });
+
     // Apply Tailwind classes
     for class in element.classes() {
         apply_tailwind_class(&mut style, class);
     }
 
+    apply_rules(&mut style, &|r| {
+        r.origin == Origin::Document && r.specificity >= CLASS_SPECIFICITY
+    });
+
     // Apply inline style attribute
     if let Some(inline) = element.inline_style() {
         apply_inline_style(&mut style, inline);
     }
 
+    apply_rules(&mut style, &|r| r.origin == Origin::Extra);
+
+    for decl in rules.iter().flat_map(|r| &r.declarations) {
+        if decl.important {
+            apply_css_property(&mut style, &decl.property, &decl.value);
+        }
+    }
+
+    // Percentages refer to the font size the cascade ended with.
+    style.line_height = style.line_height.computed(style.font_size);
     style
 }
 
+/// Resolve the style of `element`'s `pseudo` element from the matching
+/// `sheet` rules, which apply in cascade order with `!important` last.
+/// Returns `None` when no rule gives it a `content` value or it is
+/// `display: none`.
+pub fn resolve_pseudo_style(
+    element: &ElementNode,
+    pseudo: PseudoElement,
+    element_style: &ComputedStyle,
+    sheet: &Stylesheet,
+    ancestors: &[&ElementNode],
+) -> Option<ComputedStyle> {
+    let rules = sheet.matching_pseudo(element, ancestors, pseudo);
+    if rules.is_empty() {
+        return None;
+    }
+    let mut style = base_style_for_tag(&Tag::Span);
+    inherit_text_properties(&mut style, element_style);
+    let declarations = rules.iter().flat_map(|r| &r.declarations);
+    let normal = declarations.clone().filter(|d| !d.important);
+    for decl in normal.chain(declarations.filter(|d| d.important)) {
+        apply_css_property(&mut style, &decl.property, &decl.value);
+    }
+    style.line_height = style.line_height.computed(style.font_size);
+    (!style.content.is_empty() && style.display != Display::None).then_some(style)
+}
+
+/// Copy the inherited (text) properties of `parent` into `style`.
+fn inherit_text_properties(style: &mut ComputedStyle, p: &ComputedStyle) {
+    style.font_size = p.font_size;
+    style.font_weight = p.font_weight;
+    style.font_family = p.font_family.clone();
+    style.color = p.color;
+    style.text_align = p.text_align;
+    style.vertical_align = p.vertical_align;
+    style.line_height = p.line_height;
+    style.font_style = p.font_style;
+    style.text_stroke_width = p.text_stroke_width;
+    style.text_stroke_color = p.text_stroke_color;
+    style.text_fill_transparent = p.text_fill_transparent;
+    style.writing_mode = p.writing_mode;
+    style.white_space = p.white_space;
+    style.word_break = p.word_break;
+    style.overflow_wrap = p.overflow_wrap;
+    style.text_shadow = p.text_shadow.clone();
+    style.orphans = p.orphans;
+    style.print_color_adjust = p.print_color_adjust;
+    style.widows = p.widows;
+    style.list_style_image = p.list_style_image.clone();
+    style.visibility = p.visibility;
+}
+
 /// Default styles based on tag semantics.
 fn base_style_for_tag(tag: &Tag) -> ComputedStyle {
     let mut s = ComputedStyle::default();
@@ -297,20 +884,36 @@ fn base_style_for_tag(tag: &Tag) -> ComputedStyle {
             s.margin_top = 0.0;
             s.margin_bottom = 10.0;
         }
+        Tag::Pre => {
+            s.margin_top = 0.0;
+            s.margin_bottom = 10.0;
+            s.white_space = WhiteSpace::Pre;
+        }
         Tag::Ul | Tag::Ol => {
             s.margin_top = 0.0;
             s.margin_bottom = 10.0;
             s.padding_left = 24.0;
+            s.counter_reset = vec![("list-item".to_string(), 0)];
         }
         Tag::Li => {
             s.display = Display::ListItem;
             s.margin_bottom = 4.0;
+            s.counter_increment = vec![("list-item".to_string(), 1)];
         }
         Tag::Table => {
             s.display = Display::Grid;
             s.border_width = 1.0;
             s.page_break_inside_avoid = false; // tables can split
         }
+        Tag::Thead => {
+            s.display = Display::TableHeaderGroup;
+        }
+        Tag::Tbody => {
+            s.display = Display::TableRowGroup;
+        }
+        Tag::Tfoot => {
+            s.display = Display::TableFooterGroup;
+        }
         Tag::Tr => {
             s.display = Display::TableRow;
         }
@@ -337,6 +940,27 @@ fn base_style_for_tag(tag: &Tag) -> ComputedStyle {
         Tag::Img => {
             s.display = Display::InlineBlock;
         }
+        // A rule is an empty block drawn by its top border.
+        Tag::Hr => {
+            s.height = Dimension::Px(0.0);
+            s.margin_top = 8.0;
+            s.margin_bottom = 8.0;
+            s.border_width = 1.0;
+            s.border_color = Color::from_hex("#808080").unwrap();
+            s.border_sides = BorderSides::TOP;
+        }
+        Tag::Style => {
+            s.display = Display::None;
+        }
+        // Print has no disclosure widget: `<details>` is always laid out
+        // open, whatever its `open` attribute, with the summary as a heading.
+        Tag::Details => {
+            s.margin_bottom = 10.0;
+        }
+        Tag::Summary => {
+            s.font_weight = FontWeight::Bold;
+            s.margin_bottom = 6.0;
+        }
         Tag::Div | Tag::Body | Tag::Html | Tag::Head => {}
         Tag::Unknown(_) => {
             // Silently skip unrecognised elements – treat as display:none.
@@ -357,6 +981,11 @@ fn apply_tailwind_class(s: &mut ComputedStyle, class: &str) {
         "inline-block" => s.display = Display::InlineBlock,
         "hidden" => s.display = Display::None,
 
+        // Visibility
+        "visible" => s.visibility = Visibility::Visible,
+        "invisible" => s.visibility = Visibility::Hidden,
+        "collapse" => s.visibility = Visibility::Collapse,
+
         // Flex direction
         "flex-row" => s.flex_direction = FlexDirection::Row,
         "flex-col" => s.flex_direction = FlexDirection::Column,
@@ -385,6 +1014,10 @@ fn apply_tailwind_class(s: &mut ComputedStyle, class: &str) {
         "items-start" => s.align_items = AlignItems::Start,
         "items-end" => s.align_items = AlignItems::End,
         "items-center" => s.align_items = AlignItems::Center,
+        "align-baseline" => s.vertical_align = VerticalAlign::Baseline,
+        "align-top" => s.vertical_align = VerticalAlign::Top,
+        "align-middle" => s.vertical_align = VerticalAlign::Middle,
+        "align-bottom" => s.vertical_align = VerticalAlign::Bottom,
         "items-stretch" => s.align_items = AlignItems::Stretch,
 
         // Font weight
@@ -397,8 +1030,44 @@ fn apply_tailwind_class(s: &mut ComputedStyle, class: &str) {
 
         // Text decoration
         "underline" => s.text_decoration = TextDecoration::Underline,
+        "whitespace-normal" => s.white_space = WhiteSpace::Normal,
+        "whitespace-nowrap" => s.white_space = WhiteSpace::Nowrap,
+        "whitespace-pre" => s.white_space = WhiteSpace::Pre,
+        "whitespace-pre-wrap" => s.white_space = WhiteSpace::PreWrap,
+        "whitespace-pre-line" => s.white_space = WhiteSpace::PreLine,
+        "whitespace-break-spaces" => s.white_space = WhiteSpace::BreakSpaces,
+        "break-normal" => {
+            s.word_break = WordBreak::Normal;
+            s.overflow_wrap = OverflowWrap::Normal;
+        }
+        "break-words" => s.overflow_wrap = OverflowWrap::BreakWord,
+        "break-all" => s.word_break = WordBreak::BreakAll,
+        "break-keep" => s.word_break = WordBreak::KeepAll,
+        "overflow-hidden" | "overflow-clip" => s.overflow = Overflow::Hidden,
+        "overflow-visible" => s.overflow = Overflow::Visible,
+        "text-ellipsis" => s.text_overflow = TextOverflow::Ellipsis,
+        "text-clip" => s.text_overflow = TextOverflow::Clip,
+        "truncate" => {
+            s.overflow = Overflow::Hidden;
+            s.text_overflow = TextOverflow::Ellipsis;
+            s.white_space = WhiteSpace::Nowrap;
+        }
         "no-underline" => s.text_decoration = TextDecoration::None,
 
+        // Background image
+        "bg-auto" => s.background_size = BackgroundSize::Auto,
+        "bg-cover" => s.background_size = BackgroundSize::Cover,
+        "bg-contain" => s.background_size = BackgroundSize::Contain,
+        "bg-center" | "bg-top" | "bg-bottom" | "bg-left" | "bg-right" => {
+            if let Some(position) = parse_background_position(&class[3..]) {
+                s.background_position = position;
+            }
+        }
+        "bg-repeat" => s.background_repeat = BackgroundRepeat::Repeat,
+        "bg-no-repeat" => s.background_repeat = BackgroundRepeat::NoRepeat,
+        "bg-repeat-x" => s.background_repeat = BackgroundRepeat::RepeatX,
+        "bg-repeat-y" => s.background_repeat = BackgroundRepeat::RepeatY,
+
         // Text alignment
         "text-left" => s.text_align = TextAlign::Left,
         "text-center" => s.text_align = TextAlign::Center,
@@ -436,6 +1105,7 @@ fn apply_tailwind_class(s: &mut ComputedStyle, class: &str) {
             try_parse_color_class(s, class);
             try_parse_gap_class(s, class);
             try_parse_grid_cols_class(s, class);
+            try_parse_columns_class(s, class);
             try_parse_width_class(s, class);
             try_parse_height_class(s, class);
         }
@@ -649,10 +1319,21 @@ fn try_parse_gap_class(s: &mut ComputedStyle, class: &str) {
     }
 }
 
+/// Most tracks a `grid-cols-N` class creates; larger counts are clamped.
+const MAX_GRID_COLUMNS: usize = 64;
+
 fn try_parse_grid_cols_class(s: &mut ComputedStyle, class: &str) {
     if let Some(rest) = class.strip_prefix("grid-cols-") {
         if let Ok(n) = rest.parse::<usize>() {
-            s.grid_template_columns = vec![GridTrack::Fr(1.0); n];
+            s.grid_template_columns = vec![GridTrack::Fr(1.0); n.min(MAX_GRID_COLUMNS)];
+        }
+    }
+}
+
+fn try_parse_columns_class(s: &mut ComputedStyle, class: &str) {
+    if let Some(rest) = class.strip_prefix("columns-") {
+        if let Ok(n) = rest.parse::<u32>() {
+            s.column_count = n.max(1);
         }
     }
 }
@@ -678,7 +1359,7 @@ fn try_parse_height_class(s: &mut ComputedStyle, class: &str) {
 // ---------------------------------------------------------------------------
 
 fn apply_inline_style(s: &mut ComputedStyle, style_str: &str) {
-    for decl in style_str.split(';') {
+    for decl in split_declarations(style_str) {
         let decl = decl.trim();
         if decl.is_empty() {
             continue;
@@ -696,19 +1377,112 @@ fn apply_inline_style(s: &mut ComputedStyle, style_str: &str) {
     }
 }
 
+/// Properties [`apply_css_property`] understands; keep in step with it.
+const SUPPORTED_PROPERTIES: &[&str] = &[
+    "display",
+    "flex-direction",
+    "font-size",
+    "font-weight",
+    "font-style",
+    "color",
+    "background-color",
+    "background",
+    "background-image",
+    "background-size",
+    "background-position",
+    "background-repeat",
+    "text-align",
+    "vertical-align",
+    "width",
+    "height",
+    "aspect-ratio",
+    "position",
+    "top",
+    "right",
+    "bottom",
+    "left",
+    "visibility",
+    "inset",
+    "margin",
+    "margin-top",
+    "margin-right",
+    "margin-bottom",
+    "margin-left",
+    "padding",
+    "padding-top",
+    "padding-right",
+    "padding-bottom",
+    "padding-left",
+    "border-width",
+    "border",
+    "border-top",
+    "border-right",
+    "border-bottom",
+    "border-left",
+    "border-color",
+    "border-style",
+    "-webkit-text-stroke",
+    "-webkit-text-stroke-width",
+    "-webkit-text-stroke-color",
+    "-webkit-text-fill-color",
+    "print-color-adjust",
+    "-webkit-print-color-adjust",
+    "color-adjust",
+    "white-space",
+    "transform",
+    "border-radius",
+    "clip-path",
+    "overflow",
+    "text-overflow",
+    "list-style-image",
+    "box-shadow",
+    "text-shadow",
+    "writing-mode",
+    "line-height",
+    "gap",
+    "column-count",
+    "columns",
+    "column-gap",
+    "break-after",
+    "break-before",
+    "page-break-before",
+    "page-break-after",
+    "page-break-inside",
+    "orphans",
+    "widows",
+    "content",
+    "counter-reset",
+    "counter-increment",
+];
+
+/// Whether the engine supports the declaration `prop: val`, as asked by an
+/// `@supports` query.  `display` values are checked; other supported
+/// properties are taken to support any value.
+pub fn supports(prop: &str, val: &str) -> bool {
+    match prop {
+        "display" => parse_display(val).is_some(),
+        _ => SUPPORTED_PROPERTIES.contains(&prop),
+    }
+}
+
+fn parse_display(val: &str) -> Option<Display> {
+    Some(match val {
+        "flex" => Display::Flex,
+        "grid" => Display::Grid,
+        "block" => Display::Block,
+        "inline" => Display::Inline,
+        "inline-block" => Display::InlineBlock,
+        "table-header-group" => Display::TableHeaderGroup,
+        "table-row-group" => Display::TableRowGroup,
+        "table-footer-group" => Display::TableFooterGroup,
+        "none" => Display::None,
+        _ => return None,
+    })
+}
+
 fn apply_css_property(s: &mut ComputedStyle, prop: &str, val: &str) {
     match prop {
-        "display" => {
-            s.display = match val {
-                "flex" => Display::Flex,
-                "grid" => Display::Grid,
-                "block" => Display::Block,
-                "inline" => Display::Inline,
-                "inline-block" => Display::InlineBlock,
-                "none" => Display::None,
-                _ => s.display,
-            }
-        }
+        "display" => s.display = parse_display(val).unwrap_or(s.display),
         "flex-direction" => {
             s.flex_direction = match val {
                 "row" => FlexDirection::Row,
@@ -741,8 +1515,23 @@ fn apply_css_property(s: &mut ComputedStyle, prop: &str, val: &str) {
         "background-color" | "background" => {
             if let Some(c) = Color::from_hex(val) {
                 s.background_color = c;
+            } else if prop == "background" {
+                apply_background_shorthand(s, val);
             }
         }
+        "background-image" => apply_background_image(s, val),
+        "background-size" => match parse_background_size(val) {
+            Some(size) => s.background_size = size,
+            None => diagnostics::warn("css", format!("Ignoring unsupported `{prop}: {val}`")),
+        },
+        "background-position" => match parse_background_position(val) {
+            Some(position) => s.background_position = position,
+            None => diagnostics::warn("css", format!("Ignoring unsupported `{prop}: {val}`")),
+        },
+        "background-repeat" => match parse_background_repeat(val) {
+            Some(repeat) => s.background_repeat = repeat,
+            None => diagnostics::warn("css", format!("Ignoring unsupported `{prop}: {val}`")),
+        },
         "text-align" => {
             s.text_align = match val {
                 "center" => TextAlign::Center,
@@ -756,6 +1545,47 @@ fn apply_css_property(s: &mut ComputedStyle, prop: &str, val: &str) {
         "height" => {
             s.height = parse_dimension(val);
         }
+        "aspect-ratio" => match parse_aspect_ratio(val) {
+            Some(ratio) => s.aspect_ratio = ratio,
+            None => diagnostics::warn("css", format!("Ignoring invalid `{prop}: {val}`")),
+        },
+        "position" => match val {
+            "static" => s.position = Position::Static,
+            "relative" => s.position = Position::Relative,
+            "absolute" => s.position = Position::Absolute,
+            _ => diagnostics::warn("css", format!("Ignoring unsupported `{prop}: {val}`")),
+        },
+        "vertical-align" => match val {
+            "baseline" => s.vertical_align = VerticalAlign::Baseline,
+            "top" => s.vertical_align = VerticalAlign::Top,
+            "middle" => s.vertical_align = VerticalAlign::Middle,
+            "bottom" => s.vertical_align = VerticalAlign::Bottom,
+            _ => diagnostics::warn("css", format!("Ignoring unsupported `{prop}: {val}`")),
+        },
+        "visibility" => match val {
+            "visible" => s.visibility = Visibility::Visible,
+            "hidden" => s.visibility = Visibility::Hidden,
+            "collapse" => s.visibility = Visibility::Collapse,
+            _ => diagnostics::warn("css", format!("Ignoring unsupported `{prop}: {val}`")),
+        },
+        "top" => s.inset_top = parse_dimension(val),
+        "right" => s.inset_right = parse_dimension(val),
+        "bottom" => s.inset_bottom = parse_dimension(val),
+        "left" => s.inset_left = parse_dimension(val),
+        "inset" => {
+            let parts: Vec<Dimension> = val.split_whitespace().map(parse_dimension).collect();
+            let [top, right, bottom, left] = match parts[..] {
+                [all] => [all; 4],
+                [v, h] => [v, h, v, h],
+                [t, h, b] => [t, h, b, h],
+                [t, r, b, l] => [t, r, b, l],
+                _ => return,
+            };
+            s.inset_top = top;
+            s.inset_right = right;
+            s.inset_bottom = bottom;
+            s.inset_left = left;
+        }
         "margin" => apply_shorthand_spacing(
             val,
             &mut s.margin_top,
@@ -810,28 +1640,160 @@ fn apply_css_property(s: &mut ComputedStyle, prop: &str, val: &str) {
                 s.padding_left = px;
             }
         }
-        "border-width" | "border" => {
+        "border-width" => {
             if let Some(px) = parse_px(val) {
                 s.border_width = px;
             }
         }
+        "border" | "border-top" | "border-right" | "border-bottom" | "border-left" => {
+            apply_border_shorthand(s, prop, val)
+        }
         "border-color" => {
-            if let Some(c) = Color::from_hex(val) {
+            if let Some(c) = parse_color(val) {
                 s.border_color = c;
             }
         }
-        "line-height" => {
-            if let Ok(v) = val.parse::<f32>() {
-                s.line_height = v;
-            } else if let Some(px) = parse_px(val) {
-                s.line_height = px / s.font_size;
+        "border-style" => match val {
+            "none" | "hidden" => s.border_width = 0.0,
+            _ => match parse_line_style(val) {
+                Some(style) => s.border_style = style,
+                None => diagnostics::warn("css", format!("Ignoring unsupported `{prop}: {val}`")),
+            },
+        },
+        "-webkit-text-stroke" => {
+            for part in val.split_whitespace() {
+                if let Some(px) = parse_px(part) {
+                    s.text_stroke_width = px;
+                } else if let Some(c) = Color::from_hex(part) {
+                    s.text_stroke_color = Some(c);
+                }
+            }
+        }
+        "-webkit-text-stroke-width" => {
+            if let Some(px) = parse_px(val) {
+                s.text_stroke_width = px;
+            }
+        }
+        "-webkit-text-stroke-color" => {
+            if let Some(c) = Color::from_hex(val) {
+                s.text_stroke_color = Some(c);
+            }
+        }
+        "-webkit-text-fill-color" => {
+            if val == "transparent" {
+                s.text_fill_transparent = true;
+            } else if let Some(c) = Color::from_hex(val) {
+                s.text_fill_transparent = false;
+                s.color = c;
+            }
+        }
+        "print-color-adjust" | "-webkit-print-color-adjust" | "color-adjust" => match val {
+            "exact" => s.print_color_adjust = PrintColorAdjust::Exact,
+            "economy" => s.print_color_adjust = PrintColorAdjust::Economy,
+            _ => diagnostics::warn("css", format!("Ignoring invalid `{prop}: {val}`")),
+        },
+        "white-space" => {
+            if let Some(ws) = WhiteSpace::from_css(val) {
+                s.white_space = ws;
+            }
+        }
+        // The legacy `word-break: break-word` acts as `overflow-wrap: anywhere`.
+        "word-break" if val == "break-word" => {
+            s.word_break = WordBreak::Normal;
+            s.overflow_wrap = OverflowWrap::Anywhere;
+        }
+        "word-break" => {
+            if let Some(wb) = WordBreak::from_css(val) {
+                s.word_break = wb;
+            }
+        }
+        "overflow-wrap" | "word-wrap" => {
+            if let Some(ow) = OverflowWrap::from_css(val) {
+                s.overflow_wrap = ow;
+            }
+        }
+        "transform" => {
+            if val == "none" {
+                s.transform = None;
+            } else if let Some(m) = parse_transform(val) {
+                s.transform = Some(m);
+            } else {
+                diagnostics::warn("css", format!("Ignoring unsupported transform `{val}`"));
+            }
+        }
+        "border-radius" => match parse_radius(val) {
+            Some(r) if r != Radius::Length(0.0) => s.border_radius = Some(r),
+            Some(_) => s.border_radius = None,
+            None => diagnostics::warn("css", format!("Ignoring unsupported border-radius `{val}`")),
+        },
+        "clip-path" => {
+            if val == "none" {
+                s.clip_path = None;
+            } else if let Some(shape) = parse_clip_path(val) {
+                s.clip_path = Some(shape);
+            } else {
+                diagnostics::warn("css", format!("Ignoring unsupported clip-path `{val}`"));
+            }
+        }
+        "overflow" => match val {
+            "visible" => s.overflow = Overflow::Visible,
+            "hidden" | "clip" | "auto" | "scroll" => s.overflow = Overflow::Hidden,
+            _ => diagnostics::warn("css", format!("Ignoring unsupported `{prop}: {val}`")),
+        },
+        "text-overflow" => match val {
+            "clip" => s.text_overflow = TextOverflow::Clip,
+            "ellipsis" => s.text_overflow = TextOverflow::Ellipsis,
+            _ => diagnostics::warn("css", format!("Ignoring unsupported `{prop}: {val}`")),
+        },
+        "list-style-image" => match parse_url(val) {
+            Some(src) => s.list_style_image = Some(src),
+            None if val == "none" => s.list_style_image = None,
+            None => diagnostics::warn(
+                "css",
+                format!("Ignoring unsupported list-style-image `{val}`"),
+            ),
+        },
+        "box-shadow" | "text-shadow" => {
+            let is_box = prop == "box-shadow";
+            let shadows = if val == "none" {
+                Some(Vec::new())
+            } else {
+                parse_shadows(val, s.color, is_box)
+            };
+            match shadows {
+                Some(list) if is_box => s.box_shadow = list,
+                Some(list) => s.text_shadow = list,
+                None => diagnostics::warn("css", format!("Ignoring unsupported {prop} `{val}`")),
             }
         }
+        "writing-mode" => {
+            s.writing_mode = match val {
+                "vertical-rl" => WritingMode::VerticalRl,
+                "vertical-lr" => WritingMode::VerticalLr,
+                _ => WritingMode::HorizontalTb,
+            };
+        }
+        "line-height" => match parse_line_height(val) {
+            Some(line_height) => s.line_height = line_height,
+            None => diagnostics::warn("css", format!("Ignoring unsupported `{prop}: {val}`")),
+        },
         "gap" => {
             if let Some(px) = parse_px(val) {
                 s.gap = px;
             }
         }
+        "column-count" => {
+            s.column_count = val.parse::<u32>().unwrap_or(1).max(1);
+        }
+        "columns" => {
+            // `columns: <count> || <width>`; column widths are not supported.
+            if let Some(n) = val.split_whitespace().find_map(|p| p.parse::<u32>().ok()) {
+                s.column_count = n.max(1);
+            }
+        }
+        "column-gap" => {
+            s.column_gap = parse_px(val);
+        }
         "break-after" => {
             s.page_break_after = val == "always" || val == "page";
         }
@@ -847,15 +1809,783 @@ fn apply_css_property(s: &mut ComputedStyle, prop: &str, val: &str) {
         "page-break-inside" => {
             s.page_break_inside_avoid = val == "avoid";
         }
+        "orphans" | "widows" => match val.parse::<u32>() {
+            Ok(n) if n > 0 => match prop {
+                "orphans" => s.orphans = n,
+                _ => s.widows = n,
+            },
+            _ => diagnostics::warn("css", format!("Ignoring invalid `{prop}: {val}`")),
+        },
+        "content" => match parse_content(val) {
+            Some(items) => s.content = items,
+            None => diagnostics::warn("css", format!("Ignoring unsupported `content: {val}`")),
+        },
+        "filter" => match parse_filter(val) {
+            Some(filter) => s.filter = filter,
+            None if val == "none" => s.filter = Vec::new(),
+            None => diagnostics::warn("css", format!("Not rendering unsupported `{prop}: {val}`")),
+        },
+        // Effects without a vector equivalent are left out, but not silently.
+        "backdrop-filter" | "mix-blend-mode" if !matches!(val, "none" | "normal") => {
+            diagnostics::warn("css", format!("Not rendering unsupported `{prop}: {val}`"))
+        }
+        "counter-reset" => s.counter_reset = parse_counters(val, 0),
+        "counter-increment" => s.counter_increment = parse_counters(val, 1),
         _ => {}
     }
 }
 
+/// `aspect-ratio: auto | <w> [/ <h>]`, as `Some(None)` for `auto`.  The
+/// `auto <ratio>` form (intrinsic ratio first) uses the given ratio.
+fn parse_aspect_ratio(val: &str) -> Option<Option<f32>> {
+    let ratio = val.trim().strip_prefix("auto").unwrap_or(val).trim();
+    if ratio.is_empty() {
+        return Some(None);
+    }
+    let (w, h) = ratio.split_once('/').unwrap_or((ratio, "1"));
+    let (w, h): (f32, f32) = (w.trim().parse().ok()?, h.trim().parse().ok()?);
+    (w > 0.0 && h > 0.0).then_some(Some(w / h))
+}
+
 fn parse_px(s: &str) -> Option<f32> {
     let s = s.trim().trim_end_matches("px");
     s.parse().ok()
 }
 
+/// Apply `border` or a `border-{side}` shorthand: a width, a style and a
+/// colour, each optional and in any order.  A side shorthand adds that side
+/// to the bordered ones (or starts a single-sided border on a box without
+/// one), and its width, colour and style then apply to every bordered side.
+fn apply_border_shorthand(s: &mut ComputedStyle, prop: &str, val: &str) {
+    let side = match prop {
+        "border-top" => Some(BorderSides::TOP),
+        "border-right" => Some(BorderSides::RIGHT),
+        "border-bottom" => Some(BorderSides::BOTTOM),
+        "border-left" => Some(BorderSides::LEFT),
+        _ => None,
+    };
+    if matches!(val, "none" | "hidden" | "0") {
+        match side {
+            Some(side) => s.border_sides = s.border_sides.without(side),
+            None => s.border_sides = BorderSides::NONE,
+        }
+        if s.border_sides == BorderSides::NONE {
+            s.border_width = 0.0;
+        }
+        return;
+    }
+    let (mut width, mut style, mut color) = (None, None, None);
+    for part in val.split_whitespace() {
+        if let Some(px) = parse_px(part) {
+            width = Some(px);
+        } else if let Some(line) = parse_line_style(part) {
+            style = Some(line);
+        } else if let Some(c) = parse_color(part) {
+            color = Some(c);
+        } else {
+            diagnostics::warn("css", format!("Ignoring invalid `{prop}: {val}`"));
+            return;
+        }
+    }
+    s.border_sides = match side {
+        Some(side) if s.border_width > 0.0 => s.border_sides.union(side),
+        Some(side) => side,
+        None => BorderSides::ALL,
+    };
+    s.border_width = width.unwrap_or(s.border_width.max(1.0));
+    s.border_style = style.unwrap_or(s.border_style);
+    s.border_color = color.unwrap_or(s.border_color);
+}
+
+fn parse_line_style(val: &str) -> Option<LineStyle> {
+    match val {
+        "solid" => Some(LineStyle::Solid),
+        "dashed" => Some(LineStyle::Dashed),
+        "dotted" => Some(LineStyle::Dotted),
+        _ => None,
+    }
+}
+
+/// Parse a comma-separated `box-shadow` / `text-shadow` list.  A layer
+/// without a colour uses `current` (`currentColor`); `inset` shadows are not
+/// supported.  `spread` is only accepted when `allow_spread` is set.
+fn parse_shadows(val: &str, current: Color, allow_spread: bool) -> Option<Vec<Shadow>> {
+    split_outside_parens(val, |c| c == ',')
+        .into_iter()
+        .map(|layer| parse_shadow(layer, current, allow_spread))
+        .collect()
+}
+
+fn parse_shadow(layer: &str, current: Color, allow_spread: bool) -> Option<Shadow> {
+    let mut lengths = Vec::new();
+    let mut color = None;
+    for token in split_outside_parens(layer, char::is_whitespace) {
+        if let Some(px) = parse_px(token) {
+            lengths.push(px);
+        } else if color.is_none() {
+            color = Some(parse_color(token)?);
+        } else {
+            return None;
+        }
+    }
+    let max_lengths = if allow_spread { 4 } else { 3 };
+    if lengths.len() < 2 || lengths.len() > max_lengths {
+        return None;
+    }
+    let c = color.unwrap_or(current);
+    Some(Shadow {
+        offset_x: lengths[0],
+        offset_y: lengths[1],
+        blur: lengths.get(2).copied().unwrap_or(0.0).max(0.0),
+        spread: lengths.get(3).copied().unwrap_or(0.0),
+        color: [c.r, c.g, c.b, c.a],
+    })
+}
+
+/// A colour from `#rrggbb`, `#rgb`, `rgb(r, g, b)`, `rgba(r, g, b, a)`,
+/// one of the basic CSS colour names or `transparent`.
+fn parse_color(val: &str) -> Option<Color> {
+    if val == "transparent" {
+        return Some(Color::TRANSPARENT);
+    }
+    let Some(args) = val.strip_prefix("rgba(").or_else(|| val.strip_prefix("rgb(")) else {
+        return named_color(val).or_else(|| Color::from_hex(val));
+    };
+    let args: Vec<f32> = args
+        .strip_suffix(')')?
+        .split(',')
+        .map(|a| a.trim().parse().ok())
+        .collect::<Option<_>>()?;
+    let (r, g, b, a) = match args[..] {
+        [r, g, b] => (r, g, b, 1.0),
+        [r, g, b, a] => (r, g, b, a),
+        _ => return None,
+    };
+    let channel = |v: f32| v.clamp(0.0, 255.0) / 255.0;
+    Some(Color {
+        r: channel(r),
+        g: channel(g),
+        b: channel(b),
+        a: a.clamp(0.0, 1.0),
+    })
+}
+
+/// The basic CSS colour keywords, and `orange`.
+fn named_color(name: &str) -> Option<Color> {
+    let hex = match name.to_ascii_lowercase().as_str() {
+        "black" => "000000",
+        "silver" => "c0c0c0",
+        "gray" | "grey" => "808080",
+        "white" => "ffffff",
+        "maroon" => "800000",
+        "red" => "ff0000",
+        "purple" => "800080",
+        "fuchsia" => "ff00ff",
+        "green" => "008000",
+        "lime" => "00ff00",
+        "olive" => "808000",
+        "yellow" => "ffff00",
+        "navy" => "000080",
+        "blue" => "0000ff",
+        "teal" => "008080",
+        "aqua" => "00ffff",
+        "orange" => "ffa500",
+        _ => return None,
+    };
+    Color::from_hex(hex)
+}
+
+/// Set the background image from `val`: a gradient or a `url(…)`.
+fn apply_background_image(s: &mut ComputedStyle, val: &str) {
+    if val == "none" {
+        s.background_gradient = None;
+        s.background_image = None;
+    } else if let Some(gradient) = parse_gradient(val) {
+        s.background_gradient = Some(gradient);
+        s.background_image = None;
+    } else if let Some(src) = parse_url(val) {
+        s.background_image = Some(src);
+        s.background_gradient = None;
+    } else {
+        diagnostics::warn("css", format!("Ignoring unsupported background `{val}`"));
+    }
+}
+
+/// Apply a `background` shorthand other than a lone colour: an image,
+/// `position [/ size]`, a repeat style and a colour, each optional and in
+/// any order.  Like the browser, the parts left out are reset.
+fn apply_background_shorthand(s: &mut ComputedStyle, val: &str) {
+    let tokens = background_tokens(val);
+    let mut image = None;
+    let mut color = None;
+    let (mut position, mut size, mut repeat) = (Vec::new(), Vec::new(), Vec::new());
+    let mut after_slash = false;
+    for token in tokens {
+        if token == "/" {
+            after_slash = true;
+        } else if token == "none" || token.starts_with("url(") || token.contains("gradient(") {
+            image = Some(token);
+        } else if token.starts_with("repeat") || token == "no-repeat" {
+            repeat.push(token);
+        } else if let Some(c) = parse_color(token) {
+            color = Some(c);
+        } else if after_slash {
+            size.push(token);
+        } else {
+            position.push(token);
+        }
+    }
+    let parsed = (
+        parse_background_position(&position.join(" ")),
+        parse_background_size(&size.join(" ")),
+        parse_background_repeat(&repeat.join(" ")),
+    );
+    let (Some(position), Some(size), Some(repeat)) = parsed else {
+        diagnostics::warn("css", format!("Ignoring unsupported background `{val}`"));
+        return;
+    };
+    s.background_color = color.unwrap_or(Color::TRANSPARENT);
+    s.background_gradient = None;
+    s.background_image = None;
+    if let Some(image) = image {
+        apply_background_image(s, image);
+    }
+    s.background_position = position;
+    s.background_size = size;
+    s.background_repeat = repeat;
+}
+
+/// Split a `background` value at whitespace and `/` outside parentheses;
+/// each `/` is a token of its own.
+fn background_tokens(val: &str) -> Vec<&str> {
+    let mut tokens = Vec::new();
+    let (mut depth, mut start) = (0usize, 0);
+    for (i, c) in val.char_indices() {
+        match c {
+            '(' => depth += 1,
+            ')' => depth = depth.saturating_sub(1),
+            '/' | ' ' | '\t' | '\n' if depth == 0 => {
+                tokens.push(&val[start..i]);
+                if c == '/' {
+                    tokens.push("/");
+                }
+                start = i + 1;
+            }
+            _ => {}
+        }
+    }
+    tokens.push(&val[start..]);
+    tokens.retain(|t| !t.is_empty());
+    tokens
+}
+
+/// `cover`, `contain`, or one or two of `auto`, `{n}px` and `{n}%`.  An
+/// empty value is the initial `auto`.
+fn parse_background_size(val: &str) -> Option<BackgroundSize> {
+    let words: Vec<&str> = val.split_whitespace().collect();
+    let length = |word: &str| match word {
+        "auto" => Some(None),
+        _ => parse_background_length(word).map(Some),
+    };
+    Some(match words[..] {
+        [] | ["auto"] | ["auto", "auto"] => BackgroundSize::Auto,
+        ["cover"] => BackgroundSize::Cover,
+        ["contain"] => BackgroundSize::Contain,
+        [width] => BackgroundSize::Explicit {
+            width: length(width)?,
+            height: None,
+        },
+        [width, height] => BackgroundSize::Explicit {
+            width: length(width)?,
+            height: length(height)?,
+        },
+        _ => return None,
+    })
+}
+
+/// One or two of the keywords `left` / `center` / `right` /
+/// `top` / `bottom`, `{n}px` and `{n}%`, x first unless a keyword says
+/// otherwise.  A missing value is `center`; an empty one is `0% 0%`.
+fn parse_background_position(val: &str) -> Option<[BackgroundLength; 2]> {
+    use BackgroundLength::Percent;
+    let words: Vec<&str> = val.split_whitespace().collect();
+    let keyword = |word: &str| match word {
+        "left" | "top" => Some(Percent(0.0)),
+        "center" => Some(Percent(50.0)),
+        "right" | "bottom" => Some(Percent(100.0)),
+        _ => parse_background_length(word),
+    };
+    let vertical = |word: &str| matches!(word, "top" | "bottom");
+    let horizontal = |word: &str| matches!(word, "left" | "right");
+    match words[..] {
+        [] => Some([Percent(0.0); 2]),
+        [only] if vertical(only) => Some([Percent(50.0), keyword(only)?]),
+        [only] => Some([keyword(only)?, Percent(50.0)]),
+        [first, second] if vertical(first) || horizontal(second) => {
+            Some([keyword(second)?, keyword(first)?])
+        }
+        [first, second] => Some([keyword(first)?, keyword(second)?]),
+        _ => None,
+    }
+}
+
+/// `{n}px` or `{n}%`.
+fn parse_background_length(word: &str) -> Option<BackgroundLength> {
+    match word.strip_suffix('%') {
+        Some(p) => p.parse().ok().map(BackgroundLength::Percent),
+        None => parse_px(word).map(BackgroundLength::Length),
+    }
+}
+
+/// `repeat`, `repeat-x`, `repeat-y`, `no-repeat`, or a pair of `repeat` /
+/// `no-repeat` for x and y.  An empty value is the initial `repeat`.
+fn parse_background_repeat(val: &str) -> Option<BackgroundRepeat> {
+    let words: Vec<&str> = val.split_whitespace().collect();
+    Some(match words[..] {
+        [] | ["repeat"] | ["repeat", "repeat"] => BackgroundRepeat::Repeat,
+        ["repeat-x"] | ["repeat", "no-repeat"] => BackgroundRepeat::RepeatX,
+        ["repeat-y"] | ["no-repeat", "repeat"] => BackgroundRepeat::RepeatY,
+        ["no-repeat"] | ["no-repeat", "no-repeat"] => BackgroundRepeat::NoRepeat,
+        _ => return None,
+    })
+}
+
+/// Parse `linear-gradient(…)` or `radial-gradient(…)`.  Radial gradients are
+/// always centred and sized to the farthest corner; stop positions must be
+/// percentages.
+fn parse_gradient(val: &str) -> Option<Gradient> {
+    let (name, rest) = val.trim().split_once('(')?;
+    let args = split_outside_parens(rest.strip_suffix(')')?, |c| c == ',');
+    let (shape, stops) = match name.trim() {
+        "linear-gradient" => match parse_linear_direction(args.first()?) {
+            Some(shape) => (shape, &args[1..]),
+            None => (GradientShape::Linear { angle: 180.0 }, &args[..]),
+        },
+        "radial-gradient" => match parse_radial_shape(args.first()?) {
+            Some(shape) => (shape, &args[1..]),
+            None => (GradientShape::Radial { circle: false }, &args[..]),
+        },
+        _ => return None,
+    };
+    Some(Gradient {
+        shape,
+        stops: parse_color_stops(stops)?,
+    })
+}
+
+/// An angle (`45deg`) or `to <side-or-corner>`; `None` for anything else,
+/// which is then read as the first colour stop.
+fn parse_linear_direction(arg: &str) -> Option<GradientShape> {
+    let Some(sides) = arg.strip_prefix("to ") else {
+        let angle = parse_angle(arg)?.to_degrees();
+        return Some(GradientShape::Linear { angle });
+    };
+    let (mut x, mut y) = (0.0f32, 0.0f32);
+    for side in sides.split_whitespace() {
+        match side {
+            "left" => x = -1.0,
+            "right" => x = 1.0,
+            "top" => y = -1.0,
+            "bottom" => y = 1.0,
+            _ => return None,
+        }
+    }
+    if x != 0.0 && y != 0.0 {
+        Some(GradientShape::LinearToCorner { x, y })
+    } else if x != 0.0 || y != 0.0 {
+        let angle = x.atan2(-y).to_degrees();
+        Some(GradientShape::Linear { angle })
+    } else {
+        None
+    }
+}
+
+/// `circle`, `ellipse`, `farthest-corner` and `at center` in any order.
+fn parse_radial_shape(arg: &str) -> Option<GradientShape> {
+    let mut circle = false;
+    for word in arg.split_whitespace() {
+        match word {
+            "circle" => circle = true,
+            "ellipse" | "farthest-corner" | "at" | "center" => {}
+            _ => return None,
+        }
+    }
+    Some(GradientShape::Radial { circle })
+}
+
+/// Resolve `color [percentage]` stops as CSS does: unpositioned end stops go
+/// to 0% and 100%, the others are spread evenly between their neighbours,
+/// and no stop may precede the one before it.  The first and last colours
+/// are extended to the ends if their stops stop short of them.
+fn parse_color_stops(args: &[&str]) -> Option<Vec<GradientStop>> {
+    if args.len() < 2 {
+        return None;
+    }
+    let mut stops = Vec::new();
+    let mut positions = Vec::new();
+    for arg in args {
+        let (color, position) = match split_outside_parens(arg, char::is_whitespace)[..] {
+            [color] => (color, None),
+            [color, position] => {
+                let percent: f32 = position.strip_suffix('%')?.parse().ok()?;
+                (color, Some(percent / 100.0))
+            }
+            _ => return None,
+        };
+        let c = parse_color(color)?;
+        stops.push(GradientStop {
+            offset: 0.0,
+            color: [c.r, c.g, c.b, c.a],
+        });
+        positions.push(position);
+    }
+
+    let last = positions.len() - 1;
+    positions[0] = positions[0].or(Some(0.0));
+    positions[last] = positions[last].or(Some(1.0));
+    let mut floor = 0.0f32;
+    for p in positions.iter_mut().flatten() {
+        *p = p.clamp(floor, 1.0);
+        floor = *p;
+    }
+    let known: Vec<usize> = (0..positions.len())
+        .filter(|&i| positions[i].is_some())
+        .collect();
+    for pair in known.windows(2) {
+        let (a, b) = (pair[0], pair[1]);
+        let (from, to) = (positions[a]?, positions[b]?);
+        for (i, stop) in stops.iter_mut().enumerate().take(b + 1).skip(a) {
+            stop.offset = from + (to - from) * (i - a) as f32 / (b - a) as f32;
+        }
+    }
+
+    if stops[0].offset > 0.0 {
+        let start = GradientStop {
+            offset: 0.0,
+            ..stops[0]
+        };
+        stops.insert(0, start);
+    }
+    if let Some(&end) = stops.last().filter(|s| s.offset < 1.0) {
+        stops.push(GradientStop { offset: 1.0, ..end });
+    }
+    Some(stops)
+}
+
+/// Parse a `content` value: strings, `attr()`, `counter()`, `open-quote`
+/// and `close-quote`.  `none` and `normal` generate nothing.
+fn parse_content(val: &str) -> Option<Vec<ContentItem>> {
+    let mut items = Vec::new();
+    let mut rest = val.trim();
+    if matches!(rest, "none" | "normal") {
+        return Some(items);
+    }
+    while let Some(first) = rest.chars().next() {
+        if first == '"' || first == '\'' {
+            let (text, after) = parse_css_string(&rest[1..], first)?;
+            items.push(ContentItem::Text(text));
+            rest = after;
+        } else {
+            let len = rest
+                .find(|c: char| c.is_whitespace() || c == '(')
+                .unwrap_or(rest.len());
+            let (name, after) = rest.split_at(len);
+            if let Some(call) = after.strip_prefix('(') {
+                let close = call.find(')')?;
+                let args: Vec<&str> = call[..close].split(',').map(str::trim).collect();
+                items.push(match (name, args.as_slice()) {
+                    ("attr", [attr]) => ContentItem::Attr(attr.to_ascii_lowercase()),
+                    ("counter", [counter]) => ContentItem::Counter {
+                        name: counter.to_string(),
+                        style: CounterStyle::Decimal,
+                    },
+                    ("counter", [counter, style]) => ContentItem::Counter {
+                        name: counter.to_string(),
+                        style: CounterStyle::from_css(style)?,
+                    },
+                    ("counters", [counter, separator]) => ContentItem::Counters {
+                        name: counter.to_string(),
+                        separator: parse_quoted(separator)?,
+                        style: CounterStyle::Decimal,
+                    },
+                    ("counters", [counter, separator, style]) => ContentItem::Counters {
+                        name: counter.to_string(),
+                        separator: parse_quoted(separator)?,
+                        style: CounterStyle::from_css(style)?,
+                    },
+                    _ => return None,
+                });
+                rest = &call[close + 1..];
+            } else {
+                let quote = match name {
+                    "open-quote" => "\u{201C}",
+                    "close-quote" => "\u{201D}",
+                    _ => return None,
+                };
+                items.push(ContentItem::Text(quote.to_string()));
+                rest = after;
+            }
+        }
+        rest = rest.trim_start();
+    }
+    Some(items)
+}
+
+/// A whole quoted CSS string, such as a `counters()` separator.
+fn parse_quoted(s: &str) -> Option<String> {
+    let quote = s.chars().next().filter(|c| *c == '"' || *c == '\'')?;
+    match parse_css_string(&s[1..], quote)? {
+        (text, "") => Some(text),
+        _ => None,
+    }
+}
+
+/// Read a CSS string up to its closing `quote`, resolving `\` escapes
+/// (`\201C` hex code points included).  Returns the text and what follows.
+fn parse_css_string(s: &str, quote: char) -> Option<(String, &str)> {
+    let mut out = String::new();
+    let mut chars = s.char_indices().peekable();
+    while let Some((i, c)) = chars.next() {
+        if c == quote {
+            return Some((out, &s[i + 1..]));
+        }
+        if c != '\\' {
+            out.push(c);
+            continue;
+        }
+        let mut code = String::new();
+        while let Some(&(_, h)) = chars.peek() {
+            if !h.is_ascii_hexdigit() || code.len() == 6 {
+                break;
+            }
+            code.push(h);
+            chars.next();
+        }
+        if code.is_empty() {
+            out.extend(chars.next().map(|(_, escaped)| escaped));
+        } else {
+            out.extend(u32::from_str_radix(&code, 16).ok().and_then(char::from_u32));
+            // One space after a hex escape only ends it.
+            if chars.peek().is_some_and(|&(_, c)| c == ' ') {
+                chars.next();
+            }
+        }
+    }
+    None
+}
+
+/// Parse a `counter-reset` / `counter-increment` list (`a 2 b`); counters
+/// without a number get `default`.
+fn parse_counters(val: &str, default: i32) -> Vec<(String, i32)> {
+    let mut counters: Vec<(String, i32)> = Vec::new();
+    for token in val.split_whitespace() {
+        match (token.parse::<i32>(), counters.last_mut()) {
+            (Ok(n), Some(last)) => last.1 = n,
+            (Ok(_), None) => {}
+            _ if token == "none" => {}
+            _ => counters.push((token.to_string(), default)),
+        }
+    }
+    counters
+}
+
+/// Split `val` at `sep` characters outside parentheses, dropping empty parts.
+fn split_outside_parens(val: &str, sep: impl Fn(char) -> bool) -> Vec<&str> {
+    let mut parts = Vec::new();
+    let (mut depth, mut start) = (0usize, 0);
+    for (i, c) in val.char_indices() {
+        match c {
+            '(' => depth += 1,
+            ')' => depth = depth.saturating_sub(1),
+            c if depth == 0 && sep(c) => {
+                parts.push(&val[start..i]);
+                start = i + c.len_utf8();
+            }
+            _ => {}
+        }
+    }
+    parts.push(&val[start..]);
+    parts.into_iter().map(str::trim).filter(|p| !p.is_empty()).collect()
+}
+
+/// Parse a `transform` function list (`rotate(45deg) scale(2)`) into one
+/// matrix.  Percentages and font-relative lengths are not supported.
+fn parse_transform(val: &str) -> Option<[f32; 6]> {
+    let mut matrix = [1.0, 0.0, 0.0, 1.0, 0.0, 0.0];
+    let mut rest = val.trim();
+    while !rest.is_empty() {
+        let open = rest.find('(')?;
+        let close = open + rest[open..].find(')')?;
+        let name = rest[..open].trim().to_ascii_lowercase();
+        let args: Vec<&str> = rest[open + 1..close].split(',').map(str::trim).collect();
+        matrix = multiply_transforms(matrix, transform_function(&name, &args)?);
+        rest = rest[close + 1..].trim_start();
+    }
+    Some(matrix)
+}
+
+fn transform_function(name: &str, args: &[&str]) -> Option<[f32; 6]> {
+    let numbers = || -> Option<Vec<f32>> { args.iter().map(|a| a.parse().ok()).collect() };
+    let lengths = || -> Option<Vec<f32>> { args.iter().map(|a| parse_px(a)).collect() };
+    let angles = || -> Option<Vec<f32>> { args.iter().map(|a| parse_angle(a)).collect() };
+    let m = match (name, args.len()) {
+        ("rotate" | "rotatez", 1) => {
+            let (sin, cos) = angles()?[0].sin_cos();
+            [cos, sin, -sin, cos, 0.0, 0.0]
+        }
+        ("scale", 1 | 2) => {
+            let v = numbers()?;
+            [v[0], 0.0, 0.0, *v.last()?, 0.0, 0.0]
+        }
+        ("scalex", 1) => [numbers()?[0], 0.0, 0.0, 1.0, 0.0, 0.0],
+        ("scaley", 1) => [1.0, 0.0, 0.0, numbers()?[0], 0.0, 0.0],
+        ("translate", 1 | 2) => {
+            let v = lengths()?;
+            [1.0, 0.0, 0.0, 1.0, v[0], v.get(1).copied().unwrap_or(0.0)]
+        }
+        ("translatex", 1) => [1.0, 0.0, 0.0, 1.0, lengths()?[0], 0.0],
+        ("translatey", 1) => [1.0, 0.0, 0.0, 1.0, 0.0, lengths()?[0]],
+        ("skew", 1 | 2) => {
+            let v = angles()?;
+            let ay = v.get(1).copied().unwrap_or(0.0);
+            [1.0, ay.tan(), v[0].tan(), 1.0, 0.0, 0.0]
+        }
+        ("skewx", 1) => [1.0, 0.0, angles()?[0].tan(), 1.0, 0.0, 0.0],
+        ("skewy", 1) => [1.0, angles()?[0].tan(), 0.0, 1.0, 0.0, 0.0],
+        ("matrix", 6) => {
+            let v = numbers()?;
+            [v[0], v[1], v[2], v[3], v[4], v[5]]
+        }
+        _ => return None,
+    };
+    Some(m)
+}
+
+/// `left × right`: `right` is applied first, as in a CSS function list.
+fn multiply_transforms(l: [f32; 6], r: [f32; 6]) -> [f32; 6] {
+    [
+        l[0] * r[0] + l[2] * r[1],
+        l[1] * r[0] + l[3] * r[1],
+        l[0] * r[2] + l[2] * r[3],
+        l[1] * r[2] + l[3] * r[3],
+        l[0] * r[4] + l[2] * r[5] + l[4],
+        l[1] * r[4] + l[3] * r[5] + l[5],
+    ]
+}
+
+/// A single `{n}px` or `{n}%` radius; per-corner and elliptical
+/// (`a / b`) radii are not supported.
+fn parse_radius(val: &str) -> Option<Radius> {
+    let val = val.trim();
+    match val.strip_suffix('%') {
+        Some(p) => p.trim().parse().ok().map(Radius::Percent),
+        None => parse_px(val).map(Radius::Length),
+    }
+}
+
+/// The address in `url(…)`, with any quotes removed.
+fn parse_url(val: &str) -> Option<String> {
+    let inner = val.strip_prefix("url(")?.strip_suffix(')')?.trim();
+    let unquoted = ['"', '\'']
+        .iter()
+        .find_map(|&q| inner.strip_prefix(q)?.strip_suffix(q))
+        .unwrap_or(inner);
+    (!unquoted.is_empty()).then(|| unquoted.to_string())
+}
+
+/// Parse `inset(t [r [b [l]]] [round r])` or `circle([r] [at center])`.
+/// CSS `filter` as a list of the functions applied to images:
+/// `grayscale()`, `brightness()`, `contrast()` and `opacity()`, each with a
+/// number or percentage (1 when left out).  `None` if anything else is used.
+fn parse_filter(val: &str) -> Option<Vec<ImageFilter>> {
+    let mut filter = Vec::new();
+    let mut rest = val.trim();
+    while !rest.is_empty() {
+        let open = rest.find('(')?;
+        let close = open + rest[open..].find(')')?;
+        let arg = rest[open + 1..close].trim();
+        let amount = match arg.strip_suffix('%') {
+            _ if arg.is_empty() => 1.0,
+            Some(percent) => percent.trim().parse::<f32>().ok()? / 100.0,
+            None => arg.parse::<f32>().ok()?,
+        };
+        if amount.is_nan() || amount < 0.0 {
+            return None;
+        }
+        filter.push(match rest[..open].trim() {
+            "grayscale" => ImageFilter::Grayscale(amount),
+            "brightness" => ImageFilter::Brightness(amount),
+            "contrast" => ImageFilter::Contrast(amount),
+            "opacity" => ImageFilter::Opacity(amount),
+            _ => return None,
+        });
+        rest = rest[close + 1..].trim_start();
+    }
+    (!filter.is_empty()).then_some(filter)
+}
+
+fn parse_clip_path(val: &str) -> Option<ClipPath> {
+    let val = val.trim();
+    let open = val.find('(')?;
+    let args = val[open + 1..].strip_suffix(')')?;
+    let mut words = args.split_whitespace();
+    match val[..open].trim() {
+        "inset" => {
+            let insets: Vec<&str> = words.by_ref().take_while(|w| *w != "round").collect();
+            let insets: Vec<f32> = insets.iter().map(|w| parse_px(w)).collect::<Option<_>>()?;
+            let [top, right, bottom, left] = match insets[..] {
+                [a] => [a, a, a, a],
+                [a, b] => [a, b, a, b],
+                [a, b, c] => [a, b, c, b],
+                [a, b, c, d] => [a, b, c, d],
+                _ => return None,
+            };
+            let round = match words.next() {
+                Some(r) => Some(parse_radius(r)?),
+                None => None,
+            };
+            words.next().is_none().then_some(ClipPath::Inset {
+                top,
+                right,
+                bottom,
+                left,
+                round,
+            })
+        }
+        "circle" => {
+            let words: Vec<&str> = words.collect();
+            let at = words.iter().position(|w| *w == "at").unwrap_or(words.len());
+            if !matches!(words[at..], [] | ["at", "center"]) {
+                return None;
+            }
+            let radius = match words[..at] {
+                [] | ["closest-side"] => None,
+                [r] => Some(parse_radius(r)?),
+                _ => return None,
+            };
+            Some(ClipPath::Circle { radius })
+        }
+        _ => None,
+    }
+}
+
+/// An angle in radians from `deg`, `rad`, `grad`, `turn` or a bare `0`.
+fn parse_angle(s: &str) -> Option<f32> {
+    let s = s.trim();
+    let units = [
+        ("deg", std::f32::consts::PI / 180.0),
+        ("grad", std::f32::consts::PI / 200.0),
+        ("rad", 1.0),
+        ("turn", std::f32::consts::TAU),
+    ];
+    for (unit, factor) in units {
+        if let Some(num) = s.strip_suffix(unit) {
+            return num.trim().parse::<f32>().ok().map(|v| v * factor);
+        }
+    }
+    (s == "0").then_some(0.0)
+}
+
 fn parse_dimension(s: &str) -> Dimension {
     let s = s.trim();
     if s == "auto" {
@@ -901,6 +2631,75 @@ fn apply_shorthand_spacing(
     }
 }
 
+// ---------------------------------------------------------------------------
+// Page margins
+// ---------------------------------------------------------------------------
+
+/// Resolve the margins set by `sheet`'s `@page` rules for each page
+/// position, starting from a uniform `default` margin.  The first page is a
+/// right page, so `:right` rules apply to it below any `:first` rule.
+pub fn resolve_page_margins(sheet: &Stylesheet, default: f32) -> PageMargins {
+    let rules = sheet.page_rules();
+    let resolve = |applies: &dyn Fn(PageSelector) -> bool| {
+        let mut margins = Margins::uniform(default);
+        for important in [false, true] {
+            for rule in rules.iter().filter(|r| applies(r.selector)) {
+                let declarations = rule.declarations.iter();
+                for decl in declarations.filter(|d| d.important == important) {
+                    apply_page_property(&mut margins, &decl.property, &decl.value);
+                }
+            }
+        }
+        margins
+    };
+    PageMargins {
+        base: resolve(&|s| s == PageSelector::All),
+        first: resolve(&|s| s != PageSelector::Left),
+        left: resolve(&|s| matches!(s, PageSelector::All | PageSelector::Left)),
+        right: resolve(&|s| matches!(s, PageSelector::All | PageSelector::Right)),
+    }
+}
+
+fn apply_page_property(margins: &mut Margins, property: &str, value: &str) {
+    let side = match property {
+        "margin" => {
+            let parts: Vec<f32> = value.split_whitespace().filter_map(media_length).collect();
+            let (top, right, bottom, left) = match parts[..] {
+                [all] => (all, all, all, all),
+                [vertical, horizontal] => (vertical, horizontal, vertical, horizontal),
+                [top, horizontal, bottom] => (top, horizontal, bottom, horizontal),
+                [top, right, bottom, left] => (top, right, bottom, left),
+                _ => {
+                    diagnostics::warn("css", format!("Ignoring invalid @page margin `{value}`"));
+                    return;
+                }
+            };
+            *margins = Margins {
+                top,
+                right,
+                bottom,
+                left,
+            };
+            return;
+        }
+        "margin-top" => &mut margins.top,
+        "margin-right" => &mut margins.right,
+        "margin-bottom" => &mut margins.bottom,
+        "margin-left" => &mut margins.left,
+        _ => {
+            diagnostics::warn(
+                "css",
+                format!("Ignoring unsupported @page property `{property}`"),
+            );
+            return;
+        }
+    };
+    match media_length(value.trim()) {
+        Some(length) => *side = length,
+        None => diagnostics::warn("css", format!("Ignoring invalid @page margin `{value}`")),
+    }
+}
+
 // ---------------------------------------------------------------------------
 // Styled DOM tree
 // ---------------------------------------------------------------------------
@@ -926,12 +2725,283 @@ pub fn build_styled_tree(
     nodes: &[DomNode],
     parent_style: Option<&ComputedStyle>,
 ) -> Vec<StyledNode> {
+    let sheet = Stylesheet::default();
+    let mut counters = Counters::default();
+    build_styled_nodes(nodes, parent_style, &sheet, &mut Vec::new(), &mut counters)
+}
+
+/// Build the styled tree for a whole parsed document, applying `sheet`.
+///
+/// Like [`crate::dom::body_children`], only the `<body>` contents are
+/// returned; the body's own resolved style is used as the root parent so
+/// rules such as `body { color: … }` are inherited.
+///
+/// A bare fragment (`<p>…</p>` with no `<body>`) is treated as the content
+/// of an implicit `<html><body>`, so it gets the same defaults and `html` /
+/// `body` rules as a full document.
+pub fn build_document_tree(dom: &[DomNode], sheet: &Stylesheet) -> Vec<StyledNode> {
+    let mut ancestors = Vec::new();
+    let mut counters = Counters::default();
+    if let Some(body) = find_body(dom, &mut ancestors) {
+        let root = resolve_style_with_sheet(body, None, sheet, &ancestors);
+        counters.apply(&root, ancestors.len());
+        ancestors.push(body);
+        return build_styled_nodes(
+            &body.children,
+            Some(&root),
+            sheet,
+            &mut ancestors,
+            &mut counters,
+        );
+    }
+
+    let html = ElementNode::new(Tag::Html);
+    let body = ElementNode::new(Tag::Body);
+    let mut ancestors = vec![&html];
+    let root = resolve_style_with_sheet(&body, None, sheet, &ancestors);
+    counters.apply(&root, ancestors.len());
+    ancestors.push(&body);
+    build_styled_nodes(dom, Some(&root), sheet, &mut ancestors, &mut counters)
+}
+
+/// Drop the backgrounds of elements styled `print-color-adjust: economy`,
+/// as a browser printing without "background graphics" does.
+pub fn drop_economy_backgrounds(nodes: &mut [StyledNode]) {
+    for node in nodes {
+        if let StyledNode::Element {
+            style, children, ..
+        } = node
+        {
+            if style.print_color_adjust == PrintColorAdjust::Economy {
+                style.background_color = Color::TRANSPARENT;
+                style.background_gradient = None;
+                style.background_image = None;
+            }
+            drop_economy_backgrounds(children);
+        }
+    }
+}
+
+/// Raise every font size below `min` to it, for
+/// `PipelineConfig::min_font_size`.
+pub fn enforce_min_font_size(nodes: &mut [StyledNode], min: f32) {
+    for node in nodes {
+        match node {
+            StyledNode::Element {
+                style, children, ..
+            } => {
+                raise_font_size(style, min);
+                enforce_min_font_size(children, min);
+            }
+            StyledNode::Text { style, .. } => raise_font_size(style, min),
+        }
+    }
+}
+
+/// Raise `style`'s font size to `min`, growing a fixed line height with it.
+fn raise_font_size(style: &mut ComputedStyle, min: f32) {
+    if style.font_size < min {
+        if let LineHeight::Px(px) = style.line_height {
+            style.line_height = LineHeight::Px(px * min / style.font_size.max(f32::EPSILON));
+        }
+        style.font_size = min;
+    }
+}
+
+/// Locate `<body>` at the top level or inside `<html>`, recording the
+/// elements passed on the way in `ancestors`.
+fn find_body<'a>(
+    nodes: &'a [DomNode],
+    ancestors: &mut Vec<&'a ElementNode>,
+) -> Option<&'a ElementNode> {
+    for node in nodes {
+        if let DomNode::Element(e) = node {
+            if e.tag == Tag::Body {
+                return Some(e);
+            }
+            if e.tag == Tag::Html {
+                ancestors.push(e);
+                if let Some(body) = find_body(&e.children, ancestors) {
+                    return Some(body);
+                }
+                ancestors.pop();
+            }
+        }
+    }
+    None
+}
+
+/// CSS counters in scope while the styled tree is built, innermost last.
+/// A `counter-reset` stays in scope for the element's descendants and
+/// following siblings, so [`build_styled_nodes`] drops the counters created
+/// by a sibling list once it is done with it.
+#[derive(Debug, Default)]
+struct Counters(Vec<Counter>);
+
+#[derive(Debug)]
+struct Counter {
+    name: String,
+    value: i32,
+    /// Tree depth of the element that created the counter.
+    depth: usize,
+}
+
+impl Counters {
+    /// Apply the `counter-reset`, then the `counter-increment`, of `style`
+    /// on an element `depth` levels down.  Resetting a counter a sibling
+    /// created sets it again rather than nesting a new one, and
+    /// incrementing a counter that is not in scope creates it at 0 first.
+    fn apply(&mut self, style: &ComputedStyle, depth: usize) {
+        for (name, value) in &style.counter_reset {
+            match self.0.iter_mut().rev().find(|c| c.name == *name) {
+                Some(counter) if counter.depth == depth => counter.value = *value,
+                _ => self.0.push(Counter {
+                    name: name.clone(),
+                    value: *value,
+                    depth,
+                }),
+            }
+        }
+        for (name, step) in &style.counter_increment {
+            match self.0.iter_mut().rev().find(|c| c.name == *name) {
+                Some(counter) => counter.value += step,
+                None => self.0.push(Counter {
+                    name: name.clone(),
+                    value: *step,
+                    depth,
+                }),
+            }
+        }
+    }
+
+    fn value(&self, name: &str) -> i32 {
+        self.0
+            .iter()
+            .rev()
+            .find(|c| c.name == name)
+            .map_or(0, |c| c.value)
+    }
+
+    /// `counters(name, separator, style)`: 0 when none is in scope.
+    fn join(&self, name: &str, separator: &str, style: CounterStyle) -> String {
+        let values: Vec<String> = self
+            .0
+            .iter()
+            .filter(|c| c.name == name)
+            .map(|c| style.format(c.value))
+            .collect();
+        if values.is_empty() {
+            style.format(0)
+        } else {
+            values.join(separator)
+        }
+    }
+}
+
+/// The `pseudo` box of `element` with its generated text, if a rule gives
+/// it content: a text node when it is inline, otherwise a `span` box.
+fn generated_content(
+    element: &ElementNode,
+    pseudo: PseudoElement,
+    style: &ComputedStyle,
+    sheet: &Stylesheet,
+    ancestors: &[&ElementNode],
+    counters: &mut Counters,
+) -> Option<StyledNode> {
+    let pseudo_style = resolve_pseudo_style(element, pseudo, style, sheet, ancestors)?;
+    counters.apply(&pseudo_style, ancestors.len() + 1);
+    let text: String = pseudo_style
+        .content
+        .iter()
+        .map(|item| match item {
+            ContentItem::Text(text) => text.clone(),
+            ContentItem::Attr(name) => element.attributes.get(name).cloned().unwrap_or_default(),
+            ContentItem::Counter { name, style } => style.format(counters.value(name)),
+            ContentItem::Counters {
+                name,
+                separator,
+                style,
+            } => counters.join(name, separator, *style),
+        })
+        .collect();
+    let text_node = (!text.is_empty()).then(|| StyledNode::Text {
+        text,
+        style: inline_text_style(pseudo_style.clone()),
+    });
+    if pseudo_style.display == Display::Inline {
+        return text_node;
+    }
+    Some(StyledNode::Element {
+        tag: Tag::Span,
+        style: pseudo_style,
+        children: text_node.into_iter().collect(),
+        attrs: HashMap::new(),
+    })
+}
+
+/// `style` for a text node: text renders inline, so the box-model
+/// properties that must not be inherited (border, background, spacing)
+/// are cleared.
+fn inline_text_style(mut style: ComputedStyle) -> ComputedStyle {
+    style.border_width = 0.0;
+    style.background_color = Color {
+        r: 0.0,
+        g: 0.0,
+        b: 0.0,
+        a: 0.0,
+    };
+    style.background_gradient = None;
+    style.background_image = None;
+    style.margin_top = 0.0;
+    style.margin_right = 0.0;
+    style.margin_bottom = 0.0;
+    style.margin_left = 0.0;
+    style.padding_top = 0.0;
+    style.padding_right = 0.0;
+    style.padding_bottom = 0.0;
+    style.padding_left = 0.0;
+    style
+}
+
+fn build_styled_nodes<'a>(
+    nodes: &'a [DomNode],
+    parent_style: Option<&ComputedStyle>,
+    sheet: &Stylesheet,
+    ancestors: &mut Vec<&'a ElementNode>,
+    counters: &mut Counters,
+) -> Vec<StyledNode> {
+    let scope = counters.0.len();
     let mut result = Vec::new();
     for node in nodes {
         match node {
             DomNode::Element(e) => {
-                let style = resolve_style(e, parent_style);
-                let children = build_styled_tree(&e.children, Some(&style));
+                let style = resolve_style_with_sheet(e, parent_style, sheet, ancestors);
+                // `display: none` removes the element and its subtree entirely,
+                // as does `visibility: collapse` on a table row.
+                let collapsed = style.visibility == Visibility::Collapse
+                    && style.display == Display::TableRow;
+                if style.display == Display::None || collapsed {
+                    continue;
+                }
+                if !style.filter.is_empty() && e.tag != Tag::Img {
+                    diagnostics::warn(
+                        "css",
+                        format!("Not rendering `filter` on <{}>, only on images", e.tag.name()),
+                    );
+                }
+                counters.apply(&style, ancestors.len());
+                let before =
+                    generated_content(e, PseudoElement::Before, &style, sheet, ancestors, counters);
+                ancestors.push(e);
+                let mut children =
+                    build_styled_nodes(&e.children, Some(&style), sheet, ancestors, counters);
+                ancestors.pop();
+                let after =
+                    generated_content(e, PseudoElement::After, &style, sheet, ancestors, counters);
+                if let Some(before) = before {
+                    children.insert(0, before);
+                }
+                children.extend(after);
                 result.push(StyledNode::Element {
                     tag: e.tag.clone(),
                     style,
@@ -940,34 +3010,18 @@ pub fn build_styled_tree(
                 });
             }
             DomNode::Text(text) => {
-                let trimmed = text.trim();
-                if !trimmed.is_empty() {
-                    let mut style = parent_style.cloned().unwrap_or_default();
-                    // Text nodes render inline — clear all box-model properties
-                    // that must not be inherited (border, background, spacing).
-                    style.border_width = 0.0;
-                    style.background_color = Color {
-                        r: 0.0,
-                        g: 0.0,
-                        b: 0.0,
-                        a: 0.0,
-                    };
-                    style.margin_top = 0.0;
-                    style.margin_right = 0.0;
-                    style.margin_bottom = 0.0;
-                    style.margin_left = 0.0;
-                    style.padding_top = 0.0;
-                    style.padding_right = 0.0;
-                    style.padding_bottom = 0.0;
-                    style.padding_left = 0.0;
+                let style = parent_style.cloned().unwrap_or_default();
+                // Whitespace-only text is significant where spaces are kept.
+                if !text.trim().is_empty() || style.white_space.preserves_spaces() {
                     result.push(StyledNode::Text {
                         text: text.clone(),
-                        style,
+                        style: inline_text_style(style),
                     });
                 }
             }
         }
     }
+    counters.0.truncate(scope);
     result
 }
 
@@ -983,6 +3037,15 @@ mod tests {
         assert_eq!(s.padding_left, 16.0);
     }
 
+    #[test]
+    fn tailwind_grid_cols_are_clamped() {
+        let mut s = ComputedStyle::default();
+        apply_tailwind_class(&mut s, "grid-cols-3");
+        assert_eq!(s.grid_template_columns.len(), 3);
+        apply_tailwind_class(&mut s, "grid-cols-1000000000");
+        assert_eq!(s.grid_template_columns.len(), MAX_GRID_COLUMNS);
+    }
+
     #[test]
     fn inline_style_font_size() {
         let mut s = ComputedStyle::default();
@@ -991,10 +3054,302 @@ mod tests {
         assert!((s.color.r - 1.0).abs() < 0.01);
     }
 
+    #[test]
+    fn stylesheet_cascade_order() {
+        let dom = crate::dom::parse_html(
+            r#"<body><p class="text-center font-bold" style="font-size: 10px">Hi</p></body>"#,
+        );
+        let mut sheet = Stylesheet::parse(
+            "p { text-align: right; font-weight: normal } body .font-bold { font-weight: normal } \
+             p { font-size: 30px !important }",
+        );
+        sheet.append("p { font-size: 12px; color: #00ff00 }", Origin::Extra);
+        let styled = build_document_tree(&dom, &sheet);
+        match &styled[0] {
+            StyledNode::Element { style, .. } => {
+                // The type rule loses to the Tailwind class ...
+                assert_eq!(style.text_align, TextAlign::Center);
+                // ... but a more specific author rule beats it.
+                assert_eq!(style.font_weight, FontWeight::Normal);
+                // !important beats inline style and extra CSS.
+                assert_eq!(style.font_size, 30.0);
+                assert!((style.color.g - 1.0).abs() < 0.01);
+            }
+            _ => panic!("Expected element"),
+        }
+    }
+
+    #[test]
+    fn fragment_inherits_body_rules() {
+        let dom = crate::dom::parse_html("<p>Snippet</p>");
+        let sheet = Stylesheet::parse("body { color: #ff0000 } html body p { font-size: 20px }");
+        match &build_document_tree(&dom, &sheet)[0] {
+            StyledNode::Element { style, .. } => {
+                assert!((style.color.r - 1.0).abs() < 0.01);
+                assert_eq!(style.font_size, 20.0);
+            }
+            _ => panic!("Expected element"),
+        }
+    }
+
+    #[test]
+    fn pseudo_elements_generate_counters_attributes_and_strings() {
+        let dom = crate::dom::parse_html(
+            r#"<body><h2 data-tag="A">One</h2><h2>Two</h2><ol><li>x</li><li>y</li></ol></body>"#,
+        );
+        let sheet = Stylesheet::parse(
+            "body { counter-reset: section } \
+             h2::before { counter-increment: section; content: counter(section, upper-roman) '. ' } \
+             h2::after { content: ' [' attr(data-tag) ']'; display: block } \
+             li::after { content: \"\\2014 \" counter(list-item) }",
+        );
+        let texts = |node: &StyledNode| match node {
+            StyledNode::Element { children, .. } => children
+                .iter()
+                .map(|c| match c {
+                    StyledNode::Text { text, .. } => text.clone(),
+                    StyledNode::Element { tag, children, .. } => match &children[..] {
+                        [StyledNode::Text { text, .. }] => format!("<{}>{text}", tag.name()),
+                        _ => format!("<{}>", tag.name()),
+                    },
+                })
+                .collect::<Vec<_>>(),
+            _ => panic!("Expected element"),
+        };
+        let styled = build_document_tree(&dom, &sheet);
+        assert_eq!(texts(&styled[0]), vec!["I. ", "One", "<span> [A]"]);
+        assert_eq!(texts(&styled[1]), vec!["II. ", "Two", "<span> []"]);
+        let items: Vec<Vec<String>> = match &styled[2] {
+            StyledNode::Element { children, .. } => children.iter().map(texts).collect(),
+            _ => panic!("Expected list"),
+        };
+        assert_eq!(items, vec![vec!["x", "\u{2014}1"], vec!["y", "\u{2014}2"]]);
+    }
+
+    #[test]
+    fn nested_counters_number_headings_hierarchically() {
+        let dom = crate::dom::parse_html(
+            "<body><section><h2>Intro</h2><div class=\"sub\">\
+             <section><h2>Scope</h2></section><section><h2>Terms</h2></section>\
+             </div></section><section><h2>Usage</h2></section></body>",
+        );
+        let sheet = Stylesheet::parse(
+            "body, .sub { counter-reset: section } \
+             section { counter-increment: section } \
+             h2::before { content: counters(section, \".\") ' ' }",
+        );
+        fn numbers(nodes: &[StyledNode], out: &mut Vec<String>) {
+            for node in nodes {
+                if let StyledNode::Element { tag, children, .. } = node {
+                    match (tag, children.first()) {
+                        (Tag::H2, Some(StyledNode::Text { text, .. })) => out.push(text.clone()),
+                        _ => numbers(children, out),
+                    }
+                }
+            }
+        }
+        let mut out = Vec::new();
+        numbers(&build_document_tree(&dom, &sheet), &mut out);
+        assert_eq!(out, vec!["1 ", "1.1 ", "1.2 ", "2 "]);
+    }
+
+    #[test]
+    fn line_height_numbers_inherit_as_factors_and_lengths_as_computed() {
+        let dom = crate::dom::parse_html(
+            "<body><div style=\"line-height: 1.5\"><p>unitless</p></div>\
+             <div style=\"line-height: 150%\"><p>percent</p></div>\
+             <div style=\"line-height: 24px\"><p>px</p></div>\
+             <div style=\"line-height: 150%; font-size: 20px\"><p>late</p></div></body>",
+        );
+        let sheet = Stylesheet::parse("div { font-size: 16px } p { font-size: 20px }");
+        let styled = build_document_tree(&dom, &sheet);
+        let leading: Vec<(f32, f32)> = styled
+            .iter()
+            .filter_map(|node| match node {
+                StyledNode::Element {
+                    style, children, ..
+                } => match children.first() {
+                    Some(StyledNode::Element { style: p, .. }) => {
+                        Some((style.line_height.px(style.font_size), p.line_height.px(p.font_size)))
+                    }
+                    _ => None,
+                },
+                _ => None,
+            })
+            .collect();
+        // The paragraph at 20px keeps the factor, but inherits a length.
+        assert_eq!(leading, [(24.0, 30.0), (24.0, 24.0), (24.0, 24.0), (30.0, 30.0)]);
+    }
+
+    #[test]
+    fn background_shorthand_sets_image_position_size_and_repeat() {
+        let mut s = ComputedStyle::default();
+        apply_inline_style(
+            &mut s,
+            "background: #eee url('data:image/png;base64,iV/bo+') no-repeat center / cover",
+        );
+        assert_eq!(s.background_image.as_deref(), Some("data:image/png;base64,iV/bo+"));
+        assert_eq!(s.background_color, Color::from_hex("#eee").unwrap());
+        assert_eq!(s.background_size, BackgroundSize::Cover);
+        assert_eq!(s.background_position, [BackgroundLength::Percent(50.0); 2]);
+        assert_eq!(s.background_repeat, BackgroundRepeat::NoRepeat);
+
+        apply_inline_style(
+            &mut s,
+            "background-position: right 20px; background-size: 50% auto; \
+             background-repeat: repeat no-repeat",
+        );
+        use BackgroundLength::{Length, Percent};
+        assert_eq!(s.background_position, [Percent(100.0), Length(20.0)]);
+        let half = BackgroundSize::Explicit {
+            width: Some(Percent(50.0)),
+            height: None,
+        };
+        assert_eq!(s.background_size, half);
+        assert_eq!(s.background_repeat, BackgroundRepeat::RepeatX);
+
+        // A gradient replaces the image, and the shorthand resets the rest.
+        apply_inline_style(&mut s, "background: linear-gradient(#fff, #000)");
+        assert!(s.background_image.is_none() && s.background_gradient.is_some());
+        assert_eq!(s.background_repeat, BackgroundRepeat::Repeat);
+    }
+
+    #[test]
+    fn unsupported_effects_are_reported() {
+        let ((), warnings) = diagnostics::collect(|| {
+            let mut s = ComputedStyle::default();
+            apply_inline_style(&mut s, "filter: blur(4px); mix-blend-mode: normal");
+        });
+        let messages: Vec<&str> = warnings.iter().map(|d| d.message.as_str()).collect();
+        assert_eq!(messages, ["Not rendering unsupported `filter: blur(4px)`"]);
+    }
+
+    #[test]
+    fn border_radius_and_clip_path_shapes_parse() {
+        let mut s = ComputedStyle::default();
+        let css = "border-radius: 50%; clip-path: inset(4px 8px round 6px)";
+        apply_inline_style(&mut s, css);
+        assert_eq!(s.border_radius, Some(Radius::Percent(50.0)));
+        assert_eq!(
+            s.clip_path,
+            Some(ClipPath::Inset {
+                top: 4.0,
+                right: 8.0,
+                bottom: 4.0,
+                left: 8.0,
+                round: Some(Radius::Length(6.0)),
+            })
+        );
+        apply_inline_style(&mut s, "border-radius: 0; clip-path: circle(40px)");
+        assert_eq!(s.border_radius, None);
+        let circle = ClipPath::Circle {
+            radius: Some(Radius::Length(40.0)),
+        };
+        assert_eq!(s.clip_path, Some(circle));
+        let ((), warnings) = diagnostics::collect(|| {
+            apply_inline_style(&mut s, "clip-path: circle(10px at left top)");
+        });
+        assert_eq!(warnings.len(), 1);
+        assert_eq!(s.clip_path, Some(circle));
+    }
+
     #[test]
     fn color_from_hex() {
         let c = Color::from_hex("#ff8800").unwrap();
         assert!((c.r - 1.0).abs() < 0.01);
         assert!((c.g - 0.533).abs() < 0.01);
     }
+
+    #[test]
+    fn shadow_lists_parse_offsets_blur_spread_and_colour() {
+        let mut s = ComputedStyle::default();
+        apply_inline_style(
+            &mut s,
+            "color: #ff0000; box-shadow: 0 4px 6px -1px rgba(0, 0, 0, 0.1), 2px 2px; \
+             text-shadow: 1px 1px 2px #333",
+        );
+        assert_eq!(
+            s.box_shadow,
+            vec![
+                Shadow {
+                    offset_x: 0.0,
+                    offset_y: 4.0,
+                    blur: 6.0,
+                    spread: -1.0,
+                    color: [0.0, 0.0, 0.0, 0.1],
+                },
+                Shadow {
+                    offset_x: 2.0,
+                    offset_y: 2.0,
+                    blur: 0.0,
+                    spread: 0.0,
+                    color: [1.0, 0.0, 0.0, 1.0],
+                },
+            ]
+        );
+        assert_eq!(s.text_shadow.len(), 1);
+        assert_eq!(s.text_shadow[0].blur, 2.0);
+
+        // Text shadows take no spread; inset shadows are unsupported.
+        apply_inline_style(&mut s, "text-shadow: 1px 1px 2px 3px #333; box-shadow: inset 0 1px red");
+        assert_eq!(s.text_shadow.len(), 1);
+        assert_eq!(s.box_shadow.len(), 2);
+        apply_inline_style(&mut s, "box-shadow: none");
+        assert!(s.box_shadow.is_empty());
+    }
+
+    #[test]
+    fn transform_functions_compose_left_to_right() {
+        let mut s = ComputedStyle::default();
+        apply_inline_style(&mut s, "transform: translate(10px, 5px) rotate(90deg) scale(2)");
+        let m = s.transform.unwrap();
+        let expected = [0.0, 2.0, -2.0, 0.0, 10.0, 5.0];
+        for (got, want) in m.iter().zip(expected) {
+            assert!((got - want).abs() < 1e-5, "{m:?}");
+        }
+        apply_inline_style(&mut s, "transform: none");
+        assert!(s.transform.is_none());
+        apply_inline_style(&mut s, "transform: translate(50%)");
+        assert!(s.transform.is_none());
+    }
+
+    #[test]
+    fn gradients_resolve_directions_and_stop_positions() {
+        let mut s = ComputedStyle::default();
+        apply_inline_style(
+            &mut s,
+            "background: linear-gradient(to right, #ff0000, #00ff00 30%, #0000ff, #000 90%)",
+        );
+        let g = s.background_gradient.clone().unwrap();
+        let GradientShape::Linear { angle } = g.shape else {
+            panic!("{:?}", g.shape);
+        };
+        assert!((angle - 90.0).abs() < 1e-4);
+        let offsets: Vec<f32> = g.stops.iter().map(|stop| stop.offset).collect();
+        for (got, want) in offsets.iter().zip([0.0, 0.3, 0.6, 0.9, 1.0]) {
+            assert!((got - want).abs() < 1e-5, "{offsets:?}");
+        }
+        assert_eq!(offsets.len(), 5);
+        assert_eq!(g.stops[4].color, [0.0, 0.0, 0.0, 1.0]);
+
+        apply_inline_style(
+            &mut s,
+            "background-image: radial-gradient(circle, #fff, #000)",
+        );
+        let g = s.background_gradient.clone().unwrap();
+        assert_eq!(g.shape, GradientShape::Radial { circle: true });
+        apply_inline_style(
+            &mut s,
+            "background-image: linear-gradient(to top left, #fff, #000)",
+        );
+        assert_eq!(
+            s.background_gradient.clone().unwrap().shape,
+            GradientShape::LinearToCorner { x: -1.0, y: -1.0 }
+        );
+
+        // Lengths need the gradient line and are not supported.
+        apply_inline_style(&mut s, "background-image: none");
+        apply_inline_style(&mut s, "background-image: linear-gradient(#fff 10px, #000)");
+        assert!(s.background_gradient.is_none());
+    }
 }
@@ -0,0 +1,1201 @@
+//! SVG export – converts one page of a finished PDF (any PDF, not only ones
+//! produced by this crate) into a standalone SVG document for web previews.
+//!
+//! [`page_to_svg`] interprets the page's content stream with the same
+//! drawing model the renderer writes: paths with fill, stroke, dashes and
+//! clipping, colours and opacity, text, images and form XObjects.  Text set
+//! in an embedded TrueType font is converted to glyph outlines, so the
+//! preview looks right without the font installed in the browser; text in
+//! the standard-14 fonts stays selectable `<text>` in the named family.
+//! Shadings, patterns and soft masks are not converted and are reported
+//! through [`crate::diagnostics`].
+
+use std::collections::HashMap;
+use std::rc::Rc;
+
+use base64::{engine::general_purpose::STANDARD as BASE64_STD, Engine as _};
+use lopdf::content::{Content, Operation};
+use lopdf::{Dictionary, Document, Object, ObjectId, Stream};
+
+use crate::diagnostics;
+
+/// Affine matrix `[a b c d e f]`, laid out as in PDF and SVG.
+type Matrix = [f32; 6];
+
+const IDENTITY: Matrix = [1.0, 0.0, 0.0, 1.0, 0.0, 0.0];
+
+/// Form XObjects nested deeper than this are skipped (guards cycles).
+const MAX_FORM_DEPTH: usize = 8;
+
+/// Convert page `page` (1-based) of `pdf` to SVG, sized in points.
+///
+/// The SVG's coordinate system is the page's media box with the origin at
+/// its top-left corner.
+pub fn page_to_svg(pdf: &[u8], page: usize) -> Result<String, String> {
+    let doc = Document::load_mem(pdf).map_err(|e| format!("Parse PDF: {e}"))?;
+    let pages = doc.get_pages();
+    let page_id = u32::try_from(page)
+        .ok()
+        .and_then(|n| pages.get(&n))
+        .copied()
+        .ok_or_else(|| {
+            format!(
+                "Page {page} out of range (document has {} pages)",
+                pages.len()
+            )
+        })?;
+    let page_dict = doc
+        .get_dictionary(page_id)
+        .map_err(|e| format!("Read page: {e}"))?;
+
+    let media_box: Vec<f32> = inherited(&doc, page_dict, b"MediaBox")
+        .and_then(|o| o.as_array().ok())
+        .map(|a| {
+            a.iter()
+                .filter_map(|o| deref(&doc, o).and_then(number))
+                .collect()
+        })
+        .filter(|v: &Vec<f32>| v.len() == 4)
+        .unwrap_or_else(|| vec![0.0, 0.0, 595.28, 841.89]);
+    let (x0, x1) = (
+        media_box[0].min(media_box[2]),
+        media_box[0].max(media_box[2]),
+    );
+    let (y0, y1) = (
+        media_box[1].min(media_box[3]),
+        media_box[1].max(media_box[3]),
+    );
+
+    let resources = inherited(&doc, page_dict, b"Resources").and_then(|o| o.as_dict().ok());
+    let content = doc
+        .get_page_content(page_id)
+        .map_err(|e| format!("Read page content: {e}"))?;
+    let operations = Content::decode(&content)
+        .map_err(|e| format!("Parse page content: {e}"))?
+        .operations;
+
+    let mut converter = Converter::new(&doc);
+    converter.run(&operations, resources, 0);
+
+    let (width, height) = (num(x1 - x0), num(y1 - y0));
+    let mut svg = format!(
+        r#"<svg xmlns="http://www.w3.org/2000/svg" width="{width}pt" height="{height}pt" viewBox="0 0 {width} {height}" xml:space="preserve">"#
+    );
+    if !converter.defs.is_empty() {
+        svg.push_str(&format!("<defs>{}</defs>", converter.defs));
+    }
+    // PDF user space has y pointing up from the bottom of the media box.
+    svg.push_str(&format!(
+        r#"<g transform="matrix(1 0 0 -1 {} {})">"#,
+        num(-x0),
+        num(y1)
+    ));
+    svg.push_str(&converter.body);
+    svg.push_str("</g></svg>\n");
+    Ok(svg)
+}
+
+/// The graphics state saved and restored by `q` / `Q`, text state included.
+#[derive(Clone)]
+struct GraphicsState {
+    ctm: Matrix,
+    fill: [f32; 3],
+    stroke: [f32; 3],
+    fill_alpha: f32,
+    stroke_alpha: f32,
+    line_width: f32,
+    line_cap: i64,
+    line_join: i64,
+    dash: Vec<f32>,
+    dash_phase: f32,
+    /// Number of the active `<clipPath>`.
+    clip: Option<usize>,
+    font: Option<Rc<Font>>,
+    font_size: f32,
+    char_spacing: f32,
+    word_spacing: f32,
+    /// `Tz` as a factor (`1.0` = 100 %).
+    horizontal_scale: f32,
+    leading: f32,
+    rise: f32,
+    render_mode: i64,
+}
+
+impl Default for GraphicsState {
+    fn default() -> Self {
+        Self {
+            ctm: IDENTITY,
+            fill: [0.0; 3],
+            stroke: [0.0; 3],
+            fill_alpha: 1.0,
+            stroke_alpha: 1.0,
+            line_width: 1.0,
+            line_cap: 0,
+            line_join: 0,
+            dash: Vec::new(),
+            dash_phase: 0.0,
+            clip: None,
+            font: None,
+            font_size: 0.0,
+            char_spacing: 0.0,
+            word_spacing: 0.0,
+            horizontal_scale: 1.0,
+            leading: 0.0,
+            rise: 0.0,
+            render_mode: 0,
+        }
+    }
+}
+
+struct Converter<'a> {
+    doc: &'a Document,
+    state: GraphicsState,
+    stack: Vec<GraphicsState>,
+    /// Path under construction as SVG path data, already in user space.
+    path: String,
+    /// Last point of `path`, in user space.
+    current: (f32, f32),
+    /// `W` / `W*` seen: the path clips once painted (`true` = even-odd).
+    pending_clip: Option<bool>,
+    text_matrix: Matrix,
+    line_matrix: Matrix,
+    fonts: HashMap<ObjectId, Rc<Font>>,
+    clips: usize,
+    defs: String,
+    body: String,
+}
+
+impl<'a> Converter<'a> {
+    fn new(doc: &'a Document) -> Self {
+        Self {
+            doc,
+            state: GraphicsState::default(),
+            stack: Vec::new(),
+            path: String::new(),
+            current: (0.0, 0.0),
+            pending_clip: None,
+            text_matrix: IDENTITY,
+            line_matrix: IDENTITY,
+            fonts: HashMap::new(),
+            clips: 0,
+            defs: String::new(),
+            body: String::new(),
+        }
+    }
+
+    fn run(&mut self, operations: &[Operation], resources: Option<&'a Dictionary>, depth: usize) {
+        for op in operations {
+            let n: Vec<f32> = op.operands.iter().filter_map(number).collect();
+            let name = op.operands.first().and_then(|o| o.as_name().ok());
+            match op.operator.as_str() {
+                // Graphics state
+                "q" => self.stack.push(self.state.clone()),
+                "Q" => {
+                    if let Some(state) = self.stack.pop() {
+                        self.state = state;
+                    }
+                }
+                "cm" if n.len() == 6 => self.state.ctm = multiply(matrix(&n), self.state.ctm),
+                "w" if !n.is_empty() => self.state.line_width = n[0],
+                "J" if !n.is_empty() => self.state.line_cap = n[0] as i64,
+                "j" if !n.is_empty() => self.state.line_join = n[0] as i64,
+                "d" => {
+                    if let Some(Object::Array(dashes)) = op.operands.first() {
+                        self.state.dash = dashes.iter().filter_map(number).collect();
+                        self.state.dash_phase = n.first().copied().unwrap_or(0.0);
+                    }
+                }
+                "gs" => {
+                    if let Some(name) = name {
+                        self.apply_ext_gstate(resources, name);
+                    }
+                }
+
+                // Colour
+                "cs" => self.state.fill = [0.0; 3],
+                "CS" => self.state.stroke = [0.0; 3],
+                "g" | "rg" | "k" | "sc" | "scn" => {
+                    if let Some(c) = color(&n) {
+                        self.state.fill = c;
+                    }
+                }
+                "G" | "RG" | "K" | "SC" | "SCN" => {
+                    if let Some(c) = color(&n) {
+                        self.state.stroke = c;
+                    }
+                }
+
+                // Path construction
+                "m" if n.len() >= 2 => self.move_to(n[0], n[1]),
+                "l" if n.len() >= 2 => self.line_to(n[0], n[1]),
+                "c" if n.len() >= 6 => {
+                    self.curve_to(Some((n[0], n[1])), (n[2], n[3]), (n[4], n[5]))
+                }
+                "v" if n.len() >= 4 => self.curve_to(None, (n[0], n[1]), (n[2], n[3])),
+                "y" if n.len() >= 4 => {
+                    self.curve_to(Some((n[0], n[1])), (n[2], n[3]), (n[2], n[3]))
+                }
+                "h" => self.path.push('Z'),
+                "re" if n.len() >= 4 => {
+                    let (x, y, w, h) = (n[0], n[1], n[2], n[3]);
+                    self.move_to(x, y);
+                    self.line_to(x + w, y);
+                    self.line_to(x + w, y + h);
+                    self.line_to(x, y + h);
+                    self.path.push('Z');
+                }
+
+                // Path painting
+                "f" | "F" => self.paint(true, false, false),
+                "f*" => self.paint(true, false, true),
+                "S" => self.paint(false, true, false),
+                "s" => {
+                    self.path.push('Z');
+                    self.paint(false, true, false);
+                }
+                "B" => self.paint(true, true, false),
+                "B*" => self.paint(true, true, true),
+                "b" => {
+                    self.path.push('Z');
+                    self.paint(true, true, false);
+                }
+                "b*" => {
+                    self.path.push('Z');
+                    self.paint(true, true, true);
+                }
+                "n" => self.paint(false, false, false),
+                "W" => self.pending_clip = Some(false),
+                "W*" => self.pending_clip = Some(true),
+
+                // Text
+                "BT" => {
+                    self.text_matrix = IDENTITY;
+                    self.line_matrix = IDENTITY;
+                }
+                "Tf" if !n.is_empty() => {
+                    self.state.font = name.and_then(|name| self.load_font(resources, name));
+                    self.state.font_size = n[0];
+                }
+                "Tc" if !n.is_empty() => self.state.char_spacing = n[0],
+                "Tw" if !n.is_empty() => self.state.word_spacing = n[0],
+                "Tz" if !n.is_empty() => self.state.horizontal_scale = n[0] / 100.0,
+                "TL" if !n.is_empty() => self.state.leading = n[0],
+                "Ts" if !n.is_empty() => self.state.rise = n[0],
+                "Tr" if !n.is_empty() => self.state.render_mode = n[0] as i64,
+                "Td" if n.len() >= 2 => self.next_line(n[0], n[1]),
+                "TD" if n.len() >= 2 => {
+                    self.state.leading = -n[1];
+                    self.next_line(n[0], n[1]);
+                }
+                "Tm" if n.len() == 6 => {
+                    self.text_matrix = matrix(&n);
+                    self.line_matrix = self.text_matrix;
+                }
+                "T*" => self.next_line(0.0, -self.state.leading),
+                "Tj" | "'" | "\"" => {
+                    if op.operator == "\"" && n.len() >= 2 {
+                        self.state.word_spacing = n[0];
+                        self.state.char_spacing = n[1];
+                    }
+                    if op.operator != "Tj" {
+                        self.next_line(0.0, -self.state.leading);
+                    }
+                    if let Some(Object::String(bytes, _)) = op.operands.last() {
+                        self.show(bytes);
+                    }
+                }
+                "TJ" => {
+                    if let Some(Object::Array(items)) = op.operands.first() {
+                        for item in items {
+                            match item {
+                                Object::String(bytes, _) => self.show(bytes),
+                                other => {
+                                    if let Some(adjust) = number(other) {
+                                        let state = &self.state;
+                                        let tx = -adjust / 1000.0
+                                            * state.font_size
+                                            * state.horizontal_scale;
+                                        self.advance(tx);
+                                    }
+                                }
+                            }
+                        }
+                    }
+                }
+
+                // External objects
+                "Do" => {
+                    if let Some(name) = name {
+                        self.draw_xobject(resources, name, depth);
+                    }
+                }
+                "sh" => diagnostics::warn("svg", "Shading not converted to SVG; skipped"),
+                _ => {}
+            }
+        }
+    }
+
+    fn move_to(&mut self, x: f32, y: f32) {
+        let (x, y) = apply(self.state.ctm, x, y);
+        self.path.push_str(&format!("M{} {}", num(x), num(y)));
+        self.current = (x, y);
+    }
+
+    fn line_to(&mut self, x: f32, y: f32) {
+        let (x, y) = apply(self.state.ctm, x, y);
+        self.path.push_str(&format!("L{} {}", num(x), num(y)));
+        self.current = (x, y);
+    }
+
+    /// Cubic Bézier; a missing first control point is the current point.
+    fn curve_to(&mut self, c1: Option<(f32, f32)>, c2: (f32, f32), end: (f32, f32)) {
+        let ctm = self.state.ctm;
+        let (x1, y1) = c1.map_or(self.current, |(x, y)| apply(ctm, x, y));
+        let (x2, y2) = apply(ctm, c2.0, c2.1);
+        let (x, y) = apply(ctm, end.0, end.1);
+        self.path.push_str(&format!(
+            "C{} {} {} {} {} {}",
+            num(x1),
+            num(y1),
+            num(x2),
+            num(y2),
+            num(x),
+            num(y)
+        ));
+        self.current = (x, y);
+    }
+
+    /// End the current path, filling and/or stroking it, then apply any
+    /// pending clip.
+    fn paint(&mut self, fill: bool, stroke: bool, even_odd: bool) {
+        let d = std::mem::take(&mut self.path);
+        if d.is_empty() {
+            self.pending_clip = None;
+            return;
+        }
+        if fill || stroke {
+            let mut element = format!(r#"<path d="{d}""#);
+            if fill {
+                element.push_str(&self.fill_attributes(even_odd));
+            } else {
+                element.push_str(r#" fill="none""#);
+            }
+            if stroke {
+                element.push_str(&self.stroke_attributes(IDENTITY));
+            }
+            element.push_str("/>");
+            self.emit(&element);
+        }
+        if let Some(even_odd) = self.pending_clip.take() {
+            self.clips += 1;
+            let id = self.clips;
+            let parent = self.clip_attribute();
+            let rule = if even_odd {
+                r#" clip-rule="evenodd""#
+            } else {
+                ""
+            };
+            self.defs.push_str(&format!(
+                r#"<clipPath id="clip{id}"{parent}><path d="{d}"{rule}/></clipPath>"#
+            ));
+            self.state.clip = Some(id);
+        }
+    }
+
+    /// Append `element` to the output inside the active clip, if any.  The
+    /// clip is applied by a wrapping group so it stays in user space even
+    /// for elements with their own `transform`.
+    fn emit(&mut self, element: &str) {
+        match self.state.clip {
+            Some(id) => self
+                .body
+                .push_str(&format!(r#"<g clip-path="url(#clip{id})">{element}</g>"#)),
+            None => self.body.push_str(element),
+        }
+    }
+
+    fn clip_attribute(&self) -> String {
+        self.state
+            .clip
+            .map(|id| format!(r#" clip-path="url(#clip{id})""#))
+            .unwrap_or_default()
+    }
+
+    fn fill_attributes(&self, even_odd: bool) -> String {
+        let mut attrs = format!(r#" fill="{}""#, rgb(self.state.fill));
+        if even_odd {
+            attrs.push_str(r#" fill-rule="evenodd""#);
+        }
+        if self.state.fill_alpha < 1.0 {
+            attrs.push_str(&format!(
+                r#" fill-opacity="{}""#,
+                num(self.state.fill_alpha)
+            ));
+        }
+        attrs
+    }
+
+    /// Stroke attributes for an element drawn through `element` (its own
+    /// transform on top of user space), so widths come out in user space.
+    fn stroke_attributes(&self, element: Matrix) -> String {
+        let state = &self.state;
+        let scale = scale_of(state.ctm) / scale_of(element).max(f32::EPSILON);
+        let mut attrs = format!(r#" stroke="{}""#, rgb(state.stroke));
+        if state.line_width > 0.0 {
+            attrs.push_str(&format!(
+                r#" stroke-width="{}""#,
+                num(state.line_width * scale)
+            ));
+        } else {
+            // Width 0 is the thinnest line the device can draw.
+            attrs.push_str(r#" stroke-width="1" vector-effect="non-scaling-stroke""#);
+        }
+        match state.line_cap {
+            1 => attrs.push_str(r#" stroke-linecap="round""#),
+            2 => attrs.push_str(r#" stroke-linecap="square""#),
+            _ => {}
+        }
+        match state.line_join {
+            1 => attrs.push_str(r#" stroke-linejoin="round""#),
+            2 => attrs.push_str(r#" stroke-linejoin="bevel""#),
+            _ => {}
+        }
+        if !state.dash.is_empty() {
+            let dashes: Vec<String> = state.dash.iter().map(|d| num(d * scale)).collect();
+            attrs.push_str(&format!(r#" stroke-dasharray="{}""#, dashes.join(" ")));
+            if state.dash_phase != 0.0 {
+                attrs.push_str(&format!(
+                    r#" stroke-dashoffset="{}""#,
+                    num(state.dash_phase * scale)
+                ));
+            }
+        }
+        if state.stroke_alpha < 1.0 {
+            attrs.push_str(&format!(r#" stroke-opacity="{}""#, num(state.stroke_alpha)));
+        }
+        attrs
+    }
+
+    fn apply_ext_gstate(&mut self, resources: Option<&'a Dictionary>, name: &[u8]) {
+        let doc = self.doc;
+        let Some(gs) = resources
+            .and_then(|r| r.get_deref(b"ExtGState", doc).ok())
+            .and_then(|o| o.as_dict().ok())
+            .and_then(|d| d.get_deref(name, doc).ok())
+            .and_then(|o| o.as_dict().ok())
+        else {
+            return;
+        };
+        let value = |key: &[u8]| gs.get_deref(key, doc).ok().and_then(number);
+        if let Some(alpha) = value(b"ca") {
+            self.state.fill_alpha = alpha;
+        }
+        if let Some(alpha) = value(b"CA") {
+            self.state.stroke_alpha = alpha;
+        }
+        if let Some(width) = value(b"LW") {
+            self.state.line_width = width;
+        }
+        if gs
+            .get_deref(b"SMask", doc)
+            .is_ok_and(|mask| mask.as_dict().is_ok())
+        {
+            diagnostics::warn("svg", "Soft mask not converted to SVG; ignored");
+        }
+    }
+
+    fn load_font(&mut self, resources: Option<&'a Dictionary>, name: &[u8]) -> Option<Rc<Font>> {
+        let doc = self.doc;
+        let entry = resources?
+            .get_deref(b"Font", doc)
+            .ok()?
+            .as_dict()
+            .ok()?
+            .get(name)
+            .ok()?;
+        if let Object::Reference(id) = entry {
+            if let Some(font) = self.fonts.get(id) {
+                return Some(font.clone());
+            }
+        }
+        let font = Rc::new(Font::load(doc, deref(doc, entry)?.as_dict().ok()?));
+        if let Object::Reference(id) = entry {
+            self.fonts.insert(*id, font.clone());
+        }
+        Some(font)
+    }
+
+    fn next_line(&mut self, tx: f32, ty: f32) {
+        self.line_matrix = multiply([1.0, 0.0, 0.0, 1.0, tx, ty], self.line_matrix);
+        self.text_matrix = self.line_matrix;
+    }
+
+    fn advance(&mut self, tx: f32) {
+        self.text_matrix = multiply([1.0, 0.0, 0.0, 1.0, tx, 0.0], self.text_matrix);
+    }
+
+    /// Draw a string operand and move the text position past it.
+    fn show(&mut self, bytes: &[u8]) {
+        let Some(font) = self.state.font.clone() else {
+            return;
+        };
+        let face = font
+            .program
+            .as_deref()
+            .and_then(|program| ttf_parser::Face::parse(program, 0).ok());
+        let size = self.state.font_size;
+        let scale = self.state.horizontal_scale;
+        let visible = !matches!(self.state.render_mode, 3 | 7);
+        let start = multiply(self.text_matrix, self.state.ctm);
+
+        let mut text = String::new();
+        let mut outlines = String::new();
+        for code in font.codes(bytes) {
+            if visible {
+                match &face {
+                    Some(face) => {
+                        let units = f32::from(face.units_per_em());
+                        let glyph = multiply(
+                            [
+                                size * scale / units,
+                                0.0,
+                                0.0,
+                                size / units,
+                                0.0,
+                                self.state.rise,
+                            ],
+                            multiply(self.text_matrix, self.state.ctm),
+                        );
+                        let mut builder = OutlinePath {
+                            matrix: glyph,
+                            d: &mut outlines,
+                        };
+                        face.outline_glyph(ttf_parser::GlyphId(code as u16), &mut builder);
+                    }
+                    None => text.push_str(&font.text(code)),
+                }
+            }
+            let width = font.advance(code, face.as_ref()) / 1000.0;
+            let mut spacing = self.state.char_spacing;
+            if code == 32 && !font.two_byte {
+                spacing += self.state.word_spacing;
+            }
+            self.advance((width * size + spacing) * scale);
+        }
+
+        if !outlines.is_empty() {
+            let paint = self.text_paint(IDENTITY);
+            self.emit(&format!(r#"<path d="{outlines}"{paint}/>"#));
+        }
+        if !text.is_empty() {
+            // Text space has y up; SVG glyphs are drawn with y down.
+            let element = multiply([size * scale, 0.0, 0.0, -size, 0.0, self.state.rise], start);
+            let paint = self.text_paint(element);
+            self.emit(&format!(
+                r#"<text transform="matrix({})"{} font-size="1"{paint}>{}</text>"#,
+                matrix_attribute(element),
+                font_attributes(&font.base_name),
+                escape(&text)
+            ));
+        }
+    }
+
+    /// Fill and stroke for the current text rendering mode.
+    fn text_paint(&self, element: Matrix) -> String {
+        let mode = self.state.render_mode;
+        let mut attrs = if matches!(mode, 1 | 5) {
+            r#" fill="none""#.to_string()
+        } else {
+            self.fill_attributes(false)
+        };
+        if matches!(mode, 1 | 2 | 5 | 6) {
+            attrs.push_str(&self.stroke_attributes(element));
+        }
+        attrs
+    }
+
+    fn draw_xobject(&mut self, resources: Option<&'a Dictionary>, name: &[u8], depth: usize) {
+        let doc = self.doc;
+        let Some(stream) = resources
+            .and_then(|r| r.get_deref(b"XObject", doc).ok())
+            .and_then(|o| o.as_dict().ok())
+            .and_then(|d| d.get_deref(name, doc).ok())
+            .and_then(|o| o.as_stream().ok())
+        else {
+            return;
+        };
+        let subtype = stream
+            .dict
+            .get(b"Subtype")
+            .and_then(Object::as_name)
+            .unwrap_or_default();
+        match subtype {
+            b"Image" => match image_data_uri(doc, stream) {
+                Some(href) => {
+                    // The image fills the unit square with its first row at the top.
+                    let element = format!(
+                        r#"<image width="1" height="1" preserveAspectRatio="none" transform="matrix({}) matrix(1 0 0 -1 0 1)" href="{href}"/>"#,
+                        matrix_attribute(self.state.ctm)
+                    );
+                    self.emit(&element);
+                }
+                None => diagnostics::warn("svg", "Image format not converted to SVG; skipped"),
+            },
+            b"Form" if depth >= MAX_FORM_DEPTH => {
+                diagnostics::warn("svg", "Form XObjects nested too deeply; skipped")
+            }
+            b"Form" => {
+                let operations = match Content::decode(&stream_bytes(stream)) {
+                    Ok(content) => content.operations,
+                    Err(e) => {
+                        diagnostics::warn("svg", format!("Skipping form XObject — {e}"));
+                        return;
+                    }
+                };
+                let form_resources = stream
+                    .dict
+                    .get_deref(b"Resources", doc)
+                    .ok()
+                    .and_then(|o| o.as_dict().ok())
+                    .or(resources);
+                let saved = self.state.clone();
+                let saved_depth = self.stack.len();
+                let form_matrix: Vec<f32> = stream
+                    .dict
+                    .get_deref(b"Matrix", doc)
+                    .ok()
+                    .and_then(|o| o.as_array().ok())
+                    .map(|a| a.iter().filter_map(number).collect())
+                    .unwrap_or_default();
+                if form_matrix.len() == 6 {
+                    self.state.ctm = multiply(matrix(&form_matrix), self.state.ctm);
+                }
+                self.run(&operations, form_resources, depth + 1);
+                self.stack.truncate(saved_depth);
+                self.state = saved;
+            }
+            _ => {}
+        }
+    }
+}
+
+/// The parts of a font resource the converter needs.
+struct Font {
+    /// `/BaseFont` without any subset tag, e.g. `Helvetica-Bold`.
+    base_name: String,
+    /// Type0 fonts address glyphs with two-byte codes.
+    two_byte: bool,
+    /// Code → text, from the `/ToUnicode` CMap.
+    to_unicode: HashMap<u32, String>,
+    /// Code → advance in thousandths of an em, from `/Widths` or `/W`.
+    widths: HashMap<u32, f32>,
+    default_width: f32,
+    /// Embedded TrueType program whose glyph ids are the codes.
+    program: Option<Vec<u8>>,
+}
+
+impl Font {
+    fn load(doc: &Document, dict: &Dictionary) -> Self {
+        let name = |d: &Dictionary, key: &[u8]| {
+            d.get_deref(key, doc)
+                .ok()
+                .and_then(|o| o.as_name().ok())
+                .map(|n| String::from_utf8_lossy(n).into_owned())
+        };
+        let base = name(dict, b"BaseFont").unwrap_or_default();
+        let base_name = match base.split_once('+') {
+            Some((tag, rest)) if tag.len() == 6 => rest.to_string(),
+            _ => base.clone(),
+        };
+        let two_byte = name(dict, b"Subtype").as_deref() == Some("Type0");
+        let to_unicode = dict
+            .get_deref(b"ToUnicode", doc)
+            .ok()
+            .and_then(|o| o.as_stream().ok())
+            .map(|s| parse_to_unicode(&stream_bytes(s)))
+            .unwrap_or_default();
+
+        let mut widths = HashMap::new();
+        // Same estimate as the layout engine uses for the builtin fonts.
+        let mut default_width = 500.0;
+        let mut program = None;
+        if two_byte {
+            let cid_font = dict
+                .get_deref(b"DescendantFonts", doc)
+                .ok()
+                .and_then(|o| o.as_array().ok())
+                .and_then(|a| a.first())
+                .and_then(|o| deref(doc, o))
+                .and_then(|o| o.as_dict().ok());
+            if let Some(cid_font) = cid_font {
+                default_width = cid_font
+                    .get_deref(b"DW", doc)
+                    .ok()
+                    .and_then(number)
+                    .unwrap_or(1000.0);
+                if let Ok(Object::Array(w)) = cid_font.get_deref(b"W", doc) {
+                    parse_cid_widths(doc, w, &mut widths);
+                }
+                let identity = cid_font
+                    .get_deref(b"CIDToGIDMap", doc)
+                    .map_or(true, |m| m.as_name().is_ok_and(|n| n == b"Identity"));
+                if identity {
+                    program = font_program(doc, cid_font);
+                }
+            }
+        } else {
+            let first = dict
+                .get_deref(b"FirstChar", doc)
+                .ok()
+                .and_then(|o| o.as_i64().ok())
+                .unwrap_or(0);
+            if let Ok(Object::Array(w)) = dict.get_deref(b"Widths", doc) {
+                for (i, width) in w.iter().enumerate() {
+                    if let Some(width) = deref(doc, width).and_then(number) {
+                        widths.insert((first + i as i64) as u32, width);
+                    }
+                }
+            }
+        }
+
+        Self {
+            base_name,
+            two_byte,
+            to_unicode,
+            widths,
+            default_width,
+            program,
+        }
+    }
+
+    fn codes(&self, bytes: &[u8]) -> Vec<u32> {
+        if self.two_byte {
+            bytes
+                .chunks(2)
+                .map(|pair| pair.iter().fold(0, |acc, &b| (acc << 8) | u32::from(b)))
+                .collect()
+        } else {
+            bytes.iter().map(|&b| u32::from(b)).collect()
+        }
+    }
+
+    fn text(&self, code: u32) -> String {
+        if let Some(text) = self.to_unicode.get(&code) {
+            return text.clone();
+        }
+        match u8::try_from(code) {
+            Ok(byte) if !self.two_byte => win_ansi(byte).to_string(),
+            _ => char::REPLACEMENT_CHARACTER.to_string(),
+        }
+    }
+
+    /// Advance of `code` in thousandths of an em.
+    fn advance(&self, code: u32, face: Option<&ttf_parser::Face>) -> f32 {
+        if let Some(width) = self.widths.get(&code) {
+            return *width;
+        }
+        face.and_then(|face| {
+            let advance = face.glyph_hor_advance(ttf_parser::GlyphId(code as u16))?;
+            Some(f32::from(advance) * 1000.0 / f32::from(face.units_per_em()))
+        })
+        .unwrap_or(self.default_width)
+    }
+}
+
+/// Collects glyph outlines, mapped from font units to user space.
+struct OutlinePath<'s> {
+    matrix: Matrix,
+    d: &'s mut String,
+}
+
+impl OutlinePath<'_> {
+    fn point(&self, x: f32, y: f32) -> String {
+        let (x, y) = apply(self.matrix, x, y);
+        format!("{} {}", num(x), num(y))
+    }
+}
+
+impl ttf_parser::OutlineBuilder for OutlinePath<'_> {
+    fn move_to(&mut self, x: f32, y: f32) {
+        let p = self.point(x, y);
+        self.d.push_str(&format!("M{p}"));
+    }
+
+    fn line_to(&mut self, x: f32, y: f32) {
+        let p = self.point(x, y);
+        self.d.push_str(&format!("L{p}"));
+    }
+
+    fn quad_to(&mut self, x1: f32, y1: f32, x: f32, y: f32) {
+        let (c, p) = (self.point(x1, y1), self.point(x, y));
+        self.d.push_str(&format!("Q{c} {p}"));
+    }
+
+    fn curve_to(&mut self, x1: f32, y1: f32, x2: f32, y2: f32, x: f32, y: f32) {
+        let (c1, c2, p) = (self.point(x1, y1), self.point(x2, y2), self.point(x, y));
+        self.d.push_str(&format!("C{c1} {c2} {p}"));
+    }
+
+    fn close(&mut self) {
+        self.d.push('Z');
+    }
+}
+
+/// `/W` entries: `c [w1 w2 …]` or `c_first c_last w`.
+fn parse_cid_widths(doc: &Document, w: &[Object], out: &mut HashMap<u32, f32>) {
+    let mut items = w.iter().filter_map(|o| deref(doc, o));
+    while let Some(first) = items.next() {
+        let Ok(first) = first.as_i64() else {
+            break;
+        };
+        match items.next() {
+            Some(Object::Array(list)) => {
+                for (i, width) in list.iter().filter_map(number).enumerate() {
+                    out.insert((first + i as i64) as u32, width);
+                }
+            }
+            Some(last) => {
+                let (Ok(last), Some(width)) = (last.as_i64(), items.next().and_then(number)) else {
+                    break;
+                };
+                for cid in first..=last.min(first + 0xFFFF) {
+                    out.insert(cid as u32, width);
+                }
+            }
+            None => break,
+        }
+    }
+}
+
+/// The embedded TrueType program of a CID font, if ttf-parser can read it.
+fn font_program(doc: &Document, font: &Dictionary) -> Option<Vec<u8>> {
+    let descriptor = font
+        .get_deref(b"FontDescriptor", doc)
+        .ok()?
+        .as_dict()
+        .ok()?;
+    let stream = descriptor
+        .get_deref(b"FontFile2", doc)
+        .ok()?
+        .as_stream()
+        .ok()?;
+    let bytes = stream_bytes(stream);
+    ttf_parser::Face::parse(&bytes, 0).is_ok().then_some(bytes)
+}
+
+enum CmapToken {
+    Hex(Vec<u8>),
+    ArrayStart,
+    ArrayEnd,
+}
+
+/// Parse the `bfchar` and `bfrange` sections of a ToUnicode CMap.
+fn parse_to_unicode(cmap: &[u8]) -> HashMap<u32, String> {
+    let text = String::from_utf8_lossy(cmap);
+    let mut map = HashMap::new();
+    for section in sections(&text, "beginbfchar", "endbfchar") {
+        for pair in cmap_tokens(section).chunks_exact(2) {
+            if let [CmapToken::Hex(src), CmapToken::Hex(dst)] = pair {
+                map.insert(code_of(src), utf16(dst));
+            }
+        }
+    }
+    for section in sections(&text, "beginbfrange", "endbfrange") {
+        let mut tokens = cmap_tokens(section).into_iter();
+        while let (Some(CmapToken::Hex(lo)), Some(CmapToken::Hex(hi))) =
+            (tokens.next(), tokens.next())
+        {
+            let (lo, hi) = (code_of(&lo), code_of(&hi));
+            match tokens.next() {
+                Some(CmapToken::Hex(dst)) => {
+                    // Consecutive codes map to consecutive last code units.
+                    let mut units = utf16_units(&dst);
+                    for code in lo..=hi.min(lo + 0xFFFF) {
+                        map.insert(code, String::from_utf16_lossy(&units));
+                        if let Some(last) = units.last_mut() {
+                            *last = last.wrapping_add(1);
+                        }
+                    }
+                }
+                Some(CmapToken::ArrayStart) => {
+                    let mut code = lo;
+                    for token in tokens.by_ref() {
+                        match token {
+                            CmapToken::Hex(dst) => {
+                                map.insert(code, utf16(&dst));
+                                code += 1;
+                            }
+                            CmapToken::ArrayEnd => break,
+                            CmapToken::ArrayStart => {}
+                        }
+                    }
+                }
+                _ => break,
+            }
+        }
+    }
+    map
+}
+
+fn sections<'t>(text: &'t str, begin: &str, end: &str) -> Vec<&'t str> {
+    let mut found = Vec::new();
+    let mut rest = text;
+    while let Some(start) = rest.find(begin) {
+        let body = &rest[start + begin.len()..];
+        let Some(stop) = body.find(end) else {
+            break;
+        };
+        found.push(&body[..stop]);
+        rest = &body[stop + end.len()..];
+    }
+    found
+}
+
+fn cmap_tokens(section: &str) -> Vec<CmapToken> {
+    let mut tokens = Vec::new();
+    let mut chars = section.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '<' => {
+                let digits: Vec<u8> = chars
+                    .by_ref()
+                    .take_while(|&c| c != '>')
+                    .filter_map(|c| c.to_digit(16))
+                    .map(|d| d as u8)
+                    .collect();
+                let bytes = digits
+                    .chunks(2)
+                    .map(|pair| (pair[0] << 4) | pair.get(1).copied().unwrap_or(0))
+                    .collect();
+                tokens.push(CmapToken::Hex(bytes));
+            }
+            '[' => tokens.push(CmapToken::ArrayStart),
+            ']' => tokens.push(CmapToken::ArrayEnd),
+            _ => {}
+        }
+    }
+    tokens
+}
+
+fn code_of(bytes: &[u8]) -> u32 {
+    bytes.iter().fold(0, |acc, &b| (acc << 8) | u32::from(b))
+}
+
+fn utf16_units(bytes: &[u8]) -> Vec<u16> {
+    bytes
+        .chunks_exact(2)
+        .map(|pair| u16::from_be_bytes([pair[0], pair[1]]))
+        .collect()
+}
+
+fn utf16(bytes: &[u8]) -> String {
+    String::from_utf16_lossy(&utf16_units(bytes))
+}
+
+/// WinAnsiEncoding, the encoding the renderer writes builtin-font text in.
+fn win_ansi(byte: u8) -> char {
+    match byte {
+        0x80 => '\u{20AC}',
+        0x82 => '\u{201A}',
+        0x84 => '\u{201E}',
+        0x85 => '\u{2026}',
+        0x91 => '\u{2018}',
+        0x92 => '\u{2019}',
+        0x93 => '\u{201C}',
+        0x94 => '\u{201D}',
+        0x95 => '\u{2022}',
+        0x96 => '\u{2013}',
+        0x97 => '\u{2014}',
+        0x99 => '\u{2122}',
+        b => char::from(b),
+    }
+}
+
+/// `font-family` (with a generic fallback) and weight/style attributes for
+/// a base font name such as `Helvetica-BoldOblique`.
+fn font_attributes(base_name: &str) -> String {
+    let (family, style) = base_name
+        .split_once(&['-', ','][..])
+        .unwrap_or((base_name, ""));
+    let fallback = match family {
+        "Helvetica" | "Arial" => ", Arial, sans-serif",
+        "Times" => ", Times New Roman, serif",
+        "Courier" => ", Courier New, monospace",
+        _ => "",
+    };
+    let mut attrs = format!(r#" font-family="{}{fallback}""#, escape(family));
+    if style.contains("Bold") {
+        attrs.push_str(r#" font-weight="bold""#);
+    }
+    if style.contains("Italic") || style.contains("Oblique") {
+        attrs.push_str(r#" font-style="italic""#);
+    }
+    attrs
+}
+
+/// Content stream bytes, decompressed when the stream has a filter.
+fn stream_bytes(stream: &Stream) -> Vec<u8> {
+    if stream.dict.has(b"Filter") {
+        stream
+            .decompressed_content()
+            .unwrap_or_else(|_| stream.content.clone())
+    } else {
+        stream.content.clone()
+    }
+}
+
+/// An image XObject as a data URI, in the formats
+/// [`extract_images`](crate::inspect::extract_images) produces.  Images it
+/// cannot decode give `None`.
+fn image_data_uri(doc: &Document, image: &Stream) -> Option<String> {
+    let encoded = crate::inspect::encode_image(doc, image)?;
+    Some(format!(
+        "data:image/{};base64,{}",
+        encoded.format,
+        BASE64_STD.encode(&encoded.data)
+    ))
+}
+
+/// `key` from `page` or the nearest ancestor in the page tree that sets it.
+fn inherited<'a>(doc: &'a Document, page: &'a Dictionary, key: &[u8]) -> Option<&'a Object> {
+    let mut node = page;
+    // The depth limit guards against a cyclic `/Parent` chain.
+    for _ in 0..32 {
+        if let Ok(value) = node.get_deref(key, doc) {
+            return Some(value);
+        }
+        node = node.get_deref(b"Parent", doc).ok()?.as_dict().ok()?;
+    }
+    None
+}
+
+fn deref<'a>(doc: &'a Document, object: &'a Object) -> Option<&'a Object> {
+    match object {
+        Object::Reference(id) => doc.get_object(*id).ok(),
+        other => Some(other),
+    }
+}
+
+fn number(object: &Object) -> Option<f32> {
+    object.as_float().ok()
+}
+
+fn matrix(n: &[f32]) -> Matrix {
+    [n[0], n[1], n[2], n[3], n[4], n[5]]
+}
+
+/// `a` followed by `b` (PDF's `a × b`).
+fn multiply(a: Matrix, b: Matrix) -> Matrix {
+    [
+        a[0] * b[0] + a[1] * b[2],
+        a[0] * b[1] + a[1] * b[3],
+        a[2] * b[0] + a[3] * b[2],
+        a[2] * b[1] + a[3] * b[3],
+        a[4] * b[0] + a[5] * b[2] + b[4],
+        a[4] * b[1] + a[5] * b[3] + b[5],
+    ]
+}
+
+fn apply(m: Matrix, x: f32, y: f32) -> (f32, f32) {
+    (m[0] * x + m[2] * y + m[4], m[1] * x + m[3] * y + m[5])
+}
+
+/// How much `m` scales lengths, on average over both axes.
+fn scale_of(m: Matrix) -> f32 {
+    (m[0] * m[3] - m[1] * m[2]).abs().sqrt()
+}
+
+fn matrix_attribute(m: Matrix) -> String {
+    m.iter().map(|&v| num(v)).collect::<Vec<_>>().join(" ")
+}
+
+/// A colour operand list: grey, RGB or CMYK.
+fn color(n: &[f32]) -> Option<[f32; 3]> {
+    match *n {
+        [g] => Some([g, g, g]),
+        [r, g, b] => Some([r, g, b]),
+        [c, m, y, k] => Some([
+            (1.0 - c) * (1.0 - k),
+            (1.0 - m) * (1.0 - k),
+            (1.0 - y) * (1.0 - k),
+        ]),
+        _ => None,
+    }
+}
+
+fn rgb(c: [f32; 3]) -> String {
+    let channel = |v: f32| (v.clamp(0.0, 1.0) * 255.0).round() as u8;
+    format!("rgb({},{},{})", channel(c[0]), channel(c[1]), channel(c[2]))
+}
+
+/// A coordinate with at most three decimals and no trailing zeros.
+fn num(v: f32) -> String {
+    let s = format!("{v:.3}");
+    let s = s.trim_end_matches('0').trim_end_matches('.');
+    if s == "-0" {
+        "0".to_string()
+    } else {
+        s.to_string()
+    }
+}
+
+/// Escape `text` for XML, dropping the control characters XML forbids.
+fn escape(text: &str) -> String {
+    text.chars()
+        .filter(|&c| c >= ' ' || matches!(c, '\t' | '\n' | '\r'))
+        .collect::<String>()
+        .replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_pdf::pdf_with_pages;
+    use lopdf::dictionary;
+
+    /// One page with a blue rectangle and a line of Helvetica text.
+    fn drawing_fixture() -> Vec<u8> {
+        let mut doc = Document::with_version("1.7");
+        let helvetica = doc.add_object(dictionary! {
+            "Type" => "Font",
+            "Subtype" => "Type1",
+            "BaseFont" => "Helvetica-Bold",
+        });
+        let resources = dictionary! { "Font" => dictionary! { "F1" => helvetica } };
+        let ops = b"0 0 1 rg 10 20 100 50 re f BT /F1 12 Tf 72 700 Td (Tom & Jerry) Tj ET";
+        pdf_with_pages(doc, [(resources, ops.to_vec())])
+    }
+
+    #[test]
+    fn converts_paths_and_text_of_a_page() {
+        let svg = page_to_svg(&drawing_fixture(), 1).unwrap();
+        assert!(svg.starts_with(r#"<svg xmlns="http://www.w3.org/2000/svg" width="595pt""#));
+        assert!(svg.contains(r#"<g transform="matrix(1 0 0 -1 0 842)">"#));
+        assert!(svg.contains(r#"<path d="M10 20L110 20L110 70L10 70Z" fill="rgb(0,0,255)"/>"#));
+        assert!(svg.contains(
+            r#"<text transform="matrix(12 0 0 -12 72 700)" font-family="Helvetica, Arial, sans-serif" font-weight="bold" font-size="1" fill="rgb(0,0,0)">Tom &amp; Jerry</text>"#
+        ));
+    }
+
+    #[test]
+    fn rejects_pages_out_of_range() {
+        let pdf = drawing_fixture();
+        assert!(page_to_svg(&pdf, 0).is_err());
+        assert!(page_to_svg(&pdf, 2).is_err());
+        assert!(page_to_svg(b"not a pdf", 1).is_err());
+    }
+
+    #[test]
+    fn parses_to_unicode_chars_and_ranges() {
+        let cmap = b"1 beginbfchar <0003> <0020> endbfchar \
+            2 beginbfrange <0010> <0012> <0041> <0020> <0021> [<00E9> <20AC>] endbfrange";
+        let map = parse_to_unicode(cmap);
+        assert_eq!(map[&3], " ");
+        assert_eq!(map[&0x11], "B");
+        assert_eq!(map[&0x12], "C");
+        assert_eq!(map[&0x21], "€");
+    }
+}
@@ -0,0 +1,46 @@
+//! Hand-built PDFs for the unit tests of the modules that read PDF files.
+
+use lopdf::{dictionary, Dictionary, Document, Object, ObjectId, Stream};
+
+/// Give `doc` a catalog and a page tree of A4 pages (595 × 842 pt), one per
+/// entry of `pages`: the page's resources and its content stream.  Returns
+/// the page ids in order.
+pub(crate) fn add_pages(
+    doc: &mut Document,
+    pages: impl IntoIterator<Item = (Dictionary, Vec<u8>)>,
+) -> Vec<ObjectId> {
+    let pages_id = doc.new_object_id();
+    let mut kids = Vec::new();
+    for (resources, content) in pages {
+        let content = doc.add_object(Stream::new(dictionary! {}, content));
+        kids.push(doc.add_object(dictionary! {
+            "Type" => "Page",
+            "Parent" => pages_id,
+            "Contents" => content,
+            "Resources" => resources,
+        }));
+    }
+    doc.objects.insert(
+        pages_id,
+        Object::Dictionary(dictionary! {
+            "Type" => "Pages",
+            "Kids" => kids.iter().map(|&id| id.into()).collect::<Vec<Object>>(),
+            "Count" => kids.len() as i64,
+            "MediaBox" => vec![0.into(), 0.into(), 595.into(), 842.into()],
+        }),
+    );
+    let catalog = doc.add_object(dictionary! { "Type" => "Catalog", "Pages" => pages_id });
+    doc.trailer.set("Root", catalog);
+    kids
+}
+
+/// `doc` with the pages of [`add_pages`], saved.
+pub(crate) fn pdf_with_pages(
+    mut doc: Document,
+    pages: impl IntoIterator<Item = (Dictionary, Vec<u8>)>,
+) -> Vec<u8> {
+    add_pages(&mut doc, pages);
+    let mut bytes = Vec::new();
+    doc.save_to(&mut bytes).unwrap();
+    bytes
+}
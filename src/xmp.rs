@@ -0,0 +1,207 @@
+//! XMP metadata – validation of caller-supplied packets before they are
+//! embedded as the document's `/Metadata` stream.
+//!
+//! There is no XML parser in the dependency tree, so [`check_well_formed`]
+//! is a small structural checker: balanced and correctly nested elements,
+//! quoted attributes, terminated comments / CDATA / processing instructions,
+//! a single root element and well-formed entity references.  It does not
+//! validate the packet against the XMP schema.
+
+/// Return an error describing the first well-formedness violation.
+pub fn check_well_formed(xml: &str) -> Result<(), String> {
+    let mut stack: Vec<&str> = Vec::new();
+    let mut roots = 0;
+    let mut rest = xml;
+
+    while let Some(lt) = rest.find('<') {
+        check_text(&rest[..lt], stack.is_empty())?;
+        rest = &rest[lt..];
+
+        if let Some(body) = rest.strip_prefix("<?") {
+            rest = after(body, "?>", "processing instruction")?;
+        } else if let Some(body) = rest.strip_prefix("<!--") {
+            rest = after(body, "-->", "comment")?;
+        } else if let Some(body) = rest.strip_prefix("<![CDATA[") {
+            if stack.is_empty() {
+                return Err("XMP: CDATA section outside the root element".to_string());
+            }
+            rest = after(body, "]]>", "CDATA section")?;
+        } else if let Some(body) = rest.strip_prefix("<!") {
+            if roots > 0 || !stack.is_empty() {
+                return Err("XMP: declaration after the root element started".to_string());
+            }
+            rest = after(body, ">", "declaration")?;
+        } else if let Some(body) = rest.strip_prefix("</") {
+            let end = body
+                .find('>')
+                .ok_or_else(|| "XMP: unterminated end tag".to_string())?;
+            let name = body[..end].trim_end();
+            match stack.pop() {
+                Some(open) if open == name => {}
+                Some(open) => {
+                    return Err(format!("XMP: `</{name}>` closes `<{open}>`"));
+                }
+                None => return Err(format!("XMP: unexpected `</{name}>`")),
+            }
+            rest = &body[end + 1..];
+        } else {
+            let (name, self_closing, remainder) = start_tag(&rest[1..])?;
+            if stack.is_empty() {
+                roots += 1;
+                if roots > 1 {
+                    return Err("XMP: more than one root element".to_string());
+                }
+            }
+            if !self_closing {
+                stack.push(name);
+            }
+            rest = remainder;
+        }
+    }
+    check_text(rest, stack.is_empty())?;
+
+    if let Some(open) = stack.pop() {
+        return Err(format!("XMP: `<{open}>` is never closed"));
+    }
+    if roots == 0 {
+        return Err("XMP: no root element".to_string());
+    }
+    Ok(())
+}
+
+/// Skip past `terminator` in `s`.
+fn after<'a>(s: &'a str, terminator: &str, what: &str) -> Result<&'a str, String> {
+    s.find(terminator)
+        .map(|i| &s[i + terminator.len()..])
+        .ok_or_else(|| format!("XMP: unterminated {what}"))
+}
+
+/// Character data: only whitespace outside the root, and `&` must start an
+/// entity reference.
+fn check_text(text: &str, outside_root: bool) -> Result<(), String> {
+    if outside_root && !text.trim().is_empty() {
+        return Err("XMP: text outside the root element".to_string());
+    }
+    check_entities(text)
+}
+
+fn check_entities(text: &str) -> Result<(), String> {
+    let mut rest = text;
+    while let Some(amp) = rest.find('&') {
+        rest = &rest[amp + 1..];
+        let end = rest
+            .find(';')
+            .ok_or_else(|| "XMP: unterminated entity reference".to_string())?;
+        let name = &rest[..end];
+        let valid = match name.strip_prefix('#') {
+            Some(num) => match num.strip_prefix('x') {
+                Some(hex) => !hex.is_empty() && hex.chars().all(|c| c.is_ascii_hexdigit()),
+                None => !num.is_empty() && num.chars().all(|c| c.is_ascii_digit()),
+            },
+            None => !name.is_empty() && name.chars().all(is_name_char),
+        };
+        if !valid {
+            return Err(format!("XMP: invalid entity reference `&{name};`"));
+        }
+        rest = &rest[end + 1..];
+    }
+    Ok(())
+}
+
+/// Parse a start tag after its `<`; returns the name, whether it is
+/// self-closing, and the input after the closing `>`.
+fn start_tag(s: &str) -> Result<(&str, bool, &str), String> {
+    let name_len = s
+        .find(|c: char| !is_name_char(c))
+        .unwrap_or(s.len());
+    if name_len == 0 {
+        return Err("XMP: `<` not followed by an element name".to_string());
+    }
+    let name = &s[..name_len];
+    let mut rest = &s[name_len..];
+
+    loop {
+        let trimmed = rest.trim_start();
+        let had_space = trimmed.len() < rest.len();
+        rest = trimmed;
+        if let Some(r) = rest.strip_prefix("/>") {
+            return Ok((name, true, r));
+        }
+        if let Some(r) = rest.strip_prefix('>') {
+            return Ok((name, false, r));
+        }
+        if rest.is_empty() {
+            return Err(format!("XMP: unterminated start tag `<{name}`"));
+        }
+        if !had_space {
+            return Err(format!("XMP: malformed attributes in `<{name}>`"));
+        }
+
+        // attr = "value" | 'value'
+        let attr_len = rest
+            .find(|c: char| !is_name_char(c))
+            .unwrap_or(rest.len());
+        if attr_len == 0 {
+            return Err(format!("XMP: malformed attributes in `<{name}>`"));
+        }
+        let after_name = rest[attr_len..].trim_start();
+        let value = after_name
+            .strip_prefix('=')
+            .map(str::trim_start)
+            .ok_or_else(|| format!("XMP: attribute without a value in `<{name}>`"))?;
+        let quote = value
+            .chars()
+            .next()
+            .filter(|&q| q == '"' || q == '\'')
+            .ok_or_else(|| format!("XMP: unquoted attribute value in `<{name}>`"))?;
+        let close = value[1..]
+            .find(quote)
+            .ok_or_else(|| format!("XMP: unterminated attribute value in `<{name}>`"))?;
+        let text = &value[1..1 + close];
+        if text.contains('<') {
+            return Err(format!("XMP: `<` in attribute value in `<{name}>`"));
+        }
+        check_entities(text)?;
+        rest = &value[close + 2..];
+    }
+}
+
+fn is_name_char(c: char) -> bool {
+    c.is_alphanumeric() || matches!(c, ':' | '_' | '-' | '.')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const PACKET: &str = r#"<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+  <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+    <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+      <dc:source>Billing &amp; Co</dc:source>
+      <!-- custom -->
+    </rdf:Description>
+  </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>"#;
+
+    #[test]
+    fn accepts_a_typical_packet() {
+        check_well_formed(PACKET).unwrap();
+    }
+
+    #[test]
+    fn rejects_malformed_xml() {
+        for bad in [
+            "",
+            "<a><b></a></b>",
+            "<a>",
+            "<a x=1/>",
+            "<a/><b/>",
+            "<a>&bogus</a>",
+            "text<a/>",
+        ] {
+            assert!(check_well_formed(bad).is_err(), "accepted {bad:?}");
+        }
+    }
+}
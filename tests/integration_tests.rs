@@ -7,9 +7,13 @@
 //! - Pagination works correctly
 
 use pdf_forge::dom::{parse_html, DomNode, Tag};
+use pdf_forge::inspect::read_metadata;
 use pdf_forge::layout_config::LayoutConfig;
-use pdf_forge::pipeline::{compute_layout_config, generate_pdf, PipelineConfig};
+use pdf_forge::pipeline::{
+    compute_layout_config, generate, generate_pdf, generate_to_file, layout_tree, PipelineConfig,
+};
 use pdf_forge::render::render_pdf;
+use pdf_forge::svg::page_to_svg;
 use pdf_forge::templates;
 
 // =====================================================================
@@ -178,6 +182,21 @@ fn layout_content_width_matches_page() {
     }
 }
 
+#[test]
+fn layout_tree_reports_the_geometry_of_identified_elements() {
+    let html = r#"<div style="height: 50px"></div>
+        <div id="card" class="card wide" style="width: 200px; height: 100px; margin-left: 30px">
+            <p>Hello</p>
+        </div>"#;
+    let tree = layout_tree(html, &default_config()).unwrap();
+    let card = tree.iter().find_map(|b| b.find("card")).expect("card box");
+    assert_eq!(card.tag.as_deref(), Some("div"));
+    assert_eq!(card.classes, vec!["card", "wide"]);
+    assert_eq!((card.x, card.y), (70.0, 50.0));
+    assert_eq!((card.width, card.height), (200.0, 100.0));
+    assert_eq!(card.children[0].lines, vec!["Hello"]);
+}
+
 // =====================================================================
 // Pagination tests
 // =====================================================================
@@ -216,6 +235,70 @@ fn page_break_before() {
     );
 }
 
+#[test]
+fn page_first_and_left_rules_move_content_on_their_pages() {
+    let html = r#"<style>
+        @page :first { margin-top: 100px }
+        @page :left { margin-left: 60px; margin-right: 20px }
+    </style>
+    <div>One</div><div class="break-before">Two</div><div class="break-before">Three</div>"#;
+    let layout = compute_layout_config(html, &default_config());
+    assert_eq!(layout.pages.len(), 3);
+    let first_box = |page: usize| &layout.pages[page].boxes[0];
+    assert_eq!(first_box(0).y, 100.0);
+    assert_eq!(first_box(1).y, 40.0);
+    assert_eq!(first_box(2).y, 40.0);
+    assert_eq!(first_box(0).x, 40.0);
+    assert_eq!(first_box(1).x, 60.0);
+    assert_eq!(first_box(2).x, 40.0);
+}
+
+#[test]
+fn trim_trailing_blank_page_drops_only_an_overflowed_empty_page() {
+    let html = r#"<div style="height: 750px; background: #eeeeee">Full</div>
+        <div style="height: 30px"></div>"#;
+    let kept = compute_layout_config(html, &default_config());
+    assert_eq!(kept.pages.len(), 2);
+    let trim = default_config().with_trim_trailing_blank_page(true);
+    assert_eq!(compute_layout_config(html, &trim).pages.len(), 1);
+
+    let intentional = r#"<div>Cover</div><div class="break-before" style="height: 30px"></div>"#;
+    assert_eq!(compute_layout_config(intentional, &trim).pages.len(), 2);
+}
+
+#[test]
+fn widows_carry_at_least_that_many_lines_to_the_next_page() {
+    // 683 pt of spacer leaves room for three 22.4 pt lines of the paragraph.
+    let html = |widows: &str| {
+        format!(
+            r#"<div style="height: 683px"></div>
+            <p style="white-space: pre{widows}">one
+two
+three
+four
+five</p>"#
+        )
+    };
+    let lines_per_page = |html: &str| -> Vec<usize> {
+        compute_layout_config(html, &default_config())
+            .pages
+            .iter()
+            .map(|page| {
+                page.boxes
+                    .iter()
+                    .filter_map(|b| b.text.as_ref())
+                    .map(|t| t.lines.len())
+                    .sum()
+            })
+            .collect()
+    };
+    assert_eq!(lines_per_page(&html("")), vec![3, 2]);
+    let with_widows = lines_per_page(&html("; widows: 3"));
+    assert_eq!(with_widows.len(), 2);
+    assert!(with_widows[1] >= 3, "lines per page: {with_widows:?}");
+    assert_eq!(with_widows.iter().sum::<usize>(), 5);
+}
+
 // =====================================================================
 // PDF generation tests
 // =====================================================================
@@ -268,6 +351,71 @@ fn generate_pdf_from_multipage_template() {
     );
 }
 
+#[test]
+fn generate_to_file_writes_the_same_pdf_to_disk() {
+    let path = std::env::temp_dir().join(format!("pdf-forge-out-{}.pdf", std::process::id()));
+    let html = templates::multi_page_template();
+    let written = generate_to_file(html, &path, &default_config()).unwrap();
+    let bytes = std::fs::read(&path).unwrap();
+    std::fs::remove_file(&path).unwrap();
+
+    assert_eq!(written, bytes.len() as u64);
+    assert_valid_pdf(&bytes);
+    assert_eq!(bytes, generate(html, &default_config()).unwrap().bytes);
+}
+
+#[test]
+fn generated_digest_matches_pdf_bytes() {
+    use sha2::{Digest, Sha256};
+
+    let html = templates::invoice_template();
+    let first = generate(html, &default_config()).unwrap();
+    let expected: [u8; 32] = Sha256::digest(&first.bytes).into();
+    assert_eq!(first.sha256, expected);
+    assert_eq!(first.sha256_hex().len(), 64);
+
+    let second = generate(html, &default_config()).unwrap();
+    assert_eq!(first.sha256, second.sha256, "digest should be a stable cache key");
+}
+
+#[test]
+fn bare_paragraph_fragment_renders_a_single_page() {
+    let pdf = generate("<p>Just a snippet</p>", &default_config()).unwrap();
+    assert_valid_pdf(&pdf.bytes);
+    assert_eq!(pdf.layout.pages.len(), 1);
+    assert_eq!(text_lines(&pdf.layout), vec!["Just a snippet"]);
+    assert!(pdf.diagnostics.is_empty(), "{:?}", pdf.diagnostics);
+
+    // Same layout as the equivalent full document.
+    let full = compute_layout_config(
+        "<!DOCTYPE html><html><body><p>Just a snippet</p></body></html>",
+        &default_config(),
+    );
+    assert_eq!(pdf.layout.to_json(), full.to_json());
+}
+
+#[test]
+fn object_streams_replace_the_classic_xref_table() {
+    let contains = |pdf: &[u8], needle: &[u8]| pdf.windows(needle.len()).any(|w| w == needle);
+    let html = templates::invoice_template();
+    let classic = generate(html, &default_config().with_object_streams(false))
+        .unwrap()
+        .bytes;
+    assert!(contains(&classic, b"\nxref"));
+    assert!(!contains(&classic, b"/XRef"));
+
+    let packed = generate(html, &default_config().with_object_streams(true))
+        .unwrap()
+        .bytes;
+    assert_valid_pdf(&packed);
+    assert!(!contains(&packed, b"\nxref"));
+    assert!(contains(&packed, b"/Type /XRef"));
+    assert!(contains(&packed, b"/Type /ObjStm"));
+    assert!(packed.len() < classic.len());
+    let pages = |pdf: &[u8]| lopdf::Document::load_mem(pdf).unwrap().get_pages().len();
+    assert_eq!(pages(&packed), pages(&classic));
+}
+
 // =====================================================================
 // Layout config JSON round-trip
 // =====================================================================
@@ -344,6 +492,27 @@ fn visit_box(
     }
 }
 
+#[test]
+fn min_font_size_raises_smaller_text_to_it() {
+    let html = r#"<p style="font-size: 5px">Fine print</p><p style="font-size: 12px">Body</p>"#;
+    let sizes = |config: &PipelineConfig| {
+        let doc = lopdf::Document::load_mem(&generate(html, config).unwrap().bytes).unwrap();
+        let page = doc.get_pages()[&1];
+        let content = lopdf::content::Content::decode(&doc.get_page_content(page).unwrap());
+        let mut sizes: Vec<f32> = content
+            .unwrap()
+            .operations
+            .iter()
+            .filter(|op| op.operator == "Tf")
+            .map(|op| op.operands[1].as_float().unwrap())
+            .collect();
+        sizes.dedup();
+        sizes
+    };
+    assert_eq!(sizes(&default_config()), [5.0, 12.0]);
+    assert_eq!(sizes(&default_config().with_min_font_size(7.0)), [7.0, 12.0]);
+}
+
 // =====================================================================
 // Table layout tests
 // =====================================================================
@@ -368,6 +537,110 @@ fn table_produces_grid_layout() {
     );
 }
 
+#[test]
+fn table_cells_place_content_by_vertical_and_text_align() {
+    let html = "<table style=\"width: 400px\"><tr style=\"vertical-align: bottom\">
+        <td style=\"white-space: pre\">1\n2\n3\n4</td>
+        <td style=\"vertical-align: top\">Top</td>
+        <td style=\"vertical-align: middle; text-align: right\">Middle</td>
+        <td>Bottom</td>
+    </tr></table>";
+    let layout = compute_layout_config(html, &default_config());
+
+    let text_of = |b: &pdf_forge::layout_config::LayoutBox| {
+        b.text
+            .as_ref()
+            .map(|t| t.lines.iter().map(|l| l.text.as_str()).collect::<String>())
+    };
+    let mut middle_cell = None;
+    let mut runs = Vec::new();
+    for page in &layout.pages {
+        for lbox in &page.boxes {
+            visit_box(lbox, &mut |b| {
+                if b.children.iter().any(|c| text_of(c).as_deref() == Some("Middle")) {
+                    middle_cell = Some((b.x, b.width));
+                }
+                if let Some(t) = &b.text {
+                    let text: String = t.lines.iter().map(|l| l.text.as_str()).collect();
+                    runs.push((text, b.x, b.y, b.width, b.height));
+                }
+            });
+        }
+    }
+    let run = |wanted: &str| runs.iter().find(|r| r.0 == wanted).unwrap().clone();
+    let (_, _, tall_y, _, tall_h) = run("1234");
+    let (_, _, top_y, _, line_h) = run("Top");
+    let (_, middle_x, middle_y, middle_w, _) = run("Middle");
+    let (_, _, bottom_y, _, _) = run("Bottom");
+
+    assert!((top_y - tall_y).abs() < 0.5, "{top_y} vs {tall_y}");
+    let centred = tall_y + (tall_h - line_h) / 2.0;
+    assert!((middle_y - centred).abs() < 0.5, "{middle_y} vs {centred}");
+    // The row's `bottom` is inherited by the cell that sets nothing.
+    let bottom = tall_y + tall_h - line_h;
+    assert!((bottom_y - bottom).abs() < 0.5, "{bottom_y} vs {bottom}");
+
+    // `text-align: right` puts the run against the cell's right padding.
+    let (cell_x, cell_w) = middle_cell.unwrap();
+    let right = cell_x + cell_w - 8.0 - 1.0;
+    assert!((middle_x + middle_w - right).abs() < 0.5, "{middle_x} + {middle_w} vs {right}");
+}
+
+#[test]
+fn table_cells_span_columns_and_rows_without_overlapping() {
+    let html = "<table style=\"width: 420px\">
+        <tr><td colspan=\"2\">A</td>
+            <td rowspan=\"2\" style=\"white-space: pre\">B\n2\n3\n4\n5</td></tr>
+        <tr><td>C</td><td>D</td></tr>
+        <tr><td>E</td><td>F</td><td>G</td></tr>
+    </table>";
+    let layout = compute_layout_config(html, &default_config());
+
+    let mut cells = Vec::new();
+    for page in &layout.pages {
+        for lbox in &page.boxes {
+            visit_box(lbox, &mut |b| {
+                for child in &b.children {
+                    if let Some(t) = &child.text {
+                        let text: String = t.lines.iter().map(|l| l.text.as_str()).collect();
+                        cells.push((text, b.x, b.y, b.width, b.height));
+                    }
+                }
+            });
+        }
+    }
+    let cell = |wanted: &str| {
+        let found = cells.iter().find(|c| c.0.starts_with(wanted));
+        found.unwrap_or_else(|| panic!("no cell {wanted}")).clone()
+    };
+    let near = |a: f32, b: f32| (a - b).abs() < 0.5;
+
+    // Three columns: A takes the first two, B the third in two rows.
+    let (_, e_x, e_y, e_w, _) = cell("E");
+    let (_, f_x, _, f_w, _) = cell("F");
+    let (_, g_x, _, g_w, _) = cell("G");
+    let (_, a_x, a_y, a_w, _) = cell("A");
+    let (_, b_x, b_y, b_w, b_h) = cell("B");
+    let (_, c_x, c_y, c_w, c_h) = cell("C");
+    let (_, d_x, _, d_w, _) = cell("D");
+    assert!(near(a_x, e_x) && near(a_w, e_w + f_w), "A {a_x} {a_w}");
+    assert!(near(b_x, g_x) && near(b_w, g_w), "B {b_x} {b_w}");
+    assert!(near(c_x, e_x) && near(d_x, f_x) && near(c_w, e_w) && near(d_w, f_w));
+    assert!(near(b_y, a_y) && c_y > a_y);
+
+    // B's five lines push the rows it spans down; it ends where they do.
+    assert!(near(b_y + b_h, c_y + c_h), "B ends at {} not {}", b_y + b_h, c_y + c_h);
+    assert!(e_y >= b_y + b_h - 0.5, "E at {e_y} under B ending {}", b_y + b_h);
+
+    for (i, one) in cells.iter().enumerate() {
+        for other in &cells[i + 1..] {
+            let overlap_x = (one.1 + one.3).min(other.1 + other.3) - one.1.max(other.1) > 0.5;
+            let overlap_y = (one.2 + one.4).min(other.2 + other.4) - one.2.max(other.2) > 0.5;
+            assert!(!(overlap_x && overlap_y), "{} overlaps {}", one.0, other.0);
+        }
+    }
+}
+
 fn count_boxes(config: &LayoutConfig) -> usize {
     let mut count = 0;
     for page in &config.pages {
@@ -409,6 +682,64 @@ fn image_produces_image_content() {
     assert!(found_image, "Should find image content");
 }
 
+#[test]
+fn canvas_snapshot_renders_as_an_image_in_the_canvas_box() {
+    let png = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==";
+    let canvas =
+        format!(r#"<p>Chart</p><canvas width="200" height="100" data-snapshot="{png}"></canvas>"#);
+    let img = format!(
+        r#"<p>Chart</p><img src="data:image/png;base64,{png}" style="width: 200px; height: 100px" />"#
+    );
+    let image_boxes = |html: &str| {
+        let mut found = Vec::new();
+        for page in &compute_layout_config(html, &default_config()).pages {
+            for lbox in &page.boxes {
+                visit_box(lbox, &mut |b| {
+                    if b.image.is_some() {
+                        found.push((b.x, b.y, b.width, b.height));
+                    }
+                });
+            }
+        }
+        found
+    };
+    let boxes = image_boxes(&canvas);
+    assert_eq!(boxes.len(), 1, "the snapshot should be drawn once");
+    assert_eq!(boxes, image_boxes(&img));
+    assert!(boxes[0].2 > 0.0 && boxes[0].3 > 0.0);
+
+    let pdf = generate(&canvas, &default_config()).unwrap();
+    assert!(pdf.diagnostics.is_empty(), "{:?}", pdf.diagnostics);
+}
+
+#[test]
+fn grayscale_filter_embeds_a_gray_image() {
+    use base64::Engine as _;
+
+    let img = image::RgbImage::from_fn(8, 8, |x, y| image::Rgb([x as u8 * 30, 200, y as u8 * 30]));
+    let mut png = std::io::Cursor::new(Vec::new());
+    img.write_to(&mut png, image::ImageFormat::Png).unwrap();
+    let data = base64::engine::general_purpose::STANDARD.encode(png.into_inner());
+    let html = format!(
+        r#"<img src="data:image/png;base64,{data}" style="width: 80px; height: 80px" />
+        <img src="data:image/png;base64,{data}"
+            style="width: 80px; height: 80px; filter: grayscale(1)" />"#
+    );
+
+    let doc = lopdf::Document::load_mem(&generate(&html, &default_config()).unwrap().bytes)
+        .unwrap();
+    let mut color_spaces: Vec<Vec<u8>> = doc
+        .objects
+        .values()
+        .filter_map(|o| o.as_stream().ok())
+        .filter(|s| s.dict.get(b"Subtype").and_then(lopdf::Object::as_name).ok() == Some(b"Image"))
+        .map(|s| s.dict.get(b"ColorSpace").unwrap().as_name().unwrap().to_vec())
+        .collect();
+    color_spaces.sort();
+    // The same source is embedded twice: as it is, and filtered to gray.
+    assert_eq!(color_spaces, [b"DeviceGray".to_vec(), b"DeviceRGB".to_vec()]);
+}
+
 // =====================================================================
 // List layout tests
 // =====================================================================
@@ -431,6 +762,14 @@ fn ordered_list_layout() {
     assert!(total >= 3, "OL should produce at least 3 boxes");
 }
 
+#[test]
+fn before_pseudo_element_text_renders_ahead_of_each_item() {
+    let html = r#"<style>li::before { content: "• " }</style>
+        <ul><li>Apples</li><li>Pears</li></ul>"#;
+    let lines = text_lines(&compute_layout_config(html, &default_config()));
+    assert_eq!(lines, vec!["• Apples", "• Pears"]);
+}
+
 // =====================================================================
 // All templates render without error
 // =====================================================================
@@ -458,3 +797,764 @@ fn all_templates_render_successfully() {
         assert_valid_pdf(&bytes);
     }
 }
+
+// =====================================================================
+// Stylesheet tests
+// =====================================================================
+
+#[test]
+fn extra_css_overrides_document_styles() {
+    let html = r#"
+        <html><head><style>
+            body { color: #000000 }
+            .notice { display: block; color: #0000ff }
+        </style></head>
+        <body><p>Visible text</p><p class="notice">Draft notice</p></body></html>
+    "#;
+    let config = default_config()
+        .with_extra_css(".notice { display: none }")
+        .with_extra_css("body { color: #ff0000 }");
+    let layout = compute_layout_config(html, &config);
+
+    let mut texts = Vec::new();
+    for page in &layout.pages {
+        for lbox in &page.boxes {
+            visit_box(lbox, &mut |b| {
+                if let Some(t) = &b.text {
+                    for line in &t.lines {
+                        texts.push((line.text.clone(), t.color));
+                    }
+                }
+            });
+        }
+    }
+    assert!(
+        !texts.iter().any(|(t, _)| t.contains("Draft")),
+        "hidden element was rendered: {:?}",
+        texts
+    );
+    let (_, color) = texts
+        .iter()
+        .find(|(t, _)| t == "Visible text")
+        .expect("body text present");
+    assert_eq!(*color, [1.0, 0.0, 0.0, 1.0]);
+}
+
+#[test]
+fn landscape_media_query_applies_only_in_landscape() {
+    let html = r#"
+        <html><head><style>
+            body { color: #000000 }
+            @media print and (orientation: landscape) {
+                body { color: #ff0000 }
+            }
+        </style></head>
+        <body><p>Oriented text</p></body></html>
+    "#;
+    let text_color = |config: &PipelineConfig| {
+        let layout = compute_layout_config(html, config);
+        let mut color = None;
+        for page in &layout.pages {
+            for lbox in &page.boxes {
+                visit_box(lbox, &mut |b| {
+                    if let Some(t) = &b.text {
+                        if t.lines.iter().any(|l| l.text == "Oriented text") {
+                            color = Some(t.color);
+                        }
+                    }
+                });
+            }
+        }
+        color.expect("paragraph present")
+    };
+
+    assert_eq!(text_color(&default_config()), [0.0, 0.0, 0.0, 1.0]);
+    assert_eq!(
+        text_color(&PipelineConfig::a4_landscape()),
+        [1.0, 0.0, 0.0, 1.0]
+    );
+}
+
+#[test]
+fn stylesheet_files_apply_in_order_before_document_styles() {
+    let dir = std::env::temp_dir().join(format!("pdf-forge-css-{}", std::process::id()));
+    std::fs::create_dir_all(dir.join("theme")).unwrap();
+    let base = dir.join("base.css");
+    let theme = dir.join("theme/brand.css");
+    std::fs::write(&base, "p { color: #ff0000 } .note { color: #00ff00 }").unwrap();
+    let brand = "p { color: #0000ff } li { list-style-image: url('dot.png') }";
+    std::fs::write(&theme, brand).unwrap();
+    std::fs::write(dir.join("theme/dot.png"), b"dot").unwrap();
+
+    let html = r#"
+        <html><head><style>.note { color: #000000 }</style></head>
+        <body><p>Plain</p><p class="note">Note</p><ul><li>Item</li></ul></body></html>
+    "#;
+    let config = default_config().with_stylesheet_files(&[&base, &theme]);
+    let layout = compute_layout_config(html, &config);
+    std::fs::remove_dir_all(&dir).unwrap();
+
+    let mut texts = Vec::new();
+    for page in &layout.pages {
+        for lbox in &page.boxes {
+            visit_box(lbox, &mut |b| {
+                if let Some(t) = &b.text {
+                    let text: String = t.lines.iter().map(|l| l.text.as_str()).collect();
+                    texts.push((text, t.color, t.list_marker_image.clone()));
+                }
+            });
+        }
+    }
+    let find = |wanted: &str| texts.iter().find(|(t, _, _)| t == wanted).unwrap();
+    // The second file overrides the first; the document overrides both.
+    assert_eq!(find("Plain").1, [0.0, 0.0, 1.0, 1.0]);
+    assert_eq!(find("Note").1, [0.0, 0.0, 0.0, 1.0]);
+    // `url('dot.png')` resolved against theme/ and inlined.
+    let marker = texts.iter().find_map(|(_, _, m)| m.as_deref());
+    assert_eq!(marker, Some("data:image/png;base64,ZG90"));
+}
+
+#[test]
+fn imported_stylesheets_apply_with_their_media_and_cycles_stop() {
+    let dir = std::env::temp_dir().join(format!("pdf-forge-import-{}", std::process::id()));
+    std::fs::create_dir_all(dir.join("parts")).unwrap();
+    let main = dir.join("main.css");
+    std::fs::write(&main, "@import url(\"parts/colors.css\");\n.lead { font-weight: bold }")
+        .unwrap();
+    // colors.css imports main.css back: the cycle is cut, not followed.
+    let colors = "@import '../main.css';\n@import 'screen.css' screen;\np { color: #00ff00 }";
+    std::fs::write(dir.join("parts/colors.css"), colors).unwrap();
+    std::fs::write(dir.join("parts/screen.css"), "p { color: #ff0000 }").unwrap();
+
+    let html = "<html><body><p>Imported</p></body></html>";
+    let config = default_config().with_stylesheet_files(&[&main]);
+    let layout = compute_layout_config(html, &config);
+    std::fs::remove_dir_all(&dir).unwrap();
+
+    let mut color = None;
+    for page in &layout.pages {
+        for lbox in &page.boxes {
+            visit_box(lbox, &mut |b| {
+                if let Some(t) = &b.text {
+                    if t.lines.iter().any(|l| l.text == "Imported") {
+                        color = Some(t.color);
+                    }
+                }
+            });
+        }
+    }
+    // The imported rule applies; the `screen` import never does.
+    assert_eq!(color, Some([0.0, 1.0, 0.0, 1.0]));
+}
+
+#[test]
+fn economy_backgrounds_are_dropped_unless_print_backgrounds_is_forced() {
+    let html = r#"<div style="background: #ff0000; print-color-adjust: economy">Saver</div>
+        <div style="background: #00ff00">Kept</div>"#;
+    let backgrounds = |config: &PipelineConfig| -> Vec<bool> {
+        compute_layout_config(html, config).pages[0]
+            .boxes
+            .iter()
+            .map(|b| b.background_color.is_some())
+            .collect()
+    };
+    assert_eq!(backgrounds(&default_config()), vec![false, true]);
+    let forced = default_config().with_print_backgrounds(true);
+    assert_eq!(backgrounds(&forced), vec![true, true]);
+}
+
+#[test]
+fn viewport_width_drives_media_queries_and_scales_to_the_page() {
+    let html = r#"<style>
+        #nav { width: 400px; height: 20px }
+        @media (max-width: 600px) { #nav { width: 100% } }
+    </style>
+    <div id="nav"></div>"#;
+    let nav_width = |config: &PipelineConfig| {
+        let tree = layout_tree(html, config).unwrap();
+        let nav = tree.iter().find_map(|b| b.find("nav"));
+        nav.expect("nav box").width
+    };
+    let config = default_config().with_viewport_width(500.0);
+    assert_eq!(nav_width(&config), 500.0);
+    let wide = default_config().with_viewport_width(1024.0);
+    assert_eq!(nav_width(&wide), 400.0);
+
+    let layout = compute_layout_config(html, &config);
+    let scale = layout.viewport_scale.expect("scaled layout");
+    let content_width = config.effective_width() - 2.0 * config.page_margin;
+    assert!((scale * 500.0 - content_width).abs() < 0.01, "{scale}");
+    assert_eq!(layout.page_width_pt, config.effective_width());
+    assert_valid_pdf(&generate(html, &config).unwrap().bytes);
+}
+
+// =====================================================================
+// Writing mode tests
+// =====================================================================
+
+#[test]
+fn vertical_rl_paragraph_lays_out_columns_right_to_left() {
+    let html = r#"<p style="writing-mode: vertical-rl; height: 48px; font-size: 16px">ABCDEFG</p>"#;
+    let layout = compute_layout_config(html, &default_config());
+
+    let mut columns = Vec::new();
+    for page in &layout.pages {
+        for lbox in &page.boxes {
+            visit_box(lbox, &mut |b| {
+                if let Some(t) = &b.text {
+                    columns.extend(t.lines.iter().map(|l| (l.text.clone(), l.x_offset, l.y_offset)));
+                }
+            });
+        }
+    }
+    let texts: Vec<&str> = columns.iter().map(|(t, _, _)| t.as_str()).collect();
+    assert_eq!(texts, vec!["ABC", "DEF", "G"]);
+    assert!(columns.windows(2).all(|w| w[1].1 < w[0].1), "{columns:?}");
+    assert!(columns.iter().all(|c| c.2 == 0.0));
+}
+
+// =====================================================================
+// Strict mode tests
+// =====================================================================
+
+#[test]
+fn strict_mode_fails_on_missing_image_while_lenient_succeeds() {
+    let html = r#"<p>Logo:</p><img src="logo.png" style="width:50px; height:50px" />"#;
+
+    let lenient = generate(html, &default_config()).expect("lenient mode renders");
+    assert_eq!(&lenient.bytes[0..5], b"%PDF-");
+    assert!(
+        lenient.diagnostics.iter().any(|d| d.message.contains("Skipping image")),
+        "diagnostics: {:?}",
+        lenient.diagnostics
+    );
+
+    let err = generate(html, &default_config().with_strict_mode(true)).unwrap_err();
+    assert!(err.starts_with("Strict mode"), "unexpected error: {err}");
+    assert!(err.contains("logo.png"), "error should list the diagnostic: {err}");
+}
+
+#[test]
+fn fail_on_missing_assets_rejects_broken_images_but_tolerates_css_warnings() {
+    let config = default_config().with_fail_fast_on_missing_assets(true);
+
+    let html = r#"<p>Logo:</p><img src="logo.png" style="width:50px; height:50px" />"#;
+    let err = generate(html, &config).unwrap_err();
+    assert!(err.starts_with("Missing assets"), "unexpected error: {err}");
+    assert!(err.contains("logo.png"), "error should name the asset: {err}");
+
+    let html = r#"<style>@font-face { font-family: X }</style>
+        <p style="transform: translate(50%)">Unsupported CSS only</p>"#;
+    let generated = generate(html, &config).expect("CSS warnings are tolerated");
+    assert_eq!(&generated.bytes[0..5], b"%PDF-");
+    assert!(generated.diagnostics.len() >= 2, "{:?}", generated.diagnostics);
+    assert!(generated.diagnostics.iter().all(|d| !d.missing_asset));
+}
+
+// =====================================================================
+// White-space tests
+// =====================================================================
+
+fn text_lines(layout: &LayoutConfig) -> Vec<String> {
+    let mut lines = Vec::new();
+    for page in &layout.pages {
+        for lbox in &page.boxes {
+            visit_box(lbox, &mut |b| {
+                if let Some(t) = &b.text {
+                    lines.extend(t.lines.iter().map(|l| l.text.clone()));
+                }
+            });
+        }
+    }
+    lines
+}
+
+#[test]
+fn pre_block_preserves_spaces_and_line_breaks() {
+    let html = "<pre>\nfn main() {\n    let  x = 1;\n\n\tprint(x);\n}\n</pre><p>Collapsed    text\n here</p>";
+    let lines = text_lines(&compute_layout_config(html, &default_config()));
+    assert_eq!(
+        lines,
+        vec![
+            "fn main() {",
+            "    let  x = 1;",
+            "",
+            "        print(x);",
+            "}",
+            "Collapsed text here",
+        ]
+    );
+}
+
+#[test]
+fn text_overflow_ellipsis_cuts_a_nowrap_line_to_the_box_width() {
+    let html = r#"<div style="width: 100px; white-space: nowrap; overflow: hidden;
+        text-overflow: ellipsis">A label far too long for its narrow column</div>
+        <div class="truncate" style="width: 100px">Short</div>"#;
+    let layout = compute_layout_config(html, &default_config());
+    let lines = text_lines(&layout);
+    let cut = &lines[0];
+    assert!(cut.starts_with("A label") && cut.ends_with('\u{2026}'), "{cut}");
+    let fonts = pdf_forge::fonts::FontManager::default();
+    let width = fonts.measure_text_width(cut, 16.0, false, false, "Helvetica");
+    assert!(width <= 100.0, "{cut} is {width}pt wide");
+    // A line that fits is left alone.
+    assert_eq!(lines[1], "Short");
+}
+
+#[test]
+fn overflow_wrap_anywhere_breaks_a_long_string_across_lines() {
+    let token = "0x3f9a7c2e81b4d05f6a93c7e28b1d40f5";
+    let html = format!(
+        r#"<div style="width: 80px">{token}</div>
+        <div style="width: 80px; overflow-wrap: anywhere">{token}</div>
+        <div style="width: 80px; word-break: break-all">id {token}</div>"#
+    );
+    let lines = text_lines(&compute_layout_config(&html, &default_config()));
+    // Without a break opportunity the string overflows on one line.
+    assert_eq!(lines[0], token);
+    let broken: Vec<_> = lines[1..].iter().take_while(|l| !l.starts_with("id")).collect();
+    assert!(broken.len() > 1, "{lines:?}");
+    assert_eq!(broken.iter().map(|l| l.as_str()).collect::<String>(), token);
+    let fonts = pdf_forge::fonts::FontManager::default();
+    for line in &lines[1..] {
+        let width = fonts.measure_text_width(line, 16.0, false, false, "Helvetica");
+        assert!(width <= 80.0, "{line} is {width}pt wide");
+    }
+    // `break-all` fills the first line rather than moving the string down.
+    let rest = &lines[1 + broken.len()..];
+    assert!(rest[0].starts_with("id 0x"), "{rest:?}");
+}
+
+// =====================================================================
+// Multi-column tests
+// =====================================================================
+
+#[test]
+fn column_count_two_flows_text_into_side_by_side_columns() {
+    let paragraph = "Local news and events from around the neighbourhood this week. ";
+    let html = format!(
+        r#"<div style="column-count: 2; column-gap: 20px">
+            <p>First {p}</p><p>Second {p}</p><p>Third {p}</p><p>Fourth {p}</p>
+        </div>"#,
+        p = paragraph.repeat(3)
+    );
+    let layout = compute_layout_config(&html, &default_config());
+
+    let mut runs: Vec<(f32, String)> = Vec::new();
+    for page in &layout.pages {
+        for lbox in &page.boxes {
+            visit_box(lbox, &mut |b| {
+                if let Some(t) = &b.text {
+                    runs.extend(t.lines.iter().map(|l| (b.x + l.x_offset, l.text.clone())));
+                }
+            });
+        }
+    }
+    // Content width 515.28 pt split into two 247.64 pt columns 20 pt apart.
+    let (left, right): (Vec<_>, Vec<_>) = runs.iter().partition(|(x, _)| *x < 300.0);
+    assert!(!left.is_empty() && !right.is_empty(), "{runs:?}");
+    assert!(left.iter().all(|(x, _)| (*x - 40.0).abs() < 0.5), "{left:?}");
+    assert!(right.iter().all(|(x, _)| (*x - 307.64).abs() < 0.5), "{right:?}");
+    assert!(left[0].1.starts_with("First"));
+    assert!(right.iter().any(|(_, t)| t.starts_with("Fourth")));
+    // Balanced: the columns differ by at most a paragraph break.
+    assert!(left.len().abs_diff(right.len()) <= 2, "{} vs {}", left.len(), right.len());
+}
+
+// =====================================================================
+// Document metadata tests
+// =====================================================================
+
+#[test]
+fn read_metadata_returns_the_written_title_and_page_count() {
+    let html = r#"<p>One</p><p class="break-before">Two</p>"#;
+    let config = PipelineConfig {
+        title: "Quarterly Report".into(),
+        ..default_config()
+    };
+    let pdf = generate(html, &config).unwrap();
+    let metadata = read_metadata(&pdf.bytes).unwrap();
+    assert_eq!(metadata.title.as_deref(), Some("Quarterly Report"));
+    assert_eq!(metadata.page_count, pdf.layout.pages.len());
+    assert_eq!(metadata.page_count, 2);
+
+    let stripped = generate(html, &config.without_metadata()).unwrap();
+    let metadata = read_metadata(&stripped.bytes).unwrap();
+    assert_eq!(metadata.title, None);
+    assert_eq!(metadata.creation_date, None);
+    assert_eq!(metadata.page_count, 2);
+}
+
+#[test]
+fn producer_and_creator_replace_the_library_defaults() {
+    let html = "<p>White label</p>";
+    let default = read_metadata(&generate(html, &default_config()).unwrap().bytes).unwrap();
+    let config = default_config()
+        .with_producer("Acme Reports")
+        .with_creator("Acme Portal – Ümlaut");
+    let pdf = generate(html, &config).unwrap();
+    let metadata = read_metadata(&pdf.bytes).unwrap();
+    assert_eq!(metadata.producer.as_deref(), Some("Acme Reports"));
+    assert_ne!(metadata.producer, default.producer);
+    assert_eq!(metadata.creator.as_deref(), Some("Acme Portal – Ümlaut"));
+    assert_eq!(metadata.title.as_deref(), Some("rpdf output"));
+}
+
+#[test]
+fn title_from_first_heading_applies_only_without_an_explicit_title() {
+    let html = "<p>Intro</p><h1>Report</h1><h1>Appendix</h1>";
+    let config = default_config().with_title_from_first_heading(true);
+    let pdf = generate(html, &config).unwrap();
+    let metadata = read_metadata(&pdf.bytes).unwrap();
+    assert_eq!(metadata.title.as_deref(), Some("Report"));
+
+    let explicit = PipelineConfig {
+        title: "Quarterly Report".into(),
+        ..config
+    };
+    let pdf = generate(html, &explicit).unwrap();
+    let metadata = read_metadata(&pdf.bytes).unwrap();
+    assert_eq!(metadata.title.as_deref(), Some("Quarterly Report"));
+}
+
+#[test]
+fn page_mode_is_written_to_the_catalog() {
+    use pdf_forge::layout_config::PageMode;
+
+    let page_mode = |config: &PipelineConfig| {
+        let pdf = generate("<p>Contents</p>", config).unwrap().bytes;
+        let doc = lopdf::Document::load_mem(&pdf).unwrap();
+        let catalog = doc.catalog().unwrap();
+        let mode = catalog.get(b"PageMode").ok()?.as_name().ok()?;
+        Some(String::from_utf8_lossy(mode).into_owned())
+    };
+    // Readers treat a missing entry as `UseNone`.
+    assert_eq!(page_mode(&default_config()), None);
+    let thumbs = default_config().with_page_mode(PageMode::UseThumbs);
+    assert_eq!(page_mode(&thumbs).as_deref(), Some("UseThumbs"));
+}
+
+// =====================================================================
+// Margin box tests
+// =====================================================================
+
+#[test]
+fn margin_selectors_move_elements_out_of_flow_onto_every_page() {
+    let body = r#"<p>Page one</p><div class="break-before">Page two</div>"#;
+    let html = format!(
+        r#"<style>[data-pdf-footer] {{ font-size: 8px }}</style>
+        <div data-pdf-header>Acme Corp</div>{body}<div data-pdf-footer>Confidential</div>"#
+    );
+    let config = default_config().with_margin_selectors("[data-pdf-header]", "[data-pdf-footer]");
+    let layout = compute_layout_config(&html, &config);
+    let plain = compute_layout_config(body, &default_config());
+    assert_eq!(layout.pages.len(), 2);
+    let top_margin = config.page_margin;
+    let bottom_margin = config.effective_height() - config.page_margin;
+    for (page, plain_page) in layout.pages.iter().zip(&plain.pages) {
+        let lines = page_lines(page);
+        let at = |text: &str| -> Vec<f32> {
+            let found = lines.iter().filter(|(_, t)| t == text);
+            found.map(|&(y, _)| y).collect()
+        };
+        let (header, footer) = (at("Acme Corp"), at("Confidential"));
+        assert!(header.len() == 1 && header[0] < top_margin, "{lines:?}");
+        assert!(footer.len() == 1 && footer[0] > bottom_margin, "{lines:?}");
+        // The content sits where it would without the two elements.
+        let mut content = lines.clone();
+        content.retain(|(_, t)| t.starts_with("Page"));
+        assert_eq!(content, page_lines(plain_page));
+    }
+}
+
+#[test]
+fn fixed_header_height_reserves_an_exact_band_and_clips_overflow() {
+    let html = r#"<div data-pdf-header><p>Acme Corp</p><p>Second line</p></div><p>Body</p>"#;
+    let config = default_config()
+        .with_margin_selectors("[data-pdf-header]", "")
+        .with_header_height(20.0);
+    let layout = compute_layout_config(html, &config);
+    let page = &layout.pages[0];
+    let lines = page_lines(page);
+    let body = lines.iter().find(|(_, t)| t == "Body").unwrap();
+    assert_eq!(body.0, config.page_margin + 20.0, "{lines:?}");
+    // The header sits in a band clipped to exactly the reserved height.
+    let band = &page.boxes[0];
+    assert!(band.clip_path.is_some());
+    assert_eq!((band.y, band.height), (config.page_margin, 20.0));
+    assert!(lines.iter().any(|(_, t)| t == "Acme Corp"), "{lines:?}");
+}
+
+/// `(y, text)` of every text line on `page`.
+fn page_lines(page: &pdf_forge::layout_config::PageLayout) -> Vec<(f32, String)> {
+    let mut lines = Vec::new();
+    for lbox in &page.boxes {
+        visit_box(lbox, &mut |b| {
+            if let Some(t) = &b.text {
+                lines.extend(t.lines.iter().map(|l| (b.y, l.text.clone())));
+            }
+        });
+    }
+    lines
+}
+
+// =====================================================================
+// Positioning and visibility tests
+// =====================================================================
+
+#[test]
+fn aspect_ratio_sizes_the_auto_dimension() {
+    let html = r#"<div id="media" style="width: 100px; aspect-ratio: 2/1"></div><p>After</p>"#;
+    let tree = layout_tree(html, &default_config()).unwrap();
+    let media = tree.iter().find_map(|b| b.find("media")).unwrap();
+    assert_eq!((media.width, media.height), (100.0, 50.0));
+    // The box takes up its height in the flow.
+    let after = tree.iter().find(|b| b.tag.as_deref() == Some("p")).unwrap();
+    assert_eq!(after.y, media.y + 50.0);
+}
+
+#[test]
+fn absolute_boxes_are_placed_against_the_nearest_positioned_ancestor() {
+    let html = r#"
+        <div style="height: 40px"></div>
+        <div id="card" style="position: relative; margin-left: 30px; width: 200px; height: 100px">
+          <div>
+            <div id="badge" style="position: absolute; top: 10px; right: 10px; width: 20px; height: 20px"></div>
+          </div>
+        </div>
+        <p>After</p>"#;
+    let tree = layout_tree(html, &default_config()).unwrap();
+    let card = tree.iter().find_map(|b| b.find("card")).unwrap();
+    let badge = card.find("badge").unwrap();
+    assert_eq!(badge.x, card.x + 200.0 - 10.0 - 20.0);
+    assert_eq!(badge.y, card.y + 10.0);
+    // The badge takes no room in the flow.
+    let after = tree.iter().find(|b| b.tag.as_deref() == Some("p")).unwrap();
+    assert_eq!(after.y, card.y + 100.0);
+}
+
+#[test]
+fn hidden_boxes_keep_their_space_while_display_none_does_not() {
+    let after_y = |html: &str| {
+        let tree = layout_tree(html, &default_config()).unwrap();
+        tree.iter().find_map(|b| b.find("after")).unwrap().y
+    };
+    let hidden = after_y(
+        r#"<div style="visibility: hidden; height: 50px">Hidden</div><p id="after">After</p>"#,
+    );
+    let none =
+        after_y(r#"<div style="display: none; height: 50px">Gone</div><p id="after">After</p>"#);
+    assert_eq!(hidden, none + 50.0);
+
+    // The hidden box paints nothing, but a visible descendant still does.
+    let html = r#"<div style="visibility: hidden">Hidden <b style="visibility: visible">Shown</b></div>"#;
+    let config = compute_layout_config(html, &default_config());
+    fn texts(b: &pdf_forge::layout_config::LayoutBox, out: &mut Vec<String>) {
+        if let Some(t) = &b.text {
+            out.extend(t.lines.iter().map(|l| l.text.clone()));
+        }
+        b.children.iter().for_each(|c| texts(c, out));
+    }
+    let mut painted = Vec::new();
+    config.pages.iter().flat_map(|p| &p.boxes).for_each(|b| texts(b, &mut painted));
+    assert!(painted.iter().all(|t| !t.contains("Hidden")), "{painted:?}");
+    assert!(painted.iter().any(|t| t.contains("Shown")), "{painted:?}");
+
+    // `visibility: collapse` removes a table row like `display: none`.
+    let rows = |row_style: &str| {
+        let html = format!(
+            r#"<table><tr><td>One</td></tr><tr style="{row_style}"><td>Two</td></tr></table>
+            <p id="after">After</p>"#
+        );
+        after_y(&html)
+    };
+    assert_eq!(rows("visibility: collapse"), rows("display: none"));
+    assert!(rows("visibility: hidden") > rows("visibility: collapse"));
+}
+
+#[test]
+fn closed_details_are_printed_expanded() {
+    let html = r#"<details><summary>Terms</summary><p>Payment is due in 30 days.</p></details>"#;
+    let layout = compute_layout_config(html, &default_config());
+    let lines = page_lines(&layout.pages[0]);
+    let texts: Vec<&str> = lines.iter().map(|(_, t)| t.as_str()).collect();
+    assert_eq!(texts, ["Terms", "Payment is due in 30 days."]);
+    assert!(lines[0].0 < lines[1].0);
+}
+
+// =====================================================================
+// Link and destination tests
+// =====================================================================
+
+#[test]
+fn bare_urls_become_link_annotations_only_with_auto_link() {
+    let html = "<p>Read the docs at https://example.com/docs.</p>";
+    let link_uris = |config: &PipelineConfig| -> Vec<String> {
+        let doc = lopdf::Document::load_mem(&generate(html, config).unwrap().bytes).unwrap();
+        let page = doc.get_dictionary(doc.get_pages()[&1]).unwrap();
+        let Ok(annots) = page.get(b"Annots") else {
+            return Vec::new();
+        };
+        let uri = |annot: &lopdf::Object| {
+            let annot = doc.get_dictionary(annot.as_reference().unwrap()).unwrap();
+            let action = annot.get(b"A").unwrap().as_dict().unwrap();
+            String::from_utf8_lossy(action.get(b"URI").unwrap().as_str().unwrap()).into_owned()
+        };
+        annots.as_array().unwrap().iter().map(uri).collect()
+    };
+    assert!(link_uris(&default_config()).is_empty());
+    let linked = default_config().with_auto_link(true);
+    assert_eq!(link_uris(&linked), vec!["https://example.com/docs"]);
+}
+
+#[test]
+fn element_ids_become_named_destinations_on_their_page() {
+    let html = r#"<p>Cover</p><h2 id="intro" class="break-before">Introduction</h2>"#;
+    let config = default_config().with_named_destinations(true);
+    let doc = lopdf::Document::load_mem(&generate(html, &config).unwrap().bytes).unwrap();
+    let names = doc.catalog().unwrap().get(b"Names").unwrap().as_dict().unwrap();
+    let tree = doc.get_dictionary(names.get(b"Dests").unwrap().as_reference().unwrap()).unwrap();
+    let entries = tree.get(b"Names").unwrap().as_array().unwrap();
+    assert_eq!(entries[0].as_str().unwrap(), b"intro");
+    let dest = entries[1].as_array().unwrap();
+    assert_eq!(dest[0].as_reference().unwrap(), doc.get_pages()[&2]);
+    assert_eq!(dest[1].as_name().unwrap(), b"XYZ");
+
+    let plain = lopdf::Document::load_mem(&generate(html, &default_config()).unwrap().bytes);
+    assert!(plain.unwrap().catalog().unwrap().get(b"Names").is_err());
+}
+
+// =====================================================================
+// Attachment tests
+// =====================================================================
+
+#[test]
+fn page_attachment_is_listed_in_its_pages_af_array() {
+    use pdf_forge::layout_config::AfRelationship;
+
+    let html = r#"<p>Summary</p><p class="break-before">Chart</p>"#;
+    let csv = b"month,total\nJan,12\n".to_vec();
+    let config =
+        default_config().with_page_attachment(2, "chart.csv", csv.clone(), AfRelationship::Data);
+    let doc = lopdf::Document::load_mem(&generate(html, &config).unwrap().bytes).unwrap();
+    let pages = doc.get_pages();
+    assert!(doc.get_dictionary(pages[&1]).unwrap().get(b"AF").is_err());
+
+    let af = doc.get_dictionary(pages[&2]).unwrap().get(b"AF").unwrap().as_array().unwrap();
+    assert_eq!(af.len(), 1);
+    let spec = doc.get_dictionary(af[0].as_reference().unwrap()).unwrap();
+    assert_eq!(spec.get(b"Type").unwrap().as_name().unwrap(), b"Filespec");
+    assert_eq!(spec.get(b"F").unwrap().as_str().unwrap(), b"chart.csv");
+    assert_eq!(spec.get(b"AFRelationship").unwrap().as_name().unwrap(), b"Data");
+    let ef = spec.get(b"EF").unwrap().as_dict().unwrap();
+    let file = doc.get_object(ef.get(b"F").unwrap().as_reference().unwrap()).unwrap();
+    assert_eq!(file.as_stream().unwrap().get_plain_content().unwrap(), csv);
+
+    let missing = default_config().with_page_attachment(3, "x.csv", csv, AfRelationship::Data);
+    let err = generate(html, &missing).unwrap_err();
+    assert!(err.contains("no page 3"), "{err}");
+}
+
+// =====================================================================
+// Inspection tests
+// =====================================================================
+
+#[test]
+fn page_to_svg_converts_a_generated_page() {
+    let html = r#"<div style="background: #336699; height: 40px"></div><p>Hello preview</p>"#;
+    let pdf = generate(html, &default_config()).unwrap().bytes;
+    let svg = page_to_svg(&pdf, 1).unwrap();
+    assert!(svg.starts_with("<svg "), "not an SVG document: {svg}");
+    assert!(svg.trim_end().ends_with("</svg>"));
+    assert!(
+        svg.contains(r#"fill="rgb(51,102,153)""#),
+        "background missing: {svg}"
+    );
+    assert!(svg.contains("Hello"), "text missing: {svg}");
+    assert!(page_to_svg(&pdf, 2).is_err());
+}
+
+// =====================================================================
+// Event tests
+// =====================================================================
+
+#[test]
+fn event_sink_reports_each_image_load_with_its_url_and_duration() {
+    use base64::Engine as _;
+    use pdf_forge::events::EventLog;
+    use std::sync::Arc;
+
+    let png = |shade: u8| {
+        let img = image::GrayImage::from_pixel(2, 2, image::Luma([shade]));
+        let mut png = std::io::Cursor::new(Vec::new());
+        img.write_to(&mut png, image::ImageFormat::Png).unwrap();
+        let data = base64::engine::general_purpose::STANDARD.encode(png.into_inner());
+        format!("data:image/png;base64,{data}")
+    };
+    let (dark, light) = (png(40), png(220));
+    let html = format!(r#"<p>Logos</p><img src="{dark}" /><img src="{light}" />"#);
+    let log = Arc::new(EventLog::default());
+    let config = default_config().with_event_sink(log.clone());
+    generate(&html, &config).unwrap();
+
+    let events = log.events();
+    let loaded: Vec<&str> = events
+        .iter()
+        .filter(|e| e.duration.is_some())
+        .filter_map(|e| e.resource.as_deref())
+        .collect();
+    assert_eq!(loaded.len(), 2, "{events:?}");
+    assert_ne!(loaded[0], loaded[1]);
+    let summarised = |r: &&str| r.starts_with("data:image/png;base64,sha256=");
+    assert!(loaded.iter().all(summarised));
+    let layout = events.iter().find(|e| e.phase == "layout");
+    assert!(layout.is_some_and(|e| e.duration.is_some()));
+    assert!(
+        events.iter().all(|e| e.to_json().starts_with('{')),
+        "{events:?}"
+    );
+}
+
+// =====================================================================
+// Output limit tests
+// =====================================================================
+
+/// `<img>`s of noise, which barely compress losslessly.
+fn noisy_images_html(count: u32) -> String {
+    use base64::Engine as _;
+    let mut seed = 7u32;
+    let mut html = String::new();
+    for _ in 0..count {
+        let img = image::RgbImage::from_fn(160, 160, |_, _| {
+            seed = seed.wrapping_mul(1_664_525).wrapping_add(1_013_904_223);
+            let [r, g, b, _] = seed.to_be_bytes();
+            image::Rgb([r, g, b])
+        });
+        let mut png = std::io::Cursor::new(Vec::new());
+        img.write_to(&mut png, image::ImageFormat::Png).unwrap();
+        let data = base64::engine::general_purpose::STANDARD.encode(png.into_inner());
+        html.push_str(&format!(
+            r#"<img src="data:image/png;base64,{data}" style="width: 160px; height: 160px" />"#
+        ));
+    }
+    html
+}
+
+#[test]
+fn max_output_bytes_fails_or_recompresses_images_to_fit() {
+    let html = noisy_images_html(4);
+    let full = generate(&html, &default_config()).unwrap().bytes.len() as u64;
+    let cap = full / 3;
+
+    let err = generate(&html, &default_config().with_max_output_bytes(cap, false)).unwrap_err();
+    assert!(err.starts_with(pdf_forge::pipeline::OUTPUT_TOO_LARGE), "{err}");
+
+    let fitted = generate(&html, &default_config().with_max_output_bytes(cap, true)).unwrap();
+    assert!(fitted.bytes.len() as u64 <= cap, "{} > {cap}", fitted.bytes.len());
+    assert_valid_pdf(&fitted.bytes);
+
+    // A limit nothing can meet still fails after trying.
+    let err = generate(&html, &default_config().with_max_output_bytes(100, true)).unwrap_err();
+    assert!(err.starts_with(pdf_forge::pipeline::OUTPUT_TOO_LARGE), "{err}");
+}
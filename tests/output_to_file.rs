@@ -0,0 +1,105 @@
+//! Peak memory of writing a large PDF to a file.
+//!
+//! Tracks the high-water mark of live heap bytes with a counting global
+//! allocator, as `benches/streaming_input.rs` does, so it lives in its own
+//! test binary where no other test allocates alongside it.
+
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+use pdf_forge::layout_config::AfRelationship;
+use pdf_forge::pipeline::{generate, generate_to_file, PipelineConfig};
+
+struct Counting;
+
+static LIVE: AtomicUsize = AtomicUsize::new(0);
+static PEAK: AtomicUsize = AtomicUsize::new(0);
+
+fn grow(size: usize) {
+    let live = LIVE.fetch_add(size, Ordering::Relaxed) + size;
+    PEAK.fetch_max(live, Ordering::Relaxed);
+}
+
+unsafe impl GlobalAlloc for Counting {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        grow(layout.size());
+        System.alloc(layout)
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        LIVE.fetch_sub(layout.size(), Ordering::Relaxed);
+        System.dealloc(ptr, layout)
+    }
+
+    unsafe fn realloc(&self, ptr: *mut u8, layout: Layout, new_size: usize) -> *mut u8 {
+        if new_size > layout.size() {
+            grow(new_size - layout.size());
+        } else {
+            LIVE.fetch_sub(layout.size() - new_size, Ordering::Relaxed);
+        }
+        System.realloc(ptr, layout, new_size)
+    }
+}
+
+#[global_allocator]
+static ALLOCATOR: Counting = Counting;
+
+/// Live heap bytes at the high-water mark of `f`, above those live before.
+fn peak_of<T>(f: impl FnOnce() -> T) -> (T, usize) {
+    let before = LIVE.load(Ordering::Relaxed);
+    PEAK.store(before, Ordering::Relaxed);
+    let result = f();
+    (result, PEAK.load(Ordering::Relaxed) - before)
+}
+
+/// `len` bytes that do not compress, so an attachment stays its own size.
+fn noise(len: usize) -> Vec<u8> {
+    let mut state = 0x2545_f491_4f6c_dd1d_u64;
+    (0..len)
+        .map(|_| {
+            state ^= state << 13;
+            state ^= state >> 7;
+            state ^= state << 17;
+            state as u8
+        })
+        .collect()
+}
+
+#[test]
+fn generate_to_file_does_not_buffer_the_patched_pdf() {
+    const FILES: usize = 16;
+    const FILE_SIZE: usize = 2 << 20;
+    let html = "<h1>Ledger</h1><p>The data is attached to this page.</p>";
+    // Attachments are added by lopdf after printpdf has saved the page, so
+    // only the patched document is as large as the file.  Many small ones
+    // keep compressing each from outweighing saving them all.
+    let config = (0..FILES).fold(PipelineConfig::default(), |config, i| {
+        let name = format!("ledger-{i}.bin");
+        config.with_page_attachment(1, &name, noise(FILE_SIZE), AfRelationship::Data)
+    });
+    let path = std::env::temp_dir().join(format!("pdf-forge-peak-{}.pdf", std::process::id()));
+
+    let (in_memory, buffered_peak) = peak_of(|| generate(html, &config).unwrap().bytes);
+    let (written, streamed_peak) = peak_of(|| generate_to_file(html, &path, &config).unwrap());
+    let bytes = std::fs::read(&path).unwrap();
+    std::fs::remove_file(&path).unwrap();
+    // A size limit is checked by counting the bytes, not by saving them.
+    let limited = config.clone().with_max_output_bytes(u64::MAX / 2, false);
+    let (_, limited_peak) = peak_of(|| generate_to_file(html, &path, &limited).unwrap());
+    let limited_bytes = std::fs::read(&path).unwrap();
+    std::fs::remove_file(&path).unwrap();
+
+    let total = FILES * FILE_SIZE;
+    assert!(bytes.len() > total);
+    assert_eq!(written, bytes.len() as u64);
+    assert_eq!(bytes, in_memory);
+    assert!(
+        streamed_peak + total / 2 < buffered_peak,
+        "writing to a file peaked at {streamed_peak} bytes, in memory at {buffered_peak}"
+    );
+    assert_eq!(limited_bytes, in_memory);
+    assert!(
+        limited_peak + total / 2 < buffered_peak,
+        "writing under a size limit peaked at {limited_peak} bytes, in memory at {buffered_peak}"
+    );
+}